@@ -0,0 +1,336 @@
+package rawcon
+
+import (
+	"net"
+	"time"
+
+	"github.com/biotooff/rawcon/utils"
+)
+
+// doRead runs the listener on the packets next returns until one carries a
+// datagram for b, which it returns with the address of its peer.
+func (listener *RAWListener) doRead(b []byte, next func() listenPacket) (n int, addr net.Addr, err error) {
+	r := listener.r
+	for {
+		p := next()
+		seg, ok := p.segment()
+		if !ok {
+			if p.err != nil {
+				return 0, nil, p.err
+			}
+			continue
+		}
+		if !listener.ownsPeer(seg.src.IP, seg.src.Port) {
+			continue
+		}
+		uaddr := seg.src
+		addrstr := uaddr.String()
+		if seg.rst || seg.fin {
+			if seg.rst && !listener.rstInWindow(addrstr, seg.seq) {
+				continue
+			}
+			listener.endPassthrough(addrstr)
+			var known bool
+			listener.mutex.run(func() {
+				_, known = listener.conns[addrstr]
+				err = listener.closeConnByAddr(addrstr)
+			})
+			if err != nil {
+				return
+			}
+			if known && seg.rst {
+				r.event(EventReset, uaddr)
+			}
+			continue
+		}
+		if p.err != nil {
+			return 0, nil, p.err
+		}
+		addr = uaddr
+		if listener.passthrough(addrstr, seg.seq, seg.payload) {
+			continue
+		}
+		var info *connInfo
+		listener.mutex.read(func() {
+			info, ok = listener.conns[addrstr]
+		})
+		if !ok {
+			listener.mutex.run(func() {
+				if info, ok = listener.conns[addrstr]; !ok {
+					info, ok = listener.rebind(segmentIDOf(seg.tcp), seg.seq, seg.n, uaddr)
+				}
+			})
+		}
+		if ok {
+			info.touch()
+			plain := seg.ack && !seg.syn && !seg.fin && !seg.rst
+			probe, err := listener.peerWindowProbe(info, plain, seg.seq, seg.n, seg.window)
+			if err != nil {
+				return 0, nil, err
+			}
+			if probe {
+				continue
+			}
+		}
+		n = seg.n
+		if ok && n != 0 {
+			layer := info.layer
+			// the writes to the peer read it from other goroutines
+			info.lock.Lock()
+			if uint64(seg.seq)+uint64(n) > uint64(layer.ack()) {
+				layer.setAck(seg.seq + uint32(n))
+			}
+			info.lock.Unlock()
+			if info.u2r != nil {
+				if rep := info.u2r.serverHandshake(seg.payload); rep != nil {
+					if _, err = listener.writeInfo(rep, info); err != nil {
+						return
+					}
+					continue
+				}
+				typ, data, ok := info.u2r.open(seg.payload)
+				if !ok {
+					continue
+				}
+				if typ == udp2rawHeartbeat {
+					hb := info.u2r.sealLocked(udp2rawHeartbeat, nil)
+					_, err = listener.writeInfo(hb, info)
+					utils.PutBuf(hb)
+					if err != nil {
+						return
+					}
+					continue
+				}
+				if n, ok = listener.deliver(b, info.addr, data); !ok {
+					continue
+				}
+				return n, info.addr, nil
+			}
+			if info.state == httprepsent && seg.psh && seg.ack {
+				if info.hs.covers(seg.seq) && n > 20 {
+					if r.isRequest(seg.payload) {
+						// the request again, the reply was lost; a resumed
+						// session has writers to the peer
+						info.lock.Lock()
+						layer.setAck(seg.seq + uint32(n))
+						_, err = listener.writeWithLayer(info.rep, layer)
+						info.lock.Unlock()
+						if err != nil {
+							return
+						}
+					}
+				} else {
+					info.lock.Lock()
+					layer.setSeq(layer.seq() + uint32(len(info.rep)))
+					info.lock.Unlock()
+					info.rep = nil
+					info.state = established
+				}
+			}
+			if info.state == established {
+				if !seg.psh {
+					if err = listener.answerChatter(info, seg.payload); err != nil {
+						return
+					}
+					continue
+				}
+				if info.hs.covers(seg.seq) {
+					// the request again
+					continue
+				}
+				var payload []byte
+				if payload, ok = info.openSegment(seg.payload); !ok {
+					continue
+				}
+				if n, ok = listener.deliver(b, info.addr, payload); !ok {
+					continue
+				}
+				listener.trySendAck(layer)
+				return n, info.addr, nil
+			}
+			continue
+		}
+		if ok && n == 0 {
+			if val, ecr, ts := timestampsOf(seg.tcp); ts && ecr == 0 {
+				// a probe of the round trip time
+				if err = listener.answerRTTProbe(info, val); err != nil {
+					return
+				}
+				continue
+			}
+			if seg.psh && seg.ack {
+				return
+			}
+			continue
+		}
+		listener.mutex.read(func() {
+			info, ok = listener.newcons[addrstr]
+		})
+		if ok {
+			info.touch()
+			layer := info.layer
+			switch listenStep(info.state, seg.hsSegment) {
+			case listenAcked:
+				layer.setSeq(layer.seq() + 1)
+				listener.scalePeerWindow(info)
+				if info.state = r.ackedState(); info.state == established {
+					listener.mutex.run(func() {
+						listener.conns[addrstr] = info
+						delete(listener.newcons, addrstr)
+					})
+				}
+			case listenSyn:
+				if err = listener.sendPeerSynAck(info); err != nil {
+					return
+				}
+			case listenEarly:
+				info.holdEarly(seg.payload)
+			case listenRequest:
+				req := r.parseRequest(seg.payload, uaddr)
+				if info.takeRequest(req, seg.seq, n) {
+					layer.setAck(seg.seq + uint32(n))
+					early := info.takeEarly()
+					fresh := info
+					if info = listener.bindSession(info, addrstr, req.token); info == nil {
+						continue
+					}
+					// the connection of a resumed session has writers
+					info.lock.Lock()
+					_, err = listener.writeWithLayer(info.rep, info.layer)
+					info.lock.Unlock()
+					if err != nil {
+						return
+					}
+					info.state = httprepsent
+					listener.mutex.run(func() {
+						listener.conns[addrstr] = info
+						delete(listener.newcons, addrstr)
+						if info != fresh {
+							// the old flow of the session leaves the filter
+							listener.updateFilter()
+						}
+					})
+					if n, ok = listener.releaseEarly(b, info, early); ok {
+						// the data has the peer past the request already
+						info.lock.Lock()
+						info.layer.setSeq(info.layer.seq() + uint32(len(info.rep)))
+						info.lock.Unlock()
+						info.rep = nil
+						info.state = established
+						return n, info.addr, nil
+					}
+				} else if listener.startPassthrough(info, addrstr, seg.seq, seg.payload) {
+					continue
+				} else if r.isWebRequest(seg.payload) {
+					layer.setAck(seg.seq + uint32(n))
+					listener.serveWeb(info, isHeadRequest(seg.payload))
+				} else if r.Mixed {
+					layer.setAck(seg.seq + uint32(n))
+					info.state = established
+					listener.mutex.run(func() {
+						listener.conns[addrstr] = info
+						delete(listener.newcons, addrstr)
+					})
+					if n, ok = listener.deliver(b, info.addr, seg.payload); !ok {
+						continue
+					}
+					listener.trySendAck(layer)
+					return n, info.addr, nil
+				} else {
+					// data that overtook the request
+					info.holdEarly(seg.payload)
+				}
+			}
+			continue
+		}
+		layer := listener.peerLayer(&p, &seg)
+		if layer == nil {
+			continue
+		}
+		if !seg.syn || seg.ack || seg.psh || seg.fin {
+			listener.sendFinWithLayer(layer)
+			continue
+		}
+		syn := newSYNInfo(uaddr, seg.dst, int(seg.ttl), int(seg.window), getMssFromTcpLayer(seg.tcp), peerOptionsOf(seg.tcp))
+		if v := listener.acceptSYN(syn); v != SYNAccept {
+			if v == SYNReset {
+				listener.sendRstWithLayer(layer)
+			}
+			continue
+		}
+		if !listener.admit() {
+			if r.RefuseWithRST {
+				listener.sendRstWithLayer(layer)
+			}
+			continue
+		}
+		src := layer.srcIP()
+		info = &connInfo{
+			state: synreceived,
+			layer: layer,
+			addr:  uaddr,
+		}
+		info.mtu = listener.peerMTU(src)
+		info.mss, info.mssAssumed = r.peerMSS(getMssFromTcpLayer(seg.tcp), info.mtu)
+		info.peer = peerOptionsOf(seg.tcp)
+		if r.Udp2raw {
+			info.u2r = newUdp2rawState(r.random())
+		}
+		info.limiter = newRateLimiter(r.Rate, r.PacketRate, r.Pacing)
+		info.squeue = r.newSendQueue(listener.die, &listener.sendc)
+		info.coalescer = listener.peerCoalescer(info)
+		info.shaper = listener.peerShaper(info)
+		info.born = time.Now()
+		info.touch()
+		layer.setSeq(r.isn(src, seg.dport, uaddr.IP, uaddr.Port))
+		// the peer has to pass the filter before it gets the SYN-ACK
+		listener.mutex.run(func() {
+			listener.newcons[addrstr] = info
+			err = listener.updateFilter()
+		})
+		if err != nil {
+			return
+		}
+		if err = listener.sendPeerSynAck(info); err != nil {
+			return
+		}
+	}
+}
+
+// isRequest tells whether req is a request of the handshake of r, as a
+// ClientHello, the request of the profile, or a POST.
+func (r *Raw) isRequest(req []byte) bool {
+	if r.TLS || r.Mixed {
+		if ok, _, _ := utils.ParseTLSClientHelloMsg(req); ok {
+			return true
+		}
+	}
+	if p := r.profile(); p != profileNone && p.isRequest(req) {
+		return true
+	}
+	return isHTTPMessage(req, "POST")
+}
+
+// closeConnByAddr drops the peer at addrstr, which ended its connection,
+// and answers it with a FIN. The caller holds listener.mutex.
+func (listener *RAWListener) closeConnByAddr(addrstr string) (err error) {
+	info, ok := listener.newcons[addrstr]
+	if ok {
+		delete(listener.newcons, addrstr)
+	} else if info, ok = listener.conns[addrstr]; ok {
+		listener.forgetConn(info)
+		delete(listener.conns, addrstr)
+	}
+	if info != nil {
+		listener.updateFilter()
+		err = listener.closeConn(info)
+	}
+	return
+}
+
+// closeConn sends the peer of info a FIN.
+func (listener *RAWListener) closeConn(info *connInfo) error {
+	info.lock.Lock()
+	defer info.lock.Unlock()
+	return listener.sendFinWithLayer(info.layer)
+}
@@ -0,0 +1,61 @@
+package rawcon
+
+import "net"
+
+// SYNInfo is what a listener knows of the SYN of a new peer when
+// Raw.AcceptSYN looks at it.
+type SYNInfo struct {
+	Addr *net.UDPAddr
+	// Local is the address the SYN was sent to, nil where the capture
+	// does not tell it.
+	Local net.IP
+	// TTL is that of the IP header of the SYN as it arrived.
+	TTL    int
+	Window int
+	// MSS and WindowScale are the options the SYN carries, 0 and -1
+	// without them.
+	MSS         int
+	WindowScale int
+	SACK        bool
+	Timestamps  bool
+}
+
+// SYNVerdict is what a listener does with a SYN, see Raw.AcceptSYN.
+type SYNVerdict int
+
+const (
+	// SYNAccept goes on with the handshake, within Raw.MaxHalfOpen and
+	// Raw.MaxConns.
+	SYNAccept SYNVerdict = iota
+	// SYNIgnore drops the SYN as if it never came.
+	SYNIgnore
+	// SYNReset answers the SYN with a RST.
+	SYNReset
+)
+
+func newSYNInfo(addr *net.UDPAddr, local net.IP, ttl, window, mss int, opts peerOptions) SYNInfo {
+	return SYNInfo{
+		Addr:        addr,
+		Local:       local,
+		TTL:         ttl,
+		Window:      window,
+		MSS:         mss,
+		WindowScale: opts.wscale,
+		SACK:        opts.sack,
+		Timestamps:  opts.timestamps,
+	}
+}
+
+// acceptSYN asks Raw.AcceptSYN what to do with the SYN of a new peer,
+// before the listener holds anything for it. The SYNs it turns away count
+// as refused in the Backlog.
+func (listener *RAWListener) acceptSYN(syn SYNInfo) SYNVerdict {
+	if listener.r.AcceptSYN == nil {
+		return SYNAccept
+	}
+	v := listener.r.AcceptSYN(syn)
+	if v != SYNAccept {
+		listener.refused.Add(1)
+	}
+	return v
+}
@@ -0,0 +1,56 @@
+package rawcon
+
+// Backlog is the state a listener holds for its peers, see
+// RAWListener.Backlog.
+type Backlog struct {
+	// HalfOpen counts the peers still in the handshake.
+	HalfOpen    int
+	Established int
+	// Refused counts the SYNs turned away by Raw.MaxHalfOpen,
+	// Raw.MaxConns and Raw.AcceptSYN.
+	Refused uint64
+}
+
+// Backlog returns how many peers the listener holds and how many it
+// refused.
+func (listener *RAWListener) Backlog() (b Backlog) {
+	listener.mutex.read(func() {
+		b.HalfOpen = len(listener.newcons)
+		b.Established = len(listener.conns)
+	})
+	b.Refused = listener.refused.Load()
+	return
+}
+
+// admit tells whether the SYN of a new peer fits in the limits of Raw,
+// making room with Raw.EvictLRU or else counting it as refused.
+func (listener *RAWListener) admit() bool {
+	if listener.draining.Load() {
+		return false
+	}
+	r := listener.r
+	ok := true
+	var victim *connInfo
+	listener.mutex.run(func() {
+		var full []map[string]*connInfo
+		if r.MaxHalfOpen > 0 && len(listener.newcons) >= r.MaxHalfOpen {
+			full = append(full, listener.newcons)
+		} else if r.MaxConns > 0 && len(listener.newcons)+len(listener.conns) >= r.MaxConns {
+			full = append(full, listener.newcons, listener.conns)
+		}
+		if full == nil {
+			return
+		}
+		if r.EvictLRU {
+			victim = listener.dropLRU(full...)
+		}
+		ok = victim != nil
+	})
+	if victim != nil {
+		listener.evicted(victim, EvictLRU)
+	}
+	if !ok {
+		listener.refused.Add(1)
+	}
+	return ok
+}
@@ -0,0 +1,268 @@
+package rawcon
+
+import (
+	"encoding/binary"
+	"errors"
+	"net"
+	"time"
+
+	"github.com/biotooff/rawcon/utils"
+	"golang.org/x/net/ipv4"
+)
+
+func joinBuffers(bufs [][]byte) []byte {
+	if len(bufs) == 1 {
+		return bufs[0]
+	}
+	var b []byte
+	for _, buf := range bufs {
+		b = append(b, buf...)
+	}
+	return b
+}
+
+func tlsRecord(b []byte) []byte {
+	buf := make([]byte, 5+len(b))
+	copy(buf, []byte{0x17, 0x3, 0x3})
+	binary.BigEndian.PutUint16(buf[3:5], uint16(len(b)))
+	copy(buf[5:], b)
+	return buf
+}
+
+// errWouldBlock is returned by the reads of readNoWait where they would
+// wait for a packet.
+var errWouldBlock = errors.New("no packet received yet")
+
+// batchSegments joins the buffers of every message of ms, up to the first
+// one longer than limit, for which it returns a MessageTooLongError.
+func batchSegments(ms []ipv4.Message, limit int) (segs [][]byte, size int, err error) {
+	for i := range ms {
+		b := joinBuffers(ms[i].Buffers)
+		if len(b) > limit {
+			err = &MessageTooLongError{Size: len(b), Limit: limit}
+			break
+		}
+		ms[i].N = len(b)
+		segs = append(segs, b)
+		size += len(b)
+	}
+	return
+}
+
+// sealBatch pads and seals the segments of a batch in place, as
+// writeSegment does with those it sends one at a time.
+func sealBatch(rnd utils.Random, segs [][]byte, limit, pad int, u2r *udp2rawState, tls bool, prof profile, server bool) {
+	for i, b := range segs {
+		if pad > 0 {
+			b = padSegment(rnd, b, pad, limit-len(b))
+			segs[i] = b
+		}
+		if u2r != nil {
+			segs[i] = u2r.sealLocked(udp2rawData, b)
+		} else if tls {
+			segs[i] = tlsRecord(b)
+		} else if prof != profileNone {
+			segs[i] = prof.seal(rnd, b, server)
+		}
+	}
+}
+
+// WriteBatch writes the messages of ms, each one in a segment of its own.
+// It returns the number of messages sent, the Addr of the messages is
+// ignored. flags is unused and only there to match ipv4.PacketConn. The
+// messages go out in one system call unless a send queue, a write deadline
+// or Raw.BestEffortWrite is set, which have them written one at a time as
+// Write would.
+func (conn *RAWConn) WriteBatch(ms []ipv4.Message, flags int) (int, error) {
+	if err := conn.resetErr("write"); err != nil {
+		return 0, err
+	}
+	if err := conn.pathErr("write"); err != nil {
+		return 0, err
+	}
+	limit := payloadLimit(conn.mss, recordLen(conn.r.TLS, conn.r.profile()), conn.u2r, conn.pad)
+	if conn.coalescer != nil {
+		limit -= coalesceHeaderLen
+	}
+	segs, size, err := batchSegments(ms, limit)
+	if conn.shaper != nil {
+		for i, b := range segs {
+			if e := conn.shaper.write(b); e != nil {
+				return i, e
+			}
+		}
+		return len(segs), err
+	}
+	if conn.coalescer != nil {
+		for i, b := range segs {
+			if e := conn.coalescer.write(b); e != nil {
+				return i, e
+			}
+		}
+		return len(segs), err
+	}
+	if conn.squeue != nil || conn.wdeadline.t.Load() != 0 || conn.r.BestEffortWrite {
+		for i, b := range segs {
+			_, e := conn.wdeadline.write(conn.r, conn.squeue, conn.RemoteAddr, b, func(b []byte, deadline time.Time) (int, error) {
+				return conn.writeSegment(b, 0, deadline)
+			})
+			if e != nil {
+				return i, e
+			}
+		}
+		return len(segs), err
+	}
+	if conn.r.windowShut(&conn.zerownd) {
+		// held back like the segments of Write
+		return len(segs), err
+	}
+	paceBatch(size, len(segs), conn.limiter)
+	sealBatch(conn.r.random(), segs, limit, conn.pad, conn.u2r, conn.r.TLS, conn.r.profile(), false)
+	n, e := conn.writeSegments(segs)
+	if e != nil {
+		return n, e
+	}
+	return n, err
+}
+
+// ReadBatch waits for one datagram like ReadFrom, then fills the rest of ms
+// with the datagrams already received, without waiting for more: those of
+// coalesced segments, and the packets the socket or the capture already
+// holds. It returns the number of messages filled, and the error of the
+// connection met after the first one if any. On Linux the socket is
+// read with recvmmsg, many packets at a time; pcap and BPF read many per
+// system call already, and the packets already read are only taken out
+// when a listener captures on several interfaces or queues.
+func (conn *RAWConn) ReadBatch(ms []ipv4.Message, flags int) (int, error) {
+	return readBatch(ms, conn.ReadFrom, conn.readNoWait, &conn.rqueue)
+}
+
+// readNoWait is ReadFrom from the packets already received, it fails with
+// errWouldBlock where ReadFrom would wait.
+func (conn *RAWConn) readNoWait(b []byte) (int, net.Addr, error) {
+	conn.nowait.Store(true)
+	defer conn.nowait.Store(false)
+	return conn.ReadFrom(b)
+}
+
+// WriteBatch writes every message of ms to its Addr, like WriteTo. The
+// messages in a row to the same peer go out together, as those of
+// RAWConn.WriteBatch do. It returns the number of messages sent.
+func (listener *RAWListener) WriteBatch(ms []ipv4.Message, flags int) (int, error) {
+	for i := 0; i < len(ms); {
+		j := i + 1
+		for j < len(ms) && sameAddr(ms[j].Addr, ms[i].Addr) {
+			j++
+		}
+		n, err := listener.writePeerBatch(ms[i:j])
+		if err != nil {
+			return i + n, err
+		}
+		i = j
+	}
+	return len(ms), nil
+}
+
+func sameAddr(a, b net.Addr) bool {
+	return a != nil && b != nil && a.String() == b.String()
+}
+
+// writePeerBatch is WriteBatch of RAWConn for ms, messages to the same
+// peer.
+func (listener *RAWListener) writePeerBatch(ms []ipv4.Message) (int, error) {
+	addr := ms[0].Addr
+	if addr == nil {
+		return 0, &AddrError{Op: "write", Err: ErrNoConn}
+	}
+	listener.mutex.RLock()
+	info, ok := listener.connByAddr(addr.String())
+	listener.mutex.RUnlock()
+	if !ok {
+		return 0, &AddrError{Op: "write", Addr: addr, Err: ErrNoConn}
+	}
+	limit := info.payloadLimit()
+	if info.coalescer != nil {
+		limit -= coalesceHeaderLen
+	}
+	segs, size, err := batchSegments(ms, limit)
+	if info.shaper != nil {
+		for i, b := range segs {
+			if e := info.shaper.write(b); e != nil {
+				return i, e
+			}
+		}
+		return len(segs), err
+	}
+	if info.coalescer != nil {
+		for i, b := range segs {
+			if e := info.coalescer.write(b); e != nil {
+				return i, e
+			}
+		}
+		return len(segs), err
+	}
+	if info.squeue != nil || listener.wdeadline.t.Load() != 0 || listener.r.BestEffortWrite {
+		for i, b := range segs {
+			_, e := listener.wdeadline.write(listener.r, info.squeue, func() net.Addr { return addr }, b, func(b []byte, deadline time.Time) (int, error) {
+				return listener.writeSegment(b, info, 0, deadline)
+			})
+			if e != nil {
+				return i, e
+			}
+		}
+		return len(segs), err
+	}
+	if listener.r.windowShut(&info.zerownd) {
+		return len(segs), err
+	}
+	paceBatch(size, len(segs), info.limiter, listener.limiter)
+	_, tls, prof := info.framing()
+	sealBatch(listener.r.random(), segs, limit, info.pad, info.u2r, tls, prof, true)
+	n, e := listener.writeSegments(info, segs)
+	if e != nil {
+		return n, e
+	}
+	return n, err
+}
+
+// ReadBatch is ReadBatch of RAWConn for a listener.
+func (listener *RAWListener) ReadBatch(ms []ipv4.Message, flags int) (int, error) {
+	return readBatch(ms, listener.ReadFrom, listener.readNoWait, &listener.rqueue)
+}
+
+// readNoWait is readNoWait of RAWConn for a listener.
+func (listener *RAWListener) readNoWait(b []byte) (int, net.Addr, error) {
+	if w := listener.work; w != nil {
+		return w.readNoWait(b)
+	}
+	listener.nowait.Store(true)
+	defer listener.nowait.Store(false)
+	return listener.ReadFrom(b)
+}
+
+// readBatch waits for the first datagram of ms with readFrom, then takes
+// the others from q, or with more until it would wait. An error of more is
+// returned with the datagrams read before it.
+func readBatch(ms []ipv4.Message, readFrom, more func([]byte) (int, net.Addr, error), q *datagramQueue) (int, error) {
+	if len(ms) == 0 || len(ms[0].Buffers) == 0 {
+		return 0, nil
+	}
+	n, addr, err := readFrom(ms[0].Buffers[0])
+	if err != nil {
+		return 0, err
+	}
+	ms[0].N, ms[0].Addr = n, addr
+	i := 1
+	for ; i < len(ms) && len(ms[i].Buffers) > 0; i++ {
+		n, addr, ok := q.pop(ms[i].Buffers[0])
+		if !ok {
+			if n, addr, err = more(ms[i].Buffers[0]); err == errWouldBlock {
+				return i, nil
+			} else if err != nil {
+				return i, err
+			}
+		}
+		ms[i].N, ms[i].Addr = n, addr
+	}
+	return i, nil
+}
@@ -0,0 +1,166 @@
+// +build darwin dragonfly freebsd netbsd openbsd
+// +build !pcap
+
+package rawcon
+
+import (
+	"errors"
+	"fmt"
+	"runtime"
+	"syscall"
+	"time"
+	"unsafe"
+
+	"github.com/google/gopacket"
+	"golang.org/x/sys/unix"
+)
+
+// BPFSniffer captures and injects the frames of an interface on a BPF
+// device, with nothing but syscalls.
+type BPFSniffer struct {
+	fd     int
+	buflen int
+	// buf holds what the last read returned, off is where the next frame
+	// in it starts
+	buf []byte
+	off int
+}
+
+// bpfAlignment is the BPF_ALIGNMENT of the system, which the frames of a
+// read are aligned to.
+var bpfAlignment = int(unsafe.Sizeof(uintptr(0)))
+
+func init() {
+	if runtime.GOOS == "darwin" {
+		bpfAlignment = 4
+	}
+}
+
+func bpfWordAlign(x int) int {
+	return (x + bpfAlignment - 1) &^ (bpfAlignment - 1)
+}
+
+// openBPF opens a BPF device on the interface name with a buffer of buflen
+// bytes, or the size of the system if zero. Reads return at once when a
+// frame comes in and after timeout at the latest, empty then.
+func openBPF(name string, buflen int, timeout time.Duration, promisc bool) (b *BPFSniffer, err error) {
+	fd := -1
+	// the cloning device first, then the numbered ones of older systems
+	for i := -1; i < 256 && fd < 0; i++ {
+		dev := "/dev/bpf"
+		if i >= 0 {
+			dev = fmt.Sprintf("/dev/bpf%d", i)
+		}
+		fd, err = unix.Open(dev, unix.O_RDWR|unix.O_CLOEXEC, 0)
+		if err == unix.ENOENT && i >= 0 {
+			break
+		}
+	}
+	if fd < 0 {
+		return nil, fmt.Errorf("no BPF device to open: %w", err)
+	}
+	b = &BPFSniffer{fd: fd}
+	defer func() {
+		if err != nil {
+			unix.Close(fd)
+			b = nil
+		}
+	}()
+	if buflen > 0 {
+		if err = unix.IoctlSetPointerInt(fd, unix.BIOCSBLEN, buflen); err != nil {
+			return
+		}
+	}
+	if b.buflen, err = unix.IoctlGetInt(fd, unix.BIOCGBLEN); err != nil {
+		return
+	}
+	var ifr [unix.IFNAMSIZ + 16]byte
+	if len(name) >= unix.IFNAMSIZ {
+		return nil, errors.New("interface name too long: " + name)
+	}
+	copy(ifr[:], name)
+	if err = bpfIoctl(fd, unix.BIOCSETIF, unsafe.Pointer(&ifr)); err != nil {
+		return
+	}
+	// immediate mode has to come before the timeout, or reads wait for
+	// the whole timeout even with frames to return
+	if err = unix.IoctlSetPointerInt(fd, unix.BIOCIMMEDIATE, 1); err != nil {
+		return
+	}
+	tv := syscall.NsecToTimeval(int64(timeout))
+	if err = bpfIoctl(fd, unix.BIOCSRTIMEOUT, unsafe.Pointer(&tv)); err != nil {
+		return
+	}
+	// the frames written carry their own link addresses
+	if err = unix.IoctlSetPointerInt(fd, unix.BIOCSHDRCMPLT, 1); err != nil {
+		return
+	}
+	if promisc {
+		err = bpfIoctl(fd, unix.BIOCPROMISC, nil)
+	}
+	return
+}
+
+func bpfIoctl(fd int, req uint, arg unsafe.Pointer) error {
+	_, _, e := unix.Syscall(unix.SYS_IOCTL, uintptr(fd), uintptr(req), uintptr(arg))
+	if e != 0 {
+		return e
+	}
+	return nil
+}
+
+// ReadPacketData returns the next frame captured, nil if none came in
+// before the timeout. The frame stays valid until the read after the one
+// that returned nil or the last frame of a buffer.
+func (b *BPFSniffer) ReadPacketData() (data []byte, ci gopacket.CaptureInfo, err error) {
+	if b.off >= len(b.buf) {
+		// a fresh buffer, the frames of the last one may still be in use
+		buf := make([]byte, b.buflen)
+		n, err := unix.Read(b.fd, buf)
+		if err != nil || n <= 0 {
+			b.buf, b.off = nil, 0
+			return nil, ci, err
+		}
+		b.buf, b.off = buf[:n], 0
+	}
+	if len(b.buf)-b.off < int(unsafe.Sizeof(unix.BpfHdr{})) {
+		b.buf = nil
+		return nil, ci, errors.New("short BPF header")
+	}
+	hdr := (*unix.BpfHdr)(unsafe.Pointer(&b.buf[b.off]))
+	start := b.off + int(hdr.Hdrlen)
+	end := start + int(hdr.Caplen)
+	b.off += bpfWordAlign(int(hdr.Hdrlen) + int(hdr.Caplen))
+	if end > len(b.buf) {
+		b.buf = nil
+		return nil, ci, errors.New("BPF frame past the end of the buffer")
+	}
+	data = b.buf[start:end:end]
+	ci = gopacket.CaptureInfo{
+		Timestamp:     time.Unix(int64(hdr.Tstamp.Sec), int64(hdr.Tstamp.Usec)*1000),
+		CaptureLength: len(data),
+		Length:        int(hdr.Datalen),
+	}
+	return
+}
+
+// WritePacketData sends frame out of the interface as it is.
+func (b *BPFSniffer) WritePacketData(frame []byte) (int, error) {
+	return unix.Write(b.fd, frame)
+}
+
+// SetBpf replaces the filter of the device with prog.
+func (b *BPFSniffer) SetBpf(prog []syscall.BpfInsn) error {
+	if len(prog) == 0 {
+		return errors.New("empty BPF program")
+	}
+	p := syscall.BpfProgram{Len: uint32(len(prog)), Insns: &prog[0]}
+	err := bpfIoctl(b.fd, unix.BIOCSETF, unsafe.Pointer(&p))
+	runtime.KeepAlive(prog)
+	return err
+}
+
+// Close closes the BPF device.
+func (b *BPFSniffer) Close() error {
+	return unix.Close(b.fd)
+}
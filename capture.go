@@ -0,0 +1,38 @@
+package rawcon
+
+import "errors"
+
+// CaptureStats counts the packets seen by the capture a connection reads
+// from. A listener and all its peers share one capture.
+type CaptureStats struct {
+	// Received is the number of packets that passed the filter.
+	Received int
+	// Dropped is the number of packets lost because the capture buffer was
+	// full, the sign that Raw.CaptureBuffer is too small.
+	Dropped int
+	// IfDropped is the number of packets dropped by the interface or its
+	// driver, where the system reports it.
+	IfDropped int
+	// QueueDropped is the number of packets and datagrams dropped because
+	// Raw.QueueLen of them were waiting to be read.
+	QueueDropped int
+	// Malformed is the number of packets dropped because they could not be
+	// decoded, such as truncated segments or ones with bogus options.
+	Malformed int
+	// BadChecksum is the number of packets dropped because of a wrong IPv4
+	// or TCP checksum, see Raw.VerifyChecksums.
+	BadChecksum int
+}
+
+var (
+	errNoCaptureStats  = errors.New("capture statistics are not available on this system")
+	errNoCaptureFilter = errors.New("capture filters need the pcap backend")
+	errNoSocketBuffer  = errors.New("only sockets can be resized, see Raw.CaptureBuffer")
+	errNoSocket        = errors.New("the connection has no socket with Raw.PacketIO")
+	errNoCaptureGrow   = errors.New("the capture cannot be reopened with a larger buffer")
+)
+
+// queueDropped counts what the queues of conn dropped.
+func (conn *RAWConn) queueDropped() int {
+	return int(conn.qdropped.Load() + conn.rqueue.dropped.Load())
+}
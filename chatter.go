@@ -0,0 +1,108 @@
+package rawcon
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"strconv"
+	"time"
+
+	"github.com/biotooff/rawcon/utils"
+)
+
+// With Raw.Chatter set a dialed connection in the HTTP mode sends a small
+// made up GET request every so often, and the listener answers it with a
+// made up response. Both go out without the PSH flag that every segment of
+// tunnel data carries, which is how the peer tells them apart and drops
+// them. They still take their place in the sequence numbers, so the stream
+// reads as an ordinary keep-alive session.
+
+var chatterPaths = []string{
+	"/", "/favicon.ico", "/robots.txt", "/index.html", "/static/js/main.js",
+	"/static/css/style.css", "/api/v1/status", "/images/logo.png", "/ping",
+}
+
+var chatterAgents = []string{
+	"Mozilla/5.0 (Windows NT 10.0; Win64; x64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/120.0.0.0 Safari/537.36",
+	"Mozilla/5.0 (Macintosh; Intel Mac OS X 10_15_7) AppleWebKit/605.1.15 (KHTML, like Gecko) Version/17.1 Safari/605.1.15",
+	"Mozilla/5.0 (X11; Linux x86_64; rv:121.0) Gecko/20100101 Firefox/121.0",
+}
+
+var chatterTypes = []string{
+	"text/html; charset=utf-8", "application/json", "text/css", "application/javascript", "image/png",
+}
+
+// chatterRequest returns a GET request for host.
+func chatterRequest(rnd utils.Random, host string) []byte {
+	var b bytes.Buffer
+	path := chatterPaths[rnd.Intn(len(chatterPaths))]
+	if rnd.Intn(2) == 0 {
+		path += "?v=" + strconv.FormatInt(rnd.Int63n(1<<31), 36)
+	}
+	fmt.Fprintf(&b, "GET %s HTTP/1.1\r\n", path)
+	if host != "" {
+		fmt.Fprintf(&b, "Host: %s\r\n", host)
+	}
+	fmt.Fprintf(&b, "User-Agent: %s\r\n", chatterAgents[rnd.Intn(len(chatterAgents))])
+	b.WriteString("Accept: */*\r\nAccept-Encoding: gzip, deflate\r\nConnection: keep-alive\r\n\r\n")
+	return b.Bytes()
+}
+
+// isChatterRequest tells whether b looks like a request of chatterRequest.
+func isChatterRequest(b []byte) bool {
+	return bytes.HasPrefix(b, []byte("GET ")) && bytes.HasSuffix(b, []byte("\r\n\r\n"))
+}
+
+// chatterResponse returns a response with a short random body.
+func chatterResponse(rnd utils.Random) []byte {
+	var b bytes.Buffer
+	body := make([]byte, 16+rnd.Intn(240))
+	rnd.Read(body)
+	if rnd.Intn(4) == 0 {
+		b.WriteString("HTTP/1.1 304 Not Modified\r\n")
+		body = nil
+	} else {
+		b.WriteString("HTTP/1.1 200 OK\r\n")
+		fmt.Fprintf(&b, "Content-Type: %s\r\n", chatterTypes[rnd.Intn(len(chatterTypes))])
+		fmt.Fprintf(&b, "Content-Length: %d\r\n", len(body))
+	}
+	fmt.Fprintf(&b, "Date: %s\r\n", time.Now().UTC().Format(time.RFC1123))
+	b.WriteString("Server: openresty/1.11.2\r\nConnection: keep-alive\r\n\r\n")
+	b.Write(body)
+	return b.Bytes()
+}
+
+// chatter sends the requests of a dialed connection, about interval apart.
+func (conn *RAWConn) chatter(interval time.Duration) {
+	host := conn.r.pickHost()
+	if addr, ok := conn.RemoteAddr().(*net.UDPAddr); ok && host != "" && addr.Port != 80 {
+		host = net.JoinHostPort(host, strconv.Itoa(addr.Port))
+	}
+	for {
+		// a session that ticks like a clock would stand out
+		d := interval/2 + time.Duration(conn.r.random().Int63n(int64(interval)+1))
+		timer := time.NewTimer(d)
+		select {
+		case <-conn.die:
+			timer.Stop()
+			return
+		case <-timer.C:
+		}
+		conn.lockLayer()
+		err := conn.sendChatterWithLayer(chatterRequest(conn.r.random(), host), conn.layer)
+		conn.unlockLayer()
+		if err != nil {
+			return
+		}
+	}
+}
+
+// answerChatter answers a request of the dialer of info.
+func (listener *RAWListener) answerChatter(info *connInfo, req []byte) error {
+	if !isChatterRequest(req) {
+		return nil
+	}
+	info.lock.Lock()
+	defer info.lock.Unlock()
+	return listener.sendChatterWithLayer(chatterResponse(listener.r.random()), info.layer)
+}
@@ -0,0 +1,105 @@
+package rawcon
+
+import (
+	"encoding/binary"
+	"net"
+)
+
+// ChecksumMode is how the TCP checksums of the packets sent are filled in
+// where rawcon builds whole packets: with pcap, BPF and PacketIO. The
+// kernel fills them in for the raw socket of Linux.
+type ChecksumMode int
+
+const (
+	// ChecksumFull computes the checksums.
+	ChecksumFull ChecksumMode = iota
+	// ChecksumOffload leaves the checksums to a NIC with TX checksum
+	// offload: the packets only carry the sum of the pseudo-header, like
+	// those the system hands to such a NIC. VerifyChecksums then also
+	// takes such partial checksums, which the captured copies of the
+	// packets of the host have.
+	ChecksumOffload
+	// ChecksumAuto is ChecksumOffload if a UDP packet the system sends is
+	// captured with a partial checksum, ChecksumFull otherwise. Dialers on
+	// pcap and BPF find it out, listeners and the others use ChecksumFull.
+	ChecksumAuto
+)
+
+// csumAdd adds the big-endian 16-bit words of b to the one's complement sum
+// s, padding an odd b with a zero byte.
+func csumAdd(s uint32, b []byte) uint32 {
+	n := len(b) &^ 1
+	for i := 0; i < n; i += 2 {
+		s += uint32(b[i])<<8 | uint32(b[i+1])
+	}
+	if n < len(b) {
+		s += uint32(b[n]) << 8
+	}
+	return s
+}
+
+func csumFold(s uint32) uint16 {
+	for s>>16 != 0 {
+		s = s&0xffff + s>>16
+	}
+	return uint16(s)
+}
+
+// csumReplace returns the one's complement sum s with the 16-bit word old
+// replaced by new, as in RFC 1624.
+func csumReplace(s uint32, old, new uint16) uint32 {
+	return s + uint32(^old) + uint32(new)
+}
+
+// ipv4HeaderValid tells whether the checksum of the IPv4 header hdr is right.
+func ipv4HeaderValid(hdr []byte) bool {
+	return csumFold(csumAdd(0, hdr)) == 0xffff
+}
+
+// offloads tells whether the TCP checksums are left to the NIC, detected
+// telling what ChecksumAuto found.
+func (r *Raw) offloads(detected bool) bool {
+	return r.Checksums == ChecksumOffload || r.Checksums == ChecksumAuto && detected
+}
+
+// pseudoSum returns the one's complement sum of the pseudo-header of n
+// bytes of proto from srcip to dstip.
+func pseudoSum(proto byte, srcip, dstip net.IP, n int) uint32 {
+	return csumAdd(csumAdd(0, srcip.To4()), dstip.To4()) + uint32(proto) + uint32(n)
+}
+
+// tcpChecksumValid tells whether the checksum of the TCP segment from srcip
+// to dstip made of parts, its header first, is right, or if partial is set
+// left to a NIC. All parts but the last must be of an even length.
+func tcpChecksumValid(srcip, dstip net.IP, partial bool, parts ...[]byte) bool {
+	var s uint32
+	var n int
+	for _, p := range parts {
+		s = csumAdd(s, p)
+		n += len(p)
+	}
+	pseudo := pseudoSum(6, srcip, dstip, n)
+	if partial && len(parts[0]) >= 18 && binary.BigEndian.Uint16(parts[0][16:]) == csumFold(pseudo) {
+		return true
+	}
+	return csumFold(s+pseudo) == 0xffff
+}
+
+// putPartialChecksum leaves the TCP checksum of the IPv4 packet b to the
+// NIC, see ChecksumOffload.
+func putPartialChecksum(b []byte) {
+	hl := int(b[0]&0xf) * 4
+	tl := int(binary.BigEndian.Uint16(b[2:]))
+	if hl < 20 || tl < hl+20 || tl > len(b) {
+		return
+	}
+	sum := csumFold(pseudoSum(6, net.IP(b[12:16]), net.IP(b[16:20]), tl-hl))
+	binary.BigEndian.PutUint16(b[hl+16:], sum)
+}
+
+// ipv4HeaderChecksum returns the checksum of the IPv4 header hdr, whose
+// checksum field is taken as zero.
+func ipv4HeaderChecksum(hdr []byte) uint16 {
+	s := csumAdd(0, hdr[:10])
+	return ^csumFold(csumAdd(s, hdr[12:]))
+}
@@ -0,0 +1,168 @@
+// Command rawbench measures a rawcon connection. It listens on -addr, dials
+// the listener, which echoes everything, and sends it datagrams of -size
+// bytes at -pps packets per second, as fast as it can if zero, for
+// -duration. It then reports the throughput of the echoes, the percentiles
+// of their round trip times and what the captures of both ends dropped:
+//
+//	rawbench -addr 127.0.0.1:7000 -size 1200 -pps 20000 -duration 10s
+//
+// -pipe runs both ends over an in-memory PacketPipe instead of loopback,
+// which measures rawcon alone but needs a system with Raw.PacketIO. Every
+// option of rawcon.Raw is a flag as well, see rawbench -h.
+package main
+
+import (
+	"encoding/binary"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/biotooff/rawcon"
+	"github.com/biotooff/rawcon/internal/rawflag"
+)
+
+// headerLen is the sequence number and the time a datagram was sent at.
+const headerLen = 16
+
+type result struct {
+	sent, received int
+	bytes          int64
+	elapsed        time.Duration
+	rtts           []time.Duration
+}
+
+func main() {
+	r := rawcon.Raw{NoHTTP: true}
+	addr := flag.String("addr", "127.0.0.1:7000", "the address the listener is on")
+	size := flag.Int("size", 1000, "the size of the datagrams")
+	pps := flag.Int("pps", 0, "the datagrams sent a second, as many as possible if zero")
+	duration := flag.Duration("duration", 10*time.Second, "how long to send for")
+	pipe := flag.Bool("pipe", false, "run over an in-memory PacketPipe rather than loopback")
+	rawflag.Define(flag.CommandLine, &r)
+	flag.Parse()
+	if *size < headerLen {
+		log.Fatalf("the datagrams need %d bytes at least", headerLen)
+	}
+
+	lr, dr := r, r
+	if *pipe {
+		client, server := rawcon.NewPacketPipe()
+		defer client.Close()
+		defer server.Close()
+		lr.PacketIO, dr.PacketIO = server, client
+	}
+	listener, err := lr.ListenRAW(*addr)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer listener.Close()
+	go echo(listener)
+	conn, err := dr.DialRAW(*addr)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer conn.Close()
+
+	res := run(conn, *size, *pps, *duration)
+	report(os.Stdout, res)
+	stats, err := conn.CaptureStats()
+	if err == nil {
+		fmt.Printf("dialer capture: %+v\n", stats)
+	}
+	if stats, err = listener.CaptureStats(); err == nil {
+		fmt.Printf("listener capture: %+v\n", stats)
+	}
+}
+
+// echo writes back what the listener reads.
+func echo(listener *rawcon.RAWListener) {
+	buf := make([]byte, 65536)
+	for {
+		n, addr, err := listener.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+		listener.WriteTo(buf[:n], addr)
+	}
+}
+
+// run sends for duration and collects the echoes until a second after.
+func run(conn *rawcon.RAWConn, size, pps int, duration time.Duration) *result {
+	res := &result{}
+	var lock sync.Mutex
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		buf := make([]byte, 65536)
+		for {
+			n, err := conn.Read(buf)
+			if err != nil {
+				return
+			}
+			if n < headerLen {
+				continue
+			}
+			rtt := time.Since(time.Unix(0, int64(binary.BigEndian.Uint64(buf[8:]))))
+			lock.Lock()
+			res.received++
+			res.bytes += int64(n)
+			res.rtts = append(res.rtts, rtt)
+			lock.Unlock()
+		}
+	}()
+
+	msg := make([]byte, size)
+	var interval time.Duration
+	if pps > 0 {
+		interval = time.Second / time.Duration(pps)
+	}
+	start := time.Now()
+	next := start
+	for seq := uint64(0); time.Since(start) < duration; seq++ {
+		if interval > 0 {
+			if d := time.Until(next); d > 0 {
+				time.Sleep(d)
+			}
+			next = next.Add(interval)
+		}
+		binary.BigEndian.PutUint64(msg, seq)
+		binary.BigEndian.PutUint64(msg[8:], uint64(time.Now().UnixNano()))
+		if _, err := conn.Write(msg); err != nil {
+			if ne, ok := err.(net.Error); ok && ne.Timeout() {
+				continue
+			}
+			log.Fatal(err)
+		}
+		res.sent++
+	}
+	elapsed := time.Since(start)
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	<-done
+	lock.Lock()
+	defer lock.Unlock()
+	res.elapsed = elapsed
+	return res
+}
+
+// report prints the throughput over the time spent sending, and the round
+// trip times.
+func report(w io.Writer, res *result) {
+	secs := res.elapsed.Seconds()
+	fmt.Fprintf(w, "sent %d, echoed %d, lost %d (%.2f%%)\n", res.sent, res.received,
+		res.sent-res.received, 100*float64(res.sent-res.received)/float64(max(res.sent, 1)))
+	fmt.Fprintf(w, "throughput %.0f pps, %.2f Mbit/s\n", float64(res.received)/secs, float64(res.bytes)*8/secs/1e6)
+	if len(res.rtts) == 0 {
+		return
+	}
+	slices.Sort(res.rtts)
+	pct := func(p float64) time.Duration {
+		return res.rtts[min(int(p*float64(len(res.rtts))), len(res.rtts)-1)]
+	}
+	fmt.Fprintf(w, "rtt p50 %v, p90 %v, p99 %v, max %v\n", pct(0.5), pct(0.9), pct(0.99), res.rtts[len(res.rtts)-1])
+}
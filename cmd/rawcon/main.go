@@ -0,0 +1,226 @@
+// Command rawcon runs a point-to-point UDP tunnel over rawcon.
+//
+// The client carries the datagrams the local UDP applications send to -l to
+// the server at -r, which hands them to the UDP service at -t. Every local
+// UDP address gets a connection of its own, dropped once nothing came back
+// on it for -idle:
+//
+//	rawcon -server -l :4000 -t 127.0.0.1:51820
+//	rawcon -l 127.0.0.1:51820 -r server.example.com:4000
+//
+// Every option of rawcon.Raw is a flag as well, e.g. -tls or -rate, see
+// rawcon -h. Both ends need the same ones. With -metrics the counters of the
+// tunnel are served as expvar JSON at /debug/vars, and -diagnose checks the
+// host for a connection to -r and exits.
+package main
+
+import (
+	"expvar"
+	"flag"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/biotooff/rawcon"
+	"github.com/biotooff/rawcon/internal/rawflag"
+)
+
+var (
+	packetsUp   = expvar.NewInt("packets_up")
+	bytesUp     = expvar.NewInt("bytes_up")
+	packetsDown = expvar.NewInt("packets_down")
+	bytesDown   = expvar.NewInt("bytes_down")
+	sessions    = expvar.NewInt("sessions")
+	events      = expvar.NewMap("events")
+)
+
+// captureStats is what has CaptureStats, a connection or a listener.
+type captureStats interface {
+	CaptureStats() (rawcon.CaptureStats, error)
+}
+
+func main() {
+	var r rawcon.Raw
+	server := flag.Bool("server", false, "run the server end")
+	laddr := flag.String("l", "", "the local UDP address of the client, or the address the server listens on")
+	raddr := flag.String("r", "", "the address of the server, for the client")
+	target := flag.String("t", "", "the UDP service the server hands the datagrams to")
+	idle := flag.Duration("idle", 2*time.Minute, "how long a session lasts without traffic")
+	metrics := flag.String("metrics", "", "the address to serve the metrics on")
+	verbose := flag.Bool("v", false, "log the events of the connections")
+	diagnose := flag.Bool("diagnose", false, "check the host for a connection to -r and exit")
+	rawflag.Define(flag.CommandLine, &r)
+	flag.Parse()
+
+	r.OnEvent = func(e rawcon.Event) {
+		events.Add(e.Type.String(), 1)
+		if *verbose {
+			log.Printf("%v %v", e.Type, e.Addr)
+		}
+	}
+	if *diagnose {
+		d := r.Diagnose(*raddr)
+		fmt.Print(d)
+		if !d.OK() {
+			os.Exit(1)
+		}
+		return
+	}
+	if *metrics != "" {
+		go func() {
+			log.Fatal(http.ListenAndServe(*metrics, nil))
+		}()
+	}
+	var err error
+	switch {
+	case *server && *laddr != "" && *target != "":
+		err = runServer(&r, *laddr, *target, *idle)
+	case !*server && *laddr != "" && *raddr != "":
+		err = runClient(&r, *laddr, *raddr, *idle)
+	default:
+		flag.Usage()
+		os.Exit(2)
+	}
+	log.Fatal(err)
+}
+
+// runClient carries the datagrams sent to laddr to the server at raddr, a
+// connection for every sender.
+func runClient(r *rawcon.Raw, laddr, raddr string, idle time.Duration) error {
+	local, err := net.ListenPacket("udp", laddr)
+	if err != nil {
+		return err
+	}
+	defer local.Close()
+	var lock sync.Mutex
+	conns := make(map[string]net.PacketConn)
+	expvar.Publish("capture", expvar.Func(func() any {
+		var sum rawcon.CaptureStats
+		lock.Lock()
+		defer lock.Unlock()
+		for _, conn := range conns {
+			if c, ok := conn.(captureStats); ok {
+				if stats, err := c.CaptureStats(); err == nil {
+					sum.Received += stats.Received
+					sum.Dropped += stats.Dropped
+					sum.IfDropped += stats.IfDropped
+					sum.QueueDropped += stats.QueueDropped
+					sum.Malformed += stats.Malformed
+					sum.BadChecksum += stats.BadChecksum
+				}
+			}
+		}
+		return sum
+	}))
+	buf := make([]byte, 65536)
+	for {
+		n, from, err := local.ReadFrom(buf)
+		if err != nil {
+			return err
+		}
+		lock.Lock()
+		conn := conns[from.String()]
+		lock.Unlock()
+		if conn == nil {
+			if conn, err = r.DialPacket(raddr); err != nil {
+				log.Printf("dial %s: %v", raddr, err)
+				continue
+			}
+			lock.Lock()
+			conns[from.String()] = conn
+			lock.Unlock()
+			sessions.Add(1)
+			go func(conn net.PacketConn, from net.Addr) {
+				defer func() {
+					lock.Lock()
+					delete(conns, from.String())
+					lock.Unlock()
+					sessions.Add(-1)
+					conn.Close()
+				}()
+				relay(conn, local, from, idle)
+			}(conn, from)
+		}
+		if _, err = conn.WriteTo(buf[:n], nil); err != nil {
+			log.Printf("write to %s: %v", raddr, err)
+			continue
+		}
+		packetsUp.Add(1)
+		bytesUp.Add(int64(n))
+	}
+}
+
+// runServer hands the datagrams of the peers of laddr to target, from a UDP
+// socket for every peer.
+func runServer(r *rawcon.Raw, laddr, target string, idle time.Duration) error {
+	listener, err := r.ListenPacket(laddr)
+	if err != nil {
+		return err
+	}
+	defer listener.Close()
+	if c, ok := listener.(captureStats); ok {
+		expvar.Publish("capture", expvar.Func(func() any {
+			stats, _ := c.CaptureStats()
+			return stats
+		}))
+	}
+	var lock sync.Mutex
+	ups := make(map[string]net.Conn)
+	buf := make([]byte, 65536)
+	for {
+		n, from, err := listener.ReadFrom(buf)
+		if err != nil {
+			return err
+		}
+		packetsUp.Add(1)
+		bytesUp.Add(int64(n))
+		lock.Lock()
+		up := ups[from.String()]
+		lock.Unlock()
+		if up == nil {
+			if up, err = net.Dial("udp", target); err != nil {
+				log.Printf("dial %s: %v", target, err)
+				continue
+			}
+			lock.Lock()
+			ups[from.String()] = up
+			lock.Unlock()
+			sessions.Add(1)
+			go func(up net.Conn, from net.Addr) {
+				defer func() {
+					lock.Lock()
+					delete(ups, from.String())
+					lock.Unlock()
+					sessions.Add(-1)
+					up.Close()
+				}()
+				relay(up.(net.PacketConn), listener, from, idle)
+			}(up, from)
+		}
+		if _, err = up.Write(buf[:n]); err != nil {
+			log.Printf("write to %s: %v", target, err)
+		}
+	}
+}
+
+// relay writes what is read from src to to on dst until src has been idle
+// for idle.
+func relay(src, dst net.PacketConn, to net.Addr, idle time.Duration) {
+	buf := make([]byte, 65536)
+	for {
+		src.SetReadDeadline(time.Now().Add(idle))
+		n, _, err := src.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+		if _, err = dst.WriteTo(buf[:n], to); err != nil {
+			return
+		}
+		packetsDown.Add(1)
+		bytesDown.Add(int64(n))
+	}
+}
@@ -0,0 +1,267 @@
+package rawcon
+
+import (
+	"encoding/binary"
+	"net"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/biotooff/rawcon/utils"
+)
+
+// With Raw.Coalesce set, a segment carries one or more datagrams, each one
+// prefixed with its length as a 16 bit big endian integer.
+
+const (
+	coalesceHeaderLen    = 2
+	defaultCoalesceDelay = time.Millisecond
+)
+
+type coalescer struct {
+	lock  sync.Mutex
+	buf   []byte
+	n     int // datagrams in buf
+	timer *time.Timer
+	delay time.Duration
+	limit func() int
+	send  func(b []byte) error
+	// slock is held while a segment is sent, taken before lock is let go
+	// so that the segments go out in the order they were cut. spare is the
+	// buffer of the last one sent, which the next cut takes over.
+	slock sync.Mutex
+	spare []byte
+	// counters count the datagrams of the flushes of the timer that
+	// failed, no write is there to return the error
+	counters *sendCounters
+}
+
+func newCoalescer(delay time.Duration, limit func() int, send func(b []byte) error, counters *sendCounters) *coalescer {
+	if delay <= 0 {
+		delay = defaultCoalesceDelay
+	}
+	return &coalescer{
+		delay:    delay,
+		limit:    limit,
+		send:     send,
+		counters: counters,
+	}
+}
+
+// write queues b, sending what is queued first if b does not fit in the
+// same segment.
+func (c *coalescer) write(b []byte) (err error) {
+	c.lock.Lock()
+	var seg []byte
+	if len(c.buf)+coalesceHeaderLen+len(b) > c.limit() {
+		seg, _ = c.cut()
+	}
+	var l [coalesceHeaderLen]byte
+	binary.BigEndian.PutUint16(l[:], uint16(len(b)))
+	c.buf = append(c.buf, l[:]...)
+	c.buf = append(c.buf, b...)
+	c.n++
+	if c.timer == nil {
+		c.timer = time.AfterFunc(c.delay, c.flushTimer)
+	}
+	c.lock.Unlock()
+	if seg != nil {
+		err = c.sendCut(seg)
+	}
+	return
+}
+
+// flushTimer flushes what waited CoalesceDelay, counting the datagrams of
+// a failed send.
+func (c *coalescer) flushTimer() {
+	c.lock.Lock()
+	seg, n := c.cut()
+	c.lock.Unlock()
+	if seg == nil {
+		return
+	}
+	if c.sendCut(seg) != nil {
+		c.counters.failed.Add(int64(n))
+	}
+}
+
+// Flush sends the queued datagrams.
+func (c *coalescer) Flush() error {
+	c.lock.Lock()
+	seg, _ := c.cut()
+	c.lock.Unlock()
+	if seg == nil {
+		return nil
+	}
+	return c.sendCut(seg)
+}
+
+// cut takes the queued datagrams out for a segment, and the send lock
+// unless there are none. It returns the segment and the number of
+// datagrams in it. c.lock is held.
+func (c *coalescer) cut() (seg []byte, n int) {
+	if c.timer != nil {
+		c.timer.Stop()
+		c.timer = nil
+	}
+	if len(c.buf) == 0 {
+		return
+	}
+	c.slock.Lock()
+	seg, n = c.buf, c.n
+	c.buf, c.n = c.spare[:0], 0
+	c.spare = nil
+	return
+}
+
+// sendCut sends seg, a segment of cut, without c.lock so that the writes
+// go on queueing meanwhile, and gives back the send lock.
+func (c *coalescer) sendCut(seg []byte) error {
+	err := c.send(seg)
+	c.spare = seg
+	c.slock.Unlock()
+	return err
+}
+
+type datagram struct {
+	addr net.Addr
+	data []byte
+}
+
+// datagramQueue holds the datagrams of a coalesced segment that have not
+// been read yet. It owns their data, taken from utils.GetBuf and given back
+// once copied out by pop.
+type datagramQueue struct {
+	lock    sync.Mutex
+	items   []datagram
+	dropped atomic.Uint64
+	// partial holds the datagrams of shaped segments still missing chunks,
+	// by peer
+	partial map[string]*partialDatagram
+}
+
+// unpack copies the first datagram of seg into b and queues the others, it
+// fails if seg is malformed. Once max datagrams wait, if max is set, the
+// others are dropped.
+func (q *datagramQueue) unpack(b []byte, addr net.Addr, seg []byte, max int) (n int, ok bool) {
+	var msgs [][]byte
+	for len(seg) > 0 {
+		if len(seg) < coalesceHeaderLen {
+			return
+		}
+		l := int(binary.BigEndian.Uint16(seg))
+		seg = seg[coalesceHeaderLen:]
+		if l > len(seg) {
+			return
+		}
+		msgs = append(msgs, seg[:l])
+		seg = seg[l:]
+	}
+	if len(msgs) == 0 {
+		return
+	}
+	q.lock.Lock()
+	for _, msg := range msgs[1:] {
+		if max > 0 && len(q.items) >= max {
+			q.dropped.Add(1)
+			continue
+		}
+		q.items = append(q.items, datagram{addr: addr, data: utils.CopyBuffer(msg)})
+	}
+	q.lock.Unlock()
+	return copy(b, msgs[0]), true
+}
+
+// queued returns the number of datagrams waiting.
+func (q *datagramQueue) queued() int {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	return len(q.items)
+}
+
+// insert queues a copy of the datagram b from addr at position i, ahead of
+// those queued after it, unless max datagrams wait already.
+func (q *datagramQueue) insert(i int, addr net.Addr, b []byte, max int) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	if max > 0 && len(q.items) >= max {
+		q.dropped.Add(1)
+		return
+	}
+	q.items = slices.Insert(q.items, min(i, len(q.items)), datagram{addr: addr, data: utils.CopyBuffer(b)})
+}
+
+func (q *datagramQueue) pop(b []byte) (n int, addr net.Addr, ok bool) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	if len(q.items) == 0 {
+		return
+	}
+	d := q.items[0]
+	q.items[0] = datagram{}
+	q.items = q.items[1:]
+	n = copy(b, d.data)
+	utils.PutBuf(d.data)
+	return n, d.addr, true
+}
+
+func (conn *RAWConn) startCoalescing() {
+	conn.coalescer = newCoalescer(conn.r.CoalesceDelay, func() int {
+		return payloadLimit(conn.mss, recordLen(conn.r.TLS, conn.r.profile()), conn.u2r, conn.pad)
+	}, func(b []byte) error {
+		_, err := conn.writeSegment(b, 0, time.Time{})
+		return err
+	}, &conn.sendc)
+}
+
+// Flush sends the datagrams waiting to be coalesced.
+func (conn *RAWConn) Flush() error {
+	if conn.coalescer == nil {
+		return nil
+	}
+	return conn.coalescer.Flush()
+}
+
+func (listener *RAWListener) peerCoalescer(info *connInfo) *coalescer {
+	if !listener.r.Coalesce || listener.r.Shape != nil {
+		return nil
+	}
+	return newCoalescer(listener.r.CoalesceDelay, func() int {
+		return info.payloadLimit()
+	}, func(b []byte) error {
+		_, err := listener.writeSegment(b, info, 0, time.Time{})
+		return err
+	}, &listener.sendc)
+}
+
+// Flush sends the datagrams waiting to be coalesced for every peer.
+func (listener *RAWListener) Flush() (err error) {
+	var infos []*connInfo
+	listener.mutex.read(func() {
+		for _, info := range listener.conns {
+			infos = append(infos, info)
+		}
+	})
+	for _, info := range infos {
+		if info.coalescer == nil {
+			continue
+		}
+		if e := info.coalescer.Flush(); e != nil {
+			err = e
+		}
+	}
+	return
+}
+
+// deliver copies the datagram in payload, or the first one if it is a
+// coalesced or shaped segment, into b.
+func (conn *RAWConn) deliver(b []byte, addr net.Addr, payload []byte) (n int, ok bool) {
+	if conn.r.Shape != nil {
+		return conn.rqueue.unshape(b, addr, payload, conn.r.QueueLen)
+	}
+	if !conn.r.Coalesce {
+		return copy(b, payload), true
+	}
+	return conn.rqueue.unpack(b, addr, payload, conn.r.QueueLen)
+}
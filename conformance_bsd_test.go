@@ -0,0 +1,6 @@
+// +build darwin dragonfly freebsd netbsd openbsd
+// +build !pcap
+
+package rawcon
+
+const conformanceFlavor = "bsd"
@@ -0,0 +1,38 @@
+package rawcon
+
+import "testing"
+
+const conformanceFlavor = "linux"
+
+// conformanceConn returns a connection from conformanceSrc to
+// conformanceDst whose segments go to out instead of the network, and its
+// layer.
+func conformanceConn(out func(seg []byte)) (*RAWConn, *pktLayers) {
+	r := &Raw{PacketOut: func(b []byte) []byte {
+		out(append([]byte(nil), b...))
+		return nil
+	}}
+	layer := &pktLayers{
+		ip4: &iPv4Layer{
+			srcip: conformanceSrc.IP.To4(),
+			dstip: conformanceDst.IP.To4(),
+		},
+		tcp: &tcpLayer{
+			srcPort: conformanceSrc.Port,
+			dstPort: conformanceDst.Port,
+			seqn:    conformanceSeq,
+			ackn:    conformanceAck,
+			window:  synWindow(r.window(dialWindow)),
+		},
+	}
+	return &RAWConn{r: r, layer: layer, mtu: 1500, ipid: r.newIPID()}, layer
+}
+
+// conformanceRead decodes seg the way the backend reads segments.
+func conformanceRead(t *testing.T, seg []byte) (hsSegment, peerOptions, int) {
+	tcp, err := decodeTCPlayer(seg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return hsSegmentOf(tcp, len(tcp.payload)), peerOptionsOf(tcp), getMssFromTcpLayer(tcp)
+}
@@ -0,0 +1,5 @@
+// +build !linux,!darwin,!dragonfly,!freebsd,!netbsd,!openbsd !linux,pcap
+
+package rawcon
+
+const conformanceFlavor = "pcap"
@@ -0,0 +1,65 @@
+// +build !linux
+
+package rawcon
+
+import (
+	"testing"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+// conformanceConn returns a connection from conformanceSrc to
+// conformanceDst whose segments go to out instead of the capture, and its
+// layer.
+func conformanceConn(out func(seg []byte)) (*RAWConn, *pktLayers) {
+	r := &Raw{PacketOut: func(b []byte) []byte {
+		// the frames are Ethernet ones, the segment follows the IPv4 header
+		if seg, _, _, ok := parseIPv4(b[14:]); ok {
+			out(append([]byte(nil), seg...))
+		}
+		return nil
+	}}
+	layer := &pktLayers{
+		eth: &layers.Ethernet{
+			SrcMAC:       []byte{2, 0, 0, 0, 0, 1},
+			DstMAC:       []byte{2, 0, 0, 0, 0, 2},
+			EthernetType: layers.EthernetTypeIPv4,
+		},
+		ip4: &layers.IPv4{
+			SrcIP:    conformanceSrc.IP.To4(),
+			DstIP:    conformanceDst.IP.To4(),
+			Protocol: layers.IPProtocolTCP,
+			Version:  0x4,
+			Flags:    layers.IPv4DontFragment,
+			TTL:      uint8(r.ttl()),
+		},
+		tcp: &layers.TCP{
+			SrcPort: layers.TCPPort(conformanceSrc.Port),
+			DstPort: layers.TCPPort(conformanceDst.Port),
+			Seq:     conformanceSeq,
+			Ack:     conformanceAck,
+			Window:  synWindow(r.window(dialWindow)),
+		},
+	}
+	conn := &RAWConn{
+		r:     r,
+		layer: layer,
+		mtu:   1500,
+		ipid:  r.newIPID(),
+		opts: gopacket.SerializeOptions{
+			FixLengths:       true,
+			ComputeChecksums: true,
+		},
+	}
+	return conn, layer
+}
+
+// conformanceRead decodes seg the way the backend reads segments.
+func conformanceRead(t *testing.T, seg []byte) (hsSegment, peerOptions, int) {
+	var tcp layers.TCP
+	if err := tcp.DecodeFromBytes(seg, gopacket.NilDecodeFeedback); err != nil {
+		t.Fatal(err)
+	}
+	return hsSegmentOf(&tcp, len(tcp.Payload)), peerOptionsOf(&tcp), getMssFromTcpLayer(&tcp)
+}
@@ -0,0 +1,321 @@
+package rawcon
+
+import (
+	"bufio"
+	"encoding/hex"
+	"flag"
+	"math/rand"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Every build flavor sends the segments below through its own backend and
+// must come up with the same bytes, and read them back into the same
+// state: a dialer built for one system talks to listeners built for the
+// others. The TCP checksum is left out, and so is the timestamp value of
+// the segments stamped with the clock.
+
+var (
+	conformanceSrc = &net.UDPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 40000}
+	conformanceDst = &net.UDPAddr{IP: net.IPv4(10, 0, 0, 2), Port: 443}
+)
+
+const (
+	conformanceSeq = 0x01020304
+	conformanceAck = 0x0a0b0c0d
+)
+
+var conformanceSegments = []struct {
+	name  string
+	send  func(conn *RAWConn, layer *pktLayers) error
+	clock bool // the segment carries tsNow
+	want  string
+	seg   hsSegment
+	opts  peerOptions
+	mss   int
+}{
+	{
+		name:  "syn",
+		send:  func(conn *RAWConn, layer *pktLayers) error { return conn.sendSynWithLayer(layer) },
+		clock: true,
+		want:  "9c4001bb010203040a0b0c0da002312400000000020405b40303050402080a000000000000000000",
+		seg:   hsSegment{syn: true, seq: conformanceSeq, ackn: conformanceAck},
+		opts:  peerOptions{seen: true, sack: true, timestamps: true, wscale: windowScale},
+		mss:   1460,
+	},
+	{
+		name: "synack",
+		send: func(conn *RAWConn, layer *pktLayers) error {
+			return conn.sendSynAckWithLayer(layer, 1400, peerOptions{seen: true, sack: true, timestamps: true, tsval: 77, wscale: 7})
+		},
+		clock: true,
+		want:  "9c4001bb010203040a0b0c0da012312400000000020405780303050402080a000000000000004d00",
+		seg:   hsSegment{syn: true, ack: true, seq: conformanceSeq, ackn: conformanceAck},
+		opts:  peerOptions{seen: true, sack: true, timestamps: true, wscale: windowScale},
+		mss:   1400,
+	},
+	{
+		name: "synack to a bare syn",
+		send: func(conn *RAWConn, layer *pktLayers) error {
+			return conn.sendSynAckWithLayer(layer, 1400, peerOptions{seen: true, wscale: -1})
+		},
+		want: "9c4001bb010203040a0b0c0d601231240000000002040578",
+		seg:  hsSegment{syn: true, ack: true, seq: conformanceSeq, ackn: conformanceAck},
+		opts: peerOptions{seen: true, wscale: -1},
+		mss:  1400,
+	},
+	{
+		name: "ack",
+		send: func(conn *RAWConn, layer *pktLayers) error { return conn.sendAckWithLayer(layer) },
+		want: "9c4001bb010203040a0b0c0d5010312400000000",
+		seg:  hsSegment{ack: true, seq: conformanceSeq, ackn: conformanceAck},
+		opts: peerOptions{seen: true, wscale: -1},
+	},
+	{
+		name: "rtt probe",
+		send: func(conn *RAWConn, layer *pktLayers) error { return conn.sendTimestampsWithLayer(layer, 5, 6) },
+		want: "9c4001bb010203040a0b0c0d8010312400000000080a00000005000000060000",
+		seg:  hsSegment{ack: true, seq: conformanceSeq, ackn: conformanceAck},
+		opts: peerOptions{seen: true, timestamps: true, tsval: 5, wscale: -1},
+	},
+	{
+		name: "request",
+		send: func(conn *RAWConn, layer *pktLayers) error {
+			_, err := conn.writeWithLayer([]byte("POST / HTTP/1.1\r\n\r\n"), layer)
+			return err
+		},
+		want: "9c4001bb010203040a0b0c0d5018312400000000504f5354202f20485454502f312e310d0a0d0a",
+		seg:  hsSegment{ack: true, psh: true, seq: conformanceSeq, ackn: conformanceAck, n: 19},
+		opts: peerOptions{seen: true, wscale: -1},
+	},
+	{
+		name: "fin",
+		send: func(conn *RAWConn, layer *pktLayers) error {
+			// after data, which must not leave its flags behind
+			conn.writeWithLayer([]byte("data"), layer)
+			return conn.sendFin()
+		},
+		want: "9c4001bb010203040a0b0c0d5001312400000000",
+		seg:  hsSegment{fin: true, seq: conformanceSeq, ackn: conformanceAck},
+		opts: peerOptions{seen: true, wscale: -1},
+	},
+	{
+		name: "rst",
+		send: func(conn *RAWConn, layer *pktLayers) error {
+			conn.writeWithLayer([]byte("data"), layer)
+			return conn.sendRst()
+		},
+		want: "9c4001bb010203040a0b0c0d5004312400000000",
+		seg:  hsSegment{seq: conformanceSeq, ackn: conformanceAck},
+		opts: peerOptions{seen: true, wscale: -1},
+	},
+}
+
+// conformanceMask zeroes the checksum of seg, and the timestamp value of
+// its timestamps option if clock.
+func conformanceMask(seg []byte, clock bool) {
+	seg[16], seg[17] = 0, 0
+	if ts := conformanceTimestamps(seg); clock && ts != nil {
+		copy(ts[:4], []byte{0, 0, 0, 0})
+	}
+}
+
+// conformanceTimestamps returns the value and the echo reply of the timestamps
+// option of seg, or nil.
+func conformanceTimestamps(seg []byte) []byte {
+	opts := seg[20 : int(seg[12]>>4)*4]
+	for len(opts) > 1 && opts[0] != 0 {
+		if opts[0] == 1 {
+			opts = opts[1:]
+			continue
+		}
+		l := int(opts[1])
+		if l < 2 || l > len(opts) {
+			return nil
+		}
+		if opts[0] == 8 && l == 10 {
+			return opts[2:10]
+		}
+		opts = opts[l:]
+	}
+	return nil
+}
+
+func TestConformance(t *testing.T) {
+	for _, c := range conformanceSegments {
+		var segs [][]byte
+		conn, layer := conformanceConn(func(seg []byte) { segs = append(segs, seg) })
+		if err := c.send(conn, layer); err != nil {
+			t.Errorf("%s: %v", c.name, err)
+			continue
+		}
+		if len(segs) == 0 {
+			t.Errorf("%s: nothing sent", c.name)
+			continue
+		}
+		seg := segs[len(segs)-1]
+		seg0 := append([]byte(nil), seg...)
+		conformanceMask(seg, c.clock)
+		if got := hex.EncodeToString(seg); got != c.want {
+			t.Errorf("%s: sent\n%s\nwant\n%s", c.name, got, c.want)
+		}
+		hs, opts, mss := conformanceRead(t, seg0)
+		if hs != c.seg {
+			t.Errorf("%s: read as %+v, want %+v", c.name, hs, c.seg)
+		}
+		if c.clock {
+			opts.tsval = 0
+		}
+		if opts != c.opts || mss != c.mss {
+			t.Errorf("%s: options read as %+v and MSS %d, want %+v and %d", c.name, opts, mss, c.opts, c.mss)
+		}
+	}
+}
+
+var update = flag.Bool("update", false, "record the handshakes of testdata/conformance again")
+
+// The handshakes below go over a pipe with a seeded Rand on both sides, so
+// that a build sends the same packets every time. Each build records its
+// own in testdata/conformance/<flavor> with -update, and must send and
+// answer exactly what the others recorded: the clock is all that is left
+// out, the timestamps and the time in the random of the TLS hellos, and
+// the checksums that cover them.
+var conformanceHandshakes = []struct {
+	name    string
+	raw     Raw
+	address string
+}{
+	{"nohttp", Raw{NoHTTP: true}, "127.0.0.1:6883"},
+	{"http", Raw{Hosts: []string{"www.example.com"}}, "127.0.0.1:6884"},
+	{"tls", Raw{TLS: true, Hosts: []string{"www.example.com"}}, "127.0.0.1:6885"},
+	{"udp2raw", Raw{Udp2raw: true}, "127.0.0.1:6886"},
+}
+
+// conformanceRecorder keeps the packets a dialer writes and reads, as
+// lines of hex after > and < in turn.
+type conformanceRecorder struct {
+	PacketIO
+	mu    sync.Mutex
+	lines []string
+}
+
+func (rec *conformanceRecorder) add(dir string, b []byte) {
+	pkt := append([]byte(nil), b...)
+	conformancePacketMask(pkt)
+	rec.mu.Lock()
+	rec.lines = append(rec.lines, dir+" "+hex.EncodeToString(pkt))
+	rec.mu.Unlock()
+}
+
+func (rec *conformanceRecorder) ReadPacketData() ([]byte, error) {
+	b, err := rec.PacketIO.ReadPacketData()
+	if err == nil {
+		rec.add("<", b)
+	}
+	return b, err
+}
+
+func (rec *conformanceRecorder) WritePacketData(b []byte) error {
+	rec.add(">", b)
+	return rec.PacketIO.WritePacketData(b)
+}
+
+func (rec *conformanceRecorder) transcript() []string {
+	rec.mu.Lock()
+	defer rec.mu.Unlock()
+	return append([]string(nil), rec.lines...)
+}
+
+// conformancePacketMask zeroes what depends on the clock in the IPv4
+// packet pkt: the timestamps, the first four bytes of the random of a TLS
+// hello, and the checksums.
+func conformancePacketMask(pkt []byte) {
+	pkt[10], pkt[11] = 0, 0
+	seg := pkt[int(pkt[0]&0xf)*4:]
+	conformanceMask(seg, false)
+	if ts := conformanceTimestamps(seg); ts != nil {
+		copy(ts, make([]byte, 8))
+	}
+	payload := seg[int(seg[12]>>4)*4:]
+	if len(payload) >= 15 && payload[0] == 0x16 && (payload[5] == 1 || payload[5] == 2) {
+		copy(payload[11:15], []byte{0, 0, 0, 0})
+	}
+}
+
+// conformanceHandshake dials an echoing listener of r over a pipe, has
+// one datagram echoed, and returns the packets the dialer saw.
+func conformanceHandshake(t *testing.T, r Raw, address string) []string {
+	lr, dr := r, r
+	lr.Rand = rand.New(rand.NewSource(1))
+	dr.Rand = rand.New(rand.NewSource(2))
+	dr.LocalPort = "46300"
+	client, server := NewPacketPipe()
+	rec := &conformanceRecorder{PacketIO: client}
+	dr.PacketIO = rec
+	listener := echoServer(t, lr, server, address)
+	defer listener.Close()
+	conn, err := dr.DialRAW(address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err = conn.Write([]byte("conformance")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = conn.Read(make([]byte, 2048)); err != nil {
+		t.Fatal(err)
+	}
+	return rec.transcript()
+}
+
+func readConformance(path string) ([]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var lines []string
+	sc := bufio.NewScanner(f)
+	sc.Buffer(nil, 1<<16)
+	for sc.Scan() {
+		lines = append(lines, sc.Text())
+	}
+	return lines, sc.Err()
+}
+
+func TestConformanceHandshakes(t *testing.T) {
+	for _, c := range conformanceHandshakes {
+		t.Run(c.name, func(t *testing.T) {
+			got := conformanceHandshake(t, c.raw, c.address)
+			if *update {
+				path := filepath.Join("testdata", "conformance", conformanceFlavor, c.name+".txt")
+				if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+					t.Fatal(err)
+				}
+				if err := os.WriteFile(path, []byte(strings.Join(got, "\n")+"\n"), 0644); err != nil {
+					t.Fatal(err)
+				}
+			}
+			paths, _ := filepath.Glob(filepath.Join("testdata", "conformance", "*", c.name+".txt"))
+			if len(paths) == 0 {
+				t.Fatal("no build recorded it")
+			}
+			for _, path := range paths {
+				want, err := readConformance(path)
+				if err != nil {
+					t.Fatal(err)
+				}
+				flavor := filepath.Base(filepath.Dir(path))
+				if strings.Join(got, "\n") != strings.Join(want, "\n") {
+					t.Errorf("sent and read\n%s\nthe %s build recorded\n%s", strings.Join(got, "\n"), flavor, strings.Join(want, "\n"))
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,69 @@
+package rawcon
+
+import (
+	"net"
+	"sync/atomic"
+	"time"
+
+	"github.com/biotooff/rawcon/utils"
+)
+
+// writeDeadline holds the write deadline of a connection or a listener and
+// has Write and WriteTo fail once it passed.
+type writeDeadline struct {
+	t    atomic.Int64 // in UnixNano, zero for none
+	busy atomic.Bool  // a send of Raw.BestEffortWrite is under way
+}
+
+func (d *writeDeadline) set(t time.Time) {
+	if t.IsZero() {
+		d.t.Store(0)
+		return
+	}
+	d.t.Store(t.UnixNano())
+}
+
+// get returns the deadline, the zero time for none.
+func (d *writeDeadline) get() time.Time {
+	if t := d.t.Load(); t != 0 {
+		return time.Unix(0, t)
+	}
+	return time.Time{}
+}
+
+// write queues b in q if set, see Raw.SendQueue, or hands it to send. The
+// deadline holds for the pacing of send as well, which gives up before
+// sending anything rather than wait past it: a write that timed out was
+// never sent, and retrying it duplicates nothing. With Raw.BestEffortWrite
+// b is dropped while the previous one is being sent, and write never waits
+// for send.
+func (d *writeDeadline) write(r *Raw, q *sendQueue, addr func() net.Addr, b []byte, send func(b []byte, deadline time.Time) (int, error)) (n int, err error) {
+	t := d.t.Load()
+	if t == 0 && q == nil && !r.BestEffortWrite {
+		return send(b, time.Time{})
+	}
+	var deadline time.Time
+	if t != 0 {
+		if deadline = time.Unix(0, t); !deadline.After(time.Now()) {
+			return 0, &timeoutErr{op: "write to " + addr().String()}
+		}
+	}
+	if q != nil {
+		return q.push(deadline, addr, b, func(b []byte) (int, error) {
+			return send(b, time.Time{})
+		})
+	}
+	if r.BestEffortWrite {
+		if d.busy.CompareAndSwap(false, true) {
+			buf := utils.GetBuf(len(b))
+			copy(buf, b)
+			go func() {
+				defer d.busy.Store(false)
+				defer utils.PutBuf(buf)
+				send(buf, time.Time{})
+			}()
+		}
+		return len(b), nil
+	}
+	return send(b, deadline)
+}
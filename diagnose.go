@@ -0,0 +1,190 @@
+package rawcon
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"net"
+	"os/exec"
+	"runtime"
+	"strings"
+	"time"
+)
+
+// Most of what goes wrong with rawcon is the host: no permission to capture
+// or to send raw packets, a firewall answering the segments of the peer
+// with RSTs, or a gateway that cannot be found. Diagnose checks for these
+// before a connection fails in a way that does not tell.
+
+// diagnoseTimeout bounds the echo of the loopback check.
+const diagnoseTimeout = 5 * time.Second
+
+// Check is the outcome of one of the checks of Diagnose.
+type Check struct {
+	// Name is "capture", "inject", "rst", "loopback" or "gateway".
+	Name string
+	// Detail says what was found, e.g. the interface or the gateway.
+	Detail string
+	// Err is why the check failed, nil if it passed.
+	Err error
+}
+
+// Diagnosis is the report of Diagnose.
+type Diagnosis struct {
+	Checks []Check
+}
+
+// OK tells whether every check passed.
+func (d *Diagnosis) OK() bool {
+	for _, c := range d.Checks {
+		if c.Err != nil {
+			return false
+		}
+	}
+	return true
+}
+
+// String returns the report with a line for every check.
+func (d *Diagnosis) String() string {
+	var b strings.Builder
+	for _, c := range d.Checks {
+		if c.Err != nil {
+			fmt.Fprintf(&b, "%-8s FAIL %v\n", c.Name, c.Err)
+		} else {
+			fmt.Fprintf(&b, "%-8s ok   %s\n", c.Name, c.Detail)
+		}
+	}
+	return b.String()
+}
+
+func (d *Diagnosis) add(name string, detail string, err error) {
+	d.Checks = append(d.Checks, Check{Name: name, Detail: detail, Err: err})
+}
+
+// Diagnose checks whether the host lets r dial address, the peer to reach
+// being only asked for the hardware address of the gateway. It checks that
+// the capture opens, that packets can be sent, that the RSTs the system
+// answers the segments of the peer with are dropped, that a connection over
+// loopback echoes and that the gateway towards address is found. With
+// Raw.PacketIO set the host is not involved, only the loopback check is
+// run, over a PacketPipe.
+func (r *Raw) Diagnose(address string) *Diagnosis {
+	d := &Diagnosis{}
+	if r.PacketIO != nil {
+		detail, err := r.diagnoseLoopback()
+		d.add("loopback", detail, err)
+		return d
+	}
+	local, remote, err := r.diagnoseRoute(address)
+	if err != nil {
+		d.add("capture", "", err)
+		d.add("inject", "", err)
+	} else {
+		detail, err := r.diagnoseCapture(local)
+		d.add("capture", detail, err)
+		detail, err = r.diagnoseInject(local, remote)
+		d.add("inject", detail, err)
+	}
+	detail, err := diagnoseRST()
+	d.add("rst", detail, err)
+	detail, err = r.diagnoseLoopback()
+	d.add("loopback", detail, err)
+	if local == nil {
+		d.add("gateway", "", errors.New("no route to "+address))
+	} else {
+		detail, err = r.diagnoseGateway(local, remote)
+		d.add("gateway", detail, err)
+	}
+	return d
+}
+
+// diagnoseRoute returns the local address of a connection to address and
+// the address of the peer.
+func (r *Raw) diagnoseRoute(address string) (local, remote net.IP, err error) {
+	uaddr, err := net.ResolveUDPAddr("udp4", address)
+	if err != nil {
+		return
+	}
+	if local, err = r.routeIPv4(address); err != nil {
+		return
+	}
+	return local, uaddr.IP, nil
+}
+
+// diagnoseRST checks that the firewall rawcon drops the RSTs of the system
+// with can be used.
+func diagnoseRST() (string, error) {
+	switch runtime.GOOS {
+	case "linux":
+		if out, err := exec.Command("iptables", "-S", "OUTPUT").CombinedOutput(); err != nil {
+			return "", fmt.Errorf("iptables cannot drop the RSTs of the system: %w", commandError(err, out))
+		}
+		return "iptables drops the RSTs of the system", nil
+	case "darwin":
+		if out, err := exec.Command("pfctl", "-s", "info").CombinedOutput(); err != nil {
+			return "", fmt.Errorf("pf cannot drop the RSTs of the system: %w", commandError(err, out))
+		}
+		return "pf drops the RSTs of the system", nil
+	}
+	return "", errors.New("nothing drops the RSTs the system answers the segments of the peer with, a firewall rule or IgnRST on the peer has to")
+}
+
+// commandError adds what a command printed to err.
+func commandError(err error, out []byte) error {
+	if out = bytes.TrimSpace(out); len(out) == 0 {
+		return err
+	}
+	return fmt.Errorf("%w: %s", err, out)
+}
+
+// diagnoseLoopback dials a listener on loopback and has it echo.
+func (r *Raw) diagnoseLoopback() (string, error) {
+	pc, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	if err != nil {
+		return "", err
+	}
+	address := pc.LocalAddr().String()
+	pc.Close()
+	lr, dr := *r, *r
+	if r.PacketIO != nil {
+		client, server := NewPacketPipe()
+		defer client.Close()
+		defer server.Close()
+		lr.PacketIO, dr.PacketIO = server, client
+	}
+	dr.Retry = &RetryPolicy{Attempts: 3}
+	listener, err := lr.ListenRAW(address)
+	if err != nil {
+		return "", err
+	}
+	defer listener.Close()
+	go func() {
+		buf := make([]byte, 2048)
+		for {
+			n, addr, err := listener.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			listener.WriteTo(buf[:n], addr)
+		}
+	}()
+	conn, err := dr.DialRAW(address)
+	if err != nil {
+		return "", err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(diagnoseTimeout))
+	msg := []byte("rawcon diagnose")
+	if _, err = conn.Write(msg); err != nil {
+		return "", err
+	}
+	buf := make([]byte, 2048)
+	n, err := conn.Read(buf)
+	if err != nil {
+		return "", err
+	}
+	if !bytes.Equal(buf[:n], msg) {
+		return "", errors.New("the echo over loopback came back garbled")
+	}
+	return "echoed over " + address, nil
+}
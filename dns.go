@@ -0,0 +1,196 @@
+package rawcon
+
+import (
+	"encoding/binary"
+	"strings"
+
+	"github.com/biotooff/rawcon/utils"
+)
+
+// With Raw.DNS the connection poses as DNS over TCP, as on port 53. The
+// handshake is a query for an A record of the host name, with the session
+// token, if any, as the server cookie of an EDNS COOKIE option, and its
+// answer. Then every segment of data is a message of its own: the 16 bit
+// length of TCP DNS, a header with a random ID that says query from the
+// dialer and response from the listener, and the data.
+
+const (
+	dnsHeaderLen = 12
+	// dnsRecordLen is what a segment of data spends on the framing
+	dnsRecordLen = 2 + dnsHeaderLen
+
+	dnsFlagQR       = 0x8000
+	dnsQueryFlags   = 0x0100 // recursion desired
+	dnsAnswerFlags  = 0x8180 // recursion desired and available
+	dnsTypeA        = 1
+	dnsTypeOPT      = 41
+	dnsClassIN      = 1
+	dnsOptionCookie = 10
+	dnsClientCookie = 8
+)
+
+var dnsNames = []string{"www.google.com", "www.cloudflare.com", "www.microsoft.com", "www.apple.com", "www.amazon.com"}
+
+// putDNSHeader writes a header with a random ID at the start of b.
+func putDNSHeader(rnd utils.Random, b []byte, flags, qd, an, ar uint16) {
+	binary.BigEndian.PutUint16(b, uint16(rnd.Intn(1<<16)))
+	binary.BigEndian.PutUint16(b[2:], flags)
+	binary.BigEndian.PutUint16(b[4:], qd)
+	binary.BigEndian.PutUint16(b[6:], an)
+	binary.BigEndian.PutUint16(b[8:], 0)
+	binary.BigEndian.PutUint16(b[10:], ar)
+}
+
+// appendDNSName appends name in the wire format, a random well-known one if
+// it is empty or not a valid name.
+func appendDNSName(rnd utils.Random, b []byte, name string) []byte {
+	if i := strings.LastIndexByte(name, ':'); i >= 0 {
+		name = name[:i]
+	}
+	labels := strings.Split(strings.TrimSuffix(name, "."), ".")
+	for _, l := range labels {
+		if len(l) == 0 || len(l) > 63 {
+			return appendDNSName(rnd, b, dnsNames[rnd.Intn(len(dnsNames))])
+		}
+	}
+	for _, l := range labels {
+		b = append(b, byte(len(l)))
+		b = append(b, l...)
+	}
+	return append(b, 0)
+}
+
+// dnsQuery returns the handshake of a dialer asking for host, carrying the
+// session token of sid.
+func (r *Raw) dnsQuery(host string, sid []byte) []byte {
+	rnd := r.random()
+	b := make([]byte, 2+dnsHeaderLen, 512)
+	putDNSHeader(rnd, b[2:], dnsQueryFlags, 1, 0, 1)
+	b = appendDNSName(rnd, b, host)
+	b = binary.BigEndian.AppendUint16(b, dnsTypeA)
+	b = binary.BigEndian.AppendUint16(b, dnsClassIN)
+	cookie := make([]byte, dnsClientCookie)
+	rnd.Read(cookie)
+	cookie = append(cookie, r.sessionToken(sid)...)
+	// the OPT record: root name, UDP size, no extended rcode nor flags
+	b = append(b, 0)
+	b = binary.BigEndian.AppendUint16(b, dnsTypeOPT)
+	b = binary.BigEndian.AppendUint16(b, 4096)
+	b = append(b, 0, 0, 0, 0)
+	b = binary.BigEndian.AppendUint16(b, uint16(4+len(cookie)))
+	b = binary.BigEndian.AppendUint16(b, dnsOptionCookie)
+	b = binary.BigEndian.AppendUint16(b, uint16(len(cookie)))
+	b = append(b, cookie...)
+	binary.BigEndian.PutUint16(b, uint16(len(b)-2))
+	return b
+}
+
+// dnsMessage returns the message of b, its length excluded, or fails if b
+// is not a whole one.
+func dnsMessage(b []byte) ([]byte, bool) {
+	if len(b) < dnsRecordLen || int(binary.BigEndian.Uint16(b)) != len(b)-2 {
+		return nil, false
+	}
+	return b[2:], true
+}
+
+// skipDNSName returns the length of the name at the start of b, zero if it
+// is not a valid one. Compressed names are only allowed at the end.
+func skipDNSName(b []byte) int {
+	for i := 0; i < len(b); {
+		switch l := int(b[i]); {
+		case l == 0:
+			return i + 1
+		case l&0xc0 == 0xc0:
+			if i+2 > len(b) {
+				return 0
+			}
+			return i + 2
+		case l > 63:
+			return 0
+		default:
+			i += 1 + l
+		}
+	}
+	return 0
+}
+
+// parseDNSQuery returns the question of a handshake query and the session
+// token in its cookie, nil if there is none.
+func parseDNSQuery(b []byte) (question, token []byte, ok bool) {
+	m, ok := dnsMessage(b)
+	if !ok || binary.BigEndian.Uint16(m[2:])&dnsFlagQR != 0 || binary.BigEndian.Uint16(m[4:]) != 1 {
+		return nil, nil, false
+	}
+	rest := m[dnsHeaderLen:]
+	n := skipDNSName(rest)
+	if n == 0 || len(rest) < n+4 {
+		return nil, nil, false
+	}
+	question, rest = rest[:n+4], rest[n+4:]
+	// the OPT record, if any
+	if binary.BigEndian.Uint16(m[10:]) == 1 && len(rest) >= 11 && rest[0] == 0 &&
+		binary.BigEndian.Uint16(rest[1:]) == dnsTypeOPT {
+		opts := rest[11:]
+		if l := int(binary.BigEndian.Uint16(rest[9:])); l <= len(opts) {
+			opts = opts[:l]
+		}
+		for len(opts) >= 4 {
+			code, l := binary.BigEndian.Uint16(opts), int(binary.BigEndian.Uint16(opts[2:]))
+			if 4+l > len(opts) {
+				break
+			}
+			if code == dnsOptionCookie && l > dnsClientCookie {
+				token = opts[4+dnsClientCookie : 4+l]
+			}
+			opts = opts[4+l:]
+		}
+	}
+	return question, token, true
+}
+
+// dnsAnswer returns the reply of the listener to a query with question: a
+// random address for the name.
+func dnsAnswer(rnd utils.Random, question []byte) []byte {
+	b := make([]byte, 2+dnsHeaderLen, 2+dnsHeaderLen+len(question)+16)
+	putDNSHeader(rnd, b[2:], dnsAnswerFlags, 1, 1, 0)
+	b = append(b, question...)
+	// the name of the question, pointed to
+	b = append(b, 0xc0, dnsHeaderLen)
+	b = binary.BigEndian.AppendUint16(b, dnsTypeA)
+	b = binary.BigEndian.AppendUint16(b, dnsClassIN)
+	b = binary.BigEndian.AppendUint32(b, uint32(60+rnd.Intn(3540)))
+	b = binary.BigEndian.AppendUint16(b, 4)
+	b = binary.BigEndian.AppendUint32(b, rnd.Uint32())
+	binary.BigEndian.PutUint16(b, uint16(len(b)-2))
+	return b
+}
+
+// isDNSAnswer tells whether b is the reply to the handshake of a dialer.
+func isDNSAnswer(b []byte) bool {
+	m, ok := dnsMessage(b)
+	return ok && binary.BigEndian.Uint16(m[2:])&dnsFlagQR != 0 && binary.BigEndian.Uint16(m[6:]) > 0
+}
+
+// sealDNS returns b in a message of its own, a query if it goes from the
+// dialer, in a buffer of utils.GetBuf.
+func sealDNS(rnd utils.Random, b []byte, response bool) []byte {
+	buf := utils.GetBuf(dnsRecordLen + len(b))
+	binary.BigEndian.PutUint16(buf, uint16(dnsHeaderLen+len(b)))
+	if response {
+		putDNSHeader(rnd, buf[2:], dnsAnswerFlags, 0, 1, 0)
+	} else {
+		putDNSHeader(rnd, buf[2:], dnsQueryFlags, 1, 0, 0)
+	}
+	copy(buf[dnsRecordLen:], b)
+	return buf
+}
+
+// openDNS returns the data of a message of sealDNS.
+func openDNS(b []byte) ([]byte, bool) {
+	m, ok := dnsMessage(b)
+	if !ok {
+		return nil, false
+	}
+	return m[dnsHeaderLen:], true
+}
@@ -0,0 +1,72 @@
+package rawcon
+
+import (
+	"net"
+	"time"
+)
+
+// defaultCaptureBuffer is taken for the size of a capture buffer left to
+// the system, the one of libpcap on Linux, when Raw.MaxCaptureBuffer grows
+// it.
+const defaultCaptureBuffer = 2 << 20
+
+// capture is what Raw.DropWatch looks at, a connection or a listener.
+type capture interface {
+	CaptureStats() (CaptureStats, error)
+	growCapture(bytes int) error
+}
+
+// startDropWatch has c looked at every Raw.DropWatch until die is closed.
+// addr is the peer of the events, nil for a listener.
+func (r *Raw) startDropWatch(die <-chan struct{}, addr net.Addr, c capture) {
+	if r.DropWatch <= 0 {
+		return
+	}
+	go r.watchDrops(die, addr, c)
+}
+
+func (r *Raw) watchDrops(die <-chan struct{}, addr net.Addr, c capture) {
+	ticker := time.NewTicker(r.DropWatch)
+	defer ticker.Stop()
+	buffer := r.CaptureBuffer
+	if buffer <= 0 {
+		buffer = defaultCaptureBuffer
+	}
+	grow := r.MaxCaptureBuffer > buffer
+	last := 0
+	for {
+		select {
+		case <-die:
+			return
+		case <-ticker.C:
+		}
+		stats, err := c.CaptureStats()
+		if err != nil {
+			// BSD counts nothing
+			return
+		}
+		if stats.Dropped < last {
+			// a handle reopened by a migration
+			last = 0
+		}
+		n := stats.Dropped - last
+		last = stats.Dropped
+		if n == 0 {
+			continue
+		}
+		r.emit(Event{Type: EventCaptureDrop, Addr: addr, Dropped: n})
+		if !grow {
+			continue
+		}
+		buffer = min(buffer*2, r.MaxCaptureBuffer)
+		if err = c.growCapture(buffer); err != nil {
+			grow = false
+			continue
+		}
+		grow = buffer < r.MaxCaptureBuffer
+		// a new handle counts from zero
+		if stats, err = c.CaptureStats(); err == nil {
+			last = stats.Dropped
+		}
+	}
+}
@@ -0,0 +1,83 @@
+package rawcon
+
+import (
+	"net"
+	"time"
+)
+
+// tosByte puts the ECN codepoint ecn into the TOS byte dscp, which is
+// given like Raw.DSCP.
+func tosByte(dscp int, ecn ECN) int {
+	if ecn == NotECT {
+		return dscp
+	}
+	return dscp&^int(CE) | int(ecn)
+}
+
+// SetDSCP changes the TOS byte, given like Raw.DSCP, of the packets conn
+// sends from now on. For a listener it applies to all of its peers.
+func (conn *RAWConn) SetDSCP(dscp int) {
+	conn.dscp.Store(int32(dscp) + 1)
+	conn.applyTOS()
+}
+
+// tos returns the TOS byte of the packets conn sends.
+func (conn *RAWConn) tos() int {
+	if d := conn.dscp.Load(); d != 0 {
+		return tosByte(int(d-1), conn.r.ECN)
+	}
+	return conn.r.tos()
+}
+
+// tosOf returns the TOS byte of a packet given override, the one asked for
+// plus one or zero.
+func (conn *RAWConn) tosOf(override int) int {
+	if override != 0 {
+		return override - 1
+	}
+	return conn.tos()
+}
+
+// WriteToDSCP is WriteTo with the TOS byte of the packet given like
+// Raw.DSCP, e.g. to mark interactive traffic apart from bulk traffic. The
+// datagram is never coalesced with others. With Raw.Shape it is queued with
+// the others and the TOS byte is ignored.
+func (conn *RAWConn) WriteToDSCP(b []byte, addr net.Addr, dscp int) (n int, err error) {
+	if err = conn.resetErr("write"); err != nil {
+		return
+	}
+	if err = conn.pathErr("write"); err != nil {
+		return
+	}
+	if limit := payloadLimit(conn.mss, recordLen(conn.r.TLS, conn.r.profile()), conn.u2r, conn.pad); len(b) > limit {
+		return 0, &MessageTooLongError{Size: len(b), Limit: limit}
+	}
+	if conn.shaper != nil {
+		return len(b), conn.shaper.write(b)
+	}
+	tos := tosByte(dscp, conn.r.ECN) + 1
+	return conn.wdeadline.write(conn.r, conn.squeue, conn.RemoteAddr, b, func(b []byte, deadline time.Time) (int, error) {
+		return conn.writeSegment(b, tos, deadline)
+	})
+}
+
+// WriteToDSCP is WriteTo with the TOS byte of the packet given like
+// Raw.DSCP.
+func (listener *RAWListener) WriteToDSCP(b []byte, addr net.Addr, dscp int) (n int, err error) {
+	listener.mutex.RLock()
+	info, ok := listener.connByAddr(addr.String())
+	listener.mutex.RUnlock()
+	if !ok {
+		return 0, &AddrError{Op: "write", Addr: addr, Err: ErrNoConn}
+	}
+	if limit := info.payloadLimit(); len(b) > limit {
+		return 0, &MessageTooLongError{Size: len(b), Limit: limit}
+	}
+	if info.shaper != nil {
+		return len(b), info.shaper.write(b)
+	}
+	tos := tosByte(dscp, listener.r.ECN) + 1
+	return listener.wdeadline.write(listener.r, info.squeue, func() net.Addr { return addr }, b, func(b []byte, deadline time.Time) (int, error) {
+		return listener.writeSegment(b, info, tos, deadline)
+	})
+}
@@ -0,0 +1,79 @@
+package rawcon
+
+import (
+	"github.com/biotooff/rawcon/utils"
+)
+
+// The segments of data a dialer sends right behind its handshake request,
+// with ZeroRTT, can overtake it. A listener holds those of a peer whose
+// request has not come yet, up to maxEarlyData bytes, and reads them once it
+// has answered the request, the framing of the data being known only then.
+
+// maxEarlyData bounds the data held for a peer before its request.
+const maxEarlyData = 16 << 10
+
+// holdEarly keeps a copy of the segment payload that came before the
+// request, if there is room.
+func (info *connInfo) holdEarly(payload []byte) {
+	if info.earlyLen+len(payload) > maxEarlyData {
+		return
+	}
+	info.early = append(info.early, append([]byte(nil), payload...))
+	info.earlyLen += len(payload)
+}
+
+// takeEarly returns the segments held and forgets them.
+func (info *connInfo) takeEarly() [][]byte {
+	early := info.early
+	info.early, info.earlyLen = nil, 0
+	return early
+}
+
+// openSegment returns the data in the payload of a segment of the peer of
+// info, without the framing of the handshake and the padding.
+func (info *connInfo) openSegment(payload []byte) ([]byte, bool) {
+	var ok bool
+	if info.tls {
+		if len(payload) < 5 {
+			return nil, false
+		}
+		payload = payload[5:]
+	} else if info.prof != profileNone {
+		if payload, ok = info.prof.open(payload); !ok {
+			return nil, false
+		}
+	}
+	if info.pad > 0 {
+		if payload, ok = unpadSegment(payload); !ok {
+			return nil, false
+		}
+	}
+	return payload, true
+}
+
+// releaseEarly reads the segments held for the peer of info until its
+// request was answered: the first datagram goes into b, the others are
+// queued to be read next. ok is false if there was none.
+func (listener *RAWListener) releaseEarly(b []byte, info *connInfo, early [][]byte) (n int, ok bool) {
+	var buf []byte
+	for _, seg := range early {
+		payload, valid := info.openSegment(seg)
+		if !valid {
+			continue
+		}
+		if !ok {
+			n, ok = listener.deliver(b, info.addr, payload)
+			continue
+		}
+		if buf == nil {
+			buf = utils.GetBuf(65536)
+			defer utils.PutBuf(buf)
+		}
+		// the rest of a coalesced segment is queued by deliver
+		at := listener.rqueue.queued()
+		if m, delivered := listener.deliver(buf, info.addr, payload); delivered {
+			listener.rqueue.insert(at, info.addr, buf[:m], listener.r.QueueLen)
+		}
+	}
+	return
+}
@@ -0,0 +1,34 @@
+package rawcon
+
+import "net"
+
+// ECN is an ECN codepoint, the two low bits of the TOS byte.
+type ECN int
+
+const (
+	NotECT ECN = 0
+	ECT1   ECN = 1
+	ECT0   ECN = 2
+	// CE is set by a congested router on a packet that was ECT.
+	CE ECN = 3
+)
+
+// tos returns the TOS byte of the packets r sends.
+func (r *Raw) tos() int {
+	return tosByte(r.DSCP, r.ECN)
+}
+
+// checkCE counts a packet from addr if a router marked it CE on the way.
+func (conn *RAWConn) checkCE(tos uint8, addr net.Addr) {
+	if ECN(tos)&CE != CE {
+		return
+	}
+	conn.ce.Add(1)
+	conn.r.event(EventCongestion, addr)
+}
+
+// CEMarks returns the number of packets read that were marked CE. With
+// Raw.ECN set it rising is the sign the path is congested.
+func (conn *RAWConn) CEMarks() uint64 {
+	return conn.ce.Load()
+}
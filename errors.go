@@ -0,0 +1,68 @@
+package rawcon
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"time"
+)
+
+// The errors returned by connections and listeners wrap one of these when
+// they have that cause, test for them with errors.Is.
+var (
+	// ErrHandshakeTimeout means the peer did not complete the handshake
+	// in the allowed number of tries.
+	ErrHandshakeTimeout = errors.New("handshake retried too many times")
+	// ErrNoInterface means no network interface suits the address.
+	ErrNoInterface = errors.New("cannot find a suitable network interface")
+	// ErrConnReset means the peer reset the connection.
+	ErrConnReset = errors.New("connection reset by peer")
+	// ErrPeerClosed means the peer closed the connection with a FIN.
+	ErrPeerClosed = errors.New("connection closed by peer")
+	// ErrNoConn means a listener has no connection with the address.
+	ErrNoConn = errors.New("no connection with the address")
+)
+
+// AddrError is an error concerning the peer at Addr, get it with errors.As.
+type AddrError struct {
+	// Op is the operation that failed, "read" or "write".
+	Op   string
+	Addr net.Addr
+	Err  error
+}
+
+func (e *AddrError) Error() string {
+	s := e.Op
+	if e.Addr != nil {
+		s += " " + e.Addr.String()
+	}
+	return s + ": " + e.Err.Error()
+}
+
+func (e *AddrError) Unwrap() error {
+	return e.Err
+}
+
+// HandshakeError is returned by a dial whose handshake ran out of tries, it
+// wraps ErrHandshakeTimeout.
+type HandshakeError struct {
+	// Stage is the step that timed out, "syn" or "request".
+	Stage    string
+	Attempts int
+	Elapsed  time.Duration
+	// Last is the error of the last try, usually a timeout, or nil.
+	Last error
+}
+
+func (e *HandshakeError) Error() string {
+	s := fmt.Sprintf("%s: %v (%d attempts in %v)", e.Stage, ErrHandshakeTimeout,
+		e.Attempts, e.Elapsed.Round(time.Millisecond))
+	if e.Last != nil {
+		s += ": " + e.Last.Error()
+	}
+	return s
+}
+
+func (e *HandshakeError) Unwrap() error {
+	return ErrHandshakeTimeout
+}
@@ -0,0 +1,128 @@
+package rawcon
+
+import "net"
+
+// EventType is the kind of an Event.
+type EventType int
+
+const (
+	// EventReset is reported when a peer resets its connection. A dialed
+	// connection then fails every Read and Write with ErrConnReset, a
+	// listener forgets the peer.
+	EventReset EventType = iota + 1
+	// EventFailover is reported when a connection dialed with several
+	// addresses moves to the one in Addr.
+	EventFailover
+	// EventCongestion is reported for every packet read that a router
+	// marked CE, see Raw.ECN.
+	EventCongestion
+	// EventMSS is reported when the MSS of a peer changes, e.g. after a
+	// migration or a call to SetMSS, so that the size of the datagrams can
+	// follow.
+	EventMSS
+	// EventNetworkChange is reported when a connection moved to another
+	// local address or interface, see Raw.WatchNetwork.
+	EventNetworkChange
+	// EventPathError is reported when a router or the host of the peer
+	// sends an ICMP error about the flow, see Raw.ICMPErrors.
+	EventPathError
+	// EventCaptureDrop is reported when the capture dropped packets since
+	// it was last looked at, see Raw.DropWatch.
+	EventCaptureDrop
+	// EventReconnect is reported when a ReconnectingRAWConn dialed again
+	// after its connection died.
+	EventReconnect
+)
+
+func (t EventType) String() string {
+	switch t {
+	case EventReset:
+		return "reset"
+	case EventFailover:
+		return "failover"
+	case EventCongestion:
+		return "congestion"
+	case EventMSS:
+		return "mss"
+	case EventNetworkChange:
+		return "network change"
+	case EventPathError:
+		return "path error"
+	case EventCaptureDrop:
+		return "capture drop"
+	case EventReconnect:
+		return "reconnect"
+	}
+	return "unknown"
+}
+
+// Event is what Raw.OnEvent is called with.
+type Event struct {
+	Type EventType
+	// Addr is the address of the peer.
+	Addr net.Addr
+	// MSS is the new MSS of the peer, for an EventMSS.
+	MSS int
+	// Err is the *ICMPError of an EventPathError.
+	Err error
+	// Dropped is the number of packets an EventCaptureDrop is about.
+	Dropped int
+}
+
+func (r *Raw) event(typ EventType, addr net.Addr) {
+	r.emit(Event{Type: typ, Addr: addr})
+}
+
+func (r *Raw) emit(e Event) {
+	if r.OnEvent != nil {
+		r.OnEvent(e)
+	}
+}
+
+// connReset marks conn as reset by its peer, the first time it reports the
+// event, and returns the error of the read that saw the RST.
+func (conn *RAWConn) connReset() error {
+	addr := conn.RemoteAddr()
+	if conn.reset.CompareAndSwap(false, true) {
+		conn.r.event(EventReset, addr)
+	}
+	return &AddrError{Op: "read", Addr: addr, Err: ErrConnReset}
+}
+
+// resetErr returns the error of op once the peer has reset conn.
+func (conn *RAWConn) resetErr(op string) error {
+	if !conn.reset.Load() {
+		return nil
+	}
+	return &AddrError{Op: op, Addr: conn.RemoteAddr(), Err: ErrConnReset}
+}
+
+// rstInWindow tells whether a RST of sequence number seq resets conn. As in
+// RFC 5961 section 3 only one inside the receive window does, a blind
+// attacker has to guess the sequence number as well as the ports.
+func (conn *RAWConn) rstInWindow(seq uint32) bool {
+	conn.lockLayer()
+	ack := conn.layer.ack()
+	conn.unlockLayer()
+	return inWindow(seq, ack, conn.r.window(dialWindow))
+}
+
+// rstInWindow tells whether a RST of sequence number seq from the peer
+// addrstr drops it, rstInWindow of RAWConn for the peers of listener. The
+// RST of a peer it has no state for drops nothing anyway.
+func (listener *RAWListener) rstInWindow(addrstr string, seq uint32) bool {
+	var info *connInfo
+	var ok bool
+	listener.mutex.read(func() {
+		if info, ok = listener.conns[addrstr]; !ok {
+			info, ok = listener.newcons[addrstr]
+		}
+	})
+	if !ok {
+		return true
+	}
+	info.lock.Lock()
+	ack := info.layer.ack()
+	info.lock.Unlock()
+	return inWindow(seq, ack, listener.r.window(listenWindow))
+}
@@ -0,0 +1,144 @@
+package rawcon
+
+import (
+	"time"
+)
+
+// EvictReason is why a listener dropped a peer, see Raw.OnEvict.
+type EvictReason int
+
+const (
+	// EvictIdle means nothing came from the peer for Raw.IdleTimeout.
+	EvictIdle EvictReason = iota
+	// EvictTTL means the peer outlived Raw.ConnTTL.
+	EvictTTL
+	// EvictLRU means a new peer took the place of the least recently
+	// active one, see Raw.EvictLRU.
+	EvictLRU
+	// EvictCallback means Raw.EvictFunc asked for it.
+	EvictCallback
+)
+
+func (r EvictReason) String() string {
+	switch r {
+	case EvictIdle:
+		return "idle"
+	case EvictTTL:
+		return "ttl"
+	case EvictLRU:
+		return "lru"
+	case EvictCallback:
+		return "callback"
+	}
+	return "unknown"
+}
+
+// touch records that a segment came from the peer.
+func (info *connInfo) touch() {
+	info.seen.Store(time.Now().UnixNano())
+}
+
+// startEviction has the listener sweep its peers when Raw asks for it.
+func (listener *RAWListener) startEviction() {
+	r := listener.r
+	if r.IdleTimeout <= 0 && r.ConnTTL <= 0 && r.EvictFunc == nil {
+		return
+	}
+	go func() {
+		ticker := time.NewTicker(time.Second)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-listener.die:
+				return
+			case <-ticker.C:
+			}
+			listener.sweep()
+		}
+	}()
+}
+
+// sweep evicts the peers that are too old, idle for too long or that
+// Raw.EvictFunc rejects.
+func (listener *RAWListener) sweep() {
+	type peer struct {
+		key  string
+		info *connInfo
+	}
+	var peers []peer
+	listener.mutex.read(func() {
+		for _, m := range []map[string]*connInfo{listener.newcons, listener.conns} {
+			for k, info := range m {
+				peers = append(peers, peer{k, info})
+			}
+		}
+	})
+	r := listener.r
+	now := time.Now()
+	for _, p := range peers {
+		age := now.Sub(p.info.born)
+		idle := now.Sub(time.Unix(0, p.info.seen.Load()))
+		switch {
+		case r.ConnTTL > 0 && age >= r.ConnTTL:
+			listener.evict(p.key, p.info, EvictTTL)
+		case r.IdleTimeout > 0 && idle >= r.IdleTimeout:
+			listener.evict(p.key, p.info, EvictIdle)
+		case r.EvictFunc != nil && r.EvictFunc(p.info.addr, age, idle):
+			listener.evict(p.key, p.info, EvictCallback)
+		}
+	}
+}
+
+// evict drops the peer at key if info still holds it.
+func (listener *RAWListener) evict(key string, info *connInfo, reason EvictReason) {
+	var ok bool
+	listener.mutex.run(func() {
+		ok = listener.dropPeer(key, info)
+	})
+	if ok {
+		listener.evicted(info, reason)
+	}
+}
+
+// dropPeer forgets the peer at key if info still holds it, the caller must
+// hold listener.mutex.
+func (listener *RAWListener) dropPeer(key string, info *connInfo) bool {
+	if listener.newcons[key] == info {
+		delete(listener.newcons, key)
+	} else if listener.conns[key] == info {
+		listener.forgetConn(info)
+		delete(listener.conns, key)
+	} else {
+		return false
+	}
+	listener.updateFilter()
+	return true
+}
+
+// dropLRU forgets the least recently active peer of maps, the caller must
+// hold listener.mutex.
+func (listener *RAWListener) dropLRU(maps ...map[string]*connInfo) *connInfo {
+	var key string
+	var oldest *connInfo
+	for _, m := range maps {
+		for k, info := range m {
+			if oldest == nil || info.seen.Load() < oldest.seen.Load() {
+				key, oldest = k, info
+			}
+		}
+	}
+	if oldest != nil {
+		listener.dropPeer(key, oldest)
+	}
+	return oldest
+}
+
+// evicted tells a dropped peer with a FIN and reports it.
+func (listener *RAWListener) evicted(info *connInfo, reason EvictReason) {
+	info.lock.Lock()
+	listener.sendFinWithLayer(info.layer)
+	info.lock.Unlock()
+	if fn := listener.r.OnEvict; fn != nil {
+		fn(info.addr, reason)
+	}
+}
@@ -0,0 +1,63 @@
+package rawcon
+
+import (
+	"time"
+)
+
+// A connection dialed with several addresses is connected to the first one
+// that answers. Once it has received nothing for Raw.FailoverTimeout it
+// dials the next ones in turn and moves to the first that answers, like
+// Migrate does, and reports an EventFailover.
+
+const defaultFailoverTimeout = 5 * time.Second
+
+// touch records that a segment came from the peer.
+func (conn *RAWConn) touch() {
+	conn.lastRecv.Store(time.Now().UnixNano())
+}
+
+func (conn *RAWConn) idle() time.Duration {
+	return time.Since(time.Unix(0, conn.lastRecv.Load()))
+}
+
+func (conn *RAWConn) failover(addrs []string, current int) {
+	timeout := conn.r.FailoverTimeout
+	if timeout <= 0 {
+		timeout = defaultFailoverTimeout
+	}
+	if conn.r.RTTInterval <= 0 {
+		// the answers to the probes keep a healthy path busy
+		go conn.probeRTT(timeout / 4)
+	}
+	conn.touch()
+	ticker := time.NewTicker(timeout / 4)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-conn.die:
+			return
+		case <-ticker.C:
+		}
+		if conn.idle() < timeout {
+			continue
+		}
+		for i := 1; i <= len(addrs); i++ {
+			next := (current + i) % len(addrs)
+			n, err := conn.r.dial(addrs[next], conn.sid, nil)
+			if err != nil {
+				continue
+			}
+			select {
+			case <-conn.die:
+				n.Close()
+				return
+			default:
+			}
+			conn.takeOver(n)
+			conn.touch()
+			current = next
+			conn.r.event(EventFailover, conn.RemoteAddr())
+			break
+		}
+	}
+}
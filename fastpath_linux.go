@@ -0,0 +1,154 @@
+package rawcon
+
+import (
+	"net"
+
+	"github.com/biotooff/rawcon/utils"
+)
+
+// Once the handshake of a dialed connection is done its data segments go
+// out without lock. What they are built from and sent on, the headers of
+// layer and the sockets, is kept in a dataPath that is replaced whole when
+// one of them changes. Each writer takes its share of the sequence number
+// with a compare-and-swap and the reader moves the acknowledgment number up
+// the same way. The segments still built in layer, the ACKs, FINs, probes
+// and the batches, are sent under lockLayer, which holds the sequence
+// number so that the writers wait for lock until unlockLayer.
+
+// seqHeld is set in RAWConn.seq while lockLayer holds the sequence number.
+const seqHeld = 1 << 32
+
+// dataPath is a snapshot of what the data segments of a connection are
+// built from and sent on, never changed once published.
+type dataPath struct {
+	transport
+	src, dst     net.IP
+	sport, dport int
+	window       uint16
+	options      []tcpOption
+	tag          *segmentTag
+	tagAt        int // the index of the option of tag in options
+}
+
+// publishLayer has the data segments of a dialed connection go out without
+// lock, built from what layer and the sockets are now. The caller holds
+// lock, and calls it again whenever they change.
+func (raw *RAWConn) publishLayer() {
+	if raw.udp == nil {
+		return
+	}
+	l := raw.layer
+	p := &dataPath{
+		transport: raw.transport(),
+		src:       l.ip4.srcip,
+		dst:       l.ip4.dstip,
+		sport:     l.tcp.srcPort,
+		dport:     l.tcp.dstPort,
+		window:    l.tcp.window,
+		options:   append([]tcpOption(nil), l.tcp.options...),
+		tag:       l.tag,
+		tagAt:     -1,
+	}
+	for i, o := range p.options {
+		if o.kind == tcpOptionKindSegmentID {
+			p.tagAt = i
+		}
+	}
+	raw.path.Store(p)
+}
+
+// lockLayer takes lock for a segment built in layer and, once the data
+// segments go out without it, brings the sequence and acknowledgment
+// numbers of layer up to date and holds the sequence number.
+func (raw *RAWConn) lockLayer() {
+	raw.lock.Lock()
+	if raw.path.Load() == nil {
+		return
+	}
+	tcp := raw.layer.tcp
+	tcp.seqn = uint32(raw.seq.Or(seqHeld))
+	tcp.ackn = raw.ack.Load()
+	raw.heldAck = tcp.ackn
+}
+
+// unlockLayer publishes the numbers of layer and releases lock.
+func (raw *RAWConn) unlockLayer() {
+	if raw.path.Load() != nil {
+		tcp := raw.layer.tcp
+		if tcp.ackn != raw.heldAck {
+			raw.ack.Store(tcp.ackn)
+		}
+		raw.seq.Store(uint64(tcp.seqn))
+	}
+	raw.lock.Unlock()
+}
+
+// takeSeq takes n bytes of the sequence space for a data segment, false
+// while lockLayer holds the sequence number.
+func (raw *RAWConn) takeSeq(n int) (uint32, bool) {
+	for {
+		v := raw.seq.Load()
+		if v&seqHeld != 0 {
+			return 0, false
+		}
+		if raw.seq.CompareAndSwap(v, uint64(uint32(v)+uint32(n))) {
+			return uint32(v), true
+		}
+	}
+}
+
+// fastPath returns the data path b goes out on without lock with the TOS
+// byte tos minus one unless zero, nil if it has to take lock. A socket
+// that writes the IP header has to have its TOS set for the segment.
+func (raw *RAWConn) fastPath(tos int) *dataPath {
+	p := raw.path.Load()
+	if p == nil || raw.r.PacketOut != nil || (tos != 0 && p.pio == nil && p.hdr == nil) {
+		return nil
+	}
+	return p
+}
+
+// writeData sends b in the next data segment of p without lock. It
+// returns false if lockLayer holds the sequence number.
+func (raw *RAWConn) writeData(p *dataPath, b []byte, tos int) (sent bool, err error) {
+	seq, ok := raw.takeSeq(len(b))
+	if !ok {
+		return false, nil
+	}
+	tcp := tcpLayer{
+		srcPort: p.sport,
+		dstPort: p.dport,
+		seqn:    seq,
+		ackn:    raw.ack.Load(),
+		window:  p.window,
+		options: p.options,
+		payload: b,
+	}
+	tcp.setFlag(PSH | ACK)
+	if p.tag != nil && p.tagAt >= 0 {
+		var data [sessionIDLen + segmentMACLen]byte
+		copy(data[:], p.tag.data[:sessionIDLen])
+		p.tag.putMAC(data[sessionIDLen:], seq)
+		tcp.options = append(tcp.opts[:0], p.options...)
+		tcp.options[p.tagAt].data = data[:]
+	}
+	tcp.data = utils.GetBuf(len(b) + 60)
+	err = raw.transmit(p.transport, p.src, p.dst, 0, tos, tcp.marshal(p.src, p.dst))
+	utils.PutBuf(tcp.data)
+	return true, err
+}
+
+// ackTo moves the acknowledgment number of a connection whose data goes
+// out without lock past the n bytes received at seq, false if it takes
+// lock.
+func (raw *RAWConn) ackTo(seq uint32, n int) bool {
+	if raw.path.Load() == nil {
+		return false
+	}
+	for {
+		ack := raw.ack.Load()
+		if uint64(seq)+uint64(n) <= uint64(ack) || raw.ack.CompareAndSwap(ack, seq+uint32(n)) {
+			return true
+		}
+	}
+}
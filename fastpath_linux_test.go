@@ -0,0 +1,89 @@
+package rawcon
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"golang.org/x/net/ipv4"
+)
+
+// TestPipeWriteParallel writes to one connection from several goroutines,
+// with Write which goes out without lock and WriteBatch which takes it,
+// and checks every message comes back and the sequence number moved past
+// all of them. Run it with -race.
+func TestPipeWriteParallel(t *testing.T) {
+	dr, listener := pipeEchoServer(t, Raw{NoHTTP: true}, "127.0.0.1:6864")
+	defer listener.Close()
+	conn, err := dr.DialRAW("127.0.0.1:6864")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if conn.path.Load() == nil {
+		t.Fatal("the data segments take the lock")
+	}
+	start, _ := conn.seqAck()
+
+	const writers, count = 4, 50
+	want := map[string]bool{}
+	var size uint32
+	for w := 0; w < writers; w++ {
+		for i := 0; i < count; i++ {
+			msg := fmt.Sprintf("writer %d message %d", w, i)
+			want[msg] = true
+			size += uint32(len(msg))
+		}
+	}
+	got := make(chan string, len(want))
+	go func(n int) {
+		conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		buf := make([]byte, 2048)
+		for ; n > 0; n-- {
+			n, err := conn.Read(buf)
+			if err != nil {
+				close(got)
+				return
+			}
+			got <- string(buf[:n])
+		}
+		close(got)
+	}(len(want))
+
+	var wg sync.WaitGroup
+	for w := 0; w < writers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < count; i++ {
+				msg := []byte(fmt.Sprintf("writer %d message %d", w, i))
+				var err error
+				if w%2 == 1 {
+					_, err = conn.WriteBatch([]ipv4.Message{{Buffers: [][]byte{msg}}}, 0)
+				} else {
+					_, err = conn.Write(msg)
+				}
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				// keep the echoes within what the pipe queues
+				time.Sleep(time.Millisecond)
+			}
+		}(w)
+	}
+	wg.Wait()
+	for msg := range got {
+		if !want[msg] {
+			t.Fatalf("unexpected echo %q", msg)
+		}
+		delete(want, msg)
+	}
+	if len(want) != 0 {
+		t.Fatalf("%d messages did not come back", len(want))
+	}
+	if seq, _ := conn.seqAck(); seq-start != size {
+		t.Fatalf("sequence number moved by %d for %d bytes", seq-start, size)
+	}
+}
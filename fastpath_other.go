@@ -0,0 +1,19 @@
+// +build !linux
+
+package rawcon
+
+// The libpcap and BPF backends build every segment of a connection in its
+// layer under lock, their data segments included, see fastpath_linux.go
+// for the Linux one.
+
+// lockLayer takes lock for a segment built in layer.
+func (conn *RAWConn) lockLayer() {
+	conn.lock.Lock()
+}
+
+func (conn *RAWConn) unlockLayer() {
+	conn.lock.Unlock()
+}
+
+// publishLayer does nothing, the data segments take lock.
+func (conn *RAWConn) publishLayer() {}
@@ -0,0 +1,209 @@
+package rawcon
+
+import (
+	"net"
+	"time"
+
+	"github.com/biotooff/rawcon/utils"
+)
+
+// The handshakes are decided here, on segments every backend decodes its
+// own way, and the backends only carry the decisions out on their layers.
+// Deciding twice, once per build flavor, had the two drift apart: a pcap
+// dialer gave up its SYN at the first stray segment, and a pcap listener
+// acknowledged a retransmitted request twice over. The loops that read the
+// segments and act on them are in the core as well, the handshakes of a
+// dialer in handshake.go and the reads of a listener in accept.go, each
+// backend providing them with dialIO and acceptIO.
+
+// segment is a TCP segment read, as a backend decodes it for the loops of
+// the core.
+type segment struct {
+	hsSegment
+	rst     bool
+	window  uint16
+	dport   int
+	payload []byte
+	src     *net.UDPAddr
+	// dst and ttl are those of the IPv4 header, set on the reads of a
+	// listener
+	dst net.IP
+	ttl uint8
+	// tcp is the header as the backend decoded it, for its options
+	tcp *tcpHeader
+}
+
+// dialIO is what a backend provides the handshakes of a dialer with, on
+// top of the accessors of pktLayers.
+type dialIO interface {
+	// readSegment reads the next segment from the peer.
+	readSegment() (segment, error)
+	sendSyn() error
+	sendSynAck() error
+	sendAck() error
+	// write sends b as data from the layer of the connection, which it
+	// leaves as it is.
+	write(b []byte) (int, error)
+	SetReadDeadline(t time.Time) error
+}
+
+// acceptIO is what a backend provides the reads of a listener with.
+type acceptIO interface {
+	// readPacket reads the next packet, whose segment is p.segment.
+	readPacket() listenPacket
+	// peerLayer returns the layer to answer the sender of seg, read in p,
+	// with, nil if there is no address to answer from.
+	peerLayer(p *listenPacket, seg *segment) *pktLayers
+	sendRstWithLayer(layer *pktLayers) error
+	sendFinWithLayer(layer *pktLayers) error
+	writeWithLayer(b []byte, layer *pktLayers) (int, error)
+}
+
+var (
+	_ dialIO   = (*RAWConn)(nil)
+	_ acceptIO = (*RAWListener)(nil)
+)
+
+// hsSegment is what the handshakes look at of a segment read.
+type hsSegment struct {
+	syn, ack, psh, fin bool
+	seq                uint32
+	ackn               uint32
+	n                  int // length of the payload
+}
+
+// dialEvent is what a segment means to a dialer waiting for the SYN-ACK.
+type dialEvent int
+
+const (
+	// dialWait has the segment ignored.
+	dialWait dialEvent = iota
+	// dialSynAck is the SYN-ACK of the peer, to be acknowledged.
+	dialSynAck
+	// dialCrossed is a SYN of the peer dialing us as well, answered with a
+	// SYN-ACK from then on.
+	dialCrossed
+	// dialCrossAcked is the peer acknowledging that SYN-ACK.
+	dialCrossAcked
+)
+
+// dialStep returns what seg means to a dialer whose SYN has sequence
+// number seq, crossed telling whether a SYN of the peer was seen already.
+func dialStep(seg hsSegment, crossed bool, seq uint32) dialEvent {
+	switch {
+	case seg.syn && seg.ack:
+		return dialSynAck
+	case seg.syn:
+		return dialCrossed
+	case crossed && seg.ack && seg.ackn == seq+1:
+		return dialCrossAcked
+	}
+	return dialWait
+}
+
+// listenEvent is what a segment means to a listener for a peer not
+// established yet.
+type listenEvent int
+
+const (
+	listenWait listenEvent = iota
+	// listenAcked is the ACK ending the handshake of TCP.
+	listenAcked
+	// listenSyn is the SYN again, the SYN-ACK having been lost.
+	listenSyn
+	// listenRequest may be the request of the handshake.
+	listenRequest
+	// listenEarly is data that overtook the request.
+	listenEarly
+)
+
+// listenStep returns what seg means to a listener for a peer in state.
+func listenStep(state uint32, seg hsSegment) listenEvent {
+	resent := seg.syn && !seg.ack && !seg.psh
+	switch state {
+	case synreceived:
+		if seg.ack && !seg.psh && !seg.fin && !seg.syn {
+			return listenAcked
+		}
+	case waithttpreq:
+		if seg.ack && seg.psh && seg.n > 20 {
+			return listenRequest
+		} else if seg.ack && seg.psh && seg.n > 0 {
+			return listenEarly
+		}
+	default:
+		return listenWait
+	}
+	if resent {
+		return listenSyn
+	}
+	return listenWait
+}
+
+// ackedState returns the state of a peer once its handshake of TCP ended.
+func (r *Raw) ackedState() uint32 {
+	if r.NoHTTP || r.Udp2raw {
+		return established
+	}
+	return waithttpreq
+}
+
+// hsRequest is what a listener made of a request of the handshake.
+type hsRequest struct {
+	rep   []byte // nil if the payload is no request
+	token []byte
+	pad   int
+	tls   bool
+	prof  profile
+}
+
+// parseRequest makes out the request req of the handshake of the dialer
+// at addr, as a ClientHello, the request of the profile, or a POST.
+func (r *Raw) parseRequest(req []byte, addr *net.UDPAddr) (h hsRequest) {
+	if r.TLS || r.Mixed {
+		if ok, _, msg := utils.ParseTLSClientHelloMsg(req); ok {
+			h.token = msg.SessionId
+			h.pad = r.agreePadding(parsePadOffer(msg.SessionTicket))
+			h.rep = r.tlsReply(msg.SessionId, h.pad, addr)
+			h.tls = true
+		}
+	}
+	if p := r.profile(); p != profileNone {
+		if rep, tok, ok := p.answer(r.random(), req); ok {
+			h.token = tok
+			if h.rep == nil {
+				h.rep = rep
+			}
+			h.prof = p
+		}
+	}
+	if h.rep == nil && isHTTPMessage(req, "POST") {
+		h.pad = r.agreePadding(parsePadHeader(req))
+		h.rep = []byte(r.httpResponse(padHeader(h.pad) + r.addrHeader(addr)))
+		h.token = parseSessionCookie(req)
+	}
+	if h.rep != nil && r.Passthrough != "" && !r.authentic(h.token) {
+		// a handshake without the key is a prober's
+		h.rep = nil
+	}
+	return
+}
+
+// takeRequest records the request h, read at seq, unless an earlier copy
+// of it was, a retransmission getting the same reply. It tells whether h
+// was a request, its sequence space then to be acknowledged.
+func (info *connInfo) takeRequest(h hsRequest, seq uint32, n int) bool {
+	if h.rep == nil {
+		return false
+	}
+	if info.rep == nil {
+		info.rep = h.rep
+		info.pad = h.pad
+	}
+	info.hs.set(seq, n)
+	info.tls = info.tls || h.tls
+	if h.prof != profileNone {
+		info.prof = h.prof
+	}
+	return true
+}
@@ -0,0 +1,39 @@
+package rawcon
+
+import (
+	"net"
+	"testing"
+)
+
+func FuzzTCPOptions(f *testing.F) {
+	tcp := &tcpLayer{srcPort: 1, dstPort: 2, flags: SYN, options: []tcpOption{
+		{kind: tcpOptionKindMSS, data: []byte{5, 180}},
+		{kind: tcpOptionKindNop},
+		{kind: tcpOptionKindTimestamps, data: timestampsData(1, 2)},
+		{kind: tcpOptionKindSegmentID, data: make([]byte, segmentIDOptionLen-2)},
+	}}
+	f.Add(tcp.marshal(net.IPv4(127, 0, 0, 1), net.IPv4(127, 0, 0, 2)))
+	bare := make([]byte, tcpLen)
+	bare[12] = tcpLen / 4 << 4
+	f.Add(bare)
+	f.Fuzz(func(t *testing.T, b []byte) {
+		tcp, err := decodeTCPlayer(b)
+		if err != nil {
+			return
+		}
+		hl := int(tcp.dataOffset) << 2
+		if hl < tcpLen || len(tcp.payload) != len(b)-hl {
+			t.Fatalf("payload of %d bytes after a header of %d in %d", len(tcp.payload), hl, len(b))
+		}
+		var l int
+		for _, opt := range tcp.options {
+			l += int(opt.length)
+		}
+		if l > hl-tcpLen {
+			t.Fatalf("options of %d bytes in a header of %d", l, hl)
+		}
+		getMssFromTcpLayer(tcp)
+		timestampsOf(tcp)
+		segmentIDOf(tcp)
+	})
+}
@@ -0,0 +1,60 @@
+package rawcon
+
+import (
+	"testing"
+
+	"github.com/biotooff/rawcon/utils"
+)
+
+func FuzzHTTPRequest(f *testing.F) {
+	r := &Raw{Key: "secret", Response: &HTTPResponse{}}
+	f.Add([]byte(buildHTTPRequest(r.random(), padHeader(16)+r.sessionCookie(r.newSessionID()))))
+	f.Add([]byte("HEAD / HTTP/1.1\r\nHost: www.example.com\r\n\r\n"))
+	f.Add([]byte("POST / HTTP/1.1\r\nCookie: sid=\r\nX-Pad: -1\r\n\r\n"))
+	f.Fuzz(func(t *testing.T, b []byte) {
+		if pad := parsePadHeader(b); pad < 0 || pad > maxPadding {
+			t.Fatalf("padding of %d", pad)
+		}
+		r.openSessionToken(parseSessionCookie(b))
+		r.isWebRequest(b)
+		isHeadRequest(b)
+	})
+}
+
+// FuzzHandshake throws what a prober could send at the parsers of the
+// handshakes and the framing of data.
+func FuzzHandshake(f *testing.F) {
+	r := &Raw{Key: "secret"}
+	sid := r.newSessionID()
+	b := make([]byte, 2048)
+	n := r.clientHello(b, "www.example.com", sid, r.padTicket(b[1816:]))
+	f.Add(b[:n])
+	n = utils.GenTLSServerHello(b, padAnswerLen(0, 16), sid)
+	putPadOffer(r.random(), b[n:], 16)
+	f.Add(b[:n+padOfferLen])
+	f.Add(r.dnsQuery("www.example.com", sid))
+	f.Add(r.sshRequest(sid))
+	f.Add(sealSSH(r.random(), []byte("data")))
+	f.Add(sealDNS(r.random(), []byte("data"), true))
+	f.Fuzz(func(t *testing.T, b []byte) {
+		utils.ParseTLSClientHelloMsg(b)
+		utils.ParseTLSServerHelloMsg(b)
+		parseTLSPadAnswer(b)
+		parsePadOffer(b)
+		unpadSegment(b)
+		parseIPv4(b)
+		parseICMPError(b)
+		for _, p := range []profile{profileDNS, profileSSH} {
+			p.isRequest(b)
+			p.isReply(b)
+			p.open(b)
+			if _, token, ok := p.answer(r.random(), b); ok {
+				r.openSessionToken(token)
+			}
+		}
+		s := newUdp2rawState(utils.Random{})
+		s.open(b)
+		s.clientHandshake(b)
+		s.serverHandshake(b)
+	})
+}
@@ -0,0 +1,82 @@
+// +build !linux
+
+package rawcon
+
+import (
+	"errors"
+	"net"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+// The Ethernet header of a dialed connection is learned by asking the next
+// hop towards the peer, as found in the routing table, for its hardware
+// address with ARP.
+
+const (
+	arpRetries = 3
+	arpTimeout = time.Second
+)
+
+// localMAC returns the hardware address of the interface holding ip.
+func localMAC(ip net.IP) (net.HardwareAddr, error) {
+	ifaces, err := net.Interfaces()
+	if err != nil {
+		return nil, err
+	}
+	for _, iface := range ifaces {
+		addrs, err := iface.Addrs()
+		if err != nil {
+			continue
+		}
+		for _, addr := range addrs {
+			if ipnet, ok := addr.(*net.IPNet); ok && ipnet.IP.Equal(ip) && len(iface.HardwareAddr) == 6 {
+				return iface.HardwareAddr, nil
+			}
+		}
+	}
+	return nil, errors.New("cannot find the hardware address of " + ip.String())
+}
+
+// arpQuery returns the hardware address of local, the next hop towards
+// remote and the ARP request asking for the address of that hop.
+func arpQuery(local, remote net.IP) (src net.HardwareAddr, hop net.IP, req []byte, err error) {
+	if src, err = localMAC(local); err != nil {
+		return
+	}
+	if hop, err = nextHop(remote); err != nil {
+		return
+	}
+	eth := &layers.Ethernet{
+		SrcMAC:       src,
+		DstMAC:       net.HardwareAddr{0xff, 0xff, 0xff, 0xff, 0xff, 0xff},
+		EthernetType: layers.EthernetTypeARP,
+	}
+	arp := &layers.ARP{
+		AddrType:          layers.LinkTypeEthernet,
+		Protocol:          layers.EthernetTypeIPv4,
+		HwAddressSize:     6,
+		ProtAddressSize:   4,
+		Operation:         layers.ARPRequest,
+		SourceHwAddress:   src,
+		SourceProtAddress: local.To4(),
+		DstHwAddress:      make([]byte, 6),
+		DstProtAddress:    hop.To4(),
+	}
+	buf := gopacket.NewSerializeBuffer()
+	err = gopacket.SerializeLayers(buf, gopacket.SerializeOptions{FixLengths: true}, eth, arp)
+	req = buf.Bytes()
+	return
+}
+
+// arpReply returns the hardware address of ip if packet is the ARP reply
+// giving it.
+func arpReply(packet gopacket.Packet, ip net.IP) (net.HardwareAddr, bool) {
+	arp, ok := packet.Layer(layers.LayerTypeARP).(*layers.ARP)
+	if !ok || arp.Operation != layers.ARPReply || !net.IP(arp.SourceProtAddress).Equal(ip) {
+		return nil, false
+	}
+	return append(net.HardwareAddr(nil), arp.SourceHwAddress...), true
+}
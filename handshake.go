@@ -0,0 +1,288 @@
+package rawcon
+
+import (
+	"net"
+	"strconv"
+	"time"
+
+	"github.com/biotooff/rawcon/utils"
+)
+
+// HandshakeInfo is how the handshake of a dialed connection went, see
+// RAWConn.HandshakeInfo.
+type HandshakeInfo struct {
+	// Mode is the camouflage: "http", "tls", "dns", "ssh", "udp2raw", or
+	// "none" with NoHTTP.
+	Mode string
+	// PeerMSS and PeerWindowScale are what the SYN-ACK of the peer, or its
+	// SYN if they crossed, announced. They are 0 and -1 without the option.
+	PeerMSS         int
+	PeerWindowScale int
+	// PeerSACK and PeerTimestamps tell whether it offered SACK and the
+	// timestamps, see Raw.RTTInterval.
+	PeerSACK       bool
+	PeerTimestamps bool
+	// MSSAssumed tells that the peer announced no MSS, or one too small to
+	// be real, and that the connection sends with Raw.FallbackMSS.
+	MSSAssumed bool
+	// Crossed tells that the SYNs of the two ends crossed, see PunchRAW.
+	Crossed bool
+	// Completed tells whether the request got its reply. With ZeroRTT it
+	// turns true once the reply is read after the dial.
+	Completed bool
+	// SYNs is the number of SYNs sent and SYNTime the time from the first
+	// to the SYN-ACK.
+	SYNs    int
+	SYNTime time.Duration
+	// Requests is the number of times the request was sent and
+	// RequestTime the time from the first to the reply.
+	Requests    int
+	RequestTime time.Duration
+}
+
+// HandshakeInfo returns how the handshake of conn went. It is the zero
+// HandshakeInfo for a connection of a listener or one resumed by ResumeRAW.
+func (conn *RAWConn) HandshakeInfo() HandshakeInfo {
+	conn.lock.Lock()
+	defer conn.lock.Unlock()
+	return conn.hsinfo
+}
+
+// handshakeMode names the camouflage of r for HandshakeInfo.
+func (r *Raw) handshakeMode() string {
+	switch {
+	case r.Udp2raw:
+		return "udp2raw"
+	case r.DNS:
+		return "dns"
+	case r.SSH:
+		return "ssh"
+	case r.TLS:
+		return "tls"
+	case r.NoHTTP:
+		return "none"
+	}
+	return "http"
+}
+
+// notePeer records the options of the SYN-ACK or the SYN of the peer and
+// sizes the segments of conn after its MSS.
+func (conn *RAWConn) notePeer(mss int, opts peerOptions) {
+	conn.peer = opts
+	conn.hsinfo.PeerMSS = mss
+	conn.hsinfo.PeerWindowScale = opts.wscale
+	conn.hsinfo.PeerSACK = opts.sack
+	conn.hsinfo.PeerTimestamps = opts.timestamps
+	conn.mss, conn.hsinfo.MSSAssumed = conn.r.peerMSS(mss, conn.mtu)
+}
+
+// noteSYNs records the SYN phase of a dial, which completes the handshake
+// if there is no request.
+func (conn *RAWConn) noteSYNs(syn *synRetry, crossed bool) {
+	r := conn.r
+	conn.hsinfo.Mode = r.handshakeMode()
+	conn.hsinfo.Crossed = crossed
+	conn.hsinfo.SYNs = syn.tries
+	conn.hsinfo.SYNTime = time.Since(syn.start)
+	conn.hsinfo.Completed = r.Udp2raw || (r.NoHTTP && !r.TLS && r.profile() == profileNone)
+}
+
+// noteRequests records a request phase that took tries since start.
+func (conn *RAWConn) noteRequests(tries int, start time.Time) {
+	conn.hsinfo.Requests = tries
+	conn.hsinfo.RequestTime = time.Since(start)
+	conn.hsinfo.Completed = true
+}
+
+// noteZeroRTTReply records the reply to a request of ZeroRTT read after the
+// dial.
+func (conn *RAWConn) noteZeroRTTReply() {
+	tries, start := conn.zrtt.sent()
+	conn.lock.Lock()
+	conn.noteRequests(tries, start)
+	conn.lock.Unlock()
+}
+
+// handshake runs the handshake of a dialed connection to a server on port
+// once the backend set its layer and sockets up: the SYNs, then the
+// request of the camouflage or the exchange of udp2raw. sid is the session
+// the request carries, nil for none.
+func (conn *RAWConn) handshake(sid []byte, port int) (err error) {
+	crossed, err := conn.synPhase()
+	if err != nil {
+		return
+	}
+	r := conn.r
+	if r.Udp2raw {
+		return conn.udp2rawHandshake()
+	}
+	if r.NoHTTP && !r.TLS && r.profile() == profileNone {
+		return nil
+	}
+	if crossed && answersCrossing(conn.layer.seq()-1, conn.layer.ack()-1) {
+		return conn.answerCrossing()
+	}
+	return conn.requestPhase(sid, port)
+}
+
+// synPhase sends the SYNs until the peer answers, and tells whether its
+// SYN crossed ours, the peer dialing us as well.
+func (conn *RAWConn) synPhase() (crossed bool, err error) {
+	syn := conn.r.newSYNRetry()
+	layer := conn.layer
+	for {
+		var wait time.Duration
+		if wait, err = syn.next(); err != nil {
+			return
+		}
+		if crossed {
+			err = conn.sendSynAck()
+		} else {
+			err = conn.sendSyn()
+		}
+		if err != nil {
+			return
+		}
+		if err = conn.SetReadDeadline(time.Now().Add(wait)); err != nil {
+			return
+		}
+		var seg segment
+		if seg, err = conn.readSegment(); err != nil {
+			e, ok := err.(net.Error)
+			if !ok || !e.Temporary() {
+				return
+			}
+			syn.last = err
+			continue
+		}
+		switch dialStep(seg.hsSegment, crossed, layer.seq()) {
+		case dialWait:
+			continue
+		case dialCrossed:
+			layer.setAck(seg.seq + 1)
+			conn.notePeer(getMssFromTcpLayer(seg.tcp), peerOptionsOf(seg.tcp))
+			crossed = true
+			continue
+		case dialSynAck:
+			layer.setAck(seg.seq + 1)
+			layer.setSeq(layer.seq() + 1)
+			conn.notePeer(getMssFromTcpLayer(seg.tcp), peerOptionsOf(seg.tcp))
+			conn.scaleWindow()
+			if err = conn.sendAck(); err != nil {
+				return
+			}
+		case dialCrossAcked:
+			layer.setSeq(layer.seq() + 1)
+			conn.scaleWindow()
+		}
+		conn.noteSYNs(syn, crossed)
+		return
+	}
+}
+
+// requestPhase sends the request of the camouflage until the reply comes,
+// or once with ZeroRTT.
+func (conn *RAWConn) requestPhase(sid []byte, port int) (err error) {
+	r := conn.r
+	layer := conn.layer
+	var req []byte
+	host := r.pickHost()
+	if r.profile() != profileNone {
+		req = r.profileRequest(host, sid)
+	} else if r.TLS {
+		b := utils.GetBuf(2048)
+		defer utils.PutBuf(b)
+		r.random().Read(b[1816:])
+		sessionID := b[2016:]
+		if token := r.sessionToken(sid); token != nil {
+			sessionID = token
+		}
+		tlsLen := r.clientHello(b, host, sessionID, r.padTicket(b[1816:2016]))
+		req = b[:tlsLen]
+	} else {
+		if port != 80 {
+			host += strconv.Itoa(port)
+		}
+		headers := "Host: " + host + "\r\n"
+		headers += "X-Online-Host: " + host + "\r\n"
+		headers += padHeader(r.padding())
+		headers += r.sessionCookie(sid)
+		req = utils.StringToSlice(buildHTTPRequest(r.random(), headers))
+	}
+	if r.ZeroRTT {
+		req = append([]byte(nil), req...)
+		seqn := layer.seq()
+		if _, err = conn.writeRequest(req); err != nil {
+			return
+		}
+		layer.setSeq(seqn + uint32(len(req)))
+		conn.zrtt = newZeroRTT(r, func() error {
+			return conn.resendAt(req, seqn)
+		})
+		return
+	}
+	seqn, ackn := layer.seq(), layer.ack()
+	retry := 0
+	needretry := true
+	var starttime time.Time
+	reqstart := time.Now()
+	for {
+		if retry > 25 {
+			return &HandshakeError{Stage: "request", Attempts: retry, Elapsed: time.Since(reqstart)}
+		}
+		if needretry {
+			needretry = false
+			starttime = time.Now()
+			retry++
+			if _, err = conn.writeRequest(req); err != nil {
+				return
+			}
+		}
+		err = conn.SetReadDeadline(time.Now().Add(time.Millisecond * time.Duration(200+int(r.random().Int63()%100))))
+		if err != nil {
+			return
+		}
+		var seg segment
+		if seg, err = conn.readSegment(); err != nil {
+			e, ok := err.(net.Error)
+			if !ok || !e.Temporary() {
+				return
+			}
+			needretry = true
+			continue
+		}
+		if seg.syn && seg.ack {
+			// the SYN-ACK again, our ACK was lost
+			layer.setAck(ackn)
+			layer.setSeq(seqn)
+			if err = conn.sendAck(); err != nil {
+				return
+			}
+			continue
+		}
+		if seg.psh && seg.ack && seg.n >= 20 {
+			var ok bool
+			if p := r.profile(); p != profileNone {
+				ok = p.isReply(seg.payload)
+			} else if r.TLS {
+				ok, _, _ = utils.ParseTLSServerHelloMsg(seg.payload)
+			} else {
+				ok = isHTTPMessage(seg.payload, "HTTP")
+			}
+			if ok {
+				layer.setSeq(seqn + uint32(len(req)))
+				layer.setAck(seg.seq + uint32(seg.n))
+				conn.hs.set(seg.seq, seg.n)
+				if r.profile() == profileNone {
+					conn.pad = r.answeredPadding(seg.payload)
+					conn.public = r.answeredAddr(seg.payload)
+				}
+				conn.noteRequests(retry, reqstart)
+				return nil
+			}
+		}
+		if time.Now().After(starttime.Add(time.Millisecond * 200)) {
+			needretry = true
+		}
+	}
+}
@@ -0,0 +1,17 @@
+package rawcon
+
+// packetOut runs Raw.PacketOut on b, nil meaning the packet is dropped.
+func (r *Raw) packetOut(b []byte) []byte {
+	if r.PacketOut == nil {
+		return b
+	}
+	return r.PacketOut(b)
+}
+
+// packetIn runs Raw.PacketIn on b, nil meaning the packet is dropped.
+func (r *Raw) packetIn(b []byte) []byte {
+	if r.PacketIn == nil {
+		return b
+	}
+	return r.PacketIn(b)
+}
@@ -0,0 +1,93 @@
+package rawcon
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"net"
+	"strconv"
+	"time"
+)
+
+// With Raw.HopInterval set a connection that can migrate re-handshakes from
+// a new source port every so often, like Migrate does, and the listener
+// takes the new flow for the connection it already has. The time between
+// two hops is drawn from Raw.Key and the session, between half and one and
+// a half of the interval, so the flows do not change on a fixed beat. With
+// Raw.HopPorts the hops also move between ports of the peer, drawn the same
+// way. A listener taking all of them, see ports.go, keeps the connection
+// across them.
+
+// hopMAC returns a number drawn from Raw.Key, the session and the hop n,
+// label telling the draws of a hop apart.
+func (conn *RAWConn) hopMAC(label string, n uint64) uint64 {
+	mac := hmac.New(sha256.New, []byte(conn.r.Key))
+	mac.Write([]byte(label))
+	mac.Write(conn.sid)
+	binary.Write(mac, binary.BigEndian, n)
+	return binary.BigEndian.Uint64(mac.Sum(nil))
+}
+
+func (conn *RAWConn) hopDelay(n uint64) time.Duration {
+	v := conn.hopMAC("hop", n)
+	interval := conn.r.HopInterval
+	return interval/2 + time.Duration(v%uint64(interval))
+}
+
+// hopPort returns the port of the peer the hop n goes to, one of ports.
+func (conn *RAWConn) hopPort(n uint64, ports portRanges) int {
+	v := conn.hopMAC("hop port", n)
+	return ports.nth(int(v % uint64(ports.count())))
+}
+
+// hopPorts parses Raw.HopPorts, nil if it is empty.
+func (r *Raw) hopPorts() (portRanges, error) {
+	if r.HopPorts == "" {
+		return nil, nil
+	}
+	ports, err := parsePorts(r.HopPorts)
+	if err != nil {
+		return nil, &net.AddrError{Err: err.Error(), Addr: r.HopPorts}
+	}
+	return ports, nil
+}
+
+func (conn *RAWConn) hop() {
+	// DialRAW checked them
+	ports, _ := conn.r.hopPorts()
+	for n := uint64(0); ; n++ {
+		timer := time.NewTimer(conn.hopDelay(n))
+		select {
+		case <-conn.die:
+			timer.Stop()
+			return
+		case <-timer.C:
+		}
+		address := conn.RemoteAddr().String()
+		if ports != nil {
+			host, _, _ := net.SplitHostPort(address)
+			address = net.JoinHostPort(host, strconv.Itoa(conn.hopPort(n, ports)))
+		}
+		if !conn.hopTo(address) {
+			return
+		}
+	}
+}
+
+// hopTo moves the connection to a new flow to address. A failed dial
+// leaves it on the current flow until the next hop. It returns false once
+// the connection is closed.
+func (conn *RAWConn) hopTo(address string) bool {
+	next, err := conn.r.dial(address, conn.sid, nil)
+	if err != nil {
+		return true
+	}
+	select {
+	case <-conn.die:
+		next.Close()
+		return false
+	default:
+	}
+	conn.takeOver(next)
+	return true
+}
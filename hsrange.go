@@ -0,0 +1,36 @@
+package rawcon
+
+// The handshake request of a dialer and the reply of the listener are sent
+// again until the other side has them, so a side may get them after the
+// data has started. They are no data, the sequence numbers they took up
+// tell them apart: hsRange holds the stretch of the peer's handshake.
+// After 2GB of data the numbers start over towards it, data would then be
+// taken for the handshake, so a range stops filtering once the data is that
+// far past it.
+
+type hsRange struct {
+	seq  uint32
+	n    uint32
+	past bool // the data went half the sequence space past the range
+}
+
+// set has h be the n bytes of handshake at seq.
+func (h *hsRange) set(seq uint32, n int) {
+	*h = hsRange{seq: seq, n: uint32(n)}
+}
+
+// covers tells whether the segment at seq is a copy of the handshake, and
+// notes when the data went too far past it.
+func (h *hsRange) covers(seq uint32) bool {
+	if h.past || h.n == 0 {
+		return false
+	}
+	d := seq - h.seq
+	if d >= 1<<31 && d < 3<<30 {
+		// data moves on by far less than 1GB at a time, it cannot skip
+		// this quarter of the space, unlike segments from before the range
+		h.past = true
+		return false
+	}
+	return d < h.n
+}
@@ -0,0 +1,434 @@
+package rawcon
+
+import (
+	"encoding/binary"
+	"errors"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/net/icmp"
+	"golang.org/x/net/ipv4"
+)
+
+// The ICMP mode carries payloads in echo request (client to server) and echo
+// reply (server to client) messages. The echo id identifies the session and
+// is reported as the port of the peer address, the seq increases for every
+// request. Each reply takes the seq of the oldest request not answered yet,
+// so that NATs pair them correctly, and the client polls so that the server
+// has requests to answer.
+//
+// Every message starts with icmpMagic and a message type, which lets both
+// sides ignore unrelated pings as well as the echo replies the kernel of the
+// server generates on its own (disable them with net.ipv4.icmp_echo_ignore_all
+// to save bandwidth).
+
+const (
+	icmpMagic     = 0x7263
+	icmpHeaderLen = 3
+
+	icmpClientData = 1
+	icmpClientPoll = 2
+	icmpServerData = 3
+
+	icmpPollInterval = time.Millisecond * 500
+	// 1472 leaves room for the IP and ICMP headers in 1500 bytes
+	icmpMaxPayload = 1472 - icmpHeaderLen
+
+	// icmpPeerTimeout is how long a listener keeps a peer it heard nothing
+	// from, unless Raw.IdleTimeout says otherwise, a live one polls every
+	// icmpPollInterval
+	icmpPeerTimeout = time.Second * 30
+	// icmpMaxPeers is how many peers a listener holds, unless Raw.MaxConns
+	// says otherwise
+	icmpMaxPeers = 4096
+	// icmpMaxOutstanding is how many requests of a peer a listener keeps to
+	// answer, the oldest ones give way to new ones
+	icmpMaxOutstanding = 32
+)
+
+func marshalICMPEcho(typ ipv4.ICMPType, id, seq int, kind byte, b []byte) ([]byte, error) {
+	data := make([]byte, icmpHeaderLen+len(b))
+	binary.BigEndian.PutUint16(data, icmpMagic)
+	data[2] = kind
+	copy(data[icmpHeaderLen:], b)
+	msg := icmp.Message{
+		Type: typ,
+		Body: &icmp.Echo{ID: id, Seq: seq, Data: data},
+	}
+	return msg.Marshal(nil)
+}
+
+func parseICMPEcho(b []byte, typ ipv4.ICMPType) (echo *icmp.Echo, kind byte, payload []byte, ok bool) {
+	msg, err := icmp.ParseMessage(1, b)
+	if err != nil || msg.Type != typ {
+		return
+	}
+	echo, ok = msg.Body.(*icmp.Echo)
+	if !ok || len(echo.Data) < icmpHeaderLen || binary.BigEndian.Uint16(echo.Data) != icmpMagic {
+		return nil, 0, nil, false
+	}
+	return echo, echo.Data[2], echo.Data[icmpHeaderLen:], true
+}
+
+// ICMPConn is the dialer side of the ICMP mode.
+type ICMPConn struct {
+	conn  *icmp.PacketConn
+	r     *Raw
+	laddr *net.IPAddr
+	raddr *net.IPAddr
+	id    int
+	seq   uint32
+	buf   []byte
+	die   chan struct{}
+	once  sync.Once
+}
+
+// DialICMP opens an ICMP echo tunnel to the host of address, the port is
+// ignored.
+func (r *Raw) DialICMP(address string) (conn *ICMPConn, err error) {
+	udp, err := r.dialLocalPort(address, nil)
+	if err != nil {
+		return
+	}
+	defer udp.Close()
+	ulocaladdr := udp.LocalAddr().(*net.UDPAddr)
+	uremoteaddr := udp.RemoteAddr().(*net.UDPAddr)
+	c, err := icmp.ListenPacket("ip4:icmp", ulocaladdr.IP.String())
+	if err != nil {
+		return
+	}
+	if tos := r.tos(); tos != 0 {
+		c.IPv4PacketConn().SetTOS(tos)
+	}
+	conn = &ICMPConn{
+		conn:  c,
+		r:     r,
+		laddr: &net.IPAddr{IP: ulocaladdr.IP},
+		raddr: &net.IPAddr{IP: uremoteaddr.IP},
+		id:    r.random().Intn(65535) + 1,
+		seq:   uint32(r.random().Intn(65536)),
+		buf:   make([]byte, 2048),
+		die:   make(chan struct{}),
+	}
+	err = conn.send(icmpClientPoll, nil)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	go conn.poll()
+	return
+}
+
+func (conn *ICMPConn) send(kind byte, b []byte) (err error) {
+	seq := int(uint16(atomic.AddUint32(&conn.seq, 1)))
+	data, err := marshalICMPEcho(ipv4.ICMPTypeEcho, conn.id, seq, kind, b)
+	if err != nil {
+		return
+	}
+	_, err = conn.conn.WriteTo(data, conn.raddr)
+	return
+}
+
+// poll keeps sending empty requests so that the server always has a request
+// it can answer, and the NAT mapping stays alive.
+func (conn *ICMPConn) poll() {
+	ticker := time.NewTicker(icmpPollInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-conn.die:
+			return
+		case <-ticker.C:
+			if conn.send(icmpClientPoll, nil) != nil {
+				return
+			}
+		}
+	}
+}
+
+func (conn *ICMPConn) ReadFrom(b []byte) (n int, addr net.Addr, err error) {
+	for {
+		var peer net.Addr
+		n, peer, err = conn.conn.ReadFrom(conn.buf)
+		if err != nil {
+			return
+		}
+		ipaddr, ok := peer.(*net.IPAddr)
+		if !ok || !ipaddr.IP.Equal(conn.raddr.IP) {
+			continue
+		}
+		echo, kind, payload, ok := parseICMPEcho(conn.buf[:n], ipv4.ICMPTypeEchoReply)
+		if !ok || echo.ID != conn.id || kind != icmpServerData {
+			continue
+		}
+		return copy(b, payload), conn.RemoteAddr(), nil
+	}
+}
+
+func (conn *ICMPConn) Read(b []byte) (n int, err error) {
+	n, _, err = conn.ReadFrom(b)
+	return
+}
+
+func (conn *ICMPConn) WriteTo(b []byte, addr net.Addr) (n int, err error) {
+	return conn.Write(b)
+}
+
+func (conn *ICMPConn) Write(b []byte) (n int, err error) {
+	if len(b) > icmpMaxPayload {
+		return 0, errors.New("icmp payload too large")
+	}
+	err = conn.send(icmpClientData, b)
+	if err != nil {
+		return
+	}
+	return len(b), nil
+}
+
+func (conn *ICMPConn) Close() (err error) {
+	conn.once.Do(func() {
+		close(conn.die)
+		err = conn.conn.Close()
+	})
+	return
+}
+
+func (conn *ICMPConn) LocalAddr() net.Addr {
+	return &net.UDPAddr{IP: conn.laddr.IP, Port: conn.id}
+}
+
+func (conn *ICMPConn) RemoteAddr() net.Addr {
+	return &net.UDPAddr{IP: conn.raddr.IP, Port: conn.id}
+}
+
+func (conn *ICMPConn) SetDeadline(t time.Time) error {
+	return conn.conn.SetDeadline(t)
+}
+
+func (conn *ICMPConn) SetReadDeadline(t time.Time) error {
+	return conn.conn.SetReadDeadline(t)
+}
+
+func (conn *ICMPConn) SetWriteDeadline(t time.Time) error {
+	return conn.conn.SetWriteDeadline(t)
+}
+
+func (conn *ICMPConn) GetMSS() int {
+	return icmpMaxPayload
+}
+
+type icmpPeer struct {
+	seqs     []int // of the requests not answered yet, oldest first
+	lastRecv time.Time
+}
+
+// icmpPeers are the peers of an ICMPListener. Those idle for timeout are
+// forgotten, and a new one beyond max takes the place of the least
+// recently active with lru, or is ignored.
+type icmpPeers struct {
+	peers   map[string]*icmpPeer
+	timeout time.Duration
+	max     int
+	lru     bool
+	swept   time.Time
+}
+
+func (r *Raw) newICMPPeers() icmpPeers {
+	p := icmpPeers{
+		peers:   make(map[string]*icmpPeer),
+		timeout: r.IdleTimeout,
+		max:     r.MaxConns,
+		lru:     r.EvictLRU,
+	}
+	if p.timeout <= 0 {
+		p.timeout = icmpPeerTimeout
+	}
+	if p.max <= 0 {
+		p.max = icmpMaxPeers
+	}
+	return p
+}
+
+// note records an echo request of seq from the peer at key, it returns
+// false if there is no room for a new peer.
+func (t *icmpPeers) note(key string, seq int, now time.Time) bool {
+	p, ok := t.peers[key]
+	if !ok {
+		if now.Sub(t.swept) >= time.Second || len(t.peers) >= t.max {
+			t.sweep(now)
+		}
+		if len(t.peers) >= t.max && !(t.lru && t.dropLRU()) {
+			return false
+		}
+		p = &icmpPeer{}
+		t.peers[key] = p
+	}
+	if len(p.seqs) == icmpMaxOutstanding {
+		p.seqs = append(p.seqs[:0], p.seqs[1:]...)
+	}
+	p.seqs = append(p.seqs, seq)
+	p.lastRecv = now
+	return true
+}
+
+// take returns the seq of the oldest echo request of the peer at key not
+// answered yet and counts it answered. ok is false if the peer is unknown
+// or idle, and seq -1 if all its requests were answered.
+func (t *icmpPeers) take(key string, now time.Time) (seq int, ok bool) {
+	p, ok := t.peers[key]
+	if !ok || now.Sub(p.lastRecv) >= t.timeout {
+		return 0, false
+	}
+	if len(p.seqs) == 0 {
+		return -1, true
+	}
+	seq = p.seqs[0]
+	p.seqs = append(p.seqs[:0], p.seqs[1:]...)
+	return seq, true
+}
+
+// sweep forgets the idle peers.
+func (t *icmpPeers) sweep(now time.Time) {
+	t.swept = now
+	for k, p := range t.peers {
+		if now.Sub(p.lastRecv) >= t.timeout {
+			delete(t.peers, k)
+		}
+	}
+}
+
+func (t *icmpPeers) dropLRU() bool {
+	var key string
+	var oldest *icmpPeer
+	for k, p := range t.peers {
+		if oldest == nil || p.lastRecv.Before(oldest.lastRecv) {
+			key, oldest = k, p
+		}
+	}
+	delete(t.peers, key)
+	return oldest != nil
+}
+
+// ICMPListener is the server side of the ICMP mode, peers are told apart by
+// their address and echo id. A peer is forgotten once idle for
+// Raw.IdleTimeout, 30s if zero, and the listener holds Raw.MaxConns peers
+// at most, 4096 if zero, with Raw.EvictLRU as with fake TCP.
+type ICMPListener struct {
+	conn  *icmp.PacketConn
+	r     *Raw
+	laddr *net.IPAddr
+	peers icmpPeers
+	mutex myMutex
+	buf   []byte
+}
+
+// ListenICMP accepts ICMP echo tunnels on the host of address, the port is
+// ignored.
+func (r *Raw) ListenICMP(address string) (listener *ICMPListener, err error) {
+	udpaddr, err := net.ResolveUDPAddr("udp4", address)
+	if err != nil {
+		return
+	}
+	if udpaddr.IP == nil {
+		udpaddr.IP = ipv4AddrAny
+	}
+	c, err := icmp.ListenPacket("ip4:icmp", udpaddr.IP.String())
+	if err != nil {
+		return
+	}
+	if tos := r.tos(); tos != 0 {
+		c.IPv4PacketConn().SetTOS(tos)
+	}
+	listener = &ICMPListener{
+		conn:  c,
+		r:     r,
+		laddr: &net.IPAddr{IP: udpaddr.IP},
+		peers: r.newICMPPeers(),
+		buf:   make([]byte, 2048),
+	}
+	return
+}
+
+func (listener *ICMPListener) ReadFrom(b []byte) (n int, addr net.Addr, err error) {
+	for {
+		var peer net.Addr
+		n, peer, err = listener.conn.ReadFrom(listener.buf)
+		if err != nil {
+			return
+		}
+		ipaddr, ok := peer.(*net.IPAddr)
+		if !ok {
+			continue
+		}
+		echo, kind, payload, ok := parseICMPEcho(listener.buf[:n], ipv4.ICMPTypeEcho)
+		if !ok || (kind != icmpClientData && kind != icmpClientPoll) {
+			continue
+		}
+		uaddr := &net.UDPAddr{IP: ipaddr.IP, Port: echo.ID}
+		listener.mutex.run(func() {
+			ok = listener.peers.note(uaddr.String(), echo.Seq, time.Now())
+		})
+		if !ok || kind == icmpClientPoll {
+			continue
+		}
+		return copy(b, payload), uaddr, nil
+	}
+}
+
+// WriteTo answers the oldest echo request of the peer at addr not answered
+// yet with b. With every one answered b is dropped, as a NAT would drop a
+// reply to no request.
+func (listener *ICMPListener) WriteTo(b []byte, addr net.Addr) (n int, err error) {
+	uaddr, ok := addr.(*net.UDPAddr)
+	if !ok {
+		return 0, errors.New("cannot write to " + addr.String())
+	}
+	if len(b) > icmpMaxPayload {
+		return 0, errors.New("icmp payload too large")
+	}
+	var seq int
+	listener.mutex.run(func() {
+		seq, ok = listener.peers.take(uaddr.String(), time.Now())
+	})
+	if !ok {
+		return 0, &AddrError{Op: "write", Addr: addr, Err: ErrNoConn}
+	}
+	if seq < 0 {
+		return len(b), nil
+	}
+	data, err := marshalICMPEcho(ipv4.ICMPTypeEchoReply, uaddr.Port, seq, icmpServerData, b)
+	if err != nil {
+		return
+	}
+	_, err = listener.conn.WriteTo(data, &net.IPAddr{IP: uaddr.IP})
+	if err != nil {
+		return
+	}
+	return len(b), nil
+}
+
+func (listener *ICMPListener) Close() error {
+	return listener.conn.Close()
+}
+
+func (listener *ICMPListener) LocalAddr() net.Addr {
+	return &net.UDPAddr{IP: listener.laddr.IP}
+}
+
+func (listener *ICMPListener) SetDeadline(t time.Time) error {
+	return listener.conn.SetDeadline(t)
+}
+
+func (listener *ICMPListener) SetReadDeadline(t time.Time) error {
+	return listener.conn.SetReadDeadline(t)
+}
+
+func (listener *ICMPListener) SetWriteDeadline(t time.Time) error {
+	return listener.conn.SetWriteDeadline(t)
+}
+
+func (listener *ICMPListener) GetMSSByAddr(addr net.Addr) int {
+	return icmpMaxPayload
+}
@@ -0,0 +1,212 @@
+package rawcon
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+
+	"golang.org/x/net/icmp"
+)
+
+// With Raw.ICMPErrors set connections and listeners also read the ICMP
+// errors about their flows, from a socket of their own as the capture only
+// lets TCP through. An error counts when the segment it quotes is one of
+// the flow and was sent lately, which keeps blind spoofing out:
+//
+//   - fragmentation needed lowers the MSS of the flow to fit the MTU of the
+//     path, never below what fits minPathMTU, and reports an EventMSS;
+//   - the other destination unreachable errors and time exceeded are
+//     reported as an EventPathError. A dialed connection fails its next
+//     read or write with it, and if it has other addresses to fail over to
+//     it moves on at once.
+
+const (
+	icmpTypeUnreachable  = 3
+	icmpTypeTimeExceeded = 11
+	icmpCodeFragNeeded   = 4
+
+	// minPathMTU is the least MTU taken from a fragmentation needed error,
+	// the floor of Linux
+	minPathMTU = 552
+	// icmpSeqWindow is how far behind the next sequence number the quoted
+	// one may be
+	icmpSeqWindow = 1 << 24
+)
+
+// ICMPError is an ICMP error a router or the host of the peer sent about a
+// flow. It is the Err of an EventPathError and of the AddrError a dialed
+// connection fails with.
+type ICMPError struct {
+	Type int
+	Code int
+	// From is the address of the router or host that sent it.
+	From net.IP
+}
+
+func (e *ICMPError) Error() string {
+	var s string
+	switch e.Type {
+	case icmpTypeUnreachable:
+		s = "destination unreachable"
+	case icmpTypeTimeExceeded:
+		s = "time exceeded"
+	default:
+		s = fmt.Sprintf("icmp type %d", e.Type)
+	}
+	return fmt.Sprintf("%s (code %d) from %v", s, e.Code, e.From)
+}
+
+// icmpReport is an ICMP error and the TCP segment it quotes.
+type icmpReport struct {
+	typ, code int
+	mtu       int // of the next hop if it is fragmentation needed
+	src, dst  *net.UDPAddr
+	seq       uint32
+}
+
+// parseICMPError parses the ICMP message b, without its IP header, if it is
+// an error quoting a TCP segment.
+func parseICMPError(b []byte) (rep icmpReport, ok bool) {
+	if len(b) < 8 || (b[0] != icmpTypeUnreachable && b[0] != icmpTypeTimeExceeded) {
+		return
+	}
+	rep.typ, rep.code = int(b[0]), int(b[1])
+	if rep.typ == icmpTypeUnreachable && rep.code == icmpCodeFragNeeded {
+		rep.mtu = int(binary.BigEndian.Uint16(b[6:]))
+	}
+	ip := b[8:]
+	if len(ip) < 20 || ip[0]>>4 != 4 || ip[9] != 6 {
+		return
+	}
+	hl := int(ip[0]&0xf) * 4
+	if hl < 20 || len(ip) < hl+8 {
+		return
+	}
+	tcp := ip[hl:]
+	rep.src = &net.UDPAddr{IP: net.IP(ip[12:16]), Port: int(binary.BigEndian.Uint16(tcp))}
+	rep.dst = &net.UDPAddr{IP: net.IP(ip[16:20]), Port: int(binary.BigEndian.Uint16(tcp[2:]))}
+	rep.seq = binary.BigEndian.Uint32(tcp[4:])
+	return rep, true
+}
+
+// sent tells whether the quoted segment was sent lately by a flow whose
+// next sequence number is next.
+func (rep *icmpReport) sent(next uint32) bool {
+	return next-rep.seq < icmpSeqWindow
+}
+
+// pathMSS returns the MSS fitting the MTU the report asks for, or 0 if it
+// does not ask for one.
+func (rep *icmpReport) pathMSS() int {
+	if rep.mtu == 0 {
+		return 0
+	}
+	return max(rep.mtu, minPathMTU) - 40
+}
+
+func sameUDPAddr(a *net.UDPAddr, b net.Addr) bool {
+	u, ok := b.(*net.UDPAddr)
+	return ok && a.Port == u.Port && a.IP.Equal(u.IP)
+}
+
+// readICMPErrors opens an ICMP socket until die is closed and calls f with
+// the errors read from it.
+func (r *Raw) readICMPErrors(die chan struct{}, f func(rep icmpReport, from net.IP)) {
+	if !r.ICMPErrors || r.PacketIO != nil {
+		return
+	}
+	c, err := icmp.ListenPacket("ip4:icmp", "0.0.0.0")
+	if err != nil {
+		return
+	}
+	go func() {
+		<-die
+		c.Close()
+	}()
+	go func() {
+		defer c.Close()
+		b := make([]byte, 1500)
+		for {
+			n, peer, err := c.ReadFrom(b)
+			if err != nil {
+				return
+			}
+			ipaddr, ok := peer.(*net.IPAddr)
+			if !ok {
+				continue
+			}
+			if rep, ok := parseICMPError(b[:n]); ok {
+				f(rep, ipaddr.IP)
+			}
+		}
+	}()
+}
+
+// watchICMP has conn act on the ICMP errors about its flow.
+func (conn *RAWConn) watchICMP() {
+	conn.r.readICMPErrors(conn.die, func(rep icmpReport, from net.IP) {
+		if !sameUDPAddr(rep.src, conn.LocalAddr()) || !sameUDPAddr(rep.dst, conn.RemoteAddr()) {
+			return
+		}
+		if seq, _ := conn.seqAck(); !rep.sent(seq) {
+			return
+		}
+		if mss := rep.pathMSS(); mss > 0 {
+			if cur := conn.GetMSS(); cur == 0 || mss < cur {
+				conn.SetMSS(mss)
+			}
+			return
+		}
+		e := &ICMPError{Type: rep.typ, Code: rep.code, From: from}
+		conn.icmpErr.Store(e)
+		// the failover, if any, takes the path for dead
+		conn.lastRecv.Store(0)
+		conn.r.emit(Event{Type: EventPathError, Addr: conn.RemoteAddr(), Err: e})
+	})
+}
+
+// pathErr returns, once, the error of op for the last ICMP error about the
+// flow of conn.
+func (conn *RAWConn) pathErr(op string) error {
+	e := conn.icmpErr.Swap(nil)
+	if e == nil {
+		return nil
+	}
+	return &AddrError{Op: op, Addr: conn.RemoteAddr(), Err: e}
+}
+
+// watchICMP has the listener act on the ICMP errors about the flows of its
+// peers.
+func (listener *RAWListener) watchICMP() {
+	laddr := listener.LocalAddr().(*net.UDPAddr)
+	listener.r.readICMPErrors(listener.die, func(rep icmpReport, from net.IP) {
+		if rep.src.Port != laddr.Port || (!laddr.IP.IsUnspecified() && !rep.src.IP.Equal(laddr.IP)) {
+			return
+		}
+		addrstr := rep.dst.String()
+		var info *connInfo
+		listener.mutex.read(func() {
+			var ok bool
+			if info, ok = listener.conns[addrstr]; !ok {
+				info = listener.newcons[addrstr]
+			}
+		})
+		if info == nil {
+			return
+		}
+		info.lock.Lock()
+		seq := info.layer.seq()
+		info.lock.Unlock()
+		if !rep.sent(seq) {
+			return
+		}
+		if mss := rep.pathMSS(); mss > 0 {
+			if cur := listener.GetMSSByAddr(info.addr); cur == 0 || mss < cur {
+				listener.SetMSSByAddr(info.addr, mss)
+			}
+			return
+		}
+		e := &ICMPError{Type: rep.typ, Code: rep.code, From: from}
+		listener.r.emit(Event{Type: EventPathError, Addr: info.addr, Err: e})
+	})
+}
@@ -0,0 +1,110 @@
+package rawcon
+
+import (
+	"fmt"
+	"net"
+)
+
+// interfaceIPv4 returns the first IPv4 address of the interface name.
+func interfaceIPv4(name string) (net.IP, error) {
+	iface, err := net.InterfaceByName(name)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrNoInterface, err)
+	}
+	addrs, err := iface.Addrs()
+	if err != nil {
+		return nil, err
+	}
+	for _, addr := range addrs {
+		if ipnet, ok := addr.(*net.IPNet); ok && ipnet.IP.To4() != nil {
+			return ipnet.IP.To4(), nil
+		}
+	}
+	return nil, fmt.Errorf("%w: %s has no IPv4 address", ErrNoInterface, name)
+}
+
+// dialUDP opens the UDP socket that holds the local port of a connection to
+// address, with Raw.DialUDP if set. With Raw.Interface set it is bound to
+// an address of that interface, which becomes the local address of the
+// connection. A non-nil local address is used as it is.
+func (r *Raw) dialUDP(address string, local *net.UDPAddr) (net.Conn, error) {
+	if local == nil && r.Interface != "" {
+		ip, err := interfaceIPv4(r.Interface)
+		if err != nil {
+			return nil, err
+		}
+		local = &net.UDPAddr{IP: ip}
+	}
+	if r.DialUDP != nil {
+		return r.DialUDP(address, local)
+	}
+	var d net.Dialer
+	if local != nil {
+		d.LocalAddr = local
+	}
+	return d.Dial("udp4", address)
+}
+
+// interfaceOf returns the interface holding ip, nil if there is none.
+func interfaceOf(ip net.IP) *net.Interface {
+	ifaces, err := net.Interfaces()
+	if err != nil {
+		return nil
+	}
+	for i := range ifaces {
+		addrs, err := ifaces[i].Addrs()
+		if err != nil {
+			continue
+		}
+		for _, addr := range addrs {
+			if ipnet, ok := addr.(*net.IPNet); ok && ipnet.IP.Equal(ip) {
+				return &ifaces[i]
+			}
+		}
+	}
+	return nil
+}
+
+// routeIPv4 returns the local address a new connection to address would
+// get, see dialUDP.
+func (r *Raw) routeIPv4(address string) (net.IP, error) {
+	if r.Interface != "" {
+		return interfaceIPv4(r.Interface)
+	}
+	c, err := r.dialUDP(address, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer c.Close()
+	return c.LocalAddr().(*net.UDPAddr).IP, nil
+}
+
+// InterfaceInfo describes the interface a connection or a listener sends
+// and captures on, as DialRAW and ListenRAW resolved it.
+type InterfaceInfo struct {
+	// Name is the name of the interface, empty if it was not found.
+	Name string
+	// MAC is the hardware address of the interface, nil if it has none.
+	MAC net.HardwareAddr
+	// MTU is the one the segments are sized for.
+	MTU int
+	// LinkType is the link layer of the packets, e.g. "Ethernet" or
+	// "Loop" for pcap and BPF, "IPv4" where the system builds the link
+	// header and "PacketIO" with Raw.PacketIO.
+	LinkType string
+	// GatewayMAC is the hardware address the packets of a dialed
+	// connection go to, that of the gateway or of a peer on the same link.
+	// It is nil where the system builds the link header, on loopback and
+	// for listeners.
+	GatewayMAC net.HardwareAddr
+}
+
+// interfaceInfo returns what is known of the interface holding ip, whose
+// link is of linkType.
+func interfaceInfo(ip net.IP, linkType string) InterfaceInfo {
+	info := InterfaceInfo{MTU: linkMTU(ip), LinkType: linkType}
+	if iface := interfaceOf(ip); iface != nil {
+		info.Name, info.MAC = iface.Name, iface.HardwareAddr
+	}
+	return info
+}
@@ -0,0 +1,151 @@
+package rawcon
+
+import (
+	"math/rand"
+	"sync"
+	"time"
+)
+
+// reorderTimeout is how long a packet held back to be reordered waits for
+// the next one before it is sent anyway.
+const reorderTimeout = 10 * time.Millisecond
+
+// Impairment is the set of faults Impair injects in the packets written.
+type Impairment struct {
+	// Loss, Duplicate, Reorder and Corrupt are the probabilities, from 0
+	// to 1, that a packet is dropped, sent twice, sent after the next one,
+	// or sent with a byte of its TCP segment flipped.
+	Loss      float64
+	Duplicate float64
+	Reorder   float64
+	Corrupt   float64
+	// Latency delays every packet, plus a random part of up to Jitter.
+	// The packets still leave in the order they were written.
+	Latency time.Duration
+	Jitter  time.Duration
+	// Seed seeds the random decisions, the same seed and the same packets
+	// give the same faults.
+	Seed int64
+}
+
+// Impair returns a PacketIO that writes to p with the faults of im. Reads
+// go to p unchanged, impair both ends of a pipe to impair both directions.
+func Impair(p PacketIO, im Impairment) PacketIO {
+	i := &impaired{
+		PacketIO: p,
+		im:       im,
+		rand:     rand.New(rand.NewSource(im.Seed)),
+		die:      make(chan struct{}),
+	}
+	if im.Latency > 0 || im.Jitter > 0 {
+		i.delayed = make(chan delayedPacket, packetPipeLen)
+		go i.deliver()
+	}
+	return i
+}
+
+type delayedPacket struct {
+	due  time.Time
+	data []byte
+}
+
+type impaired struct {
+	PacketIO
+	im      Impairment
+	lock    sync.Mutex
+	rand    *rand.Rand
+	held    []byte
+	timer   *time.Timer
+	delayed chan delayedPacket
+	die     chan struct{}
+	dieOnce sync.Once
+}
+
+func (i *impaired) WritePacketData(data []byte) error {
+	i.lock.Lock()
+	defer i.lock.Unlock()
+	if i.rand.Float64() < i.im.Loss {
+		return nil
+	}
+	data = append([]byte(nil), data...)
+	if i.rand.Float64() < i.im.Corrupt {
+		if seg, _, _, ok := parseIPv4(data); ok && len(seg) > 0 {
+			seg[i.rand.Intn(len(seg))] ^= byte(1 + i.rand.Intn(255))
+		}
+	}
+	copies := 1
+	if i.rand.Float64() < i.im.Duplicate {
+		copies = 2
+	}
+	if i.held == nil && i.rand.Float64() < i.im.Reorder {
+		i.held = data
+		i.timer = time.AfterFunc(reorderTimeout, i.release)
+		return nil
+	}
+	var err error
+	for ; copies > 0; copies-- {
+		if e := i.send(data); e != nil {
+			err = e
+		}
+	}
+	if i.held != nil {
+		i.timer.Stop()
+		i.send(i.held)
+		i.held = nil
+	}
+	return err
+}
+
+// release sends the packet held back if no other one came in time.
+func (i *impaired) release() {
+	i.lock.Lock()
+	defer i.lock.Unlock()
+	if i.held != nil {
+		i.send(i.held)
+		i.held = nil
+	}
+}
+
+// send passes data on to the PacketIO, at once or through the delay queue.
+// The caller must hold i.lock.
+func (i *impaired) send(data []byte) error {
+	if i.delayed == nil {
+		return i.PacketIO.WritePacketData(data)
+	}
+	d := i.im.Latency
+	if i.im.Jitter > 0 {
+		d += time.Duration(i.rand.Int63n(int64(i.im.Jitter)))
+	}
+	select {
+	case i.delayed <- delayedPacket{due: time.Now().Add(d), data: data}:
+	case <-i.die:
+	default:
+		// the queue is full, drop the packet like a full link would
+	}
+	return nil
+}
+
+func (i *impaired) deliver() {
+	for {
+		select {
+		case p := <-i.delayed:
+			if d := time.Until(p.due); d > 0 {
+				select {
+				case <-time.After(d):
+				case <-i.die:
+					return
+				}
+			}
+			i.PacketIO.WritePacketData(p.data)
+		case <-i.die:
+			return
+		}
+	}
+}
+
+func (i *impaired) Close() error {
+	i.dieOnce.Do(func() {
+		close(i.die)
+	})
+	return i.PacketIO.Close()
+}
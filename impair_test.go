@@ -0,0 +1,86 @@
+package rawcon
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func impairedPacket(b byte) []byte {
+	return ipv4Packet(net.IPv4(10, 0, 0, 1), net.IPv4(10, 0, 0, 2), int(b), 0, 64, []byte{b})
+}
+
+// readSegments reads what arrives on p within d and returns the first byte
+// of every TCP segment.
+func readSegments(p PacketIO, d time.Duration) (got []byte) {
+	p.SetReadDeadline(time.Now().Add(d))
+	for {
+		data, err := p.ReadPacketData()
+		if err != nil {
+			return
+		}
+		if seg, _, _, ok := parseIPv4(data); ok && len(seg) > 0 {
+			got = append(got, seg[0])
+		}
+	}
+}
+
+func TestImpairFaults(t *testing.T) {
+	tests := []struct {
+		name string
+		im   Impairment
+		want string
+	}{
+		{"none", Impairment{}, "\x01\x02\x03"},
+		{"loss", Impairment{Loss: 1}, ""},
+		{"duplicate", Impairment{Duplicate: 1}, "\x01\x01\x02\x02\x03\x03"},
+		{"reorder", Impairment{Reorder: 1}, "\x02\x01\x03"},
+	}
+	for _, tt := range tests {
+		a, b := NewPacketPipe()
+		w := Impair(a, tt.im)
+		for i := byte(1); i <= 3; i++ {
+			w.WritePacketData(impairedPacket(i))
+		}
+		if got := readSegments(b, 3*reorderTimeout); string(got) != tt.want {
+			t.Errorf("%s: got %q, want %q", tt.name, got, tt.want)
+		}
+		w.Close()
+		b.Close()
+	}
+}
+
+func TestImpairSeed(t *testing.T) {
+	run := func() []byte {
+		a, b := NewPacketPipe()
+		defer b.Close()
+		w := Impair(a, Impairment{Loss: 0.5, Corrupt: 0.5, Seed: 42})
+		defer w.Close()
+		for i := byte(0); i < 100; i++ {
+			w.WritePacketData(impairedPacket(i))
+		}
+		return readSegments(b, 10*time.Millisecond)
+	}
+	first, second := run(), run()
+	if len(first) == 0 || len(first) == 100 {
+		t.Fatalf("%d of 100 packets arrived with 50%% loss", len(first))
+	}
+	if string(first) != string(second) {
+		t.Fatal("the same seed gave different faults")
+	}
+}
+
+func TestImpairLatency(t *testing.T) {
+	a, b := NewPacketPipe()
+	defer b.Close()
+	w := Impair(a, Impairment{Latency: 30 * time.Millisecond})
+	defer w.Close()
+	start := time.Now()
+	w.WritePacketData(impairedPacket(1))
+	if _, err := b.ReadPacketData(); err != nil {
+		t.Fatal(err)
+	}
+	if d := time.Since(start); d < 30*time.Millisecond {
+		t.Fatalf("packet arrived after %v", d)
+	}
+}
@@ -0,0 +1,109 @@
+// Package rawflag turns the options of rawcon.Raw into command line flags,
+// for the commands under cmd.
+package rawflag
+
+import (
+	"flag"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/biotooff/rawcon"
+)
+
+// Define defines a flag for every option of r that a command line can set,
+// named after the field in lower case: -nohttp for Raw.NoHTTP. Lists such
+// as Raw.Hosts are separated by commas. The callbacks, PacketIO and the
+// other options holding values of their own are left out.
+func Define(fs *flag.FlagSet, r *rawcon.Raw) {
+	v := reflect.ValueOf(r).Elem()
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		if !f.IsExported() {
+			continue
+		}
+		name := strings.ToLower(f.Name)
+		usage := "sets Raw." + f.Name
+		switch p := v.Field(i).Addr().Interface().(type) {
+		case *bool:
+			fs.BoolVar(p, name, *p, usage)
+		case *string:
+			fs.StringVar(p, name, *p, usage)
+		case *time.Duration:
+			fs.DurationVar(p, name, *p, usage)
+		case *int:
+			fs.IntVar(p, name, *p, usage)
+		case *[]string:
+			fs.Var((*stringList)(p), name, usage+", separated by commas")
+		case *[]int:
+			fs.Var((*intList)(p), name, usage+", separated by commas")
+		default:
+			// the modes such as Raw.IPID
+			if f.Type.Kind() == reflect.Int {
+				fs.Var(intValue{v.Field(i)}, name, usage+" to the number of the mode")
+			}
+		}
+	}
+}
+
+// intValue is a flag setting a field of a named integer type.
+type intValue struct {
+	v reflect.Value
+}
+
+func (iv intValue) String() string {
+	if !iv.v.IsValid() {
+		return "0"
+	}
+	return strconv.FormatInt(iv.v.Int(), 10)
+}
+
+func (iv intValue) Set(s string) error {
+	n, err := strconv.ParseInt(s, 0, 64)
+	if err != nil {
+		return err
+	}
+	iv.v.SetInt(n)
+	return nil
+}
+
+type stringList []string
+
+func (l *stringList) String() string {
+	if l == nil {
+		return ""
+	}
+	return strings.Join(*l, ",")
+}
+
+func (l *stringList) Set(s string) error {
+	*l = strings.Split(s, ",")
+	return nil
+}
+
+type intList []int
+
+func (l *intList) String() string {
+	if l == nil {
+		return ""
+	}
+	s := make([]string, len(*l))
+	for i, n := range *l {
+		s[i] = strconv.Itoa(n)
+	}
+	return strings.Join(s, ",")
+}
+
+func (l *intList) Set(s string) error {
+	*l = (*l)[:0]
+	for _, f := range strings.Split(s, ",") {
+		n, err := strconv.Atoi(f)
+		if err != nil {
+			return err
+		}
+		*l = append(*l, n)
+	}
+	return nil
+}
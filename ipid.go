@@ -0,0 +1,68 @@
+package rawcon
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/sha256"
+	"encoding/binary"
+	"net"
+	"sync/atomic"
+
+	"github.com/biotooff/rawcon/utils"
+)
+
+// IPIDMode is how the IP ID of the packets sent is chosen, see Raw.IPID.
+type IPIDMode int
+
+const (
+	// IPIDIncrement starts at a random ID and adds one per packet.
+	IPIDIncrement IPIDMode = iota
+	// IPIDZero always sends zero, which RFC 6864 allows since every packet
+	// has DF set.
+	IPIDZero
+	// IPIDRandom draws every ID at random.
+	IPIDRandom
+	// IPIDKeyed draws every ID from a PRF keyed by Raw.Key over the
+	// destination and a counter, random without the key.
+	IPIDKeyed
+)
+
+type ipidGen struct {
+	mode    IPIDMode
+	block   cipher.Block
+	counter atomic.Uint64
+	rnd     utils.Random
+}
+
+func (r *Raw) newIPID() *ipidGen {
+	g := &ipidGen{mode: r.IPID, rnd: r.random()}
+	if g.mode == IPIDKeyed {
+		if len(r.Key) == 0 {
+			g.mode = IPIDRandom
+		} else {
+			key := sha256.Sum256([]byte("ipid" + r.Key))
+			g.block, _ = aes.NewCipher(key[:16])
+		}
+	}
+	return g
+}
+
+// next returns the ID of the packet to dst sent after one with ID prev.
+func (g *ipidGen) next(prev uint16, dst net.IP) uint16 {
+	if g == nil {
+		return prev + 1
+	}
+	switch g.mode {
+	case IPIDZero:
+		return 0
+	case IPIDRandom:
+		return uint16(g.rnd.Uint32())
+	case IPIDKeyed:
+		var b [aes.BlockSize]byte
+		copy(b[:4], dst.To4())
+		binary.BigEndian.PutUint64(b[8:], g.counter.Add(1))
+		g.block.Encrypt(b[:], b[:])
+		return binary.BigEndian.Uint16(b[:])
+	}
+	return prev + 1
+}
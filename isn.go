@@ -0,0 +1,71 @@
+package rawcon
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"net"
+	"sync"
+	"time"
+)
+
+// ISNMode is how the initial sequence number of a connection is chosen,
+// see Raw.ISN.
+type ISNMode int
+
+const (
+	// ISNRandom draws every ISN at random.
+	ISNRandom ISNMode = iota
+	// ISNClock adds a keyed hash of the addresses and ports of the flow to
+	// a clock ticking every 4 microseconds, the ISNs of RFC 6528. The key
+	// comes from Raw.Key, or is drawn once for the process without one.
+	ISNClock
+	// ISNKeyed is the hash of ISNClock alone, the same for every
+	// connection of a flow, so that an end that knows Raw.Key computes the
+	// ISN of a flow without keeping state. Random without the key.
+	ISNKeyed
+)
+
+// isnTick is the period of the clock of ISNClock.
+const isnTick = 4 * time.Microsecond
+
+// isnSecret is the key of ISNClock without Raw.Key.
+var isnSecret = sync.OnceValue(func() []byte {
+	b := make([]byte, sha256.Size)
+	rand.Read(b)
+	return b
+})
+
+// isn returns the ISN of the connection from src:sport to dst:dport.
+func (r *Raw) isn(src net.IP, sport int, dst net.IP, dport int) uint32 {
+	mode := r.ISN
+	if mode == ISNKeyed && len(r.Key) == 0 {
+		mode = ISNRandom
+	}
+	if mode == ISNRandom {
+		return r.random().Uint32()
+	}
+	key := isnSecret()
+	if len(r.Key) > 0 {
+		sum := sha256.Sum256([]byte("isn" + r.Key))
+		key = sum[:]
+	}
+	isn := isnHash(key, src, sport, dst, dport)
+	if mode == ISNClock {
+		isn += uint32(time.Now().UnixNano() / int64(isnTick))
+	}
+	return isn
+}
+
+// isnHash is the F of RFC 6528 over the four-tuple.
+func isnHash(key []byte, src net.IP, sport int, dst net.IP, dport int) uint32 {
+	var b [12]byte
+	copy(b[0:4], src.To4())
+	copy(b[4:8], dst.To4())
+	binary.BigEndian.PutUint16(b[8:], uint16(sport))
+	binary.BigEndian.PutUint16(b[10:], uint16(dport))
+	mac := hmac.New(sha256.New, key)
+	mac.Write(b[:])
+	return binary.BigEndian.Uint32(mac.Sum(nil))
+}
@@ -0,0 +1,42 @@
+package rawcon
+
+import (
+	"errors"
+	"net"
+	"syscall"
+)
+
+// maxLocalPortTries bounds the ports a dial draws from Raw.LocalPort before
+// giving up on finding a free one.
+const maxLocalPortTries = 16
+
+// dialLocalPort opens the UDP socket of a connection to address, as dialUDP
+// does, on a port of Raw.LocalPort. A port is drawn at every call, so every
+// attempt, failover and reconnect of a dialer gets a new one, and another
+// is drawn while the system has the one drawn in use. A non-nil local
+// address, that of a resumed session, is used as it is.
+func (r *Raw) dialLocalPort(address string, local *net.UDPAddr) (net.Conn, error) {
+	if local != nil || r.LocalPort == "" {
+		return r.dialUDP(address, local)
+	}
+	ports, err := parsePorts(r.LocalPort)
+	if err != nil {
+		return nil, &net.AddrError{Err: err.Error(), Addr: r.LocalPort}
+	}
+	var ip net.IP
+	if r.Interface != "" {
+		if ip, err = interfaceIPv4(r.Interface); err != nil {
+			return nil, err
+		}
+	}
+	n := ports.count()
+	for i := 0; i < min(n, maxLocalPortTries); i++ {
+		port := ports.nth(r.random().Intn(n))
+		var c net.Conn
+		c, err = r.dialUDP(address, &net.UDPAddr{IP: ip, Port: port})
+		if err == nil || !errors.Is(err, syscall.EADDRINUSE) {
+			return c, err
+		}
+	}
+	return nil, err
+}
@@ -0,0 +1,178 @@
+package rawcon
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"time"
+)
+
+// A connection dialed with Raw.Key set carries a session token in its
+// handshake: the TLS session id, or a cookie of the HTTP request. The token
+// is sid(8) time(8) mac(16), where mac is a truncated HMAC-SHA256 of sid and
+// time keyed by Raw.Key. When a listener sees a valid token for a session it
+// already knows, coming from a new address and with a newer time, it moves
+// the existing connection there instead of creating a new one.
+
+const (
+	sessionIDLen    = 8
+	sessionTokenLen = 32
+)
+
+var sessionCookieName = []byte("Cookie: sid=")
+
+// newSessionID returns the id of a new session, or nil if connections dialed
+// with r cannot migrate.
+func (r *Raw) newSessionID() []byte {
+	if len(r.Key) == 0 || r.Udp2raw || r.Dummy || (r.NoHTTP && !r.TLS) {
+		return nil
+	}
+	sid := make([]byte, sessionIDLen)
+	r.random().Read(sid)
+	return sid
+}
+
+func (r *Raw) sessionMAC(b []byte) []byte {
+	mac := hmac.New(sha256.New, []byte(r.Key))
+	mac.Write(b[:sessionIDLen+8])
+	return mac.Sum(nil)[:sessionTokenLen-sessionIDLen-8]
+}
+
+func (r *Raw) sessionToken(sid []byte) []byte {
+	if sid == nil {
+		return nil
+	}
+	b := make([]byte, sessionTokenLen)
+	copy(b, sid)
+	binary.BigEndian.PutUint64(b[sessionIDLen:], uint64(time.Now().UnixNano()))
+	copy(b[sessionIDLen+8:], r.sessionMAC(b))
+	return b
+}
+
+func (r *Raw) openSessionToken(b []byte) (sid string, ts int64, ok bool) {
+	if len(r.Key) == 0 || len(b) != sessionTokenLen {
+		return
+	}
+	if !hmac.Equal(b[sessionIDLen+8:], r.sessionMAC(b)) {
+		return
+	}
+	return string(b[:sessionIDLen]), int64(binary.BigEndian.Uint64(b[sessionIDLen:])), true
+}
+
+// sessionCookie returns the request header carrying the session token.
+func (r *Raw) sessionCookie(sid []byte) string {
+	token := r.sessionToken(sid)
+	if token == nil {
+		return ""
+	}
+	return string(sessionCookieName) + base64.RawURLEncoding.EncodeToString(token) + "\r\n"
+}
+
+func parseSessionCookie(req []byte) []byte {
+	i := bytes.Index(req, sessionCookieName)
+	if i < 0 {
+		return nil
+	}
+	v := req[i+len(sessionCookieName):]
+	if j := bytes.IndexByte(v, '\r'); j >= 0 {
+		v = v[:j]
+	}
+	token, err := base64.RawURLEncoding.DecodeString(string(v))
+	if err != nil {
+		return nil
+	}
+	return token
+}
+
+// Migrate re-handshakes the connection from the local address the system
+// now uses to reach the peer, e.g. after a network change, and keeps the
+// session. It needs Raw.Key and the HTTP or TLS handshake on both sides.
+func (conn *RAWConn) Migrate() (err error) {
+	if conn.sid == nil {
+		return errors.New("connection cannot migrate")
+	}
+	n, err := conn.r.dial(conn.RemoteAddr().String(), conn.sid, nil)
+	if err != nil {
+		return
+	}
+	conn.takeOver(n)
+	return
+}
+
+// bindSession is called once the handshake request of info, a connection
+// from addrstr, has been accepted. It returns the connection to go on with:
+// info itself, the connection of the same session which is moved to addrstr,
+// or nil if the token was replayed.
+func (listener *RAWListener) bindSession(info *connInfo, addrstr string, token []byte) *connInfo {
+	sid, ts, ok := listener.r.openSessionToken(token)
+	if !ok {
+		return info
+	}
+	listener.mutex.Lock()
+	defer listener.mutex.Unlock()
+	old, ok := listener.sessions[sid]
+	if !ok || old == info {
+		info.sid = sid
+		info.sts = ts
+		listener.sessions[sid] = info
+		return info
+	}
+	if ts <= old.sts {
+		return nil
+	}
+	for k, v := range listener.conns {
+		if v == old {
+			delete(listener.conns, k)
+		}
+	}
+	// the writes to the peer read what they send with under old.lock
+	old.lock.Lock()
+	old.layer = info.layer
+	old.sts = ts
+	old.state = info.state
+	old.rep = info.rep
+	old.hs = info.hs
+	old.tls = info.tls
+	old.prof = info.prof
+	mss := 0
+	if info.mss > 0 && info.mss != old.mss {
+		old.mss, mss = info.mss, info.mss
+	}
+	old.lock.Unlock()
+	if mss > 0 {
+		listener.r.emit(Event{Type: EventMSS, Addr: old.addr, MSS: mss})
+	}
+	if old.addr.String() != addrstr {
+		listener.aliases[old.addr.String()] = old
+	}
+	delete(listener.newcons, addrstr)
+	return old
+}
+
+// connByAddr looks a connection up by the address reported to the
+// application, the caller must hold listener.mutex.
+func (listener *RAWListener) connByAddr(addrstr string) (info *connInfo, ok bool) {
+	if info, ok = listener.aliases[addrstr]; ok {
+		return
+	}
+	info, ok = listener.conns[addrstr]
+	return
+}
+
+// forgetConn drops the session state of info, the caller must hold
+// listener.mutex.
+func (listener *RAWListener) forgetConn(info *connInfo) {
+	if info.sid != "" && listener.sessions[info.sid] == info {
+		delete(listener.sessions, info.sid)
+	}
+	if info.addr != nil && listener.aliases[info.addr.String()] == info {
+		delete(listener.aliases, info.addr.String())
+	}
+	if info.addr != nil {
+		listener.rqueue.forget(info.addr)
+	}
+	info.values.end()
+}
@@ -0,0 +1,81 @@
+package rawcon
+
+import "net"
+
+// GetMSSByAddr returns the MSS of the peer at addr, which is known from its
+// SYN on, or 0 for an unknown peer.
+func (listener *RAWListener) GetMSSByAddr(addr net.Addr) int {
+	listener.mutex.RLock()
+	defer listener.mutex.RUnlock()
+	info, ok := listener.connByAddr(addr.String())
+	if !ok {
+		info, ok = listener.newcons[addr.String()]
+	}
+	if ok {
+		mss, _, _ := info.framing()
+		return mss
+	}
+	return 0
+}
+
+// PeerMSSAssumed tells whether the peer at addr announced no MSS in its SYN,
+// so that the MSS GetMSSByAddr returns is Raw.FallbackMSS.
+func (listener *RAWListener) PeerMSSAssumed(addr net.Addr) bool {
+	listener.mutex.RLock()
+	defer listener.mutex.RUnlock()
+	info, ok := listener.connByAddr(addr.String())
+	if !ok {
+		info, ok = listener.newcons[addr.String()]
+	}
+	return ok && info.mssAssumed
+}
+
+// SetMSS changes the MSS of conn, e.g. once a probe found the MTU of the
+// path, and reports an EventMSS if it changed.
+func (conn *RAWConn) SetMSS(mss int) {
+	conn.lock.Lock()
+	old := conn.mss
+	conn.mss = mss
+	conn.lock.Unlock()
+	conn.mssChanged(old)
+}
+
+// mssChanged reports an EventMSS if the MSS of conn is no longer old.
+func (conn *RAWConn) mssChanged(old int) {
+	if mss := conn.GetMSS(); mss != old {
+		conn.r.emit(Event{Type: EventMSS, Addr: conn.RemoteAddr(), MSS: mss})
+	}
+}
+
+// SetMSSByAddr changes the MSS of the peer at addr like SetMSS does.
+func (listener *RAWListener) SetMSSByAddr(addr net.Addr, mss int) {
+	listener.mutex.Lock()
+	info, ok := listener.connByAddr(addr.String())
+	if !ok {
+		info, ok = listener.newcons[addr.String()]
+	}
+	var old int
+	if ok {
+		info.lock.Lock()
+		old, info.mss = info.mss, mss
+		info.lock.Unlock()
+	}
+	listener.mutex.Unlock()
+	if ok && old != mss {
+		listener.r.emit(Event{Type: EventMSS, Addr: addr, MSS: mss})
+	}
+}
+
+// framing returns the MSS of the peer of info and how the segments to it
+// are framed, which bindSession changes when its session resumes.
+func (info *connInfo) framing() (mss int, tls bool, prof profile) {
+	info.lock.Lock()
+	defer info.lock.Unlock()
+	return info.mss, info.tls, info.prof
+}
+
+// payloadLimit returns how much a segment to the peer of info carries.
+func (info *connInfo) payloadLimit() int {
+	mss, tls, prof := info.framing()
+	return payloadLimit(mss, recordLen(tls, prof), info.u2r, info.pad)
+}
@@ -0,0 +1,125 @@
+package rawcon
+
+import (
+	"encoding/binary"
+	"net"
+)
+
+// Segments are as large as the MTU of the interface they go out on allows,
+// jumbo frames included, and the SYN and the SYN-ACK announce the MSS that
+// MTU takes, unless Raw.AdvertisedMSS says otherwise. A listener on the
+// wildcard address takes the MTU of the interface each SYN comes in on,
+// so that a peer reaching it over a PPPoE link or a tunnel is not told to
+// send more than fits. The loopback interfaces, whose MTU is 64KB on some
+// systems, and the interfaces that cannot be found keep defaultMTU.
+
+const (
+	defaultMTU = 1500
+	// maxMTU bounds the MTU taken from an interface, the largest jumbo
+	// frames in use
+	maxMTU = 9216
+	// captureSlack is what the capture keeps past the MTU, for the link
+	// header
+	captureSlack = 100
+)
+
+// linkMTU returns the MTU of the interface holding ip, or the least of
+// those with an IPv4 address for the wildcard address.
+func linkMTU(ip net.IP) int {
+	ifaces, err := net.Interfaces()
+	if err != nil {
+		return defaultMTU
+	}
+	mtu := 0
+	for _, iface := range ifaces {
+		if iface.Flags&net.FlagUp == 0 || iface.Flags&net.FlagLoopback != 0 || iface.MTU <= 0 {
+			continue
+		}
+		addrs, err := iface.Addrs()
+		if err != nil {
+			continue
+		}
+		for _, addr := range addrs {
+			ipnet, ok := addr.(*net.IPNet)
+			if !ok || ipnet.IP.To4() == nil {
+				continue
+			}
+			if ipnet.IP.Equal(ip) {
+				return min(max(iface.MTU, minPathMTU), maxMTU)
+			}
+			if ip.IsUnspecified() && (mtu == 0 || iface.MTU < mtu) {
+				mtu = iface.MTU
+			}
+		}
+	}
+	if mtu == 0 {
+		return defaultMTU
+	}
+	return min(max(mtu, minPathMTU), maxMTU)
+}
+
+// linkMSS returns the MSS announced on an interface of mtu, which is 0 when
+// it is not known.
+func linkMSS(mtu int) int {
+	if mtu <= 0 {
+		return defaultMSS
+	}
+	return mtu - 40
+}
+
+// advertisedMSS returns the MSS the SYN or the SYN-ACK announces on an
+// interface of mtu.
+func (r *Raw) advertisedMSS(mtu int) int {
+	if r.AdvertisedMSS > 0 {
+		return min(r.AdvertisedMSS, 65535)
+	}
+	return linkMSS(mtu)
+}
+
+// peerMTU returns the MTU of the interface holding local, the address the
+// SYN of a peer came to.
+func (listener *RAWListener) peerMTU(local net.IP) int {
+	if !listener.laddr.IP.IsUnspecified() {
+		return listener.mtu
+	}
+	return linkMTU(local)
+}
+
+// sendPeerSynAck sends the SYN-ACK answering the SYN of the peer of info.
+func (listener *RAWListener) sendPeerSynAck(info *connInfo) error {
+	return listener.sendSynAckWithLayer(info.layer, listener.r.advertisedMSS(info.mtu), info.peer)
+}
+
+// sendMSS returns the MSS of the segments sent on an interface of mtu to a
+// peer that announced peer, 0 if it announced none.
+func sendMSS(peer, mtu int) int {
+	if peer <= 0 {
+		peer = defaultMSS
+	}
+	return min(peer, linkMSS(mtu))
+}
+
+// minPeerMSS is the least MSS a peer is taken to announce, as Linux's
+// tcp_min_snd_mss. A smaller one, 0 included, counts as none.
+const minPeerMSS = 48
+
+// peerMSS returns the MSS of the segments sent on an interface of mtu to a
+// peer that announced peer, and whether it is Raw.FallbackMSS because the
+// peer announced none.
+func (r *Raw) peerMSS(peer, mtu int) (mss int, assumed bool) {
+	if peer >= minPeerMSS {
+		return sendMSS(peer, mtu), false
+	}
+	return sendMSS(r.FallbackMSS, mtu), true
+}
+
+// mssOption returns the data of the TCP option announcing mss.
+func mssOption(mss int) []byte {
+	return binary.BigEndian.AppendUint16(nil, uint16(mss))
+}
+
+// recvBufLen returns how long a buffer holding any packet off an interface
+// of mtu is.
+func recvBufLen(mtu int) int {
+	return max(2048, mtu+captureSlack)
+}
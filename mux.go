@@ -0,0 +1,98 @@
+package rawcon
+
+import (
+	"encoding/binary"
+	"errors"
+	"net"
+
+	"github.com/biotooff/rawcon/utils"
+)
+
+// Many UDP flows can share a connection, and so one handshake and one
+// conntrack entry: the datagrams written with WriteToFlow start with the ID
+// of their flow as a uvarint, one byte below 128, which ReadFromFlow strips
+// again. Both ends have to use the flow methods, Read and Write carry no
+// header.
+
+// maxFlowHeader is the longest header of a flow ID.
+const maxFlowHeader = binary.MaxVarintLen32
+
+var errFlowHeader = errors.New("datagram without a flow header")
+
+// putFlow returns b behind the header of flow id, in a buffer the caller
+// gives back with utils.PutBuf.
+func putFlow(id uint32, b []byte) []byte {
+	buf := utils.GetBuf(maxFlowHeader + len(b))
+	n := binary.PutUvarint(buf, uint64(id))
+	return buf[:n+copy(buf[n:], b)]
+}
+
+// cutFlow splits the datagram b into the ID of its flow and its payload.
+func cutFlow(b []byte) (id uint32, payload []byte, err error) {
+	v, n := binary.Uvarint(b)
+	if n <= 0 || v > 1<<32-1 {
+		return 0, nil, errFlowHeader
+	}
+	return uint32(v), b[n:], nil
+}
+
+// flowErr has the limit of a MessageTooLongError leave room for the header
+// of the flow.
+func flowErr(err error, hdr int) error {
+	var tooLong *MessageTooLongError
+	if errors.As(err, &tooLong) {
+		return &MessageTooLongError{Size: tooLong.Size - hdr, Limit: tooLong.Limit - hdr}
+	}
+	return err
+}
+
+// WriteToFlow writes b as a datagram of the flow id.
+func (conn *RAWConn) WriteToFlow(id uint32, b []byte) (n int, err error) {
+	buf := putFlow(id, b)
+	defer utils.PutBuf(buf)
+	if _, err = conn.Write(buf); err != nil {
+		return 0, flowErr(err, len(buf)-len(b))
+	}
+	return len(b), nil
+}
+
+// ReadFromFlow reads the next datagram into b and returns the ID of its
+// flow. The datagrams that carry no flow header are dropped.
+func (conn *RAWConn) ReadFromFlow(b []byte) (n int, id uint32, err error) {
+	buf := utils.GetBuf(maxFlowHeader + len(b))
+	defer utils.PutBuf(buf)
+	for {
+		if n, err = conn.Read(buf); err != nil {
+			return 0, 0, err
+		}
+		if fid, payload, ferr := cutFlow(buf[:n]); ferr == nil {
+			return copy(b, payload), fid, nil
+		}
+	}
+}
+
+// WriteToFlow writes b as a datagram of the flow id to the peer at addr.
+func (listener *RAWListener) WriteToFlow(id uint32, b []byte, addr net.Addr) (n int, err error) {
+	buf := putFlow(id, b)
+	defer utils.PutBuf(buf)
+	if _, err = listener.WriteTo(buf, addr); err != nil {
+		return 0, flowErr(err, len(buf)-len(b))
+	}
+	return len(b), nil
+}
+
+// ReadFromFlow reads the next datagram into b and returns the ID of its
+// flow and the peer that sent it. The datagrams that carry no flow header
+// are dropped.
+func (listener *RAWListener) ReadFromFlow(b []byte) (n int, id uint32, addr net.Addr, err error) {
+	buf := utils.GetBuf(maxFlowHeader + len(b))
+	defer utils.PutBuf(buf)
+	for {
+		if n, addr, err = listener.ReadFrom(buf); err != nil {
+			return 0, 0, nil, err
+		}
+		if fid, payload, ferr := cutFlow(buf[:n]); ferr == nil {
+			return copy(b, payload), fid, addr, nil
+		}
+	}
+}
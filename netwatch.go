@@ -0,0 +1,54 @@
+package rawcon
+
+import (
+	"net"
+	"time"
+)
+
+// With Raw.WatchNetwork set a dialed connection checks every so often
+// which local address the system would now reach the peer from, and
+// whether the interface holding it is up. Once the address changed, or the
+// interface came back after going down, the handle or socket it used may
+// be dead: it dials the peer again and moves over like Migrate does. A
+// connection without a session shows up as a new peer at the listener.
+
+const netWatchInterval = time.Second
+
+func (conn *RAWConn) watchNetwork() {
+	ticker := time.NewTicker(netWatchInterval)
+	defer ticker.Stop()
+	wasDown := false
+	for {
+		select {
+		case <-conn.die:
+			return
+		case <-ticker.C:
+		}
+		remote := conn.RemoteAddr().String()
+		ip, err := conn.r.routeIPv4(remote)
+		if err != nil {
+			wasDown = true
+			continue
+		}
+		if iface := interfaceOf(ip); iface == nil || iface.Flags&net.FlagUp == 0 {
+			wasDown = true
+			continue
+		}
+		if !wasDown && ip.Equal(conn.LocalAddr().(*net.UDPAddr).IP) {
+			continue
+		}
+		n, err := conn.r.dial(remote, conn.sid, nil)
+		if err != nil {
+			continue
+		}
+		select {
+		case <-conn.die:
+			n.Close()
+			return
+		default:
+		}
+		conn.takeOver(n)
+		wasDown = false
+		conn.r.event(EventNetworkChange, conn.RemoteAddr())
+	}
+}
@@ -0,0 +1,37 @@
+package rawcon
+
+// A dialer's SYN offers the MSS, a window scale, SACK and the timestamps,
+// as the stacks it passes for do. The options that follow have to agree
+// with what the two SYNs negotiated, or stateful inspection takes the flow
+// for forged: a SYN-ACK carries only the options its SYN offered, the
+// window is only scaled when both ends announced a scale, and the
+// timestamps probing the round trip only go to a peer that offered them.
+// Others get a window probe instead, which any TCP answers.
+
+// peerOptions are the options the SYN or SYN-ACK of a peer offered.
+type peerOptions struct {
+	seen       bool // false if no SYN of the peer was read
+	sack       bool
+	timestamps bool
+	tsval      uint32 // of the SYN, echoed by the SYN-ACK
+	wscale     int    // -1 if none
+}
+
+// allowsTimestamps tells whether segments to the peer may carry the
+// timestamps option. Without a SYN of the peer, as on a resumed
+// connection, they may, as they always did.
+func (o peerOptions) allowsTimestamps() bool {
+	return !o.seen || o.timestamps
+}
+
+// answerRTTProbe answers a probe of the round trip time from the peer of
+// info, echoing val, or with a pure ACK if the peer did not offer the
+// timestamps.
+func (listener *RAWListener) answerRTTProbe(info *connInfo, val uint32) error {
+	info.lock.Lock()
+	defer info.lock.Unlock()
+	if !info.peer.allowsTimestamps() {
+		return listener.sendAckWithLayer(info.layer)
+	}
+	return listener.sendTimestampsWithLayer(info.layer, tsNow(), val)
+}
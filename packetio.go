@@ -0,0 +1,210 @@
+package rawcon
+
+import (
+	"encoding/binary"
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/biotooff/rawcon/utils"
+)
+
+// PacketIO is a source and sink of IPv4 packets carrying TCP, or UDP in the
+// fake UDP mode, used through Raw.PacketIO instead of the sockets or the
+// capture of the system. A connection or a listener owns it and closes it
+// when it is closed.
+type PacketIO interface {
+	// ReadPacketData returns the next packet, starting with its IPv4
+	// header. It fails with an error whose Timeout method returns true
+	// once the read deadline has passed.
+	ReadPacketData() ([]byte, error)
+	// WritePacketData sends data, a whole IPv4 packet. data is reused once
+	// it returns, an implementation copies what it keeps past the call.
+	WritePacketData(data []byte) error
+	SetReadDeadline(t time.Time) error
+	Close() error
+}
+
+// packetsPending tells whether pio holds a packet it can return without
+// waiting, which only the PacketIOs of rawcon tell.
+func packetsPending(pio PacketIO) bool {
+	p, ok := pio.(interface{ pending() bool })
+	return ok && p.pending()
+}
+
+// releasePacket hands data, a packet ReadPacketData of pio returned, back to
+// pio once it is no longer used, which only the PacketIOs of rawcon take.
+func releasePacket(pio PacketIO, data []byte) {
+	if p, ok := pio.(interface{ release([]byte) }); ok {
+		p.release(data)
+	}
+}
+
+// packetPipeLen is the number of packets an end of a pipe holds until they
+// are read, the next ones are dropped like a full link would.
+const packetPipeLen = 1024
+
+// NewPacketPipe returns the two ends of an in-memory link: the packets
+// written to one of them are read from the other, in order. It lets a
+// dialer and a listener talk to each other without root or a network.
+func NewPacketPipe() (PacketIO, PacketIO) {
+	a, b := newPipeEnd(), newPipeEnd()
+	a.peer, b.peer = b, a
+	return a, b
+}
+
+func newPipeEnd() *pipeEnd {
+	return &pipeEnd{
+		in:   make(chan []byte, packetPipeLen),
+		free: make(chan []byte, packetPipeLen),
+		die:  make(chan struct{}),
+		dl:   make(chan struct{}),
+	}
+}
+
+type pipeEnd struct {
+	in chan []byte
+	// free holds the buffers of the packets read and released, the next
+	// packets written to the pipe end are copied into them
+	free     chan []byte
+	peer     *pipeEnd
+	die      chan struct{}
+	dieOnce  sync.Once
+	lock     sync.Mutex
+	deadline time.Time
+	// dl is closed when the deadline changes
+	dl chan struct{}
+}
+
+func (p *pipeEnd) ReadPacketData() ([]byte, error) {
+	for {
+		p.lock.Lock()
+		deadline, dl := p.deadline, p.dl
+		p.lock.Unlock()
+		var timer *time.Timer
+		var timeout <-chan time.Time
+		if !deadline.IsZero() {
+			d := time.Until(deadline)
+			if d <= 0 {
+				return nil, os.ErrDeadlineExceeded
+			}
+			timer = time.NewTimer(d)
+			timeout = timer.C
+		}
+		var data []byte
+		var err error
+		select {
+		case data = <-p.in:
+		case <-p.die:
+			err = net.ErrClosed
+		case <-timeout:
+			err = os.ErrDeadlineExceeded
+		case <-dl:
+		}
+		if timer != nil {
+			timer.Stop()
+		}
+		if data != nil || err != nil {
+			return data, err
+		}
+	}
+}
+
+// pending tells whether a packet waits to be read.
+func (p *pipeEnd) pending() bool {
+	return len(p.in) > 0
+}
+
+func (p *pipeEnd) WritePacketData(data []byte) error {
+	select {
+	case <-p.die:
+		return net.ErrClosed
+	default:
+	}
+	var b []byte
+	select {
+	case b = <-p.peer.free:
+	default:
+	}
+	b = append(b[:0], data...)
+	select {
+	case p.peer.in <- b:
+	default:
+		p.peer.release(b)
+	}
+	return nil
+}
+
+// release keeps b, a packet ReadPacketData returned, for the next packet
+// written to p.
+func (p *pipeEnd) release(b []byte) {
+	select {
+	case p.free <- b:
+	default:
+	}
+}
+
+func (p *pipeEnd) SetReadDeadline(t time.Time) error {
+	p.lock.Lock()
+	p.deadline = t
+	close(p.dl)
+	p.dl = make(chan struct{})
+	p.lock.Unlock()
+	return nil
+}
+
+func (p *pipeEnd) Close() error {
+	p.dieOnce.Do(func() {
+		close(p.die)
+	})
+	return nil
+}
+
+// ipv4Packet puts an IPv4 header in front of the TCP segment seg, in a
+// buffer of utils.GetBuf.
+func ipv4Packet(srcip, dstip net.IP, id, tos, ttl int, seg []byte) []byte {
+	return ipv4PacketOf(6, srcip, dstip, id, tos, ttl, seg)
+}
+
+// ipv4PacketOf is ipv4Packet for seg of the protocol proto.
+func ipv4PacketOf(proto byte, srcip, dstip net.IP, id, tos, ttl int, seg []byte) []byte {
+	b := utils.GetBuf(20 + len(seg))
+	clear(b[:20])
+	b[0] = 0x45
+	b[1] = byte(tos)
+	binary.BigEndian.PutUint16(b[2:], uint16(len(b)))
+	binary.BigEndian.PutUint16(b[4:], uint16(id))
+	b[6] = 0x40 // don't fragment
+	b[8] = byte(ttl)
+	b[9] = proto
+	copy(b[12:16], srcip.To4())
+	copy(b[16:20], dstip.To4())
+	var sum uint32
+	for i := 0; i < 20; i += 2 {
+		sum += uint32(binary.BigEndian.Uint16(b[i:]))
+	}
+	for sum > 0xffff {
+		sum = sum>>16 + sum&0xffff
+	}
+	binary.BigEndian.PutUint16(b[10:], ^uint16(sum))
+	copy(b[20:], seg)
+	return b
+}
+
+// parseIPv4 returns the TCP segment of the IPv4 packet b and its addresses.
+// Fragments and other protocols are not ok.
+func parseIPv4(b []byte) (seg []byte, srcip, dstip net.IP, ok bool) {
+	if len(b) < 20 || b[0]>>4 != 4 || b[9] != 6 {
+		return
+	}
+	hl := int(b[0]&0xf) * 4
+	tl := int(binary.BigEndian.Uint16(b[2:]))
+	if hl < 20 || tl < hl || tl > len(b) {
+		return
+	}
+	if binary.BigEndian.Uint16(b[6:])&0x3fff != 0 {
+		return
+	}
+	return b[hl:tl], net.IP(b[12:16]), net.IP(b[16:20]), true
+}
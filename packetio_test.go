@@ -0,0 +1,3004 @@
+package rawcon
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/biotooff/rawcon/utils"
+	"golang.org/x/net/ipv4"
+)
+
+func TestPacketPipe(t *testing.T) {
+	a, b := NewPacketPipe()
+	defer a.Close()
+	defer b.Close()
+
+	pkt := ipv4Packet(net.IPv4(10, 0, 0, 1), net.IPv4(10, 0, 0, 2), 1, 0, 64, []byte("segment"))
+	if err := a.WritePacketData(pkt); err != nil {
+		t.Fatal(err)
+	}
+	data, err := b.ReadPacketData()
+	if err != nil {
+		t.Fatal(err)
+	}
+	seg, src, dst, ok := parseIPv4(data)
+	if !ok || string(seg) != "segment" || !src.Equal(net.IPv4(10, 0, 0, 1)) || !dst.Equal(net.IPv4(10, 0, 0, 2)) {
+		t.Fatalf("unexpected packet %v %q %v %v", ok, seg, src, dst)
+	}
+
+	b.SetReadDeadline(time.Now().Add(10 * time.Millisecond))
+	_, err = b.ReadPacketData()
+	if e, ok := err.(net.Error); !ok || !e.Timeout() {
+		t.Fatalf("expected a timeout, got %v", err)
+	}
+	b.Close()
+	if _, err = b.ReadPacketData(); err == nil {
+		t.Fatal("read from a closed end")
+	}
+}
+
+func TestPacketPipeAllocs(t *testing.T) {
+	a, b := NewPacketPipe()
+	defer a.Close()
+	defer b.Close()
+
+	pkt := ipv4Packet(net.IPv4(10, 0, 0, 1), net.IPv4(10, 0, 0, 2), 1, 0, 64, make([]byte, 1400))
+	// the packets released are copied into for the next ones written
+	allocs := testing.AllocsPerRun(100, func() {
+		if err := a.WritePacketData(pkt); err != nil {
+			t.Fatal(err)
+		}
+		data, err := b.ReadPacketData()
+		if err != nil {
+			t.Fatal(err)
+		}
+		releasePacket(b, data)
+	})
+	if allocs != 0 {
+		t.Fatalf("%v allocations a packet", allocs)
+	}
+}
+
+// pipeEchoServer listens on address over an end of a pipe and echoes what
+// it reads. It returns the Raw to dial with over the other end.
+func pipeEchoServer(t testing.TB, r Raw, address string) (dr *Raw, listener *RAWListener) {
+	client, server := NewPacketPipe()
+	lr := r
+	dr = &r
+	dr.PacketIO = client
+	listener = echoServer(t, lr, server, address)
+	return
+}
+
+// echoServer listens on address over pio and echoes what it reads.
+func echoServer(t testing.TB, r Raw, pio PacketIO, address string) *RAWListener {
+	r.PacketIO = pio
+	listener, err := r.ListenRAW(address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		buf := make([]byte, 2048)
+		for {
+			n, addr, err := listener.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			listener.WriteTo(buf[:n], addr)
+		}
+	}()
+	return listener
+}
+
+func testPipeEcho(t *testing.T, r Raw, address string) {
+	dr, listener := pipeEchoServer(t, r, address)
+	defer listener.Close()
+	conn, err := dr.DialRAW(address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	testEcho(t, conn)
+}
+
+func testEcho(t *testing.T, conn *RAWConn) {
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	buf := make([]byte, 2048)
+	for i := 0; i < 10; i++ {
+		msg := bytes.Repeat([]byte{byte(i)}, 100+i)
+		if _, err := conn.Write(msg); err != nil {
+			t.Fatal(err)
+		}
+		n, err := conn.Read(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(buf[:n], msg) {
+			t.Fatalf("echo %d mismatch", i)
+		}
+	}
+}
+
+func TestPipeEchoNoHTTP(t *testing.T) {
+	testPipeEcho(t, Raw{NoHTTP: true}, "127.0.0.1:6701")
+}
+
+func TestPipeEchoHTTP(t *testing.T) {
+	testPipeEcho(t, Raw{Hosts: []string{"www.example.com"}}, "127.0.0.1:6702")
+}
+
+func TestPipeEchoTLS(t *testing.T) {
+	testPipeEcho(t, Raw{TLS: true}, "127.0.0.1:6703")
+}
+
+func TestPipeEchoUdp2raw(t *testing.T) {
+	testPipeEcho(t, Raw{Udp2raw: true}, "127.0.0.1:6704")
+}
+
+func TestPipeEchoZeroRTT(t *testing.T) {
+	testPipeEcho(t, Raw{ZeroRTT: true}, "127.0.0.1:6705")
+	testPipeEcho(t, Raw{ZeroRTT: true, TLS: true}, "127.0.0.1:6706")
+}
+
+// keepOpen keeps a connection from closing the PacketIO it is handed over.
+type keepOpen struct {
+	PacketIO
+}
+
+func (keepOpen) Close() error {
+	return nil
+}
+
+func TestPipeResumeSession(t *testing.T) {
+	for i, r := range []Raw{{}, {TLS: true}, {Udp2raw: true}} {
+		address := "127.0.0.1:" + strconv.Itoa(6710+i)
+		dr, listener := pipeEchoServer(t, r, address)
+		dr.PacketIO = keepOpen{dr.PacketIO}
+		conn, err := dr.DialRAW(address)
+		if err != nil {
+			t.Fatal(err)
+		}
+		testEcho(t, conn)
+		session, err := conn.ExportSession()
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn.Close()
+		if conn, err = dr.ResumeRAW(session); err != nil {
+			t.Fatal(err)
+		}
+		testEcho(t, conn)
+		conn.Close()
+		listener.Close()
+	}
+}
+
+func TestPipeRTT(t *testing.T) {
+	dr, listener := pipeEchoServer(t, Raw{NoHTTP: true, RTTInterval: 10 * time.Millisecond}, "127.0.0.1:6720")
+	defer listener.Close()
+	dr.PacketIO = Impair(dr.PacketIO, Impairment{Latency: 20 * time.Millisecond})
+	conn, err := dr.DialRAW("127.0.0.1:6720")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	go func() {
+		buf := make([]byte, 2048)
+		for {
+			if _, err := conn.Read(buf); err != nil {
+				return
+			}
+		}
+	}()
+	deadline := time.Now().Add(2 * time.Second)
+	for conn.RTT() == 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if rtt := conn.RTT(); rtt < 20*time.Millisecond || rtt > time.Second {
+		t.Fatalf("measured an RTT of %v over a link with 20ms latency", rtt)
+	}
+}
+
+// natRebind moves the packets sent from port from to port to once rebound
+// is set, like a NAT whose mapping changed mid-flow.
+type natRebind struct {
+	PacketIO
+	from, to uint16
+	rebound  atomic.Bool
+}
+
+// rewritePort replaces the port at off of the TCP segment in b if it is
+// old, and fixes the checksum up like RFC 1624 does.
+func rewritePort(b []byte, off int, old, new uint16) []byte {
+	seg, _, _, ok := parseIPv4(b)
+	if !ok || len(seg) < 20 || binary.BigEndian.Uint16(seg[off:]) != old {
+		return b
+	}
+	b = append([]byte(nil), b...)
+	seg = b[len(b)-len(seg):]
+	binary.BigEndian.PutUint16(seg[off:], new)
+	sum := uint32(^binary.BigEndian.Uint16(seg[16:])) + uint32(^old) + uint32(new)
+	for sum > 0xffff {
+		sum = sum>>16 + sum&0xffff
+	}
+	binary.BigEndian.PutUint16(seg[16:], ^uint16(sum))
+	return b
+}
+
+func (n *natRebind) WritePacketData(b []byte) error {
+	if n.rebound.Load() {
+		b = rewritePort(b, 0, n.from, n.to)
+	}
+	return n.PacketIO.WritePacketData(b)
+}
+
+func (n *natRebind) ReadPacketData() ([]byte, error) {
+	b, err := n.PacketIO.ReadPacketData()
+	if err == nil && n.rebound.Load() {
+		b = rewritePort(b, 2, n.to, n.from)
+	}
+	return b, err
+}
+
+func TestPipeSegmentID(t *testing.T) {
+	dr, listener := pipeEchoServer(t, Raw{Key: "key", SegmentID: true}, "127.0.0.1:6730")
+	defer listener.Close()
+	nat := &natRebind{PacketIO: dr.PacketIO}
+	dr.PacketIO = nat
+	conn, err := dr.DialRAW("127.0.0.1:6730")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	testEcho(t, conn)
+	nat.from = uint16(conn.LocalAddr().(*net.UDPAddr).Port)
+	nat.to = nat.from + 1
+	nat.rebound.Store(true)
+	testEcho(t, conn)
+}
+
+// lastData keeps a copy of the last packet with data written through it.
+type lastData struct {
+	PacketIO
+	mu   sync.Mutex
+	last []byte
+}
+
+func (l *lastData) WritePacketData(b []byte) error {
+	if seg, _, _, ok := parseIPv4(b); ok && len(seg) > 20 && len(seg) > int(seg[12]>>4)*4 {
+		l.mu.Lock()
+		l.last = append(l.last[:0], b...)
+		l.mu.Unlock()
+	}
+	return l.PacketIO.WritePacketData(b)
+}
+
+// TestPipeSegmentIDReplay has segments the dialer sent arrive again from
+// another port, once as they were and once with a sequence number ahead,
+// neither of which may move the connection there.
+func TestPipeSegmentIDReplay(t *testing.T) {
+	dr, listener := pipeEchoServer(t, Raw{Key: "key", SegmentID: true}, "127.0.0.1:6855")
+	defer listener.Close()
+	last := &lastData{PacketIO: dr.PacketIO}
+	dr.PacketIO = last
+	conn, err := dr.DialRAW("127.0.0.1:6855")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	testEcho(t, conn)
+	port := uint16(conn.LocalAddr().(*net.UDPAddr).Port)
+	last.mu.Lock()
+	seg := append([]byte(nil), last.last...)
+	last.mu.Unlock()
+	replay := rewritePort(seg, 0, port, port+1)
+	s, _, _, _ := parseIPv4(replay)
+	seq := binary.BigEndian.Uint16(s[4:])
+	for _, b := range [][]byte{replay, rewritePort(replay, 4, seq, seq+1)} {
+		if err = last.PacketIO.WritePacketData(b); err != nil {
+			t.Fatal(err)
+		}
+	}
+	time.Sleep(100 * time.Millisecond)
+	moved := "127.0.0.1:" + strconv.Itoa(int(port)+1)
+	listener.mutex.read(func() {
+		if _, ok := listener.conns[moved]; ok {
+			t.Errorf("moved the connection to %s", moved)
+		}
+	})
+	testEcho(t, conn)
+}
+
+// router drops the packets whose TTL runs out at its hop.
+type router struct {
+	PacketIO
+	dropped atomic.Int32
+}
+
+func (r *router) WritePacketData(b []byte) error {
+	if len(b) > 8 && b[8] <= 1 {
+		r.dropped.Add(1)
+		return nil
+	}
+	return r.PacketIO.WritePacketData(b)
+}
+
+func TestPipeDecoyTTL(t *testing.T) {
+	for i, r := range []Raw{{DecoyTTL: 1}, {DecoyTTL: 1, TLS: true}} {
+		address := "127.0.0.1:" + strconv.Itoa(6740+i)
+		dr, listener := pipeEchoServer(t, r, address)
+		hop := &router{PacketIO: dr.PacketIO}
+		dr.PacketIO = hop
+		conn, err := dr.DialRAW(address)
+		if err != nil {
+			t.Fatal(err)
+		}
+		testEcho(t, conn)
+		if hop.dropped.Load() == 0 {
+			t.Fatal("no decoy sent")
+		}
+		conn.Close()
+		listener.Close()
+	}
+}
+
+// congested marks CE on the packets read that are ECT, and records the
+// codepoint of those written.
+type congested struct {
+	PacketIO
+	sent atomic.Int32
+}
+
+func (c *congested) WritePacketData(b []byte) error {
+	c.sent.Store(int32(b[1] & 3))
+	return c.PacketIO.WritePacketData(b)
+}
+
+func (c *congested) ReadPacketData() ([]byte, error) {
+	b, err := c.PacketIO.ReadPacketData()
+	if err == nil && b[1]&3 != 0 {
+		b[1] |= byte(CE)
+	}
+	return b, err
+}
+
+func TestPipeECN(t *testing.T) {
+	var events atomic.Int32
+	r := Raw{NoHTTP: true, ECN: ECT0, OnEvent: func(e Event) {
+		if e.Type == EventCongestion {
+			events.Add(1)
+		}
+	}}
+	dr, listener := pipeEchoServer(t, r, "127.0.0.1:6750")
+	defer listener.Close()
+	c := &congested{PacketIO: dr.PacketIO}
+	dr.PacketIO = c
+	conn, err := dr.DialRAW("127.0.0.1:6750")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	testEcho(t, conn)
+	if ECN(c.sent.Load()) != ECT0 {
+		t.Fatalf("sent %v instead of ECT(0)", c.sent.Load())
+	}
+	if conn.CEMarks() == 0 || events.Load() == 0 {
+		t.Fatal("CE marks not reported")
+	}
+}
+
+// tosRecorder records the TOS byte of the packets written.
+type tosRecorder struct {
+	PacketIO
+	tos atomic.Int32
+}
+
+func (r *tosRecorder) WritePacketData(b []byte) error {
+	r.tos.Store(int32(b[1]))
+	return r.PacketIO.WritePacketData(b)
+}
+
+func TestPipeDSCP(t *testing.T) {
+	dr, listener := pipeEchoServer(t, Raw{NoHTTP: true, DSCP: 0x20}, "127.0.0.1:6751")
+	defer listener.Close()
+	rec := &tosRecorder{PacketIO: dr.PacketIO}
+	dr.PacketIO = rec
+	conn, err := dr.DialRAW("127.0.0.1:6751")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	testEcho(t, conn)
+	if tos := rec.tos.Load(); tos != 0x20 {
+		t.Fatalf("sent TOS %#x instead of Raw.DSCP", tos)
+	}
+	if _, err = conn.WriteToDSCP([]byte("interactive"), conn.RemoteAddr(), 0xb8); err != nil {
+		t.Fatal(err)
+	}
+	if tos := rec.tos.Load(); tos != 0xb8 {
+		t.Fatalf("sent TOS %#x instead of the one asked for", tos)
+	}
+	conn.SetDSCP(0x08)
+	if _, err = conn.Write([]byte("bulk")); err != nil {
+		t.Fatal(err)
+	}
+	if tos := rec.tos.Load(); tos != 0x08 {
+		t.Fatalf("sent TOS %#x instead of the one set", tos)
+	}
+}
+
+// ipidRecorder records the IP IDs of the packets written.
+type ipidRecorder struct {
+	PacketIO
+	mutex sync.Mutex
+	ids   []uint16
+}
+
+func (r *ipidRecorder) WritePacketData(b []byte) error {
+	r.mutex.Lock()
+	r.ids = append(r.ids, binary.BigEndian.Uint16(b[4:6]))
+	r.mutex.Unlock()
+	return r.PacketIO.WritePacketData(b)
+}
+
+// pipeIPIDs echoes over a connection dialed with r and returns the IP IDs
+// of what it sent, sorted since the reader sends its ACKs alongside.
+func pipeIPIDs(t *testing.T, r Raw, address string) []uint16 {
+	dr, listener := pipeEchoServer(t, r, address)
+	defer listener.Close()
+	rec := &ipidRecorder{PacketIO: dr.PacketIO}
+	dr.PacketIO = rec
+	conn, err := dr.DialRAW(address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	testEcho(t, conn)
+	conn.Close()
+	rec.mutex.Lock()
+	defer rec.mutex.Unlock()
+	ids := append([]uint16(nil), rec.ids...)
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	return ids
+}
+
+// TestPipeIPID checks the IP IDs each mode of Raw.IPID puts on the wire.
+func TestPipeIPID(t *testing.T) {
+	dst := net.IPv4(127, 0, 0, 1)
+	// keyed follows the generator of its key, the counter starting anew
+	// with each connection
+	keyed := func(r Raw, n int) []uint16 {
+		g := r.newIPID()
+		ids := make([]uint16, n)
+		for i := range ids {
+			ids[i] = g.next(0, dst)
+		}
+		sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+		return ids
+	}
+	// consecutive tells whether ids are one run of IDs, which may wrap
+	consecutive := func(ids []uint16) bool {
+		gaps := 0
+		for i := 1; i < len(ids); i++ {
+			if ids[i]-ids[i-1] != 1 {
+				gaps++
+			}
+		}
+		return gaps == 0 || gaps == 1 && ids[0] == 0 && ids[len(ids)-1] == 0xffff
+	}
+	distinct := func(ids []uint16) int {
+		n := 0
+		for i := range ids {
+			if i == 0 || ids[i] != ids[i-1] {
+				n++
+			}
+		}
+		return n
+	}
+
+	ids := pipeIPIDs(t, Raw{NoHTTP: true}, "127.0.0.1:6875")
+	if len(ids) < 10 || !consecutive(ids) {
+		t.Fatalf("IPIDIncrement sent %v", ids)
+	}
+	// each connection starts its run at random
+	if again := pipeIPIDs(t, Raw{NoHTTP: true}, "127.0.0.1:6875"); again[0] == ids[0] {
+		t.Fatalf("IPIDIncrement starts at %d twice", ids[0])
+	}
+
+	ids = pipeIPIDs(t, Raw{NoHTTP: true, IPID: IPIDZero}, "127.0.0.1:6876")
+	if distinct(ids) != 1 || ids[0] != 0 {
+		t.Fatalf("IPIDZero sent %v", ids)
+	}
+
+	ids = pipeIPIDs(t, Raw{NoHTTP: true, IPID: IPIDRandom}, "127.0.0.1:6877")
+	if consecutive(ids) || distinct(ids) < len(ids)-2 {
+		t.Fatalf("IPIDRandom sent %v", ids)
+	}
+
+	r := Raw{NoHTTP: true, IPID: IPIDKeyed, Key: "ipid"}
+	ids = pipeIPIDs(t, r, "127.0.0.1:6878")
+	if want := keyed(r, len(ids)); !reflect.DeepEqual(ids, want) {
+		t.Fatalf("IPIDKeyed sent %v, want %v", ids, want)
+	}
+	other := r
+	other.Key = "other"
+	if reflect.DeepEqual(ids, keyed(other, len(ids))) {
+		t.Fatal("IPIDKeyed sends the same IDs under another key")
+	}
+
+	// without a key there is nothing to draw from but chance
+	ids = pipeIPIDs(t, Raw{NoHTTP: true, IPID: IPIDKeyed}, "127.0.0.1:6879")
+	if consecutive(ids) || distinct(ids) < len(ids)-2 {
+		t.Fatalf("IPIDKeyed without key sent %v", ids)
+	}
+}
+
+func TestPipeMSS(t *testing.T) {
+	mss := make(chan int, 1)
+	r := Raw{NoHTTP: true, OnEvent: func(e Event) {
+		if e.Type == EventMSS {
+			mss <- e.MSS
+		}
+	}}
+	dr, listener := pipeEchoServer(t, r, "127.0.0.1:6752")
+	defer listener.Close()
+	conn, err := dr.DialRAW("127.0.0.1:6752")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	testEcho(t, conn)
+	if n := listener.GetMSSByAddr(conn.LocalAddr()); n != 1460 {
+		t.Fatalf("listener has an MSS of %d for the peer", n)
+	}
+	conn.SetMSS(1200)
+	if n := <-mss; n != 1200 || conn.GetMSS() != 1200 {
+		t.Fatalf("MSS %d reported, %d set", n, conn.GetMSS())
+	}
+	listener.SetMSSByAddr(conn.LocalAddr(), 1300)
+	if n := <-mss; n != 1300 || listener.GetMSSByAddr(conn.LocalAddr()) != 1300 {
+		t.Fatalf("MSS %d reported for the peer", n)
+	}
+}
+
+// payloadRecorder records the largest TCP payload of the packets written.
+type payloadRecorder struct {
+	PacketIO
+	largest atomic.Int32
+}
+
+func (r *payloadRecorder) WritePacketData(b []byte) error {
+	if seg, _, _, ok := parseIPv4(b); ok && len(seg) >= 20 {
+		if n := int32(len(seg) - int(seg[12]>>4)*4); n > r.largest.Load() {
+			r.largest.Store(n)
+		}
+	}
+	return r.PacketIO.WritePacketData(b)
+}
+
+// TestPipeMessageTooLong writes datagrams as large as a segment carries,
+// then one byte larger, which both sides refuse whole.
+func TestPipeMessageTooLong(t *testing.T) {
+	dr, listener := pipeEchoServer(t, Raw{TLS: true}, "127.0.0.1:6871")
+	defer listener.Close()
+	rec := &payloadRecorder{PacketIO: dr.PacketIO}
+	dr.PacketIO = rec
+	conn, err := dr.DialRAW("127.0.0.1:6871")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	testEcho(t, conn)
+	mss := conn.GetMSS()
+	// the TLS record header takes 5 bytes of each segment
+	limit := mss - 5
+	var tooLong *MessageTooLongError
+	if _, err = conn.Write(make([]byte, limit+1)); !errors.As(err, &tooLong) || tooLong.Size != limit+1 || tooLong.Limit != limit {
+		t.Fatalf("writing %d bytes: %v", limit+1, err)
+	}
+	if _, err = conn.WriteBatch([]ipv4.Message{{Buffers: [][]byte{make([]byte, limit+1)}}}, 0); !errors.As(err, &tooLong) {
+		t.Fatalf("writing a batch of %d bytes: %v", limit+1, err)
+	}
+	if _, err = conn.Write(make([]byte, limit)); err != nil {
+		t.Fatal(err)
+	}
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	buf := make([]byte, 2048)
+	if n, err := conn.Read(buf); err != nil || n != limit {
+		t.Fatalf("echo of %d bytes: %d, %v", limit, n, err)
+	}
+	if n := int(rec.largest.Load()); n != mss {
+		t.Fatalf("largest segment carried %d bytes for an MSS of %d", n, mss)
+	}
+
+	addr := conn.LocalAddr()
+	if _, err = listener.WriteTo(make([]byte, limit+1), addr); !errors.As(err, &tooLong) || tooLong.Limit != limit {
+		t.Fatalf("listener writing %d bytes: %v", limit+1, err)
+	}
+	if _, err = listener.WriteToDSCP(make([]byte, limit+1), addr, 0x20); !errors.As(err, &tooLong) {
+		t.Fatalf("listener writing %d bytes with a DSCP: %v", limit+1, err)
+	}
+	// a peer announcing a smaller MSS lowers the limit
+	listener.SetMSSByAddr(addr, 1000)
+	if _, err = listener.WriteTo(make([]byte, 1000-5+1), addr); !errors.As(err, &tooLong) || tooLong.Limit != 1000-5 {
+		t.Fatalf("listener writing past an MSS of 1000: %v", err)
+	}
+}
+
+func TestPipeInterfaceInfo(t *testing.T) {
+	dr, listener := pipeEchoServer(t, Raw{NoHTTP: true}, "127.0.0.1:6753")
+	defer listener.Close()
+	conn, err := dr.DialRAW("127.0.0.1:6753")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if info := conn.GetLocalInterfaceInfo(); info.LinkType != "PacketIO" || info.MTU != defaultMTU {
+		t.Fatalf("dialed over %+v", info)
+	}
+	if infos := listener.GetLocalInterfaceInfo(); len(infos) != 1 || infos[0].LinkType != "PacketIO" {
+		t.Fatalf("listening on %+v", infos)
+	}
+}
+
+func TestPipeRetryPolicy(t *testing.T) {
+	client, server := NewPacketPipe()
+	defer server.Close()
+	r := &Raw{NoHTTP: true, PacketIO: client,
+		Retry: &RetryPolicy{Attempts: 3, Timeout: 20 * time.Millisecond, Backoff: BackoffExponential}}
+	start := time.Now()
+	_, err := r.DialRAW("127.0.0.1:6753")
+	var herr *HandshakeError
+	if !errors.As(err, &herr) || !errors.Is(err, ErrHandshakeTimeout) {
+		t.Fatalf("dial to nobody returned %v", err)
+	}
+	if herr.Stage != "syn" || herr.Attempts != 3 || herr.Last == nil {
+		t.Fatalf("unexpected details %+v", herr)
+	}
+	if d := time.Since(start); d < 140*time.Millisecond {
+		t.Fatalf("gave up after %v, before the backoff ran out", d)
+	}
+}
+
+// TestPipeErrors checks the causes the errors of dials, listeners and
+// connections wrap.
+func TestPipeErrors(t *testing.T) {
+	dr, listener := pipeEchoServer(t, Raw{NoHTTP: true}, "127.0.0.1:6872")
+	defer listener.Close()
+	nowhere := Raw{NoHTTP: true, Interface: "rawcon-none", PacketIO: dr.PacketIO}
+	if _, err := nowhere.DialRAW("127.0.0.1:6872"); !errors.Is(err, ErrNoInterface) {
+		t.Fatalf("dial on a missing interface: %v", err)
+	}
+	conn, err := dr.DialRAW("127.0.0.1:6872")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	testEcho(t, conn)
+
+	stranger := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 9), Port: 9}
+	for op, write := range map[string]func() error{
+		"WriteTo": func() error {
+			_, err := listener.WriteTo([]byte("x"), stranger)
+			return err
+		},
+		"WriteToDSCP": func() error {
+			_, err := listener.WriteToDSCP([]byte("x"), stranger, 0x20)
+			return err
+		},
+		"WriteBatch": func() error {
+			_, err := listener.WriteBatch([]ipv4.Message{{Buffers: [][]byte{[]byte("x")}, Addr: stranger}}, 0)
+			return err
+		},
+	} {
+		var aerr *AddrError
+		if err := write(); !errors.As(err, &aerr) || !errors.Is(err, ErrNoConn) || aerr.Op != "write" || aerr.Addr.String() != stranger.String() {
+			t.Fatalf("%s to a stranger: %v", op, err)
+		}
+	}
+
+	// the listener ends the connection with a FIN
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	listener.Shutdown(ctx)
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	var aerr *AddrError
+	if _, err = conn.Read(make([]byte, 64)); !errors.As(err, &aerr) || !errors.Is(err, ErrPeerClosed) || aerr.Op != "read" || aerr.Addr.String() != conn.RemoteAddr().String() {
+		t.Fatalf("read after a FIN: %v", err)
+	}
+	if errors.Is(err, ErrConnReset) {
+		t.Fatalf("a FIN taken for a reset: %v", err)
+	}
+}
+
+func TestPipeDialUDP(t *testing.T) {
+	dr, listener := pipeEchoServer(t, Raw{NoHTTP: true}, "127.0.0.1:6754")
+	defer listener.Close()
+	var dialed atomic.Int32
+	dr.DialUDP = func(address string, local *net.UDPAddr) (net.Conn, error) {
+		dialed.Add(1)
+		return net.Dial("udp4", address)
+	}
+	conn, err := dr.DialRAW("127.0.0.1:6754")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	testEcho(t, conn)
+	if dialed.Load() != 1 {
+		t.Fatalf("Raw.DialUDP called %d times", dialed.Load())
+	}
+}
+
+func TestPipeRawDialer(t *testing.T) {
+	dr, listener := pipeEchoServer(t, Raw{NoHTTP: true}, "127.0.0.1:6755")
+	defer listener.Close()
+	d := &RawDialer{Raw: *dr}
+	c, err := d.DialContext(context.Background(), "tcp", "127.0.0.1:6755")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	testEcho(t, c.(*RAWConn))
+	if _, err = d.Dial("udp", "127.0.0.1:6755"); err == nil {
+		t.Fatal("dialed a udp network")
+	}
+}
+
+func TestPipeBacklog(t *testing.T) {
+	dr, listener := pipeEchoServer(t, Raw{NoHTTP: true, MaxConns: 1}, "127.0.0.1:6756")
+	defer listener.Close()
+	conn, err := dr.DialRAW("127.0.0.1:6756")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	testEcho(t, conn)
+	dr.Retry = &RetryPolicy{Attempts: 2, Timeout: 20 * time.Millisecond}
+	if c, err := dr.DialRAW("127.0.0.1:6756"); err == nil {
+		c.Close()
+		t.Fatal("dialed past MaxConns")
+	}
+	if b := listener.Backlog(); b.Established != 1 || b.HalfOpen != 0 || b.Refused != 2 {
+		t.Fatalf("unexpected backlog %+v", b)
+	}
+}
+
+func TestPipeEvict(t *testing.T) {
+	var evicted []EvictReason
+	var mu sync.Mutex
+	onEvict := func(addr net.Addr, reason EvictReason) {
+		mu.Lock()
+		evicted = append(evicted, reason)
+		mu.Unlock()
+	}
+	dr, listener := pipeEchoServer(t, Raw{NoHTTP: true, MaxConns: 1, EvictLRU: true, OnEvict: onEvict}, "127.0.0.1:6757")
+	defer listener.Close()
+	old, err := dr.DialRAW("127.0.0.1:6757")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer old.Close()
+	testEcho(t, old)
+	conn, err := dr.DialRAW("127.0.0.1:6757")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	testEcho(t, conn)
+	listener.r.EvictFunc = func(addr net.Addr, age, idle time.Duration) bool {
+		return addr.String() == conn.LocalAddr().String()
+	}
+	listener.sweep()
+	mu.Lock()
+	defer mu.Unlock()
+	if len(evicted) != 2 || evicted[0] != EvictLRU || evicted[1] != EvictCallback {
+		t.Fatalf("evicted %v", evicted)
+	}
+	if b := listener.Backlog(); b.Established != 0 || b.HalfOpen != 0 {
+		t.Fatalf("peers left after eviction: %+v", b)
+	}
+}
+
+func TestPipeShutdown(t *testing.T) {
+	dr, listener := pipeEchoServer(t, Raw{NoHTTP: true}, "127.0.0.1:6758")
+	defer listener.Close()
+	conn, err := dr.DialRAW("127.0.0.1:6758")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	testEcho(t, conn)
+	done := make(chan error, 1)
+	ctx, cancel := context.WithTimeout(context.Background(), 300*time.Millisecond)
+	defer cancel()
+	go func() { done <- listener.Shutdown(ctx) }()
+	time.Sleep(2 * drainPoll)
+	// the established peer is still served while draining
+	testEcho(t, conn)
+	if err := <-done; err != context.DeadlineExceeded {
+		t.Fatalf("Shutdown returned %v", err)
+	}
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err = conn.Read(make([]byte, 64)); !errors.Is(err, ErrPeerClosed) {
+		t.Fatalf("read after shutdown returned %v", err)
+	}
+}
+
+func TestPipeShard(t *testing.T) {
+	dr, listener := pipeEchoServer(t, Raw{NoHTTP: true, Shards: 2, Shard: 1}, "127.0.0.1:6759")
+	defer listener.Close()
+	dialFrom := func(shard int) (*RAWConn, error) {
+		dr.DialUDP = func(address string, local *net.UDPAddr) (net.Conn, error) {
+			raddr, _ := net.ResolveUDPAddr("udp4", address)
+			for port := 40000; port < 50000; port++ {
+				if shardOf(raddr.IP, port, 2) != shard {
+					continue
+				}
+				c, err := net.DialUDP("udp4", &net.UDPAddr{IP: raddr.IP, Port: port}, raddr)
+				if err == nil {
+					return c, nil
+				}
+			}
+			return nil, errors.New("no free port")
+		}
+		return dr.DialRAW("127.0.0.1:6759")
+	}
+	conn, err := dialFrom(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	testEcho(t, conn)
+	dr.Retry = &RetryPolicy{Attempts: 2, Timeout: 20 * time.Millisecond}
+	if c, err := dialFrom(0); err == nil {
+		c.Close()
+		t.Fatal("the listener answered a peer of another shard")
+	}
+}
+
+func TestPipeEchoWorkers(t *testing.T) {
+	testPipeEcho(t, Raw{NoHTTP: true, Workers: 4}, "127.0.0.1:6760")
+	testPipeEcho(t, Raw{TLS: true, Workers: 4}, "127.0.0.1:6761")
+}
+
+func TestPipeWorkersDeadline(t *testing.T) {
+	client, server := NewPacketPipe()
+	defer client.Close()
+	r := &Raw{NoHTTP: true, Workers: 2, PacketIO: server}
+	listener, err := r.ListenRAW("127.0.0.1:6762")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	listener.SetReadDeadline(time.Now().Add(50 * time.Millisecond))
+	_, _, err = listener.ReadFrom(make([]byte, 64))
+	if e, ok := err.(net.Error); !ok || !e.Timeout() {
+		t.Fatalf("read past the deadline returned %v", err)
+	}
+}
+
+func TestPipePacketHooks(t *testing.T) {
+	trailer := []byte("rawc")
+	var in, dropped atomic.Int32
+	r := Raw{
+		NoHTTP: true,
+		PacketOut: func(b []byte) []byte {
+			return append(append([]byte(nil), b...), trailer...)
+		},
+		PacketIn: func(b []byte) []byte {
+			if !bytes.HasSuffix(b, trailer) {
+				dropped.Add(1)
+				return nil
+			}
+			in.Add(1)
+			return b[:len(b)-len(trailer)]
+		},
+	}
+	testPipeEcho(t, r, "127.0.0.1:6763")
+	if in.Load() == 0 || dropped.Load() != 0 {
+		t.Fatalf("%d packets with the trailer, %d without", in.Load(), dropped.Load())
+	}
+}
+
+func TestPipeChatter(t *testing.T) {
+	var answers atomic.Int32
+	r := Raw{
+		Chatter: 5 * time.Millisecond,
+		PacketIn: func(b []byte) []byte {
+			// the responses come without the PSH flag
+			if len(b) >= 20 && b[13]&0x08 == 0 && bytes.HasPrefix(b[b[12]>>4*4:], []byte("HTTP/1.1 ")) {
+				answers.Add(1)
+			}
+			return b
+		},
+	}
+	dr, listener := pipeEchoServer(t, r, "127.0.0.1:6764")
+	defer listener.Close()
+	conn, err := dr.DialRAW("127.0.0.1:6764")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	for i := 0; i < 10; i++ {
+		testEcho(t, conn)
+		time.Sleep(10 * time.Millisecond)
+	}
+	if answers.Load() == 0 {
+		t.Fatal("no chatter was answered")
+	}
+}
+
+type fixedTraffic []int
+
+func (m *fixedTraffic) Next() (int, time.Duration) {
+	size := (*m)[0]
+	*m = append((*m)[1:], size)
+	return size, 0
+}
+
+func TestPipeShape(t *testing.T) {
+	r := Raw{NoHTTP: true, Shape: func() TrafficModel {
+		return &fixedTraffic{100, 0, 333}
+	}}
+	dr, listener := pipeEchoServer(t, r, "127.0.0.1:6765")
+	defer listener.Close()
+	conn, err := dr.DialRAW("127.0.0.1:6765")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	buf := make([]byte, 2048)
+	for i, size := range []int{1, 95, 96, 97, 300, 1000, 1200, 40} {
+		msg := bytes.Repeat([]byte{byte(i + 1)}, size)
+		if _, err := conn.Write(msg); err != nil {
+			t.Fatal(err)
+		}
+		n, err := conn.Read(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(buf[:n], msg) {
+			t.Fatalf("echo of %d bytes came back as %d", size, n)
+		}
+	}
+}
+
+func TestPipePadding(t *testing.T) {
+	for i, r := range []Raw{{Padding: 64}, {Padding: 64, TLS: true}} {
+		address := "127.0.0.1:" + strconv.Itoa(6766+i)
+		dr, listener := pipeEchoServer(t, r, address)
+		// the listener offers less, its amount wins
+		dr.Padding = 300
+		conn, err := dr.DialRAW(address)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if conn.pad != 64 {
+			t.Errorf("agreed on %d bytes of padding, not 64", conn.pad)
+		}
+		testEcho(t, conn)
+		conn.Close()
+		listener.Close()
+	}
+}
+
+func TestPipeFingerprint(t *testing.T) {
+	for i, spec := range []*utils.ClientHelloSpec{utils.Chrome120, utils.Firefox121, utils.Safari17} {
+		address := "127.0.0.1:" + strconv.Itoa(6768+i)
+		dr, listener := pipeEchoServer(t, Raw{TLS: true, Padding: 64}, address)
+		dr.Fingerprint = spec
+		conn, err := dr.DialRAW(address)
+		if err != nil {
+			t.Fatal(err)
+		}
+		want := 64
+		if spec == utils.Safari17 {
+			// no session ticket to offer padding in
+			want = 0
+		}
+		if conn.pad != want {
+			t.Errorf("fingerprint %d agreed on %d bytes of padding", i, conn.pad)
+		}
+		testEcho(t, conn)
+		conn.Close()
+		listener.Close()
+	}
+}
+
+func TestPipeResponse(t *testing.T) {
+	body := bytes.Repeat([]byte("<p>hello</p>\n"), 400)
+	file := filepath.Join(t.TempDir(), "index.html")
+	if err := os.WriteFile(file, body, 0644); err != nil {
+		t.Fatal(err)
+	}
+	var lock sync.Mutex
+	var page, reply []byte
+	var probed atomic.Bool
+	r := Raw{
+		Response: &HTTPResponse{
+			Status:   "HTTP/1.1 404 Not Found",
+			Headers:  []string{"Server: nginx/1.24.0", "Content-Type: text/html"},
+			BodyFile: file,
+		},
+		PacketOut: func(b []byte) []byte {
+			// the first request of the dialer poses as a prober's
+			p := b[b[12]>>4*4:]
+			if bytes.HasPrefix(p, []byte("POST ")) && probed.CompareAndSwap(false, true) {
+				copy(p, "GET ")
+			}
+			return b
+		},
+		PacketIn: func(b []byte) []byte {
+			p := b[b[12]>>4*4:]
+			lock.Lock()
+			if b[13]&0x08 == 0 {
+				page = append(page, p...)
+			} else if reply == nil && bytes.HasPrefix(p, []byte("HTTP/1.1 ")) {
+				reply = append(reply, p...)
+			}
+			lock.Unlock()
+			return b
+		},
+	}
+	dr, listener := pipeEchoServer(t, r, "127.0.0.1:6771")
+	defer listener.Close()
+	conn, err := dr.DialRAW("127.0.0.1:6771")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	testEcho(t, conn)
+	lock.Lock()
+	defer lock.Unlock()
+	if !bytes.HasPrefix(page, []byte("HTTP/1.1 404 Not Found\r\nServer: nginx/1.24.0\r\n")) || !bytes.HasSuffix(page, body) {
+		t.Errorf("probe got %q", page)
+	}
+	if !bytes.Contains(reply, []byte("\r\nServer: nginx/1.24.0\r\n")) {
+		t.Errorf("handshake got %q", reply)
+	}
+}
+
+func TestPipePassthrough(t *testing.T) {
+	web, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer web.Close()
+	go func() {
+		for {
+			c, err := web.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer c.Close()
+				buf := make([]byte, 2048)
+				if _, err := c.Read(buf); err == nil {
+					c.Write([]byte("HTTP/1.1 200 OK\r\nContent-Length: 5\r\n\r\nhello"))
+				}
+			}()
+		}
+	}()
+	var lock sync.Mutex
+	var page []byte
+	r := Raw{
+		Key:         "secret",
+		Passthrough: web.Addr().String(),
+		PacketIn: func(b []byte) []byte {
+			p := b[b[12]>>4*4:]
+			lock.Lock()
+			if b[13]&0x08 == 0 {
+				page = append(page, p...)
+			}
+			lock.Unlock()
+			return b
+		},
+	}
+	testPipeEcho(t, r, "127.0.0.1:6772")
+
+	// a dialer without the key is handed over to the web server
+	prober, listener := pipeEchoServer(t, r, "127.0.0.1:6773")
+	defer listener.Close()
+	prober.Key = "wrong"
+	prober.ZeroRTT = true
+	pc, err := prober.DialRAW("127.0.0.1:6773")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pc.Close()
+	// the segments only reach PacketIn when the connection is read
+	go pc.Read(make([]byte, 2048))
+	for i := 0; i < 100; i++ {
+		lock.Lock()
+		ok := bytes.HasSuffix(page, []byte("\r\n\r\nhello"))
+		lock.Unlock()
+		if ok {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("prober got %q", page)
+}
+
+func TestPipeEchoDNS(t *testing.T) {
+	var queries atomic.Int32
+	r := Raw{DNS: true, Key: "secret", PacketIn: func(b []byte) []byte {
+		// every segment of data is a DNS message of its own
+		p := b[b[12]>>4*4:]
+		if len(p) > 0 {
+			if _, ok := dnsMessage(p); !ok {
+				t.Errorf("segment of %d bytes is not a DNS message", len(p))
+			}
+			if p[4]&0x80 == 0 {
+				queries.Add(1)
+			}
+		}
+		return b
+	}}
+	testPipeEcho(t, r, "127.0.0.1:6774")
+	if queries.Load() == 0 {
+		t.Error("no query was seen")
+	}
+}
+
+func TestPipeEchoSSH(t *testing.T) {
+	var packets atomic.Int32
+	r := Raw{SSH: true, Key: "secret", PacketIn: func(b []byte) []byte {
+		// after the banner every segment of data is a binary packet
+		p := b[b[12]>>4*4:]
+		if len(p) > 0 && !bytes.HasPrefix(p, sshBannerPrefix) {
+			if _, ok := openSSH(p); !ok {
+				t.Errorf("segment of %d bytes is not an SSH packet", len(p))
+			}
+			packets.Add(1)
+		}
+		return b
+	}}
+	testPipeEcho(t, r, "127.0.0.1:6775")
+	if packets.Load() == 0 {
+		t.Error("no packet was seen")
+	}
+}
+
+func TestPipeVerifyChecksums(t *testing.T) {
+	r := Raw{NoHTTP: true, VerifyChecksums: true}
+	client, server := NewPacketPipe()
+	defer client.Close()
+	lr := r
+	lr.PacketIO = server
+	listener, err := lr.ListenRAW("127.0.0.1:6793")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	go func() {
+		buf := make([]byte, 2048)
+		for {
+			n, addr, err := listener.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			listener.WriteTo(buf[:n], addr)
+		}
+	}()
+	dr := r
+	dr.PacketIO = client
+	conn, err := dr.DialRAW("127.0.0.1:6793")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	testEcho(t, conn)
+
+	// a SYN whose checksum is one off
+	src, dst := net.IPv4(127, 0, 0, 2), net.IPv4(127, 0, 0, 1)
+	syn := make([]byte, 20)
+	binary.BigEndian.PutUint16(syn, 1234)
+	binary.BigEndian.PutUint16(syn[2:], 6793)
+	syn[12], syn[13] = 5<<4, 0x02
+	sum := ^csumFold(csumAdd(csumAdd(csumAdd(0, src.To4()), dst.To4()), syn) + 6 + 20)
+	binary.BigEndian.PutUint16(syn[16:], sum^1)
+	pkt := ipv4Packet(src, dst, 1, 0, 64, syn)
+	if err = client.WritePacketData(pkt); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; ; i++ {
+		if stats, _ := listener.CaptureStats(); stats.BadChecksum == 1 {
+			break
+		}
+		if i == 100 {
+			t.Fatal("the corrupted SYN was not counted")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if stats, _ := conn.CaptureStats(); stats.BadChecksum != 0 {
+		t.Fatalf("%d bad checksums on the way back", stats.BadChecksum)
+	}
+}
+
+func TestPipeChecksumOffload(t *testing.T) {
+	r := Raw{NoHTTP: true, VerifyChecksums: true, Checksums: ChecksumOffload}
+	client, server := NewPacketPipe()
+	defer client.Close()
+	lr := r
+	lr.PacketIO = server
+	listener, err := lr.ListenRAW("127.0.0.1:6794")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	go func() {
+		buf := make([]byte, 2048)
+		for {
+			n, addr, err := listener.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			listener.WriteTo(buf[:n], addr)
+		}
+	}()
+	dr := r
+	dr.PacketIO = client
+	conn, err := dr.DialRAW("127.0.0.1:6794")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	testEcho(t, conn)
+	if stats, _ := listener.CaptureStats(); stats.BadChecksum != 0 {
+		t.Fatalf("%d partial checksums taken for bad ones", stats.BadChecksum)
+	}
+}
+
+func TestPipeDiagnose(t *testing.T) {
+	client, server := NewPacketPipe()
+	defer client.Close()
+	defer server.Close()
+	r := &Raw{NoHTTP: true, PacketIO: client}
+	d := r.Diagnose("127.0.0.1:6795")
+	if !d.OK() || len(d.Checks) != 1 || d.Checks[0].Name != "loopback" {
+		t.Fatalf("diagnosed\n%s", d)
+	}
+}
+
+func BenchmarkPipeEcho(b *testing.B) {
+	for i, size := range []int{64, 512, 1400} {
+		b.Run(strconv.Itoa(size), func(b *testing.B) {
+			address := "127.0.0.1:" + strconv.Itoa(6796+i)
+			dr, listener := pipeEchoServer(b, Raw{NoHTTP: true}, address)
+			defer listener.Close()
+			conn, err := dr.DialRAW(address)
+			if err != nil {
+				b.Fatal(err)
+			}
+			defer conn.Close()
+			msg := make([]byte, size)
+			buf := make([]byte, 2048)
+			b.SetBytes(int64(size))
+			b.ResetTimer()
+			for n := 0; n < b.N; n++ {
+				if _, err = conn.Write(msg); err != nil {
+					b.Fatal(err)
+				}
+				if _, err = conn.Read(buf); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+// BenchmarkPipeWriteParallel writes to one connection from several
+// goroutines, which on Linux do not take its lock, see publishLayer.
+func BenchmarkPipeWriteParallel(b *testing.B) {
+	dr, listener := pipeEchoServer(b, Raw{NoHTTP: true}, "127.0.0.1:6851")
+	defer listener.Close()
+	conn, err := dr.DialRAW("127.0.0.1:6851")
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer conn.Close()
+	b.SetBytes(512)
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		msg := make([]byte, 512)
+		for pb.Next() {
+			if _, err := conn.Write(msg); err != nil {
+				b.Error(err)
+				return
+			}
+		}
+	})
+}
+
+func TestPipeMux(t *testing.T) {
+	client, server := NewPacketPipe()
+	defer client.Close()
+	lr := Raw{NoHTTP: true, PacketIO: server}
+	listener, err := lr.ListenRAW("127.0.0.1:6799")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	go func() {
+		buf := make([]byte, 2048)
+		for {
+			n, id, addr, err := listener.ReadFromFlow(buf)
+			if err != nil {
+				return
+			}
+			listener.WriteToFlow(id+1, buf[:n], addr)
+		}
+	}()
+	dr := Raw{NoHTTP: true, PacketIO: client}
+	conn, err := dr.DialRAW("127.0.0.1:6799")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	buf := make([]byte, 2048)
+	for _, id := range []uint32{0, 200, 1 << 31} {
+		msg := []byte("flow " + strconv.Itoa(int(id)))
+		if _, err = conn.WriteToFlow(id, msg); err != nil {
+			t.Fatal(err)
+		}
+		n, got, err := conn.ReadFromFlow(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != id+1 || !bytes.Equal(buf[:n], msg) {
+			t.Fatalf("flow %d echoed %q on flow %d", id, buf[:n], got)
+		}
+	}
+	limit := payloadLimit(conn.GetMSS(), 0, nil, 0)
+	var tooLong *MessageTooLongError
+	if _, err = conn.WriteToFlow(300, make([]byte, limit)); !errors.As(err, &tooLong) || tooLong.Limit != limit-2 {
+		t.Fatalf("writing %d bytes to a flow: %v", limit, err)
+	}
+}
+
+// pipePunch has a and b, each with a PacketPipe end in PacketIO, punch
+// towards each other with ra and rb.
+func pipePunch(t *testing.T, a, b Raw, ra, rb Rendezvous) (ca, cb *RAWConn) {
+	type result struct {
+		conn *RAWConn
+		err  error
+	}
+	done := make(chan result, 1)
+	go func() {
+		conn, err := b.PunchRAW(rb)
+		done <- result{conn, err}
+	}()
+	ca, err := a.PunchRAW(ra)
+	res := <-done
+	if err != nil || res.err != nil {
+		t.Fatal(err, res.err)
+	}
+	ca.SetDeadline(time.Now().Add(5 * time.Second))
+	res.conn.SetDeadline(time.Now().Add(5 * time.Second))
+	buf := make([]byte, 2048)
+	for _, dir := range [][2]*RAWConn{{ca, res.conn}, {res.conn, ca}} {
+		msg := []byte("punched from " + dir[0].LocalAddr().String())
+		if _, err = dir[0].Write(msg); err != nil {
+			t.Fatal(err)
+		}
+		n, err := dir[1].Read(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(buf[:n], msg) {
+			t.Fatalf("read %q, want %q", buf[:n], msg)
+		}
+	}
+	return ca, res.conn
+}
+
+func TestPipePunch(t *testing.T) {
+	a, b := NewPacketPipe()
+	defer a.Close()
+	defer b.Close()
+	start := time.Now().Add(100 * time.Millisecond)
+	ra := Raw{NoHTTP: true, PacketIO: a}
+	rb := Raw{NoHTTP: true, PacketIO: b}
+	// the first port predicted is wrong, the second slot meets
+	ca, cb := pipePunch(t, ra, rb,
+		Rendezvous{Local: "127.0.0.1:6800", Peer: "127.0.0.1", Ports: []int{6803, 6801}, Start: start, Slot: time.Second},
+		Rendezvous{Local: "127.0.0.1:6801", Peer: "127.0.0.1", Ports: []int{6802, 6800}, Start: start, Slot: time.Second})
+	ca.Close()
+	cb.Close()
+	if _, err := ra.PunchRAW(Rendezvous{Local: "127.0.0.1:6800", Peer: "127.0.0.1"}); err != errPunchPorts {
+		t.Fatalf("punching no port: %v", err)
+	}
+	ur := Raw{Udp2raw: true, PacketIO: a}
+	if _, err := ur.PunchRAW(Rendezvous{Local: "127.0.0.1:6800", Peer: "127.0.0.1", Ports: []int{6801}}); err != errPunchHandshake {
+		t.Fatalf("punching with Udp2raw: %v", err)
+	}
+}
+
+func TestPipeCrossing(t *testing.T) {
+	for i, r := range []Raw{{Padding: 32}, {TLS: true, Padding: 32}, {DNS: true}} {
+		a, b := NewPacketPipe()
+		ra, rb := r, r
+		ra.PacketIO, rb.PacketIO = a, b
+		pa, pb := 6806+2*i, 6807+2*i
+		start := time.Now()
+		ca, cb := pipePunch(t, ra, rb,
+			Rendezvous{Local: "127.0.0.1:" + strconv.Itoa(pa), Peer: "127.0.0.1", Ports: []int{pb}, Start: start},
+			Rendezvous{Local: "127.0.0.1:" + strconv.Itoa(pb), Peer: "127.0.0.1", Ports: []int{pa}, Start: start})
+		if r.Padding > 0 && (ca.pad != r.Padding || cb.pad != r.Padding) {
+			t.Errorf("%d: padding %d and %d, want %d", i, ca.pad, cb.pad, r.Padding)
+		}
+		ca.Close()
+		cb.Close()
+		a.Close()
+		b.Close()
+	}
+}
+
+func TestPipeReflectAddr(t *testing.T) {
+	for i, tls := range []bool{false, true} {
+		address := "127.0.0.1:" + strconv.Itoa(6804+i)
+		dr, listener := pipeEchoServer(t, Raw{TLS: tls, Padding: 32, ReflectAddr: true}, address)
+		conn, err := dr.DialRAW(address)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := conn.PublicAddr(); got == nil || got.String() != conn.LocalAddr().String() {
+			t.Errorf("tls %v: public address %v, want %v", tls, got, conn.LocalAddr())
+		}
+		if conn.pad != 32 {
+			t.Errorf("tls %v: padding %d next to the address", tls, conn.pad)
+		}
+		testEcho(t, conn)
+		conn.Close()
+		listener.Close()
+	}
+}
+
+// swapRequest writes the first segment with PSH (0x08), the handshake request,
+// after the next one.
+type swapRequest struct {
+	PacketIO
+	held    []byte
+	swapped bool
+}
+
+func (s *swapRequest) WritePacketData(data []byte) error {
+	ihl := int(data[0]&0x0f) * 4
+	if s.swapped || len(data) <= ihl+13 || data[ihl+13]&0x08 == 0 {
+		return s.PacketIO.WritePacketData(data)
+	}
+	if s.held == nil {
+		s.held = append([]byte(nil), data...)
+		return nil
+	}
+	s.swapped = true
+	if err := s.PacketIO.WritePacketData(data); err != nil {
+		return err
+	}
+	return s.PacketIO.WritePacketData(s.held)
+}
+
+func TestPipeEarlyData(t *testing.T) {
+	for i, r := range []Raw{{ZeroRTT: true}, {ZeroRTT: true, TLS: true}} {
+		address := "127.0.0.1:" + strconv.Itoa(6812+i)
+		dr, listener := pipeEchoServer(t, r, address)
+		dr.PacketIO = &swapRequest{PacketIO: dr.PacketIO}
+		conn, err := dr.DialRAW(address)
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		msg := []byte("ahead of the request")
+		if _, err = conn.Write(msg); err != nil {
+			t.Fatal(err)
+		}
+		buf := make([]byte, 2048)
+		n, err := conn.Read(buf)
+		if err != nil {
+			t.Fatalf("tls %v: %v", r.TLS, err)
+		}
+		if !bytes.Equal(buf[:n], msg) {
+			t.Fatalf("tls %v: echoed %q", r.TLS, buf[:n])
+		}
+		if !conn.r.PacketIO.(*swapRequest).swapped {
+			t.Fatal("the request was not overtaken")
+		}
+		conn.Close()
+		listener.Close()
+	}
+}
+
+func TestPipeHandshakeInfo(t *testing.T) {
+	for i, r := range []Raw{{TLS: true}, {NoHTTP: true}, {ZeroRTT: true}} {
+		address := "127.0.0.1:" + strconv.Itoa(6814+i)
+		dr, listener := pipeEchoServer(t, r, address)
+		conn, err := dr.DialRAW(address)
+		if err != nil {
+			t.Fatal(err)
+		}
+		info := conn.HandshakeInfo()
+		want := dr.handshakeMode()
+		if info.Mode != want || info.SYNs < 1 || info.PeerMSS <= 0 || info.PeerWindowScale != 5 || info.Crossed {
+			t.Errorf("%s: %+v", want, info)
+		}
+		if info.Completed == r.ZeroRTT || (info.Requests > 0) != r.TLS {
+			t.Errorf("%s: request phase %+v", want, info)
+		}
+		if r.ZeroRTT {
+			testEcho(t, conn)
+			if info = conn.HandshakeInfo(); !info.Completed || info.Requests < 1 {
+				t.Errorf("%s: no reply after a read %+v", want, info)
+			}
+		}
+		conn.Close()
+		listener.Close()
+	}
+}
+
+func TestPipeWriteDeadline(t *testing.T) {
+	dr, listener := pipeEchoServer(t, Raw{NoHTTP: true, PacketRate: 10, Pacing: true}, "127.0.0.1:6817")
+	defer listener.Close()
+	conn, err := dr.DialRAW("127.0.0.1:6817")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetWriteDeadline(time.Now().Add(50 * time.Millisecond))
+	if _, err = conn.Write([]byte("first")); err != nil {
+		t.Fatal(err)
+	}
+	// the pacing holds the second for 100ms
+	start := time.Now()
+	_, err = conn.Write([]byte("second"))
+	if ne, ok := err.(net.Error); !ok || !ne.Timeout() {
+		t.Fatalf("write past the deadline: %v", err)
+	}
+	if d := time.Since(start); d > 80*time.Millisecond {
+		t.Fatalf("the write gave up after %v", d)
+	}
+	if _, err = conn.Write([]byte("late")); err == nil {
+		t.Fatal("write after the deadline")
+	}
+	if _, err = conn.WriteToDSCP([]byte("late"), conn.RemoteAddr(), 0xb8); err == nil {
+		t.Fatal("write with a DSCP after the deadline")
+	}
+}
+
+// pipeRate writes count datagrams of size bytes through an echo server,
+// both sides limited by r, and returns how long the writes took and how
+// long until all of them came back.
+func pipeRate(t *testing.T, r Raw, address string, count, size int) (writes, echoes time.Duration) {
+	dr, listener := pipeEchoServer(t, r, address)
+	defer listener.Close()
+	conn, err := dr.DialRAW(address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	msg := make([]byte, size)
+	start := time.Now()
+	for i := 0; i < count; i++ {
+		if _, err = conn.Write(msg); err != nil {
+			t.Fatal(err)
+		}
+	}
+	writes = time.Since(start)
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	buf := make([]byte, 2048)
+	for i := 0; i < count; i++ {
+		if n, err := conn.Read(buf); err != nil || n != size {
+			t.Fatalf("echo %d: %d bytes, %v", i, n, err)
+		}
+	}
+	return writes, time.Since(start)
+}
+
+func TestPipeRate(t *testing.T) {
+	// a burst of 10000 bytes, the other 20000 take 200ms
+	writes, echoes := pipeRate(t, Raw{NoHTTP: true, Rate: 100000}, "127.0.0.1:6867", 30, 1000)
+	if writes < 150*time.Millisecond || echoes > 2*time.Second {
+		t.Fatalf("30000 bytes at 100000/s written in %v, echoed in %v", writes, echoes)
+	}
+}
+
+func TestPipePacketRate(t *testing.T) {
+	// without pacing a burst of 10 packets, with it one every 10ms
+	for i, pacing := range []bool{false, true} {
+		address := "127.0.0.1:" + strconv.Itoa(6868+i)
+		count := 30
+		if pacing {
+			count = 21
+		}
+		writes, echoes := pipeRate(t, Raw{NoHTTP: true, PacketRate: 100, Pacing: pacing}, address, count, 10)
+		if writes < 150*time.Millisecond || echoes > 2*time.Second {
+			t.Fatalf("pacing %v: %d packets at 100/s written in %v, echoed in %v", pacing, count, writes, echoes)
+		}
+	}
+}
+
+// TestPipePacedWriteDeadline has the deadline of a paced write expire, the
+// write giving its tokens back: the next one waits for the first only.
+func TestPipePacedWriteDeadline(t *testing.T) {
+	dr, listener := pipeEchoServer(t, Raw{NoHTTP: true, PacketRate: 10, Pacing: true}, "127.0.0.1:6870")
+	defer listener.Close()
+	conn, err := dr.DialRAW("127.0.0.1:6870")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	start := time.Now()
+	if _, err = conn.Write([]byte("first")); err != nil {
+		t.Fatal(err)
+	}
+	conn.SetWriteDeadline(time.Now().Add(50 * time.Millisecond))
+	if _, err = conn.Write([]byte("second")); err == nil {
+		t.Fatal("a write paced past its deadline went out")
+	}
+	conn.SetWriteDeadline(time.Time{})
+	if _, err = conn.Write([]byte("third")); err != nil {
+		t.Fatal(err)
+	}
+	// the third takes the place of the second, 100ms after the first
+	if d := time.Since(start); d < 80*time.Millisecond || d > 160*time.Millisecond {
+		t.Fatalf("the third write went out after %v", d)
+	}
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	buf := make([]byte, 2048)
+	for _, want := range []string{"first", "third"} {
+		n, err := conn.Read(buf)
+		if err != nil || string(buf[:n]) != want {
+			t.Fatalf("read %q, %v, want %q", buf[:n], err, want)
+		}
+	}
+}
+
+func TestPipeBestEffortWrite(t *testing.T) {
+	dr, listener := pipeEchoServer(t, Raw{NoHTTP: true, PacketRate: 10, Pacing: true, BestEffortWrite: true}, "127.0.0.1:6818")
+	defer listener.Close()
+	conn, err := dr.DialRAW("127.0.0.1:6818")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	start := time.Now()
+	for i := 0; i < 20; i++ {
+		if n, err := conn.Write([]byte("datagram")); n != 8 || err != nil {
+			t.Fatalf("write %d: %d, %v", i, n, err)
+		}
+	}
+	if d := time.Since(start); d > 80*time.Millisecond {
+		t.Fatalf("the writes waited %v", d)
+	}
+	buf := make([]byte, 2048)
+	echoed := 0
+	for {
+		conn.SetReadDeadline(time.Now().Add(300 * time.Millisecond))
+		if _, err = conn.Read(buf); err != nil {
+			break
+		}
+		echoed++
+	}
+	if echoed == 0 || echoed >= 20 {
+		t.Fatalf("%d of 20 datagrams went through", echoed)
+	}
+}
+
+func TestPipeSendQueue(t *testing.T) {
+	for i, policy := range []OverflowPolicy{DropNewest, DropOldest, BlockOnFull} {
+		r := Raw{NoHTTP: true, PacketRate: 20, Pacing: true, SendQueue: 2, SendOverflow: policy}
+		address := "127.0.0.1:" + strconv.Itoa(6819+i)
+		dr, listener := pipeEchoServer(t, r, address)
+		conn, err := dr.DialRAW(address)
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn.SetWriteDeadline(time.Now().Add(120 * time.Millisecond))
+		start := time.Now()
+		for j := 0; j < 8; j++ {
+			if _, err = conn.Write([]byte{byte(j)}); err != nil {
+				break
+			}
+		}
+		stats := conn.SendStats()
+		if policy == BlockOnFull {
+			if ne, ok := err.(net.Error); !ok || !ne.Timeout() || stats.Dropped != 0 {
+				t.Errorf("policy %d: %v, %+v", policy, err, stats)
+			}
+		} else if err != nil || time.Since(start) > 60*time.Millisecond || stats.Dropped < 4 || stats.Queued > 2 {
+			t.Errorf("policy %d: %v after %v, %+v", policy, err, time.Since(start), stats)
+		}
+		conn.SetDeadline(time.Now().Add(2 * time.Second))
+		buf := make([]byte, 16)
+		var last byte
+		for j := 0; j < stats.Queued+stats.Sent; j++ {
+			n, err := conn.Read(buf)
+			if err != nil || n != 1 {
+				t.Fatalf("policy %d: echo %d: %v", policy, j, err)
+			}
+			last = buf[0]
+		}
+		if policy == DropOldest && last != 7 {
+			t.Errorf("dropping the oldest kept %d last", last)
+		}
+		conn.Close()
+		listener.Close()
+	}
+}
+
+func TestPipeListenPorts(t *testing.T) {
+	for _, port := range []int{6822, 6824, 6826} {
+		dr, listener := pipeEchoServer(t, Raw{NoHTTP: true}, "127.0.0.1:6822-6824,6826")
+		conn, err := dr.DialRAW("127.0.0.1:" + strconv.Itoa(port))
+		if err != nil {
+			t.Fatalf("dial %d: %v", port, err)
+		}
+		testEcho(t, conn)
+		conn.Close()
+		listener.Close()
+	}
+}
+
+func TestPipeLocalPort(t *testing.T) {
+	for i, spec := range []string{"46100", "46000-46009,46020"} {
+		address := "127.0.0.1:" + strconv.Itoa(6827+i)
+		dr, listener := pipeEchoServer(t, Raw{NoHTTP: true, LocalPort: spec}, address)
+		conn, err := dr.DialRAW(address)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ports, _ := parsePorts(spec)
+		if port := conn.LocalAddr().(*net.UDPAddr).Port; !ports.has(port) {
+			t.Errorf("%s: dialed from %d", spec, port)
+		}
+		testEcho(t, conn)
+		conn.Close()
+		listener.Close()
+	}
+}
+
+// reusedIO lets the connections dialed one after the other share an end
+// of a pipe: closing one only wakes its reads.
+type reusedIO struct {
+	PacketIO
+}
+
+func (io reusedIO) Close() error {
+	return io.SetReadDeadline(time.Unix(1, 0))
+}
+
+func TestPipeReconnect(t *testing.T) {
+	client, server := NewPacketPipe()
+	defer client.Close()
+	lr := Raw{NoHTTP: true, PacketIO: server}
+	listener, err := lr.ListenRAW("127.0.0.1:6829")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	go func() {
+		buf := make([]byte, 2048)
+		for {
+			n, addr, err := listener.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			listener.WriteTo(buf[:n], addr)
+		}
+	}()
+	reconnected := make(chan net.Addr, 1)
+	dr := Raw{NoHTTP: true, PacketIO: reusedIO{client}}
+	dr.OnReconnect = func(local, remote net.Addr) {
+		reconnected <- local
+	}
+	rc, err := dr.DialReconnecting("127.0.0.1:6829")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rc.Close()
+	first := rc.LocalAddr().String()
+	rc.SetDeadline(time.Now().Add(5 * time.Second))
+	// the connection dies, the read finds out and waits for the next one
+	rc.lock.Lock()
+	rc.conn.Close()
+	rc.lock.Unlock()
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		rc.Write([]byte("echo"))
+	}()
+	buf := make([]byte, 2048)
+	if n, err := rc.Read(buf); err != nil || string(buf[:n]) != "echo" {
+		t.Fatalf("read %q, %v", buf[:n], err)
+	}
+	select {
+	case local := <-reconnected:
+		if local.String() == first {
+			t.Fatalf("dialed again from %s", local)
+		}
+	default:
+		t.Fatal("OnReconnect was not called")
+	}
+}
+
+func TestPipeReconnectOversizedWrite(t *testing.T) {
+	dr, listener := pipeEchoServer(t, Raw{NoHTTP: true}, "127.0.0.1:6844")
+	defer listener.Close()
+	dr.PacketIO = reusedIO{dr.PacketIO}
+	var reconnects atomic.Int32
+	dr.OnReconnect = func(local, remote net.Addr) {
+		reconnects.Add(1)
+	}
+	rc, err := dr.DialReconnecting("127.0.0.1:6844")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rc.Close()
+	// no deadline: a write taken for a dead connection would retry forever
+	var tooLong *MessageTooLongError
+	if _, err := rc.Write(make([]byte, 5000)); !errors.As(err, &tooLong) {
+		t.Fatalf("oversized write: %v", err)
+	}
+	time.Sleep(50 * time.Millisecond)
+	if n := reconnects.Load(); n != 0 {
+		t.Fatalf("dialed again %d times", n)
+	}
+}
+
+// fanOutIO is a listener end of a pipe that also sends what it writes down
+// a second pipe.
+type fanOutIO struct {
+	PacketIO
+	also PacketIO
+}
+
+func (io fanOutIO) WritePacketData(data []byte) error {
+	io.also.WritePacketData(data)
+	return io.PacketIO.WritePacketData(data)
+}
+
+// splitIO reads from one pipe and writes to another.
+type splitIO struct {
+	PacketIO
+	out PacketIO
+}
+
+func (io splitIO) WritePacketData(data []byte) error {
+	return io.out.WritePacketData(data)
+}
+
+// migratingPipe returns the Raw to dial address with, and the PacketIO to
+// give it before Migrate: the connection then reads from a pipe of its
+// own, as it would from a new socket.
+func migratingPipe(t *testing.T, r Raw, address string) (dr *Raw, next PacketIO, listener *RAWListener) {
+	c1, s1 := NewPacketPipe()
+	c2, s2 := NewPacketPipe()
+	t.Cleanup(func() {
+		c2.Close()
+		s2.Close()
+	})
+	lr := r
+	dr = &r
+	dr.PacketIO = reusedIO{c1}
+	listener = echoServer(t, lr, fanOutIO{s1, s2}, address)
+	return dr, splitIO{c2, c1}, listener
+}
+
+func TestPipeMigrate(t *testing.T) {
+	dr, next, listener := migratingPipe(t, Raw{Key: "migrate"}, "127.0.0.1:6845")
+	defer listener.Close()
+	conn, err := dr.DialRAW("127.0.0.1:6845")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	testEcho(t, conn)
+	first := conn.LocalAddr().String()
+
+	deadline := time.Now().Add(time.Second)
+	conn.SetReadDeadline(deadline)
+	read := make(chan error, 1)
+	go func() {
+		_, err := conn.Read(make([]byte, 2048))
+		read <- err
+	}()
+	time.Sleep(50 * time.Millisecond)
+	dr.PacketIO = next
+	if err := conn.Migrate(); err != nil {
+		t.Fatal(err)
+	}
+	if conn.LocalAddr().String() == first {
+		t.Fatalf("still at %s", first)
+	}
+	// the read in progress goes on with the new PacketIO and its deadline
+	select {
+	case err := <-read:
+		if ne, ok := err.(net.Error); !ok || !ne.Timeout() {
+			t.Fatalf("read across the migration: %v", err)
+		}
+		if time.Now().Before(deadline) {
+			t.Fatal("the read ended before its deadline")
+		}
+	case <-time.After(3 * time.Second):
+		t.Fatal("the read outlived its deadline")
+	}
+	testEcho(t, conn)
+}
+
+// TestPipeMigrateWriting migrates a connection while the listener keeps
+// writing to it, which under -race checks that bindSession changes the
+// connection under the lock of its writes. The pacing holds the writes
+// between the lookup of the peer and the segment.
+func TestPipeMigrateWriting(t *testing.T) {
+	dr, next, listener := migratingPipe(t, Raw{Key: "migrate", TLS: true, PacketRate: 200, Pacing: true}, "127.0.0.1:6866")
+	defer listener.Close()
+	conn, err := dr.DialRAW("127.0.0.1:6866")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	testEcho(t, conn)
+	var addr net.Addr
+	listener.mutex.read(func() {
+		for _, info := range listener.conns {
+			addr = info.addr
+		}
+	})
+
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		msg := []byte("while migrating")
+		for i := 0; ; i++ {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			if i%2 == 0 {
+				listener.WriteTo(msg, addr)
+			} else {
+				listener.WriteBatch([]ipv4.Message{{Buffers: [][]byte{msg}, Addr: addr}}, 0)
+			}
+			listener.GetMSSByAddr(addr)
+			time.Sleep(100 * time.Microsecond)
+		}
+	}()
+	time.Sleep(10 * time.Millisecond)
+	dr.PacketIO = next
+	err = conn.Migrate()
+	time.Sleep(10 * time.Millisecond)
+	close(stop)
+	<-done
+	if err != nil {
+		t.Fatal(err)
+	}
+	// what the listener wrote is read past by the echoes
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	buf := make([]byte, 2048)
+	if _, err = conn.Write([]byte("after")); err != nil {
+		t.Fatal(err)
+	}
+	for {
+		n, err := conn.Read(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(buf[:n]) == "after" {
+			break
+		}
+	}
+}
+
+// portSwitch hands the packets a dialer writes to one end of a pipe to a
+// pipe of each listener by their destination port, dropping those to the
+// ports in down. It returns the PacketIO of the listener on port.
+type portSwitch struct {
+	lock  sync.Mutex
+	ports map[uint16]PacketIO
+	down  map[uint16]bool
+}
+
+func newPortSwitch(t *testing.T) (client PacketIO, sw *portSwitch, listen func(port uint16) PacketIO) {
+	client, server := NewPacketPipe()
+	sw = &portSwitch{ports: map[uint16]PacketIO{}, down: map[uint16]bool{}}
+	t.Cleanup(func() {
+		client.Close()
+		server.Close()
+	})
+	go func() {
+		for {
+			b, err := server.ReadPacketData()
+			if err != nil {
+				return
+			}
+			if seg, _, _, ok := parseIPv4(b); ok && len(seg) >= 4 {
+				port := binary.BigEndian.Uint16(seg[2:])
+				sw.lock.Lock()
+				if in := sw.ports[port]; in != nil && !sw.down[port] {
+					in.WritePacketData(b)
+				}
+				sw.lock.Unlock()
+			}
+			releasePacket(server, b)
+		}
+	}()
+	listen = func(port uint16) PacketIO {
+		in, out := NewPacketPipe()
+		t.Cleanup(func() { in.Close() })
+		sw.lock.Lock()
+		sw.ports[port] = in
+		sw.lock.Unlock()
+		return splitIO{out, server}
+	}
+	return
+}
+
+func (sw *portSwitch) setDown(port uint16, down bool) {
+	sw.lock.Lock()
+	sw.down[port] = down
+	sw.lock.Unlock()
+}
+
+// TestPipeFailover has the server a connection went to die, the connection
+// moving to the next address of its dial.
+func TestPipeFailover(t *testing.T) {
+	client, sw, listen := newPortSwitch(t)
+	failovers := make(chan net.Addr, 4)
+	r := Raw{NoHTTP: true, Key: "failover", FailoverTimeout: 200 * time.Millisecond, OnEvent: func(e Event) {
+		if e.Type == EventFailover {
+			failovers <- e.Addr
+		}
+	}}
+	first := echoServer(t, r, listen(6873), "127.0.0.1:6873")
+	defer first.Close()
+	second := echoServer(t, r, listen(6874), "127.0.0.1:6874")
+	defer second.Close()
+
+	// the first address does not answer, the dial goes on to the next
+	sw.setDown(6873, true)
+	dr := r
+	dr.PacketIO = reusedIO{client}
+	dr.Retry = &RetryPolicy{Attempts: 2, Timeout: 50 * time.Millisecond}
+	conn, err := dr.DialRAW("127.0.0.1:6873,127.0.0.1:6874")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if got := conn.RemoteAddr().String(); got != "127.0.0.1:6874" {
+		t.Fatalf("dialed %s", got)
+	}
+	testEcho(t, conn)
+
+	// the second dies, the connection moves back to the first
+	sw.setDown(6873, false)
+	sw.setDown(6874, true)
+	select {
+	case addr := <-failovers:
+		if addr.String() != "127.0.0.1:6873" {
+			t.Fatalf("failed over to %v", addr)
+		}
+	case <-time.After(3 * time.Second):
+		t.Fatal("no failover")
+	}
+	if got := conn.RemoteAddr().String(); got != "127.0.0.1:6873" {
+		t.Fatalf("connected to %s after the failover", got)
+	}
+	testEcho(t, conn)
+}
+
+// closeRecorder tells whether the connection over it was closed.
+type closeRecorder struct {
+	PacketIO
+	closed atomic.Bool
+}
+
+func (c *closeRecorder) Close() error {
+	c.closed.Store(true)
+	return c.PacketIO.Close()
+}
+
+// TestPipeParallelDial runs the handshakes with several addresses, each
+// over a pipe of its own, the dials of all but one answering late. The
+// first to answer is returned and the others closed once they complete.
+func TestPipeParallelDial(t *testing.T) {
+	addrs := []string{"127.0.0.1:6880", "127.0.0.1:6881", "127.0.0.1:6882"}
+	delays := []time.Duration{300 * time.Millisecond, 50 * time.Millisecond, 150 * time.Millisecond}
+	pios := make([]*closeRecorder, len(addrs))
+	dialers := map[string]*Raw{}
+	serve := func(i int) {
+		dr, listener := pipeEchoServer(t, Raw{NoHTTP: true}, addrs[i])
+		t.Cleanup(func() { listener.Close() })
+		pios[i] = &closeRecorder{PacketIO: dr.PacketIO}
+		dr.PacketIO = pios[i]
+		dialers[addrs[i]] = dr
+	}
+	for i := range addrs {
+		serve(i)
+	}
+	delay := map[string]time.Duration{}
+	for i, addr := range addrs {
+		delay[addr] = delays[i]
+	}
+	var running, most atomic.Int32
+	var fail sync.Map // the addresses whose dials fail
+	dial := func(addr string) (*RAWConn, error) {
+		n := running.Add(1)
+		defer running.Add(-1)
+		for m := most.Load(); n > m && !most.CompareAndSwap(m, n); m = most.Load() {
+		}
+		if _, ok := fail.Load(addr); ok {
+			return nil, errors.New("no answer from " + addr)
+		}
+		time.Sleep(delay[addr])
+		return dialers[addr].dial(addr, nil, nil)
+	}
+
+	conn, i, err := dialParallel(addrs, len(addrs), dial)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if i != 1 || conn.RemoteAddr().String() != addrs[1] {
+		t.Fatalf("returned the dial of %d to %v", i, conn.RemoteAddr())
+	}
+	conn.start()
+	testEcho(t, conn)
+	deadline := time.Now().Add(3 * time.Second)
+	for !pios[0].closed.Load() || !pios[2].closed.Load() {
+		if time.Now().After(deadline) {
+			t.Fatal("the late connections were left open")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if pios[1].closed.Load() {
+		t.Fatal("the connection returned was closed")
+	}
+	if most.Load() != int32(len(addrs)) {
+		t.Fatalf("%d of %d handshakes ran at once", most.Load(), len(addrs))
+	}
+
+	// one at a time, the failures are passed over
+	serve(2)
+	most.Store(0)
+	fail.Store(addrs[0], true)
+	fail.Store(addrs[1], true)
+	conn, i, err = dialParallel(addrs, 1, dial)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if i != 2 {
+		t.Fatalf("returned the dial of %d", i)
+	}
+	if most.Load() != 1 {
+		t.Fatalf("%d handshakes ran at once, one allowed", most.Load())
+	}
+}
+
+// windowTap keeps the last segment with data the dialer read and looks at
+// the pure ACKs it sends.
+type windowTap struct {
+	PacketIO
+	lock sync.Mutex
+	last []byte
+	acks []uint32 // their sequence numbers
+	data int      // segments with data sent
+	mute bool     // drops what the dialer sends
+}
+
+func (w *windowTap) ReadPacketData() ([]byte, error) {
+	b, err := w.PacketIO.ReadPacketData()
+	if seg, _, _, ok := parseIPv4(b); err == nil && ok && len(seg) > int(seg[12]>>4)*4 {
+		w.lock.Lock()
+		w.last = append([]byte(nil), b...)
+		w.lock.Unlock()
+	}
+	return b, err
+}
+
+func (w *windowTap) WritePacketData(b []byte) error {
+	if seg, _, _, ok := parseIPv4(b); ok && len(seg) >= 20 {
+		w.lock.Lock()
+		if len(seg) == int(seg[12]>>4)*4 && seg[13] == 0x10 {
+			w.acks = append(w.acks, binary.BigEndian.Uint32(seg[4:]))
+		} else if len(seg) > int(seg[12]>>4)*4 {
+			w.data++
+		}
+		mute := w.mute
+		w.lock.Unlock()
+		if mute {
+			return nil
+		}
+	}
+	return w.PacketIO.WritePacketData(b)
+}
+
+// pureAck returns a pure ACK following the last segment with data read,
+// advertising window, its sequence number moved by delta.
+func (w *windowTap) pureAck(delta uint32, window uint16) []byte {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	seg, srcip, dstip, _ := parseIPv4(w.last)
+	hl := int(seg[12]>>4) * 4
+	ack := make([]byte, 20)
+	copy(ack, seg[:20])
+	binary.BigEndian.PutUint32(ack[4:], binary.BigEndian.Uint32(seg[4:])+uint32(len(seg)-hl)+delta)
+	ack[12], ack[13] = 5<<4, 0x10
+	binary.BigEndian.PutUint16(ack[14:], window)
+	binary.BigEndian.PutUint16(ack[16:], 0)
+	binary.BigEndian.PutUint16(ack[16:], ^csumFold(csumAdd(pseudoSum(6, srcip, dstip, 20), ack)))
+	return ipv4Packet(srcip, dstip, 1, 0, 64, ack)
+}
+
+func (w *windowTap) sentAcks() []uint32 {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	return append([]uint32(nil), w.acks...)
+}
+
+func pipeWindowTap(t *testing.T, r Raw, address string) (conn *RAWConn, tap *windowTap, server PacketIO, listener *RAWListener) {
+	client, server := NewPacketPipe()
+	lr := Raw{NoHTTP: true, PacketIO: server}
+	listener, err := lr.ListenRAW(address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		buf := make([]byte, 2048)
+		for {
+			n, addr, err := listener.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			listener.WriteTo(buf[:n], addr)
+		}
+	}()
+	tap = &windowTap{PacketIO: client}
+	r.PacketIO = tap
+	if conn, err = r.DialRAW(address); err != nil {
+		t.Fatal(err)
+	}
+	testEcho(t, conn)
+	go func() {
+		buf := make([]byte, 2048)
+		for {
+			if _, err := conn.Read(buf); err != nil {
+				return
+			}
+		}
+	}()
+	return conn, tap, server, listener
+}
+
+func TestPipeWindowProbe(t *testing.T) {
+	conn, tap, server, listener := pipeWindowTap(t, Raw{NoHTTP: true}, "127.0.0.1:6831")
+	defer listener.Close()
+	defer conn.Close()
+	before := len(tap.sentAcks())
+	// a keepalive of a middlebox, one byte short of what was acked
+	server.WritePacketData(tap.pureAck(^uint32(0), 1000))
+	deadline := time.Now().Add(2 * time.Second)
+	for len(tap.sentAcks()) == before && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+	}
+	if len(tap.sentAcks()) == before {
+		t.Fatal("the probe was not answered")
+	}
+}
+
+func TestPipeZeroWindow(t *testing.T) {
+	conn, tap, server, listener := pipeWindowTap(t, Raw{NoHTTP: true, WindowUpdate: 20 * time.Millisecond}, "127.0.0.1:6832")
+	defer listener.Close()
+	defer conn.Close()
+	time.Sleep(100 * time.Millisecond)
+	acks := tap.sentAcks()
+	if len(acks) < 3 {
+		t.Fatalf("%d window updates in 100ms", len(acks))
+	}
+	seq := acks[len(acks)-1]
+	// the listener would answer the probes and open the window again
+	tap.lock.Lock()
+	tap.mute = true
+	tap.lock.Unlock()
+	server.WritePacketData(tap.pureAck(0, 0))
+	deadline := time.Now().Add(2 * time.Second)
+	for !conn.zerownd.Load() && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	tap.lock.Lock()
+	data := tap.data
+	tap.lock.Unlock()
+	if _, err := conn.Write([]byte("held back")); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(60 * time.Millisecond)
+	tap.lock.Lock()
+	if tap.data != data {
+		t.Error("data went into a zero window")
+	}
+	if probe := tap.acks[len(tap.acks)-1]; probe != seq-1 {
+		t.Errorf("probed at %d, the next segment is at %d", probe, seq)
+	}
+	tap.lock.Unlock()
+	server.WritePacketData(tap.pureAck(0, 1000))
+	for conn.zerownd.Load() && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	if conn.zerownd.Load() {
+		t.Fatal("the window did not open again")
+	}
+}
+
+// windowRecorder records the window fields of the SYNs and of the other
+// segments written.
+type windowRecorder struct {
+	PacketIO
+	lock       sync.Mutex
+	syn, other []uint16
+}
+
+func (w *windowRecorder) WritePacketData(b []byte) error {
+	if seg, _, _, ok := parseIPv4(b); ok && len(seg) >= 20 {
+		w.lock.Lock()
+		if window := binary.BigEndian.Uint16(seg[14:]); seg[13]&0x02 != 0 {
+			w.syn = append(w.syn, window)
+		} else {
+			w.other = append(w.other, window)
+		}
+		w.lock.Unlock()
+	}
+	return w.PacketIO.WritePacketData(b)
+}
+
+func TestPipeWindowScale(t *testing.T) {
+	dr, listener := pipeEchoServer(t, Raw{NoHTTP: true, Window: 200000}, "127.0.0.1:6833")
+	defer listener.Close()
+	rec := &windowRecorder{PacketIO: dr.PacketIO}
+	dr.PacketIO = rec
+	conn, err := dr.DialRAW("127.0.0.1:6833")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	testEcho(t, conn)
+	rec.lock.Lock()
+	defer rec.lock.Unlock()
+	if len(rec.syn) == 0 || len(rec.other) == 0 {
+		t.Fatalf("recorded %d SYNs and %d other segments", len(rec.syn), len(rec.other))
+	}
+	if rec.syn[0] != 65535 {
+		t.Errorf("SYN announced %d", rec.syn[0])
+	}
+	want := scaledWindow(200000, windowScale)
+	for _, w := range rec.other {
+		if w != want {
+			t.Fatalf("segment announced %d instead of %d", w, want)
+		}
+	}
+}
+
+// bareSynAck returns the SYN-ACK a listener of lr on port answers a SYN
+// offering no option at all with.
+func bareSynAck(t *testing.T, lr Raw, port int) []byte {
+	seg := answerBareSyn(t, lr, port)
+	if seg[13] != 0x12 {
+		t.Fatalf("no SYN-ACK: %x", seg)
+	}
+	return seg
+}
+
+// answerBareSyn returns the segment a listener of lr on port answers a SYN
+// offering no option at all with.
+func answerBareSyn(t *testing.T, lr Raw, port int) []byte {
+	client, server := NewPacketPipe()
+	t.Cleanup(func() { client.Close() })
+	lr.PacketIO = server
+	listener, err := lr.ListenRAW("127.0.0.1:" + strconv.Itoa(port))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	go func() {
+		buf := make([]byte, 2048)
+		for {
+			if _, _, err := listener.ReadFrom(buf); err != nil {
+				return
+			}
+		}
+	}()
+	ip := net.IPv4(127, 0, 0, 1).To4()
+	syn := make([]byte, 20)
+	binary.BigEndian.PutUint16(syn, 40000)
+	binary.BigEndian.PutUint16(syn[2:], uint16(port))
+	binary.BigEndian.PutUint32(syn[4:], 1000)
+	syn[12], syn[13] = 5<<4, 0x02
+	binary.BigEndian.PutUint16(syn[14:], 65535)
+	binary.BigEndian.PutUint16(syn[16:], ^csumFold(csumAdd(pseudoSum(6, ip, ip, 20), syn)))
+	if err = client.WritePacketData(ipv4Packet(ip, ip, 1, 0, 64, syn)); err != nil {
+		t.Fatal(err)
+	}
+	b, err := client.ReadPacketData()
+	if err != nil {
+		t.Fatal(err)
+	}
+	seg, _, _, ok := parseIPv4(b)
+	if !ok || len(seg) < 20 {
+		t.Fatalf("no TCP segment: %x", b)
+	}
+	return seg
+}
+
+func TestPipeMirrorOptions(t *testing.T) {
+	seg := bareSynAck(t, Raw{NoHTTP: true}, 6834)
+	// the MSS alone
+	if hl := int(seg[12]>>4) * 4; hl != 24 || seg[20] != 2 {
+		t.Errorf("SYN-ACK options %x", seg[20:hl])
+	}
+
+	dr, listener := pipeEchoServer(t, Raw{NoHTTP: true}, "127.0.0.1:6835")
+	defer listener.Close()
+	conn, err := dr.DialRAW("127.0.0.1:6835")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if info := conn.HandshakeInfo(); !info.PeerSACK || !info.PeerTimestamps || info.PeerWindowScale < 0 {
+		t.Errorf("the listener left out options offered: %+v", info)
+	}
+}
+
+func TestPipeAdvertisedMSS(t *testing.T) {
+	seg := bareSynAck(t, Raw{NoHTTP: true}, 6836)
+	if mss := binary.BigEndian.Uint16(seg[22:]); mss != uint16(linkMSS(defaultMTU)) {
+		t.Errorf("announced %d on loopback", mss)
+	}
+	seg = bareSynAck(t, Raw{NoHTTP: true, AdvertisedMSS: 1240}, 6837)
+	if mss := binary.BigEndian.Uint16(seg[22:]); mss != 1240 {
+		t.Errorf("announced %d instead of Raw.AdvertisedMSS", mss)
+	}
+}
+
+func TestPipePool(t *testing.T) {
+	var listeners []*RAWListener
+	var lock sync.Mutex
+	defer func() {
+		lock.Lock()
+		defer lock.Unlock()
+		for _, l := range listeners {
+			l.Close()
+		}
+	}()
+	r := &Raw{NoHTTP: true}
+	pool := r.newRawPool(2, func() (*RAWConn, error) {
+		// a pipe and a listener each, connections steal each other's
+		// packets on a shared one
+		dr, listener := pipeEchoServer(t, *r, "127.0.0.1:6838")
+		lock.Lock()
+		listeners = append(listeners, listener)
+		lock.Unlock()
+		return dr.DialRAW("127.0.0.1:6838")
+	})
+	defer pool.Close()
+	deadline := time.Now().Add(5 * time.Second)
+	for pool.Idle() < 2 && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+	}
+	if n := pool.Idle(); n != 2 {
+		t.Fatalf("%d connections warm", n)
+	}
+	conn, err := pool.Get()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	testEcho(t, conn)
+	// the one handed out is replaced
+	for pool.Idle() < 2 && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+	}
+	if n := pool.Idle(); n != 2 {
+		t.Fatalf("%d connections warm after Get", n)
+	}
+	pool.Close()
+	if _, err = pool.Get(); !errors.Is(err, net.ErrClosed) {
+		t.Fatalf("Get on a closed pool returned %v", err)
+	}
+}
+
+func TestPipePeerValues(t *testing.T) {
+	dr, listener := pipeEchoServer(t, Raw{NoHTTP: true}, "127.0.0.1:6839")
+	defer listener.Close()
+	conn, err := dr.DialRAW("127.0.0.1:6839")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	testEcho(t, conn)
+	addr := conn.LocalAddr()
+	if listener.SetPeerValue(&net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 1}, "user", "nobody") {
+		t.Fatal("a value attached to an unknown peer")
+	}
+	if !listener.SetPeerValue(addr, "user", "alice") {
+		t.Fatal("no value attached to the peer")
+	}
+	if v := listener.PeerValue(addr, "user"); v != "alice" {
+		t.Fatalf("the peer holds %v", v)
+	}
+	ctx := listener.PeerContext(addr)
+	if ctx == nil || ctx.Err() != nil {
+		t.Fatal("no live context for the peer")
+	}
+	conn.Close()
+	select {
+	case <-ctx.Done():
+	case <-time.After(2 * time.Second):
+		t.Fatal("the context outlived the peer")
+	}
+	if v := listener.PeerValue(addr, "user"); v != nil {
+		t.Fatalf("the value outlived the peer: %v", v)
+	}
+}
+
+func TestPipeAcceptSYN(t *testing.T) {
+	var seen atomic.Pointer[SYNInfo]
+	r := Raw{NoHTTP: true, AcceptSYN: func(syn SYNInfo) SYNVerdict {
+		seen.Store(&syn)
+		if syn.Addr.Port == 40000 {
+			return SYNReset
+		}
+		return SYNAccept
+	}}
+	seg := answerBareSyn(t, r, 6840)
+	if seg[13]&0x04 == 0 {
+		t.Fatalf("the refused SYN got %#x", seg[13])
+	}
+	syn := seen.Load()
+	if syn == nil {
+		t.Fatal("AcceptSYN not called")
+	}
+	if syn.TTL != 64 || syn.MSS != 0 || syn.WindowScale != -1 || syn.SACK || syn.Window != 65535 {
+		t.Errorf("SYN seen as %+v", *syn)
+	}
+	// other peers get through
+	testPipeEcho(t, r, "127.0.0.1:6841")
+}
+
+func TestPipeTap(t *testing.T) {
+	dr, listener := pipeEchoServer(t, Raw{NoHTTP: true}, "127.0.0.1:6842")
+	defer listener.Close()
+	conn, err := dr.DialRAW("127.0.0.1:6842")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	tap := conn.Tap(64)
+	ltap := listener.Tap(64)
+	testEcho(t, conn)
+	var out, in, lin bool
+	for !(out && in && lin) {
+		select {
+		case p := <-tap:
+			if len(p.Payload) == 0 {
+				continue
+			}
+			if p.Out {
+				out = out || p.Dst.Port == 6842 && p.TTL == 64
+			} else {
+				in = in || p.Src.Port == 6842
+			}
+		case p := <-ltap:
+			lin = lin || !p.Out && len(p.Payload) > 0 && p.Dst.Port == 6842
+		case <-time.After(2 * time.Second):
+			t.Fatalf("tapped out %v, in %v, listener in %v", out, in, lin)
+		}
+	}
+	conn.Close()
+	for range tap {
+	}
+}
+
+func TestPipeWriteBatchGates(t *testing.T) {
+	dr, listener := pipeEchoServer(t, Raw{NoHTTP: true, SendQueue: 4}, "127.0.0.1:6843")
+	defer listener.Close()
+	conn, err := dr.DialRAW("127.0.0.1:6843")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	ms := []ipv4.Message{{Buffers: [][]byte{[]byte("one")}}, {Buffers: [][]byte{[]byte("two")}}}
+	conn.SetWriteDeadline(time.Now().Add(-time.Second))
+	n, err := conn.WriteBatch(ms, 0)
+	if ne, ok := err.(net.Error); n != 0 || !ok || !ne.Timeout() {
+		t.Fatalf("batch past the deadline: %d, %v", n, err)
+	}
+	conn.SetWriteDeadline(time.Time{})
+	if n, err = conn.WriteBatch(ms, 0); n != 2 || err != nil {
+		t.Fatalf("batch: %d, %v", n, err)
+	}
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	buf := make([]byte, 16)
+	for _, want := range []string{"one", "two"} {
+		if n, err := conn.Read(buf); err != nil || string(buf[:n]) != want {
+			t.Fatalf("echo %q: %q, %v", want, buf[:n], err)
+		}
+	}
+	for i := 0; conn.SendStats().Sent < 2 && i < 100; i++ {
+		time.Sleep(time.Millisecond)
+	}
+	if s := conn.SendStats(); s.Sent != 2 {
+		t.Errorf("the batch bypassed the send queue: %+v", s)
+	}
+}
+
+func TestPipeBatch(t *testing.T) {
+	client, server := NewPacketPipe()
+	lr := Raw{NoHTTP: true, PacketIO: server}
+	listener, err := lr.ListenRAW("127.0.0.1:6846")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	newBatch := func(n int) []ipv4.Message {
+		ms := make([]ipv4.Message, n)
+		for i := range ms {
+			ms[i].Buffers = [][]byte{make([]byte, 2048)}
+		}
+		return ms
+	}
+	out := []ipv4.Message{{Buffers: [][]byte{[]byte("one")}}, {Buffers: [][]byte{[]byte("two")}}, {Buffers: [][]byte{[]byte("three")}}}
+	// the listener completes the handshake as it reads
+	dialed := make(chan *RAWConn, 1)
+	go func() {
+		dr := Raw{NoHTTP: true, PacketIO: client}
+		conn, err := dr.DialRAW("127.0.0.1:6846")
+		if err != nil {
+			t.Error(err)
+			close(dialed)
+			return
+		}
+		if n, err := conn.WriteBatch(out, 0); n != 3 || err != nil {
+			t.Errorf("dialer batch: %d, %v", n, err)
+		}
+		dialed <- conn
+	}()
+	listener.SetReadDeadline(time.Now().Add(2 * time.Second))
+	in := newBatch(4)
+	var got []string
+	var peer net.Addr
+	for len(got) < 3 {
+		n, err := listener.ReadBatch(in, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, m := range in[:n] {
+			got = append(got, string(m.Buffers[0][:m.N]))
+			peer = m.Addr
+		}
+	}
+	if strings.Join(got, " ") != "one two three" {
+		t.Fatalf("listener read %q", got)
+	}
+	conn := <-dialed
+	if conn == nil {
+		t.FailNow()
+	}
+	defer conn.Close()
+
+	// the segments are all in the pipe before the dialer reads
+	for i := range out {
+		out[i].Addr = peer
+	}
+	if n, err := listener.WriteBatch(out, 0); n != 3 || err != nil {
+		t.Fatalf("listener batch: %d, %v", n, err)
+	}
+	time.Sleep(50 * time.Millisecond)
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	in = newBatch(4)
+	n, err := conn.ReadBatch(in, 0)
+	if err != nil || n != 3 {
+		t.Fatalf("dialer read %d, %v", n, err)
+	}
+	for i, want := range []string{"one", "two", "three"} {
+		if s := string(in[i].Buffers[0][:in[i].N]); s != want {
+			t.Fatalf("datagram %d: %q", i, s)
+		}
+	}
+
+	out[1].Addr = &net.UDPAddr{IP: net.IPv4(127, 0, 0, 9), Port: 9}
+	if n, err := listener.WriteBatch(out, 0); n != 1 || !errors.Is(err, ErrNoConn) {
+		t.Fatalf("batch to an unknown peer: %d, %v", n, err)
+	}
+}
+
+// rstPacket returns a RST from src to dst at the sequence number seq.
+func rstPacket(src, dst *net.UDPAddr, seq uint32) []byte {
+	seg := make([]byte, 20)
+	binary.BigEndian.PutUint16(seg, uint16(src.Port))
+	binary.BigEndian.PutUint16(seg[2:], uint16(dst.Port))
+	binary.BigEndian.PutUint32(seg[4:], seq)
+	seg[12], seg[13] = 5<<4, 0x04
+	binary.BigEndian.PutUint16(seg[16:], ^csumFold(csumAdd(pseudoSum(6, src.IP, dst.IP, 20), seg)))
+	return ipv4Packet(src.IP, dst.IP, 1, 0, 64, seg)
+}
+
+func TestPipeRSTWindow(t *testing.T) {
+	client, server := NewPacketPipe()
+	listener := echoServer(t, Raw{NoHTTP: true}, server, "127.0.0.1:6847")
+	defer listener.Close()
+	r := Raw{NoHTTP: true, PacketIO: client}
+	conn, err := r.DialRAW("127.0.0.1:6847")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	testEcho(t, conn)
+	local, remote := conn.LocalAddr().(*net.UDPAddr), conn.RemoteAddr().(*net.UDPAddr)
+
+	// a blind RST, the ports right but the sequence number far off
+	_, ack := conn.seqAck()
+	server.WritePacketData(rstPacket(remote, local, ack+1<<20))
+	testEcho(t, conn)
+
+	_, ack = conn.seqAck()
+	server.WritePacketData(rstPacket(remote, local, ack))
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if _, err := conn.Read(make([]byte, 2048)); !errors.Is(err, ErrConnReset) {
+		t.Fatalf("read after a RST in the window: %v", err)
+	}
+	if _, err := conn.Write([]byte("after")); !errors.Is(err, ErrConnReset) {
+		t.Fatalf("write after a RST in the window: %v", err)
+	}
+}
+
+func TestPipeListenerRSTWindow(t *testing.T) {
+	resets := make(chan Event, 4)
+	client, server := NewPacketPipe()
+	lr := Raw{NoHTTP: true, OnEvent: func(e Event) {
+		if e.Type == EventReset {
+			resets <- e
+		}
+	}}
+	listener := echoServer(t, lr, server, "127.0.0.1:6848")
+	defer listener.Close()
+	r := Raw{NoHTTP: true, PacketIO: client}
+	conn, err := r.DialRAW("127.0.0.1:6848")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	testEcho(t, conn)
+	local, remote := conn.LocalAddr().(*net.UDPAddr), conn.RemoteAddr().(*net.UDPAddr)
+
+	seq, _ := conn.seqAck()
+	client.WritePacketData(rstPacket(local, remote, seq-1<<20))
+	testEcho(t, conn)
+	select {
+	case e := <-resets:
+		t.Fatalf("a blind RST dropped %v", e.Addr)
+	default:
+	}
+
+	seq, _ = conn.seqAck()
+	client.WritePacketData(rstPacket(local, remote, seq+100))
+	select {
+	case <-resets:
+	case <-time.After(2 * time.Second):
+		t.Fatal("a RST in the window kept the peer")
+	}
+}
+
+func TestPipeHop(t *testing.T) {
+	c1, s1 := NewPacketPipe()
+	c2, s2 := NewPacketPipe()
+	defer c2.Close()
+	defer s2.Close()
+	lr := Raw{Key: "hop", PacketIO: fanOutIO{s1, s2}}
+	listener, err := lr.ListenRAW("127.0.0.1:6849-6850")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	var lock sync.Mutex
+	peers := make(map[string]bool)
+	go func() {
+		buf := make([]byte, 2048)
+		for {
+			n, addr, err := listener.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			lock.Lock()
+			peers[addr.String()] = true
+			lock.Unlock()
+			listener.WriteTo(buf[:n], addr)
+		}
+	}()
+
+	dr := &Raw{Key: "hop", HopPorts: "6850", PacketIO: reusedIO{c1}}
+	conn, err := dr.DialRAW("127.0.0.1:6849")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	testEcho(t, conn)
+	first := conn.LocalAddr().String()
+
+	// the hop reads from a pipe of its own, as from a new socket
+	dr.PacketIO = splitIO{c2, c1}
+	ports, _ := dr.hopPorts()
+	if !conn.hopTo(net.JoinHostPort("127.0.0.1", strconv.Itoa(conn.hopPort(0, ports)))) {
+		t.Fatal("closed by the hop")
+	}
+	if conn.LocalAddr().String() == first || conn.RemoteAddr().(*net.UDPAddr).Port != 6850 {
+		t.Fatalf("hopped from %s to %s -> %s", first, conn.LocalAddr(), conn.RemoteAddr())
+	}
+	testEcho(t, conn)
+	lock.Lock()
+	defer lock.Unlock()
+	if len(peers) != 1 {
+		t.Fatalf("the listener saw %d connections", len(peers))
+	}
+}
+
+func TestPipeFakeUDP(t *testing.T) {
+	client, server := NewPacketPipe()
+	lr := Raw{Key: "udp", PacketIO: server}
+	listener, err := lr.ListenFakeUDP("127.0.0.1:6852")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	go func() {
+		buf := make([]byte, 2048)
+		for {
+			n, addr, err := listener.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			listener.WriteTo(buf[:n], addr)
+		}
+	}()
+	dr := Raw{Key: "udp", PacketIO: client}
+	conn, err := dr.DialFakeUDP("127.0.0.1:6852")
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	buf := make([]byte, 2048)
+	for i := 0; i < 10; i++ {
+		msg := bytes.Repeat([]byte{byte(i)}, 100+i)
+		if _, err := conn.Write(msg); err != nil {
+			t.Fatal(err)
+		}
+		n, err := conn.Read(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(buf[:n], msg) {
+			t.Fatalf("echo %d mismatch", i)
+		}
+	}
+	if err = conn.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err = conn.Close(); err != nil {
+		t.Fatalf("closing again: %v", err)
+	}
+}
+
+// TestPipeFakeUDPWildcard has a listener on the wildcard address answer
+// from the address the client sent to, which is not the one the route to
+// the client goes out from.
+func TestPipeFakeUDPWildcard(t *testing.T) {
+	client, server := NewPacketPipe()
+	lr := Raw{Key: "udp", PacketIO: server}
+	listener, err := lr.ListenFakeUDP(":6865")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	go func() {
+		buf := make([]byte, 2048)
+		for {
+			n, addr, err := listener.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			listener.WriteTo(buf[:n], addr)
+		}
+	}()
+	dr := Raw{Key: "udp", PacketIO: client}
+	conn, err := dr.DialFakeUDP("127.0.0.5:6865")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	buf := make([]byte, 2048)
+	for i := 0; i < 3; i++ {
+		if _, err = conn.Write([]byte("wildcard")); err != nil {
+			t.Fatal(err)
+		}
+		n, err := conn.Read(buf)
+		if err != nil || string(buf[:n]) != "wildcard" {
+			t.Fatalf("echo %d: %q, %v", i, buf[:n], err)
+		}
+	}
+	listener.mutex.read(func() {
+		if len(listener.routes) != 0 {
+			t.Errorf("looked up the routes to %v", listener.routes)
+		}
+	})
+}
+
+func TestPipeEchoCoalesce(t *testing.T) {
+	testPipeEcho(t, Raw{NoHTTP: true, Coalesce: true}, "127.0.0.1:6853")
+}
+
+// failingIO is an end of a pipe whose writes fail once fail is set.
+type failingIO struct {
+	PacketIO
+	fail *atomic.Bool
+}
+
+func (io failingIO) WritePacketData(data []byte) error {
+	if io.fail.Load() {
+		return errors.New("link down")
+	}
+	return io.PacketIO.WritePacketData(data)
+}
+
+func TestPipeUdp2rawWriteError(t *testing.T) {
+	client, server := NewPacketPipe()
+	var fail atomic.Bool
+	lr := Raw{Udp2raw: true, PacketIO: failingIO{server, &fail}}
+	listener, err := lr.ListenRAW("127.0.0.1:6854")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	peer := make(chan net.Addr, 1)
+	go func() {
+		// the listener answers the handshake while it reads
+		listener.SetReadDeadline(time.Now().Add(5 * time.Second))
+		_, addr, _ := listener.ReadFrom(make([]byte, 2048))
+		peer <- addr
+	}()
+	dr := Raw{Udp2raw: true, PacketIO: failingIO{client, &fail}}
+	conn, err := dr.DialRAW("127.0.0.1:6854")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if _, err := conn.Write([]byte("ping")); err != nil {
+		t.Fatal(err)
+	}
+	addr := <-peer
+	if addr == nil {
+		t.Fatal("the listener read nothing")
+	}
+	// a write the link refused sent nothing
+	fail.Store(true)
+	if n, err := conn.Write([]byte("lost")); n != 0 || err == nil {
+		t.Fatalf("conn write returned %d, %v", n, err)
+	}
+	if n, err := listener.WriteTo([]byte("lost"), addr); n != 0 || err == nil {
+		t.Fatalf("listener write returned %d, %v", n, err)
+	}
+}
@@ -0,0 +1,168 @@
+package rawcon
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"strconv"
+
+	"github.com/biotooff/rawcon/utils"
+)
+
+// With Raw.Padding set on both sides the dialer offers that much padding in
+// its handshake and the listener answers with the smaller of the two
+// amounts. Each segment of data then ends with up to that many random bytes
+// and a byte counting them, so its size says less about the datagram it
+// carries. The offer goes in a header of the HTTP request, or at the start
+// of the session ticket of the ClientHello, and the answer in a header of
+// the HTTP response, or at the start of the Finished record of the TLS
+// reply. In TLS both are nonce(8) amount(1) tag(7), where tag is a
+// truncated SHA-256 of the rest, so random tickets are not taken for
+// offers.
+
+const (
+	maxPadding  = 255
+	padOfferLen = 16
+)
+
+var padHeaderName = []byte("X-Pad: ")
+
+// padding returns the padding r offers or accepts, zero if none. ZeroRTT
+// sends datagrams before the answer can come, so it goes without.
+func (r *Raw) padding() int {
+	if r.Padding <= 0 || r.ZeroRTT || r.Udp2raw || r.profile() != profileNone || (r.NoHTTP && !r.TLS && !r.Mixed) {
+		return 0
+	}
+	if r.Padding > maxPadding {
+		return maxPadding
+	}
+	return r.Padding
+}
+
+// agreePadding returns the padding to use given what the peer offered or
+// answered.
+func (r *Raw) agreePadding(peer int) int {
+	return min(peer, r.padding())
+}
+
+// answeredPadding returns the padding to use given the reply rep to the
+// handshake of a dialer.
+func (r *Raw) answeredPadding(rep []byte) int {
+	if r.TLS {
+		return r.agreePadding(parseTLSPadAnswer(rep))
+	}
+	return r.agreePadding(parsePadHeader(rep))
+}
+
+func padTag(b []byte) []byte {
+	sum := sha256.Sum256(b[:9])
+	return sum[:padOfferLen-9]
+}
+
+// putPadOffer writes an offer or an answer of amount at the start of b.
+func putPadOffer(rnd utils.Random, b []byte, amount int) {
+	rnd.Read(b[:8])
+	b[8] = byte(amount)
+	copy(b[9:padOfferLen], padTag(b))
+}
+
+func parsePadOffer(b []byte) int {
+	if len(b) < padOfferLen || !bytes.Equal(b[9:padOfferLen], padTag(b)) {
+		return 0
+	}
+	return int(b[8])
+}
+
+// padTicket returns the session ticket of a ClientHello: a prefix of the
+// random bytes of region, starting with the offer of r if there is one.
+func (r *Raw) padTicket(region []byte) []byte {
+	pad := r.padding()
+	if pad == 0 || len(region) < padOfferLen {
+		return region[:r.random().Intn(len(region)+1)]
+	}
+	t := region[:padOfferLen+r.random().Intn(len(region)-padOfferLen+1)]
+	putPadOffer(r.random(), t, pad)
+	return t
+}
+
+// padAnswerLen returns the length of the Finished record of a TLS reply
+// given a random one, enough for the answer if there is one.
+func padAnswerLen(l, pad int) int {
+	if pad > 0 && l < padOfferLen {
+		l += padOfferLen
+	}
+	return l
+}
+
+// parseTLSPadAnswer returns the answer in a TLS reply.
+func parseTLSPadAnswer(b []byte) int {
+	return parsePadOffer(tlsFinished(b))
+}
+
+// tlsFinished returns the body of the Finished record of a TLS reply: the
+// ServerHello, the ChangeCipherSpec and the Finished record. It is nil if
+// the reply is cut short.
+func tlsFinished(b []byte) []byte {
+	for i := 0; i < 2; i++ {
+		if len(b) < 5 {
+			return nil
+		}
+		l := 5 + int(binary.BigEndian.Uint16(b[3:]))
+		if l > len(b) {
+			return nil
+		}
+		b = b[l:]
+	}
+	if len(b) < 5 {
+		return nil
+	}
+	return b[5:]
+}
+
+// padHeader returns the header offering or answering pad.
+func padHeader(pad int) string {
+	if pad <= 0 {
+		return ""
+	}
+	return string(padHeaderName) + strconv.Itoa(pad) + "\r\n"
+}
+
+func parsePadHeader(b []byte) int {
+	i := bytes.Index(b, padHeaderName)
+	if i < 0 {
+		return 0
+	}
+	v := b[i+len(padHeaderName):]
+	if j := bytes.IndexByte(v, '\r'); j >= 0 {
+		v = v[:j]
+	}
+	pad, err := strconv.Atoi(string(v))
+	if err != nil || pad < 0 || pad > maxPadding {
+		return 0
+	}
+	return pad
+}
+
+// padSegment returns b followed by up to pad random bytes, no more than
+// room, and their count, in a buffer of utils.GetBuf.
+func padSegment(rnd utils.Random, b []byte, pad, room int) []byte {
+	n := min(rnd.Intn(pad+1), max(room, 0))
+	out := utils.GetBuf(len(b) + n + 1)
+	copy(out, b)
+	rnd.Read(out[len(b) : len(b)+n])
+	out[len(b)+n] = byte(n)
+	return out
+}
+
+// unpadSegment strips the padding off a segment, or fails if there is not
+// as much as it says.
+func unpadSegment(b []byte) ([]byte, bool) {
+	if len(b) == 0 {
+		return nil, false
+	}
+	n := int(b[len(b)-1])
+	if n+1 > len(b) {
+		return nil, false
+	}
+	return b[:len(b)-1-n], true
+}
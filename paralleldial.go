@@ -0,0 +1,79 @@
+package rawcon
+
+import (
+	"net"
+)
+
+// resolveAll replaces the host names in addrs with one address per IPv4
+// address they resolve to, so that every server replica behind a name can
+// be dialed. Names that do not resolve are kept as they are.
+func resolveAll(addrs []string) []string {
+	var out []string
+	for _, addr := range addrs {
+		host, port, err := net.SplitHostPort(addr)
+		if err != nil || net.ParseIP(host) != nil {
+			out = append(out, addr)
+			continue
+		}
+		ips, err := net.LookupIP(host)
+		n := len(out)
+		if err == nil {
+			for _, ip := range ips {
+				if ip.To4() != nil {
+					out = append(out, net.JoinHostPort(ip.String(), port))
+				}
+			}
+		}
+		if len(out) == n {
+			out = append(out, addr)
+		}
+	}
+	return out
+}
+
+// dialParallel runs the handshakes with addrs, at most max at a time, and
+// returns the first connection dial completes with its index in addrs. The
+// connections completing later are closed.
+func dialParallel(addrs []string, max int, dial func(addr string) (*RAWConn, error)) (*RAWConn, int, error) {
+	type result struct {
+		conn *RAWConn
+		i    int
+		err  error
+	}
+	results := make(chan result, len(addrs))
+	slots := make(chan struct{}, max)
+	done := make(chan struct{})
+	for i := range addrs {
+		go func(i int) {
+			select {
+			case slots <- struct{}{}:
+			case <-done:
+				results <- result{i: i}
+				return
+			}
+			conn, err := dial(addrs[i])
+			<-slots
+			results <- result{conn, i, err}
+		}(i)
+	}
+	var err error
+	for left := len(addrs); left > 0; left-- {
+		res := <-results
+		if res.err != nil {
+			if err == nil {
+				err = res.err
+			}
+			continue
+		}
+		close(done)
+		go func(left int) {
+			for ; left > 0; left-- {
+				if late := <-results; late.conn != nil {
+					late.conn.Close()
+				}
+			}
+		}(left - 1)
+		return res.conn, res.i, nil
+	}
+	return nil, 0, err
+}
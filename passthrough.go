@@ -0,0 +1,146 @@
+package rawcon
+
+import (
+	"net"
+	"time"
+)
+
+// With Raw.Passthrough set a listener hands the peers whose first request
+// is not the handshake of a tunnel client over to a real web server. From
+// then on the listener keeps them apart from its tunnel peers, in proxies:
+// their data goes to a TCP connection of their own to the server, and what
+// the server sends back goes to them in fake TCP segments, until either
+// side closes.
+
+const passthroughDialTimeout = 2 * time.Second
+
+// authentic tells whether a handshake carrying token comes from a tunnel
+// client. Without Raw.Key any well-formed handshake does.
+func (r *Raw) authentic(token []byte) bool {
+	if len(r.Key) == 0 {
+		return true
+	}
+	_, _, ok := r.openSessionToken(token)
+	return ok
+}
+
+// startPassthrough hands info over to the web server with its first request
+// req, received at seq. It fails if the server cannot be reached, the
+// request is then left to the other camouflage.
+func (listener *RAWListener) startPassthrough(info *connInfo, addrstr string, seq uint32, req []byte) bool {
+	r := listener.r
+	if r.Passthrough == "" || r.Mixed {
+		return false
+	}
+	up, err := net.DialTimeout("tcp", r.Passthrough, passthroughDialTimeout)
+	if err != nil {
+		return false
+	}
+	if _, err = up.Write(req); err != nil {
+		up.Close()
+		return false
+	}
+	info.lock.Lock()
+	info.up = up
+	info.rep = nil
+	info.layer.setAck(seq + uint32(len(req)))
+	info.lock.Unlock()
+	listener.mutex.run(func() {
+		delete(listener.newcons, addrstr)
+		listener.proxies[addrstr] = info
+	})
+	go listener.relay(info, addrstr)
+	return true
+}
+
+// passthrough forwards the data of a segment to the web server if it comes
+// from a peer handed over to it, and reports whether it does.
+func (listener *RAWListener) passthrough(addrstr string, seq uint32, b []byte) bool {
+	if listener.r.Passthrough == "" {
+		return false
+	}
+	var info *connInfo
+	listener.mutex.read(func() {
+		info = listener.proxies[addrstr]
+	})
+	if info == nil {
+		return false
+	}
+	if len(b) == 0 {
+		return true
+	}
+	info.touch()
+	info.lock.Lock()
+	// only the data right after what was received goes on, the peer sends
+	// the rest again
+	ack := info.layer.ack()
+	d := int32(ack - seq)
+	if d >= 0 && int(d) < len(b) {
+		b = b[d:]
+		info.layer.setAck(ack + uint32(len(b)))
+	} else {
+		b = nil
+	}
+	listener.sendAckWithLayer(info.layer)
+	info.lock.Unlock()
+	if len(b) > 0 {
+		if _, err := info.up.Write(b); err != nil {
+			info.up.Close()
+		}
+	}
+	return true
+}
+
+// endPassthrough closes the connection to the web server of the peer at
+// addrstr if it has one, when the peer closes its side.
+func (listener *RAWListener) endPassthrough(addrstr string) {
+	if listener.r.Passthrough == "" {
+		return
+	}
+	var info *connInfo
+	listener.mutex.read(func() {
+		info = listener.proxies[addrstr]
+	})
+	if info != nil {
+		info.up.Close()
+	}
+}
+
+// relay sends what the web server says to the peer of info, then closes the
+// connection of the peer with a FIN.
+func (listener *RAWListener) relay(info *connInfo, addrstr string) {
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-listener.die:
+			info.up.Close()
+		case <-done:
+		}
+	}()
+	seg := make([]byte, payloadLimit(info.mss, 0, nil, 0))
+	for {
+		n, err := info.up.Read(seg)
+		if n > 0 {
+			info.lock.Lock()
+			werr := listener.sendChatterWithLayer(seg[:n], info.layer)
+			info.lock.Unlock()
+			if werr != nil {
+				break
+			}
+		}
+		if err != nil {
+			break
+		}
+	}
+	info.up.Close()
+	listener.mutex.run(func() {
+		if listener.proxies[addrstr] == info {
+			delete(listener.proxies, addrstr)
+			listener.updateFilter()
+		}
+	})
+	info.lock.Lock()
+	listener.sendFinWithLayer(info.layer)
+	info.lock.Unlock()
+}
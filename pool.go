@@ -0,0 +1,192 @@
+package rawcon
+
+import (
+	"net"
+	"sync"
+	"time"
+)
+
+// RawPool keeps connections to a server dialed ahead of need, so that an
+// application opening sessions in bursts gets one without waiting for a
+// handshake. It takes an idle connection for dead, and dials its
+// replacement, as Raw.Reconnect says: once the peer reset it or it
+// received nothing for ReconnectPolicy.IdleTimeout, the peer being probed
+// meanwhile as with Raw.RTTInterval.
+type RawPool struct {
+	r      *Raw
+	size   int
+	policy ReconnectPolicy
+	dial   func() (*RAWConn, error)
+
+	lock    sync.Mutex
+	idle    []*RAWConn
+	dialing int
+	die     chan struct{}
+}
+
+// NewRawPool returns a pool keeping size connections to address dialed, as
+// DialRAW dials them. The dials run in the background.
+func (r *Raw) NewRawPool(address string, size int) *RawPool {
+	return r.newRawPool(size, func() (*RAWConn, error) {
+		return r.DialRAW(address)
+	})
+}
+
+func (r *Raw) newRawPool(size int, dial func() (*RAWConn, error)) *RawPool {
+	p := &RawPool{
+		r:      r,
+		size:   size,
+		policy: r.reconnectPolicy(),
+		dial:   dial,
+		die:    make(chan struct{}),
+	}
+	p.lock.Lock()
+	p.fill()
+	p.lock.Unlock()
+	go p.watch()
+	return p
+}
+
+// fill dials the connections missing from the pool. p.lock is held.
+func (p *RawPool) fill() {
+	for ; len(p.idle)+p.dialing < p.size; p.dialing++ {
+		go p.dialOne()
+	}
+}
+
+// dialOne dials a connection for the pool until one succeeds, waiting
+// longer after every failure.
+func (p *RawPool) dialOne() {
+	wait := p.policy.Wait
+	for {
+		conn, err := p.dial()
+		if err == nil {
+			if p.r.RTTInterval <= 0 {
+				go conn.probeRTT(p.policy.IdleTimeout / 4)
+			}
+			conn.touch()
+			p.lock.Lock()
+			p.dialing--
+			select {
+			case <-p.die:
+				p.lock.Unlock()
+				conn.Close()
+				return
+			default:
+			}
+			p.idle = append(p.idle, conn)
+			p.lock.Unlock()
+			return
+		}
+		d := wait
+		if p.policy.Jitter > 0 {
+			d += time.Duration(p.r.random().Int63n(int64(p.policy.Jitter)))
+		}
+		select {
+		case <-p.die:
+			p.lock.Lock()
+			p.dialing--
+			p.lock.Unlock()
+			return
+		case <-time.After(d):
+		}
+		wait = min(wait*2, p.policy.MaxWait)
+	}
+}
+
+// healthy tells whether an idle conn can still be handed out.
+func (p *RawPool) healthy(conn *RAWConn) bool {
+	select {
+	case <-conn.die:
+		return false
+	default:
+	}
+	return !conn.reset.Load() && conn.idle() < p.policy.IdleTimeout
+}
+
+// watch replaces the idle connections that died.
+func (p *RawPool) watch() {
+	ticker := time.NewTicker(p.policy.IdleTimeout / 4)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-p.die:
+			return
+		case <-ticker.C:
+		}
+		var dead []*RAWConn
+		p.lock.Lock()
+		live := p.idle[:0]
+		for _, conn := range p.idle {
+			if p.healthy(conn) {
+				live = append(live, conn)
+			} else {
+				dead = append(dead, conn)
+			}
+		}
+		clear(p.idle[len(live):])
+		p.idle = live
+		p.fill()
+		p.lock.Unlock()
+		for _, conn := range dead {
+			conn.Close()
+		}
+	}
+}
+
+// Get hands out a connection of the pool, which is then the caller's to
+// close, and dials its replacement. It dials one itself while the pool has
+// none ready.
+func (p *RawPool) Get() (*RAWConn, error) {
+	p.lock.Lock()
+	select {
+	case <-p.die:
+		p.lock.Unlock()
+		return nil, net.ErrClosed
+	default:
+	}
+	var conn *RAWConn
+	for len(p.idle) > 0 && conn == nil {
+		c := p.idle[len(p.idle)-1]
+		p.idle[len(p.idle)-1] = nil
+		p.idle = p.idle[:len(p.idle)-1]
+		if p.healthy(c) {
+			conn = c
+		} else {
+			defer c.Close()
+		}
+	}
+	p.fill()
+	p.lock.Unlock()
+	if conn != nil {
+		return conn, nil
+	}
+	return p.dial()
+}
+
+// Idle returns the number of connections ready to be handed out.
+func (p *RawPool) Idle() int {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	return len(p.idle)
+}
+
+// Close closes the connections of the pool not handed out and stops the
+// dials. The connections handed out stay open.
+func (p *RawPool) Close() error {
+	p.lock.Lock()
+	select {
+	case <-p.die:
+		p.lock.Unlock()
+		return nil
+	default:
+	}
+	close(p.die)
+	idle := p.idle
+	p.idle = nil
+	p.lock.Unlock()
+	for _, conn := range idle {
+		conn.Close()
+	}
+	return nil
+}
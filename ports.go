@@ -0,0 +1,257 @@
+package rawcon
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// A listener can take several ports, written as a list of ports and
+// ranges in place of the port of its address: "0.0.0.0:4000-4010,4020".
+// Its filters test them all, so one capture serves clients spread over the
+// ports or hopping between them. The peers are answered from the port they
+// sent to, LocalAddr reports the first one.
+
+// maxPortRanges bounds the ranges of a listener, a classic BPF program can
+// only jump so far over their checks.
+const maxPortRanges = 64
+
+var errPortRanges = errors.New("too many port ranges, the most is " + strconv.Itoa(maxPortRanges))
+
+// portRange is the ports from lo to hi, both included.
+type portRange struct {
+	lo, hi int
+}
+
+// portRanges are the ports of a listener, sorted and apart from one
+// another.
+type portRanges []portRange
+
+// splitListenPorts cuts the ports off address and returns the address with
+// the first of them alone.
+func splitListenPorts(address string) (string, portRanges, error) {
+	host, spec, err := net.SplitHostPort(address)
+	if err != nil {
+		return "", nil, err
+	}
+	ports, err := parsePorts(spec)
+	if err != nil {
+		if err != errPortRanges {
+			err = &net.AddrError{Err: err.Error(), Addr: address}
+		}
+		return "", nil, err
+	}
+	return net.JoinHostPort(host, strconv.Itoa(ports[0].lo)), ports, nil
+}
+
+// parsePorts parses a comma separated list of ports and ranges of them.
+func parsePorts(spec string) (portRanges, error) {
+	var ports portRanges
+	for _, part := range strings.Split(spec, ",") {
+		los, his, isRange := strings.Cut(part, "-")
+		lo, err := strconv.Atoi(los)
+		if err != nil {
+			return nil, errors.New("invalid port")
+		}
+		hi := lo
+		if isRange {
+			if hi, err = strconv.Atoi(his); err != nil {
+				return nil, errors.New("invalid port")
+			}
+		}
+		if lo < 0 || hi > 65535 || lo > hi {
+			return nil, errors.New("invalid port range")
+		}
+		ports = append(ports, portRange{lo, hi})
+	}
+	ports = ports.merged()
+	if ports[0].lo == 0 && !ports.single() {
+		// 0 asks for a port of the system, alone
+		return nil, errors.New("invalid port range")
+	}
+	if len(ports) > maxPortRanges {
+		return nil, errPortRanges
+	}
+	return ports, nil
+}
+
+// merged sorts p and joins the ranges that touch.
+func (p portRanges) merged() portRanges {
+	slices.SortFunc(p, func(a, b portRange) int { return a.lo - b.lo })
+	var out portRanges
+	for _, r := range p {
+		if n := len(out); n > 0 && r.lo <= out[n-1].hi+1 {
+			out[n-1].hi = max(out[n-1].hi, r.hi)
+			continue
+		}
+		out = append(out, r)
+	}
+	return out
+}
+
+// single tells whether p is a single port, as a listener has by default.
+func (p portRanges) single() bool {
+	return len(p) == 1 && p[0].lo == p[0].hi
+}
+
+// count returns the number of ports in p.
+func (p portRanges) count() int {
+	n := 0
+	for _, r := range p {
+		n += r.hi - r.lo + 1
+	}
+	return n
+}
+
+// nth returns the port i of p, counting from 0.
+func (p portRanges) nth(i int) int {
+	for _, r := range p {
+		if n := r.hi - r.lo + 1; i >= n {
+			i -= n
+		} else {
+			return r.lo + i
+		}
+	}
+	return 0
+}
+
+func (p portRanges) has(port int) bool {
+	for _, r := range p {
+		if port >= r.lo && port <= r.hi {
+			return true
+		}
+	}
+	return false
+}
+
+// pcapFilter returns the pcap filter clause matching the ports, dir being
+// "src" or "dst".
+func (p portRanges) pcapFilter(dir string) string {
+	var terms []string
+	for _, r := range p {
+		if r.lo == r.hi {
+			terms = append(terms, dir+" port "+strconv.Itoa(r.lo))
+		} else {
+			terms = append(terms, fmt.Sprintf("%s portrange %d-%d", dir, r.lo, r.hi))
+		}
+	}
+	if len(terms) == 1 {
+		return terms[0]
+	}
+	return "(" + strings.Join(terms, " or ") + ")"
+}
+
+// iptables returns the ports of each range as --sport and --dport take them.
+func (p portRanges) iptables() []string {
+	var out []string
+	for _, r := range p {
+		if r.lo == r.hi {
+			out = append(out, strconv.Itoa(r.lo))
+		} else {
+			out = append(out, fmt.Sprintf("%d:%d", r.lo, r.hi))
+		}
+	}
+	return out
+}
+
+// pf returns the ports as a pf rule takes them after "port".
+func (p portRanges) pf() string {
+	if p.single() {
+		return strconv.Itoa(p[0].lo)
+	}
+	return "{ " + strings.Join(p.iptables(), ", ") + " }"
+}
+
+// bpfInsn is an instruction of a classic BPF program, between the types of
+// golang.org/x/net/bpf and of the BSD syscall package.
+type bpfInsn struct {
+	op     uint16
+	jt, jf uint8
+	k      uint32
+}
+
+const (
+	bpfJmpClass = 0x05
+	bpfJA       = 0x05
+	bpfJEQ      = 0x15
+	bpfJGT      = 0x25
+	bpfJGE      = 0x35
+)
+
+// bpf replaces the port check of prog by one testing all of p. prog must
+// end with the check, a jeq on A holding the port that jumps to the next
+// instruction when it matches, a ret that accepts and a ret that drops.
+// The jumps of prog past the check are moved along.
+func (p portRanges) bpf(prog []bpfInsn) ([]bpfInsn, error) {
+	var check []bpfInsn
+	// start[i] is where the check of p[i] begins
+	start := make([]int, len(p)+1)
+	for i, r := range p {
+		start[i] = len(check)
+		if r.lo == r.hi {
+			check = append(check, bpfInsn{op: bpfJEQ, k: uint32(r.lo)})
+		} else {
+			check = append(check, bpfInsn{op: bpfJGE, k: uint32(r.lo)}, bpfInsn{op: bpfJGT, k: uint32(r.hi)})
+		}
+	}
+	m := len(check)
+	start[len(p)] = m + 1 // past the last range, the drop
+	accept := m
+	off := func(from, to int) (uint8, error) {
+		d := to - from - 1
+		if d > 255 {
+			return 0, errPortRanges
+		}
+		return uint8(d), nil
+	}
+	var err error
+	for i, r := range p {
+		j, next := start[i], start[i+1]
+		if r.lo == r.hi {
+			if check[j].jt, err = off(j, accept); err != nil {
+				return nil, err
+			}
+			if check[j].jf, err = off(j, next); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		if check[j].jf, err = off(j, next); err != nil {
+			return nil, err
+		}
+		if check[j+1].jt, err = off(j+1, next); err != nil {
+			return nil, err
+		}
+		if check[j+1].jf, err = off(j+1, accept); err != nil {
+			return nil, err
+		}
+	}
+	c := len(prog) - 3
+	out := slices.Clone(prog[:c])
+	move := m - 1
+	for i := range out {
+		in := &out[i]
+		if in.op&0x07 != bpfJmpClass {
+			continue
+		}
+		if in.op == bpfJA {
+			if i+1+int(in.k) > c {
+				in.k += uint32(move)
+			}
+			continue
+		}
+		for _, jump := range []*uint8{&in.jt, &in.jf} {
+			if i+1+int(*jump) > c {
+				if int(*jump)+move > 255 {
+					return nil, errPortRanges
+				}
+				*jump += uint8(move)
+			}
+		}
+	}
+	out = append(out, check...)
+	return append(out, prog[c+1:]...), nil
+}
@@ -0,0 +1,104 @@
+package rawcon
+
+import "github.com/biotooff/rawcon/utils"
+
+// A profile is a camouflage other than HTTP and TLS: it has a handshake of
+// its own and frames every segment of data afterwards in a record. The
+// listener learns the profile of each peer from its handshake.
+type profile uint8
+
+const (
+	profileNone profile = iota
+	profileDNS
+	profileSSH
+)
+
+// profile returns the profile r is set to.
+func (r *Raw) profile() profile {
+	switch {
+	case r.DNS:
+		return profileDNS
+	case r.SSH:
+		return profileSSH
+	}
+	return profileNone
+}
+
+// recordLen returns the most bytes a segment of data spends on a record.
+func (p profile) recordLen() int {
+	switch p {
+	case profileDNS:
+		return dnsRecordLen
+	case profileSSH:
+		return sshRecordLen
+	}
+	return 0
+}
+
+// profileRequest returns the handshake of a dialer carrying the session
+// token of sid.
+func (r *Raw) profileRequest(host string, sid []byte) []byte {
+	switch r.profile() {
+	case profileDNS:
+		return r.dnsQuery(host, sid)
+	case profileSSH:
+		return r.sshRequest(sid)
+	}
+	return nil
+}
+
+// isRequest tells whether b is the handshake of a dialer.
+func (p profile) isRequest(b []byte) (ok bool) {
+	switch p {
+	case profileDNS:
+		_, _, ok = parseDNSQuery(b)
+	case profileSSH:
+		_, ok = parseSSHHello(b)
+	}
+	return
+}
+
+// answer returns the reply to the handshake b of a dialer and the session
+// token it carries.
+func (p profile) answer(rnd utils.Random, b []byte) (rep, token []byte, ok bool) {
+	switch p {
+	case profileDNS:
+		question, token, ok := parseDNSQuery(b)
+		if !ok {
+			return nil, nil, false
+		}
+		return dnsAnswer(rnd, question), token, true
+	case profileSSH:
+		return sshAnswer(rnd, b)
+	}
+	return nil, nil, false
+}
+
+// isReply tells whether b is the reply to the handshake of a dialer.
+func (p profile) isReply(b []byte) bool {
+	switch p {
+	case profileDNS:
+		return isDNSAnswer(b)
+	case profileSSH:
+		_, ok := parseSSHHello(b)
+		return ok
+	}
+	return false
+}
+
+// seal returns b in a record, in a buffer of utils.GetBuf. response says
+// whether it goes from the listener.
+func (p profile) seal(rnd utils.Random, b []byte, response bool) []byte {
+	if p == profileSSH {
+		return sealSSH(rnd, b)
+	}
+	return sealDNS(rnd, b, response)
+}
+
+// open returns the data of a record of seal.
+func (p profile) open(b []byte) ([]byte, bool) {
+	if p == profileSSH {
+		return openSSH(b)
+	}
+	return openDNS(b)
+}
@@ -0,0 +1,99 @@
+package rawcon
+
+import (
+	"errors"
+	"net"
+	"strconv"
+	"time"
+)
+
+// Two peers behind NATs reach each other without a relay by dialing each
+// other at the same time: the SYN of each opens the mapping of its NAT for
+// the SYN of the other, which crosses it. Neither listens, both answer the
+// crossing SYN with a SYN-ACK, as TCP does on a simultaneous open. What the
+// peers have to know of each other is up to the caller to exchange, through
+// a server both of them reach.
+
+// defaultPunchSlot is how long every predicted port is tried for.
+const defaultPunchSlot = 2 * time.Second
+
+// punchInterval is the wait between the SYNs sent to a predicted port.
+const punchInterval = 250 * time.Millisecond
+
+var (
+	errPunchHandshake = errors.New("hole punching does not work with Udp2raw")
+	errPunchPorts     = errors.New("rendezvous without a port of the peer")
+	errPunchLocal     = errors.New("rendezvous without a local port")
+)
+
+// Rendezvous is what the two ends of a hole punch learned of each other.
+// Both must agree on Start and Slot.
+type Rendezvous struct {
+	// Local is the address to send from, the one whose mapping on the NAT
+	// in front of it the peer was told of. Its port must be set.
+	Local string
+	// Peer is the public IP address of the peer.
+	Peer string
+	// Ports are the ports the NAT of the peer is predicted to map the
+	// Local of the peer to, tried one after the other.
+	Ports []int
+	// Start is when both ends send their first SYN.
+	Start time.Time
+	// Slot is how long each of Ports is tried, 2 seconds if zero. Port i
+	// is tried from Start plus i Slots on.
+	Slot time.Duration
+}
+
+// PunchRAW opens a fake TCP connection to a peer behind a NAT that calls
+// PunchRAW with the matching Rendezvous and the same handshake at the same
+// time. One of the two ends then replies to the handshake of the other, see
+// answersCrossing, which Udp2raw cannot. Unlike a dial, PunchRAW leaves the
+// PacketIO of r to the caller to close, it is tried on every port.
+func (r *Raw) PunchRAW(rv Rendezvous) (conn *RAWConn, err error) {
+	if r.Udp2raw {
+		return nil, errPunchHandshake
+	}
+	if len(rv.Ports) == 0 {
+		return nil, errPunchPorts
+	}
+	local, err := net.ResolveUDPAddr("udp4", rv.Local)
+	if err != nil {
+		return nil, err
+	}
+	if local.Port == 0 {
+		return nil, errPunchLocal
+	}
+	slot := rv.Slot
+	if slot <= 0 {
+		slot = defaultPunchSlot
+	}
+	pr := *r
+	pr.DialUDP = func(address string, _ *net.UDPAddr) (net.Conn, error) {
+		return r.dialUDP(address, local)
+	}
+	if r.PacketIO != nil {
+		pr.PacketIO = punchIO{r.PacketIO}
+	}
+	pr.Retry = &RetryPolicy{
+		Attempts: max(int(slot/punchInterval), 1),
+		Timeout:  punchInterval,
+	}
+	sid := r.newSessionID()
+	for i, port := range rv.Ports {
+		time.Sleep(time.Until(rv.Start.Add(time.Duration(i) * slot)))
+		address := net.JoinHostPort(rv.Peer, strconv.Itoa(port))
+		if conn, err = pr.dial(address, sid, nil); err == nil {
+			conn.start()
+			return
+		}
+	}
+	return
+}
+
+// punchIO keeps a PacketIO open when the connection of a port that failed
+// is closed.
+type punchIO struct {
+	PacketIO
+}
+
+func (punchIO) Close() error { return nil }
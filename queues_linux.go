@@ -0,0 +1,260 @@
+package rawcon
+
+import (
+	"encoding/binary"
+	"errors"
+	"net"
+	"sync"
+	"sync/atomic"
+	"syscall"
+
+	"golang.org/x/net/bpf"
+	"golang.org/x/net/ipv4"
+	"golang.org/x/sys/unix"
+)
+
+// With Raw.Queues a dialed connection reads with AF_PACKET sockets joined
+// in a fanout group of the FANOUT_QM kind, which hands each of them the
+// packets of the receive queues the NIC recorded for it, instead of with
+// its raw socket. Every socket is read on a goroutine of its own and its
+// packets go through a packet pipe, like those of Raw.XDP. The connection
+// sends with as many raw sockets, each segment taking the next one.
+
+// queuePoll is how long a pump waits for packets at most, in milliseconds,
+// before it looks whether it has to stop.
+const queuePoll = 100
+
+// sendSocket is one of the raw sockets a dialed connection sends with.
+type sendSocket struct {
+	conn *net.IPConn
+	// hdr writes the IP headers, set unless the kernel picks the IP IDs
+	hdr *ipv4.RawConn
+}
+
+// queueSource is what a dialed connection reads from and sends with under
+// Raw.Queues.
+type queueSource struct {
+	PacketIO
+	in      PacketIO
+	fds     []int // of the AF_PACKET sockets
+	sends   []sendSocket
+	next    atomic.Uint32
+	dropped []atomic.Uint64 // what the kernel dropped on each socket
+	die     chan struct{}
+	wg      sync.WaitGroup
+	once    sync.Once
+}
+
+// openQueues opens the sockets of Raw.Queues for a connection from local
+// to remote whose raw socket is conn. filter is the one of conn, checking
+// the ports. The queues take over the reads of conn.
+func (raw *RAWConn) openQueues(conn *net.IPConn, filter []bpf.RawInstruction, local, remote *net.UDPAddr) (q *queueSource, err error) {
+	r := raw.r
+	iface := interfaceOf(local.IP)
+	if iface == nil {
+		return nil, errors.New("no interface has " + local.IP.String())
+	}
+	n := min(r.Queues, rxQueues(iface.Name))
+	out, in := NewPacketPipe()
+	q = &queueSource{PacketIO: out, in: in, dropped: make([]atomic.Uint64, n), die: make(chan struct{})}
+	defer func() {
+		if err != nil {
+			q.Close()
+			q = nil
+		}
+	}()
+	prog := queueFilter(local.IP, remote.IP, filter)
+	var group int
+	for i := 0; i < n; i++ {
+		var fd int
+		if fd, err = unix.Socket(unix.AF_PACKET, unix.SOCK_DGRAM|unix.SOCK_CLOEXEC, int(htons(unix.ETH_P_IP))); err != nil {
+			return
+		}
+		q.fds = append(q.fds, fd)
+		if err = attachFilter(fd, prog); err != nil {
+			return
+		}
+		if r.CaptureBuffer > 0 {
+			unix.SetsockoptInt(fd, unix.SOL_SOCKET, unix.SO_RCVBUF, r.CaptureBuffer)
+		}
+		if err = unix.Bind(fd, &unix.SockaddrLinklayer{Protocol: htons(unix.ETH_P_IP), Ifindex: iface.Index}); err != nil {
+			return
+		}
+		// the kernel picks a group of its own for the first socket, the
+		// others join it
+		arg := group | unix.PACKET_FANOUT_QM<<16
+		if i == 0 {
+			arg |= unix.PACKET_FANOUT_FLAG_UNIQUEID << 16
+		}
+		if err = unix.SetsockoptInt(fd, unix.SOL_PACKET, unix.PACKET_FANOUT, arg); err != nil {
+			return
+		}
+		if i == 0 {
+			if group, err = unix.GetsockoptInt(fd, unix.SOL_PACKET, unix.PACKET_FANOUT); err != nil {
+				return
+			}
+			group &= 0xffff
+		}
+	}
+	q.sends = append(q.sends, sendSocket{conn: conn, hdr: raw.ipv4RawConn})
+	for i := 1; i < n; i++ {
+		var s sendSocket
+		if s, err = raw.openSendSocket(local, remote); err != nil {
+			return
+		}
+		q.sends = append(q.sends, s)
+	}
+	for _, fd := range q.fds {
+		q.wg.Add(1)
+		go q.pump(fd, recvBufLen(raw.mtu))
+	}
+	return
+}
+
+// openSendSocket opens a raw socket from local to remote set up like the
+// one of dialSocket, which reads nothing.
+func (raw *RAWConn) openSendSocket(local, remote *net.UDPAddr) (s sendSocket, err error) {
+	r := raw.r
+	if s.conn, err = net.DialIP("ip4:tcp", &net.IPAddr{IP: local.IP}, &net.IPAddr{IP: remote.IP}); err != nil {
+		return
+	}
+	ipv4.NewPacketConn(s.conn).SetBPF([]bpf.RawInstruction{{0x6, 0, 0, 0}})
+	if r.Interface != "" {
+		var c syscall.RawConn
+		if c, err = s.conn.SyscallConn(); err == nil {
+			c.Control(func(fd uintptr) {
+				err = unix.SetsockoptString(int(fd), unix.SOL_SOCKET, unix.SO_BINDTODEVICE, r.Interface)
+			})
+		}
+		if err != nil {
+			s.conn.Close()
+			return
+		}
+	}
+	if tos := raw.tos(); tos != 0 {
+		ipv4.NewConn(s.conn).SetTOS(tos)
+	}
+	if r.TTL > 0 {
+		ipv4.NewConn(s.conn).SetTTL(r.TTL)
+	}
+	if raw.ipv4RawConn != nil {
+		if s.hdr, err = ipv4.NewRawConn(s.conn); err != nil {
+			s.conn.Close()
+		}
+	}
+	return
+}
+
+// queueFilter puts checks in front of filter, a socket filter of a raw
+// socket, for the packets of an AF_PACKET socket: those the host sends and
+// those of other addresses than from remote to local are dropped by the
+// last instruction of filter.
+func queueFilter(local, remote net.IP, filter []bpf.RawInstruction) []bpf.RawInstruction {
+	l := uint8(len(filter))
+	return append([]bpf.RawInstruction{
+		{0x20, 0, 0, 0xfffff000 + uint32(bpf.ExtType)},
+		{0x15, l + 3, 0, unix.PACKET_OUTGOING},
+		{0x20, 0, 0, 12},
+		{0x15, 0, l + 1, binary.BigEndian.Uint32(remote.To4())},
+		{0x20, 0, 0, 16},
+		{0x15, 0, l - 1, binary.BigEndian.Uint32(local.To4())},
+	}, filter...)
+}
+
+func htons(v uint16) uint16 {
+	return v<<8 | v>>8
+}
+
+// attachFilter sets filter as the socket filter of fd.
+func attachFilter(fd int, filter []bpf.RawInstruction) error {
+	insns := make([]unix.SockFilter, len(filter))
+	for i, in := range filter {
+		insns[i] = unix.SockFilter{Code: in.Op, Jt: in.Jt, Jf: in.Jf, K: in.K}
+	}
+	prog := unix.SockFprog{Len: uint16(len(insns)), Filter: &insns[0]}
+	return unix.SetsockoptSockFprog(fd, unix.SOL_SOCKET, unix.SO_ATTACH_FILTER, &prog)
+}
+
+// pump passes the packets of the socket fd on to the pipe.
+func (q *queueSource) pump(fd, size int) {
+	defer q.wg.Done()
+	buf := make([]byte, size)
+	fds := []unix.PollFd{{Fd: int32(fd), Events: unix.POLLIN}}
+	for {
+		select {
+		case <-q.die:
+			return
+		default:
+		}
+		n, _, err := unix.Recvfrom(fd, buf, unix.MSG_DONTWAIT)
+		if err == nil {
+			q.in.WritePacketData(buf[:n])
+			continue
+		}
+		if err != unix.EAGAIN && err != unix.EINTR {
+			return
+		}
+		unix.Poll(fds, queuePoll)
+	}
+}
+
+// send returns the socket the next segment goes out on.
+func (q *queueSource) send() sendSocket {
+	return q.sends[int(q.next.Add(1))%len(q.sends)]
+}
+
+// each runs f on the sockets the connection sends with.
+func (q *queueSource) each(f func(s sendSocket)) {
+	for _, s := range q.sends {
+		f(s)
+	}
+}
+
+// drops returns how many packets the kernel dropped on the sockets of q
+// since they were opened, their counters being reset on every look.
+func (q *queueSource) drops() (n uint64) {
+	for i, fd := range q.fds {
+		if st, err := unix.GetsockoptTpacketStats(fd, unix.SOL_PACKET, unix.PACKET_STATISTICS); err == nil {
+			q.dropped[i].Add(uint64(st.Drops))
+		}
+		n += q.dropped[i].Load()
+	}
+	return
+}
+
+// setReadBuffer sizes the receive buffers of the sockets of q.
+func (q *queueSource) setReadBuffer(bytes int) error {
+	for _, fd := range q.fds {
+		if err := unix.SetsockoptInt(fd, unix.SOL_SOCKET, unix.SO_RCVBUF, bytes); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (q *queueSource) pending() bool {
+	return packetsPending(q.PacketIO)
+}
+
+// release hands a packet the sockets received back to the pipe.
+func (q *queueSource) release(b []byte) {
+	releasePacket(q.PacketIO, b)
+}
+
+// Close closes the AF_PACKET sockets and the send sockets but the first,
+// the raw socket of the connection.
+func (q *queueSource) Close() error {
+	q.once.Do(func() {
+		close(q.die)
+		q.wg.Wait()
+		for _, fd := range q.fds {
+			unix.Close(fd)
+		}
+		for _, s := range q.sends[min(len(q.sends), 1):] {
+			s.conn.Close()
+		}
+		q.PacketIO.Close()
+		q.in.Close()
+	})
+	return nil
+}
@@ -0,0 +1,112 @@
+package rawcon
+
+import (
+	"errors"
+	"net"
+	"os/exec"
+	"testing"
+	"time"
+
+	"golang.org/x/net/ipv4"
+	"golang.org/x/sys/unix"
+)
+
+// TestQueueCapture reads segments sent over lo with the sockets of
+// Raw.Queues, which must leave out those of other ports and the copies
+// the host sends.
+func TestQueueCapture(t *testing.T) {
+	local := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 6860}
+	remote := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 2), Port: 6861}
+	conn, err := net.DialIP("ip4:tcp", &net.IPAddr{IP: local.IP}, &net.IPAddr{IP: remote.IP})
+	if errors.Is(err, unix.EPERM) {
+		t.Skip(err)
+	} else if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	raw := &RAWConn{r: &Raw{Queues: 4}, mtu: 1500}
+	q, err := raw.openQueues(conn, dialFilter(local, remote), local, remote)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer q.Close()
+	if n := min(4, rxQueues("lo")); len(q.fds) != n || len(q.sends) != n {
+		t.Fatalf("%d sockets and %d send sockets, want %d", len(q.fds), len(q.sends), n)
+	}
+
+	peer, err := net.ListenIP("ip4:tcp", &net.IPAddr{IP: remote.IP})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer peer.Close()
+	send, err := ipv4.NewRawConn(peer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, port := range []int{local.Port + 100, local.Port} {
+		tcp := &tcpLayer{srcPort: remote.Port, dstPort: port, flags: PSH | ACK, payload: []byte("queued")}
+		seg := tcp.marshal(remote.IP, local.IP)
+		header := &ipv4.Header{Version: 4, Len: 20, TotalLen: 20 + len(seg), TTL: 64, Protocol: 6, Dst: local.IP, Src: remote.IP}
+		if err = send.WriteTo(header, seg, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	q.SetReadDeadline(time.Now().Add(time.Second))
+	data, err := q.ReadPacketData()
+	if err != nil {
+		t.Fatal(err)
+	}
+	seg, src, dst, ok := parseIPv4(data)
+	if !ok || !src.Equal(remote.IP) || !dst.Equal(local.IP) {
+		t.Fatalf("unexpected packet %x", data)
+	}
+	tcp, err := decodeTCPlayer(seg)
+	if err != nil || tcp.dstPort != local.Port || string(tcp.payload) != "queued" {
+		t.Fatalf("unexpected segment %x, %v", seg, err)
+	}
+	q.release(data)
+	q.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+	if data, err = q.ReadPacketData(); err == nil {
+		t.Fatalf("read %x once more", data)
+	}
+}
+
+// TestQueueFanout joins a socket for each queue of a veth with four of
+// them in one fanout group.
+func TestQueueFanout(t *testing.T) {
+	if out, err := exec.Command("ip", "link", "add", "rcq0", "numrxqueues", "4", "type", "veth", "peer", "name", "rcq1").CombinedOutput(); err != nil {
+		t.Skipf("no veth: %v %s", err, out)
+	}
+	defer exec.Command("ip", "link", "del", "rcq0").Run()
+	for _, args := range [][]string{{"addr", "add", "10.77.0.1/24", "dev", "rcq0"}, {"link", "set", "rcq0", "up"}} {
+		if out, err := exec.Command("ip", args...).CombinedOutput(); err != nil {
+			t.Fatalf("ip %v: %v %s", args, err, out)
+		}
+	}
+	local := &net.UDPAddr{IP: net.IPv4(10, 77, 0, 1), Port: 6862}
+	remote := &net.UDPAddr{IP: net.IPv4(10, 77, 0, 2), Port: 6863}
+	conn, err := net.DialIP("ip4:tcp", &net.IPAddr{IP: local.IP}, &net.IPAddr{IP: remote.IP})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	raw := &RAWConn{r: &Raw{Queues: 8}, mtu: 1500}
+	q, err := raw.openQueues(conn, dialFilter(local, remote), local, remote)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer q.Close()
+	if len(q.fds) != 4 || len(q.sends) != 4 {
+		t.Fatalf("%d sockets and %d send sockets for 4 queues", len(q.fds), len(q.sends))
+	}
+	if q.sends[0].conn != conn {
+		t.Fatal("the raw socket of the connection does not send")
+	}
+	seen := map[*net.IPConn]bool{}
+	for i := 0; i < 4; i++ {
+		seen[q.send().conn] = true
+	}
+	if len(seen) != 4 {
+		t.Fatalf("4 segments went out on %d sockets", len(seen))
+	}
+}
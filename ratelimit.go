@@ -0,0 +1,151 @@
+package rawcon
+
+import (
+	"sync"
+	"time"
+)
+
+const (
+	// without pacing a bucket holds up to 100ms worth of tokens
+	rateBurstDivisor = 10
+	// with pacing it holds a single full sized packet, so that the packets
+	// leave at the configured rate instead of in bursts
+	pacingByteBurst = 1500
+)
+
+type tokenBucket struct {
+	lock   sync.Mutex
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+func newTokenBucket(rate int, burst int) *tokenBucket {
+	if rate <= 0 {
+		return nil
+	}
+	if burst <= 0 {
+		burst = 1
+	}
+	return &tokenBucket{
+		rate:   float64(rate),
+		burst:  float64(burst),
+		tokens: float64(burst),
+		last:   time.Now(),
+	}
+}
+
+// reserve takes n tokens out of the bucket and returns how long the caller
+// has to wait before it may use them.
+func (b *tokenBucket) reserve(n int) time.Duration {
+	if b == nil {
+		return 0
+	}
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	now := time.Now()
+	b.tokens += now.Sub(b.last).Seconds() * b.rate
+	if b.tokens > b.burst {
+		b.tokens = b.burst
+	}
+	b.last = now
+	b.tokens -= float64(n)
+	if b.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-b.tokens / b.rate * float64(time.Second))
+}
+
+// release puts back n tokens reserve took and that went unused.
+func (b *tokenBucket) release(n int) {
+	if b == nil {
+		return
+	}
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	b.tokens += float64(n)
+	if b.tokens > b.burst {
+		b.tokens = b.burst
+	}
+}
+
+type rateLimiter struct {
+	bytes   *tokenBucket
+	packets *tokenBucket
+}
+
+// newRateLimiter returns nil if neither rate is limited.
+func newRateLimiter(rate, packetRate int, pacing bool) *rateLimiter {
+	if rate <= 0 && packetRate <= 0 {
+		return nil
+	}
+	byteBurst, packetBurst := rate/rateBurstDivisor, packetRate/rateBurstDivisor
+	if pacing {
+		byteBurst, packetBurst = pacingByteBurst, 1
+	}
+	return &rateLimiter{
+		bytes:   newTokenBucket(rate, byteBurst),
+		packets: newTokenBucket(packetRate, packetBurst),
+	}
+}
+
+func (l *rateLimiter) reserve(n, packets int) time.Duration {
+	if l == nil {
+		return 0
+	}
+	d := l.bytes.reserve(n)
+	if p := l.packets.reserve(packets); p > d {
+		d = p
+	}
+	return d
+}
+
+func (l *rateLimiter) release(n, packets int) {
+	if l == nil {
+		return
+	}
+	l.bytes.release(n)
+	l.packets.release(packets)
+}
+
+// pace blocks until every limiter allows sending a packet of n bytes.
+func pace(n int, limiters ...*rateLimiter) {
+	paceBatch(n, 1, limiters...)
+}
+
+// paceUntil is paceBatch not waiting past deadline, unless it is zero. It
+// reports false at once, the limiters left as they were, if the wait would
+// end after it.
+func paceUntil(deadline time.Time, n, packets int, limiters ...*rateLimiter) bool {
+	var d time.Duration
+	for _, l := range limiters {
+		if r := l.reserve(n, packets); r > d {
+			d = r
+		}
+	}
+	if d > 0 && !deadline.IsZero() && time.Now().Add(d).After(deadline) {
+		for _, l := range limiters {
+			l.release(n, packets)
+		}
+		return false
+	}
+	if d > 0 {
+		time.Sleep(d)
+	}
+	return true
+}
+
+// paceBatch blocks until every limiter allows sending the given number of
+// packets carrying n bytes in total.
+func paceBatch(n, packets int, limiters ...*rateLimiter) {
+	var d time.Duration
+	for _, l := range limiters {
+		if r := l.reserve(n, packets); r > d {
+			d = r
+		}
+	}
+	if d > 0 {
+		time.Sleep(d)
+	}
+}
@@ -0,0 +1,2304 @@
+// +build darwin dragonfly freebsd netbsd openbsd
+// +build !pcap
+
+package rawcon
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os/exec"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/google/gopacket/layers"
+	"github.com/biotooff/rawcon/utils"
+	"github.com/google/gopacket"
+	"golang.org/x/net/ipv4"
+)
+
+// The BSDs and macOS capture and inject on /dev/bpf with the BPFSniffer of
+// bpf_bsd.go, by syscall alone, so this backend builds with CGO_ENABLED=0.
+// Building with the pcap tag trades it for the libpcap one of raw_other.go.
+
+type RAWConn struct {
+	udp        net.Conn
+	tcp        net.Conn
+	sniffer    *BPFSniffer
+	pio        PacketIO // see Raw.PacketIO, used instead of sniffer
+	// slock guards sniffer and pio for the reads, which do not hold lock
+	// while takeOver replaces them
+	slock      sync.RWMutex
+	pktsrc     *gopacket.PacketSource
+	opts       gopacket.SerializeOptions
+	buffer     gopacket.SerializeBuffer
+	cleaner    *utils.ExitCleaner
+	packets    chan gopacket.Packet
+	rtime      time.Time
+	wdeadline  writeDeadline
+	layer      *pktLayers
+	r          *Raw
+	ipid       *ipidGen
+	ce         atomic.Uint64
+	qdropped   atomic.Uint64
+	malformed  atomic.Uint64
+	reasm      reassembler
+	badsum     atomic.Uint64
+	offload    bool // ChecksumAuto found the NIC offloads checksums
+	icmpErr    atomic.Pointer[ICMPError]
+	tap        atomic.Pointer[packetTap] // see Tap
+	dscp       atomic.Int32 // set by SetDSCP, plus one
+	hs         hsRange // the handshake of the peer
+	lock       sync.Mutex
+	mss        int
+	mtu        int          // of the interface the packets go out on
+	pad        int          // agreed on in the handshake
+	public     *net.UDPAddr // reflected by the listener, see PublicAddr
+	hsinfo     HandshakeInfo
+	peer       peerOptions // what the SYN or SYN-ACK of the peer offered
+	async      utils.AsyncRunner
+	linktype   layers.LinkType
+	rcond      *sync.Cond
+	rver       uint64
+	errch      chan error
+	nocopy     bool
+	isLoopBack bool
+	loophdr    atomic.Uint32 // loopback header seen on the wire, 0 if none yet
+	die        chan struct{}
+	u2r        *udp2rawState
+	sid        []byte
+	limiter    *rateLimiter
+	squeue     *sendQueue
+	sendc      sendCounters
+	coalescer  *coalescer
+	shaper     *shaper
+	rqueue     datagramQueue
+	reset      atomic.Bool
+	zerownd    atomic.Bool // the peer advertised a zero window
+	zrtt       *zeroRTT
+	rtt        rttEstimator
+	lastRecv   atomic.Int64 // Unix nanoseconds of the last segment read
+	fanin      chan capturedPacket
+	nowait     atomic.Bool // see readNoWait
+	sip        net.IP
+	dip        net.IP
+	sport      int
+	dport      int
+	lports     portRanges // those of a listener, see ports.go
+}
+
+func (raw *RAWConn) GetMSS() int {
+	return raw.mss
+}
+
+// GetLocalInterfaceInfo returns the interface conn captures on, and the
+// Ethernet addresses its packets carry.
+func (conn *RAWConn) GetLocalInterfaceInfo() InterfaceInfo {
+	link := conn.linktype.String()
+	if conn.pio != nil {
+		link = "PacketIO"
+	}
+	info := interfaceInfo(conn.layer.ip4.SrcIP, link)
+	if conn.mtu > 0 {
+		info.MTU = conn.mtu
+	}
+	if eth := conn.layer.eth; eth != nil {
+		info.MAC, info.GatewayMAC = eth.SrcMAC, eth.DstMAC
+	}
+	return info
+}
+
+func getMssFromTcpLayer(tcp *layers.TCP) int {
+	for _, v := range tcp.Options {
+		if v.OptionType != layers.TCPOptionKindMSS || len(v.OptionData) < 2 {
+			continue
+		}
+		return (int)(binary.BigEndian.Uint16(v.OptionData))
+	}
+	return 0
+}
+
+// peerOptionsOf returns the options the SYN or SYN-ACK tcp offers.
+func peerOptionsOf(tcp *layers.TCP) peerOptions {
+	opts := peerOptions{seen: true, wscale: -1}
+	for _, v := range tcp.Options {
+		switch v.OptionType {
+		case layers.TCPOptionKindWindowScale:
+			if len(v.OptionData) >= 1 {
+				opts.wscale = int(v.OptionData[0])
+			}
+		case layers.TCPOptionKindSACKPermitted:
+			opts.sack = true
+		case layers.TCPOptionKindTimestamps:
+			opts.tsval, _, opts.timestamps = parseTimestamps(v.OptionData)
+		}
+	}
+	return opts
+}
+
+// hsSegmentOf returns what the handshakes look at of tcp, carrying n bytes.
+func hsSegmentOf(tcp *layers.TCP, n int) hsSegment {
+	return hsSegment{
+		syn:  tcp.SYN,
+		ack:  tcp.ACK,
+		psh:  tcp.PSH,
+		fin:  tcp.FIN,
+		seq:  tcp.Seq,
+		ackn: tcp.Ack,
+		n:    n,
+	}
+}
+
+// tcpHeader is the TCP header as the backend decodes it.
+type tcpHeader = layers.TCP
+
+// segmentOf returns the segment of the core of tcp.
+func segmentOf(tcp *layers.TCP) segment {
+	return segment{
+		hsSegment: hsSegmentOf(tcp, len(tcp.Payload)),
+		rst:       tcp.RST,
+		window:    tcp.Window,
+		dport:     int(tcp.DstPort),
+		payload:   tcp.Payload,
+		tcp:       tcp,
+	}
+}
+
+// srcIP returns the address the segments of layer are sent from.
+func (layer *pktLayers) srcIP() net.IP {
+	return layer.ip4.SrcIP
+}
+
+// capture returns the sniffer, or the PacketIO, the reads are from.
+func (conn *RAWConn) capture() (*BPFSniffer, PacketIO) {
+	conn.slock.RLock()
+	defer conn.slock.RUnlock()
+	return conn.sniffer, conn.pio
+}
+
+func (conn *RAWConn) readPacket() (packet gopacket.Packet, err error) {
+	for {
+		var data []byte
+		sniffer, _ := conn.capture()
+		data, _, err = sniffer.ReadPacketData()
+		if err != nil {
+			if s, _ := conn.capture(); s != sniffer {
+				// the connection has migrated, go on with the new sniffer
+				continue
+			}
+			return
+		}
+		if len(data) == 0 {
+			// the BPF read timed out
+			if conn.rtime.Equal(time.Time{}) || conn.rtime.After(time.Now()) {
+				continue
+			}
+			err = &timeoutErr{
+				op: "read from " + conn.RemoteAddr().String(),
+			}
+			return
+		}
+		if data = conn.r.packetIn(data); data == nil {
+			continue
+		}
+		packet = gopacket.NewPacket(data, conn.linktype, gopacket.DecodeOptions{NoCopy: conn.nocopy, Lazy: true})
+		return
+	}
+}
+
+// capturedPacket is a packet read from one of the sniffers of a listener on
+// several interfaces.
+type capturedPacket struct {
+	data    []byte
+	sniffer *BPFSniffer
+	err     error
+}
+
+// pump feeds the packets captured by sniffer to readLayers.
+func (conn *RAWConn) pump(sniffer *BPFSniffer) {
+	for {
+		data, _, err := sniffer.ReadPacketData()
+		if err == nil && len(data) == 0 {
+			continue
+		}
+		p := capturedPacket{sniffer: sniffer, err: err}
+		if err == nil {
+			p.data = append([]byte(nil), data...)
+		}
+		if err == nil && conn.r.QueueLen > 0 {
+			select {
+			case conn.fanin <- p:
+			case <-conn.die:
+				return
+			default:
+				conn.qdropped.Add(1)
+			}
+			continue
+		}
+		select {
+		case conn.fanin <- p:
+		case <-conn.die:
+			return
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+func (conn *RAWConn) readLayers() (layer *pktLayers, err error) {
+	for {
+		var packet gopacket.Packet
+		var from *BPFSniffer
+		_, pio := conn.capture()
+		if pio != nil {
+			if conn.nowait.Load() && !packetsPending(pio) {
+				return nil, errWouldBlock
+			}
+			var data []byte
+			if data, err = pio.ReadPacketData(); err != nil {
+				if _, p := conn.capture(); p != pio {
+					// the connection has migrated, go on with the new PacketIO
+					continue
+				}
+				return
+			}
+			if data = conn.r.packetIn(data); data == nil {
+				continue
+			}
+			// the packets of a PacketIO start with the IPv4 header
+			packet = gopacket.NewPacket(data, layers.LayerTypeIPv4, gopacket.DecodeOptions{NoCopy: true, Lazy: true})
+		} else if conn.nowait.Load() && len(conn.fanin) == 0 {
+			// a sniffer read alone cannot tell whether it would wait
+			return nil, errWouldBlock
+		} else if conn.fanin != nil {
+			select {
+			case p := <-conn.fanin:
+				if p.err != nil {
+					return nil, p.err
+				}
+				from = p.sniffer
+				if p.data = conn.r.packetIn(p.data); p.data == nil {
+					continue
+				}
+				packet = gopacket.NewPacket(p.data, conn.linktype, gopacket.DecodeOptions{NoCopy: true, Lazy: true})
+			case <-conn.die:
+				return nil, io.EOF
+			}
+		} else if packet, err = conn.readPacket(); err != nil {
+			return
+		}
+		var eth *layers.Ethernet
+		var ethLayer, loopLayer gopacket.Layer
+		if conn.isLoopBack {
+			loopLayer = packet.Layer(layers.LayerTypeLoopback)
+		} else {
+			ethLayer = packet.Layer(layers.LayerTypeEthernet)
+			eth, _ = ethLayer.(*layers.Ethernet)
+		}
+		if ethLayer == nil && loopLayer == nil && pio == nil {
+			continue
+		}
+		if eth != nil && isHostMAC(eth.SrcMAC) {
+			continue
+		}
+		ipLayer := packet.Layer(layers.LayerTypeIPv4)
+		if ipLayer == nil {
+			continue
+		}
+		ip4, _ := ipLayer.(*layers.IPv4)
+		if conn.sip != nil && !conn.sip.Equal(ip4.SrcIP) {
+			continue
+		}
+		if conn.dip != nil && !conn.dip.Equal(ip4.DstIP) {
+			continue
+		}
+		if ip4.Flags&layers.IPv4MoreFragments != 0 || ip4.FragOffset != 0 {
+			whole := conn.reasm.add(append(append([]byte(nil), ip4.Contents...), ip4.Payload...))
+			if whole == nil {
+				continue
+			}
+			packet = gopacket.NewPacket(whole, layers.LayerTypeIPv4, gopacket.DecodeOptions{NoCopy: true, Lazy: true})
+			if ip4, _ = packet.Layer(layers.LayerTypeIPv4).(*layers.IPv4); ip4 == nil {
+				continue
+			}
+		}
+		if packet.ErrorLayer() != nil {
+			conn.malformed.Add(1)
+			continue
+		}
+		tcpLayer := packet.Layer(layers.LayerTypeTCP)
+		if tcpLayer == nil {
+			continue
+		}
+		tcp, _ := tcpLayer.(*layers.TCP)
+		if conn.r.VerifyChecksums && !validChecksums(ip4, tcp, conn.r.Checksums != ChecksumFull) {
+			conn.badsum.Add(1)
+			continue
+		}
+		if t := conn.tap.Load(); t != nil {
+			t.ip(false, ip4.Contents, ip4.Payload)
+		}
+		if conn.r.IgnRST && tcp.RST {
+			continue
+		}
+		if loopLayer != nil {
+			conn.learnLoopHeader(loopLayer.LayerContents())
+		}
+		if conn.sport != 0 && conn.sport != int(tcp.SrcPort) {
+			continue
+		}
+		if conn.dport != 0 && conn.dport != int(tcp.DstPort) && !conn.lports.has(int(tcp.DstPort)) {
+			continue
+		}
+		layer = &pktLayers{
+			eth: eth, ip4: ip4, tcp: tcp,
+			sniffer: from,
+		}
+		return
+	}
+}
+
+// readSegment reads the next segment of a dialed connection.
+func (conn *RAWConn) readSegment() (seg segment, err error) {
+	cl, err := conn.readLayers()
+	if err != nil {
+		return
+	}
+	seg = segmentOf(cl.tcp)
+	seg.src = &net.UDPAddr{IP: cl.ip4.SrcIP, Port: int(cl.tcp.SrcPort)}
+	return
+}
+
+func (conn *RAWConn) Close() (err error) {
+	conn.zrtt.stop()
+	conn.lock.Lock()
+	defer conn.lock.Unlock()
+	if conn.die != nil {
+		select {
+		default:
+		case <-conn.die:
+			return
+		}
+	}
+	if conn.cleaner != nil {
+		conn.cleaner.Exit()
+		conn.cleaner = nil
+	}
+	if conn.udp != nil && (conn.sniffer != nil || conn.pio != nil) {
+		conn.sendFin()
+	}
+	if conn.udp != nil {
+		err = conn.udp.Close()
+	}
+	if conn.tcp != nil {
+		err = conn.tcp.Close()
+	}
+	if conn.sniffer != nil {
+		conn.sniffer.Close()
+	}
+	if conn.pio != nil {
+		if err1 := conn.pio.Close(); err1 != nil {
+			err = err1
+		}
+	}
+	if conn.die != nil {
+		close(conn.die)
+	}
+	go func() {
+		conn.rcond.L.Lock()
+		defer conn.rcond.L.Unlock()
+		conn.rcond.Broadcast()
+	}()
+	return
+}
+
+func (conn *RAWConn) sendPacketWithLayer(layer *pktLayers) (err error) {
+	opts := conn.opts
+	layer.stampSegmentID()
+	layer.ip4.Id = conn.ipid.next(layer.ip4.Id, layer.ip4.DstIP)
+	layer.ip4.TOS = uint8(conn.tosOf(layer.tos))
+	layer.tcp.SetNetworkLayerForChecksum(layer.ip4)
+	var link gopacket.SerializableLayer = layer.eth
+	linklen := 14
+	if conn.pio != nil {
+		// the packets of a PacketIO start with the IPv4 header
+		link, linklen = gopacket.Payload(nil), 0
+	} else if layer.eth == nil {
+		link, linklen = gopacket.Payload(conn.loopHeader()), 4
+	}
+	sniffer := conn.sniffer
+	if layer.sniffer != nil {
+		sniffer = layer.sniffer
+	}
+	offload := conn.r.offloads(conn.offload)
+	if frame := templateFrame(&layer.tmpl, opts, link, layer.ip4, layer.tcp, layer.tcp.Payload); frame != nil {
+		err = conn.sendFrame(sniffer, frame, linklen, offload)
+		utils.PutBuf(frame)
+		return
+	}
+	buffer := gopacket.NewSerializeBuffer()
+	err = gopacket.SerializeLayers(buffer, opts,
+		link, layer.ip4,
+		layer.tcp, gopacket.Payload(layer.tcp.Payload))
+	if err == nil {
+		err = conn.sendFrame(sniffer, buffer.Bytes(), linklen, offload)
+	}
+	return
+}
+
+// sendFrame sends frame, whose link header is linklen bytes long, on
+// sniffer or on the PacketIO of conn, once Raw.PacketOut has seen it.
+func (conn *RAWConn) sendFrame(sniffer *BPFSniffer, frame []byte, linklen int, offload bool) (err error) {
+	if offload {
+		putFrameChecksum(frame, linklen)
+	}
+	b := conn.r.packetOut(frame)
+	if b == nil {
+		return nil
+	}
+	if t := conn.tap.Load(); t != nil {
+		t.frame(b, linklen)
+	}
+	if conn.pio != nil {
+		return conn.pio.WritePacketData(b)
+	}
+	_, err = sniffer.WritePacketData(b)
+	return
+}
+
+// loopHeader returns the 4-byte null/loopback header announcing an IPv4
+// packet. BSDs disagree on its byte order: lo0 is DLT_NULL in host order on
+// FreeBSD and macOS but DLT_LOOP in network order on OpenBSD, so the order
+// seen on received packets wins over the per-OS guess.
+func (conn *RAWConn) loopHeader() []byte {
+	hdr := make([]byte, 4)
+	if v := conn.loophdr.Load(); v != 0 {
+		binary.BigEndian.PutUint32(hdr, v)
+	} else if runtime.GOOS == "openbsd" {
+		binary.BigEndian.PutUint32(hdr, uint32(layers.ProtocolFamilyIPv4))
+	} else {
+		binary.NativeEndian.PutUint32(hdr, uint32(layers.ProtocolFamilyIPv4))
+	}
+	return hdr
+}
+
+// learnLoopHeader records the loopback header of a received IPv4 packet.
+func (conn *RAWConn) learnLoopHeader(hdr []byte) {
+	if len(hdr) == 4 {
+		conn.loophdr.Store(binary.BigEndian.Uint32(hdr))
+	}
+}
+
+func (conn *RAWConn) sendPacket() (err error) {
+	return conn.sendPacketWithLayer(conn.layer)
+}
+
+func (layer *pktLayers) updateTCP() {
+	tcp := layer.tcp
+	tcp.Padding = nil
+	tcp.FIN = false
+	tcp.PSH = false
+	tcp.ACK = false
+	tcp.RST = false
+	tcp.SYN = false
+}
+
+// ack returns the acknowledgment number layer sends, setAck changes it.
+func (layer *pktLayers) ack() uint32 {
+	return layer.tcp.Ack
+}
+
+// seq returns the sequence number of the next segment layer sends.
+func (layer *pktLayers) seq() uint32 {
+	return layer.tcp.Seq
+}
+
+func (layer *pktLayers) setAck(ack uint32) {
+	layer.tcp.Ack = ack
+}
+
+func (layer *pktLayers) setSeq(seq uint32) {
+	layer.tcp.Seq = seq
+}
+
+func (layer *pktLayers) setWindow(window uint16) {
+	layer.tcp.Window = window
+}
+
+func (conn *RAWConn) updateTCP() {
+	conn.layer.updateTCP()
+}
+
+func (conn *RAWConn) sendSynWithLayer(layer *pktLayers) (err error) {
+	layer.updateTCP()
+	tcp := layer.tcp
+	tcp.SYN = true
+	options := tcp.Options
+	defer func() { tcp.Options = options }()
+	tcp.Options = append(tcp.Options, layers.TCPOption{
+		OptionType:   layers.TCPOptionKindMSS,
+		OptionLength: 4,
+		OptionData:   mssOption(conn.r.advertisedMSS(conn.mtu)),
+	})
+	tcp.Options = append(tcp.Options, layers.TCPOption{
+		OptionType:   layers.TCPOptionKindWindowScale,
+		OptionLength: 3,
+		OptionData:   []byte{windowScale},
+	})
+	tcp.Options = append(tcp.Options, layers.TCPOption{
+		OptionType:   layers.TCPOptionKindSACKPermitted,
+		OptionLength: 2,
+	})
+	tcp.Options = append(tcp.Options, layers.TCPOption{
+		OptionType:   layers.TCPOptionKindTimestamps,
+		OptionLength: 10,
+		OptionData:   timestampsData(tsNow(), 0),
+	})
+	return conn.sendPacketWithLayer(layer)
+}
+
+// sendTimestampsWithLayer sends a pure ACK carrying the TCP timestamps
+// option.
+func (conn *RAWConn) sendTimestampsWithLayer(layer *pktLayers, val, ecr uint32) (err error) {
+	layer.updateTCP()
+	tcp := layer.tcp
+	tcp.ACK = true
+	options := tcp.Options
+	defer func() { tcp.Options = options }()
+	tcp.Options = append(tcp.Options, layers.TCPOption{
+		OptionType:   layers.TCPOptionKindTimestamps,
+		OptionLength: 10,
+		OptionData:   timestampsData(val, ecr),
+	})
+	return conn.sendPacketWithLayer(layer)
+}
+
+func timestampsOf(tcp *layers.TCP) (val, ecr uint32, ok bool) {
+	for _, v := range tcp.Options {
+		if v.OptionType == layers.TCPOptionKindTimestamps {
+			return parseTimestamps(v.OptionData)
+		}
+	}
+	return
+}
+
+// setSegmentID adds the option carrying tag to the segments of conn.
+func (conn *RAWConn) setSegmentID(tag *segmentTag) {
+	conn.layer.tag = tag
+	tcp := conn.layer.tcp
+	tcp.Options = append(tcp.Options, layers.TCPOption{
+		OptionType:   tcpOptionKindSegmentID,
+		OptionLength: segmentIDOptionLen,
+		OptionData:   tag.data[:],
+	})
+}
+
+func segmentIDOf(tcp *layers.TCP) []byte {
+	for _, v := range tcp.Options {
+		if v.OptionType == tcpOptionKindSegmentID {
+			return v.OptionData
+		}
+	}
+	return nil
+}
+
+func (conn *RAWConn) sendSyn() (err error) {
+	return conn.sendSynWithLayer(conn.layer)
+}
+
+// sendSynAckWithLayer sends a SYN-ACK announcing mss answering a SYN that
+// offered peer, with those of the options that it offered.
+func (conn *RAWConn) sendSynAckWithLayer(layer *pktLayers, mss int, peer peerOptions) (err error) {
+	layer.updateTCP()
+	tcp := layer.tcp
+	tcp.SYN = true
+	tcp.ACK = true
+	options := tcp.Options
+	defer func() { tcp.Options = options }()
+	tcp.Options = append(tcp.Options, layers.TCPOption{
+		OptionType:   layers.TCPOptionKindMSS,
+		OptionLength: 4,
+		OptionData:   mssOption(mss),
+	})
+	if peer.wscale >= 0 {
+		tcp.Options = append(tcp.Options, layers.TCPOption{
+			OptionType:   layers.TCPOptionKindWindowScale,
+			OptionLength: 3,
+			OptionData:   []byte{windowScale},
+		})
+	}
+	if peer.sack {
+		tcp.Options = append(tcp.Options, layers.TCPOption{
+			OptionType:   layers.TCPOptionKindSACKPermitted,
+			OptionLength: 2,
+		})
+	}
+	if peer.timestamps {
+		tcp.Options = append(tcp.Options, layers.TCPOption{
+			OptionType:   layers.TCPOptionKindTimestamps,
+			OptionLength: 10,
+			OptionData:   timestampsData(tsNow(), peer.tsval),
+		})
+	}
+	return conn.sendPacketWithLayer(layer)
+}
+
+func (conn *RAWConn) sendSynAck() (err error) {
+	return conn.sendSynAckWithLayer(conn.layer, conn.r.advertisedMSS(conn.mtu), conn.peer)
+}
+
+func (conn *RAWConn) sendAckWithLayer(layer *pktLayers) (err error) {
+	layer.updateTCP()
+	layer.tcp.ACK = true
+	return conn.sendPacketWithLayer(layer)
+}
+
+func (conn *RAWConn) sendAck() (err error) {
+	return conn.sendAckWithLayer(conn.layer)
+}
+
+func (conn *RAWConn) sendFinWithLayer(layer *pktLayers) (err error) {
+	layer.updateTCP()
+	layer.tcp.FIN = true
+	return conn.sendPacketWithLayer(layer)
+}
+
+func (conn *RAWConn) sendFin() (err error) {
+	return conn.sendFinWithLayer(conn.layer)
+}
+
+func (conn *RAWConn) sendRstWithLayer(layer *pktLayers) (err error) {
+	layer.updateTCP()
+	layer.tcp.RST = true
+	return conn.sendPacketWithLayer(layer)
+}
+
+func (conn *RAWConn) sendRst() (err error) {
+	return conn.sendRstWithLayer(conn.layer)
+}
+
+func (conn *RAWConn) writeWithLayer(b []byte, layer *pktLayers) (n int, err error) {
+	n = len(b)
+	layer.updateTCP()
+	tcp := layer.tcp
+	tcp.PSH = true
+	tcp.ACK = true
+	tcp.Payload = b
+	defer func() { tcp.Payload = nil }()
+	return n, conn.sendPacketWithLayer(layer)
+}
+
+// the write method don't increace the seq number
+// applyTOS does nothing, the TOS byte is set on every packet sent.
+func (conn *RAWConn) applyTOS() {}
+
+// sendDecoy sends b at the next sequence number with Raw.DecoyTTL.
+func (conn *RAWConn) sendDecoy(b []byte) (err error) {
+	ip4 := conn.layer.ip4
+	ip4.TTL = uint8(conn.r.DecoyTTL)
+	defer func() { ip4.TTL = uint8(conn.r.ttl()) }()
+	_, err = conn.write(b)
+	return
+}
+
+func (conn *RAWConn) write(b []byte) (n int, err error) {
+	return conn.writeWithLayer(b, conn.layer)
+}
+
+// sendChatterWithLayer sends b at the next sequence number without the PSH
+// flag, see Raw.Chatter, and moves the sequence number past it.
+func (conn *RAWConn) sendChatterWithLayer(b []byte, layer *pktLayers) (err error) {
+	layer.updateTCP()
+	tcp := layer.tcp
+	tcp.ACK = true
+	tcp.Payload = b
+	err = conn.sendPacketWithLayer(layer)
+	tcp.Payload = nil
+	tcp.Seq += uint32(len(b))
+	return
+}
+
+// ackUpTo moves the acknowledgment number of the connection past the n
+// bytes received at seq. It takes the lock, the segments sent from other
+// goroutines carry the number too.
+func (conn *RAWConn) ackUpTo(seq uint32, n int) {
+	conn.lock.Lock()
+	defer conn.lock.Unlock()
+	if uint64(seq)+uint64(n) > uint64(conn.layer.tcp.Ack) {
+		conn.layer.tcp.Ack = seq + uint32(n)
+	}
+}
+
+// seqAck returns the next sequence number and the acknowledgment number of
+// the connection.
+func (conn *RAWConn) seqAck() (seq, ack uint32) {
+	return conn.layer.tcp.Seq, conn.layer.tcp.Ack
+}
+
+func (conn *RAWConn) setSeqAck(seq, ack uint32) {
+	conn.layer.tcp.Seq, conn.layer.tcp.Ack = seq, ack
+}
+
+// detach has nothing to do, Close sends no FIN here.
+func (conn *RAWConn) detach() {}
+
+// resendAt sends b again at the sequence number seqn, leaving the one of
+// the connection as it is.
+func (conn *RAWConn) resendAt(b []byte, seqn uint32) (err error) {
+	conn.lock.Lock()
+	defer conn.lock.Unlock()
+	tcp := conn.layer.tcp
+	cur := tcp.Seq
+	tcp.Seq = seqn
+	_, err = conn.write(b)
+	tcp.Seq = cur
+	return
+}
+
+func (conn *RAWConn) Write(b []byte) (n int, err error) {
+	if err = conn.resetErr("write"); err != nil {
+		return
+	}
+	if err = conn.pathErr("write"); err != nil {
+		return
+	}
+	limit := payloadLimit(conn.mss, recordLen(conn.r.TLS, conn.r.profile()), conn.u2r, conn.pad)
+	if conn.coalescer != nil {
+		limit -= coalesceHeaderLen
+	}
+	if len(b) > limit {
+		return 0, &MessageTooLongError{Size: len(b), Limit: limit}
+	}
+	if conn.shaper != nil {
+		return len(b), conn.shaper.write(b)
+	}
+	if conn.coalescer != nil {
+		return len(b), conn.coalescer.write(b)
+	}
+	return conn.wdeadline.write(conn.r, conn.squeue, conn.RemoteAddr, b, func(b []byte, deadline time.Time) (int, error) {
+		return conn.writeSegment(b, 0, deadline)
+	})
+}
+
+// writeSegment sends b in a segment of its own.
+func (conn *RAWConn) writeSegment(b []byte, tos int, deadline time.Time) (n int, err error) {
+	if conn.r.windowShut(&conn.zerownd) {
+		return len(b), nil
+	}
+	if !paceUntil(deadline, len(b), 1, conn.limiter) {
+		return 0, &timeoutErr{op: "write to " + conn.RemoteAddr().String()}
+	}
+	if conn.u2r != nil {
+		sealed := conn.u2r.sealLocked(udp2rawData, b)
+		defer utils.PutBuf(sealed)
+		if _, err = conn.writeTOS(sealed, tos); err != nil {
+			return 0, err
+		}
+		return len(b), nil
+	}
+	n = len(b)
+	if conn.pad > 0 {
+		b = padSegment(conn.r.random(), b, conn.pad, payloadLimit(conn.mss, recordLen(conn.r.TLS, conn.r.profile()), nil, conn.pad)-n)
+		defer utils.PutBuf(b)
+	}
+	if conn.r.TLS {
+		buf := utils.GetBuf(len(b) + 5)
+		defer utils.PutBuf(buf)
+		copy(buf, []byte{0x17, 0x3, 0x3})
+		binary.BigEndian.PutUint16(buf[3:5], uint16(len(b)))
+		copy(buf[5:], b)
+		b = buf[:5+len(b)]
+	} else if p := conn.r.profile(); p != profileNone {
+		b = p.seal(conn.r.random(), b, false)
+		defer utils.PutBuf(b)
+	}
+	if _, err = conn.writeTOS(b, tos); err != nil {
+		return 0, err
+	}
+	return
+}
+
+// writeTOS sends b in the next segment, with the TOS byte tos minus one
+// unless tos is zero.
+func (conn *RAWConn) writeTOS(b []byte, tos int) (n int, err error) {
+	conn.lock.Lock()
+	defer conn.lock.Unlock()
+	conn.layer.tos = tos
+	n, err = conn.write(b)
+	conn.layer.tos = 0
+	conn.layer.tcp.Seq += uint32(n)
+	return
+}
+
+// resolveEthernet builds the Ethernet header of the packets from local to
+// remote, asking the next hop for its address with ARP.
+func (conn *RAWConn) resolveEthernet(local, remote net.IP) (eth *layers.Ethernet, err error) {
+	src, hop, req, err := arpQuery(local, remote)
+	if err != nil {
+		return
+	}
+	defer conn.SetReadDeadline(time.Time{})
+	for i := 0; i < arpRetries; i++ {
+		if _, err = conn.sniffer.WritePacketData(req); err != nil {
+			return
+		}
+		conn.SetReadDeadline(time.Now().Add(arpTimeout))
+		for {
+			packet, e := conn.readPacket()
+			if e != nil {
+				break
+			}
+			if dst, ok := arpReply(packet, hop); ok {
+				eth = &layers.Ethernet{
+					SrcMAC:       src,
+					DstMAC:       dst,
+					EthernetType: layers.EthernetTypeIPv4,
+				}
+				return
+			}
+		}
+	}
+	return nil, errors.New("no ARP reply from " + hop.String())
+}
+
+// snifferFilter widens the port check at the end of prog, the filter of a
+// listener, to the ports p.
+func (p portRanges) snifferFilter(prog []syscall.BpfInsn) ([]syscall.BpfInsn, error) {
+	if p.single() {
+		return prog, nil
+	}
+	insns := make([]bpfInsn, len(prog))
+	for i, in := range prog {
+		insns[i] = bpfInsn{op: in.Code, jt: in.Jt, jf: in.Jf, k: in.K}
+	}
+	insns, err := p.bpf(insns)
+	if err != nil {
+		return nil, err
+	}
+	prog = make([]syscall.BpfInsn, len(insns))
+	for i, in := range insns {
+		prog[i] = syscall.BpfInsn{Code: in.op, Jt: in.jt, Jf: in.jf, K: in.k}
+	}
+	return prog, nil
+}
+
+// openSniffer opens a BPF device on the interface name set up by the
+// capture options of r.
+func (r *Raw) openSniffer(name string) (*BPFSniffer, error) {
+	return openBPF(name, r.captureBufLen(), time.Millisecond, r.Promisc)
+}
+
+// diagnoseCapture checks that a BPF device opens on the interface of local.
+func (r *Raw) diagnoseCapture(local net.IP) (string, error) {
+	iface, err := r.chooseInterface(local)
+	if err != nil {
+		return "", err
+	}
+	sniffer, err := r.openSniffer(iface.Name)
+	if err != nil {
+		return "", err
+	}
+	sniffer.Close()
+	return "BPF on " + iface.Name, nil
+}
+
+// diagnoseInject checks that BPF sends on the interface of local, with the
+// ARP request for the next hop towards remote.
+func (r *Raw) diagnoseInject(local, remote net.IP) (string, error) {
+	iface, err := r.chooseInterface(local)
+	if err != nil {
+		return "", err
+	}
+	if iface.Flags&net.FlagLoopback != 0 {
+		return "nothing to send on loopback", nil
+	}
+	_, _, req, err := arpQuery(local, remote)
+	if err != nil {
+		return "", err
+	}
+	sniffer, err := r.openSniffer(iface.Name)
+	if err != nil {
+		return "", err
+	}
+	defer sniffer.Close()
+	if _, err = sniffer.WritePacketData(req); err != nil {
+		return "", err
+	}
+	return "BPF sends on " + iface.Name, nil
+}
+
+// diagnoseGateway asks the next hop towards remote for its hardware address.
+func (r *Raw) diagnoseGateway(local, remote net.IP) (string, error) {
+	iface, err := r.chooseInterface(local)
+	if err != nil {
+		return "", err
+	}
+	if iface.Flags&net.FlagLoopback != 0 {
+		return "no gateway on loopback", nil
+	}
+	sniffer, err := r.openSniffer(iface.Name)
+	if err != nil {
+		return "", err
+	}
+	defer sniffer.Close()
+	conn := &RAWConn{
+		r:        r,
+		sniffer:  sniffer,
+		linktype: layers.LinkTypeEthernet,
+		layer: &pktLayers{
+			ip4: &layers.IPv4{SrcIP: local, DstIP: remote},
+			tcp: &layers.TCP{},
+		},
+	}
+	eth, err := conn.resolveEthernet(local, remote)
+	if err != nil {
+		return "", err
+	}
+	return "next hop at " + eth.DstMAC.String(), nil
+}
+
+// sniffOwn captures a UDP packet the system sends to a random address.
+func (conn *RAWConn) sniffOwn() (packet gopacket.Packet, err error) {
+	buf := make([]byte, 32)
+	conn.r.random().Read(buf)
+	raddr := &net.UDPAddr{IP: net.IPv4(8, 8, buf[0], buf[1]), Port: int(binary.LittleEndian.Uint16(buf[2:4]))}
+	uconn, err := conn.r.dialUDP(raddr.String(), nil)
+	if err != nil {
+		return
+	}
+	defer uconn.Close()
+	if _, err = uconn.Write(buf); err != nil {
+		return
+	}
+	conn.SetReadDeadline(time.Now().Add(time.Second * 2))
+	defer conn.SetReadDeadline(time.Time{})
+	for {
+		packet, err = conn.readPacket()
+		if err != nil {
+			return
+		}
+		ip4, ok := packet.Layer(layers.LayerTypeIPv4).(*layers.IPv4)
+		if ok && ip4.DstIP.Equal(raddr.IP) {
+			return
+		}
+	}
+}
+
+// sniffEthernet learns the Ethernet header from sniffOwn, for when ARP does
+// not work.
+func (conn *RAWConn) sniffEthernet() (eth *layers.Ethernet, err error) {
+	packet, err := conn.sniffOwn()
+	if err != nil {
+		return
+	}
+	eth, ok := packet.Layer(layers.LayerTypeEthernet).(*layers.Ethernet)
+	if !ok {
+		err = errors.New("cannot find the link layer")
+	}
+	return
+}
+
+// listenInterfaces returns the interfaces a listener on ip captures on. For
+// a wildcard address they are all those with an IPv4 address but the
+// loopback, or Raw.Interface alone if it is set.
+func (r *Raw) listenInterfaces(ip net.IP) (ifaces []net.Interface, err error) {
+	if !ip.Equal(net.IPv4zero) || r.Interface != "" {
+		iface, err := r.chooseInterface(ip)
+		if err != nil {
+			return nil, err
+		}
+		return []net.Interface{iface}, nil
+	}
+	all, err := net.Interfaces()
+	if err != nil {
+		return
+	}
+	for _, iface := range all {
+		if iface.Flags&net.FlagUp == 0 || iface.Flags&net.FlagLoopback != 0 {
+			continue
+		}
+		addrs, err := iface.Addrs()
+		if err != nil {
+			continue
+		}
+		for _, addr := range addrs {
+			if ipnet, ok := addr.(*net.IPNet); ok && ipnet.IP.To4() != nil {
+				ifaces = append(ifaces, iface)
+				break
+			}
+		}
+	}
+	if len(ifaces) == 0 {
+		err = ErrNoInterface
+	}
+	return
+}
+
+// chooseInterface returns the interface to capture on for the local address
+// ip, Raw.Interface if it is set.
+func (r *Raw) chooseInterface(ip net.IP) (iface net.Interface, err error) {
+	if r.Interface != "" {
+		i, err := net.InterfaceByName(r.Interface)
+		if err != nil {
+			return iface, err
+		}
+		return *i, nil
+	}
+	ifaces, err := net.Interfaces()
+	if err != nil {
+		return
+	}
+	for _, i := range ifaces {
+		addrs, err := i.Addrs()
+		if err != nil {
+			continue
+		}
+		for _, addr := range addrs {
+			if ipnet, ok := addr.(*net.IPNet); ok && ipnet.IP.Equal(ip) {
+				return i, nil
+			}
+		}
+	}
+	err = ErrNoInterface
+	return
+}
+
+func (r *Raw) captureBufLen() int {
+	if r.CaptureBuffer > 0 {
+		return r.CaptureBuffer
+	}
+	return 65536
+}
+
+// CaptureStats is not supported by the BPF sniffer, only QueueDropped is
+// counted.
+func (conn *RAWConn) CaptureStats() (CaptureStats, error) {
+	return CaptureStats{QueueDropped: conn.queueDropped(), Malformed: int(conn.malformed.Load()), BadChecksum: int(conn.badsum.Load())}, errNoCaptureStats
+}
+
+// SetReadBuffer fails, the size of the BPF buffer is only set when it is
+// opened, see Raw.CaptureBuffer.
+func (conn *RAWConn) SetReadBuffer(bytes int) error {
+	return errNoSocketBuffer
+}
+
+// growCapture fails, BPF counts no drops to grow the buffer for.
+func (conn *RAWConn) growCapture(bytes int) error {
+	return errNoCaptureGrow
+}
+
+// SetWriteBuffer fails, BPF has no send buffer to size.
+func (conn *RAWConn) SetWriteBuffer(bytes int) error {
+	return errNoSocketBuffer
+}
+
+// Sniffer returns the BPF sniffer the connection captures and sends with,
+// the first one of a listener on several interfaces. Reading from it
+// steals packets from the connection and it must not be closed. It is
+// replaced when the connection migrates.
+func (conn *RAWConn) Sniffer() *BPFSniffer {
+	return conn.sniffer
+}
+
+// writeSegments sends each b in a segment of its own, it returns how many
+// of them went out.
+func (conn *RAWConn) writeSegments(bs [][]byte) (n int, err error) {
+	conn.lock.Lock()
+	defer conn.lock.Unlock()
+	for _, b := range bs {
+		if _, err = conn.write(b); err != nil {
+			return
+		}
+		conn.layer.tcp.Seq += uint32(len(b))
+		n++
+	}
+	return
+}
+
+func (conn *RAWConn) writeUdp2raw(typ byte, data []byte) (n int, err error) {
+	b := conn.u2r.sealLocked(typ, data)
+	defer utils.PutBuf(b)
+	conn.lock.Lock()
+	defer conn.lock.Unlock()
+	n, err = conn.write(b)
+	conn.layer.tcp.Seq += uint32(n)
+	return
+}
+
+func (conn *RAWConn) trySendAck(layer *pktLayers) {
+	now := time.Now()
+	if layer.tcp.Ack < layer.lastack+16384 {
+		if now.Sub(layer.lastacktime) < time.Millisecond*time.Duration(10) {
+			return
+		}
+	}
+	layer.lastack = layer.tcp.Ack
+	layer.lastacktime = now
+	conn.sendAckWithLayer(layer)
+}
+
+func (conn *RAWConn) ReadFrom(b []byte) (n int, addr net.Addr, err error) {
+	if n, addr, ok := conn.rqueue.pop(b); ok {
+		return n, addr, nil
+	}
+	if err = conn.resetErr("read"); err != nil {
+		return
+	}
+	if err = conn.pathErr("read"); err != nil {
+		return
+	}
+	for {
+		var layer *pktLayers
+		layer, err = conn.readLayers()
+		if err != nil {
+			return
+		}
+		ip4 := layer.ip4
+		tcp := layer.tcp
+		conn.touch()
+		conn.checkCE(ip4.TOS, conn.RemoteAddr())
+		if tcp.RST {
+			if !conn.rstInWindow(tcp.Seq) {
+				continue
+			}
+			err = conn.connReset()
+			return
+		}
+		plain := tcp.ACK && !tcp.SYN && !tcp.FIN
+		if ok, err := conn.windowProbe(plain, tcp.Seq, len(tcp.Payload), tcp.Window); ok || err != nil {
+			if err != nil {
+				return 0, nil, err
+			}
+			continue
+		}
+		if len(tcp.Payload) == 0 && conn.rtt.echo(timestampsOf(tcp)) {
+			continue
+		}
+		if tcp.SYN && tcp.ACK {
+			err = conn.sendAck()
+			if err != nil {
+				return
+			}
+			continue
+		}
+		if conn.u2r != nil {
+			if !tcp.ACK || len(layer.tcp.Payload) == 0 {
+				continue
+			}
+			conn.ackUpTo(tcp.Seq, len(layer.tcp.Payload))
+			typ, data, ok := conn.u2r.open(layer.tcp.Payload)
+			if !ok || typ != udp2rawData {
+				continue
+			}
+			addr = conn.RemoteAddr()
+			if n, ok = conn.deliver(b, addr, data); !ok {
+				continue
+			}
+			return
+		}
+		if tcp.PSH && tcp.ACK && conn.zrtt.reply(tcp.Payload) {
+			conn.noteZeroRTTReply()
+			conn.hs.set(tcp.Seq, len(tcp.Payload))
+			conn.ackUpTo(tcp.Seq, len(tcp.Payload))
+			continue
+		}
+		if tcp.ACK && !tcp.PSH && len(tcp.Payload) > 0 {
+			// a response to Raw.Chatter
+			conn.ackUpTo(tcp.Seq, len(tcp.Payload))
+			continue
+		}
+		if !tcp.PSH || !tcp.ACK || conn.hs.covers(tcp.Seq) {
+			continue
+		}
+		if conn.udp != nil {
+			addr = conn.RemoteAddr()
+		} else {
+			addr = &net.UDPAddr{
+				IP:   ip4.SrcIP,
+				Port: int(tcp.SrcPort),
+			}
+		}
+		n = len(tcp.Payload)
+		if n > 0 {
+			conn.ackUpTo(tcp.Seq, n)
+			payload := tcp.Payload
+			if conn.r.TLS {
+				if n < 5 {
+					continue
+				}
+				payload = payload[5:]
+			} else if p := conn.r.profile(); p != profileNone {
+				d, ok := p.open(payload)
+				if !ok {
+					continue
+				}
+				payload = d
+			}
+			var ok bool
+			if conn.pad > 0 {
+				if payload, ok = unpadSegment(payload); !ok {
+					continue
+				}
+			}
+			if n, ok = conn.deliver(b, addr, payload); !ok {
+				continue
+			}
+			conn.trySendAck(conn.layer)
+		}
+		return
+	}
+}
+
+func (conn *RAWConn) WriteTo(b []byte, addr net.Addr) (n int, err error) {
+	uaddr := addr.(*net.UDPAddr)
+	conn.layer.ip4.DstIP = uaddr.IP
+	conn.layer.tcp.DstPort = layers.TCPPort(uaddr.Port)
+	return conn.Write(b)
+}
+
+func (conn *RAWConn) Read(b []byte) (n int, err error) {
+	n, _, err = conn.ReadFrom(b)
+	return
+}
+
+func (conn *RAWConn) LocalAddr() net.Addr {
+	return &net.UDPAddr{
+		IP:   conn.layer.ip4.SrcIP,
+		Port: int(conn.layer.tcp.SrcPort),
+	}
+}
+
+func (conn *RAWConn) RemoteAddr() net.Addr {
+	return &net.UDPAddr{
+		IP:   conn.layer.ip4.DstIP,
+		Port: int(conn.layer.tcp.DstPort),
+	}
+}
+
+func (conn *RAWConn) SetReadDeadline(t time.Time) (err error) {
+	if _, pio := conn.capture(); pio != nil {
+		return pio.SetReadDeadline(t)
+	}
+	conn.rtime = t
+	return
+}
+
+func (conn *RAWConn) SetWriteDeadline(t time.Time) (err error) {
+	conn.wdeadline.set(t)
+	return
+}
+
+func (conn *RAWConn) SetDeadline(t time.Time) (err error) {
+	err = conn.SetReadDeadline(t)
+	if err == nil {
+		err = conn.SetWriteDeadline(t)
+	}
+	return
+}
+
+func (r *Raw) dialRAWDummy(address string) (conn *RAWConn, err error) {
+	udp, err := r.dialUDP(address, nil)
+	if err != nil {
+		return
+	}
+	defer udp.Close()
+	iface, err := r.chooseInterface(udp.LocalAddr().(*net.UDPAddr).IP)
+	if err != nil {
+		return
+	}
+	sniffer, err := r.openSniffer(iface.Name)
+	if err != nil {
+		return
+	}
+	conn = &RAWConn{
+		ipid:       r.newIPID(),
+		mtu:        linkMTU(udp.LocalAddr().(*net.UDPAddr).IP),
+		sniffer:    sniffer,
+		buffer:     gopacket.NewSerializeBuffer(),
+		isLoopBack: udp.LocalAddr().(*net.UDPAddr).IP.IsLoopback(),
+		packets:    make(chan gopacket.Packet),
+		opts: gopacket.SerializeOptions{
+			FixLengths:       true,
+			ComputeChecksums: true,
+		},
+		r: r,
+		layer: &pktLayers{
+			ip4: &layers.IPv4{
+				DstIP: udp.LocalAddr().(*net.UDPAddr).IP,
+			},
+			tcp: &layers.TCP{
+				DstPort: layers.TCPPort(udp.LocalAddr().(*net.UDPAddr).Port),
+			},
+		},
+		die:   make(chan struct{}),
+		rcond: &sync.Cond{L: &sync.Mutex{}},
+	}
+	conn.limiter = newRateLimiter(r.Rate, r.PacketRate, r.Pacing)
+	conn.squeue = r.newSendQueue(conn.die, &conn.sendc)
+	conn.sip = udp.RemoteAddr().(*net.UDPAddr).IP
+	conn.sport = udp.RemoteAddr().(*net.UDPAddr).Port
+	defer func() {
+		if err != nil {
+			conn.Close()
+		} else {
+			conn.nocopy = true
+		}
+	}()
+	if conn.isLoopBack {
+		conn.linktype = layers.LinkTypeLoop
+		err = conn.sniffer.SetBpf([]syscall.BpfInsn{
+			{0x20, 0, 0, 0x00000000},
+			{0x15, 1, 0, 0x00000002},
+			{0x15, 0, 10, 0x02000000},
+			{0x30, 0, 0, 0x0000000d},
+			{0x15, 0, 8, 0x00000006},
+			{0x20, 0, 0, 0x00000010},
+			{0x15, 0, 6, binary.BigEndian.Uint32([]byte(conn.sip.To4()))},
+			{0x28, 0, 0, 0x0000000a},
+			{0x45, 4, 0, 0x00001fff},
+			{0xb1, 0, 0, 0x00000004},
+			{0x48, 0, 0, 0x00000004},
+			{0x15, 0, 1, uint32(conn.sport)},
+			{0x6, 0, 0, 0x00040000},
+			{0x6, 0, 0, 0x00000000},
+		})
+		if err != nil {
+			return
+		}
+	} else {
+		conn.linktype = layers.LinkTypeEthernet
+		err = conn.sniffer.SetBpf([]syscall.BpfInsn{
+			{0x28, 0, 0, 0x0000000c},
+			{0x15, 11, 0, 0x000086dd},
+			{0x15, 0, 10, 0x00000800},
+			{0x30, 0, 0, 0x00000017},
+			{0x15, 0, 8, 0x00000006},
+			{0x20, 0, 0, 0x0000001a},
+			{0x15, 0, 6, binary.BigEndian.Uint32([]byte(conn.sip.To4()))},
+			{0x28, 0, 0, 0x00000014},
+			{0x45, 4, 0, 0x00001fff},
+			{0xb1, 0, 0, 0x0000000e},
+			{0x48, 0, 0, 0x0000000e},
+			{0x15, 0, 1, uint32(conn.sport)},
+			{0x6, 0, 0, 0x00040000},
+			{0x6, 0, 0, 0x00000000},
+		})
+		if err != nil {
+			return
+		}
+	}
+	var layersArray []*pktLayers
+	var tcpConn net.Conn
+	var tcpConnErr error
+	var synAckLayer *pktLayers
+	var tcpLocalAddr *net.TCPAddr
+	var tcpRemoteAddr *net.TCPAddr
+	sigch := make(chan bool)
+	go func() {
+		<-sigch
+		tcpConn, tcpConnErr = net.Dial("tcp4", address)
+		if tcpConn != nil && tcpConnErr == nil {
+			tcpLocalAddr = tcpConn.LocalAddr().(*net.TCPAddr)
+			tcpRemoteAddr = tcpConn.RemoteAddr().(*net.TCPAddr)
+		}
+	}()
+	retry := 0
+	sigch <- true
+	for {
+		if tcpConnErr != nil {
+			err = tcpConnErr
+			return
+		}
+		if tcpConn != nil && tcpLocalAddr != nil && tcpRemoteAddr != nil {
+			for _, layer := range layersArray {
+				if int(layer.tcp.SrcPort) == tcpRemoteAddr.Port &&
+					int(layer.tcp.DstPort) == tcpLocalAddr.Port &&
+					layer.ip4.SrcIP.Equal(tcpRemoteAddr.IP) &&
+					layer.ip4.DstIP.Equal(tcpLocalAddr.IP) {
+					synAckLayer = layer
+					break
+				}
+			}
+			if synAckLayer != nil {
+				break
+			}
+			if retry > 5 {
+				var layersArrayString string
+				for _, layer := range layersArray {
+					layersArrayString += fmt.Sprintf("{%d %d %v %v} ", int(layer.tcp.SrcPort), int(layer.tcp.DstPort),
+						layer.ip4.SrcIP.Equal(tcpRemoteAddr.IP), layer.ip4.DstIP.Equal(tcpLocalAddr.IP))
+				}
+				err = fmt.Errorf("%w and con't capture anything\n"+
+					"len(layersArray)=%d\n"+"tcpRemoteAddr.Port=%d\ntcpLocalAddr.Port=%d\n"+
+					"layersArray:\n%s\n", ErrHandshakeTimeout, len(layersArray), tcpRemoteAddr.Port, tcpLocalAddr.Port, layersArrayString)
+				return
+			}
+		}
+		conn.SetReadDeadline(time.Now().Add(time.Millisecond * 500))
+		var layer *pktLayers
+		layer, err = conn.readLayers()
+		if err != nil {
+			if e, ok := err.(net.Error); ok && e.Temporary() {
+				retry++
+				continue
+			}
+			return
+		}
+		if layer == nil || layer.ip4 == nil || layer.tcp == nil ||
+			!(layer.tcp.SYN && layer.tcp.ACK) {
+			continue
+		}
+		layersArray = append(layersArray, layer)
+	}
+	conn.SetReadDeadline(time.Time{})
+	ipv4.NewConn(tcpConn).SetTTL(0)
+	conn.layer = &pktLayers{
+		ip4: &layers.IPv4{
+			SrcIP:    tcpLocalAddr.IP,
+			DstIP:    tcpRemoteAddr.IP,
+			Protocol: layers.IPProtocolTCP,
+			Version:  0x4,
+			Id:       uint16(r.random().Intn(65536)),
+			Flags:    layers.IPv4DontFragment,
+			TTL:      uint8(r.ttl()),
+			TOS:      uint8(r.tos()),
+		},
+		tcp: &layers.TCP{
+			SrcPort: layers.TCPPort(tcpLocalAddr.Port),
+			DstPort: layers.TCPPort(tcpRemoteAddr.Port),
+			Window:  12580,
+			Ack:     synAckLayer.tcp.Seq + 1,
+			Seq:     synAckLayer.tcp.Ack,
+		},
+	}
+	if synAckLayer.eth != nil {
+		conn.layer.eth = &layers.Ethernet{
+			EthernetType: synAckLayer.eth.EthernetType,
+			SrcMAC:       synAckLayer.eth.DstMAC,
+			DstMAC:       synAckLayer.eth.SrcMAC,
+		}
+	}
+	conn.tcp = tcpConn
+	conn.dip = conn.layer.ip4.SrcIP
+	conn.dport = int(conn.layer.tcp.SrcPort)
+	if conn.isLoopBack {
+		err = conn.sniffer.SetBpf([]syscall.BpfInsn{
+			{0x20, 0, 0, 0x00000000},
+			{0x15, 1, 0, 0x00000002},
+			{0x15, 0, 14, 0x02000000},
+			{0x30, 0, 0, 0x0000000d},
+			{0x15, 0, 12, 0x00000006},
+			{0x20, 0, 0, 0x00000010},
+			{0x15, 0, 10, binary.BigEndian.Uint32([]byte(conn.sip.To4()))},
+			{0x28, 0, 0, 0x0000000a},
+			{0x45, 8, 0, 0x00001fff},
+			{0xb1, 0, 0, 0x00000004},
+			{0x48, 0, 0, 0x00000004},
+			{0x15, 0, 5, uint32(conn.sport)},
+			{0x20, 0, 0, 0x00000014},
+			{0x15, 0, 3, binary.BigEndian.Uint32([]byte(conn.dip.To4()))},
+			{0x48, 0, 0, 0x00000006},
+			{0x15, 0, 1, uint32(conn.dport)},
+			{0x6, 0, 0, 0x00040000},
+			{0x6, 0, 0, 0x00000000},
+		})
+		if err != nil {
+			return
+		}
+	} else {
+		err = conn.sniffer.SetBpf([]syscall.BpfInsn{
+			{0x28, 0, 0, 0x0000000c},
+			{0x15, 15, 0, 0x000086dd},
+			{0x15, 0, 14, 0x00000800},
+			{0x30, 0, 0, 0x00000017},
+			{0x15, 0, 12, 0x00000006},
+			{0x20, 0, 0, 0x0000001a},
+			{0x15, 0, 10, binary.BigEndian.Uint32([]byte(conn.sip.To4()))},
+			{0x28, 0, 0, 0x00000014},
+			{0x45, 8, 0, 0x00001fff},
+			{0xb1, 0, 0, 0x0000000e},
+			{0x48, 0, 0, 0x0000000e},
+			{0x15, 0, 5, uint32(conn.sport)},
+			{0x20, 0, 0, 0x0000001e},
+			{0x15, 0, 3, binary.BigEndian.Uint32([]byte(conn.dip.To4()))},
+			{0x48, 0, 0, 0x00000010},
+			{0x15, 0, 1, uint32(conn.dport)},
+			{0x6, 0, 0, 0x00040000},
+			{0x6, 0, 0, 0x00000000},
+		})
+		if err != nil {
+			return
+		}
+	}
+	defer func() { conn.SetDeadline(time.Time{}) }()
+	if r.NoHTTP && !r.TLS && r.profile() == profileNone {
+		return
+	}
+	err = conn.requestPhase(nil, tcpRemoteAddr.Port)
+	return
+}
+
+func (r *Raw) dialRAW(address string, sid []byte, resume *sessionState) (conn *RAWConn, err error) {
+	if r.Filter != "" {
+		return nil, errNoCaptureFilter
+	}
+	if r.Dummy && r.PacketIO == nil {
+		return r.dialRAWDummy(address)
+	}
+	udp, err := r.dialLocalPort(address, resume.localAddr())
+	if err != nil {
+		return
+	}
+	ulocaladdr := udp.LocalAddr().(*net.UDPAddr)
+	uremoteaddr := udp.RemoteAddr().(*net.UDPAddr)
+	conn = &RAWConn{
+		ipid:       r.newIPID(),
+		mtu:        linkMTU(ulocaladdr.IP),
+		pio:        r.PacketIO,
+		buffer:     gopacket.NewSerializeBuffer(),
+		isLoopBack: ulocaladdr.IP.IsLoopback(),
+		packets:    make(chan gopacket.Packet),
+		opts: gopacket.SerializeOptions{
+			FixLengths:       true,
+			ComputeChecksums: true,
+		},
+		r: r,
+		layer: &pktLayers{
+			ip4: &layers.IPv4{
+				SrcIP:    ulocaladdr.IP,
+				DstIP:    uremoteaddr.IP,
+				Protocol: layers.IPProtocolTCP,
+				Version:  0x4,
+				Id:       uint16(r.random().Intn(65536)),
+				Flags:    layers.IPv4DontFragment,
+				TTL:      uint8(r.ttl()),
+				TOS:      uint8(r.tos()),
+			},
+			tcp: &layers.TCP{
+				SrcPort: layers.TCPPort(ulocaladdr.Port),
+				DstPort: layers.TCPPort(uremoteaddr.Port),
+				Window:  synWindow(r.window(dialWindow)),
+				Ack:     0,
+			},
+		},
+		linktype: layers.LinkTypeRaw,
+		die:      make(chan struct{}),
+		rcond:    &sync.Cond{L: &sync.Mutex{}},
+		sip:      uremoteaddr.IP,
+		sport:    uremoteaddr.Port,
+		dip:      ulocaladdr.IP,
+		dport:    ulocaladdr.Port,
+		udp:      udp,
+		sid:      sid,
+	}
+	conn.limiter = newRateLimiter(r.Rate, r.PacketRate, r.Pacing)
+	conn.squeue = r.newSendQueue(conn.die, &conn.sendc)
+	conn.layer.tcp.Seq = r.isn(conn.layer.ip4.SrcIP, int(conn.layer.tcp.SrcPort), conn.layer.ip4.DstIP, int(conn.layer.tcp.DstPort))
+	defer func() {
+		if err != nil {
+			conn.Close()
+		} else {
+			conn.nocopy = true
+		}
+	}()
+	if conn.pio == nil {
+		if err = conn.dialSniffer(); err != nil {
+			return
+		}
+	}
+	if resume != nil {
+		resume.restore(conn)
+		return
+	}
+	defer func() { conn.SetDeadline(time.Time{}) }()
+	err = conn.handshake(sid, conn.sport)
+	return
+}
+
+// dialSniffer opens the sniffer of a dialed connection, learns the Ethernet
+// header its packets go out with, and has the system drop the RSTs it would
+// answer the peer with.
+func (conn *RAWConn) dialSniffer() (err error) {
+	r := conn.r
+	iface, err := r.chooseInterface(conn.dip)
+	if err != nil {
+		return
+	}
+	if conn.sniffer, err = r.openSniffer(iface.Name); err != nil {
+		return
+	}
+	var eth *layers.Ethernet
+	if !conn.isLoopBack {
+		conn.linktype = layers.LinkTypeEthernet
+		if eth, err = conn.resolveEthernet(conn.layer.ip4.SrcIP, conn.layer.ip4.DstIP); err != nil {
+			if eth, err = conn.sniffEthernet(); err != nil {
+				return
+			}
+		}
+	} else {
+		conn.linktype = layers.LinkTypeLoop
+	}
+	conn.layer.eth = eth
+	if r.Checksums == ChecksumAuto {
+		var packet gopacket.Packet
+		if packet, err = conn.sniffOwn(); err != nil {
+			return
+		}
+		conn.offload = partialUDPChecksum(packet)
+	}
+	if conn.isLoopBack {
+		err = conn.sniffer.SetBpf([]syscall.BpfInsn{
+			{0x20, 0, 0, 0x00000000},
+			{0x15, 1, 0, 0x00000002},
+			{0x15, 0, 14, 0x02000000},
+			{0x30, 0, 0, 0x0000000d},
+			{0x15, 0, 12, 0x00000006},
+			{0x20, 0, 0, 0x00000010},
+			{0x15, 0, 10, binary.BigEndian.Uint32([]byte(conn.sip.To4()))},
+			{0x28, 0, 0, 0x0000000a},
+			{0x45, 8, 0, 0x00001fff},
+			{0xb1, 0, 0, 0x00000004},
+			{0x48, 0, 0, 0x00000004},
+			{0x15, 0, 5, uint32(conn.sport)},
+			{0x20, 0, 0, 0x00000014},
+			{0x15, 0, 3, binary.BigEndian.Uint32([]byte(conn.dip.To4()))},
+			{0x48, 0, 0, 0x00000006},
+			{0x15, 0, 1, uint32(conn.dport)},
+			{0x6, 0, 0, 0x00040000},
+			{0x6, 0, 0, 0x00000000},
+		})
+		if err != nil {
+			return
+		}
+	} else {
+		err = conn.sniffer.SetBpf([]syscall.BpfInsn{
+			{0x28, 0, 0, 0x0000000c},
+			{0x15, 15, 0, 0x000086dd},
+			{0x15, 0, 14, 0x00000800},
+			{0x30, 0, 0, 0x00000017},
+			{0x15, 0, 12, 0x00000006},
+			{0x20, 0, 0, 0x0000001a},
+			{0x15, 0, 10, binary.BigEndian.Uint32([]byte(conn.sip.To4()))},
+			{0x28, 0, 0, 0x00000014},
+			{0x45, 8, 0, 0x00001fff},
+			{0xb1, 0, 0, 0x0000000e},
+			{0x48, 0, 0, 0x0000000e},
+			{0x15, 0, 5, uint32(conn.sport)},
+			{0x20, 0, 0, 0x0000001e},
+			{0x15, 0, 3, binary.BigEndian.Uint32([]byte(conn.dip.To4()))},
+			{0x48, 0, 0, 0x00000010},
+			{0x15, 0, 1, uint32(conn.dport)},
+			{0x6, 0, 0, 0x00040000},
+			{0x6, 0, 0, 0x00000000},
+		})
+		if err != nil {
+			return
+		}
+	}
+	if runtime.GOOS == "darwin" {
+		cmd := exec.Command("sh", "-c", fmt.Sprintf("echo block drop out proto tcp from %s port %d to %s port %d flags R/R >> /etc/pf.conf && pfctl -f /etc/pf.conf",
+			conn.dip.String(), conn.dport, conn.sip.String(), conn.sport))
+		_, err = cmd.CombinedOutput()
+		if err == nil {
+			exec.Command("pfctl", "-e").Run()
+			cleaner := &utils.ExitCleaner{}
+			filename := randStringBytesMaskImprSrc(utils.Random{}, 20)
+			clean := exec.Command("sh", "-c", fmt.Sprintf("cat /etc/pf.conf | grep -v "+
+				"'block drop out proto tcp from %s port %d to %s port %d flags R/R' > /tmp/%s.conf && mv /tmp/%s.conf /etc/pf.conf"+
+				" && pfctl -f /etc/pf.conf",
+				conn.dip.String(), conn.dport, conn.sip.String(), conn.sport, filename, filename))
+			cleaner.Push(func() {
+				clean.Run()
+				exec.Command("pfctl", "-e").Run()
+			})
+			conn.cleaner = cleaner
+		}
+	}
+	return nil
+}
+
+// takeOver moves the sniffer and sockets of n, a new connection of the same
+// session, into conn and closes the old ones without telling the peer.
+func (conn *RAWConn) takeOver(n *RAWConn) {
+	conn.zrtt.stop()
+	conn.lock.Lock()
+	conn.zrtt = n.zrtt
+	udp, tcp, sniffer, pio, cleaner := conn.udp, conn.tcp, conn.sniffer, conn.pio, conn.cleaner
+	conn.udp = n.udp
+	conn.tcp = n.tcp
+	conn.slock.Lock()
+	conn.sniffer = n.sniffer
+	conn.pio = n.pio
+	conn.slock.Unlock()
+	conn.cleaner = n.cleaner
+	conn.layer = n.layer
+	conn.linktype = n.linktype
+	conn.isLoopBack = n.isLoopBack
+	conn.loophdr.Store(n.loophdr.Load())
+	conn.hs = n.hs
+	conn.hsinfo = n.hsinfo
+	conn.peer = n.peer
+	conn.pad = n.pad
+	old := conn.mss
+	conn.mss = n.mss
+	conn.sip, conn.dip = n.sip, n.dip
+	conn.sport, conn.dport = n.sport, n.dport
+	conn.lock.Unlock()
+	conn.mssChanged(old)
+	if cleaner != nil {
+		cleaner.Exit()
+	}
+	if udp != nil {
+		udp.Close()
+	}
+	if tcp != nil {
+		tcp.Close()
+	}
+	if sniffer != nil {
+		sniffer.Close()
+	}
+	if pio != nil && pio != n.pio {
+		pio.Close()
+	}
+}
+
+// updateFilter does nothing, Raw.TightFilter only applies to pcap.
+func (listener *RAWListener) updateFilter() error {
+	return nil
+}
+
+type RAWListener struct {
+	*RAWConn
+	newcons     map[string]*connInfo
+	conns       map[string]*connInfo
+	sessions    map[string]*connInfo
+	aliases     map[string]*connInfo
+	proxies     map[string]*connInfo // peers handed over by Raw.Passthrough
+	mutex       myMutex
+	laddr       *net.IPAddr
+	lport       int
+	tcpListener net.Listener
+	refused     atomic.Uint64
+	draining    atomic.Bool
+	work        *listenWork
+	sniffers    []*BPFSniffer
+	ctx         listenerContext // see PeerContext
+}
+
+func (listener *RAWListener) Close() (err error) {
+	conn := listener
+	// if conn != nil {
+	// 	listener.mutex.run(func() {
+	// 		for _, v := range listener.newcons {
+	// 			listener.closeConn(v)
+	// 		}
+	// 		for _, v := range listener.conns {
+	// 			listener.closeConn(v)
+	// 		}
+	// 	})
+	// }
+	if listener.tcpListener != nil {
+		listener.tcpListener.Close()
+	}
+	if len(listener.sniffers) > 1 {
+		for _, sniffer := range listener.sniffers[1:] {
+			sniffer.Close()
+		}
+	}
+	return conn.RAWConn.Close()
+}
+
+func (r *Raw) ListenRAW(address string) (listener *RAWListener, err error) {
+	if err = r.checkShard(); err != nil {
+		return
+	}
+	if r.Filter != "" {
+		return nil, errNoCaptureFilter
+	}
+	address, ports, err := splitListenPorts(address)
+	if err != nil {
+		return
+	}
+	udpaddr, err := net.ResolveUDPAddr("udp4", address)
+	if err != nil {
+		return
+	}
+	if udpaddr.IP == nil {
+		udpaddr.IP = net.IPv4zero
+	}
+	var dip net.IP
+	if !udpaddr.IP.Equal(net.IPv4zero) {
+		dip = udpaddr.IP
+	}
+	listener = &RAWListener{
+		laddr: &net.IPAddr{IP: udpaddr.IP},
+		lport: udpaddr.Port,
+		RAWConn: &RAWConn{
+			ipid:       r.newIPID(),
+			pio:        r.PacketIO,
+			buffer:     gopacket.NewSerializeBuffer(),
+			isLoopBack: udpaddr.IP.IsLoopback(),
+			packets:    make(chan gopacket.Packet),
+			opts: gopacket.SerializeOptions{
+				FixLengths:       true,
+				ComputeChecksums: true,
+			},
+			r:        r,
+			die:      make(chan struct{}),
+			rcond:    &sync.Cond{L: &sync.Mutex{}},
+			linktype: layers.LinkTypeRaw,
+			dip:      dip,
+			dport:    udpaddr.Port,
+			lports:   ports,
+		},
+		newcons:  make(map[string]*connInfo),
+		conns:    make(map[string]*connInfo),
+		sessions: make(map[string]*connInfo),
+		aliases:  make(map[string]*connInfo),
+		proxies:  make(map[string]*connInfo),
+	}
+	listener.limiter = newRateLimiter(r.ListenerRate, r.ListenerPacketRate, r.Pacing)
+	listener.startEviction()
+	listener.startWindowUpdates()
+	r.startDropWatch(listener.die, nil, listener)
+	listener.watchICMP()
+	defer func() {
+		if err != nil && listener != nil {
+			listener.Close()
+			listener = nil
+		}
+	}()
+	if listener.pio == nil {
+		if err = listener.openSniffers(address); err != nil {
+			return
+		}
+	}
+	listener.startWorkers()
+	return
+}
+
+// openSniffers opens the sniffers of the listener on address, one for every
+// interface it listens on, and keeps the system from answering its peers
+// with RSTs.
+func (listener *RAWListener) openSniffers(address string) (err error) {
+	r, dip := listener.r, listener.dip
+	wildcard := dip == nil
+	ifaces, err := r.listenInterfaces(listener.laddr.IP)
+	if err != nil {
+		return
+	}
+	var sniffers []*BPFSniffer
+	for _, iface := range ifaces {
+		sniffer, err := r.openSniffer(iface.Name)
+		if err != nil {
+			for _, s := range sniffers {
+				s.Close()
+			}
+			return err
+		}
+		sniffers = append(sniffers, sniffer)
+	}
+	listener.sniffers, listener.sniffer = sniffers, sniffers[0]
+	// a wildcard listener skips the check of the destination address
+	dipInsn := syscall.BpfInsn{0x5, 0, 0, 0x00000000}
+	if dip != nil {
+		dipInsn = syscall.BpfInsn{0x15, 0, 6, binary.BigEndian.Uint32([]byte(dip.To4()))}
+	}
+	var prog []syscall.BpfInsn
+	if listener.isLoopBack {
+		listener.linktype = layers.LinkTypeLoop
+		prog = []syscall.BpfInsn{
+			{0x20, 0, 0, 0x00000000},
+			{0x15, 1, 0, 0x00000002},
+			{0x15, 0, 10, 0x02000000},
+			{0x30, 0, 0, 0x0000000d},
+			{0x15, 0, 8, 0x00000006},
+			{0x20, 0, 0, 0x00000014},
+			dipInsn,
+			{0x28, 0, 0, 0x0000000a},
+			{0x45, 4, 0, 0x00001fff},
+			{0xb1, 0, 0, 0x00000004},
+			{0x48, 0, 0, 0x00000006},
+			{0x15, 0, 1, uint32(listener.dport)},
+			{0x6, 0, 0, 0x00040000},
+			{0x6, 0, 0, 0x00000000},
+		}
+	} else {
+		listener.linktype = layers.LinkTypeEthernet
+		prog = []syscall.BpfInsn{
+			{0x28, 0, 0, 0x0000000c},
+			{0x15, 11, 0, 0x000086dd},
+			{0x15, 0, 10, 0x00000800},
+			{0x30, 0, 0, 0x00000017},
+			{0x15, 0, 8, 0x00000006},
+			{0x20, 0, 0, 0x0000001e},
+			dipInsn,
+			{0x28, 0, 0, 0x00000014},
+			{0x45, 4, 0, 0x00001fff},
+			{0xb1, 0, 0, 0x0000000e},
+			{0x48, 0, 0, 0x00000010},
+			{0x15, 0, 1, uint32(listener.dport)},
+			{0x6, 0, 0, 0x00040000},
+			{0x6, 0, 0, 0x00000000},
+		}
+	}
+	if prog, err = listener.lports.snifferFilter(prog); err != nil {
+		return
+	}
+	for _, sniffer := range listener.sniffers {
+		if err = sniffer.SetBpf(prog); err != nil {
+			return
+		}
+	}
+	if len(listener.sniffers) > 1 {
+		listener.fanin = make(chan capturedPacket, r.QueueLen)
+		for _, sniffer := range listener.sniffers {
+			go listener.pump(sniffer)
+		}
+	}
+	if !r.Dummy {
+		from := listener.laddr.String()
+		if wildcard {
+			from = "any"
+		}
+		cmd := exec.Command("sh", "-c", fmt.Sprintf("echo block drop out proto tcp from %s port %s to any flags R/R >> /etc/pf.conf && pfctl -f /etc/pf.conf",
+			from, listener.lports.pf()))
+		_, err = cmd.CombinedOutput()
+		if err == nil {
+			exec.Command("pfctl", "-e").Run()
+			cleaner := &utils.ExitCleaner{}
+			filename := randStringBytesMaskImprSrc(utils.Random{}, 20)
+			clean := exec.Command("sh", "-c", fmt.Sprintf("cat /etc/pf.conf | grep -v "+
+				"'block drop out proto tcp from %s port %s to any flags R/R' > /tmp/%s.conf && mv /tmp/%s.conf /etc/pf.conf"+
+				" && pfctl -f /etc/pf.conf",
+				from, listener.lports.pf(), filename, filename))
+			cleaner.Push(func() {
+				clean.Run()
+				exec.Command("pfctl", "-e").Run()
+			})
+			listener.cleaner = cleaner
+		}
+	} else if r.Shard == 0 {
+		// one shard holding the port keeps the system from answering
+		listener.tcpListener, err = net.Listen("tcp", address)
+		if err != nil {
+			return
+		}
+		go func() {
+			buf := make([]byte, 512)
+			defer listener.tcpListener.Close()
+			for {
+				conn, err := listener.tcpListener.Accept()
+				if err != nil {
+					return
+				}
+				go func(c net.Conn) {
+					defer c.Close()
+					ipv4.NewConn(c).SetTTL(0)
+					for {
+						_, err := c.Read(buf)
+						if err != nil {
+							return
+						}
+					}
+				}(conn)
+			}
+		}()
+	}
+	return
+}
+
+// listenPacket is a packet read by a listener.
+type listenPacket struct {
+	layer *pktLayers
+	err   error
+}
+
+func (listener *RAWListener) readPacket() listenPacket {
+	layer, err := listener.readLayers()
+	if layer != nil {
+		listener.checkCE(layer.ip4.TOS, &net.UDPAddr{IP: layer.ip4.SrcIP, Port: int(layer.tcp.SrcPort)})
+	}
+	return listenPacket{layer: layer, err: err}
+}
+
+// detach copies what p shares with the capture buffer.
+func (p *listenPacket) detach() {
+	l := p.layer
+	if l == nil {
+		return
+	}
+	d := *l
+	if l.eth != nil {
+		eth := *l.eth
+		eth.SrcMAC = append(net.HardwareAddr(nil), eth.SrcMAC...)
+		eth.DstMAC = append(net.HardwareAddr(nil), eth.DstMAC...)
+		eth.Contents, eth.Payload = nil, nil
+		d.eth = &eth
+	}
+	ip4 := *l.ip4
+	ip4.SrcIP = append(net.IP(nil), ip4.SrcIP...)
+	ip4.DstIP = append(net.IP(nil), ip4.DstIP...)
+	ip4.Options = nil
+	ip4.Contents, ip4.Payload = nil, nil
+	d.ip4 = &ip4
+	tcp := *l.tcp
+	tcp.Options = make([]layers.TCPOption, len(l.tcp.Options))
+	for i, opt := range l.tcp.Options {
+		opt.OptionData = append([]byte(nil), opt.OptionData...)
+		tcp.Options[i] = opt
+	}
+	tcp.Padding = nil
+	tcp.Contents = nil
+	tcp.Payload = append([]byte(nil), l.tcp.Payload...)
+	d.tcp = &tcp
+	p.layer = &d
+}
+
+// peer returns the address p comes from, nil if it is an error.
+func (p *listenPacket) peer() (net.IP, int) {
+	if p.layer == nil {
+		return nil, 0
+	}
+	return p.layer.ip4.SrcIP, int(p.layer.tcp.SrcPort)
+}
+
+func (listener *RAWListener) ReadFrom(b []byte) (n int, addr net.Addr, err error) {
+	if n, addr, ok := listener.rqueue.pop(b); ok {
+		return n, addr, nil
+	}
+	if listener.work != nil {
+		return listener.readWork(b)
+	}
+	return listener.doRead(b, listener.readPacket)
+}
+
+// segment returns the segment of p, false if it has none.
+func (p *listenPacket) segment() (seg segment, ok bool) {
+	l := p.layer
+	if l == nil {
+		return
+	}
+	seg = segmentOf(l.tcp)
+	seg.src = &net.UDPAddr{IP: l.ip4.SrcIP, Port: int(l.tcp.SrcPort)}
+	seg.dst, seg.ttl = l.ip4.DstIP, l.ip4.TTL
+	return seg, true
+}
+
+// peerLayer returns the layer to answer the sender of seg with, on the
+// sniffer and with the link addresses it came with.
+func (listener *RAWListener) peerLayer(p *listenPacket, seg *segment) *pktLayers {
+	cl := p.layer
+	layer := &pktLayers{
+		sniffer: cl.sniffer,
+		ip4: &layers.IPv4{
+			SrcIP:    cl.ip4.DstIP,
+			DstIP:    cl.ip4.SrcIP,
+			Protocol: layers.IPProtocolTCP,
+			Version:  0x4,
+			Id:       uint16(listener.r.random().Intn(65536)),
+			Flags:    layers.IPv4DontFragment,
+			TTL:      uint8(listener.r.ttl()),
+			TOS:      uint8(listener.r.tos()),
+		},
+		tcp: &layers.TCP{
+			SrcPort: cl.tcp.DstPort,
+			DstPort: cl.tcp.SrcPort,
+			Window:  synWindow(listener.r.window(listenWindow)),
+			Ack:     cl.tcp.Seq + 1,
+		},
+	}
+	if cl.eth != nil {
+		layer.eth = &layers.Ethernet{
+			DstMAC:       cl.eth.SrcMAC,
+			SrcMAC:       cl.eth.DstMAC,
+			EthernetType: cl.eth.EthernetType,
+		}
+	}
+	return layer
+}
+
+func (listener *RAWListener) WriteTo(b []byte, addr net.Addr) (n int, err error) {
+	listener.mutex.RLock()
+	info, ok := listener.connByAddr(addr.String())
+	listener.mutex.RUnlock()
+	if !ok {
+		return 0, &AddrError{Op: "write", Addr: addr, Err: ErrNoConn}
+	}
+	limit := info.payloadLimit()
+	if info.coalescer != nil {
+		limit -= coalesceHeaderLen
+	}
+	if len(b) > limit {
+		return 0, &MessageTooLongError{Size: len(b), Limit: limit}
+	}
+	if info.shaper != nil {
+		return len(b), info.shaper.write(b)
+	}
+	if info.coalescer != nil {
+		return len(b), info.coalescer.write(b)
+	}
+	return listener.wdeadline.write(listener.r, info.squeue, func() net.Addr { return addr }, b, func(b []byte, deadline time.Time) (int, error) {
+		return listener.writeSegment(b, info, 0, deadline)
+	})
+}
+
+// writeSegment sends b to the peer of info in a segment of its own.
+func (listener *RAWListener) writeSegment(b []byte, info *connInfo, tos int, deadline time.Time) (n int, err error) {
+	if listener.r.windowShut(&info.zerownd) {
+		return len(b), nil
+	}
+	if !paceUntil(deadline, len(b), 1, info.limiter, listener.limiter) {
+		return 0, &timeoutErr{op: "write to " + info.addr.String()}
+	}
+	if info.u2r != nil {
+		sealed := info.u2r.sealLocked(udp2rawData, b)
+		defer utils.PutBuf(sealed)
+		if _, err = listener.writeInfoTOS(sealed, info, tos); err != nil {
+			return 0, err
+		}
+		return len(b), nil
+	}
+	n = len(b)
+	mss, tls, prof := info.framing()
+	if info.pad > 0 {
+		b = padSegment(listener.r.random(), b, info.pad, payloadLimit(mss, recordLen(tls, prof), nil, info.pad)-n)
+		defer utils.PutBuf(b)
+	}
+	if tls {
+		buf := utils.GetBuf(len(b) + 5)
+		defer utils.PutBuf(buf)
+		copy(buf, []byte{0x17, 0x3, 0x3})
+		binary.BigEndian.PutUint16(buf[3:5], uint16(len(b)))
+		copy(buf[5:], b)
+		b = buf[:5+len(b)]
+	} else if prof != profileNone {
+		b = prof.seal(listener.r.random(), b, true)
+		defer utils.PutBuf(b)
+	}
+	if _, err = listener.writeInfoTOS(b, info, tos); err != nil {
+		return 0, err
+	}
+	return
+}
+
+// writeSegments sends each b to the peer of info in a segment of its own,
+// it returns how many of them went out.
+func (listener *RAWListener) writeSegments(info *connInfo, bs [][]byte) (n int, err error) {
+	info.lock.Lock()
+	defer info.lock.Unlock()
+	for _, b := range bs {
+		if _, err = listener.writeWithLayer(b, info.layer); err != nil {
+			return
+		}
+		info.layer.tcp.Seq += uint32(len(b))
+		n++
+	}
+	return
+}
+
+func (listener *RAWListener) writeInfo(b []byte, info *connInfo) (n int, err error) {
+	return listener.writeInfoTOS(b, info, 0)
+}
+
+func (listener *RAWListener) writeInfoTOS(b []byte, info *connInfo, tos int) (n int, err error) {
+	info.lock.Lock()
+	defer info.lock.Unlock()
+	info.layer.tos = tos
+	n, err = listener.writeWithLayer(b, info.layer)
+	info.layer.tos = 0
+	info.layer.tcp.Seq += uint32(n)
+	return
+}
+
+func (listener *RAWListener) LocalAddr() net.Addr {
+	return &net.UDPAddr{
+		IP:   listener.laddr.IP,
+		Port: listener.lport,
+	}
+}
+
+// GetLocalInterfaceInfo returns the interfaces the listener captures on.
+func (listener *RAWListener) GetLocalInterfaceInfo() (infos []InterfaceInfo) {
+	if listener.pio != nil {
+		return []InterfaceInfo{interfaceInfo(listener.laddr.IP, "PacketIO")}
+	}
+	ifaces, _ := listener.r.listenInterfaces(listener.laddr.IP)
+	for _, iface := range ifaces {
+		ip := listener.laddr.IP
+		if ip.IsUnspecified() {
+			var err error
+			if ip, err = interfaceIPv4(iface.Name); err != nil {
+				continue
+			}
+		}
+		linkType := layers.LinkTypeEthernet
+		if iface.Flags&net.FlagLoopback != 0 {
+			linkType = layers.LinkTypeLoop
+		}
+		infos = append(infos, interfaceInfo(ip, linkType.String()))
+	}
+	return
+}
+
+// FIXME
+type pktLayers struct {
+	// sniffer is the one the packets of a listener's peer come in on, if
+	// the listener captures on several
+	sniffer     *BPFSniffer
+	eth         *layers.Ethernet
+	ip4         *layers.IPv4
+	tcp         *layers.TCP
+	lastack     uint32
+	lastacktime time.Time
+	tos         int // plus one, zero for the TOS of the connection
+	tmpl        *headerTemplate
+	tag         *segmentTag // of the segments of a dialed connection
+}
+
+func (layer *pktLayers) setDst(addr *net.UDPAddr) {
+	layer.ip4.DstIP = addr.IP
+	layer.tcp.DstPort = layers.TCPPort(addr.Port)
+}
+
+type connInfo struct {
+	state uint32
+	layer *pktLayers
+	rep   []byte
+	hs    hsRange
+	mss   int
+	pad   int
+	tls   bool
+	prof  profile
+	u2r   *udp2rawState
+	lock  sync.Mutex
+	addr  *net.UDPAddr // reported to the application, kept on migration
+	sid   string
+	sts   int64
+	// limiter paces what is sent to this peer
+	limiter   *rateLimiter
+	squeue    *sendQueue
+	coalescer *coalescer
+	shaper    *shaper
+	born      time.Time
+	seen      atomic.Int64 // Unix nanoseconds of the last segment from the peer
+	zerownd   atomic.Bool  // the peer advertised a zero window
+	up        net.Conn     // the web server of a peer of Raw.Passthrough
+	// early holds the data that came before the request, see holdEarly
+	early    [][]byte
+	earlyLen int
+	// mssAssumed is set when the SYN announced no MSS, see Raw.FallbackMSS
+	mssAssumed bool
+	// peer is what the SYN offered
+	peer peerOptions
+	// mtu is that of the interface the SYN came in on
+	mtu int
+	// values are those the application attached, see SetPeerValue
+	values peerValues
+}
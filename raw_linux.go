@@ -1,12 +1,14 @@
 package rawcon
 
 import (
-	"crypto/rand"
 	"encoding/binary"
 	"errors"
 	"fmt"
 	"net"
-	"strings"
+	"os"
+	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
 
 	"github.com/biotooff/rawcon/utils"
@@ -14,32 +16,102 @@ import (
 	"os/exec"
 	"strconv"
 
-	ran "math/rand"
-
 	"golang.org/x/net/bpf"
 	"golang.org/x/net/ipv4"
 )
 
 type RAWConn struct {
 	conn    *net.IPConn
+	pio     PacketIO
+	// slock guards conn, pio, dstport and rdeadline for the reads, which
+	// do not hold lock while takeOver replaces them
+	slock   sync.RWMutex
+	rdeadline time.Time // the one of SetReadDeadline
+	xdp     *xdpSource // see Raw.XDP, read instead of conn
+	queues  *queueSource // see Raw.Queues, read instead of conn
 	ipv4RawConn *ipv4.RawConn
 	ipv4RawId int
+	idlock    sync.Mutex
+	ipid    *ipidGen
 	udp     net.Conn
 	layer   *pktLayers
 	buf     []byte
 	cleaner *utils.ExitCleaner
 	r       *Raw
 	dstport int
-	hseqn   uint32
+	lports  portRanges // those of a listener, see ports.go
+	hs      hsRange // the handshake of the peer
 	mss     int
+	mtu     int          // of the interface the packets go out on
+	pad     int          // agreed on in the handshake
+	public  *net.UDPAddr // reflected by the listener, see PublicAddr
+	hsinfo  HandshakeInfo
+	peer    peerOptions // what the SYN or SYN-ACK of the peer offered
+	wdeadline writeDeadline
+	rbatch  recvBatch
+	nowait  atomic.Bool // see readNoWait
+	lock    sync.Mutex
+	die     chan struct{}
+	u2r     *udp2rawState
+	sid     []byte
+	limiter *rateLimiter
+	squeue  *sendQueue
+	sendc   sendCounters
+	coalescer *coalescer
+	shaper  *shaper
+	rqueue  datagramQueue
+	reset   atomic.Bool
+	zerownd atomic.Bool // the peer advertised a zero window
+	zrtt    *zeroRTT
+	rtt     rttEstimator
+	lastRecv atomic.Int64 // Unix nanoseconds of the last segment read
+	// detached is set once the session is exported
+	detached atomic.Bool
+	oob     [64]byte
+	received atomic.Uint64
+	dropped  atomic.Uint64
+	// pktdst is the destination address of the last packet read
+	pktdst  net.IP
+	// pkttos is the TOS byte of the last packet read
+	pkttos  uint8
+	// pktttl is the TTL of the last packet read, 0 if the kernel did not
+	// tell it
+	pktttl  uint8
+	ce      atomic.Uint64
+	qdropped atomic.Uint64
+	malformed atomic.Uint64
+	reasm   reassembler
+	badsum  atomic.Uint64
+	icmpErr atomic.Pointer[ICMPError]
+	tap     atomic.Pointer[packetTap] // see Tap
+	// dscp is the one set by SetDSCP plus one
+	dscp    atomic.Int32
+	// path, seq and ack stand in for layer once the data segments go out
+	// without lock, see fastpath_linux.go; seq has seqHeld set while
+	// lockLayer holds it
+	path    atomic.Pointer[dataPath]
+	seq     atomic.Uint64
+	ack     atomic.Uint32
+	heldAck uint32 // the ack lockLayer put in layer
 }
 
 func (raw *RAWConn) Close() (err error) {
+	raw.zrtt.stop()
+	if raw.die != nil {
+		select {
+		case <-raw.die:
+			return
+		default:
+			close(raw.die)
+		}
+	}
 	if raw.cleaner != nil {
 		raw.cleaner.Exit()
 	}
-	if raw.udp != nil {
+	if raw.udp != nil && !raw.detached.Load() {
+		raw.lockLayer()
 		raw.sendFin()
+		raw.unlockLayer()
 	}
 	if raw.udp != nil {
 		err = raw.udp.Close()
@@ -50,6 +122,11 @@ func (raw *RAWConn) Close() (err error) {
 			err = err1
 		}
 	}
+	if raw.pio != nil {
+		if err1 := raw.pio.Close(); err1 != nil {
+			err = err1
+		}
+	}
 	return
 }
 
@@ -57,9 +134,25 @@ func (raw *RAWConn) GetMSS() int {
 	return raw.mss
 }
 
+// linkType is the LinkType of the interfaces of raw.
+func (raw *RAWConn) linkType() string {
+	if raw.pio != nil {
+		return "PacketIO"
+	}
+	return "IPv4"
+}
+
+// GetLocalInterfaceInfo returns the interface of the local address of raw,
+// the kernel picks the gateway.
+func (raw *RAWConn) GetLocalInterfaceInfo() InterfaceInfo {
+	info := interfaceInfo(raw.layer.ip4.srcip, raw.linkType())
+	info.MTU = raw.mtu
+	return info
+}
+
 func getMssFromTcpLayer(tcp *tcpLayer) int {
 	for _, v := range tcp.options {
-		if v.kind != tcpOptionKindMSS || len(v.data) == 0 {
+		if v.kind != tcpOptionKindMSS || len(v.data) < 2 {
 			continue
 		}
 		return (int)(binary.BigEndian.Uint16(v.data))
@@ -67,6 +160,57 @@ func getMssFromTcpLayer(tcp *tcpLayer) int {
 	return 0
 }
 
+// peerOptionsOf returns the options the SYN or SYN-ACK tcp offers.
+func peerOptionsOf(tcp *tcpLayer) peerOptions {
+	opts := peerOptions{seen: true, wscale: -1}
+	for _, v := range tcp.options {
+		switch v.kind {
+		case tcpOptionKindWindowScale:
+			if len(v.data) >= 1 {
+				opts.wscale = int(v.data[0])
+			}
+		case tcpOptionKindSACKPermitted:
+			opts.sack = true
+		case tcpOptionKindTimestamps:
+			opts.tsval, _, opts.timestamps = parseTimestamps(v.data)
+		}
+	}
+	return opts
+}
+
+// hsSegmentOf returns what the handshakes look at of tcp, carrying n bytes.
+func hsSegmentOf(tcp *tcpLayer, n int) hsSegment {
+	return hsSegment{
+		syn:  tcp.chkFlag(SYN),
+		ack:  tcp.chkFlag(ACK),
+		psh:  tcp.chkFlag(PSH),
+		fin:  tcp.chkFlag(FIN),
+		seq:  tcp.seqn,
+		ackn: tcp.ackn,
+		n:    n,
+	}
+}
+
+// tcpHeader is the TCP header as the backend decodes it.
+type tcpHeader = tcpLayer
+
+// segmentOf returns the segment of the core of tcp.
+func segmentOf(tcp *tcpLayer) segment {
+	return segment{
+		hsSegment: hsSegmentOf(tcp, len(tcp.payload)),
+		rst:       tcp.chkFlag(RST),
+		window:    tcp.window,
+		dport:     tcp.dstPort,
+		payload:   tcp.payload,
+		tcp:       tcp,
+	}
+}
+
+// srcIP returns the address the segments of layer are sent from.
+func (layer *pktLayers) srcIP() net.IP {
+	return layer.ip4.srcip
+}
+
 func (layer *pktLayers) updateTCP() {
 	tcp := layer.tcp
 	tcp.flags = 0
@@ -76,36 +220,140 @@ func (layer *pktLayers) updateTCP() {
 	tcp.payload = nil
 }
 
+// ack returns the acknowledgment number layer sends, setAck changes it.
+func (layer *pktLayers) ack() uint32 {
+	return layer.tcp.ackn
+}
+
+// seq returns the sequence number of the next segment layer sends.
+func (layer *pktLayers) seq() uint32 {
+	return layer.tcp.seqn
+}
+
+func (layer *pktLayers) setAck(ack uint32) {
+	layer.tcp.ackn = ack
+}
+
+func (layer *pktLayers) setSeq(seq uint32) {
+	layer.tcp.seqn = seq
+}
+
+func (layer *pktLayers) setWindow(window uint16) {
+	layer.tcp.window = window
+}
+
 func (raw *RAWConn) updateTCP() {
 	raw.layer.updateTCP()
 }
 
 func (raw *RAWConn) sendPacketWithLayer(layer *pktLayers) (err error) {
-	data := layer.tcp.marshal(layer.ip4.srcip, layer.ip4.dstip)
-	if raw.udp != nil {
-		_, err = raw.conn.Write(data)
-	} else if raw.ipv4RawConn != nil {
-		raw.ipv4RawId++
+	layer.stampSegmentID()
+	data := raw.r.packetOut(layer.tcp.marshal(layer.ip4.srcip, layer.ip4.dstip))
+	if data == nil {
+		return
+	}
+	return raw.transmit(raw.transport(), layer.ip4.srcip, layer.ip4.dstip, layer.ip4.ttl, layer.ip4.tos, data)
+}
+
+// transport is what the segments of a connection go out on.
+type transport struct {
+	conn   *net.IPConn
+	pio    PacketIO
+	queues *queueSource
+	hdr    *ipv4.RawConn // set if rawcon writes the IP headers
+	dialed bool          // conn is connected to the peer
+}
+
+// transport returns the one of raw, the caller must hold lock.
+func (raw *RAWConn) transport() transport {
+	return transport{conn: raw.conn, pio: raw.pio, queues: raw.queues, hdr: raw.ipv4RawConn, dialed: raw.udp != nil}
+}
+
+// transmit sends the TCP segment data from src to dst on s, with the TTL
+// ttl and the TOS byte tos minus one unless they are zero.
+func (raw *RAWConn) transmit(s transport, src, dst net.IP, ttl, tos int, data []byte) (err error) {
+	setTTL, setTOS := ttl != 0, tos != 0
+	if ttl == 0 {
+		ttl = raw.r.ttl()
+	}
+	if t := raw.tap.Load(); t != nil {
+		t.segment(true, src, dst, uint8(ttl), data)
+	}
+	tos = raw.tosOf(tos)
+	if s.pio != nil {
+		id := raw.nextIPID(dst)
+		pkt := ipv4Packet(src, dst, id, tos, ttl, data)
+		// the kernel fills the checksums of the raw socket in, and nothing
+		// tells whether a PacketIO offloads them
+		if raw.r.offloads(false) {
+			putPartialChecksum(pkt)
+		}
+		err = s.pio.WritePacketData(pkt)
+		utils.PutBuf(pkt)
+	} else if hdr := s.headerConn(); hdr != nil {
+		id := raw.nextIPID(dst)
 		header := &ipv4.Header{
 			Version:4,
 			Len:20,
-			TOS: 0x00,
+			TOS: tos,
 			TotalLen:len(data)+20,
-			ID:raw.ipv4RawId,
+			ID:id,
 			Flags:ipv4.DontFragment,
 			FragOff:0,
-			TTL:64,
+			TTL:ttl,
 			Protocol:6,
 			Checksum:0,
-			Dst:layer.ip4.dstip,
+			Dst:dst,
+		}
+		err = hdr.WriteTo(header,data,nil)
+	} else if s.dialed {
+		conn := s.sendConn()
+		if setTTL {
+			p := ipv4.NewConn(conn)
+			if old, e := p.TTL(); e == nil {
+				p.SetTTL(ttl)
+				defer p.SetTTL(old)
+			}
+		}
+		if setTOS {
+			p := ipv4.NewConn(conn)
+			p.SetTOS(tos)
+			defer p.SetTOS(raw.tos())
 		}
-		err = raw.ipv4RawConn.WriteTo(header,data,nil)
+		_, err = conn.Write(data)
 	} else {
-		_, err = raw.conn.WriteTo(data, &net.IPAddr{IP: layer.ip4.dstip})
+		_, err = s.conn.WriteTo(data, &net.IPAddr{IP: dst})
 	}
 	return
 }
 
+// headerConn returns the socket the next packet goes out on with the IP
+// header written by rawcon, nil if the kernel writes it.
+func (s *transport) headerConn() *ipv4.RawConn {
+	if s.queues != nil {
+		return s.queues.send().hdr
+	}
+	return s.hdr
+}
+
+// sendConn returns the socket the next segment of a dialed connection goes
+// out on, the kernel writing its IP header.
+func (s *transport) sendConn() *net.IPConn {
+	if s.queues != nil {
+		return s.queues.send().conn
+	}
+	return s.conn
+}
+
+// nextIPID returns the IP ID of the next packet to dst, the packets of a
+// listener may be sent by several workers at once.
+func (raw *RAWConn) nextIPID(dst net.IP) int {
+	raw.idlock.Lock()
+	defer raw.idlock.Unlock()
+	raw.ipv4RawId = int(raw.ipid.next(uint16(raw.ipv4RawId), dst))
+	return raw.ipv4RawId
+}
+
 func (raw *RAWConn) sendPacket() (err error) {
 	return raw.sendPacketWithLayer(raw.layer)
 }
@@ -119,25 +367,77 @@ func (raw *RAWConn) sendSynWithLayer(layer *pktLayers) (err error) {
 	tcp.options = append(tcp.options, tcpOption{
 		kind:   tcpOptionKindMSS,
 		length: 4,
-		data:   []byte{0x5, 0xb4},
+		data:   mssOption(raw.r.advertisedMSS(raw.mtu)),
 	})
 	tcp.options = append(tcp.options, tcpOption{
 		kind:   tcpOptionKindWindowScale,
 		length: 3,
-		data:   []byte{0x5},
+		data:   []byte{windowScale},
 	})
 	tcp.options = append(tcp.options, tcpOption{
 		kind:   tcpOptionKindSACKPermitted,
 		length: 2,
 	})
+	tcp.options = append(tcp.options, tcpOption{
+		kind:   tcpOptionKindTimestamps,
+		length: 10,
+		data:   timestampsData(tsNow(), 0),
+	})
+	return raw.sendPacketWithLayer(layer)
+}
+
+// sendTimestampsWithLayer sends a pure ACK carrying the TCP timestamps
+// option.
+func (raw *RAWConn) sendTimestampsWithLayer(layer *pktLayers, val, ecr uint32) (err error) {
+	layer.updateTCP()
+	tcp := layer.tcp
+	tcp.setFlag(ACK)
+	options := tcp.options
+	defer func() { tcp.options = options }()
+	tcp.options = append(tcp.options, tcpOption{
+		kind:   tcpOptionKindTimestamps,
+		length: 10,
+		data:   timestampsData(val, ecr),
+	})
 	return raw.sendPacketWithLayer(layer)
 }
 
+func timestampsOf(tcp *tcpLayer) (val, ecr uint32, ok bool) {
+	for _, v := range tcp.options {
+		if v.kind == tcpOptionKindTimestamps {
+			return parseTimestamps(v.data)
+		}
+	}
+	return
+}
+
+// setSegmentID adds the option carrying tag to the segments of raw.
+func (raw *RAWConn) setSegmentID(tag *segmentTag) {
+	raw.layer.tag = tag
+	tcp := raw.layer.tcp
+	tcp.options = append(tcp.options, tcpOption{
+		kind:   tcpOptionKindSegmentID,
+		length: segmentIDOptionLen,
+		data:   tag.data[:],
+	})
+}
+
+func segmentIDOf(tcp *tcpLayer) []byte {
+	for _, v := range tcp.options {
+		if v.kind == tcpOptionKindSegmentID {
+			return v.data
+		}
+	}
+	return nil
+}
+
 func (raw *RAWConn) sendSyn() (err error) {
 	return raw.sendSynWithLayer(raw.layer)
 }
 
-func (raw *RAWConn) sendSynAckWithLayer(layer *pktLayers) (err error) {
+// sendSynAckWithLayer sends a SYN-ACK announcing mss answering a SYN that
+// offered peer, with those of the options that it offered.
+func (raw *RAWConn) sendSynAckWithLayer(layer *pktLayers, mss int, peer peerOptions) (err error) {
 	layer.updateTCP()
 	tcp := layer.tcp
 	tcp.setFlag(SYN | ACK)
@@ -146,22 +446,33 @@ func (raw *RAWConn) sendSynAckWithLayer(layer *pktLayers) (err error) {
 	tcp.options = append(tcp.options, tcpOption{
 		kind:   tcpOptionKindMSS,
 		length: 4,
-		data:   []byte{0x5, 0xb4},
-	})
-	tcp.options = append(tcp.options, tcpOption{
-		kind:   tcpOptionKindWindowScale,
-		length: 3,
-		data:   []byte{0x5},
-	})
-	tcp.options = append(tcp.options, tcpOption{
-		kind:   tcpOptionKindSACKPermitted,
-		length: 2,
+		data:   mssOption(mss),
 	})
+	if peer.wscale >= 0 {
+		tcp.options = append(tcp.options, tcpOption{
+			kind:   tcpOptionKindWindowScale,
+			length: 3,
+			data:   []byte{windowScale},
+		})
+	}
+	if peer.sack {
+		tcp.options = append(tcp.options, tcpOption{
+			kind:   tcpOptionKindSACKPermitted,
+			length: 2,
+		})
+	}
+	if peer.timestamps {
+		tcp.options = append(tcp.options, tcpOption{
+			kind:   tcpOptionKindTimestamps,
+			length: 10,
+			data:   timestampsData(tsNow(), peer.tsval),
+		})
+	}
 	return raw.sendPacketWithLayer(layer)
 }
 
 func (conn *RAWConn) sendSynAck() (err error) {
-	return conn.sendSynAckWithLayer(conn.layer)
+	return conn.sendSynAckWithLayer(conn.layer, conn.r.advertisedMSS(conn.mtu), conn.peer)
 }
 
 func (conn *RAWConn) sendAckWithLayer(layer *pktLayers) (err error) {
@@ -205,6 +516,28 @@ func (raw *RAWConn) write(b []byte) (n int, err error) {
 	return
 }
 
+// applyTOS has the socket of a dialed connection, which writes the IP
+// headers itself, use the TOS byte of raw.
+func (raw *RAWConn) applyTOS() {
+	raw.lock.Lock()
+	defer raw.lock.Unlock()
+	if raw.queues != nil {
+		raw.queues.each(func(s sendSocket) {
+			ipv4.NewConn(s.conn).SetTOS(raw.tos())
+		})
+	} else if raw.udp != nil && raw.conn != nil {
+		ipv4.NewConn(raw.conn).SetTOS(raw.tos())
+	}
+}
+
+// sendDecoy sends b at the next sequence number with Raw.DecoyTTL.
+func (raw *RAWConn) sendDecoy(b []byte) (err error) {
+	raw.layer.ip4.ttl = raw.r.DecoyTTL
+	defer func() { raw.layer.ip4.ttl = 0 }()
+	_, err = raw.write(b)
+	return
+}
+
 func (raw *RAWConn) writeWithLayer(b []byte, layer *pktLayers) (n int, err error) {
 	n = len(b)
 	layer.updateTCP()
@@ -215,7 +548,114 @@ func (raw *RAWConn) writeWithLayer(b []byte, layer *pktLayers) (n int, err error
 	return
 }
 
+// sendChatterWithLayer sends b at the next sequence number without the PSH
+// flag, see Raw.Chatter, and moves the sequence number past it.
+func (raw *RAWConn) sendChatterWithLayer(b []byte, layer *pktLayers) (err error) {
+	layer.updateTCP()
+	tcp := layer.tcp
+	tcp.setFlag(ACK)
+	tcp.payload = b
+	err = raw.sendPacketWithLayer(layer)
+	tcp.payload = nil
+	tcp.seqn += uint32(len(b))
+	return
+}
+
+// ackUpTo moves the acknowledgment number of the connection past the n
+// bytes received at seq. It takes the lock, the segments sent from other
+// goroutines carry the number too.
+func (raw *RAWConn) ackUpTo(seq uint32, n int) {
+	if raw.ackTo(seq, n) {
+		return
+	}
+	raw.lockLayer()
+	defer raw.unlockLayer()
+	if uint64(seq)+uint64(n) > uint64(raw.layer.tcp.ackn) {
+		raw.layer.tcp.ackn = seq + uint32(n)
+	}
+}
+
+// seqAck returns the next sequence number and the acknowledgment number of
+// the connection.
+func (raw *RAWConn) seqAck() (seq, ack uint32) {
+	if raw.path.Load() != nil {
+		return uint32(raw.seq.Load()), raw.ack.Load()
+	}
+	return raw.layer.tcp.seqn, raw.layer.tcp.ackn
+}
+
+func (raw *RAWConn) setSeqAck(seq, ack uint32) {
+	raw.layer.tcp.seqn, raw.layer.tcp.ackn = seq, ack
+	if raw.path.Load() != nil {
+		raw.seq.Store(uint64(seq))
+		raw.ack.Store(ack)
+	}
+}
+
+// detach keeps Close from sending a FIN once the session is exported.
+func (raw *RAWConn) detach() {
+	raw.detached.Store(true)
+}
+
+// resendAt sends b again at the sequence number seqn, leaving the one of
+// the connection as it is.
+func (raw *RAWConn) resendAt(b []byte, seqn uint32) (err error) {
+	raw.lockLayer()
+	defer raw.unlockLayer()
+	tcp := raw.layer.tcp
+	cur := tcp.seqn
+	tcp.seqn = seqn
+	_, err = raw.write(b)
+	tcp.seqn = cur
+	return
+}
+
 func (raw *RAWConn) Write(b []byte) (n int, err error) {
+	if err = raw.resetErr("write"); err != nil {
+		return
+	}
+	if err = raw.pathErr("write"); err != nil {
+		return
+	}
+	limit := payloadLimit(raw.mss, recordLen(raw.r.TLS, raw.r.profile()), raw.u2r, raw.pad)
+	if raw.coalescer != nil {
+		limit -= coalesceHeaderLen
+	}
+	if len(b) > limit {
+		return 0, &MessageTooLongError{Size: len(b), Limit: limit}
+	}
+	if raw.shaper != nil {
+		return len(b), raw.shaper.write(b)
+	}
+	if raw.coalescer != nil {
+		return len(b), raw.coalescer.write(b)
+	}
+	return raw.wdeadline.write(raw.r, raw.squeue, raw.RemoteAddr, b, func(b []byte, deadline time.Time) (int, error) {
+		return raw.writeSegment(b, 0, deadline)
+	})
+}
+
+// writeSegment sends b in a segment of its own.
+func (raw *RAWConn) writeSegment(b []byte, tos int, deadline time.Time) (n int, err error) {
+	if raw.r.windowShut(&raw.zerownd) {
+		return len(b), nil
+	}
+	if !paceUntil(deadline, len(b), 1, raw.limiter) {
+		return 0, &timeoutErr{op: "write to " + raw.RemoteAddr().String()}
+	}
+	if raw.u2r != nil {
+		sealed := raw.u2r.sealLocked(udp2rawData, b)
+		defer utils.PutBuf(sealed)
+		if _, err = raw.writeTOS(sealed, tos); err != nil {
+			return 0, err
+		}
+		return len(b), nil
+	}
+	n = len(b)
+	if raw.pad > 0 {
+		b = padSegment(raw.r.random(), b, raw.pad, payloadLimit(raw.mss, recordLen(raw.r.TLS, raw.r.profile()), nil, raw.pad)-n)
+		defer utils.PutBuf(b)
+	}
 	if raw.r.TLS {
 		buf := utils.GetBuf(len(b) + 5)
 		defer utils.PutBuf(buf)
@@ -223,40 +663,425 @@ func (raw *RAWConn) Write(b []byte) (n int, err error) {
 		binary.BigEndian.PutUint16(buf[3:5], uint16(len(b)))
 		copy(buf[5:], b)
 		b = buf[:5+len(b)]
+	} else if p := raw.r.profile(); p != profileNone {
+		b = p.seal(raw.r.random(), b, false)
+		defer utils.PutBuf(b)
+	}
+	if _, err = raw.writeTOS(b, tos); err != nil {
+		return 0, err
 	}
+	return
+}
+
+// writeTOS sends b in the next segment, with the TOS byte tos minus one
+// unless tos is zero.
+func (raw *RAWConn) writeTOS(b []byte, tos int) (n int, err error) {
+	for p := raw.fastPath(tos); p != nil; p = raw.fastPath(tos) {
+		sent, err := raw.writeData(p, b, tos)
+		if !sent {
+			break
+		}
+		if err == nil || raw.path.Load() == p {
+			return len(b), err
+		}
+		// the connection migrated while b went out, send it again on the
+		// new path
+	}
+	raw.lockLayer()
+	defer raw.unlockLayer()
+	raw.layer.ip4.tos = tos
 	n, err = raw.write(b)
+	raw.layer.ip4.tos = 0
 	raw.layer.tcp.seqn += uint32(n)
 	return
 }
 
+// writeSegments sends each b in a segment of its own, with a single
+// sendmmsg on a dialed connection. It returns how many of them went out.
+func (raw *RAWConn) writeSegments(bs [][]byte) (n int, err error) {
+	raw.lockLayer()
+	defer raw.unlockLayer()
+	if raw.udp == nil {
+		for _, b := range bs {
+			if _, err = raw.write(b); err != nil {
+				return
+			}
+			raw.layer.tcp.seqn += uint32(len(b))
+			n++
+		}
+		return
+	}
+	return raw.writeBatchWithLayer(raw.layer, bs, false)
+}
+
+// writeBatchWithLayer sends each b as the next segment of layer, with a
+// single sendmmsg unless a PacketIO or Raw.PacketOut takes the packets, and
+// moves the sequence number past those that went out. With to the
+// messages carry their destination, for the socket of a listener which is
+// not connected.
+func (raw *RAWConn) writeBatchWithLayer(layer *pktLayers, bs [][]byte, to bool) (n int, err error) {
+	tcp := layer.tcp
+	if raw.pio != nil || raw.r.PacketOut != nil {
+		for _, b := range bs {
+			if _, err = raw.writeWithLayer(b, layer); err != nil {
+				return
+			}
+			tcp.seqn += uint32(len(b))
+			n++
+		}
+		return
+	}
+	src, dst := layer.ip4.srcip, layer.ip4.dstip
+	ttl := layer.ip4.ttl
+	if ttl == 0 {
+		ttl = raw.r.ttl()
+	}
+	t := raw.tap.Load()
+	seqn := tcp.seqn
+	ms := make([]ipv4.Message, len(bs))
+	for i, b := range bs {
+		layer.updateTCP()
+		tcp.setFlag(PSH | ACK)
+		tcp.payload = b
+		layer.stampSegmentID()
+		data := tcp.marshal(src, dst)
+		if t != nil {
+			t.segment(true, src, dst, uint8(ttl), data)
+		}
+		if raw.ipv4RawConn != nil {
+			// the socket takes the IP header from us, see
+			// sendPacketWithLayer
+			data = ipv4Packet(src, dst, raw.nextIPID(dst), raw.tosOf(layer.ip4.tos), ttl, data)
+		} else {
+			data = utils.CopyBuffer(data)
+		}
+		ms[i].Buffers = [][]byte{data}
+		if to {
+			ms[i].Addr = &net.IPAddr{IP: dst}
+		}
+		tcp.seqn += uint32(len(b))
+	}
+	tcp.payload = nil
+	n, err = ipv4.NewPacketConn(raw.conn).WriteBatch(ms, 0)
+	for _, m := range ms {
+		utils.PutBuf(m.Buffers[0])
+	}
+	if n < 0 {
+		n = 0
+	}
+	tcp.seqn = seqn
+	for _, b := range bs[:n] {
+		tcp.seqn += uint32(len(b))
+	}
+	return
+}
+
+func (raw *RAWConn) writeUdp2raw(typ byte, data []byte) (n int, err error) {
+	b := raw.u2r.sealLocked(typ, data)
+	defer utils.PutBuf(b)
+	return raw.writeTOS(b, 0)
+}
+
+// setupCapture sizes the receive buffer of conn, has the kernel report the
+// packets it drops when the buffer is full and the destination address of
+// every packet, and binds conn to Raw.Interface.
+func (r *Raw) setupCapture(conn *net.IPConn) (err error) {
+	if r.CaptureBuffer > 0 {
+		conn.SetReadBuffer(r.CaptureBuffer)
+	}
+	c, err := conn.SyscallConn()
+	if err != nil {
+		return
+	}
+	c.Control(func(fd uintptr) {
+		syscall.SetsockoptInt(int(fd), syscall.SOL_SOCKET, syscall.SO_RXQ_OVFL, 1)
+		syscall.SetsockoptInt(int(fd), syscall.IPPROTO_IP, syscall.IP_PKTINFO, 1)
+		syscall.SetsockoptInt(int(fd), syscall.IPPROTO_IP, syscall.IP_RECVTOS, 1)
+		syscall.SetsockoptInt(int(fd), syscall.IPPROTO_IP, syscall.IP_RECVTTL, 1)
+		if r.Interface != "" {
+			err = syscall.SetsockoptString(int(fd), syscall.SOL_SOCKET, syscall.SO_BINDTODEVICE, r.Interface)
+		}
+	})
+	return
+}
+
+// readControl counts a packet read and goes through the control messages
+// that came with it.
+func (raw *RAWConn) readControl(oob []byte) {
+	raw.received.Add(1)
+	raw.pktdst = nil
+	raw.pkttos = 0
+	raw.pktttl = 0
+	msgs, err := syscall.ParseSocketControlMessage(oob)
+	if err != nil {
+		return
+	}
+	for _, m := range msgs {
+		switch {
+		case m.Header.Level == syscall.SOL_SOCKET && m.Header.Type == syscall.SO_RXQ_OVFL && len(m.Data) >= 4:
+			// the kernel reports the total number of drops of the socket
+			raw.dropped.Store(uint64(binary.NativeEndian.Uint32(m.Data)))
+		case m.Header.Level == syscall.IPPROTO_IP && m.Header.Type == syscall.IP_PKTINFO && len(m.Data) >= syscall.SizeofInet4Pktinfo:
+			// struct in_pktinfo ends with the destination of the header
+			raw.pktdst = net.IP(append([]byte(nil), m.Data[8:12]...))
+		case m.Header.Level == syscall.IPPROTO_IP && m.Header.Type == syscall.IP_TOS && len(m.Data) >= 1:
+			raw.pkttos = m.Data[0]
+		case m.Header.Level == syscall.IPPROTO_IP && m.Header.Type == syscall.IP_TTL && len(m.Data) >= 4:
+			raw.pktttl = uint8(binary.NativeEndian.Uint32(m.Data))
+		}
+	}
+}
+
+// CaptureStats returns the packet counters of the socket the connection
+// reads from. IfDropped is not reported on Linux.
+func (raw *RAWConn) CaptureStats() (stats CaptureStats, err error) {
+	stats.Received = int(raw.received.Load())
+	stats.Dropped = int(raw.dropped.Load())
+	if raw.queues != nil {
+		stats.Dropped += int(raw.queues.drops())
+	}
+	stats.QueueDropped = raw.queueDropped()
+	stats.Malformed = int(raw.malformed.Load())
+	stats.BadChecksum = int(raw.badsum.Load())
+	return
+}
+
+// SetReadBuffer sets the size in bytes of the receive buffer of the socket
+// raw reads from, see Raw.CaptureBuffer.
+func (raw *RAWConn) SetReadBuffer(bytes int) error {
+	if raw.pio != nil {
+		return errNoSocketBuffer
+	}
+	if raw.queues != nil {
+		return raw.queues.setReadBuffer(bytes)
+	}
+	return raw.conn.SetReadBuffer(bytes)
+}
+
+// growCapture resizes the receive buffer of the socket, the kernel caps it
+// at net.core.rmem_max.
+func (raw *RAWConn) growCapture(bytes int) error {
+	return raw.SetReadBuffer(bytes)
+}
+
+// SetWriteBuffer sets the size in bytes of the send buffer of the socket.
+func (raw *RAWConn) SetWriteBuffer(bytes int) (err error) {
+	if raw.pio != nil {
+		return errNoSocketBuffer
+	}
+	if raw.queues != nil {
+		raw.queues.each(func(s sendSocket) {
+			if e := s.conn.SetWriteBuffer(bytes); e != nil {
+				err = e
+			}
+		})
+		return
+	}
+	return raw.conn.SetWriteBuffer(bytes)
+}
+
+// SyscallConn returns the raw socket the connection reads from and writes
+// to, like SyscallConn of net.IPConn, for socket options rawcon does not
+// cover. Reading from it steals packets from the connection. It is
+// replaced when the connection migrates.
+func (raw *RAWConn) SyscallConn() (syscall.RawConn, error) {
+	if raw.pio != nil {
+		return nil, errNoSocket
+	}
+	return raw.conn.SyscallConn()
+}
+
+// readPacketIO reads the next TCP segment from Raw.PacketIO, or from the
+// sockets of Raw.XDP, into raw.buf.
+func (raw *RAWConn) readPacketIO(pio PacketIO) (n int, ipaddr *net.IPAddr, err error) {
+	for {
+		if raw.nowait.Load() && !packetsPending(pio) {
+			return 0, nil, errWouldBlock
+		}
+		var pkt []byte
+		if pkt, err = pio.ReadPacketData(); err != nil {
+			return
+		}
+		var ok bool
+		n, ipaddr, ok = raw.parsePacketIO(pkt)
+		releasePacket(pio, pkt)
+		if ok {
+			return
+		}
+	}
+}
+
+// parsePacketIO copies the TCP segment of pkt, a packet of readPacketIO,
+// into raw.buf. Nothing it keeps refers to pkt, which is released after.
+func (raw *RAWConn) parsePacketIO(pkt []byte) (n int, ipaddr *net.IPAddr, ok bool) {
+	// unlike the socket, the pipe passes fragments on
+	data := raw.reasm.add(pkt)
+	if data == nil {
+		return
+	}
+	seg, _, _, ok := parseIPv4(data)
+	if !ok || len(seg) > len(raw.buf) {
+		return 0, nil, false
+	}
+	raw.received.Add(1)
+	if raw.r.VerifyChecksums && !ipv4HeaderValid(data[:len(data)-len(seg)]) {
+		raw.badsum.Add(1)
+		return 0, nil, false
+	}
+	ips := net.IP(append([]byte(nil), data[12:20]...))
+	raw.pktdst = ips[4:]
+	raw.pkttos = data[1]
+	raw.pktttl = data[8]
+	return copy(raw.buf, seg), &net.IPAddr{IP: ips[:4:4]}, true
+}
+
+// recvBatchLen is the most packets a read takes from the socket at once.
+const recvBatchLen = 16
+
+// recvBatch holds the packets a recvmmsg read from the socket, which
+// ReadTCPLayer goes through one by one before it reads again.
+type recvBatch struct {
+	ms   []ipv4.Message
+	next int
+	n    int
+}
+
+// readSocket returns the next packet of conn and its control messages,
+// reading the socket once the packets of the last read are used up. The
+// packet stays in place until the next read of the socket, like those of
+// raw.buf.
+func (raw *RAWConn) readSocket(conn *net.IPConn) (buf, oob []byte, n, oobn int, ipaddr *net.IPAddr, err error) {
+	b := &raw.rbatch
+	if b.next == b.n {
+		if raw.nowait.Load() {
+			err = errWouldBlock
+			return
+		}
+		if b.ms == nil {
+			b.ms = make([]ipv4.Message, recvBatchLen)
+			for i := range b.ms {
+				b.ms[i].Buffers = [][]byte{make([]byte, len(raw.buf))}
+				b.ms[i].OOB = make([]byte, len(raw.oob))
+			}
+		}
+		b.next, b.n = 0, 0
+		if b.n, err = ipv4.NewPacketConn(conn).ReadBatch(b.ms, 0); err != nil {
+			b.n = 0
+			return
+		}
+	}
+	m := &b.ms[b.next]
+	b.next++
+	ipaddr, _ = m.Addr.(*net.IPAddr)
+	if ipaddr == nil {
+		ipaddr = &net.IPAddr{}
+	}
+	return m.Buffers[0], m.OOB, m.N, m.NN, ipaddr, nil
+}
+
+// spinRead is ReadMsgIP trying the socket again and again for Raw.BusyPoll
+// before it waits for the socket to be readable.
+func (raw *RAWConn) spinRead(conn *net.IPConn) (n, oobn int, ipaddr *net.IPAddr, err error) {
+	rc, err := conn.SyscallConn()
+	if err != nil {
+		return
+	}
+	var from syscall.Sockaddr
+	var rerr error
+	err = rc.Read(func(fd uintptr) bool {
+		end := time.Now().Add(raw.r.BusyPoll)
+		for {
+			n, oobn, _, from, rerr = syscall.Recvmsg(int(fd), raw.buf, raw.oob[:], syscall.MSG_DONTWAIT)
+			if rerr != syscall.EAGAIN {
+				return true
+			}
+			if time.Now().After(end) {
+				return false
+			}
+		}
+	})
+	if err == nil && rerr != nil {
+		err = &net.OpError{Op: "read", Net: "ip4:tcp", Source: conn.LocalAddr(), Err: os.NewSyscallError("recvmsg", rerr)}
+	}
+	if err != nil {
+		return 0, 0, nil, err
+	}
+	ipaddr = &net.IPAddr{}
+	if sa, ok := from.(*syscall.SockaddrInet4); ok {
+		ipaddr.IP = net.IPv4(sa.Addr[0], sa.Addr[1], sa.Addr[2], sa.Addr[3])
+	}
+	return
+}
+
 func (raw *RAWConn) ReadTCPLayer() (tcp *tcpLayer, addr *net.UDPAddr, err error) {
 	for {
-		var n int
+		var n, oobn int
 		var ipaddr *net.IPAddr
-		n, ipaddr, err = raw.conn.ReadFromIP(raw.buf)
+		buf, oob := raw.buf, raw.oob[:]
+		conn, pio, dstport := raw.sockets()
+		if pio != nil {
+			n, ipaddr, err = raw.readPacketIO(pio)
+		} else if raw.xdp != nil {
+			n, ipaddr, err = raw.readPacketIO(raw.xdp)
+		} else if raw.r.BusyPoll > 0 {
+			if raw.nowait.Load() {
+				return nil, nil, errWouldBlock
+			}
+			n, oobn, ipaddr, err = raw.spinRead(conn)
+		} else {
+			buf, oob, n, oobn, ipaddr, err = raw.readSocket(conn)
+		}
 		if err != nil {
+			if c, p, _ := raw.sockets(); c != conn || p != pio {
+				// the connection has migrated, go on with the new socket
+				continue
+			}
 			e, ok := err.(net.Error)
 			if ok && e.Temporary() {
 				raw.SetReadDeadline(time.Time{})
 			}
 			return
 		}
-		tcp, err = decodeTCPlayer(raw.buf[:n])
-		if err != nil {
-			return
+		seg := buf[:n]
+		dstip := raw.pktdst
+		if pio == nil && raw.xdp == nil {
+			raw.readControl(oob[:oobn])
+			// unlike ReadFromIP, ReadMsgIP leaves the IPv4 header in
+			var ok bool
+			if seg, _, dstip, ok = parseIPv4(seg); !ok {
+				continue
+			}
+		}
+		if seg = raw.r.packetIn(seg); seg == nil {
+			continue
 		}
-		if tcp.dstPort != raw.dstport {
+		if t := raw.tap.Load(); t != nil {
+			t.segment(false, ipaddr.IP, dstip, raw.pktttl, seg)
+		}
+		// the IPv4 header was checked by the kernel or by readPacketIO
+		if raw.r.VerifyChecksums && !tcpChecksumValid(ipaddr.IP, dstip, raw.r.Checksums != ChecksumFull, seg) {
+			raw.badsum.Add(1)
+			continue
+		}
+		if tcp, err = decodeTCPlayer(seg); err != nil {
+			// whoever sent it, it is not worth failing the read for
+			raw.malformed.Add(1)
+			err = nil
+			continue
+		}
+		if tcp.dstPort != dstport && !raw.lports.has(tcp.dstPort) {
 			continue
 		}
 		addr = &net.UDPAddr{
 			IP:   ipaddr.IP,
 			Port: tcp.srcPort,
 		}
+		raw.checkCE(raw.pkttos, addr)
 		if tcp.chkFlag(RST) {
 			if raw.r.IgnRST {
 				continue
 			} else {
-				err = fmt.Errorf("connect reset by peer %s", addr.String())
+				err = &AddrError{Op: "read", Addr: addr, Err: ErrConnReset}
 				fmt.Println(err)
 			}
 		}
@@ -264,6 +1089,17 @@ func (raw *RAWConn) ReadTCPLayer() (tcp *tcpLayer, addr *net.UDPAddr, err error)
 	}
 }
 
+// readSegment reads the next segment of a dialed connection.
+func (raw *RAWConn) readSegment() (seg segment, err error) {
+	tcp, addr, err := raw.ReadTCPLayer()
+	if err != nil {
+		return
+	}
+	seg = segmentOf(tcp)
+	seg.src = addr
+	return
+}
+
 func (raw *RAWConn) Read(b []byte) (n int, err error) {
 	n, _, err = raw.ReadFrom(b)
 	return
@@ -283,30 +1119,106 @@ func (conn *RAWConn) RemoteAddr() net.Addr {
 	}
 }
 
+// sockets returns the socket and the PacketIO the connection reads from,
+// the queues of Raw.Queues standing for the latter, and the local port of
+// the segments it takes.
+func (raw *RAWConn) sockets() (*net.IPConn, PacketIO, int) {
+	raw.slock.RLock()
+	defer raw.slock.RUnlock()
+	if raw.pio == nil && raw.queues != nil {
+		return raw.conn, raw.queues, raw.dstport
+	}
+	return raw.conn, raw.pio, raw.dstport
+}
+
 func (raw *RAWConn) SetDeadline(t time.Time) error {
+	raw.wdeadline.set(t)
+	raw.slock.Lock()
+	defer raw.slock.Unlock()
+	raw.rdeadline = t
+	if raw.pio != nil {
+		return raw.pio.SetReadDeadline(t)
+	}
+	if raw.xdp != nil {
+		raw.xdp.SetReadDeadline(t)
+	}
+	if raw.queues != nil {
+		raw.queues.SetReadDeadline(t)
+	}
 	return raw.conn.SetDeadline(t)
 }
 
 func (raw *RAWConn) SetReadDeadline(t time.Time) error {
+	raw.slock.Lock()
+	defer raw.slock.Unlock()
+	raw.rdeadline = t
+	if raw.pio != nil {
+		return raw.pio.SetReadDeadline(t)
+	}
+	if raw.xdp != nil {
+		return raw.xdp.SetReadDeadline(t)
+	}
+	if raw.queues != nil {
+		return raw.queues.SetReadDeadline(t)
+	}
 	return raw.conn.SetReadDeadline(t)
 }
 
 func (raw *RAWConn) SetWriteDeadline(t time.Time) error {
+	raw.wdeadline.set(t)
+	raw.slock.RLock()
+	defer raw.slock.RUnlock()
+	if raw.pio != nil {
+		return nil
+	}
+	if raw.queues != nil {
+		raw.queues.each(func(s sendSocket) {
+			s.conn.SetWriteDeadline(t)
+		})
+		return nil
+	}
 	return raw.conn.SetWriteDeadline(t)
 }
 
 func (raw *RAWConn) ReadFrom(b []byte) (n int, addr net.Addr, err error) {
+	if n, addr, ok := raw.rqueue.pop(b); ok {
+		return n, addr, nil
+	}
+	if err = raw.resetErr("read"); err != nil {
+		return
+	}
+	if err = raw.pathErr("read"); err != nil {
+		return
+	}
 	for {
 		var tcp *tcpLayer
 		tcp, addr, err = raw.ReadTCPLayer()
 		if err != nil {
+			if tcp != nil && tcp.chkFlag(RST) {
+				if !raw.rstInWindow(tcp.seqn) {
+					err = nil
+					continue
+				}
+				err = raw.connReset()
+			}
 			return
 		}
 		if tcp == nil || addr == nil {
 			continue
 		}
+		raw.touch()
+		plain := tcp.flags&(SYN|FIN|RST|ACK) == ACK
+		if ok, err := raw.windowProbe(plain, tcp.seqn, len(tcp.payload), tcp.window); ok || err != nil {
+			if err != nil {
+				return 0, addr, err
+			}
+			continue
+		}
+		if len(tcp.payload) == 0 && raw.rtt.echo(timestampsOf(tcp)) {
+			continue
+		}
 		if tcp.chkFlag(FIN) {
-			err = fmt.Errorf("receive fin from %s", addr.String())
+			err = &AddrError{Op: "read", Addr: addr, Err: ErrPeerClosed}
 			return
 		}
 		if tcp.chkFlag(SYN | ACK) {
@@ -317,21 +1229,58 @@ func (raw *RAWConn) ReadFrom(b []byte) (n int, addr net.Addr, err error) {
 				continue
 			}
 		}
-		if !tcp.chkFlag(PSH|ACK) || tcp.seqn == raw.hseqn {
+		if raw.u2r != nil {
+			if !tcp.chkFlag(ACK) || len(tcp.payload) == 0 {
+				continue
+			}
+			raw.ackUpTo(tcp.seqn, len(tcp.payload))
+			typ, data, ok := raw.u2r.open(tcp.payload)
+			if !ok || typ != udp2rawData {
+				continue
+			}
+			if n, ok = raw.deliver(b, addr, data); !ok {
+				continue
+			}
+			return n, addr, err
+		}
+		if tcp.chkFlag(PSH|ACK) && raw.zrtt.reply(tcp.payload) {
+			raw.noteZeroRTTReply()
+			raw.hs.set(tcp.seqn, len(tcp.payload))
+			raw.ackUpTo(tcp.seqn, len(tcp.payload))
+			continue
+		}
+		if tcp.chkFlag(ACK) && !tcp.chkFlag(PSH) && len(tcp.payload) > 0 {
+			// a response to Raw.Chatter
+			raw.ackUpTo(tcp.seqn, len(tcp.payload))
+			continue
+		}
+		if !tcp.chkFlag(PSH|ACK) || raw.hs.covers(tcp.seqn) {
 			continue
 		}
 		n = len(tcp.payload)
 		if n > 0 {
-			if uint64(tcp.seqn)+uint64(n) > uint64(raw.layer.tcp.ackn) {
-				raw.layer.tcp.ackn = tcp.seqn + uint32(n)
-			}
+			raw.ackUpTo(tcp.seqn, n)
+			payload := tcp.payload
 			if raw.r.TLS {
 				if n < 5 {
 					continue
 				}
-				n = copy(b, tcp.payload[5:])
-			} else {
-				n = copy(b, tcp.payload)
+				payload = payload[5:]
+			} else if p := raw.r.profile(); p != profileNone {
+				d, ok := p.open(payload)
+				if !ok {
+					continue
+				}
+				payload = d
+			}
+			var ok bool
+			if raw.pad > 0 {
+				if payload, ok = unpadSegment(payload); !ok {
+					continue
+				}
+			}
+			if n, ok = raw.deliver(b, addr, payload); !ok {
+				continue
 			}
 			raw.trySendAck(raw.layer)
 		}
@@ -355,41 +1304,25 @@ func (raw *RAWConn) trySendAck(layer *pktLayers) {
 	// raw.sendAckWithLayer(layer)
 }
 
-func (r *Raw) DialRAW(address string) (raw *RAWConn, err error) {
-	udp, err := net.Dial("udp4", address)
+func (r *Raw) dialRAW(address string, sid []byte, resume *sessionState) (raw *RAWConn, err error) {
+	if r.Filter != "" {
+		return nil, errNoCaptureFilter
+	}
+	udp, err := r.dialLocalPort(address, resume.localAddr())
 	if err != nil {
 		return
 	}
 	ulocaladdr := udp.LocalAddr().(*net.UDPAddr)
 	uremoteaddr := udp.RemoteAddr().(*net.UDPAddr)
-	conn, err := net.DialIP("ip4:tcp", &net.IPAddr{IP: ulocaladdr.IP}, &net.IPAddr{IP: uremoteaddr.IP})
-	fatalErr(err)
-	if r.DSCP != 0 {
-		ipv4.NewConn(conn).SetTOS(r.DSCP)
-	}
-	// https://www.kernel.org/doc/Documentation/networking/filter.txt
-	ipv4.NewPacketConn(conn).SetBPF([]bpf.RawInstruction{
-		{0x30, 0, 0, 0x00000009},
-		{0x15, 0, 12, 0x00000006},
-		{0x28, 0, 0, 0x00000006},
-		{0x45, 4, 0, 0x00001fff},
-		{0xb1, 0, 0, 0x00000000},
-		{0x48, 0, 0, 0x00000000},
-		{0x15, 4, 0, uint32(ulocaladdr.Port)},
-		{0x48, 0, 0, 0x00000000},
-		{0x15, 0, 5, uint32(uremoteaddr.Port)},
-		{0x48, 0, 0, 0x00000002},
-		{0x15, 2, 3, uint32(ulocaladdr.Port)},
-		{0x48, 0, 0, 0x00000002},
-		{0x15, 0, 1, uint32(uremoteaddr.Port)},
-		{0x6, 0, 0, 0x00040000},
-		{0x6, 0, 0, 0x00000000},
-	})
+	mtu := linkMTU(ulocaladdr.IP)
 	raw = &RAWConn{
-		conn:    conn,
-		udp:     udp,
-		buf:     make([]byte, 2048),
-		dstport: ulocaladdr.Port,
+		ipid:      r.newIPID(),
+		ipv4RawId: r.random().Intn(65536),
+		pio:       r.PacketIO,
+		udp:       udp,
+		buf:       make([]byte, recvBufLen(mtu)),
+		mtu:       mtu,
+		dstport:   ulocaladdr.Port,
 		layer: &pktLayers{
 			ip4: &iPv4Layer{
 				srcip: ulocaladdr.IP,
@@ -398,198 +1331,229 @@ func (r *Raw) DialRAW(address string) (raw *RAWConn, err error) {
 			tcp: &tcpLayer{
 				srcPort: ulocaladdr.Port,
 				dstPort: uremoteaddr.Port,
-				window:  12580,
+				window:  synWindow(r.window(dialWindow)),
 				ackn:    0,
 				data:    make([]byte, 2048),
 			},
 		},
-		r: r,
+		r:   r,
+		die: make(chan struct{}),
+		sid: sid,
+	}
+	raw.limiter = newRateLimiter(r.Rate, r.PacketRate, r.Pacing)
+	raw.squeue = r.newSendQueue(raw.die, &raw.sendc)
+	raw.layer.tcp.seqn = r.isn(raw.layer.ip4.srcip, raw.layer.tcp.srcPort, raw.layer.ip4.dstip, raw.layer.tcp.dstPort)
+	defer func() {
+		if err != nil {
+			raw.Close()
+		} else {
+			raw.SetReadDeadline(time.Time{})
+		}
+	}()
+	if raw.pio == nil {
+		if err = raw.dialSocket(ulocaladdr, uremoteaddr); err != nil {
+			return
+		}
+	}
+	if resume != nil {
+		resume.restore(raw)
+		return
+	}
+	err = raw.handshake(sid, uremoteaddr.Port)
+	return
+}
+
+// dialFilter returns the socket filter of a dialed connection from local to
+// remote, which takes the TCP segments between their ports.
+func dialFilter(local, remote *net.UDPAddr) []bpf.RawInstruction {
+	// https://www.kernel.org/doc/Documentation/networking/filter.txt
+	return []bpf.RawInstruction{
+		{0x30, 0, 0, 0x00000009},
+		{0x15, 0, 12, 0x00000006},
+		{0x28, 0, 0, 0x00000006},
+		{0x45, 4, 0, 0x00001fff},
+		{0xb1, 0, 0, 0x00000000},
+		{0x48, 0, 0, 0x00000000},
+		{0x15, 4, 0, uint32(local.Port)},
+		{0x48, 0, 0, 0x00000000},
+		{0x15, 0, 5, uint32(remote.Port)},
+		{0x48, 0, 0, 0x00000002},
+		{0x15, 2, 3, uint32(local.Port)},
+		{0x48, 0, 0, 0x00000002},
+		{0x15, 0, 1, uint32(remote.Port)},
+		{0x6, 0, 0, 0x00040000},
+		{0x6, 0, 0, 0x00000000},
 	}
-	binary.Read(rand.Reader, binary.LittleEndian, &(raw.layer.tcp.seqn))
-	defer func() {
-		if err != nil {
-			raw.Close()
-		} else {
-			raw.SetReadDeadline(time.Time{})
+}
+
+// dialSocket opens the raw socket of a dialed connection and has iptables
+// drop the RSTs the system answers the packets of the peer with.
+func (raw *RAWConn) dialSocket(local, remote *net.UDPAddr) (err error) {
+	r := raw.r
+	conn, err := net.DialIP("ip4:tcp", &net.IPAddr{IP: local.IP}, &net.IPAddr{IP: remote.IP})
+	fatalErr(err)
+	raw.conn = conn
+	if err = r.setupCapture(conn); err != nil {
+		return
+	}
+	if tos := r.tos(); tos != 0 {
+		ipv4.NewConn(conn).SetTOS(tos)
+	}
+	if r.TTL > 0 {
+		ipv4.NewConn(conn).SetTTL(r.TTL)
+	}
+	if r.IPID != IPIDIncrement {
+		// the kernel would pick the IDs otherwise
+		if raw.ipv4RawConn, err = ipv4.NewRawConn(conn); err != nil {
+			return
 		}
-	}()
+	}
+	filter := dialFilter(local, remote)
+	ipv4.NewPacketConn(conn).SetBPF(filter)
 	cmd := exec.Command("iptables", "-I", "OUTPUT", "-p", "tcp", "-s", conn.LocalAddr().String(),
-		"--sport", strconv.Itoa(ulocaladdr.Port), "-d", conn.RemoteAddr().String(),
-		"--dport", strconv.Itoa(uremoteaddr.Port), "--tcp-flags", "RST", "RST", "-j", "DROP")
-	_, err = cmd.CombinedOutput()
-	if err != nil {
+		"--sport", strconv.Itoa(local.Port), "-d", conn.RemoteAddr().String(),
+		"--dport", strconv.Itoa(remote.Port), "--tcp-flags", "RST", "RST", "-j", "DROP")
+	if _, err = cmd.CombinedOutput(); err != nil {
 		return
 	}
 	cleaner := &utils.ExitCleaner{}
 	clean := exec.Command("iptables", "-D", "OUTPUT", "-p", "tcp", "-s", conn.LocalAddr().String(),
-		"--sport", strconv.Itoa(ulocaladdr.Port), "-d", conn.RemoteAddr().String(),
-		"--dport", strconv.Itoa(uremoteaddr.Port), "--tcp-flags", "RST", "RST", "-j", "DROP")
+		"--sport", strconv.Itoa(local.Port), "-d", conn.RemoteAddr().String(),
+		"--dport", strconv.Itoa(remote.Port), "--tcp-flags", "RST", "RST", "-j", "DROP")
 	cleaner.Push(func() {
 		clean.Run()
 	})
-	defer func() {
-		if err != nil {
-			cleaner.Exit()
-			return
-		}
-		raw.cleaner = cleaner
-	}()
-	retry := 0
-	layer := raw.layer
-	var ackn uint32
-	var seqn uint32
-	for {
-		if retry > 5 {
-			err = errors.New("retry too many times")
-			return
-		}
-		retry++
-		err = raw.sendSyn()
-		if err != nil {
-			return
-		}
-		err = raw.SetReadDeadline(time.Now().Add(time.Millisecond * time.Duration(500+int(ran.Int63()%500))))
-		if err != nil {
-			return
-		}
-		var tcp *tcpLayer
-		tcp, _, err = raw.ReadTCPLayer()
-		if err != nil {
-			e, ok := err.(net.Error)
-			if !ok || !e.Temporary() {
-				return
-			} else {
-				continue
-			}
-		}
-		if tcp.chkFlag(SYN | ACK) {
-			layer.tcp.ackn = tcp.seqn + 1
-			layer.tcp.seqn++
-			ackn = layer.tcp.ackn
-			seqn = layer.tcp.seqn
-			raw.mss = getMssFromTcpLayer(tcp)
-			err = raw.sendAck()
-			if err != nil {
-				return
-			}
-			break
+	raw.cleaner = cleaner
+	if r.Queues > 1 {
+		// without them the raw socket reads the segments
+		if q, err := raw.openQueues(conn, filter, local, remote); err == nil {
+			ipv4.NewPacketConn(conn).SetBPF([]bpf.RawInstruction{{0x6, 0, 0, 0}})
+			raw.queues = q
+			cleaner.Push(func() { q.Close() })
 		}
 	}
-	if r.NoHTTP && !r.TLS {
-		return
+	return
+}
+
+// diagnoseCapture checks that a raw socket on local opens.
+func (r *Raw) diagnoseCapture(local net.IP) (string, error) {
+	conn, err := net.ListenIP("ip4:tcp", &net.IPAddr{IP: local})
+	if err != nil {
+		return "", err
 	}
-	var req []byte
-	var host string
-	if len(r.Hosts) == 0 {
-		if len(r.Host) != 0 {
-			r.Hosts = strings.Split(r.Host, ",")
-		}
+	conn.Close()
+	return "raw socket on " + local.String(), nil
+}
+
+// diagnoseInject checks that a raw socket on local may write the IPv4
+// headers itself, as the IP ID policies need.
+func (r *Raw) diagnoseInject(local, remote net.IP) (string, error) {
+	conn, err := net.ListenIP("ip4:tcp", &net.IPAddr{IP: local})
+	if err != nil {
+		return "", err
 	}
-	if len(r.Hosts) > 0 {
-		host = r.Hosts[ran.Int()%len(r.Hosts)]
+	defer conn.Close()
+	if _, err = ipv4.NewRawConn(conn); err != nil {
+		return "", err
 	}
-	if r.TLS {
-		b := utils.GetBuf(2048)
-		defer utils.PutBuf(b)
-		utils.PutRandomBytes(b[1816:])
-		tlsLen := utils.GenTLSClientHello(b, host, b[2016:], b[1816:1816+ran.Intn(200)])
-		req = b[:tlsLen]
+	return "raw socket with IP_HDRINCL", nil
+}
+
+// diagnoseGateway names the interface towards remote, the kernel finds the
+// gateway.
+func (r *Raw) diagnoseGateway(local, remote net.IP) (string, error) {
+	info := interfaceInfo(local, "IPv4")
+	if info.Name == "" {
+		return "", fmt.Errorf("%w: none holds %v", ErrNoInterface, local)
+	}
+	return "routed by the kernel through " + info.Name, nil
+}
+
+// takeOver moves the sockets of n, a new connection of the same session,
+// into raw and closes the old ones without telling the peer.
+func (raw *RAWConn) takeOver(n *RAWConn) {
+	raw.zrtt.stop()
+	raw.lockLayer()
+	raw.zrtt = n.zrtt
+	conn, pio, udp, cleaner := raw.conn, raw.pio, raw.udp, raw.cleaner
+	raw.slock.Lock()
+	// the dial of n left its sockets without deadlines, those of the
+	// application go on holding
+	if n.pio != nil {
+		n.pio.SetReadDeadline(raw.rdeadline)
 	} else {
-		if uremoteaddr.Port != 80 {
-			host += strconv.Itoa(uremoteaddr.Port)
+		n.conn.SetReadDeadline(raw.rdeadline)
+		n.conn.SetWriteDeadline(raw.wdeadline.get())
+		if n.queues != nil {
+			n.queues.SetReadDeadline(raw.rdeadline)
 		}
-		headers := "Host: " + host + "\r\n"
-		headers += "X-Online-Host: " + host + "\r\n"
-		req = utils.StringToSlice(buildHTTPRequest(headers))
 	}
-	retry = 0
-	needretry := true
-	var starttime time.Time
-	for {
-		if retry > 25 {
-			err = errors.New("retry too many times")
-			return
-		}
-		if needretry {
-			needretry = false
-			starttime = time.Now()
-			retry++
-			_, err = raw.write(req)
-			if err != nil {
-				return
-			}
-		}
-		err = raw.SetReadDeadline(time.Now().Add(time.Millisecond * time.Duration(200+int(ran.Int63()%100))))
-		if err != nil {
-			return
-		}
-		var tcp *tcpLayer
-		tcp, _, err = raw.ReadTCPLayer()
-		if err != nil {
-			e, ok := err.(net.Error)
-			if !ok || !e.Temporary() {
-				return
-			} else {
-				needretry = true
-				continue
-			}
-		}
-		if tcp.chkFlag(SYN | ACK) {
-			layer.tcp.ackn = ackn
-			layer.tcp.seqn = seqn
-			err = raw.sendAck()
-			if err != nil {
-				return
-			}
-			continue
-		}
-		n := len(tcp.payload)
-		if tcp.chkFlag(PSH|ACK) && n >= tcpLen {
-			if r.TLS {
-				ok, _, _ := utils.ParseTLSServerHelloMsg(tcp.payload)
-				if ok {
-					layer.tcp.seqn += uint32(len(req))
-					layer.tcp.ackn = tcp.seqn + uint32(n)
-					raw.hseqn = tcp.seqn
-					break
-				}
-			} else {
-				head := string(tcp.payload[:4])
-				tail := string(tcp.payload[n-4:])
-				if head == "HTTP" && tail == "\r\n\r\n" {
-					layer.tcp.seqn += uint32(len(req))
-					layer.tcp.ackn = tcp.seqn + uint32(n)
-					raw.hseqn = tcp.seqn
-					break
-				}
-			}
-		}
-		if time.Now().After(starttime.Add(time.Millisecond * 200)) {
-			needretry = true
-		}
+	raw.conn = n.conn
+	raw.pio = n.pio
+	raw.queues = n.queues
+	raw.dstport = n.dstport
+	raw.slock.Unlock()
+	raw.udp = n.udp
+	raw.cleaner = n.cleaner
+	raw.layer = n.layer
+	raw.ipv4RawConn = n.ipv4RawConn
+	raw.hs = n.hs
+	raw.hsinfo = n.hsinfo
+	raw.peer = n.peer
+	raw.pad = n.pad
+	old := raw.mss
+	raw.mss = n.mss
+	// the numbers of n go on in the layer of raw, published by unlockLayer
+	n.layer.tcp.seqn, n.layer.tcp.ackn = n.seqAck()
+	raw.publishLayer()
+	raw.unlockLayer()
+	raw.mssChanged(old)
+	if raw.dscp.Load() != 0 {
+		raw.applyTOS()
+	}
+	if cleaner != nil {
+		cleaner.Exit()
+	}
+	udp.Close()
+	if conn != nil {
+		conn.Close()
+	}
+	if pio != nil && pio != n.pio {
+		pio.Close()
 	}
-	return
 }
 
-type RAWListener struct {
-	RAWConn
-	newcons map[string]*connInfo
-	conns   map[string]*connInfo
-	mutex   myMutex
-	laddr   *net.UDPAddr
+// updateFilter does nothing, Raw.TightFilter only applies to pcap.
+func (listener *RAWListener) updateFilter() error {
+	return nil
 }
 
-func (listener *RAWListener) GetMSSByAddr(addr net.Addr) int {
-	listener.mutex.Lock()
-	defer listener.mutex.Unlock()
-	conn, ok := listener.conns[addr.String()]
-	if ok && conn.mss > 0 {
-		return conn.mss
-	}
-	return 0
+type RAWListener struct {
+	RAWConn
+	newcons  map[string]*connInfo
+	conns    map[string]*connInfo
+	sessions map[string]*connInfo
+	aliases  map[string]*connInfo
+	proxies  map[string]*connInfo // peers handed over by Raw.Passthrough
+	mutex    myMutex
+	laddr    *net.UDPAddr
+	refused  atomic.Uint64
+	draining atomic.Bool
+	work     *listenWork
+	ctx      listenerContext // see PeerContext
 }
 
 func (r *Raw) ListenRAW(address string) (listener *RAWListener, err error) {
+	if r.Filter != "" {
+		return nil, errNoCaptureFilter
+	}
+	if err = r.checkShard(); err != nil {
+		return
+	}
+	address, ports, err := splitListenPorts(address)
+	if err != nil {
+		return
+	}
 	udpaddr, err := net.ResolveUDPAddr("udp4", address)
 	if err != nil {
 		return
@@ -597,12 +1561,81 @@ func (r *Raw) ListenRAW(address string) (listener *RAWListener, err error) {
 	if udpaddr.IP == nil {
 		udpaddr.IP = ipv4AddrAny
 	}
+	mtu := linkMTU(udpaddr.IP)
+	listener = &RAWListener{
+		RAWConn: RAWConn{
+			lports:  ports,
+			ipid:    r.newIPID(),
+			pio:     r.PacketIO,
+			ipv4RawId: r.random().Intn(65536),
+			udp:     nil,
+			buf:     make([]byte, recvBufLen(mtu)),
+			mtu:     mtu,
+			layer:   nil,
+			dstport: udpaddr.Port,
+			r:       r,
+			die:     make(chan struct{}),
+		},
+		newcons:  make(map[string]*connInfo),
+		conns:    make(map[string]*connInfo),
+		sessions: make(map[string]*connInfo),
+		aliases:  make(map[string]*connInfo),
+		proxies:  make(map[string]*connInfo),
+		laddr:    udpaddr,
+	}
+	listener.limiter = newRateLimiter(r.ListenerRate, r.ListenerPacketRate, r.Pacing)
+	listener.startEviction()
+	listener.startWindowUpdates()
+	r.startDropWatch(listener.die, nil, listener)
+	listener.watchICMP()
+	if listener.pio == nil {
+		if err = listener.listenSocket(); err != nil {
+			listener.Close()
+			return nil, err
+		}
+	}
+	listener.startWorkers()
+	return
+}
+
+// socketFilter returns the filter of the socket of a listener on the ports
+// p, that of listenSocket with its port check widened.
+func (p portRanges) socketFilter() ([]bpf.RawInstruction, error) {
+	prog, err := p.bpf([]bpfInsn{
+		{op: 0x30, k: 0x00000009},
+		{op: 0x15, jf: 6, k: 0x00000006},
+		{op: 0x28, k: 0x00000006},
+		{op: 0x45, jt: 4, k: 0x00001fff},
+		{op: 0xb1, k: 0x00000000},
+		{op: 0x48, k: 0x00000002},
+		{op: 0x15, jf: 1},
+		{op: 0x6, k: 0x00040000},
+		{op: 0x6, k: 0x00000000},
+	})
+	if err != nil {
+		return nil, err
+	}
+	filter := make([]bpf.RawInstruction, len(prog))
+	for i, in := range prog {
+		filter[i] = bpf.RawInstruction{Op: in.op, Jt: in.jt, Jf: in.jf, K: in.k}
+	}
+	return filter, nil
+}
+
+// listenSocket opens the raw socket of the listener and has iptables drop
+// the RSTs the system answers its peers with.
+func (listener *RAWListener) listenSocket() (err error) {
+	r, udpaddr := listener.r, listener.laddr
 	conn, err := net.ListenIP("ip4:tcp", &net.IPAddr{IP: udpaddr.IP})
 	if err != nil {
 		return
 	}
+	listener.conn = conn
+	if err = r.setupCapture(conn); err != nil {
+		return
+	}
 	isAddrAny := udpaddr.IP.Equal(ipv4AddrAny)
-	ipv4.NewPacketConn(conn).SetBPF([]bpf.RawInstruction{
+	filter := []bpf.RawInstruction{
 		{0x30, 0, 0, 0x00000009},
 		{0x15, 0, 8, 0x00000006},
 		{0x28, 0, 0, 0x00000006},
@@ -614,54 +1647,59 @@ func (r *Raw) ListenRAW(address string) (listener *RAWListener, err error) {
 		{0x15, 0, 1, uint32(udpaddr.Port)},
 		{0x6, 0, 0, 0x00040000},
 		{0x6, 0, 0, 0x00000000},
-	})
-	ipv4RawConn,_ := ipv4.NewRawConn(conn)
-	listener = &RAWListener{
-		RAWConn: RAWConn{
-			conn:    conn,
-			ipv4RawConn: ipv4RawConn,
-			ipv4RawId: ran.Int(),
-			udp:     nil,
-			buf:     make([]byte, 2048),
-			layer:   nil,
-			dstport: udpaddr.Port,
-			r:       r,
-		},
-		newcons: make(map[string]*connInfo),
-		conns:   make(map[string]*connInfo),
-		laddr:   udpaddr,
-	}
-	var cmd *exec.Cmd
-	if isAddrAny {
-		cmd = exec.Command("iptables", "-I", "OUTPUT", "-p", "tcp",
-			"--sport", strconv.Itoa(udpaddr.Port), "--tcp-flags", "RST", "RST", "-j", "DROP")
-	} else {
-		cmd = exec.Command("iptables", "-I", "OUTPUT", "-p", "tcp", "-s", conn.LocalAddr().String(),
-			"--sport", strconv.Itoa(udpaddr.Port), "--tcp-flags", "RST", "RST", "-j", "DROP")
 	}
-	_, err = cmd.CombinedOutput()
-	if err != nil {
-		return
+	if !listener.lports.single() {
+		if filter, err = listener.lports.socketFilter(); err != nil {
+			return
+		}
+	}
+	var unsteer func()
+	if r.FlowSteering {
+		// without the rules the filter alone has to do
+		if unsteer, err = listener.steerFlows(); err == nil {
+			filter = steerFilter(r.SteerQueue, filter)
+		}
+		err = nil
 	}
+	ipv4.NewPacketConn(conn).SetBPF(filter)
+	listener.ipv4RawConn, _ = ipv4.NewRawConn(conn)
 	cleaner := &utils.ExitCleaner{}
-	var clean1 *exec.Cmd
-	if isAddrAny {
-		clean1 = exec.Command("iptables", "-D", "OUTPUT", "-p", "tcp",
-			"--sport", strconv.Itoa(udpaddr.Port), "--tcp-flags", "RST", "RST", "-j", "DROP")
-	} else {
-		clean1 = exec.Command("iptables", "-D", "OUTPUT", "-p", "tcp", "-s", conn.LocalAddr().String(),
-			"--sport", strconv.Itoa(udpaddr.Port), "--tcp-flags", "RST", "RST", "-j", "DROP")
+	if unsteer != nil {
+		cleaner.Push(unsteer)
 	}
-	cleaner.Push(func() {
-		clean1.Run()
-	})
-	defer func() {
-		if err != nil {
+	for _, sport := range listener.lports.iptables() {
+		var cmd *exec.Cmd
+		if isAddrAny {
+			cmd = exec.Command("iptables", "-I", "OUTPUT", "-p", "tcp",
+				"--sport", sport, "--tcp-flags", "RST", "RST", "-j", "DROP")
+		} else {
+			cmd = exec.Command("iptables", "-I", "OUTPUT", "-p", "tcp", "-s", conn.LocalAddr().String(),
+				"--sport", sport, "--tcp-flags", "RST", "RST", "-j", "DROP")
+		}
+		if _, err = cmd.CombinedOutput(); err != nil {
 			cleaner.Exit()
+			return
+		}
+		var clean1 *exec.Cmd
+		if isAddrAny {
+			clean1 = exec.Command("iptables", "-D", "OUTPUT", "-p", "tcp",
+				"--sport", sport, "--tcp-flags", "RST", "RST", "-j", "DROP")
 		} else {
-			listener.cleaner = cleaner
+			clean1 = exec.Command("iptables", "-D", "OUTPUT", "-p", "tcp", "-s", conn.LocalAddr().String(),
+				"--sport", sport, "--tcp-flags", "RST", "RST", "-j", "DROP")
 		}
-	}()
+		cleaner.Push(func() {
+			clean1.Run()
+		})
+	}
+	if r.XDP {
+		// without XDP the raw socket reads the segments
+		if x, err := listener.openXDP(); err == nil {
+			listener.xdp = x
+			cleaner.Push(func() { x.Close() })
+		}
+	}
+	listener.cleaner = cleaner
 	// var cmd2 *exec.Cmd
 	// if isAddrAny {
 	// 	cmd2 = exec.Command("iptables", "-I", "INPUT", "-p", "tcp",
@@ -689,199 +1727,77 @@ func (r *Raw) ListenRAW(address string) (listener *RAWListener, err error) {
 	return
 }
 
-func (listener *RAWListener) doRead(b []byte) (n int, addr *net.UDPAddr, err error) {
-	for {
-		var tcp *tcpLayer
-		var addrstr string
-		tcp, addr, err = listener.ReadTCPLayer()
-		if addr != nil {
-			addrstr = addr.String()
-		}
-		if tcp != nil && (tcp.chkFlag(RST) || tcp.chkFlag(FIN)) {
-			listener.mutex.run(func() {
-				delete(listener.newcons, addrstr)
-				delete(listener.conns, addrstr)
-			})
-			continue
-		}
-		if err != nil {
-			return
-		}
-		var info *connInfo
-		var ok bool
-		listener.mutex.run(func() {
-			info, ok = listener.conns[addrstr]
-		})
-		n = len(tcp.payload)
-		if ok && n != 0 {
-			t := info.layer.tcp
-			if uint64(tcp.seqn)+uint64(n) > uint64(t.ackn) {
-				t.ackn = tcp.seqn + uint32(n)
-			}
-			if info.state == httprepsent {
-				if tcp.chkFlag(PSH | ACK) {
-					if tcp.seqn == info.hseqn && n > 20 {
-						ok := false
-						if listener.r.TLS || listener.r.Mixed {
-							ok, _, _ = utils.ParseTLSClientHelloMsg(tcp.payload)
-						}
-						head := string(tcp.payload[:4])
-						tail := string(tcp.payload[n-4:])
-						if !ok && head == "POST" && tail == "\r\n\r\n" {
-							ok = true
-						}
-						if ok {
-							t.ackn = tcp.seqn + uint32(n)
-							_, err = listener.writeWithLayer(info.rep, info.layer)
-							if err != nil {
-								return
-							}
-						}
-					} else {
-						t.seqn += uint32(len(info.rep))
-						info.rep = nil
-						info.state = established
-					}
-				} else {
-					// listener.layer = info.layer
-					// listener.sendFin()
-				}
-			}
-			if info.state == established {
-				if info.tls {
-					if len(tcp.payload) < 5 {
-						continue
-					}
-					n = copy(b, tcp.payload[5:])
-				} else {
-					n = copy(b, tcp.payload)
-				}
-				listener.trySendAck(info.layer)
-				return
-			}
-			continue
-		}
-		if ok && n == 0 {
-			if tcp.chkFlag(PSH | ACK) {
-				return
-			}
-			continue
-		}
-		listener.mutex.run(func() {
-			info, ok = listener.newcons[addrstr]
-		})
-		if ok {
-			t := info.layer.tcp
-			if info.state == synreceived {
-				if tcp.chkFlag(ACK) && !tcp.chkFlag(PSH|FIN|SYN) {
-					t.seqn++
-					if listener.r.NoHTTP {
-						info.state = established
-						listener.mutex.run(func() {
-							listener.conns[addrstr] = info
-							delete(listener.newcons, addrstr)
-						})
-					} else {
-						info.state = waithttpreq
-					}
-				} else if tcp.chkFlag(SYN) && !tcp.chkFlag(ACK|PSH) {
-					err = listener.sendSynAckWithLayer(info.layer)
-					if err != nil {
-						return
-					}
-				}
-			} else if info.state == waithttpreq {
-				if tcp.chkFlag(ACK|PSH) && n > 20 {
-					if listener.r.TLS || listener.r.Mixed {
-						ok, _, msg := utils.ParseTLSClientHelloMsg(tcp.payload)
-						if ok {
-							t.ackn = tcp.seqn + uint32(n)
-							if info.rep == nil {
-								rep := make([]byte, 2048)
-								l := ran.Intn(128)
-								n = utils.GenTLSServerHello(rep, l, msg.SessionId)
-								info.rep = rep[:l+n]
-							}
-							info.hseqn = tcp.seqn
-							info.tls = true
-						}
-					}
-					head := string(tcp.payload[:4])
-					tail := string(tcp.payload[n-4:])
-					if info.rep == nil && head == "POST" && tail == "\r\n\r\n" {
-						t.ackn = tcp.seqn + uint32(n)
-						rep := buildHTTPResponse("")
-						info.rep = []byte(rep)
-						info.hseqn = tcp.seqn
-					}
-					if info.rep != nil {
-						_, err = listener.writeWithLayer(info.rep, info.layer)
-						if err != nil {
-							return
-						}
-						info.state = httprepsent
-						listener.mutex.run(func() {
-							listener.conns[addrstr] = info
-							delete(listener.newcons, addrstr)
-						})
-					} else if listener.r.Mixed {
-						t.ackn = tcp.seqn + uint32(n)
-						info.state = established
-						listener.mutex.run(func() {
-							listener.conns[addrstr] = info
-							delete(listener.newcons, addrstr)
-						})
-						n = copy(b, tcp.payload)
-						listener.trySendAck(info.layer)
-						return
-					}
-				} else if tcp.chkFlag(SYN) && !tcp.chkFlag(ACK|PSH) {
-					err = listener.sendSynAckWithLayer(info.layer)
-					if err != nil {
-						return
-					}
-				}
-			}
-			continue
-		}
-		srcip := listener.laddr.IP
-		if srcip.Equal(ipv4AddrAny) {
-			srcip, _ = getSrcIPForDstIP(addr.IP)
-			if srcip == nil {
-				continue
-			}
+// listenPacket is a segment read by a listener along with the local address
+// it was sent to and its TTL.
+type listenPacket struct {
+	tcp  *tcpLayer
+	addr *net.UDPAddr
+	dst  net.IP
+	ttl  uint8
+	err  error
+}
+
+func (listener *RAWListener) readPacket() listenPacket {
+	tcp, addr, err := listener.ReadTCPLayer()
+	return listenPacket{tcp: tcp, addr: addr, dst: listener.pktdst, ttl: listener.pktttl, err: err}
+}
+
+// detach copies what p shares with the read buffer of the listener.
+func (p *listenPacket) detach() {
+	if tcp := p.tcp; tcp != nil {
+		tcp.payload = append([]byte(nil), tcp.payload...)
+		tcp.padding = append([]byte(nil), tcp.padding...)
+		for i := range tcp.options {
+			tcp.options[i].data = append([]byte(nil), tcp.options[i].data...)
 		}
-		layer := &pktLayers{
-			ip4: &iPv4Layer{
-				srcip: srcip,
-				dstip: addr.IP,
-			},
-			tcp: &tcpLayer{
-				srcPort: listener.laddr.Port,
-				dstPort: addr.Port,
-				window:  12580,
-				ackn:    tcp.seqn + 1,
-				data:    make([]byte, 2048),
-			},
+	}
+	p.dst = append(net.IP(nil), p.dst...)
+}
+
+// peer returns the address p comes from, nil if it is an error.
+func (p *listenPacket) peer() (net.IP, int) {
+	if p.addr == nil {
+		return nil, 0
+	}
+	return p.addr.IP, p.addr.Port
+}
+
+// segment returns the segment of p, false if it has none.
+func (p *listenPacket) segment() (seg segment, ok bool) {
+	if p.tcp == nil {
+		return
+	}
+	seg = segmentOf(p.tcp)
+	seg.src, seg.dst, seg.ttl = p.addr, p.dst, p.ttl
+	return seg, true
+}
+
+// peerLayer returns the layer to answer the sender of seg with, from the
+// address it was sent to on a wildcard listener.
+func (listener *RAWListener) peerLayer(p *listenPacket, seg *segment) *pktLayers {
+	srcip := listener.laddr.IP
+	if srcip.Equal(ipv4AddrAny) {
+		// answer from the address the peer asked for
+		if srcip = seg.dst; srcip == nil {
+			srcip, _ = getSrcIPForDstIP(seg.src.IP)
 		}
-		if tcp.chkFlag(SYN) && !tcp.chkFlag(ACK|PSH|FIN) {
-			info = &connInfo{
-				state: synreceived,
-				layer: layer,
-				mss:   getMssFromTcpLayer(tcp),
-			}
-			binary.Read(rand.Reader, binary.LittleEndian, &(info.layer.tcp.seqn))
-			err = listener.sendSynAckWithLayer(info.layer)
-			if err != nil {
-				return
-			}
-			listener.mutex.run(func() {
-				listener.newcons[addrstr] = info
-			})
-		} else {
-			listener.sendFinWithLayer(layer)
+		if srcip == nil {
+			return nil
 		}
 	}
+	return &pktLayers{
+		ip4: &iPv4Layer{
+			srcip: srcip,
+			dstip: seg.src.IP,
+		},
+		tcp: &tcpLayer{
+			srcPort: seg.dport,
+			dstPort: seg.src.Port,
+			window:  synWindow(listener.r.window(listenWindow)),
+			ackn:    seg.seq + 1,
+			data:    make([]byte, 2048),
+		},
+	}
 }
 
 func (listener *RAWListener) LocalAddr() net.Addr {
@@ -892,27 +1808,118 @@ func (listener *RAWListener) RemoteAddr() net.Addr {
 	return nil
 }
 
+// GetLocalInterfaceInfo returns the interface of the address the listener
+// is on, or every interface with an IPv4 address for the wildcard address.
+func (listener *RAWListener) GetLocalInterfaceInfo() (infos []InterfaceInfo) {
+	if !listener.laddr.IP.IsUnspecified() {
+		return []InterfaceInfo{interfaceInfo(listener.laddr.IP, listener.linkType())}
+	}
+	ifaces, _ := net.Interfaces()
+	for _, iface := range ifaces {
+		if iface.Flags&net.FlagUp == 0 {
+			continue
+		}
+		if ip, err := interfaceIPv4(iface.Name); err == nil {
+			infos = append(infos, interfaceInfo(ip, listener.linkType()))
+		}
+	}
+	return
+}
+
 func (listener *RAWListener) ReadFrom(b []byte) (n int, addr net.Addr, err error) {
-	n, addr, err = listener.doRead(b)
+	if n, addr, ok := listener.rqueue.pop(b); ok {
+		return n, addr, nil
+	}
+	if listener.work != nil {
+		return listener.readWork(b)
+	}
+	n, addr, err = listener.doRead(b, listener.readPacket)
 	return
 }
 
 func (listener *RAWListener) WriteTo(b []byte, addr net.Addr) (n int, err error) {
-	listener.mutex.Lock()
-	info, ok := listener.conns[addr.String()]
-	listener.mutex.Unlock()
+	listener.mutex.RLock()
+	info, ok := listener.connByAddr(addr.String())
+	listener.mutex.RUnlock()
 	if !ok {
-		return 0, errors.New("cannot write to " + addr.String())
+		return 0, &AddrError{Op: "write", Addr: addr, Err: ErrNoConn}
+	}
+	limit := info.payloadLimit()
+	if info.coalescer != nil {
+		limit -= coalesceHeaderLen
+	}
+	if len(b) > limit {
+		return 0, &MessageTooLongError{Size: len(b), Limit: limit}
+	}
+	if info.shaper != nil {
+		return len(b), info.shaper.write(b)
+	}
+	if info.coalescer != nil {
+		return len(b), info.coalescer.write(b)
+	}
+	return listener.wdeadline.write(listener.r, info.squeue, func() net.Addr { return addr }, b, func(b []byte, deadline time.Time) (int, error) {
+		return listener.writeSegment(b, info, 0, deadline)
+	})
+}
+
+// writeSegment sends b to the peer of info in a segment of its own.
+func (listener *RAWListener) writeSegment(b []byte, info *connInfo, tos int, deadline time.Time) (n int, err error) {
+	if listener.r.windowShut(&info.zerownd) {
+		return len(b), nil
+	}
+	if !paceUntil(deadline, len(b), 1, info.limiter, listener.limiter) {
+		return 0, &timeoutErr{op: "write to " + info.addr.String()}
+	}
+	if info.u2r != nil {
+		sealed := info.u2r.sealLocked(udp2rawData, b)
+		defer utils.PutBuf(sealed)
+		if _, err = listener.writeInfoTOS(sealed, info, tos); err != nil {
+			return 0, err
+		}
+		return len(b), nil
+	}
+	n = len(b)
+	mss, tls, prof := info.framing()
+	if info.pad > 0 {
+		b = padSegment(listener.r.random(), b, info.pad, payloadLimit(mss, recordLen(tls, prof), nil, info.pad)-n)
+		defer utils.PutBuf(b)
 	}
-	if info.tls {
+	if tls {
 		buf := utils.GetBuf(len(b) + 5)
 		defer utils.PutBuf(buf)
 		copy(buf, []byte{0x17, 0x3, 0x3})
 		binary.BigEndian.PutUint16(buf[3:5], uint16(len(b)))
 		copy(buf[5:], b)
 		b = buf[:5+len(b)]
+	} else if prof != profileNone {
+		b = prof.seal(listener.r.random(), b, true)
+		defer utils.PutBuf(b)
+	}
+	if _, err = listener.writeInfoTOS(b, info, tos); err != nil {
+		return 0, err
 	}
+	return
+}
+
+// writeSegments sends each b to the peer of info in a segment of its own,
+// with a single sendmmsg where it can. It returns how many of them went
+// out.
+func (listener *RAWListener) writeSegments(info *connInfo, bs [][]byte) (n int, err error) {
+	info.lock.Lock()
+	defer info.lock.Unlock()
+	return listener.writeBatchWithLayer(info.layer, bs, true)
+}
+
+func (listener *RAWListener) writeInfo(b []byte, info *connInfo) (n int, err error) {
+	return listener.writeInfoTOS(b, info, 0)
+}
+
+func (listener *RAWListener) writeInfoTOS(b []byte, info *connInfo, tos int) (n int, err error) {
+	info.lock.Lock()
+	defer info.lock.Unlock()
+	info.layer.ip4.tos = tos
 	n, err = listener.writeWithLayer(b, info.layer)
+	info.layer.ip4.tos = 0
 	info.layer.tcp.seqn += uint32(n)
 	return
 }
@@ -922,15 +1929,48 @@ type pktLayers struct {
 	tcp         *tcpLayer
 	lastack     uint32
 	lastacktime time.Time
+	tag         *segmentTag // of the segments of a dialed connection
+}
+
+func (layer *pktLayers) setDst(addr *net.UDPAddr) {
+	layer.ip4.dstip = addr.IP
+	layer.tcp.dstPort = addr.Port
 }
 
 type connInfo struct {
 	state uint32
 	layer *pktLayers
 	rep   []byte
-	hseqn uint32
+	hs    hsRange
 	mss   int
+	pad   int
 	tls   bool
+	prof  profile
+	u2r   *udp2rawState
+	lock  sync.Mutex
+	addr  *net.UDPAddr // reported to the application, kept on migration
+	sid   string
+	sts   int64
+	// limiter paces what is sent to this peer
+	limiter   *rateLimiter
+	squeue    *sendQueue
+	coalescer *coalescer
+	shaper    *shaper
+	born      time.Time
+	seen      atomic.Int64 // Unix nanoseconds of the last segment from the peer
+	zerownd   atomic.Bool  // the peer advertised a zero window
+	up        net.Conn     // the web server of a peer of Raw.Passthrough
+	// early holds the data that came before the request, see holdEarly
+	early    [][]byte
+	earlyLen int
+	// mssAssumed is set when the SYN announced no MSS, see Raw.FallbackMSS
+	mssAssumed bool
+	// peer is what the SYN offered
+	peer peerOptions
+	// mtu is that of the interface the SYN came in on
+	mtu int
+	// values are those the application attached, see SetPeerValue
+	values peerValues
 }
 
 // copy from github.com/google/gopacket/layers/tcp.go
@@ -974,6 +2014,8 @@ const (
 type iPv4Layer struct {
 	srcip net.IP
 	dstip net.IP
+	ttl   int // Raw.TTL if zero
+	tos   int // plus one, zero for the TOS of the connection
 }
 
 type tcpOption struct {
@@ -1026,6 +2068,10 @@ func decodeTCPlayer(data []byte) (tcp *tcpLayer, err error) {
 	tcp.reserved = uint8(u16 >> 9 & (1<<3 - 1))
 	tcp.ecn = uint8(u16 >> 6 & (1<<3 - 1))
 	tcp.flags = uint8(u16 & (1<<6 - 1))
+	if int(tcp.dataOffset) < tcpLen>>2 {
+		err = fmt.Errorf("Invalid TCP data offset %d < %d", tcp.dataOffset, tcpLen>>2)
+		return
+	}
 	if (length >> 2) < int(tcp.dataOffset) {
 		err = errors.New("TCP data offset greater than packet length")
 		return
@@ -1045,6 +2091,7 @@ func decodeTCPlayer(data []byte) (tcp *tcpLayer, err error) {
 	}
 
 	data = data[tcpLen:headerLen]
+options:
 	for len(data) > 0 {
 		if tcp.options == nil {
 			tcp.options = tcp.opts[:0]
@@ -1055,10 +2102,14 @@ func decodeTCPlayer(data []byte) (tcp *tcpLayer, err error) {
 		case tcpOptionKindEndList:
 			opt.length = 1
 			tcp.padding = data[1:]
-			break
+			break options
 		case tcpOptionKindNop:
 			opt.length = 1
 		default:
+			if len(data) < 2 {
+				err = fmt.Errorf("Invalid TCP option %d without a length", opt.kind)
+				return
+			}
 			opt.length = data[1]
 			if opt.length < 2 {
 				err = fmt.Errorf("Invalid TCP option length %d < 2", opt.length)
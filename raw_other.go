@@ -1,22 +1,21 @@
-// +build !linux,!darwin,!dragonfly,!freebsd,!netbsd,!openbsd
+// +build !linux,!darwin,!dragonfly,!freebsd,!netbsd,!openbsd !linux,pcap
 
 package rawcon
 
 import (
-	"crypto/rand"
 	"encoding/binary"
 	"errors"
 	"fmt"
+	"io"
 	"net"
 	"os/exec"
 	"runtime"
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
-	ran "math/rand"
-
 	"github.com/google/gopacket/layers"
 	"github.com/google/gopacket/pcap"
 	"github.com/biotooff/rawcon/utils"
@@ -25,7 +24,13 @@ import (
 	"golang.org/x/net/ipv4"
 )
 
+// libpcap is what is left where no syscall reaches the wire: Windows loads
+// wpcap.dll at run time and so does without cgo, other systems link
+// libpcap through it. On the BSDs and macOS this backend is a fallback to
+// their own, picked with the pcap tag.
+
 const maxCapLimit int32 = 1600
+const maxFilterPeers = 64
 const maxCapTimeout time.Duration = pcap.BlockForever//time.Millisecond * 10//
 const maxLayersChanLen int32 = 2000
 const connectTimeout = 20// seconds
@@ -34,18 +39,37 @@ type RAWConn struct {
 	udp        net.Conn
 	tcp        *net.TCPConn
 	handle     *pcap.Handle
+	pio        PacketIO // see Raw.PacketIO, used instead of handle
+	// slock guards handle for readLayers, which does not hold lock while
+	// takeOver or growCapture replace it
+	slock      sync.RWMutex
 	pktsrc     *gopacket.PacketSource
 	opts       gopacket.SerializeOptions
 	buffer     gopacket.SerializeBuffer
 	cleaner    *utils.ExitCleaner
 	layersChan chan *pktLayers
 	rtimer     *time.Timer
-	wtimer     *time.Timer
+	wdeadline  writeDeadline
 	layer      *pktLayers
 	r          *Raw
-	hseqn      uint32
+	ipid       *ipidGen
+	ce         atomic.Uint64
+	qdropped   atomic.Uint64
+	malformed  atomic.Uint64
+	reasm      reassembler
+	badsum     atomic.Uint64
+	offload    bool // ChecksumAuto found the NIC offloads checksums
+	icmpErr    atomic.Pointer[ICMPError]
+	tap        atomic.Pointer[packetTap] // see Tap
+	dscp       atomic.Int32 // set by SetDSCP, plus one
+	hs         hsRange // the handshake of the peer
 	lock       sync.Mutex
 	mss        int
+	mtu        int          // of the interface the packets go out on
+	pad        int          // agreed on in the handshake
+	public     *net.UDPAddr // reflected by the listener, see PublicAddr
+	hsinfo     HandshakeInfo
+	peer       peerOptions // what the SYN or SYN-ACK of the peer offered
 	async      utils.AsyncRunner
 	linktype   layers.LinkType
 	rcond      *sync.Cond
@@ -54,15 +78,51 @@ type RAWConn struct {
 	nocopy     bool
 	isLoopBack bool
 	die        chan struct{}
+	u2r        *udp2rawState
+	sid        []byte
+	limiter    *rateLimiter
+	squeue     *sendQueue
+	sendc      sendCounters
+	coalescer  *coalescer
+	shaper     *shaper
+	rqueue     datagramQueue
+	reset      atomic.Bool
+	zerownd    atomic.Bool // the peer advertised a zero window
+	zrtt       *zeroRTT
+	rtt        rttEstimator
+	lastRecv   atomic.Int64 // Unix nanoseconds of the last segment read
+	fanin      chan capturedPacket
+	nowait     atomic.Bool // see readNoWait
+	// device and filter are those of the capture of a dialed connection
+	device string
+	filter string
+	lports portRanges // those of a listener, see ports.go
 }
 
 func (raw *RAWConn) GetMSS() int {
 	return raw.mss
 }
 
+// GetLocalInterfaceInfo returns the interface conn captures on, and the
+// Ethernet addresses its packets carry.
+func (conn *RAWConn) GetLocalInterfaceInfo() InterfaceInfo {
+	link := conn.linktype.String()
+	if conn.pio != nil {
+		link = "PacketIO"
+	}
+	info := interfaceInfo(conn.layer.ip4.SrcIP, link)
+	if conn.mtu > 0 {
+		info.MTU = conn.mtu
+	}
+	if eth := conn.layer.eth; eth != nil {
+		info.MAC, info.GatewayMAC = eth.SrcMAC, eth.DstMAC
+	}
+	return info
+}
+
 func getMssFromTcpLayer(tcp *layers.TCP) int {
 	for _, v := range tcp.Options {
-		if v.OptionType != layers.TCPOptionKindMSS || len(v.OptionData) == 0 {
+		if v.OptionType != layers.TCPOptionKindMSS || len(v.OptionData) < 2 {
 			continue
 		}
 		return (int)(binary.BigEndian.Uint16(v.OptionData))
@@ -70,6 +130,57 @@ func getMssFromTcpLayer(tcp *layers.TCP) int {
 	return 0
 }
 
+// peerOptionsOf returns the options the SYN or SYN-ACK tcp offers.
+func peerOptionsOf(tcp *layers.TCP) peerOptions {
+	opts := peerOptions{seen: true, wscale: -1}
+	for _, v := range tcp.Options {
+		switch v.OptionType {
+		case layers.TCPOptionKindWindowScale:
+			if len(v.OptionData) >= 1 {
+				opts.wscale = int(v.OptionData[0])
+			}
+		case layers.TCPOptionKindSACKPermitted:
+			opts.sack = true
+		case layers.TCPOptionKindTimestamps:
+			opts.tsval, _, opts.timestamps = parseTimestamps(v.OptionData)
+		}
+	}
+	return opts
+}
+
+// hsSegmentOf returns what the handshakes look at of tcp, carrying n bytes.
+func hsSegmentOf(tcp *layers.TCP, n int) hsSegment {
+	return hsSegment{
+		syn:  tcp.SYN,
+		ack:  tcp.ACK,
+		psh:  tcp.PSH,
+		fin:  tcp.FIN,
+		seq:  tcp.Seq,
+		ackn: tcp.Ack,
+		n:    n,
+	}
+}
+
+// tcpHeader is the TCP header as the backend decodes it.
+type tcpHeader = layers.TCP
+
+// segmentOf returns the segment of the core of tcp, carrying payload.
+func segmentOf(tcp *layers.TCP, payload []byte) segment {
+	return segment{
+		hsSegment: hsSegmentOf(tcp, len(payload)),
+		rst:       tcp.RST,
+		window:    tcp.Window,
+		dport:     int(tcp.DstPort),
+		payload:   payload,
+		tcp:       tcp,
+	}
+}
+
+// srcIP returns the address the segments of layer are sent from.
+func (layer *pktLayers) srcIP() net.IP {
+	return layer.ip4.SrcIP
+}
+
 func (conn *RAWConn) readPacket() (packet gopacket.Packet, err error) {
 	var data [] byte
 	data, _, err = conn.handle.ZeroCopyReadPacketData()
@@ -80,6 +191,13 @@ func (conn *RAWConn) readPacket() (packet gopacket.Packet, err error) {
 	return
 }
 
+// capture returns the handle, or the PacketIO, readLayers reads from.
+func (conn *RAWConn) capture() (*pcap.Handle, PacketIO) {
+	conn.slock.RLock()
+	defer conn.slock.RUnlock()
+	return conn.handle, conn.pio
+}
+
 func (conn *RAWConn) readBytesOfPacket() (data [] byte, err error) {
 	data, _, err = conn.handle.ZeroCopyReadPacketData()
 	return
@@ -89,28 +207,69 @@ var eth layers.Ethernet
 var ip4 layers.IPv4
 var	tcp layers.TCP
 var payload gopacket.Payload
-var parser *gopacket.DecodingLayerParser
+var loop layers.Loopback
+var parser = newParser(layers.LayerTypeEthernet)
+
+// loopParser decodes the packets of a loopback capture, like the one of the
+// Npcap Loopback Adapter, which start with a 4 byte address family
+var loopParser = newParser(layers.LayerTypeLoopback)
+
+// fragmentFilter lets through the fragments that come after the first, the
+// one with the TCP header the rest of a filter looks at.
+const fragmentFilter = "ip proto tcp and ip[6:2] & 0x1fff != 0"
+
+// ipParser decodes the packets put back together from fragments
+var ipParser = newParser(layers.LayerTypeIPv4)
 var decoded []gopacket.LayerType = make([]gopacket.LayerType, 4)
 var buffer []byte = make([]byte, maxCapLimit)
 func (conn *RAWConn) readLayers() (layer *pktLayers, err error) {
 	select{
 		case <-conn.die: 
-			err=errors.New("EOF")
+			err=io.EOF
 			return
 		default:
 	}
-	if(parser == nil){
-		parser = gopacket.NewDecodingLayerParser(layers.LayerTypeEthernet)
-		parser.SetDecodingLayerContainer(gopacket.DecodingLayerArray(nil))
-		parser.AddDecodingLayer(&eth)
-		parser.AddDecodingLayer(&ip4)
-		parser.AddDecodingLayer(&tcp)
-		parser.AddDecodingLayer(&payload)
+	p, ethp := parser, &eth
+	if _, pio := conn.capture(); pio != nil {
+		// the packets of a PacketIO start with the IPv4 header
+		p, ethp = ipParser, nil
+	} else if isLoopbackLink(conn.linktype) {
+		p, ethp = loopParser, nil
 	}
-	
 	for{
-		buffer, _, err = conn.handle.ZeroCopyReadPacketData()
+		var from *pcap.Handle
+		handle, pio := conn.capture()
+		if pio != nil {
+			if conn.nowait.Load() && !packetsPending(pio) {
+				return nil, errWouldBlock
+			}
+			if buffer, err = pio.ReadPacketData(); err != nil {
+				if _, p := conn.capture(); p != pio {
+					// the connection has migrated, go on with the new PacketIO
+					continue
+				}
+				return
+			}
+		} else if conn.nowait.Load() && len(conn.fanin) == 0 {
+			// a handle read alone cannot tell whether it would wait
+			err = errWouldBlock
+			return
+		} else if conn.fanin != nil {
+			select {
+			case p := <-conn.fanin:
+				buffer, from, err = p.data, p.handle, p.err
+			case <-conn.die:
+				err = io.EOF
+				return
+			}
+		} else {
+			buffer, _, err = handle.ZeroCopyReadPacketData()
+		}
 		if err !=nil{
+			if h, _ := conn.capture(); from == nil && handle != h {
+				// the connection has migrated, go on with the new handle
+				continue
+			}
 			errStr:=err.Error()
 			if errStr == "Timeout Expired" {
 				fmt.Println("pcap read timeout")
@@ -120,10 +279,43 @@ func (conn *RAWConn) readLayers() (layer *pktLayers, err error) {
 			fmt.Println("pcap read err: ", err)
 			return
 		}
-		if err = parser.DecodeLayers(buffer, &decoded); err != nil {
-	      	conn.Close()
-	      	fmt.Println("Could not decode layers: ", err)
-	      	continue
+		if buffer = conn.r.packetIn(buffer); buffer == nil {
+			continue
+		}
+		// the payload layer is left as it was when the segment has none
+		payload = nil
+		err = p.DecodeLayers(buffer, &decoded)
+		if t, ok := err.(gopacket.UnsupportedLayerType); ok && gopacket.LayerType(t) == gopacket.LayerTypeFragment {
+			whole := conn.reasm.add(append(append([]byte(nil), ip4.Contents...), ip4.Payload...))
+			if whole == nil {
+				err = nil
+				continue
+			}
+			payload = nil
+			err = ipParser.DecodeLayers(whole, &decoded)
+		}
+		if err != nil {
+			if _, ok := err.(gopacket.UnsupportedLayerType); !ok {
+				conn.malformed.Add(1)
+			}
+			err = nil
+			continue
+		}
+		if !decodedTCP(decoded) {
+			continue
+		}
+		if pio != nil && !conn.ownsSegment(&tcp) {
+			continue
+		}
+		if conn.r.VerifyChecksums && !validChecksums(&ip4, &tcp, conn.r.Checksums != ChecksumFull) {
+			conn.badsum.Add(1)
+			continue
+		}
+		if t := conn.tap.Load(); t != nil {
+			t.ip(false, ip4.Contents, ip4.Payload)
+		}
+		if ethp != nil && isHostMAC(eth.SrcMAC) {
+			continue
 		}
 		if tcp.RST {
 			fmt.Println("RST recv",tcp.SrcPort,"->",tcp.DstPort)
@@ -132,13 +324,93 @@ func (conn *RAWConn) readLayers() (layer *pktLayers, err error) {
 			}
 		}
 		layer = &pktLayers{
-			eth: &eth, ip4: &ip4, tcp: &tcp, payload : payload,
+			eth: ethp, ip4: &ip4, tcp: &tcp, payload : payload,
+			handle: from,
 		}
 		return
 	}
 }
 
+// ownsSegment tells whether tcp, read from a PacketIO, which filters
+// nothing unlike the capture, goes to the port of conn.
+func (conn *RAWConn) ownsSegment(tcp *layers.TCP) bool {
+	if conn.layer == nil {
+		return conn.lports.has(int(tcp.DstPort))
+	}
+	return tcp.DstPort == conn.layer.tcp.SrcPort
+}
+
+// readSegment reads the next segment of a dialed connection.
+func (conn *RAWConn) readSegment() (seg segment, err error) {
+	cl, err := conn.readLayers()
+	if err != nil {
+		return
+	}
+	seg = segmentOf(cl.tcp, cl.payload)
+	seg.src = &net.UDPAddr{IP: cl.ip4.SrcIP, Port: int(cl.tcp.SrcPort)}
+	return
+}
+
+// decodedTCP tells whether decoded, the layers of a packet, go down to TCP.
+// The layers left out keep what the previous packet put in them.
+func decodedTCP(decoded []gopacket.LayerType) bool {
+	for _, t := range decoded {
+		if t == layers.LayerTypeTCP {
+			return true
+		}
+	}
+	return false
+}
+
+func newParser(first gopacket.LayerType) *gopacket.DecodingLayerParser {
+	p := gopacket.NewDecodingLayerParser(first)
+	p.SetDecodingLayerContainer(gopacket.DecodingLayerArray(nil))
+	p.AddDecodingLayer(&eth)
+	p.AddDecodingLayer(&loop)
+	p.AddDecodingLayer(&ip4)
+	p.AddDecodingLayer(&tcp)
+	p.AddDecodingLayer(&payload)
+	return p
+}
+
+func isLoopbackLink(lt layers.LinkType) bool {
+	return lt == layers.LinkTypeNull || lt == layers.LinkTypeLoop
+}
+
+// isLoopbackDevice tells the loopback device apart, on Windows the Npcap
+// Loopback Adapter.
+func isLoopbackDevice(in pcap.Interface) bool {
+	return in.Flags&pcapIfLoopback != 0 || strings.HasSuffix(in.Name, "NPF_Loopback")
+}
+
+// capturedPacket is a packet read from one of the handles of a listener on
+// several interfaces.
+type capturedPacket struct {
+	data   []byte
+	handle *pcap.Handle
+	err    error
+}
+
+// pump feeds the packets captured by handle to readLayers.
+func (conn *RAWConn) pump(handle *pcap.Handle) {
+	for {
+		data, _, err := handle.ReadPacketData()
+		if err == pcap.NextErrorTimeoutExpired {
+			continue
+		}
+		select {
+		case conn.fanin <- capturedPacket{data: data, handle: handle, err: err}:
+		case <-conn.die:
+			return
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
 func (conn *RAWConn) Close() (err error) {
+	conn.zrtt.stop()
 	if conn.die != nil {
 		select {
 		default:
@@ -152,8 +424,10 @@ func (conn *RAWConn) Close() (err error) {
 	if conn.die != nil {
 		close(conn.die)
 	}
-	if conn.udp != nil && conn.handle != nil {
-		// conn.sendFin()
+	if conn.udp != nil && (conn.handle != nil || conn.pio != nil) {
+		conn.lock.Lock()
+		conn.sendFin()
+		conn.lock.Unlock()
 	}
 	if conn.udp != nil {
 		err = conn.udp.Close()
@@ -164,29 +438,67 @@ func (conn *RAWConn) Close() (err error) {
 	if conn.handle != nil {
 		conn.handle.Close()
 	}
+	if conn.pio != nil {
+		if err1 := conn.pio.Close(); err1 != nil {
+			err = err1
+		}
+	}
 	return
 }
 
 func (conn *RAWConn) sendPacketWithLayer(layer *pktLayers) (err error) {
-	buffer := gopacket.NewSerializeBuffer()
 	opts := conn.opts
-	layer.ip4.Id++
+	layer.stampSegmentID()
+	layer.ip4.Id = conn.ipid.next(layer.ip4.Id, layer.ip4.DstIP)
+	layer.ip4.TOS = uint8(conn.tosOf(layer.tos))
 	layer.tcp.SetNetworkLayerForChecksum(layer.ip4)
-	if layer.eth != nil {
-		err = gopacket.SerializeLayers(buffer, opts,
-			layer.eth, layer.ip4,
-			layer.tcp, gopacket.Payload(layer.payload))
-	} else {
-		err = gopacket.SerializeLayers(buffer, opts,
-			&layers.Loopback{Family: layers.ProtocolFamilyIPv4}, layer.ip4,
-			layer.tcp, gopacket.Payload(layer.payload))
+	var link gopacket.SerializableLayer = layer.eth
+	linklen := 14
+	if conn.pio != nil {
+		// the packets of a PacketIO start with the IPv4 header
+		link, linklen = gopacket.Payload(nil), 0
+	} else if layer.eth == nil {
+		link, linklen = &layers.Loopback{Family: layers.ProtocolFamilyIPv4}, 4
+	}
+	handle := conn.handle
+	if layer.handle != nil {
+		handle = layer.handle
+	}
+	offload := conn.r.offloads(conn.offload)
+	if frame := templateFrame(&layer.tmpl, opts, link, layer.ip4, layer.tcp, layer.payload); frame != nil {
+		err = conn.sendFrame(handle, frame, linklen, offload)
+		utils.PutBuf(frame)
+		return
 	}
+	buffer := gopacket.NewSerializeBuffer()
+	err = gopacket.SerializeLayers(buffer, opts,
+		link, layer.ip4,
+		layer.tcp, gopacket.Payload(layer.payload))
 	if err == nil {
-		err = conn.handle.WritePacketData(buffer.Bytes())
+		err = conn.sendFrame(handle, buffer.Bytes(), linklen, offload)
 	}
 	return
 }
 
+// sendFrame sends frame, whose link header is linklen bytes long, on handle
+// or on the PacketIO of conn, once Raw.PacketOut has seen it.
+func (conn *RAWConn) sendFrame(handle *pcap.Handle, frame []byte, linklen int, offload bool) error {
+	if offload {
+		putFrameChecksum(frame, linklen)
+	}
+	b := conn.r.packetOut(frame)
+	if b == nil {
+		return nil
+	}
+	if t := conn.tap.Load(); t != nil {
+		t.frame(b, linklen)
+	}
+	if conn.pio != nil {
+		return conn.pio.WritePacketData(b)
+	}
+	return handle.WritePacketData(b)
+}
+
 func (conn *RAWConn) sendPacket() (err error) {
 	return conn.sendPacketWithLayer(conn.layer)
 }
@@ -200,6 +512,28 @@ func (layer *pktLayers) updateTCP() {
 	layer.tcp.SYN = false
 }
 
+// ack returns the acknowledgment number layer sends, setAck changes it.
+func (layer *pktLayers) ack() uint32 {
+	return layer.tcp.Ack
+}
+
+// seq returns the sequence number of the next segment layer sends.
+func (layer *pktLayers) seq() uint32 {
+	return layer.tcp.Seq
+}
+
+func (layer *pktLayers) setAck(ack uint32) {
+	layer.tcp.Ack = ack
+}
+
+func (layer *pktLayers) setSeq(seq uint32) {
+	layer.tcp.Seq = seq
+}
+
+func (layer *pktLayers) setWindow(window uint16) {
+	layer.tcp.Window = window
+}
+
 func (conn *RAWConn) updateTCP() {
 	conn.layer.updateTCP()
 }
@@ -213,25 +547,77 @@ func (conn *RAWConn) sendSynWithLayer(layer *pktLayers) (err error) {
 	tcp.Options = append(tcp.Options, layers.TCPOption{
 		OptionType:   layers.TCPOptionKindMSS,
 		OptionLength: 4,
-		OptionData:   []byte{0x5, 0xb4},
+		OptionData:   mssOption(conn.r.advertisedMSS(conn.mtu)),
 	})
 	tcp.Options = append(tcp.Options, layers.TCPOption{
 		OptionType:   layers.TCPOptionKindWindowScale,
 		OptionLength: 3,
-		OptionData:   []byte{0x6},
+		OptionData:   []byte{windowScale},
 	})
 	tcp.Options = append(tcp.Options, layers.TCPOption{
 		OptionType:   layers.TCPOptionKindSACKPermitted,
 		OptionLength: 2,
 	})
+	tcp.Options = append(tcp.Options, layers.TCPOption{
+		OptionType:   layers.TCPOptionKindTimestamps,
+		OptionLength: 10,
+		OptionData:   timestampsData(tsNow(), 0),
+	})
+	return conn.sendPacketWithLayer(layer)
+}
+
+// sendTimestampsWithLayer sends a pure ACK carrying the TCP timestamps
+// option.
+func (conn *RAWConn) sendTimestampsWithLayer(layer *pktLayers, val, ecr uint32) (err error) {
+	layer.updateTCP()
+	tcp := layer.tcp
+	tcp.ACK = true
+	options := tcp.Options
+	defer func() { tcp.Options = options }()
+	tcp.Options = append(tcp.Options, layers.TCPOption{
+		OptionType:   layers.TCPOptionKindTimestamps,
+		OptionLength: 10,
+		OptionData:   timestampsData(val, ecr),
+	})
 	return conn.sendPacketWithLayer(layer)
 }
 
+func timestampsOf(tcp *layers.TCP) (val, ecr uint32, ok bool) {
+	for _, v := range tcp.Options {
+		if v.OptionType == layers.TCPOptionKindTimestamps {
+			return parseTimestamps(v.OptionData)
+		}
+	}
+	return
+}
+
+// setSegmentID adds the option carrying tag to the segments of conn.
+func (conn *RAWConn) setSegmentID(tag *segmentTag) {
+	conn.layer.tag = tag
+	tcp := conn.layer.tcp
+	tcp.Options = append(tcp.Options, layers.TCPOption{
+		OptionType:   tcpOptionKindSegmentID,
+		OptionLength: segmentIDOptionLen,
+		OptionData:   tag.data[:],
+	})
+}
+
+func segmentIDOf(tcp *layers.TCP) []byte {
+	for _, v := range tcp.Options {
+		if v.OptionType == tcpOptionKindSegmentID {
+			return v.OptionData
+		}
+	}
+	return nil
+}
+
 func (conn *RAWConn) sendSyn() (err error) {
 	return conn.sendSynWithLayer(conn.layer)
 }
 
-func (conn *RAWConn) sendSynAckWithLayer(layer *pktLayers) (err error) {
+// sendSynAckWithLayer sends a SYN-ACK announcing mss answering a SYN that
+// offered peer, with those of the options that it offered.
+func (conn *RAWConn) sendSynAckWithLayer(layer *pktLayers, mss int, peer peerOptions) (err error) {
 	layer.updateTCP()
 	tcp := layer.tcp
 	tcp.SYN = true
@@ -241,22 +627,33 @@ func (conn *RAWConn) sendSynAckWithLayer(layer *pktLayers) (err error) {
 	tcp.Options = append(tcp.Options, layers.TCPOption{
 		OptionType:   layers.TCPOptionKindMSS,
 		OptionLength: 4,
-		OptionData:   []byte{0x5, 0xb4},
-	})
-	tcp.Options = append(tcp.Options, layers.TCPOption{
-		OptionType:   layers.TCPOptionKindWindowScale,
-		OptionLength: 3,
-		OptionData:   []byte{0x6},
-	})
-	tcp.Options = append(tcp.Options, layers.TCPOption{
-		OptionType:   layers.TCPOptionKindSACKPermitted,
-		OptionLength: 2,
+		OptionData:   mssOption(mss),
 	})
+	if peer.wscale >= 0 {
+		tcp.Options = append(tcp.Options, layers.TCPOption{
+			OptionType:   layers.TCPOptionKindWindowScale,
+			OptionLength: 3,
+			OptionData:   []byte{windowScale},
+		})
+	}
+	if peer.sack {
+		tcp.Options = append(tcp.Options, layers.TCPOption{
+			OptionType:   layers.TCPOptionKindSACKPermitted,
+			OptionLength: 2,
+		})
+	}
+	if peer.timestamps {
+		tcp.Options = append(tcp.Options, layers.TCPOption{
+			OptionType:   layers.TCPOptionKindTimestamps,
+			OptionLength: 10,
+			OptionData:   timestampsData(tsNow(), peer.tsval),
+		})
+	}
 	return conn.sendPacketWithLayer(layer)
 }
 
 func (conn *RAWConn) sendSynAck() (err error) {
-	return conn.sendSynAckWithLayer(conn.layer)
+	return conn.sendSynAckWithLayer(conn.layer, conn.r.advertisedMSS(conn.mtu), conn.peer)
 }
 
 func (conn *RAWConn) sendAckWithLayer(layer *pktLayers) (err error) {
@@ -276,7 +673,7 @@ func (conn *RAWConn) sendFinWithLayer(layer *pktLayers) (err error) {
 }
 
 func (conn *RAWConn) sendFin() (err error) {
-	return conn.sendPacketWithLayer(conn.layer)
+	return conn.sendFinWithLayer(conn.layer)
 }
 
 func (conn *RAWConn) sendRstWithLayer(layer *pktLayers) (err error) {
@@ -286,7 +683,7 @@ func (conn *RAWConn) sendRstWithLayer(layer *pktLayers) (err error) {
 }
 
 func (conn *RAWConn) sendRst() (err error) {
-	return conn.sendPacketWithLayer(conn.layer)
+	return conn.sendRstWithLayer(conn.layer)
 }
 
 func (conn *RAWConn) writeWithLayer(b []byte, layer *pktLayers) (n int, err error) {
@@ -300,12 +697,117 @@ func (conn *RAWConn) writeWithLayer(b []byte, layer *pktLayers) (n int, err erro
 }
 
 // the write method don't increace the seq number
+// applyTOS does nothing, the TOS byte is set on every packet sent.
+func (conn *RAWConn) applyTOS() {}
+
+// sendDecoy sends b at the next sequence number with Raw.DecoyTTL.
+func (conn *RAWConn) sendDecoy(b []byte) (err error) {
+	ip4 := conn.layer.ip4
+	ip4.TTL = uint8(conn.r.DecoyTTL)
+	defer func() { ip4.TTL = uint8(conn.r.ttl()) }()
+	_, err = conn.write(b)
+	return
+}
+
 func (conn *RAWConn) write(b []byte) (n int, err error) {
 	return conn.writeWithLayer(b, conn.layer)
 }
 
+// sendChatterWithLayer sends b at the next sequence number without the PSH
+// flag, see Raw.Chatter, and moves the sequence number past it.
+func (conn *RAWConn) sendChatterWithLayer(b []byte, layer *pktLayers) (err error) {
+	layer.updateTCP()
+	layer.tcp.ACK = true
+	layer.payload = b
+	err = conn.sendPacketWithLayer(layer)
+	layer.payload = nil
+	layer.tcp.Seq += uint32(len(b))
+	return
+}
+
+// ackUpTo moves the acknowledgment number of the connection past the n
+// bytes received at seq. It takes the lock, the segments sent from other
+// goroutines carry the number too.
+func (conn *RAWConn) ackUpTo(seq uint32, n int) {
+	conn.lock.Lock()
+	defer conn.lock.Unlock()
+	if uint64(seq)+uint64(n) > uint64(conn.layer.tcp.Ack) {
+		conn.layer.tcp.Ack = seq + uint32(n)
+	}
+}
+
+// seqAck returns the next sequence number and the acknowledgment number of
+// the connection.
+func (conn *RAWConn) seqAck() (seq, ack uint32) {
+	return conn.layer.tcp.Seq, conn.layer.tcp.Ack
+}
+
+func (conn *RAWConn) setSeqAck(seq, ack uint32) {
+	conn.layer.tcp.Seq, conn.layer.tcp.Ack = seq, ack
+}
+
+// detach has nothing to do, Close sends no FIN here.
+func (conn *RAWConn) detach() {}
+
+// resendAt sends b again at the sequence number seqn, leaving the one of
+// the connection as it is.
+func (conn *RAWConn) resendAt(b []byte, seqn uint32) (err error) {
+	conn.lock.Lock()
+	defer conn.lock.Unlock()
+	tcp := conn.layer.tcp
+	cur := tcp.Seq
+	tcp.Seq = seqn
+	_, err = conn.write(b)
+	tcp.Seq = cur
+	return
+}
+
 func (conn *RAWConn) Write(b []byte) (n int, err error) {
-	
+	if err = conn.resetErr("write"); err != nil {
+		return
+	}
+	if err = conn.pathErr("write"); err != nil {
+		return
+	}
+	limit := payloadLimit(conn.mss, recordLen(conn.r.TLS, conn.r.profile()), conn.u2r, conn.pad)
+	if conn.coalescer != nil {
+		limit -= coalesceHeaderLen
+	}
+	if len(b) > limit {
+		return 0, &MessageTooLongError{Size: len(b), Limit: limit}
+	}
+	if conn.shaper != nil {
+		return len(b), conn.shaper.write(b)
+	}
+	if conn.coalescer != nil {
+		return len(b), conn.coalescer.write(b)
+	}
+	return conn.wdeadline.write(conn.r, conn.squeue, conn.RemoteAddr, b, func(b []byte, deadline time.Time) (int, error) {
+		return conn.writeSegment(b, 0, deadline)
+	})
+}
+
+// writeSegment sends b in a segment of its own.
+func (conn *RAWConn) writeSegment(b []byte, tos int, deadline time.Time) (n int, err error) {
+	if conn.r.windowShut(&conn.zerownd) {
+		return len(b), nil
+	}
+	if !paceUntil(deadline, len(b), 1, conn.limiter) {
+		return 0, &timeoutErr{op: "write to " + conn.RemoteAddr().String()}
+	}
+	if conn.u2r != nil {
+		sealed := conn.u2r.sealLocked(udp2rawData, b)
+		defer utils.PutBuf(sealed)
+		if _, err = conn.writeTOS(sealed, tos); err != nil {
+			return 0, err
+		}
+		return len(b), nil
+	}
+	n = len(b)
+	if conn.pad > 0 {
+		b = padSegment(conn.r.random(), b, conn.pad, payloadLimit(conn.mss, recordLen(conn.r.TLS, conn.r.profile()), nil, conn.pad)-n)
+		defer utils.PutBuf(b)
+	}
 	if conn.r.TLS {
 		buf := utils.GetBuf(len(b) + 5)
 		defer utils.PutBuf(buf)
@@ -313,71 +815,440 @@ func (conn *RAWConn) Write(b []byte) (n int, err error) {
 		binary.BigEndian.PutUint16(buf[3:5], uint16(len(b)))
 		copy(buf[5:], b)
 		b = buf[:5+len(b)]
+	} else if p := conn.r.profile(); p != profileNone {
+		b = p.seal(conn.r.random(), b, false)
+		defer utils.PutBuf(b)
+	}
+	if _, err = conn.writeTOS(b, tos); err != nil {
+		return 0, err
 	}
-	n, err = conn.write(b)
-	conn.layer.tcp.Seq += uint32(n)
 	return
 }
 
-func (conn *RAWConn) trySendAck(layer *pktLayers) {
-	// now := time.Now()
-	// if layer.tcp.Ack < layer.lastack+16384 {
-	// 	if now.Sub(layer.lastacktime) < time.Millisecond*time.Duration(10) {
-	// 		return
-	// 	}
-	// }
-	// layer.lastack = layer.tcp.Ack
-	// layer.lastacktime = now
-	// conn.sendAckWithLayer(layer)
+// writeTOS sends b in the next segment, with the TOS byte tos minus one
+// unless tos is zero.
+func (conn *RAWConn) writeTOS(b []byte, tos int) (n int, err error) {
+	conn.lock.Lock()
+	defer conn.lock.Unlock()
+	conn.layer.tos = tos
+	n, err = conn.write(b)
+	conn.layer.tos = 0
+	conn.layer.tcp.Seq += uint32(n)
+	return
 }
 
-func (conn *RAWConn) ReadFrom(b []byte) (n int, addr net.Addr, err error) {
-	defer func() {
-		if conn.rtimer != nil {
-			conn.rtimer.Stop()
-			conn.rtimer = nil
-		}
-	}()
-	for {
-		var layer *pktLayers
-		layer, err = conn.readLayers()
-		if err != nil {
+// resolveEthernet builds the Ethernet header of the packets from local to
+// remote sent on device, asking the next hop for its address with ARP.
+func (r *Raw) resolveEthernet(device string, local, remote net.IP) (eth *layers.Ethernet, err error) {
+	src, hop, req, err := arpQuery(local, remote)
+	if err != nil {
+		return
+	}
+	// a handle of its own, as the one of the connection blocks forever
+	handle, err := pcap.OpenLive(device, 128, false, arpTimeout/10)
+	if err != nil {
+		return
+	}
+	defer handle.Close()
+	if err = handle.SetBPFFilter("arp"); err != nil {
+		return
+	}
+	for i := 0; i < arpRetries; i++ {
+		if err = handle.WritePacketData(req); err != nil {
 			return
 		}
-		ip4 := layer.ip4
-		tcp := layer.tcp
-		if tcp.SYN && tcp.ACK {
-			err = conn.sendAck()
-			if err != nil {
-				return
-			}
-			continue
-		}
-		if !tcp.PSH || !tcp.ACK || tcp.Seq == conn.hseqn {
-			continue
-		}
-		if conn.udp != nil {
-			addr = conn.RemoteAddr()
-		} else {
-			addr = &net.UDPAddr{
-				IP:   ip4.SrcIP,
-				Port: int(tcp.SrcPort),
-			}
-		}
-		n = len(layer.payload)
-		if n > 0 {
-			if uint64(tcp.Seq)+uint64(n) > uint64(conn.layer.tcp.Ack) {
-				conn.layer.tcp.Ack = tcp.Seq + uint32(n)
+		for deadline := time.Now().Add(arpTimeout); time.Now().Before(deadline); {
+			data, _, e := handle.ReadPacketData()
+			if e == pcap.NextErrorTimeoutExpired {
+				continue
+			} else if e != nil {
+				return nil, e
 			}
-			if conn.r.TLS {
-				if n < 5 {
-					continue
+			packet := gopacket.NewPacket(data, layers.LayerTypeEthernet, gopacket.Default)
+			if dst, ok := arpReply(packet, hop); ok {
+				eth = &layers.Ethernet{
+					SrcMAC:       src,
+					DstMAC:       dst,
+					EthernetType: layers.EthernetTypeIPv4,
 				}
-				n = copy(b, layer.payload[5:])
-			} else {
-				n = copy(b, layer.payload)
+				return
 			}
-			conn.trySendAck(conn.layer)
+		}
+	}
+	return nil, errors.New("no ARP reply from " + hop.String())
+}
+
+// diagnoseCapture checks that a pcap capture opens on the device of local.
+func (r *Raw) diagnoseCapture(local net.IP) (string, error) {
+	in, err := r.chooseInterface(local)
+	if err != nil {
+		return "", err
+	}
+	handle, err := r.openCapture(in.Name, linkMTU(local))
+	if err != nil {
+		return "", err
+	}
+	handle.Close()
+	return "pcap on " + in.Name, nil
+}
+
+// diagnoseInject checks that pcap sends on the device of local, with the ARP
+// request for the next hop towards remote.
+func (r *Raw) diagnoseInject(local, remote net.IP) (string, error) {
+	in, err := r.chooseInterface(local)
+	if err != nil {
+		return "", err
+	}
+	if isLoopbackDevice(in) {
+		return "nothing to send on loopback", nil
+	}
+	_, _, req, err := arpQuery(local, remote)
+	if err != nil {
+		return "", err
+	}
+	handle, err := r.openCapture(in.Name, linkMTU(local))
+	if err != nil {
+		return "", err
+	}
+	defer handle.Close()
+	if err = handle.WritePacketData(req); err != nil {
+		return "", err
+	}
+	return "pcap sends on " + in.Name, nil
+}
+
+// diagnoseGateway asks the next hop towards remote for its hardware address.
+func (r *Raw) diagnoseGateway(local, remote net.IP) (string, error) {
+	in, err := r.chooseInterface(local)
+	if err != nil {
+		return "", err
+	}
+	if isLoopbackDevice(in) {
+		return "no gateway on loopback", nil
+	}
+	eth, err := r.resolveEthernet(in.Name, local, remote)
+	if err != nil {
+		return "", err
+	}
+	return "next hop at " + eth.DstMAC.String(), nil
+}
+
+// sniffOwn captures a UDP packet the system sends to a random address.
+func (conn *RAWConn) sniffOwn() (packet gopacket.Packet, err error) {
+	buf := make([]byte, 32)
+	conn.r.random().Read(buf)
+	raddr := &net.UDPAddr{IP: net.IPv4(8, 8, buf[0], buf[1]), Port: int(binary.LittleEndian.Uint16(buf[2:4]))}
+	uconn, err := conn.r.dialUDP(raddr.String(), nil)
+	if err != nil {
+		return
+	}
+	defer uconn.Close()
+	filter := "udp and src port " + strconv.Itoa(uconn.LocalAddr().(*net.UDPAddr).Port) +
+		" and dst host " + uconn.RemoteAddr().(*net.UDPAddr).IP.String() +
+		" and dst port " + strconv.Itoa(uconn.RemoteAddr().(*net.UDPAddr).Port)
+	if err = conn.handle.SetBPFFilter(filter); err != nil {
+		return
+	}
+	if _, err = uconn.Write(buf); err != nil {
+		return
+	}
+	return conn.readPacket()
+}
+
+// sniffEthernet learns the Ethernet header from sniffOwn, for when ARP does
+// not work. eth is nil on a loopback interface.
+func (conn *RAWConn) sniffEthernet() (eth *layers.Ethernet, err error) {
+	packet, err := conn.sniffOwn()
+	if err != nil {
+		return
+	}
+	if ethLayer := packet.Layer(layers.LayerTypeEthernet); ethLayer != nil {
+		eth, _ = ethLayer.(*layers.Ethernet)
+	} else if packet.Layer(layers.LayerTypeLoopback) == nil {
+		err = errors.New("cannot find the link layer")
+	}
+	return
+}
+
+// captureFilter ands filter with Raw.Filter.
+func (r *Raw) captureFilter(filter string) string {
+	filter = "(" + filter + ") or (" + fragmentFilter + ")"
+	if r.Filter == "" {
+		return filter
+	}
+	return "(" + filter + ") and (" + r.Filter + ")"
+}
+
+// openCapture opens a pcap handle on device set up by the capture options
+// of r.
+func (r *Raw) openCapture(device string, mtu int) (handle *pcap.Handle, err error) {
+	return r.openCaptureBuffer(device, mtu, r.CaptureBuffer)
+}
+
+// openCaptureBuffer is openCapture with a buffer of the given size, the
+// system default if zero.
+func (r *Raw) openCaptureBuffer(device string, mtu, buffer int) (handle *pcap.Handle, err error) {
+	inactive, err := pcap.NewInactiveHandle(device)
+	if err != nil {
+		return
+	}
+	defer inactive.CleanUp()
+	snaplen := max(mtu, defaultMTU) + captureSlack
+	if r.SnapLen > 0 {
+		snaplen = r.SnapLen
+	}
+	if err = inactive.SetSnapLen(snaplen); err != nil {
+		return
+	}
+	if err = inactive.SetPromisc(r.Promisc); err != nil {
+		return
+	}
+	if err = inactive.SetImmediateMode(r.Immediate || r.BusyPoll > 0); err != nil {
+		return
+	}
+	if err = inactive.SetTimeout(maxCapTimeout); err != nil {
+		return
+	}
+	if buffer > 0 {
+		if err = inactive.SetBufferSize(buffer); err != nil {
+			return
+		}
+	}
+	if handle, err = inactive.Activate(); err != nil {
+		return
+	}
+	// the packets we inject would loop back into readLayers otherwise
+	if err = handle.SetDirection(pcap.DirectionIn); err != nil {
+		if r.InboundOnly {
+			handle.Close()
+			return nil, err
+		}
+		err = nil
+	}
+	return
+}
+
+// CaptureStats returns the counters of the pcap handle the connection reads
+// from.
+func (conn *RAWConn) CaptureStats() (stats CaptureStats, err error) {
+	s, err := conn.handle.Stats()
+	if err != nil {
+		return
+	}
+	stats.Received = s.PacketsReceived
+	stats.Dropped = s.PacketsDropped
+	stats.IfDropped = s.PacketsIfDropped
+	stats.QueueDropped = conn.queueDropped()
+	stats.Malformed = int(conn.malformed.Load())
+	stats.BadChecksum = int(conn.badsum.Load())
+	return
+}
+
+// SetReadBuffer fails, the size of the pcap buffer is only set when it is
+// opened, see Raw.CaptureBuffer.
+func (conn *RAWConn) SetReadBuffer(bytes int) error {
+	return errNoSocketBuffer
+}
+
+// growCapture reopens the handle of conn with a buffer of bytes, see
+// Raw.MaxCaptureBuffer.
+func (conn *RAWConn) growCapture(bytes int) error {
+	if conn.fanin != nil || conn.device == "" {
+		return errNoCaptureGrow
+	}
+	handle, err := conn.r.openCaptureBuffer(conn.device, conn.mtu, bytes)
+	if err != nil {
+		return err
+	}
+	if err = handle.SetBPFFilter(conn.r.captureFilter(conn.filter)); err != nil {
+		handle.Close()
+		return err
+	}
+	conn.lock.Lock()
+	conn.slock.Lock()
+	old := conn.handle
+	conn.handle = handle
+	conn.slock.Unlock()
+	conn.lock.Unlock()
+	// readLayers goes on with the new handle
+	old.Close()
+	return nil
+}
+
+// SetWriteBuffer fails, pcap has no send buffer to size.
+func (conn *RAWConn) SetWriteBuffer(bytes int) error {
+	return errNoSocketBuffer
+}
+
+// Handle returns the pcap handle the connection captures and sends with,
+// for what rawcon does not cover such as another filter or pcap_stats. A
+// filter set on it replaces the one rawcon needs, and reading from it
+// steals packets from the connection; it must not be closed. It is
+// replaced when the connection migrates.
+func (conn *RAWConn) Handle() *pcap.Handle {
+	return conn.handle
+}
+
+// Handles returns the handles of the listener, one for every interface it
+// captures on, with the caveats of Handle.
+func (listener *RAWListener) Handles() []*pcap.Handle {
+	handles := make([]*pcap.Handle, len(listener.captures))
+	for i, c := range listener.captures {
+		handles[i] = c.handle
+	}
+	return handles
+}
+
+// writeSegments sends each b in a segment of its own, it returns how many
+// of them went out.
+func (conn *RAWConn) writeSegments(bs [][]byte) (n int, err error) {
+	conn.lock.Lock()
+	defer conn.lock.Unlock()
+	for _, b := range bs {
+		if _, err = conn.write(b); err != nil {
+			return
+		}
+		conn.layer.tcp.Seq += uint32(len(b))
+		n++
+	}
+	return
+}
+
+func (conn *RAWConn) writeUdp2raw(typ byte, data []byte) (n int, err error) {
+	b := conn.u2r.sealLocked(typ, data)
+	defer utils.PutBuf(b)
+	conn.lock.Lock()
+	defer conn.lock.Unlock()
+	n, err = conn.write(b)
+	conn.layer.tcp.Seq += uint32(n)
+	return
+}
+
+func (conn *RAWConn) trySendAck(layer *pktLayers) {
+	// now := time.Now()
+	// if layer.tcp.Ack < layer.lastack+16384 {
+	// 	if now.Sub(layer.lastacktime) < time.Millisecond*time.Duration(10) {
+	// 		return
+	// 	}
+	// }
+	// layer.lastack = layer.tcp.Ack
+	// layer.lastacktime = now
+	// conn.sendAckWithLayer(layer)
+}
+
+func (conn *RAWConn) ReadFrom(b []byte) (n int, addr net.Addr, err error) {
+	defer func() {
+		if conn.rtimer != nil {
+			conn.rtimer.Stop()
+			conn.rtimer = nil
+		}
+	}()
+	if n, addr, ok := conn.rqueue.pop(b); ok {
+		return n, addr, nil
+	}
+	if err = conn.resetErr("read"); err != nil {
+		return
+	}
+	if err = conn.pathErr("read"); err != nil {
+		return
+	}
+	for {
+		var layer *pktLayers
+		layer, err = conn.readLayers()
+		if err != nil {
+			return
+		}
+		ip4 := layer.ip4
+		tcp := layer.tcp
+		conn.touch()
+		conn.checkCE(ip4.TOS, conn.RemoteAddr())
+		if tcp.RST {
+			if !conn.rstInWindow(tcp.Seq) {
+				continue
+			}
+			err = conn.connReset()
+			return
+		}
+		plain := tcp.ACK && !tcp.SYN && !tcp.FIN
+		if ok, err := conn.windowProbe(plain, tcp.Seq, len(layer.payload), tcp.Window); ok || err != nil {
+			if err != nil {
+				return 0, nil, err
+			}
+			continue
+		}
+		if len(layer.payload) == 0 && conn.rtt.echo(timestampsOf(tcp)) {
+			continue
+		}
+		if tcp.SYN && tcp.ACK {
+			err = conn.sendAck()
+			if err != nil {
+				return
+			}
+			continue
+		}
+		if conn.u2r != nil {
+			if !tcp.ACK || len(layer.payload) == 0 {
+				continue
+			}
+			conn.ackUpTo(tcp.Seq, len(layer.payload))
+			typ, data, ok := conn.u2r.open(layer.payload)
+			if !ok || typ != udp2rawData {
+				continue
+			}
+			addr = conn.RemoteAddr()
+			if n, ok = conn.deliver(b, addr, data); !ok {
+				continue
+			}
+			return
+		}
+		if tcp.PSH && tcp.ACK && conn.zrtt.reply(layer.payload) {
+			conn.noteZeroRTTReply()
+			conn.hs.set(tcp.Seq, len(layer.payload))
+			conn.ackUpTo(tcp.Seq, len(layer.payload))
+			continue
+		}
+		if tcp.ACK && !tcp.PSH && len(layer.payload) > 0 {
+			// a response to Raw.Chatter
+			conn.ackUpTo(tcp.Seq, len(layer.payload))
+			continue
+		}
+		if !tcp.PSH || !tcp.ACK || conn.hs.covers(tcp.Seq) {
+			continue
+		}
+		if conn.udp != nil {
+			addr = conn.RemoteAddr()
+		} else {
+			addr = &net.UDPAddr{
+				IP:   ip4.SrcIP,
+				Port: int(tcp.SrcPort),
+			}
+		}
+		n = len(layer.payload)
+		if n > 0 {
+			conn.ackUpTo(tcp.Seq, n)
+			payload := layer.payload
+			if conn.r.TLS {
+				if n < 5 {
+					continue
+				}
+				payload = payload[5:]
+			} else if p := conn.r.profile(); p != profileNone {
+				d, ok := p.open(payload)
+				if !ok {
+					continue
+				}
+				payload = d
+			}
+			var ok bool
+			if conn.pad > 0 {
+				if payload, ok = unpadSegment(payload); !ok {
+					continue
+				}
+			}
+			if n, ok = conn.deliver(b, addr, payload); !ok {
+				continue
+			}
+			conn.trySendAck(conn.layer)
 		}
 		return
 	}
@@ -410,6 +1281,9 @@ func (conn *RAWConn) RemoteAddr() net.Addr {
 }
 
 func (conn *RAWConn) SetReadDeadline(t time.Time) (err error) {
+	if _, pio := conn.capture(); pio != nil {
+		return pio.SetReadDeadline(t)
+	}
 	if conn.rtimer != nil {
 		conn.rtimer.Stop()
 	}
@@ -418,10 +1292,7 @@ func (conn *RAWConn) SetReadDeadline(t time.Time) (err error) {
 }
 
 func (conn *RAWConn) SetWriteDeadline(t time.Time) (err error) {
-	if conn.wtimer != nil {
-		conn.wtimer.Stop()
-	}
-	conn.wtimer = time.NewTimer(t.Sub(time.Now()))
+	conn.wdeadline.set(t)
 	return
 }
 
@@ -434,38 +1305,27 @@ func (conn *RAWConn) SetDeadline(t time.Time) (err error) {
 }
 
 func (r *Raw) dialRAWDummy(address string) (conn *RAWConn, err error) {
-	ifaces, err := pcap.FindAllDevs()
-	if err != nil {
-		return
-	}
-	udp, err := net.Dial("udp4", address)
+	udp, err := r.dialUDP(address, nil)
 	if err != nil {
 		return
 	}
 	defer udp.Close()
-	var ifaceName string
-	for _, iface := range ifaces {
-		for _, addr := range iface.Addresses {
-			if addr.IP.Equal(udp.LocalAddr().(*net.UDPAddr).IP) {
-				ifaceName = iface.Name
-			}
-		}
-	}
-	if len(ifaceName) == 0 {
-		err = errors.New("cannot find correct interface")
+	in, err := r.chooseInterface(udp.LocalAddr().(*net.UDPAddr).IP)
+	if err != nil {
 		return
 	}
-	handle, err := pcap.OpenLive(ifaceName, maxCapLimit, false, maxCapTimeout)
+	handle, err := r.openCapture(in.Name, linkMTU(udp.LocalAddr().(*net.UDPAddr).IP))
 	if err != nil {
 		return
 	}
 	filter := "tcp and src host " + udp.RemoteAddr().(*net.UDPAddr).IP.String() +
 		" and src port " + strconv.Itoa(udp.RemoteAddr().(*net.UDPAddr).Port)
-	err = handle.SetBPFFilter(filter)
+	err = handle.SetBPFFilter(r.captureFilter(filter))
 	if err != nil {
 		return
 	}
 	conn = &RAWConn{
+		ipid:       r.newIPID(),
 		buffer:     gopacket.NewSerializeBuffer(),
 		handle:     handle,
 		isLoopBack: udp.LocalAddr().(*net.UDPAddr).IP.IsLoopback(),
@@ -487,6 +1347,8 @@ func (r *Raw) dialRAWDummy(address string) (conn *RAWConn, err error) {
 		die:      make(chan struct{}),
 		rcond:    &sync.Cond{L: &sync.Mutex{}},
 	}
+	conn.limiter = newRateLimiter(r.Rate, r.PacketRate, r.Pacing)
+	conn.squeue = r.newSendQueue(conn.die, &conn.sendc)
 	//go conn.reader()
 	defer func() {
 		if err != nil {
@@ -537,9 +1399,9 @@ func (r *Raw) dialRAWDummy(address string) (conn *RAWConn, err error) {
 					layersArrayString += fmt.Sprintf("{%d %d %v %v} ", int(layer.tcp.SrcPort), int(layer.tcp.DstPort),
 						layer.ip4.SrcIP.Equal(tcpRemoteAddr.IP), layer.ip4.DstIP.Equal(tcpLocalAddr.IP))
 				}
-				err = fmt.Errorf("retry too many times and con't capture anything\n"+
+				err = fmt.Errorf("%w and con't capture anything\n"+
 					"len(layersArray)=%d\n"+"tcpRemoteAddr.Port=%d\ntcpLocalAddr.Port=%d\n"+
-					"layersArray:\n%s\n", len(layersArray), tcpRemoteAddr.Port, tcpLocalAddr.Port, layersArrayString)
+					"layersArray:\n%s\n", ErrHandshakeTimeout, len(layersArray), tcpRemoteAddr.Port, tcpLocalAddr.Port, layersArrayString)
 				return
 			}
 		}
@@ -554,7 +1416,7 @@ func (r *Raw) dialRAWDummy(address string) (conn *RAWConn, err error) {
 		select {
 			case <-timeoutChan: break
 			case <-time.After(connectTimeout * time.Second):
-				err = errors.New("tcp connect timeout")
+				err = ErrHandshakeTimeout
 				return 
 		}
 		//
@@ -578,10 +1440,10 @@ func (r *Raw) dialRAWDummy(address string) (conn *RAWConn, err error) {
 			DstIP:    tcpRemoteAddr.IP,
 			Protocol: layers.IPProtocolTCP,
 			Version:  0x4,
-			Id:       uint16(ran.Int() % 65536),
+			Id:       uint16(r.random().Intn(65536)),
 			Flags:    layers.IPv4DontFragment,
-			TTL:      0x40,
-			TOS:      uint8(r.DSCP),
+			TTL:      uint8(r.ttl()),
+			TOS:      uint8(r.tos()),
 		},
 		tcp: &layers.TCP{
 			SrcPort: layers.TCPPort(tcpLocalAddr.Port),
@@ -607,139 +1469,35 @@ func (r *Raw) dialRAWDummy(address string) (conn *RAWConn, err error) {
 		" and src port " + strconv.Itoa(int(conn.layer.tcp.DstPort)) +
 		" and dst host " + conn.layer.ip4.SrcIP.String() +
 		" and dst port " + strconv.Itoa(int(conn.layer.tcp.SrcPort))
-	err = handle.SetBPFFilter(filter)
+	err = handle.SetBPFFilter(r.captureFilter(filter))
 	if err != nil {
 		return
 	}
-	var cl *pktLayers
-	tcp := conn.layer.tcp
 	defer func() { conn.rtimer = nil }()
-	if r.NoHTTP && !r.TLS {
+	if r.NoHTTP && !r.TLS && r.profile() == profileNone {
 		return
 	}
-	var req []byte
-	var host string
-	if len(r.Hosts) == 0 {
-		if len(r.Host) != 0 {
-			r.Hosts = strings.Split(r.Host, ",")
-		}
-	}
-	if len(r.Hosts) > 0 {
-		host = r.Hosts[ran.Int()%len(r.Hosts)]
-	}
-	if r.TLS {
-		b := utils.GetBuf(2048)
-		defer utils.PutBuf(b)
-		utils.PutRandomBytes(b[1816:])
-		tlsLen := utils.GenTLSClientHello(b, host, b[2016:], b[1816:1816+ran.Intn(200)])
-		req = b[:tlsLen]
-	} else {
-		if tcpRemoteAddr.Port != 80 {
-			host += strconv.Itoa(tcpRemoteAddr.Port)
-		}
-		headers := "Host: " + host + "\r\n"
-		headers += "X-Online-Host: " + host + "\r\n"
-		req = utils.StringToSlice(buildHTTPRequest(headers))
-	}
-	retry = 0
-	needretry := true
-	var starttime time.Time
-out:
-	for {
-		if retry > 25 {
-			err = errors.New("retry too many times")
-			return
-		}
-		if needretry {
-			starttime = time.Now()
-			needretry = false
-			retry++
-			_, err = conn.write(req)
-			if err != nil {
-				return
-			}
-		}
-		err = conn.SetReadDeadline(time.Now().Add(time.Millisecond * time.Duration(200+int(ran.Int63()%100))))
-		if err != nil {
-			return
-		}
-		cl, err = conn.readLayers()
-		if err != nil {
-			e, ok := err.(net.Error)
-			if !ok || !e.Temporary() {
-				return
-			}
-			needretry = true
-			continue out
-		}
-		n := len(cl.payload)
-		if cl.tcp.PSH && cl.tcp.ACK && n >= 20 {
-			var ok bool
-			if r.TLS {
-				ok, _, _ = utils.ParseTLSServerHelloMsg(cl.payload)
-			} else {
-				head := string(cl.payload[:4])
-				tail := string(cl.payload[n-4:])
-				if head == "HTTP" && tail == "\r\n\r\n" {
-					ok = true
-				}
-			}
-			if ok {
-				conn.hseqn = cl.tcp.Seq
-				tcp.Seq += uint32(len(req))
-				tcp.Ack = cl.tcp.Seq + uint32(n)
-				break out
-			}
-		}
-		if time.Now().After(starttime.Add(time.Millisecond * 500)) {
-			needretry = true
-		}
-	}
+	err = conn.requestPhase(nil, tcpRemoteAddr.Port)
 	return
 }
 
-func (r *Raw) DialRAW(address string) (conn *RAWConn, err error) {
-	if r.Dummy {
+func (r *Raw) dialRAW(address string, sid []byte, resume *sessionState) (conn *RAWConn, err error) {
+	if r.Dummy && r.PacketIO == nil {
 		return r.dialRAWDummy(address)
 	}
-	ifaces, err := pcap.FindAllDevs()
-	if err != nil {
-		return
-	}
-	udp, err := net.Dial("udp4", address)
+	udp, err := r.dialLocalPort(address, resume.localAddr())
 	if err != nil {
 		return
 	}
-	defer func() {
-		if udp != nil {
-			udp.Close()
-		}
-	}()
 	ulocaladdr := udp.LocalAddr().(*net.UDPAddr)
-	localaddr := &net.IPAddr{IP: ulocaladdr.IP}
 	uremoteaddr := udp.RemoteAddr().(*net.UDPAddr)
-	remoteaddr := &net.IPAddr{IP: uremoteaddr.IP}
-	var ifaceName string
-	for _, iface := range ifaces {
-		for _, addr := range iface.Addresses {
-			if addr.IP.Equal(ulocaladdr.IP) {
-				ifaceName = iface.Name
-			}
-		}
-	}
-	if len(ifaceName) == 0 {
-		err = errors.New("cannot find correct interface")
-		return
-	}
-	handle, err := pcap.OpenLive(ifaceName, maxCapLimit, false, maxCapTimeout)
-	if err != nil {
-		return
-	}
 	conn = &RAWConn{
+		ipid:       r.newIPID(),
+		mtu:        linkMTU(ulocaladdr.IP),
 		udp:        udp,
+		pio:        r.PacketIO,
 		buffer:     gopacket.NewSerializeBuffer(),
-		handle:     handle,
-		isLoopBack: udp.LocalAddr().(*net.UDPAddr).IP.IsLoopback(),
+		isLoopBack: ulocaladdr.IP.IsLoopback(),
 		layersChan: make(chan *pktLayers, maxLayersChanLen),
 		opts: gopacket.SerializeOptions{
 			FixLengths:       true,
@@ -747,29 +1505,31 @@ func (r *Raw) DialRAW(address string) (conn *RAWConn, err error) {
 		},
 		layer: &pktLayers{
 			ip4: &layers.IPv4{
-				SrcIP:    localaddr.IP,
-				DstIP:    remoteaddr.IP,
+				SrcIP:    ulocaladdr.IP,
+				DstIP:    uremoteaddr.IP,
 				Protocol: layers.IPProtocolTCP,
 				Version:  0x4,
-				Id:       uint16(ran.Int63() % 65536),
+				Id:       uint16(r.random().Intn(65536)),
 				Flags:    layers.IPv4DontFragment,
-				TTL:      0x40,
-				TOS:      uint8(r.DSCP),
+				TTL:      uint8(r.ttl()),
+				TOS:      uint8(r.tos()),
 			},
 			tcp: &layers.TCP{
 				SrcPort: layers.TCPPort(ulocaladdr.Port),
 				DstPort: layers.TCPPort(uremoteaddr.Port),
-				Window:  12580,
+				Window:  synWindow(r.window(dialWindow)),
 				Ack:     0,
 			},
 		},
 		r:        r,
-		linktype: handle.LinkType(),
+		linktype: layers.LinkTypeRaw,
 		die:      make(chan struct{}),
 		rcond:    &sync.Cond{L: &sync.Mutex{}},
+		sid:      sid,
 	}
-	udp = nil
-	
+	conn.limiter = newRateLimiter(r.Rate, r.PacketRate, r.Pacing)
+	conn.squeue = r.newSendQueue(conn.die, &conn.sendc)
+	conn.layer.tcp.Seq = r.isn(conn.layer.ip4.SrcIP, int(conn.layer.tcp.SrcPort), conn.layer.ip4.DstIP, int(conn.layer.tcp.DstPort))
 	defer func() {
 		if err != nil {
 			conn.Close()
@@ -777,246 +1537,191 @@ func (r *Raw) DialRAW(address string) (conn *RAWConn, err error) {
 			conn.nocopy = true
 		}
 	}()
-	var eth *layers.Ethernet
-	if ulocaladdr.IP.String() != "127.0.0.1" {
-		buf := make([]byte, 32)
-		binary.Read(rand.Reader, binary.LittleEndian, buf)
-		var uconn *net.UDPConn
-		uconn, err = net.DialUDP("udp4", nil, &net.UDPAddr{IP: net.IPv4(8, 8, buf[0], buf[1]), Port: int(binary.LittleEndian.Uint16(buf[2:4]))})
-		if err != nil {
+	if conn.pio == nil {
+		if err = conn.dialCapture(ulocaladdr, uremoteaddr); err != nil {
 			return
 		}
-		defer uconn.Close()
-		filter := "udp and src port " + strconv.Itoa(uconn.LocalAddr().(*net.UDPAddr).Port) +
-			" and dst host " + uconn.RemoteAddr().(*net.UDPAddr).IP.String() +
-			" and dst port " + strconv.Itoa(uconn.RemoteAddr().(*net.UDPAddr).Port)
-		err = handle.SetBPFFilter(filter)
-		if err != nil {
-			return
+	}
+	if resume != nil {
+		resume.restore(conn)
+		return
+	}
+	defer func() {
+		conn.rtimer = nil
+		if conn.pio != nil {
+			conn.pio.SetReadDeadline(time.Time{})
 		}
+	}()
+	err = conn.handshake(sid, uremoteaddr.Port)
+	return
+}
 
-		sigch := make(chan bool)
-
-		go func() {
-			<-sigch
-			_, err = uconn.Write(buf)
-			if err != nil {
+// dialCapture opens the capture of a connection dialed from local to
+// remote, learns the Ethernet header its packets go out with, and has the
+// system drop the RSTs it would answer the peer with.
+func (conn *RAWConn) dialCapture(local, remote *net.UDPAddr) (err error) {
+	r := conn.r
+	in, err := r.chooseInterface(local.IP)
+	if err != nil {
+		return
+	}
+	handle, err := r.openCapture(in.Name, conn.mtu)
+	if err != nil {
+		return
+	}
+	conn.handle = handle
+	conn.linktype = handle.LinkType()
+	var eth *layers.Ethernet
+	if !isLoopbackLink(conn.linktype) {
+		if eth, err = r.resolveEthernet(in.Name, local.IP, remote.IP); err != nil {
+			if eth, err = conn.sniffEthernet(); err != nil {
 				return
 			}
-		}()
-
-		conn.SetReadDeadline(time.Now().Add(time.Second * 2))
-
-		var packet gopacket.Packet
-		packet, err = conn.readPacket()
-		if err != nil {
-			return
-		}
-
-		ethLayer := packet.Layer(layers.LayerTypeEthernet)
-		loopLayer := packet.Layer(layers.LayerTypeLoopback)
-		if ethLayer != nil {
-			eth, _ = ethLayer.(*layers.Ethernet)
-		} else if loopLayer == nil {
-			return
 		}
 	}
 	//go conn.reader()
 	conn.layer.eth = eth
-	filter := "tcp and src host " + remoteaddr.String() +
-		" and src port " + strconv.Itoa(uremoteaddr.Port) +
-		" and dst host " + localaddr.String() +
-		" and dst port " + strconv.Itoa(ulocaladdr.Port)
-	err = handle.SetBPFFilter(filter)
+	if r.Checksums == ChecksumAuto {
+		var packet gopacket.Packet
+		if packet, err = conn.sniffOwn(); err != nil {
+			return
+		}
+		conn.offload = partialUDPChecksum(packet)
+	}
+	filter := "tcp and src host " + remote.IP.String() +
+		" and src port " + strconv.Itoa(remote.Port) +
+		" and dst host " + local.IP.String() +
+		" and dst port " + strconv.Itoa(local.Port)
+	err = handle.SetBPFFilter(r.captureFilter(filter))
 	if err != nil {
 		return
 	}
-	tcp := conn.layer.tcp
-	var cl *pktLayers
-	binary.Read(rand.Reader, binary.LittleEndian, &(conn.layer.tcp.Seq))
+	conn.device, conn.filter = in.Name, filter
 	if runtime.GOOS == "darwin" {
 		cmd := exec.Command("sh", "-c", fmt.Sprintf("echo block drop out proto tcp from %s port %d to %s port %d flags R/R >> /etc/pf.conf && pfctl -f /etc/pf.conf",
-			localaddr.String(), ulocaladdr.Port, remoteaddr.String(), uremoteaddr.Port))
+			local.IP.String(), local.Port, remote.IP.String(), remote.Port))
 		_, err = cmd.CombinedOutput()
 		if err == nil {
 			exec.Command("pfctl", "-e").Run()
 			cleaner := &utils.ExitCleaner{}
-			filename := randStringBytesMaskImprSrc(20)
+			filename := randStringBytesMaskImprSrc(utils.Random{}, 20)
 			clean := exec.Command("sh", "-c", fmt.Sprintf("cat /etc/pf.conf | grep -v "+
 				"'block drop out proto tcp from %s port %d to %s port %d flags R/R' > /tmp/%s.conf && mv /tmp/%s.conf /etc/pf.conf"+
 				" && pfctl -f /etc/pf.conf",
-				localaddr.String(), ulocaladdr.Port, remoteaddr.String(), uremoteaddr.Port, filename, filename))
+				local.IP.String(), local.Port, remote.IP.String(), remote.Port, filename, filename))
 			cleaner.Push(func() {
 				clean.Run()
 				exec.Command("pfctl", "-e").Run()
 			})
 			conn.cleaner = cleaner
 		}
-	} else if runtime.GOOS == "windows" {
-
 	}
-	retry := 0
-	var ackn uint32
-	var seqn uint32
-	defer func() { conn.rtimer = nil }()
-	for {
-		if retry > 5 {
-			err = errors.New("retry too many times")
-			return
-		}
-		retry++
-		err = conn.sendSyn()
+	return nil
+}
+
+// chooseInterface returns the pcap device to capture on for the local
+// address ip. With Raw.Interface set it is the device of that interface.
+func (r *Raw) chooseInterface(ip net.IP) (in pcap.Interface, err error) {
+	ips := []net.IP{ip}
+	if r.Interface != "" {
+		iface, err := net.InterfaceByName(r.Interface)
 		if err != nil {
-			return
+			return in, err
 		}
-		conn.SetReadDeadline(time.Now().Add(time.Millisecond * time.Duration(500+int(ran.Int63()%500))))
-		cl, err = conn.readLayers()
+		addrs, err := iface.Addrs()
 		if err != nil {
-			e, ok := err.(net.Error)
-			if !ok || !e.Temporary() {
-				return
-			}
-			continue
+			return in, err
 		}
-		if cl.tcp.SYN && cl.tcp.ACK {
-			tcp.Ack = cl.tcp.Seq + 1
-			tcp.Seq++
-			ackn = tcp.Ack
-			seqn = tcp.Seq
-			conn.mss = getMssFromTcpLayer(cl.tcp)
-			err = conn.sendAck()
-			if err != nil {
-				return
+		ips = ips[:0]
+		for _, addr := range addrs {
+			if ipnet, ok := addr.(*net.IPNet); ok {
+				ips = append(ips, ipnet.IP)
 			}
 		}
-		break
 	}
-	if r.NoHTTP && !r.TLS {
+	ifaces, err := pcap.FindAllDevs()
+	if err != nil {
 		return
 	}
-	var req []byte
-	var host string
-	if len(r.Hosts) == 0 {
-		if len(r.Host) != 0 {
-			r.Hosts = strings.Split(r.Host, ",")
-		}
-	}
-	if len(r.Hosts) > 0 {
-		host = r.Hosts[ran.Int()%len(r.Hosts)]
-	}
-	if r.TLS {
-		b := utils.GetBuf(2048)
-		defer utils.PutBuf(b)
-		utils.PutRandomBytes(b[1816:])
-		tlsLen := utils.GenTLSClientHello(b, host, b[2016:], b[1816:1816+ran.Intn(200)])
-		req = b[:tlsLen]
-	} else {
-		if uremoteaddr.Port != 80 {
-			host += strconv.Itoa(uremoteaddr.Port)
-		}
-		headers := "Host: " + host + "\r\n"
-		headers += "X-Online-Host: " + host + "\r\n"
-		req = utils.StringToSlice(buildHTTPRequest(headers))
-	}
-	retry = 0
-	needretry := true
-	var starttime time.Time
-	for {
-		if retry > 25 {
-			err = errors.New("retry too many times")
-			return
-		}
-		if needretry {
-			needretry = false
-			starttime = time.Now()
-			retry++
-			_, err = conn.write(req)
-			if err != nil {
-				return
-			}
-		}
-		err = conn.SetReadDeadline(time.Now().Add(time.Millisecond * time.Duration(200+int(ran.Int63()%100))))
-		if err != nil {
-			return
-		}
-		cl, err = conn.readLayers()
-		if err != nil {
-			e, ok := err.(net.Error)
-			if !ok || !e.Temporary() {
-				return
-			}
-			needretry = true
-			continue
-		}
-		if cl.tcp.SYN && cl.tcp.ACK {
-			tcp.Ack = ackn
-			tcp.Seq = seqn
-			err = conn.sendAck()
-			if err != nil {
-				return
-			}
-			continue
-		}
-		n := len(cl.payload)
-		if cl.tcp.PSH && cl.tcp.ACK && n >= 20 {
-			var ok bool
-			if r.TLS {
-				ok, _, _ = utils.ParseTLSServerHelloMsg(cl.payload)
-			} else {
-				head := string(cl.payload[:4])
-				tail := string(cl.payload[n-4:])
-				if head == "HTTP" && tail == "\r\n\r\n" {
-					ok = true
+	for _, iface := range ifaces {
+		for _, address := range iface.Addresses {
+			for _, ip := range ips {
+				if address.IP.Equal(ip) {
+					return iface, nil
 				}
 			}
-			if ok {
-				conn.hseqn = cl.tcp.Seq
-				tcp.Seq += uint32(len(req))
-				tcp.Ack = cl.tcp.Seq + uint32(n)
-				break
-			}
 		}
-		if time.Now().After(starttime.Add(time.Millisecond * 200)) {
-			needretry = true
+	}
+	// the Npcap Loopback Adapter may not list the loopback addresses
+	if r.Interface == "" && ip.IsLoopback() {
+		for _, iface := range ifaces {
+			if isLoopbackDevice(iface) {
+				return iface, nil
+			}
 		}
 	}
+	err = ErrNoInterface
 	return
 }
 
-func chooseInterfaceByAddr(addr string) (in pcap.Interface, err error) {
-	ifaces, err := pcap.FindAllDevs()
-	if err != nil {
-		return
+// takeOver moves the handle and sockets of n, a new connection of the same
+// session, into conn and closes the old ones without telling the peer.
+func (conn *RAWConn) takeOver(n *RAWConn) {
+	conn.zrtt.stop()
+	conn.lock.Lock()
+	conn.zrtt = n.zrtt
+	udp, tcp, handle, pio, cleaner := conn.udp, conn.tcp, conn.handle, conn.pio, conn.cleaner
+	conn.udp = n.udp
+	conn.tcp = n.tcp
+	conn.slock.Lock()
+	conn.handle = n.handle
+	conn.pio = n.pio
+	conn.slock.Unlock()
+	conn.device, conn.filter = n.device, n.filter
+	conn.cleaner = n.cleaner
+	conn.layer = n.layer
+	conn.linktype = n.linktype
+	conn.isLoopBack = n.isLoopBack
+	conn.hs = n.hs
+	conn.hsinfo = n.hsinfo
+	conn.peer = n.peer
+	conn.pad = n.pad
+	old := conn.mss
+	conn.mss = n.mss
+	conn.lock.Unlock()
+	conn.mssChanged(old)
+	if cleaner != nil {
+		cleaner.Exit()
+	}
+	if udp != nil {
+		udp.Close()
+	}
+	if tcp != nil {
+		tcp.Close()
+	}
+	if handle != nil {
+		handle.Close()
+	}
+	if pio != nil && pio != n.pio {
+		pio.Close()
 	}
-	for _, iface := range ifaces {
-		for _, address := range iface.Addresses {
-			if address.IP.String() == addr {
-				in = iface
-				return
-			}
-		}
-	}
-	err = errors.New("incorrect bind address")
-	return
 }
 
 type RAWListener struct {
 	*RAWConn
-	newcons map[string]*connInfo
-	conns   map[string]*connInfo
-	mutex   myMutex
-	laddr   *net.IPAddr
-	lport   int
-}
-
-func (listener *RAWListener) GetMSSByAddr(addr net.Addr) int {
-	listener.mutex.Lock()
-	defer listener.mutex.Unlock()
-	conn, ok := listener.conns[addr.String()]
-	if ok && conn.mss > 0 {
-		return conn.mss
-	}
-	return 0
+	newcons  map[string]*connInfo
+	conns    map[string]*connInfo
+	sessions map[string]*connInfo
+	aliases  map[string]*connInfo
+	proxies  map[string]*connInfo // peers handed over by Raw.Passthrough
+	mutex    myMutex
+	laddr    *net.IPAddr
+	lport    int
+	captures []listenCapture
+	refused  atomic.Uint64
+	draining atomic.Bool
+	work     *listenWork
+	ctx      listenerContext // see PeerContext
 }
 
 func (listener *RAWListener) Close() (err error) {
@@ -1031,66 +1736,98 @@ func (listener *RAWListener) Close() (err error) {
 	// 		}
 	// 	})
 	// }
+	if len(listener.captures) > 1 {
+		for _, c := range listener.captures[1:] {
+			c.handle.Close()
+		}
+	}
 	return conn.RAWConn.Close()
 }
 
-func (listener *RAWListener) closeConn(info *connInfo) (err error) {
-	return listener.sendFinWithLayer(info.layer)
-}
-
 func (r *Raw) ListenRAW(address string) (listener *RAWListener, err error) {
-	udpaddr, err := net.ResolveUDPAddr("udp4", address)
-	if err != nil {
+	if err = r.checkShard(); err != nil {
 		return
 	}
-	if udpaddr.IP == nil || udpaddr.IP.Equal(net.IPv4(0, 0, 0, 0)) {
-		udpaddr.IP = net.IPv4(127, 0, 0, 1)
-	}
-	in, err := chooseInterfaceByAddr(udpaddr.IP.String())
+	address, ports, err := splitListenPorts(address)
 	if err != nil {
 		return
 	}
-	handle, err := pcap.OpenLive(in.Name, maxCapLimit, false, maxCapTimeout)
+	udpaddr, err := net.ResolveUDPAddr("udp4", address)
 	if err != nil {
 		return
 	}
-	filter := "tcp and dst host " + udpaddr.IP.String() +
-		" and dst port " + strconv.Itoa(udpaddr.Port)
-	err = handle.SetBPFFilter(filter)
-	if err != nil {
-		return
+	if udpaddr.IP == nil {
+		udpaddr.IP = net.IPv4zero
 	}
-	pktsrc := gopacket.NewPacketSource(handle, handle.LinkType())
 	listener = &RAWListener{
 		laddr: &net.IPAddr{IP: udpaddr.IP},
 		lport: udpaddr.Port,
 		RAWConn: &RAWConn{
-			buffer:  gopacket.NewSerializeBuffer(),
-			handle:  handle,
-			pktsrc:  pktsrc,
+			ipid:       r.newIPID(),
+			mtu:        linkMTU(udpaddr.IP),
+			buffer:     gopacket.NewSerializeBuffer(),
+			pio:        r.PacketIO,
+			lports:     ports,
 			layersChan: make(chan *pktLayers, maxLayersChanLen),
 			opts: gopacket.SerializeOptions{
 				FixLengths:       true,
 				ComputeChecksums: true,
 			},
-			r: r,
+			r:        r,
 			rcond:    &sync.Cond{L: &sync.Mutex{}},
+			die:      make(chan struct{}),
+			linktype: layers.LinkTypeRaw,
 		},
-		newcons: make(map[string]*connInfo),
-		conns:   make(map[string]*connInfo),
+		newcons:  make(map[string]*connInfo),
+		conns:    make(map[string]*connInfo),
+		sessions: make(map[string]*connInfo),
+		aliases:  make(map[string]*connInfo),
+		proxies:  make(map[string]*connInfo),
+	}
+	if listener.pio == nil {
+		if err = listener.openCaptures(udpaddr); err != nil {
+			return nil, err
+		}
+	}
+	listener.limiter = newRateLimiter(r.ListenerRate, r.ListenerPacketRate, r.Pacing)
+	listener.startEviction()
+	listener.startWindowUpdates()
+	r.startDropWatch(listener.die, nil, listener)
+	listener.watchICMP()
+	listener.startWorkers()
+	return
+}
+
+// openCaptures opens the handles of the listener on addr, and has the
+// system drop the RSTs it would answer the peers with.
+func (listener *RAWListener) openCaptures(addr *net.UDPAddr) (err error) {
+	r := listener.r
+	captures, err := r.listenCaptures(addr, listener.lports)
+	if err != nil {
+		return
+	}
+	handle := captures[0].handle
+	listener.captures = captures
+	listener.handle = handle
+	listener.pktsrc = gopacket.NewPacketSource(handle, handle.LinkType())
+	listener.linktype = handle.LinkType()
+	if len(captures) > 1 {
+		listener.fanin = make(chan capturedPacket)
+		for _, c := range captures {
+			go listener.pump(c.handle)
+		}
 	}
 	if runtime.GOOS == "darwin" {
-		cmd := exec.Command("sh", "-c", fmt.Sprintf("echo block drop out proto tcp from %s port %d to any flags R/R >> /etc/pf.conf && pfctl -f /etc/pf.conf",
-			listener.laddr.String(), listener.lport))
-		_, err = cmd.CombinedOutput()
-		if err == nil {
+		cmd := exec.Command("sh", "-c", fmt.Sprintf("echo block drop out proto tcp from %s port %s to any flags R/R >> /etc/pf.conf && pfctl -f /etc/pf.conf",
+			listener.laddr.String(), listener.lports.pf()))
+		if _, err := cmd.CombinedOutput(); err == nil {
 			exec.Command("pfctl", "-e").Run()
 			cleaner := &utils.ExitCleaner{}
-			filename := randStringBytesMaskImprSrc(20)
+			filename := randStringBytesMaskImprSrc(utils.Random{}, 20)
 			clean := exec.Command("sh", "-c", fmt.Sprintf("cat /etc/pf.conf | grep -v "+
-				"'block drop out proto tcp from %s port %d to any flags R/R' > /tmp/%s.conf && mv /tmp/%s.conf /etc/pf.conf"+
+				"'block drop out proto tcp from %s port %s to any flags R/R' > /tmp/%s.conf && mv /tmp/%s.conf /etc/pf.conf"+
 				" && pfctl -f /etc/pf.conf",
-				listener.laddr.String(), listener.lport, filename, filename))
+				listener.laddr.String(), listener.lports.pf(), filename, filename))
 			cleaner.Push(func() {
 				clean.Run()
 				exec.Command("pfctl", "-e").Run()
@@ -1098,249 +1835,372 @@ func (r *Raw) ListenRAW(address string) (listener *RAWListener, err error) {
 			listener.cleaner = cleaner
 		}
 	}
-	return
+	return nil
 }
 
-func (listener *RAWListener) closeConnByAddr(addrstr string) (err error) {
-	info, ok := listener.newcons[addrstr]
-	if ok {
-		delete(listener.newcons, addrstr)
-	} else {
-		info, ok = listener.conns[addrstr]
-		if ok {
-			delete(listener.conns, addrstr)
-		}
-	}
-	if info != nil {
-		err = listener.closeConn(info)
-	}
-	return
+// listenCapture is a pcap handle of a listener and its filter.
+type listenCapture struct {
+	handle *pcap.Handle
+	device string
+	filter string
+	info   InterfaceInfo
 }
 
-func (listener *RAWListener) ReadFrom(b []byte) (n int, addr net.Addr, err error) {
-	for {
-		var cl *pktLayers
-		cl, err = listener.readLayers()
-		if err != nil {
-			return
-		}
-		tcp := cl.tcp
-		listener.layer = nil
-		uaddr := &net.UDPAddr{
-			IP:   cl.ip4.SrcIP,
-			Port: int(tcp.SrcPort),
-		}
-		addr = uaddr
-		addrstr := uaddr.String()
-		if tcp.RST || tcp.FIN {
-			listener.mutex.run(func() {
-				err = listener.closeConnByAddr(addrstr)
-			})
+// listenCaptures opens the handles of a listener on addr and ports. A
+// wildcard address gets one for every interface with an IPv4 address but the
+// loopback, or for Raw.Interface alone if it is set.
+func (r *Raw) listenCaptures(addr *net.UDPAddr, ports portRanges) (captures []listenCapture, err error) {
+	var devs []pcap.Interface
+	if addr.IP.Equal(net.IPv4zero) {
+		if r.Interface != "" {
+			in, err := r.chooseInterface(nil)
 			if err != nil {
-				return
-			}
-			continue
-		}
-		var info *connInfo
-		var ok bool
-		listener.mutex.run(func() {
-			info, ok = listener.conns[addrstr]
-		})
-		n = len(cl.payload)
-		if ok && n != 0 {
-			if uint64(tcp.Seq)+uint64(n) > uint64(info.layer.tcp.Ack) {
-				info.layer.tcp.Ack = tcp.Seq + uint32(n)
+				return nil, err
 			}
-			if info.state == httprepsent {
-				if tcp.PSH && tcp.ACK {
-					if tcp.Seq == info.hseqn && n > 20 {
-						ok := false
-						if listener.r.TLS || listener.r.Mixed {
-							ok, _, _ = utils.ParseTLSClientHelloMsg(cl.payload)
-						} else {
-							head := string(cl.payload[:4])
-							tail := string(cl.payload[n-4:])
-							if head == "POST" && tail == "\r\n\r\n" {
-								ok = true
-							}
-						}
-						if ok {
-							info.layer.tcp.Ack = tcp.Seq + uint32(n)
-							info.layer.tcp.Seq += uint32(len(info.rep))
-							_, err = listener.writeWithLayer(info.rep, info.layer)
-							if err != nil {
-								return
-							}
-						}
-					} else {
-						info.layer.tcp.Seq += uint32(len(info.rep))
-						info.rep = nil
-						info.state = established
-					}
-				} else {
-					// listener.layer = info.layer
-					// listener.sendFin()
-				}
+			devs = append(devs, in)
+		} else {
+			all, err := pcap.FindAllDevs()
+			if err != nil {
+				return nil, err
 			}
-			if info.state == established {
-				if info.tls {
-					if len(cl.payload) < 5 {
-						continue
-					}
-					n = copy(b, cl.payload[5:])
-				} else {
-					n = copy(b, cl.payload)
+			for _, in := range all {
+				if !isLoopbackDevice(in) && len(ipv4Hosts(in)) > 0 {
+					devs = append(devs, in)
 				}
-				return
 			}
-			continue
 		}
-		if ok && n == 0 {
-			if tcp.ACK && tcp.PSH {
-				return
-			}
-			continue
+	} else {
+		in, err := r.chooseInterface(addr.IP)
+		if err != nil {
+			return nil, err
 		}
-		listener.mutex.run(func() {
-			info, ok = listener.newcons[addrstr]
-		})
-		if ok {
-			if info.state == synreceived {
-				if tcp.ACK && !tcp.PSH && !tcp.FIN && !tcp.SYN {
-					info.layer.tcp.Seq++
-					if listener.r.NoHTTP {
-						info.state = established
-						listener.mutex.run(func() {
-							listener.conns[addrstr] = info
-							delete(listener.newcons, addrstr)
-						})
-					} else {
-						info.state = waithttpreq
-					}
-				} else if tcp.SYN && !tcp.ACK && !tcp.PSH {
-					listener.layer = info.layer
-					err = listener.sendSynAckWithLayer(info.layer)
-					if err != nil {
-						return
-					}
-				}
-			} else if info.state == waithttpreq {
-				if tcp.PSH && tcp.ACK && n > 20 {
-					if listener.r.TLS || listener.r.Mixed {
-						ok, _, msg := utils.ParseTLSClientHelloMsg(cl.payload)
-						if ok {
-							info.layer.tcp.Ack += uint32(n)
-							if info.rep == nil {
-								rep := make([]byte, 2048)
-								l := ran.Intn(128)
-								n = utils.GenTLSServerHello(rep, l, msg.SessionId)
-								info.rep = rep[:l+n]
-							}
-							info.hseqn = tcp.Seq
-						}
-					}
-					head := string(cl.payload[:4])
-					tail := string(cl.payload[n-4:])
-					if info.rep == nil && head == "POST" && tail == "\r\n\r\n" {
-						info.layer.tcp.Ack += uint32(n)
-						if info.rep == nil {
-							rep := buildHTTPResponse("")
-							info.rep = []byte(rep)
-						}
-						info.hseqn = tcp.Seq
-					}
-					if info.rep != nil {
-						_, err = listener.writeWithLayer(info.rep, info.layer)
-						if err != nil {
-							return
-						}
-						info.state = httprepsent
-						listener.mutex.run(func() {
-							listener.conns[addrstr] = info
-							delete(listener.newcons, addrstr)
-						})
-					} else if listener.r.Mixed {
-						info.layer.tcp.Ack = tcp.Seq + uint32(n)
-						info.state = established
-						listener.mutex.run(func() {
-							listener.conns[addrstr] = info
-							delete(listener.newcons, addrstr)
-						})
-						n = copy(b, cl.payload)
-						return
-					}
-				} else if tcp.SYN && !tcp.ACK && !tcp.PSH {
-					err = listener.sendSynAckWithLayer(info.layer)
-					if err != nil {
-						return
-					}
-				}
+		devs = append(devs, in)
+	}
+	if len(devs) == 0 {
+		return nil, ErrNoInterface
+	}
+	defer func() {
+		if err != nil {
+			for _, c := range captures {
+				c.handle.Close()
 			}
-			continue
+			captures = nil
 		}
-		layer := &pktLayers{
-			eth: nil,
-			ip4: &layers.IPv4{
-				SrcIP:    cl.ip4.DstIP,
-				DstIP:    cl.ip4.SrcIP,
-				Protocol: layers.IPProtocolTCP,
-				Version:  0x4,
-				Id:       uint16(ran.Int63() % 65536),
-				Flags:    layers.IPv4DontFragment,
-				TTL:      0x40,
-				TOS:      uint8(listener.r.DSCP),
-			},
-			tcp: &layers.TCP{
-				SrcPort: cl.tcp.DstPort,
-				DstPort: cl.tcp.SrcPort,
-				Window:  32760,
-				Ack:     cl.tcp.Seq + 1,
-			},
+	}()
+	for _, in := range devs {
+		hosts := []string{addr.IP.String()}
+		if addr.IP.Equal(net.IPv4zero) {
+			hosts = ipv4Hosts(in)
 		}
-		if cl.eth != nil {
-			layer.eth = &layers.Ethernet{
-				DstMAC:       cl.eth.SrcMAC,
-				SrcMAC:       cl.eth.DstMAC,
-				EthernetType: cl.eth.EthernetType,
-			}
+		mtu := 0
+		for _, host := range hosts {
+			mtu = max(mtu, linkMTU(net.ParseIP(host)))
 		}
-		if tcp.SYN && !tcp.ACK && !tcp.PSH && !tcp.FIN {
-			info := &connInfo{
-				state: synreceived,
-				layer: layer,
-				mss:   getMssFromTcpLayer(tcp),
-			}
-			binary.Read(rand.Reader, binary.LittleEndian, &(info.layer.tcp.Seq))
-			err = listener.sendSynAckWithLayer(info.layer)
-			if err != nil {
-				return
+		var handle *pcap.Handle
+		if handle, err = r.openCapture(in.Name, mtu); err != nil {
+			return
+		}
+		info := interfaceInfo(net.ParseIP(hosts[0]), handle.LinkType().String())
+		info.MTU = mtu
+		c := listenCapture{
+			handle: handle,
+			device: in.Name,
+			info:   info,
+			filter: "tcp and (dst host " + strings.Join(hosts, " or dst host ") +
+				") and " + ports.pcapFilter("dst") + r.shardFilter(),
+		}
+		captures = append(captures, c)
+		if err = handle.SetBPFFilter(r.captureFilter(c.filter)); err != nil {
+			return
+		}
+	}
+	return
+}
+
+// pcap_if_t flags
+const pcapIfLoopback = 0x1
+
+func ipv4Hosts(in pcap.Interface) (hosts []string) {
+	for _, address := range in.Addresses {
+		if address.IP.To4() != nil {
+			hosts = append(hosts, address.IP.String())
+		}
+	}
+	return
+}
+
+// CaptureStats adds up the counters of the handles of the listener.
+func (listener *RAWListener) CaptureStats() (stats CaptureStats, err error) {
+	for _, c := range listener.captures {
+		s, err := c.handle.Stats()
+		if err != nil {
+			return stats, err
+		}
+		stats.Received += s.PacketsReceived
+		stats.Dropped += s.PacketsDropped
+		stats.IfDropped += s.PacketsIfDropped
+	}
+	stats.QueueDropped = listener.queueDropped()
+	stats.Malformed = int(listener.malformed.Load())
+	stats.BadChecksum = int(listener.badsum.Load())
+	return
+}
+
+// growCapture reopens the handle of a listener on a single interface with
+// a buffer of bytes, see Raw.MaxCaptureBuffer.
+func (listener *RAWListener) growCapture(bytes int) (err error) {
+	if len(listener.captures) != 1 {
+		return errNoCaptureGrow
+	}
+	c := &listener.captures[0]
+	handle, err := listener.r.openCaptureBuffer(c.device, c.info.MTU, bytes)
+	if err != nil {
+		return
+	}
+	if err = handle.SetBPFFilter(listener.r.captureFilter(c.filter)); err != nil {
+		handle.Close()
+		return
+	}
+	var old *pcap.Handle
+	listener.mutex.run(func() {
+		old = c.handle
+		c.handle = handle
+		listener.lock.Lock()
+		listener.handle = handle
+		listener.lock.Unlock()
+		err = listener.updateFilter()
+	})
+	old.Close()
+	return
+}
+
+// updateFilter narrows the capture filter down to the current peers if
+// Raw.TightFilter is set, the caller must hold listener.mutex.
+func (listener *RAWListener) updateFilter() error {
+	if !listener.r.TightFilter {
+		return nil
+	}
+	var filter string
+	if len(listener.newcons)+len(listener.conns)+len(listener.proxies) <= maxFilterPeers {
+		peers := []string{"tcp[tcpflags] & (tcp-syn|tcp-ack) == tcp-syn"}
+		for _, m := range []map[string]*connInfo{listener.newcons, listener.conns, listener.proxies} {
+			for addrstr := range m {
+				host, port, err := net.SplitHostPort(addrstr)
+				if err != nil {
+					continue
+				}
+				peers = append(peers, "(src host "+host+" and src port "+port+")")
 			}
-			listener.mutex.run(func() {
-				listener.newcons[addrstr] = info
-			})
-		} else {
-			listener.layer = layer
-			listener.sendFinWithLayer(layer)
 		}
+		filter = " and (" + strings.Join(peers, " or ") + ")"
 	}
+	for _, c := range listener.captures {
+		if err := c.handle.SetBPFFilter(listener.r.captureFilter(c.filter + filter)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// listenPacket is a packet read by a listener.
+type listenPacket struct {
+	layer *pktLayers
+	err   error
+}
+
+func (listener *RAWListener) readPacket() listenPacket {
+	layer, err := listener.readLayers()
+	if layer != nil {
+		listener.checkCE(layer.ip4.TOS, &net.UDPAddr{IP: layer.ip4.SrcIP, Port: int(layer.tcp.SrcPort)})
+	}
+	return listenPacket{layer: layer, err: err}
+}
+
+// detach copies what p shares with the decoders and the capture buffer.
+func (p *listenPacket) detach() {
+	l := p.layer
+	if l == nil {
+		return
+	}
+	d := *l
+	if l.eth != nil {
+		eth := *l.eth
+		eth.SrcMAC = append(net.HardwareAddr(nil), eth.SrcMAC...)
+		eth.DstMAC = append(net.HardwareAddr(nil), eth.DstMAC...)
+		eth.Contents, eth.Payload = nil, nil
+		d.eth = &eth
+	}
+	ip4 := *l.ip4
+	ip4.SrcIP = append(net.IP(nil), ip4.SrcIP...)
+	ip4.DstIP = append(net.IP(nil), ip4.DstIP...)
+	ip4.Options = nil
+	ip4.Contents, ip4.Payload = nil, nil
+	d.ip4 = &ip4
+	tcp := *l.tcp
+	tcp.Options = make([]layers.TCPOption, len(l.tcp.Options))
+	for i, opt := range l.tcp.Options {
+		opt.OptionData = append([]byte(nil), opt.OptionData...)
+		tcp.Options[i] = opt
+	}
+	tcp.Padding = nil
+	tcp.Contents, tcp.Payload = nil, nil
+	d.tcp = &tcp
+	d.payload = append([]byte(nil), l.payload...)
+	p.layer = &d
+}
+
+// peer returns the address p comes from, nil if it is an error.
+func (p *listenPacket) peer() (net.IP, int) {
+	if p.layer == nil {
+		return nil, 0
+	}
+	return p.layer.ip4.SrcIP, int(p.layer.tcp.SrcPort)
+}
+
+func (listener *RAWListener) ReadFrom(b []byte) (n int, addr net.Addr, err error) {
+	if n, addr, ok := listener.rqueue.pop(b); ok {
+		return n, addr, nil
+	}
+	if listener.work != nil {
+		return listener.readWork(b)
+	}
+	return listener.doRead(b, listener.readPacket)
+}
+
+// segment returns the segment of p, false if it has none.
+func (p *listenPacket) segment() (seg segment, ok bool) {
+	l := p.layer
+	if l == nil {
+		return
+	}
+	seg = segmentOf(l.tcp, l.payload)
+	seg.src = &net.UDPAddr{IP: l.ip4.SrcIP, Port: int(l.tcp.SrcPort)}
+	seg.dst, seg.ttl = l.ip4.DstIP, l.ip4.TTL
+	return seg, true
+}
+
+// peerLayer returns the layer to answer the sender of seg with, on the
+// handle and with the link addresses it came with.
+func (listener *RAWListener) peerLayer(p *listenPacket, seg *segment) *pktLayers {
+	cl := p.layer
+	layer := &pktLayers{
+		handle: cl.handle,
+		ip4: &layers.IPv4{
+			SrcIP:    cl.ip4.DstIP,
+			DstIP:    cl.ip4.SrcIP,
+			Protocol: layers.IPProtocolTCP,
+			Version:  0x4,
+			Id:       uint16(listener.r.random().Intn(65536)),
+			Flags:    layers.IPv4DontFragment,
+			TTL:      uint8(listener.r.ttl()),
+			TOS:      uint8(listener.r.tos()),
+		},
+		tcp: &layers.TCP{
+			SrcPort: cl.tcp.DstPort,
+			DstPort: cl.tcp.SrcPort,
+			Window:  synWindow(listener.r.window(listenWindow)),
+			Ack:     cl.tcp.Seq + 1,
+		},
+	}
+	if cl.eth != nil {
+		layer.eth = &layers.Ethernet{
+			DstMAC:       cl.eth.SrcMAC,
+			SrcMAC:       cl.eth.DstMAC,
+			EthernetType: cl.eth.EthernetType,
+		}
+	}
+	return layer
 }
 
 func (listener *RAWListener) WriteTo(b []byte, addr net.Addr) (n int, err error) {
-	listener.mutex.Lock()
-	info, ok := listener.conns[addr.String()]
-	listener.mutex.Unlock()
+	listener.mutex.RLock()
+	info, ok := listener.connByAddr(addr.String())
+	listener.mutex.RUnlock()
 	if !ok {
-		return 0, errors.New("cannot write to " + addr.String())
+		return 0, &AddrError{Op: "write", Addr: addr, Err: ErrNoConn}
+	}
+	limit := info.payloadLimit()
+	if info.coalescer != nil {
+		limit -= coalesceHeaderLen
 	}
-	if info.tls {
+	if len(b) > limit {
+		return 0, &MessageTooLongError{Size: len(b), Limit: limit}
+	}
+	if info.shaper != nil {
+		return len(b), info.shaper.write(b)
+	}
+	if info.coalescer != nil {
+		return len(b), info.coalescer.write(b)
+	}
+	return listener.wdeadline.write(listener.r, info.squeue, func() net.Addr { return addr }, b, func(b []byte, deadline time.Time) (int, error) {
+		return listener.writeSegment(b, info, 0, deadline)
+	})
+}
+
+// writeSegment sends b to the peer of info in a segment of its own.
+func (listener *RAWListener) writeSegment(b []byte, info *connInfo, tos int, deadline time.Time) (n int, err error) {
+	if listener.r.windowShut(&info.zerownd) {
+		return len(b), nil
+	}
+	if !paceUntil(deadline, len(b), 1, info.limiter, listener.limiter) {
+		return 0, &timeoutErr{op: "write to " + info.addr.String()}
+	}
+	if info.u2r != nil {
+		sealed := info.u2r.sealLocked(udp2rawData, b)
+		defer utils.PutBuf(sealed)
+		if _, err = listener.writeInfoTOS(sealed, info, tos); err != nil {
+			return 0, err
+		}
+		return len(b), nil
+	}
+	n = len(b)
+	mss, tls, prof := info.framing()
+	if info.pad > 0 {
+		b = padSegment(listener.r.random(), b, info.pad, payloadLimit(mss, recordLen(tls, prof), nil, info.pad)-n)
+		defer utils.PutBuf(b)
+	}
+	if tls {
 		buf := utils.GetBuf(len(b) + 5)
 		defer utils.PutBuf(buf)
 		copy(buf, []byte{0x17, 0x3, 0x3})
 		binary.BigEndian.PutUint16(buf[3:5], uint16(len(b)))
 		copy(buf[5:], b)
 		b = buf[:5+len(b)]
+	} else if prof != profileNone {
+		b = prof.seal(listener.r.random(), b, true)
+		defer utils.PutBuf(b)
+	}
+	if _, err = listener.writeInfoTOS(b, info, tos); err != nil {
+		return 0, err
+	}
+	return
+}
+
+// writeSegments sends each b to the peer of info in a segment of its own,
+// it returns how many of them went out.
+func (listener *RAWListener) writeSegments(info *connInfo, bs [][]byte) (n int, err error) {
+	info.lock.Lock()
+	defer info.lock.Unlock()
+	for _, b := range bs {
+		if _, err = listener.writeWithLayer(b, info.layer); err != nil {
+			return
+		}
+		info.layer.tcp.Seq += uint32(len(b))
+		n++
 	}
+	return
+}
+
+func (listener *RAWListener) writeInfo(b []byte, info *connInfo) (n int, err error) {
+	return listener.writeInfoTOS(b, info, 0)
+}
+
+func (listener *RAWListener) writeInfoTOS(b []byte, info *connInfo, tos int) (n int, err error) {
+	info.lock.Lock()
+	defer info.lock.Unlock()
+	info.layer.tos = tos
 	n, err = listener.writeWithLayer(b, info.layer)
+	info.layer.tos = 0
 	info.layer.tcp.Seq += uint32(n)
 	return
 }
@@ -1352,19 +2212,69 @@ func (listener *RAWListener) LocalAddr() net.Addr {
 	}
 }
 
+// GetLocalInterfaceInfo returns the interfaces the listener captures on.
+func (listener *RAWListener) GetLocalInterfaceInfo() (infos []InterfaceInfo) {
+	if listener.pio != nil {
+		return []InterfaceInfo{interfaceInfo(listener.laddr.IP, "PacketIO")}
+	}
+	for _, c := range listener.captures {
+		infos = append(infos, c.info)
+	}
+	return
+}
+
 type pktLayers struct {
 	eth         *layers.Ethernet
 	ip4         *layers.IPv4
 	tcp         *layers.TCP
 	payload 	[]byte
+	// handle is the one the packets of a listener's peer come in on, if
+	// the listener captures on several
+	handle      *pcap.Handle
 	lastack     uint32
 	lastacktime time.Time
+	tos         int // plus one, zero for the TOS of the connection
+	tmpl        *headerTemplate
+	tag         *segmentTag // of the segments of a dialed connection
+}
+
+func (layer *pktLayers) setDst(addr *net.UDPAddr) {
+	layer.ip4.DstIP = addr.IP
+	layer.tcp.DstPort = layers.TCPPort(addr.Port)
 }
+
 type connInfo struct {
 	state uint32
 	layer *pktLayers
 	rep   []byte
-	hseqn uint32
+	hs    hsRange
 	mss   int
+	pad   int
 	tls   bool
+	prof  profile
+	u2r   *udp2rawState
+	lock  sync.Mutex
+	addr  *net.UDPAddr // reported to the application, kept on migration
+	sid   string
+	sts   int64
+	// limiter paces what is sent to this peer
+	limiter   *rateLimiter
+	squeue    *sendQueue
+	coalescer *coalescer
+	shaper    *shaper
+	born      time.Time
+	seen      atomic.Int64 // Unix nanoseconds of the last segment from the peer
+	zerownd   atomic.Bool  // the peer advertised a zero window
+	up        net.Conn     // the web server of a peer of Raw.Passthrough
+	// early holds the data that came before the request, see holdEarly
+	early    [][]byte
+	earlyLen int
+	// mssAssumed is set when the SYN announced no MSS, see Raw.FallbackMSS
+	mssAssumed bool
+	// peer is what the SYN offered
+	peer peerOptions
+	// mtu is that of the interface the SYN came in on
+	mtu int
+	// values are those the application attached, see SetPeerValue
+	values peerValues
 }
@@ -1,13 +1,20 @@
 package rawcon
 
 import (
+	"bytes"
 	"crypto/rand"
 	"encoding/binary"
 	"fmt"
 	"log"
+	mrand "math/rand"
+	"net"
 	"reflect"
+	"runtime"
 	"testing"
 	"time"
+
+	"github.com/biotooff/rawcon/utils"
+	"golang.org/x/net/bpf"
 )
 
 const (
@@ -182,3 +189,692 @@ func TestMultiEcho(t *testing.T) {
 	}
 	return
 }
+
+func TestPickHost(t *testing.T) {
+	r := &Raw{Hosts: []string{"a.example", "b.example"}, HostWeights: []int{0, 1}}
+	for i := 0; i < 20; i++ {
+		if h := r.pickHost(); h != "b.example" {
+			t.Fatalf("drew %s, weighed zero", h)
+		}
+	}
+	r = &Raw{Hosts: []string{"a.example", "b.example", "c.example"}, HostInterval: time.Hour}
+	first := r.pickHost()
+	for i := 0; i < 20; i++ {
+		if h := r.pickHost(); h != first {
+			t.Fatalf("drew %s then %s within the interval", first, h)
+		}
+	}
+	r.HostSource = func() []string { return []string{"fresh.example"} }
+	if h := r.pickHost(); h != "fresh.example" {
+		t.Fatalf("drew %s, not the name of HostSource", h)
+	}
+}
+
+// TestRandReplay checks that two Raws with the same seeded Rand pick the
+// same host names and shape the same way.
+func TestRandReplay(t *testing.T) {
+	hosts := []string{"a.example", "b.example", "c.example", "d.example", "e.example"}
+	picks := func() (names []string, sizes []int) {
+		r := &Raw{Hosts: hosts, HostInterval: time.Hour, Rand: mrand.New(mrand.NewSource(7)), Shape: BrowsingTraffic}
+		for i := 0; i < 4; i++ {
+			names = append(names, r.pickHost())
+		}
+		m := r.trafficModel()
+		for i := 0; i < 50; i++ {
+			size, gap := m.Next()
+			sizes = append(sizes, size, int(gap))
+		}
+		return
+	}
+	names, sizes := picks()
+	names2, sizes2 := picks()
+	if !reflect.DeepEqual(names, names2) || !reflect.DeepEqual(sizes, sizes2) {
+		t.Fatalf("drew %v %v, then %v %v", names, sizes, names2, sizes2)
+	}
+}
+
+func TestRandomNoSource(t *testing.T) {
+	var rnd utils.Random
+	seen := map[int]bool{}
+	for i := 0; i < 1000; i++ {
+		n := rnd.Intn(7)
+		if n < 0 || n >= 7 {
+			t.Fatalf("drew %d out of [0, 7)", n)
+		}
+		seen[n] = true
+		if rnd.Int63() < 0 {
+			t.Fatal("drew a negative number")
+		}
+	}
+	if len(seen) != 7 {
+		t.Fatalf("drew only %v of [0, 7)", seen)
+	}
+}
+
+func TestDNSQuery(t *testing.T) {
+	r := &Raw{DNS: true, Key: "secret"}
+	sid := r.newSessionID()
+	q := r.dnsQuery("www.example.com:53", sid)
+	question, token, ok := parseDNSQuery(q)
+	if !ok {
+		t.Fatal("query does not parse")
+	}
+	if got, _, ok := r.openSessionToken(token); !ok || got != string(sid) {
+		t.Fatalf("token %x does not open to session %x", token, sid)
+	}
+	if !isDNSAnswer(dnsAnswer(utils.Random{}, question)) {
+		t.Fatal("answer is not one")
+	}
+	data := []byte("datagram")
+	if got, ok := openDNS(sealDNS(utils.Random{}, data, true)); !ok || string(got) != string(data) {
+		t.Fatalf("got %q back", got)
+	}
+}
+
+func TestSSHHello(t *testing.T) {
+	r := &Raw{SSH: true, Key: "secret"}
+	sid := r.newSessionID()
+	rep, token, ok := sshAnswer(r.random(), r.sshRequest(sid))
+	if !ok {
+		t.Fatal("request does not parse")
+	}
+	if got, _, ok := r.openSessionToken(token); !ok || got != string(sid) {
+		t.Fatalf("token %x does not open to session %x", token, sid)
+	}
+	if _, ok := parseSSHHello(rep); !ok {
+		t.Fatal("answer does not parse")
+	}
+	for n := 0; n < 40; n++ {
+		data := make([]byte, n)
+		b := sealSSH(r.random(), data)
+		if (len(b)-4-sshMACLen)%sshBlock != 0 || len(b)-n > sshRecordLen {
+			t.Fatalf("packet of %d bytes for %d bytes of data", len(b), n)
+		}
+		if got, ok := openSSH(b); !ok || len(got) != n {
+			t.Fatalf("got %d bytes back of %d", len(got), n)
+		}
+	}
+}
+
+func TestRandReproducible(t *testing.T) {
+	// the session tokens carry the time, so the handshakes go without
+	draw := func() []byte {
+		r := &Raw{Key: "secret", Fingerprint: utils.Chrome120, Rand: mrand.New(mrand.NewSource(1))}
+		sid := r.newSessionID()
+		b := make([]byte, 2048)
+		n := r.clientHello(b, "www.example.com", sid, r.padTicket(b[1816:]))
+		return append(append(b[:n:n], sid...), r.dnsQuery("www.example.com", nil)...)
+	}
+	if a, b := draw(), draw(); !bytes.Equal(a, b) {
+		t.Fatal("the same seed drew different handshakes")
+	}
+}
+
+func TestParseICMPError(t *testing.T) {
+	b := []byte{icmpTypeUnreachable, icmpCodeFragNeeded, 0, 0, 0, 0, 0x05, 0xdc,
+		0x45, 0, 0, 40, 0, 0, 0x40, 0, 64, 6, 0, 0, 10, 0, 0, 1, 192, 0, 2, 1,
+		0x1f, 0x90, 0x01, 0xbb, 0, 0, 0x10, 0}
+	rep, ok := parseICMPError(b)
+	if !ok || rep.src.String() != "10.0.0.1:8080" || rep.dst.String() != "192.0.2.1:443" {
+		t.Fatalf("parsed %+v, %v", rep, ok)
+	}
+	if mss := rep.pathMSS(); mss != 1460 {
+		t.Fatalf("mss of %d", mss)
+	}
+	if !rep.sent(0x1000+100) || rep.sent(0x1000-1) {
+		t.Fatal("sequence window")
+	}
+	if _, ok := parseICMPError(b[:len(b)-1]); ok {
+		t.Fatal("parsed a truncated quote")
+	}
+}
+
+func TestICMPPeers(t *testing.T) {
+	r := Raw{IdleTimeout: time.Minute, MaxConns: 2}
+	peers := r.newICMPPeers()
+	now := time.Now()
+	if !peers.note("a", 1, now) || !peers.note("b", 1, now.Add(time.Second)) {
+		t.Fatal("refused a peer below the cap")
+	}
+	if peers.note("c", 1, now.Add(2*time.Second)) {
+		t.Fatal("took a peer beyond the cap")
+	}
+	if !peers.note("a", 2, now.Add(3*time.Second)) {
+		t.Fatal("refused a known peer at the cap")
+	}
+	// the replies take the requests of a in turn, and none is left to a
+	// third
+	for _, want := range []int{1, 2, -1} {
+		if seq, ok := peers.take("a", now.Add(3*time.Second)); !ok || seq != want {
+			t.Fatalf("seq %d, %v, want %d", seq, ok, want)
+		}
+	}
+	// b is idle by now and makes room
+	later := now.Add(time.Second + time.Minute)
+	if _, ok := peers.take("b", later); ok {
+		t.Fatal("wrote to an idle peer")
+	}
+	if !peers.note("c", 1, later) {
+		t.Fatal("an idle peer kept its place")
+	}
+	if _, ok := peers.peers["b"]; ok || len(peers.peers) != 2 {
+		t.Fatalf("peers %v", peers.peers)
+	}
+
+	r.EvictLRU = true
+	peers = r.newICMPPeers()
+	peers.note("a", 1, now)
+	peers.note("b", 1, now.Add(time.Second))
+	if !peers.note("c", 1, now.Add(2*time.Second)) {
+		t.Fatal("EvictLRU refused a peer")
+	}
+	if _, ok := peers.peers["a"]; ok {
+		t.Fatal("the least recently active peer stayed")
+	}
+
+	// the oldest requests give way once too many wait for a reply
+	for seq := 0; seq < icmpMaxOutstanding+2; seq++ {
+		peers.note("b", seq, now.Add(2*time.Second))
+	}
+	if seq, _ := peers.take("b", now.Add(2*time.Second)); seq != 2 {
+		t.Fatalf("answered %d first", seq)
+	}
+	if n := len(peers.peers["b"].seqs); n != icmpMaxOutstanding-1 {
+		t.Fatalf("%d requests left", n)
+	}
+}
+
+// TestICMPEcho has a listener answer each request of a client once: the
+// poll and the message take a reply each, and a third reply is dropped.
+func TestICMPEcho(t *testing.T) {
+	var r Raw
+	listener, err := r.ListenICMP("127.0.0.1:0")
+	if err != nil {
+		t.Skip(err)
+	}
+	defer listener.Close()
+	conn, err := r.DialICMP("127.0.0.1:1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if _, err = conn.Write([]byte("ping")); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 2048)
+	listener.SetReadDeadline(time.Now().Add(2 * time.Second))
+	n, addr, err := listener.ReadFrom(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 3; i++ {
+		if _, err = listener.WriteTo(buf[:n], addr); err != nil {
+			t.Fatal(err)
+		}
+	}
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	for i := 0; i < 2; i++ {
+		if n, err = conn.Read(buf); err != nil || string(buf[:n]) != "ping" {
+			t.Fatalf("reply %d: %q, %v", i, buf[:n], err)
+		}
+	}
+	// the next poll comes after icmpPollInterval
+	conn.SetReadDeadline(time.Now().Add(icmpPollInterval / 2))
+	if n, err = conn.Read(buf); err == nil {
+		t.Fatalf("a reply to no request: %q", buf[:n])
+	}
+}
+
+func TestReassembly(t *testing.T) {
+	pkt := make([]byte, 20+64)
+	pkt[0], pkt[9] = 0x45, 6
+	binary.BigEndian.PutUint16(pkt[2:], uint16(len(pkt)))
+	binary.BigEndian.PutUint16(pkt[4:], 0x1234)
+	copy(pkt[12:], []byte{10, 0, 0, 1, 10, 0, 0, 2})
+	rand.Read(pkt[20:])
+	binary.BigEndian.PutUint16(pkt[10:], ipv4HeaderChecksum(pkt[:20]))
+	frag := func(off, n int, more bool) []byte {
+		f := append(append([]byte(nil), pkt[:20]...), pkt[20+off:20+off+n]...)
+		binary.BigEndian.PutUint16(f[2:], uint16(len(f)))
+		v := uint16(off / 8)
+		if more {
+			v |= ipv4MoreFragments
+		}
+		binary.BigEndian.PutUint16(f[6:], v)
+		return f
+	}
+	var ra reassembler
+	if ra.add(frag(48, 16, false)) != nil || ra.add(frag(0, 24, true)) != nil {
+		t.Fatal("reassembled too early")
+	}
+	if got := ra.add(frag(24, 24, true)); !bytes.Equal(got, pkt) {
+		t.Fatalf("reassembled % x", got)
+	}
+	ra.add(frag(0, 32, true))
+	if ra.add(frag(24, 40, false)) != nil || len(ra.pending) != 0 {
+		t.Fatal("kept overlapping fragments")
+	}
+}
+
+func TestSendMSS(t *testing.T) {
+	for _, c := range []struct{ peer, mtu, mss int }{
+		{0, 0, defaultMSS},
+		{8960, defaultMTU, defaultMSS},
+		{8960, 9000, 8960},
+		{1200, 9000, 1200},
+		{0, 1492, 1452},
+	} {
+		if mss := sendMSS(c.peer, c.mtu); mss != c.mss {
+			t.Errorf("sendMSS(%d, %d) = %d, want %d", c.peer, c.mtu, mss, c.mss)
+		}
+	}
+	if n := payloadLimit(8960, 0, nil, 0); n != 8960 {
+		t.Errorf("payload limit of %d for a jumbo MSS", n)
+	}
+}
+
+func TestFallbackMSS(t *testing.T) {
+	r := Raw{FallbackMSS: 536}
+	for _, c := range []struct {
+		peer, mtu, mss int
+		assumed        bool
+	}{
+		{1400, defaultMTU, 1400, false},
+		{0, defaultMTU, 536, true},
+		{1, defaultMTU, 536, true},
+		{0, 560, 520, true},
+	} {
+		if mss, assumed := r.peerMSS(c.peer, c.mtu); mss != c.mss || assumed != c.assumed {
+			t.Errorf("peerMSS(%d, %d) = %d, %v", c.peer, c.mtu, mss, assumed)
+		}
+	}
+	if mss, _ := (&Raw{}).peerMSS(0, defaultMTU); mss != defaultMSS {
+		t.Errorf("no fallback gives %d", mss)
+	}
+}
+
+func TestScaledWindow(t *testing.T) {
+	for _, c := range []struct {
+		w, shift int
+		want     uint16
+	}{
+		{12580, -1, 12580},
+		{200000, -1, 65535},
+		{12580, 5, 394},
+		{12580, 6, 197},
+		{20, 6, 1},
+		{maxWindow, 14, 65535},
+	} {
+		if got := scaledWindow(c.w, c.shift); got != c.want {
+			t.Errorf("scaledWindow(%d, %d) = %d, want %d", c.w, c.shift, got, c.want)
+		}
+	}
+	if w := (&Raw{Window: 1 << 31}).window(dialWindow); w != maxWindow {
+		t.Errorf("window %d above the largest scale", w)
+	}
+}
+
+func TestHSRange(t *testing.T) {
+	var h hsRange
+	if h.covers(0) {
+		t.Fatal("an unset range covers")
+	}
+	h.set(1<<32-100, 300)
+	for _, c := range []struct {
+		seq    uint32
+		covers bool
+	}{
+		{1<<32 - 100, true},
+		{150, true},
+		{200, false},
+		{1<<32 - 101, false},
+		{1 << 30, false},
+		{1<<32 - 50, true},
+		{1<<31 + 50, false},
+		// the data is on its way around, the range no longer filters
+		{1<<32 - 100, false},
+	} {
+		if got := h.covers(c.seq); got != c.covers {
+			t.Errorf("covers(%d) = %v", c.seq, got)
+		}
+	}
+}
+
+// dropCounter is a capture whose drops the test sets.
+type dropCounter struct {
+	dropped chan int
+	grown   chan int
+	n       int
+}
+
+func (d *dropCounter) CaptureStats() (CaptureStats, error) {
+	select {
+	case n := <-d.dropped:
+		d.n = n
+	default:
+	}
+	return CaptureStats{Dropped: d.n}, nil
+}
+
+func (d *dropCounter) growCapture(bytes int) error {
+	d.grown <- bytes
+	return nil
+}
+
+func TestDropWatch(t *testing.T) {
+	events := make(chan Event, 10)
+	r := Raw{
+		DropWatch:        time.Millisecond,
+		CaptureBuffer:    1 << 20,
+		MaxCaptureBuffer: 3 << 20,
+		OnEvent:          func(e Event) { events <- e },
+	}
+	d := &dropCounter{dropped: make(chan int), grown: make(chan int, 10)}
+	die := make(chan struct{})
+	defer close(die)
+	r.startDropWatch(die, nil, d)
+	for i, c := range []struct{ dropped, reported, buffer int }{
+		{5, 5, 2 << 20},
+		{12, 7, 3 << 20},
+		// a reopened handle counts from zero, the buffer is at its most
+		{4, 4, 0},
+	} {
+		d.dropped <- c.dropped
+		e := <-events
+		if e.Type != EventCaptureDrop || e.Dropped != c.reported {
+			t.Fatalf("%d: event %v of %d drops", i, e.Type, e.Dropped)
+		}
+		if c.buffer == 0 {
+			continue
+		}
+		if got := <-d.grown; got != c.buffer {
+			t.Fatalf("%d: grown to %d, want %d", i, got, c.buffer)
+		}
+	}
+	select {
+	case got := <-d.grown:
+		t.Fatalf("grown past the most, to %d", got)
+	case <-time.After(20 * time.Millisecond):
+	}
+}
+
+func TestISN(t *testing.T) {
+	src, dst := net.IPv4(10, 0, 0, 1), net.IPv4(10, 0, 0, 2)
+	keyed := Raw{ISN: ISNKeyed, Key: "secret"}
+	a := keyed.isn(src, 1000, dst, 80)
+	if keyed.isn(src, 1000, dst, 80) != a {
+		t.Fatal("the keyed ISN of a flow changed")
+	}
+	if keyed.isn(src, 1001, dst, 80) == a {
+		t.Fatal("two flows share the keyed ISN")
+	}
+	if other := (Raw{ISN: ISNKeyed, Key: "other"}); other.isn(src, 1000, dst, 80) == a {
+		t.Fatal("two keys give the same ISN")
+	}
+	clock := Raw{ISN: ISNClock, Key: "secret"}
+	first := clock.isn(src, 1000, dst, 80)
+	time.Sleep(time.Millisecond)
+	if d := clock.isn(src, 1000, dst, 80) - first; d < 250 || d > 1<<20 {
+		t.Fatalf("the clock of the ISN moved by %d in a millisecond", d)
+	}
+}
+
+func TestListenPorts(t *testing.T) {
+	address, ports, err := splitListenPorts("0.0.0.0:4020,4000-4010,4011,3990-3995")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := portRanges{{3990, 3995}, {4000, 4011}, {4020, 4020}}
+	if address != "0.0.0.0:3990" || !reflect.DeepEqual(ports, want) {
+		t.Fatalf("%s %v", address, ports)
+	}
+	for _, bad := range []string{"0.0.0.0:10-5", "0.0.0.0:70000", "0.0.0.0:1,x", "0.0.0.0:0,5"} {
+		if _, _, err = splitListenPorts(bad); err == nil {
+			t.Errorf("%s was taken", bad)
+		}
+	}
+
+	// ldh [0]; jeq 0 to the drop; jeq port; ret accept; ret drop
+	prog := []bpfInsn{
+		{op: 0x28},
+		{op: bpfJEQ, jt: 2},
+		{op: bpfJEQ, jf: 1, k: 3990},
+		{op: 0x6, k: 0xffff},
+		{op: 0x6},
+	}
+	out, err := ports.bpf(prog)
+	if err != nil {
+		t.Fatal(err)
+	}
+	raw := make([]bpf.RawInstruction, len(out))
+	for i, in := range out {
+		raw[i] = bpf.RawInstruction{Op: in.op, Jt: in.jt, Jf: in.jf, K: in.k}
+	}
+	insns, ok := bpf.Disassemble(raw)
+	if !ok {
+		t.Fatal("cannot disassemble the program")
+	}
+	vm, err := bpf.NewVM(insns)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for port := 0; port < 4100; port++ {
+		pkt := []byte{byte(port >> 8), byte(port)}
+		n, err := vm.Run(pkt)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if (n > 0) != ports.has(port) {
+			t.Fatalf("port %d: the program returned %d", port, n)
+		}
+	}
+}
+
+func TestHandshakeSteps(t *testing.T) {
+	synack := hsSegment{syn: true, ack: true, seq: 7}
+	for _, c := range []struct {
+		seg     hsSegment
+		crossed bool
+		want    dialEvent
+	}{
+		{synack, false, dialSynAck},
+		{hsSegment{syn: true}, false, dialCrossed},
+		{hsSegment{ack: true, ackn: 101}, false, dialWait},
+		{hsSegment{ack: true, ackn: 101}, true, dialCrossAcked},
+		{hsSegment{ack: true, ackn: 102}, true, dialWait},
+		{hsSegment{ack: true, psh: true, n: 10}, false, dialWait},
+	} {
+		if got := dialStep(c.seg, c.crossed, 100); got != c.want {
+			t.Errorf("dialStep(%+v, %v) = %d, want %d", c.seg, c.crossed, got, c.want)
+		}
+	}
+	for _, c := range []struct {
+		state uint32
+		seg   hsSegment
+		want  listenEvent
+	}{
+		{synreceived, hsSegment{ack: true}, listenAcked},
+		{synreceived, hsSegment{ack: true, fin: true}, listenWait},
+		{synreceived, hsSegment{syn: true}, listenSyn},
+		{synreceived, hsSegment{ack: true, psh: true, n: 100}, listenWait},
+		{waithttpreq, hsSegment{ack: true, psh: true, n: 100}, listenRequest},
+		{waithttpreq, hsSegment{ack: true, psh: true, n: 20}, listenEarly},
+		{waithttpreq, hsSegment{ack: true}, listenWait},
+		{waithttpreq, hsSegment{syn: true}, listenSyn},
+		{established, hsSegment{syn: true}, listenWait},
+	} {
+		if got := listenStep(c.state, c.seg); got != c.want {
+			t.Errorf("listenStep(%d, %+v) = %d, want %d", c.state, c.seg, got, c.want)
+		}
+	}
+}
+
+func TestTakeRequest(t *testing.T) {
+	r := &Raw{}
+	addr := &net.UDPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 4000}
+	req := []byte("POST /index.html HTTP/1.1\r\nHost: example.com\r\n\r\n")
+	h := r.parseRequest(req, addr)
+	if h.rep == nil || h.tls {
+		t.Fatalf("POST not taken for a request: %+v", h)
+	}
+	var info connInfo
+	if !info.takeRequest(h, 1000, len(req)) {
+		t.Fatal("request not taken")
+	}
+	rep := info.rep
+	// a retransmission gets the same reply
+	if !info.takeRequest(r.parseRequest(req, addr), 1000, len(req)) || &info.rep[0] != &rep[0] {
+		t.Error("a retransmitted request got another reply")
+	}
+	if info.takeRequest(r.parseRequest([]byte("GET / HTTP/1.1\r\n\r\n"), addr), 1000, 18) {
+		t.Error("a GET taken for the request")
+	}
+	if h := (&Raw{Passthrough: "127.0.0.1:80", Key: "k"}).parseRequest(req, addr); h.rep != nil {
+		t.Error("a request without the key answered with passthrough")
+	}
+}
+
+func TestTapReplace(t *testing.T) {
+	conn := &RAWConn{die: make(chan struct{})}
+	before := runtime.NumGoroutine()
+	first := conn.Tap(1)
+	for i := 0; i < 100; i++ {
+		conn.Tap(1)
+	}
+	if _, ok := <-first; ok {
+		t.Error("a replaced tap left open")
+	}
+	last := conn.Tap(1)
+	time.Sleep(10 * time.Millisecond)
+	if n := runtime.NumGoroutine() - before; n > 2 {
+		t.Errorf("%d goroutines left by replaced taps", n)
+	}
+	close(conn.die)
+	if _, ok := <-last; ok {
+		t.Error("tap left open with the connection closed")
+	}
+}
+
+func TestWriteDeadlineNoLateSend(t *testing.T) {
+	var d writeDeadline
+	var sent int
+	addr := func() net.Addr { return &net.UDPAddr{} }
+	slow := func(b []byte, deadline time.Time) (int, error) {
+		time.Sleep(30 * time.Millisecond)
+		sent++
+		return len(b), nil
+	}
+	d.set(time.Now().Add(10 * time.Millisecond))
+	if _, err := d.write(&Raw{}, nil, addr, []byte("a"), slow); err != nil {
+		t.Fatalf("a write started before the deadline failed: %v", err)
+	}
+	for i := 0; i < 3; i++ {
+		if _, err := d.write(&Raw{}, nil, addr, []byte("b"), slow); err == nil {
+			t.Fatal("a write past the deadline did not time out")
+		}
+	}
+	time.Sleep(50 * time.Millisecond)
+	if sent != 1 {
+		t.Errorf("%d segments sent, want 1: timed-out writes went out", sent)
+	}
+
+	// one packet per 100ms, the pacing of the second outlasting the deadline
+	l := newRateLimiter(0, 10, true)
+	sent = 0
+	paced := func(b []byte, deadline time.Time) (int, error) {
+		if !paceUntil(deadline, len(b), 1, l) {
+			return 0, &timeoutErr{op: "write"}
+		}
+		sent++
+		return len(b), nil
+	}
+	d.set(time.Now().Add(50 * time.Millisecond))
+	if _, err := d.write(&Raw{}, nil, addr, []byte("a"), paced); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := d.write(&Raw{}, nil, addr, []byte("b"), paced); err == nil {
+		t.Fatal("a write paced past the deadline did not time out")
+	}
+	time.Sleep(150 * time.Millisecond)
+	if sent != 1 {
+		t.Errorf("%d segments sent, want 1: a timed-out write went out", sent)
+	}
+	d.set(time.Time{})
+	start := time.Now()
+	if _, err := d.write(&Raw{}, nil, addr, []byte("c"), paced); err != nil || sent != 2 {
+		t.Fatalf("write without a deadline: %v", err)
+	}
+	if w := time.Since(start); w > 20*time.Millisecond {
+		t.Errorf("the timed-out write kept its pacing tokens, waited %v", w)
+	}
+}
+
+func TestHopSchedule(t *testing.T) {
+	r := &Raw{Key: "secret", HopInterval: time.Second, HopPorts: "4000-4003,4010"}
+	ports, err := r.hopPorts()
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn := &RAWConn{r: r, sid: []byte("session1")}
+	again := &RAWConn{r: r, sid: []byte("session1")}
+	seen := make(map[int]bool)
+	for n := uint64(0); n < 100; n++ {
+		if d := conn.hopDelay(n); d < time.Second/2 || d >= 3*time.Second/2 {
+			t.Fatalf("hop %d after %v", n, d)
+		}
+		port := conn.hopPort(n, ports)
+		if !ports.has(port) {
+			t.Fatalf("hop %d to %d", n, port)
+		}
+		if again.hopDelay(n) != conn.hopDelay(n) || again.hopPort(n, ports) != port {
+			t.Fatalf("hop %d drawn differently", n)
+		}
+		seen[port] = true
+	}
+	if len(seen) != ports.count() {
+		t.Fatalf("the hops went to %v", seen)
+	}
+	r.HopPorts = "4000-x"
+	if _, err = r.DialRAW("127.0.0.1:4000"); err == nil {
+		t.Fatal("dialed with bad hop ports")
+	}
+}
+
+func TestCoalescerFlush(t *testing.T) {
+	var counters sendCounters
+	sent := make(chan []byte, 4)
+	block := make(chan struct{})
+	c := newCoalescer(time.Millisecond, func() int { return 10 }, func(b []byte) error {
+		sent <- append([]byte(nil), b...)
+		<-block
+		return fmt.Errorf("down")
+	}, &counters)
+	if err := c.write([]byte("abc")); err != nil {
+		t.Fatal(err)
+	}
+	if seg := <-sent; !bytes.Equal(seg, []byte("\x00\x03abc")) {
+		t.Fatalf("sent %q", seg)
+	}
+	// the send of the timer is stuck, the writes still queue
+	done := make(chan error, 1)
+	go func() { done <- c.write([]byte("de")) }()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("a write waited for the send of the timer")
+	}
+	close(block)
+	if seg := <-sent; !bytes.Equal(seg, []byte("\x00\x02de")) {
+		t.Fatalf("sent %q", seg)
+	}
+	deadline := time.Now().Add(time.Second)
+	for counters.failed.Load() != 2 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	if n := counters.failed.Load(); n != 2 {
+		t.Fatalf("%d failed datagrams counted", n)
+	}
+}
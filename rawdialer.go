@@ -0,0 +1,57 @@
+package rawcon
+
+import (
+	"context"
+	"net"
+)
+
+// RawDialer dials fake TCP connections with the options of its Raw. Its
+// DialContext fits golang.org/x/net/proxy.ContextDialer and
+// http.Transport.DialContext. The connections keep the semantics of
+// RAWConn: every Write is one segment and nothing is retransmitted, so what
+// runs over them must put up with loss and reordering.
+type RawDialer struct {
+	Raw
+}
+
+// Dial is DialContext without a context.
+func (d *RawDialer) Dial(network, address string) (net.Conn, error) {
+	return d.DialContext(context.Background(), network, address)
+}
+
+// DialContext dials address with DialRAW. network must be "tcp" or "tcp4".
+// When ctx ends first the dial returns the error of ctx and the connection
+// is closed once its handshake completes.
+func (d *RawDialer) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	switch network {
+	case "tcp", "tcp4":
+	default:
+		return nil, &net.OpError{Op: "dial", Net: network, Err: net.UnknownNetworkError(network)}
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	type result struct {
+		conn *RAWConn
+		err  error
+	}
+	ch := make(chan result, 1)
+	go func() {
+		conn, err := d.DialRAW(address)
+		ch <- result{conn, err}
+	}()
+	select {
+	case res := <-ch:
+		if res.err != nil {
+			return nil, &net.OpError{Op: "dial", Net: network, Err: res.err}
+		}
+		return res.conn, nil
+	case <-ctx.Done():
+		go func() {
+			if res := <-ch; res.conn != nil {
+				res.conn.Close()
+			}
+		}()
+		return nil, ctx.Err()
+	}
+}
@@ -0,0 +1,154 @@
+package rawcon
+
+import (
+	"encoding/binary"
+	"sync"
+	"time"
+)
+
+// When a middlebox clears DF, or the peer sends fragments, the segments
+// arrive in pieces. The kernel puts them back together before the raw
+// socket of Linux sees them, but pcap, BPF and PacketIO get the fragments
+// themselves, so these paths reassemble them. A datagram whose fragments
+// overlap is dropped, and so is one not complete after reasmTimeout. At
+// most reasmMaxPending datagrams and reasmMaxBytes of fragments are held
+// at once, the fragments of further ones are dropped.
+
+const (
+	reasmTimeout    = 30 * time.Second
+	reasmMaxPending = 64
+	reasmMaxBytes   = 1 << 20
+
+	ipv4MoreFragments = 0x2000
+	ipv4FragOffset    = 0x1fff
+)
+
+type fragKey struct {
+	src, dst [4]byte
+	id       uint16
+	proto    byte
+}
+
+type fragment struct {
+	off  int
+	data []byte
+}
+
+// reassembly is a datagram whose fragments are coming in.
+type reassembly struct {
+	header   []byte // of the first fragment, once it came
+	frags    []fragment
+	total    int // length of the payload, -1 until the last fragment came
+	size     int // of the fragments held
+	deadline time.Time
+}
+
+// reassembler puts fragmented IPv4 packets back together. The zero value is
+// ready to use.
+type reassembler struct {
+	lock    sync.Mutex
+	pending map[fragKey]*reassembly
+	size    int
+}
+
+// isFragment tells whether the IPv4 packet b is a fragment.
+func isFragment(b []byte) bool {
+	return len(b) >= 20 && binary.BigEndian.Uint16(b[6:])&(ipv4MoreFragments|ipv4FragOffset) != 0
+}
+
+// add returns the IPv4 packet b as is if it is not a fragment, the whole
+// packet if b is the fragment completing it, or else nil.
+func (ra *reassembler) add(b []byte) []byte {
+	if !isFragment(b) {
+		return b
+	}
+	if b[0]>>4 != 4 {
+		return nil
+	}
+	hl := int(b[0]&0xf) * 4
+	tl := int(binary.BigEndian.Uint16(b[2:]))
+	if hl < 20 || tl < hl || tl > len(b) {
+		return nil
+	}
+	flags := binary.BigEndian.Uint16(b[6:])
+	off := int(flags&ipv4FragOffset) * 8
+	more := flags&ipv4MoreFragments != 0
+	data := b[hl:tl]
+	end := off + len(data)
+	if more && (len(data) == 0 || len(data)%8 != 0) || hl+end > 65535 {
+		return nil
+	}
+	key := fragKey{id: binary.BigEndian.Uint16(b[4:]), proto: b[9]}
+	copy(key.src[:], b[12:16])
+	copy(key.dst[:], b[16:20])
+
+	ra.lock.Lock()
+	defer ra.lock.Unlock()
+	now := time.Now()
+	ra.expire(now)
+	p := ra.pending[key]
+	if p == nil {
+		if len(ra.pending) >= reasmMaxPending {
+			return nil
+		}
+		if ra.pending == nil {
+			ra.pending = make(map[fragKey]*reassembly)
+		}
+		p = &reassembly{total: -1, deadline: now.Add(reasmTimeout)}
+		ra.pending[key] = p
+	}
+	if ra.size+len(data) > reasmMaxBytes || p.total >= 0 && end > p.total {
+		ra.drop(key, p)
+		return nil
+	}
+	for _, f := range p.frags {
+		if off < f.off+len(f.data) && f.off < end || !more && f.off+len(f.data) > end {
+			ra.drop(key, p)
+			return nil
+		}
+	}
+	if !more {
+		if p.total >= 0 {
+			ra.drop(key, p)
+			return nil
+		}
+		p.total = end
+	}
+	if off == 0 {
+		p.header = append([]byte(nil), b[:hl]...)
+	}
+	p.frags = append(p.frags, fragment{off: off, data: append([]byte(nil), data...)})
+	p.size += len(data)
+	ra.size += len(data)
+	// the fragments do not overlap and all end by total
+	if p.header == nil || p.size != p.total {
+		return nil
+	}
+	whole := make([]byte, len(p.header)+p.total)
+	copy(whole, p.header)
+	for _, f := range p.frags {
+		copy(whole[len(p.header)+f.off:], f.data)
+	}
+	binary.BigEndian.PutUint16(whole[2:], uint16(len(whole)))
+	binary.BigEndian.PutUint16(whole[6:], 0)
+	binary.BigEndian.PutUint16(whole[10:], 0)
+	binary.BigEndian.PutUint16(whole[10:], ipv4HeaderChecksum(whole[:len(p.header)]))
+	ra.drop(key, p)
+	return whole
+}
+
+// drop forgets the datagram p of key, the caller must hold ra.lock.
+func (ra *reassembler) drop(key fragKey, p *reassembly) {
+	ra.size -= p.size
+	delete(ra.pending, key)
+}
+
+// expire drops the datagrams that are too late, the caller must hold
+// ra.lock.
+func (ra *reassembler) expire(now time.Time) {
+	for key, p := range ra.pending {
+		if now.After(p.deadline) {
+			ra.drop(key, p)
+		}
+	}
+}
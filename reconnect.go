@@ -0,0 +1,320 @@
+package rawcon
+
+import (
+	"errors"
+	"net"
+	"sync"
+	"time"
+)
+
+// ReconnectPolicy is how a ReconnectingRAWConn tells that its connection
+// died and how it dials again, see Raw.Reconnect.
+type ReconnectPolicy struct {
+	// IdleTimeout is how long the connection goes without receiving
+	// anything before it is taken for dead, 15s if zero. The peer is
+	// probed meanwhile, as with Raw.RTTInterval, for a live connection to
+	// have something to receive.
+	IdleTimeout time.Duration
+	// Wait is how long a failed dial waits before the next one, 100ms if
+	// zero. It doubles with every failure, up to MaxWait.
+	Wait time.Duration
+	// MaxWait bounds the wait, 30s if zero.
+	MaxWait time.Duration
+	// Jitter is the longest random wait added to every wait.
+	Jitter time.Duration
+}
+
+var defaultReconnectPolicy = ReconnectPolicy{
+	IdleTimeout: 15 * time.Second,
+	Wait:        100 * time.Millisecond,
+	MaxWait:     30 * time.Second,
+}
+
+func (r *Raw) reconnectPolicy() ReconnectPolicy {
+	if r.Reconnect == nil {
+		return defaultReconnectPolicy
+	}
+	p := *r.Reconnect
+	if p.IdleTimeout <= 0 {
+		p.IdleTimeout = defaultReconnectPolicy.IdleTimeout
+	}
+	if p.Wait <= 0 {
+		p.Wait = defaultReconnectPolicy.Wait
+	}
+	if p.MaxWait <= 0 {
+		p.MaxWait = defaultReconnectPolicy.MaxWait
+	}
+	return p
+}
+
+// ReconnectingRAWConn is a connection of DialRAW that dials again, with a
+// new handshake, once the one it holds died: reset or closed by the peer,
+// closed under it or silent for ReconnectPolicy.IdleTimeout. Reads and writes meanwhile wait
+// for the new connection until their deadline. It reports an
+// EventReconnect and calls Raw.OnReconnect every time it dialed again.
+// With Raw.WatchNetwork the connection also follows changes of the network
+// in place.
+type ReconnectingRAWConn struct {
+	r       *Raw
+	address string
+	policy  ReconnectPolicy
+
+	lock      sync.Mutex
+	conn      *RAWConn      // nil while dialing again
+	ready     chan struct{} // closed once conn is set
+	laddr     net.Addr      // of the last connection
+	raddr     net.Addr
+	rdeadline time.Time
+	wdeadline time.Time
+	die       chan struct{}
+}
+
+// DialReconnecting dials address as DialRAW does and keeps the connection
+// up, see ReconnectingRAWConn. The first dial must succeed.
+func (r *Raw) DialReconnecting(address string) (*ReconnectingRAWConn, error) {
+	conn, err := r.DialRAW(address)
+	if err != nil {
+		return nil, err
+	}
+	rc := &ReconnectingRAWConn{
+		r:       r,
+		address: address,
+		policy:  r.reconnectPolicy(),
+		ready:   make(chan struct{}),
+		die:     make(chan struct{}),
+	}
+	rc.use(conn)
+	return rc, nil
+}
+
+// use makes conn the connection of rc and watches it.
+func (rc *ReconnectingRAWConn) use(conn *RAWConn) bool {
+	rc.lock.Lock()
+	select {
+	case <-rc.die:
+		rc.lock.Unlock()
+		conn.Close()
+		return false
+	default:
+	}
+	conn.SetReadDeadline(rc.rdeadline)
+	conn.SetWriteDeadline(rc.wdeadline)
+	rc.conn = conn
+	rc.laddr, rc.raddr = conn.LocalAddr(), conn.RemoteAddr()
+	close(rc.ready)
+	rc.lock.Unlock()
+	go rc.watch(conn)
+	return true
+}
+
+// watch takes conn for dead once the peer reset it or it stayed idle for
+// too long.
+func (rc *ReconnectingRAWConn) watch(conn *RAWConn) {
+	if conn.r.RTTInterval <= 0 {
+		go conn.probeRTT(rc.policy.IdleTimeout / 4)
+	}
+	conn.touch()
+	ticker := time.NewTicker(rc.policy.IdleTimeout / 4)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-conn.die:
+			return
+		case <-ticker.C:
+		}
+		if conn.reset.Load() || conn.idle() >= rc.policy.IdleTimeout {
+			rc.broken(conn)
+			return
+		}
+	}
+}
+
+// broken drops conn, if it still is the connection of rc, and dials again.
+func (rc *ReconnectingRAWConn) broken(conn *RAWConn) {
+	rc.lock.Lock()
+	if rc.conn != conn {
+		rc.lock.Unlock()
+		return
+	}
+	rc.conn = nil
+	rc.ready = make(chan struct{})
+	rc.lock.Unlock()
+	conn.Close()
+	go rc.redial()
+}
+
+func (rc *ReconnectingRAWConn) redial() {
+	wait := rc.policy.Wait
+	for {
+		conn, err := rc.r.DialRAW(rc.address)
+		if err == nil {
+			if rc.use(conn) {
+				rc.r.event(EventReconnect, conn.RemoteAddr())
+				if rc.r.OnReconnect != nil {
+					rc.r.OnReconnect(conn.LocalAddr(), conn.RemoteAddr())
+				}
+			}
+			return
+		}
+		d := wait
+		if rc.policy.Jitter > 0 {
+			d += time.Duration(rc.r.random().Int63n(int64(rc.policy.Jitter)))
+		}
+		select {
+		case <-rc.die:
+			return
+		case <-time.After(d):
+		}
+		wait = min(wait*2, rc.policy.MaxWait)
+	}
+}
+
+// current returns the connection of rc, waiting for it until deadline
+// while rc dials again.
+func (rc *ReconnectingRAWConn) current(op string, write bool) (*RAWConn, error) {
+	var timeout <-chan time.Time
+	for {
+		rc.lock.Lock()
+		conn, ready, deadline := rc.conn, rc.ready, rc.rdeadline
+		if write {
+			deadline = rc.wdeadline
+		}
+		rc.lock.Unlock()
+		if conn != nil {
+			select {
+			case <-conn.die:
+				// closed under rc
+				rc.broken(conn)
+				continue
+			default:
+				return conn, nil
+			}
+		}
+		if timeout == nil && !deadline.IsZero() {
+			timer := time.NewTimer(time.Until(deadline))
+			defer timer.Stop()
+			timeout = timer.C
+		}
+		select {
+		case <-ready:
+		case <-rc.die:
+			return nil, net.ErrClosed
+		case <-timeout:
+			return nil, &timeoutErr{op: op + " " + rc.address}
+		}
+	}
+}
+
+// failed tells whether err, returned by conn, means that conn died, in
+// which case rc dials again and the operation is to be retried. Only a
+// reset, a FIN of the peer or a closed conn do, any other error, such as a
+// MessageTooLongError or a timeout, is the caller's to handle.
+func (rc *ReconnectingRAWConn) failed(conn *RAWConn, err error) bool {
+	select {
+	case <-rc.die:
+		return false
+	default:
+	}
+	if !errors.Is(err, ErrConnReset) && !errors.Is(err, ErrPeerClosed) && !errors.Is(err, net.ErrClosed) {
+		select {
+		case <-conn.die:
+		default:
+			return false
+		}
+	}
+	rc.broken(conn)
+	return true
+}
+
+func (rc *ReconnectingRAWConn) ReadFrom(b []byte) (n int, addr net.Addr, err error) {
+	for {
+		var conn *RAWConn
+		if conn, err = rc.current("read from", false); err != nil {
+			return
+		}
+		if n, addr, err = conn.ReadFrom(b); err == nil || !rc.failed(conn, err) {
+			return
+		}
+	}
+}
+
+func (rc *ReconnectingRAWConn) Read(b []byte) (n int, err error) {
+	n, _, err = rc.ReadFrom(b)
+	return
+}
+
+// WriteTo sends b to the peer, addr is ignored as it is by RAWConn.
+func (rc *ReconnectingRAWConn) WriteTo(b []byte, addr net.Addr) (n int, err error) {
+	for {
+		var conn *RAWConn
+		if conn, err = rc.current("write to", true); err != nil {
+			return
+		}
+		if n, err = conn.WriteTo(b, addr); err == nil || !rc.failed(conn, err) {
+			return
+		}
+	}
+}
+
+func (rc *ReconnectingRAWConn) Write(b []byte) (n int, err error) {
+	return rc.WriteTo(b, nil)
+}
+
+func (rc *ReconnectingRAWConn) Close() error {
+	rc.lock.Lock()
+	select {
+	case <-rc.die:
+		rc.lock.Unlock()
+		return nil
+	default:
+	}
+	close(rc.die)
+	conn := rc.conn
+	rc.conn = nil
+	rc.lock.Unlock()
+	if conn != nil {
+		return conn.Close()
+	}
+	return nil
+}
+
+// LocalAddr returns the local address of the connection, the last one
+// while dialing again.
+func (rc *ReconnectingRAWConn) LocalAddr() net.Addr {
+	rc.lock.Lock()
+	defer rc.lock.Unlock()
+	return rc.laddr
+}
+
+func (rc *ReconnectingRAWConn) RemoteAddr() net.Addr {
+	rc.lock.Lock()
+	defer rc.lock.Unlock()
+	return rc.raddr
+}
+
+func (rc *ReconnectingRAWConn) SetDeadline(t time.Time) error {
+	rc.SetReadDeadline(t)
+	return rc.SetWriteDeadline(t)
+}
+
+func (rc *ReconnectingRAWConn) SetReadDeadline(t time.Time) error {
+	rc.lock.Lock()
+	rc.rdeadline = t
+	conn := rc.conn
+	rc.lock.Unlock()
+	if conn != nil {
+		return conn.SetReadDeadline(t)
+	}
+	return nil
+}
+
+func (rc *ReconnectingRAWConn) SetWriteDeadline(t time.Time) error {
+	rc.lock.Lock()
+	rc.wdeadline = t
+	conn := rc.conn
+	rc.lock.Unlock()
+	if conn != nil {
+		return conn.SetWriteDeadline(t)
+	}
+	return nil
+}
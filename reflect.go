@@ -0,0 +1,107 @@
+package rawcon
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"net"
+)
+
+// The address a listener with Raw.ReflectAddr sees a dialer at goes in a
+// header of the HTTP response, or in the Finished record of the TLS reply
+// right behind the room of the padding answer. In TLS it is nonce(8)
+// address(6) tag(8), the IPv4 address and the port masked with the nonce
+// and the tag a truncated SHA-256 of the rest, as for the padding.
+
+const addrAnswerLen = 8 + 6 + 8
+
+var addrHeaderName = []byte("X-Client-Addr: ")
+
+// addrHeader returns the header reflecting addr, if r reflects.
+func (r *Raw) addrHeader(addr *net.UDPAddr) string {
+	if !r.ReflectAddr || addr == nil {
+		return ""
+	}
+	return string(addrHeaderName) + addr.String() + "\r\n"
+}
+
+func parseAddrHeader(b []byte) *net.UDPAddr {
+	i := bytes.Index(b, addrHeaderName)
+	if i < 0 {
+		return nil
+	}
+	v := b[i+len(addrHeaderName):]
+	if j := bytes.IndexByte(v, '\r'); j >= 0 {
+		v = v[:j]
+	}
+	addr, err := net.ResolveUDPAddr("udp4", string(v))
+	if err != nil || addr.IP == nil {
+		return nil
+	}
+	return addr
+}
+
+// reflectLen returns the length of the Finished record of a TLS reply
+// given the one without the address, enough for it if r reflects.
+func (r *Raw) reflectLen(l int) int {
+	if !r.ReflectAddr {
+		return l
+	}
+	return max(l, padOfferLen+addrAnswerLen)
+}
+
+// putReflectedAddr writes addr into fin, the Finished record of a TLS reply
+// of reflectLen, if r reflects.
+func (r *Raw) putReflectedAddr(fin []byte, addr *net.UDPAddr) {
+	ip := addr.IP.To4()
+	if !r.ReflectAddr || ip == nil {
+		return
+	}
+	b := fin[padOfferLen : padOfferLen+addrAnswerLen]
+	r.random().Read(b[:8])
+	copy(b[8:12], ip)
+	binary.BigEndian.PutUint16(b[12:14], uint16(addr.Port))
+	for i := 0; i < 6; i++ {
+		b[8+i] ^= b[i]
+	}
+	copy(b[14:], addrTag(b))
+}
+
+func addrTag(b []byte) []byte {
+	sum := sha256.Sum256(b[:14])
+	return sum[:addrAnswerLen-14]
+}
+
+func parseReflectedAddr(fin []byte) *net.UDPAddr {
+	if len(fin) < padOfferLen+addrAnswerLen {
+		return nil
+	}
+	b := fin[padOfferLen : padOfferLen+addrAnswerLen]
+	if !bytes.Equal(b[14:], addrTag(b)) {
+		return nil
+	}
+	var a [6]byte
+	for i := range a {
+		a[i] = b[8+i] ^ b[i]
+	}
+	return &net.UDPAddr{IP: net.IP(a[:4]), Port: int(binary.BigEndian.Uint16(a[4:]))}
+}
+
+// answeredAddr returns the address of the dialer the reply rep to its
+// handshake reflects, nil if there is none.
+func (r *Raw) answeredAddr(rep []byte) *net.UDPAddr {
+	if r.TLS {
+		return parseReflectedAddr(tlsFinished(rep))
+	}
+	return parseAddrHeader(rep)
+}
+
+// PublicAddr returns the address and port the listener saw the connection
+// at, which differ from LocalAddr behind a NAT. It is nil unless the
+// listener has Raw.ReflectAddr set and the handshake is HTTP or TLS.
+func (conn *RAWConn) PublicAddr() net.Addr {
+	if conn.public == nil {
+		return nil
+	}
+	return conn.public
+}
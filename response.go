@@ -0,0 +1,105 @@
+package rawcon
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+// HTTPResponse is the website a listener in the HTTP mode poses as, see
+// Raw.Response.
+type HTTPResponse struct {
+	// Status is the status line, "HTTP/1.1 200 OK" if empty.
+	Status string
+	// Headers are the header lines, such as "Server: nginx", sent in that
+	// order. Content-Length is added.
+	Headers []string
+	// BodyFile is the file served as the body of the responses to the
+	// requests that are not handshakes of dialers, read anew for each one.
+	// There is no body if it is empty.
+	BodyFile string
+}
+
+func (resp *HTTPResponse) head(headers string, length int64) string {
+	var b strings.Builder
+	if resp.Status == "" {
+		b.WriteString("HTTP/1.1 200 OK\r\n")
+	} else {
+		b.WriteString(strings.TrimRight(resp.Status, "\r\n") + "\r\n")
+	}
+	for _, h := range resp.Headers {
+		b.WriteString(strings.TrimRight(h, "\r\n") + "\r\n")
+	}
+	b.WriteString(headers)
+	fmt.Fprintf(&b, "Content-Length: %d\r\n\r\n", length)
+	return b.String()
+}
+
+// httpResponse returns the reply of a listener to the handshake of a
+// dialer, carrying headers besides the usual ones. Its body is the tunnel,
+// so it announces one longer than most sessions last.
+func (r *Raw) httpResponse(headers string) string {
+	if r.Response == nil {
+		return buildHTTPResponse(r.random(), headers)
+	}
+	return r.Response.head(headers, r.random().Int63()%65536+104857600)
+}
+
+var httpMethods = []string{"GET ", "HEAD ", "POST ", "PUT ", "DELETE ", "OPTIONS ", "PATCH ", "CONNECT ", "TRACE "}
+
+// isWebRequest tells whether b, which is not the handshake of a dialer,
+// looks like an HTTP request the listener should answer as a website.
+func (r *Raw) isWebRequest(b []byte) bool {
+	if r.Response == nil || r.Mixed || !bytes.HasSuffix(b, []byte("\r\n\r\n")) {
+		return false
+	}
+	for _, m := range httpMethods {
+		if bytes.HasPrefix(b, []byte(m)) {
+			return true
+		}
+	}
+	return false
+}
+
+func isHeadRequest(b []byte) bool {
+	return bytes.HasPrefix(b, []byte("HEAD "))
+}
+
+// serveWeb answers a request that is not the handshake of a dialer with
+// Raw.Response, streaming its body from the file a segment at a time, from
+// the read loop like the handshake replies. The segments go out like those
+// of Raw.Chatter, without PSH. The answer to a
+// HEAD request has no body.
+func (listener *RAWListener) serveWeb(info *connInfo, head bool) {
+	resp := listener.r.Response
+	var body io.Reader
+	var length int64
+	if resp.BodyFile != "" {
+		f, err := os.Open(resp.BodyFile)
+		if err != nil {
+			return
+		}
+		defer f.Close()
+		fi, err := f.Stat()
+		if err != nil {
+			return
+		}
+		body, length = f, fi.Size()
+	}
+	rd := io.Reader(strings.NewReader(resp.head("", length)))
+	if body != nil && !head {
+		rd = io.MultiReader(rd, body)
+	}
+	seg := make([]byte, payloadLimit(info.mss, 0, nil, 0))
+	for {
+		n, err := io.ReadFull(rd, seg)
+		if n > 0 && listener.sendChatterWithLayer(seg[:n], info.layer) != nil {
+			return
+		}
+		if err != nil {
+			return
+		}
+	}
+}
@@ -0,0 +1,99 @@
+package rawcon
+
+import (
+	"time"
+
+	"github.com/biotooff/rawcon/utils"
+)
+
+// Backoff is how the wait for a SYN-ACK grows from one try to the next, see
+// RetryPolicy.
+type Backoff int
+
+const (
+	// BackoffConstant waits Timeout on every try.
+	BackoffConstant Backoff = iota
+	// BackoffLinear waits Timeout times the number of the try.
+	BackoffLinear
+	// BackoffExponential doubles the wait on every try.
+	BackoffExponential
+)
+
+// RetryPolicy is how a dialer retries its SYN until the peer answers, see
+// Raw.Retry.
+type RetryPolicy struct {
+	// Attempts is how many SYNs are sent before giving up, 6 if zero.
+	Attempts int
+	// Timeout is the wait for the SYN-ACK of the first try, 500ms if zero.
+	Timeout time.Duration
+	Backoff Backoff
+	// Jitter is the longest random wait added to every try.
+	Jitter time.Duration
+}
+
+var defaultRetryPolicy = RetryPolicy{
+	Attempts: 6,
+	Timeout:  500 * time.Millisecond,
+	Jitter:   500 * time.Millisecond,
+}
+
+func (r *Raw) retryPolicy() RetryPolicy {
+	if r.Retry == nil {
+		return defaultRetryPolicy
+	}
+	p := *r.Retry
+	if p.Attempts <= 0 {
+		p.Attempts = defaultRetryPolicy.Attempts
+	}
+	if p.Timeout <= 0 {
+		p.Timeout = defaultRetryPolicy.Timeout
+	}
+	return p
+}
+
+// wait returns how long try n, counted from zero, waits for the answer.
+func (p *RetryPolicy) wait(rnd utils.Random, n int) time.Duration {
+	d := p.Timeout
+	switch p.Backoff {
+	case BackoffLinear:
+		d *= time.Duration(n + 1)
+	case BackoffExponential:
+		if n > 16 {
+			n = 16
+		}
+		d <<= uint(n)
+	}
+	if p.Jitter > 0 {
+		d += time.Duration(rnd.Int63n(int64(p.Jitter)))
+	}
+	return d
+}
+
+// synRetry counts the SYNs sent by a dial.
+type synRetry struct {
+	policy RetryPolicy
+	tries  int
+	start  time.Time
+	rnd    utils.Random
+	// last is the error that ended the previous try.
+	last error
+}
+
+func (r *Raw) newSYNRetry() *synRetry {
+	return &synRetry{policy: r.retryPolicy(), start: time.Now(), rnd: r.random()}
+}
+
+// next returns how long the next try waits for the SYN-ACK, or a
+// HandshakeError once all the tries are spent.
+func (s *synRetry) next() (time.Duration, error) {
+	if s.tries >= s.policy.Attempts {
+		return 0, &HandshakeError{
+			Stage:    "syn",
+			Attempts: s.tries,
+			Elapsed:  time.Since(s.start),
+			Last:     s.last,
+		}
+	}
+	s.tries++
+	return s.policy.wait(s.rnd, s.tries-1), nil
+}
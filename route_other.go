@@ -0,0 +1,32 @@
+// +build !linux,!windows
+
+package rawcon
+
+import (
+	"bufio"
+	"bytes"
+	"net"
+	"os/exec"
+	"strings"
+)
+
+// nextHop returns the address packets to dst are sent to: a gateway, or dst
+// itself when it is on a local network.
+func nextHop(dst net.IP) (net.IP, error) {
+	out, err := exec.Command("route", "-n", "get", dst.String()).Output()
+	if err != nil {
+		return nil, err
+	}
+	s := bufio.NewScanner(bytes.NewReader(out))
+	for s.Scan() {
+		k, v, ok := strings.Cut(strings.TrimSpace(s.Text()), ":")
+		if !ok || k != "gateway" {
+			continue
+		}
+		// the gateway of a local network is a link, not an address
+		if ip := net.ParseIP(strings.TrimSpace(v)); ip != nil {
+			return ip, nil
+		}
+	}
+	return dst, nil
+}
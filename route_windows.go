@@ -0,0 +1,48 @@
+package rawcon
+
+import (
+	"encoding/binary"
+	"errors"
+	"net"
+	"syscall"
+	"unsafe"
+)
+
+var procGetBestRoute = syscall.NewLazyDLL("iphlpapi.dll").NewProc("GetBestRoute")
+
+// MIB_IPFORWARDROW
+type mibIPForwardRow struct {
+	dest      uint32
+	mask      uint32
+	policy    uint32
+	nextHop   uint32
+	ifIndex   uint32
+	typ       uint32
+	proto     uint32
+	age       uint32
+	nextHopAS uint32
+	metrics   [5]uint32
+}
+
+const mibIPRouteTypeDirect = 3
+
+// nextHop returns the address packets to dst are sent to: a gateway, or dst
+// itself when it is on a local network.
+func nextHop(dst net.IP) (net.IP, error) {
+	ip := dst.To4()
+	if ip == nil {
+		return nil, errors.New("not an IPv4 address: " + dst.String())
+	}
+	var row mibIPForwardRow
+	// addresses are in network byte order
+	ret, _, _ := procGetBestRoute.Call(uintptr(binary.LittleEndian.Uint32(ip)), 0, uintptr(unsafe.Pointer(&row)))
+	if ret != 0 {
+		return nil, syscall.Errno(ret)
+	}
+	if row.typ == mibIPRouteTypeDirect || row.nextHop == 0 {
+		return ip, nil
+	}
+	hop := make(net.IP, 4)
+	binary.LittleEndian.PutUint32(hop, row.nextHop)
+	return hop, nil
+}
@@ -0,0 +1,107 @@
+package rawcon
+
+import (
+	"encoding/binary"
+	"sync"
+	"time"
+)
+
+// With Raw.RTTInterval set a dialer sends a pure ACK carrying the TCP
+// timestamps option at that interval. Listeners answer such a probe with a
+// pure ACK echoing its value, the time it took is a sample of the round
+// trip time. The values count microseconds so that short paths can be
+// measured. A peer that did not offer the timestamps in its SYN gets a
+// window probe instead, see options.go, and the round trip goes unmeasured.
+
+var tsEpoch = time.Now()
+
+func tsNow() uint32 {
+	if ts := uint32(time.Since(tsEpoch) / time.Microsecond); ts != 0 {
+		return ts
+	}
+	return 1
+}
+
+func timestampsData(val, ecr uint32) []byte {
+	b := make([]byte, 8)
+	binary.BigEndian.PutUint32(b, val)
+	binary.BigEndian.PutUint32(b[4:], ecr)
+	return b
+}
+
+func parseTimestamps(data []byte) (val, ecr uint32, ok bool) {
+	if len(data) != 8 {
+		return
+	}
+	return binary.BigEndian.Uint32(data), binary.BigEndian.Uint32(data[4:]), true
+}
+
+// rttEstimator smooths the samples like RFC 6298 does.
+type rttEstimator struct {
+	lock   sync.Mutex
+	srtt   time.Duration
+	rttvar time.Duration
+}
+
+func (e *rttEstimator) sample(d time.Duration) {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	if e.srtt == 0 {
+		e.srtt, e.rttvar = d, d/2
+		return
+	}
+	diff := e.srtt - d
+	if diff < 0 {
+		diff = -diff
+	}
+	e.rttvar = (3*e.rttvar + diff) / 4
+	e.srtt = (7*e.srtt + d) / 8
+}
+
+// echo samples the round trip if the timestamps of a segment read answer
+// a probe, and tells whether they do.
+func (e *rttEstimator) echo(val, ecr uint32, ok bool) bool {
+	if !ok || ecr == 0 {
+		return false
+	}
+	e.sample(time.Duration(tsNow()-ecr) * time.Microsecond)
+	return true
+}
+
+// RTT returns the smoothed round trip time to the peer, zero until it has
+// been measured, see Raw.RTTInterval.
+func (conn *RAWConn) RTT() time.Duration {
+	conn.rtt.lock.Lock()
+	defer conn.rtt.lock.Unlock()
+	return conn.rtt.srtt
+}
+
+// RTTVar returns the variation of the round trip time.
+func (conn *RAWConn) RTTVar() time.Duration {
+	conn.rtt.lock.Lock()
+	defer conn.rtt.lock.Unlock()
+	return conn.rtt.rttvar
+}
+
+func (conn *RAWConn) probeRTT(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-conn.die:
+			return
+		case <-ticker.C:
+			var err error
+			conn.lockLayer()
+			if conn.peer.allowsTimestamps() {
+				err = conn.sendTimestampsWithLayer(conn.layer, tsNow(), 0)
+			} else {
+				err = conn.sendWindowWithLayer(conn.layer, true)
+			}
+			conn.unlockLayer()
+			if err != nil {
+				return
+			}
+		}
+	}
+}
@@ -0,0 +1,138 @@
+package rawcon
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"hash"
+	"net"
+	"sync"
+)
+
+// With Raw.SegmentID a dialed connection that has a session, see
+// RAWConn.Migrate, carries its session id in a TCP option of every segment
+// sent after the handshake, followed by a MAC of the id and of the sequence
+// number of the segment keyed by Raw.Key. A listener reading a segment with
+// data and such an option from an address it does not know moves the
+// connection of that session there if the MAC holds and the data is new to
+// it, so a peer behind a NAT that changes its port mid-flow is not dropped
+// as an unknown one. The option of a segment the listener has already
+// received does not move the connection, so an observer cannot replay it
+// from an address of its own; one that can get a copy of a segment to the
+// listener before the segment itself can still move it.
+
+const (
+	// tcpOptionKindSegmentID is the kind RFC 4727 leaves to experiments.
+	tcpOptionKindSegmentID = 253
+	segmentMACLen          = 8
+	segmentIDOptionLen     = 2 + sessionIDLen + segmentMACLen
+	// segmentIDWindow is how far past the sequence number the listener
+	// expects next the data of a segment moving a connection may start.
+	segmentIDWindow = 1 << 30
+)
+
+// segmentTag is the data of the option a dialed connection tags its
+// segments with.
+type segmentTag struct {
+	macs sync.Pool // of the hash.Hash of segmentMAC
+	data [sessionIDLen + segmentMACLen]byte
+}
+
+// segmentMAC returns the keyed hash of segment ids.
+func (r *Raw) segmentMAC() hash.Hash {
+	key := sha256.Sum256([]byte("segment id" + r.Key))
+	return hmac.New(sha256.New, key[:])
+}
+
+// newSegmentTag returns the tag of the segments of session sid.
+func (r *Raw) newSegmentTag(sid []byte) *segmentTag {
+	t := &segmentTag{}
+	t.macs.New = func() any { return r.segmentMAC() }
+	copy(t.data[:], sid)
+	return t
+}
+
+// putMAC writes the MAC of the segment with sequence number seq to b.
+func (t *segmentTag) putMAC(b []byte, seq uint32) {
+	var sum [sha256.Size]byte
+	mac := t.macs.Get().(hash.Hash)
+	copy(b, segmentSum(mac, t.data[:sessionIDLen], seq, sum[:0]))
+	t.macs.Put(mac)
+}
+
+// stamp puts the MAC of the segment with sequence number seq in t.
+func (t *segmentTag) stamp(seq uint32) {
+	t.putMAC(t.data[sessionIDLen:], seq)
+}
+
+// segmentSum appends the MAC of sid and seq under mac to b.
+func segmentSum(mac hash.Hash, sid []byte, seq uint32, b []byte) []byte {
+	var s [4]byte
+	binary.BigEndian.PutUint32(s[:], seq)
+	mac.Reset()
+	mac.Write(sid)
+	mac.Write(s[:])
+	return mac.Sum(b)[:segmentMACLen]
+}
+
+// stampSegmentID updates the option of layer, if it tags its segments, for
+// the segment it sends next.
+func (layer *pktLayers) stampSegmentID() {
+	if layer.tag != nil {
+		layer.tag.stamp(layer.seq())
+	}
+}
+
+// dial dials address like dialRAW does, tags the segments of the new
+// connection with its session id and publishes its layer for the data
+// segments.
+func (r *Raw) dial(address string, sid []byte, resume *sessionState) (conn *RAWConn, err error) {
+	conn, err = r.dialRAW(address, sid, resume)
+	if err != nil {
+		return
+	}
+	conn.lockLayer()
+	if r.SegmentID && sid != nil {
+		conn.setSegmentID(r.newSegmentTag(sid))
+		if resume == nil && conn.mss > segmentIDOptionLen {
+			conn.mss -= segmentIDOptionLen
+		}
+	}
+	conn.publishLayer()
+	conn.unlockLayer()
+	return
+}
+
+// rebind moves the connection of the session tagged in tag to addr, where
+// a segment with sequence number seq and n bytes of data came from. The
+// caller must hold listener.mutex.
+func (listener *RAWListener) rebind(tag []byte, seq uint32, n int, addr *net.UDPAddr) (info *connInfo, ok bool) {
+	if !listener.r.SegmentID || len(tag) != sessionIDLen+segmentMACLen || n == 0 {
+		return
+	}
+	sid := tag[:sessionIDLen]
+	if info, ok = listener.sessions[string(sid)]; !ok {
+		return
+	}
+	info.lock.Lock()
+	next := info.layer.ack()
+	info.lock.Unlock()
+	var sum [sha256.Size]byte
+	if seq-next >= segmentIDWindow || !hmac.Equal(tag[sessionIDLen:], segmentSum(listener.r.segmentMAC(), sid, seq, sum[:0])) {
+		return nil, false
+	}
+	addrstr := addr.String()
+	for k, v := range listener.conns {
+		if v == info {
+			delete(listener.conns, k)
+		}
+	}
+	listener.conns[addrstr] = info
+	if info.addr.String() != addrstr {
+		listener.aliases[info.addr.String()] = info
+	}
+	info.lock.Lock()
+	info.layer.setDst(addr)
+	info.lock.Unlock()
+	return
+}
@@ -0,0 +1,37 @@
+package rawcon
+
+import (
+	"net"
+	"sync"
+	"time"
+)
+
+// The capture of some Wi-Fi drivers and bridges hands the frames we inject
+// back to us. Every frame sent from the hardware address of one of the
+// interfaces of the host is ours, so the captures skip them.
+
+const hostMACsTTL = 5 * time.Second
+
+var hostMACs struct {
+	sync.Mutex
+	macs map[string]bool
+	at   time.Time
+}
+
+// isHostMAC tells whether mac belongs to an interface of the host. The
+// interfaces are listed again every few seconds to follow hot-plugging.
+func isHostMAC(mac net.HardwareAddr) bool {
+	hostMACs.Lock()
+	defer hostMACs.Unlock()
+	if hostMACs.macs == nil || time.Since(hostMACs.at) > hostMACsTTL {
+		macs := make(map[string]bool)
+		ifaces, _ := net.Interfaces()
+		for _, iface := range ifaces {
+			if len(iface.HardwareAddr) > 0 {
+				macs[string(iface.HardwareAddr)] = true
+			}
+		}
+		hostMACs.macs, hostMACs.at = macs, time.Now()
+	}
+	return hostMACs.macs[string(mac)]
+}
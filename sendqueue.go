@@ -0,0 +1,157 @@
+package rawcon
+
+import (
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/biotooff/rawcon/utils"
+)
+
+// OverflowPolicy is what a full send queue does with one more datagram,
+// see Raw.SendQueue.
+type OverflowPolicy int
+
+const (
+	// DropNewest drops the datagram written.
+	DropNewest OverflowPolicy = iota
+	// DropOldest drops the datagram that waited the longest to make room.
+	DropOldest
+	// BlockOnFull has the write wait for room, until the write deadline.
+	BlockOnFull
+)
+
+// SendStats counts the datagrams of the send queues of a connection, or of
+// all the peers of a listener, see Raw.SendQueue.
+type SendStats struct {
+	// Queued is the number of datagrams waiting to be sent.
+	Queued int
+	// Sent is the number of datagrams handed to the system.
+	Sent int
+	// Dropped is the number of datagrams that did not fit in the queue.
+	Dropped int
+	// Failed is the number of datagrams whose send failed, from the queues
+	// or from the segments Raw.Coalesce sends after CoalesceDelay.
+	Failed int
+}
+
+type sendCounters struct {
+	queued, sent, dropped, failed atomic.Int64
+}
+
+// SendStats returns the counters of the send queues.
+func (conn *RAWConn) SendStats() SendStats {
+	c := &conn.sendc
+	return SendStats{
+		Queued:  int(c.queued.Load()),
+		Sent:    int(c.sent.Load()),
+		Dropped: int(c.dropped.Load()),
+		Failed:  int(c.failed.Load()),
+	}
+}
+
+type queuedSend struct {
+	b    []byte // from utils.GetBuf
+	send func([]byte) (int, error)
+}
+
+// sendQueue holds the datagrams written to a connection or to a peer of a
+// listener until a goroutine sends them, one that runs while there are
+// some.
+type sendQueue struct {
+	lock    sync.Mutex
+	items   []queuedSend
+	max     int
+	policy  OverflowPolicy
+	sending bool
+	// room is closed, and replaced, when a datagram leaves the queue
+	room     chan struct{}
+	die      <-chan struct{}
+	counters *sendCounters
+}
+
+// newSendQueue returns nil without Raw.SendQueue.
+func (r *Raw) newSendQueue(die <-chan struct{}, counters *sendCounters) *sendQueue {
+	if r.SendQueue <= 0 {
+		return nil
+	}
+	return &sendQueue{
+		max:      r.SendQueue,
+		policy:   r.SendOverflow,
+		room:     make(chan struct{}),
+		die:      die,
+		counters: counters,
+	}
+}
+
+// push queues a copy of b for send. With BlockOnFull it waits for room
+// until deadline, if set.
+func (q *sendQueue) push(deadline time.Time, addr func() net.Addr, b []byte, send func([]byte) (int, error)) (n int, err error) {
+	var timeout <-chan time.Time
+	q.lock.Lock()
+	for len(q.items) >= q.max {
+		switch q.policy {
+		case DropOldest:
+			utils.PutBuf(q.items[0].b)
+			q.items[0] = queuedSend{}
+			q.items = q.items[1:]
+			q.counters.queued.Add(-1)
+			q.counters.dropped.Add(1)
+			continue
+		case BlockOnFull:
+			room := q.room
+			q.lock.Unlock()
+			if timeout == nil && !deadline.IsZero() {
+				timer := time.NewTimer(time.Until(deadline))
+				defer timer.Stop()
+				timeout = timer.C
+			}
+			select {
+			case <-room:
+			case <-timeout:
+				return 0, &timeoutErr{op: "write to " + addr().String()}
+			case <-q.die:
+				return 0, net.ErrClosed
+			}
+			q.lock.Lock()
+			continue
+		}
+		q.lock.Unlock()
+		q.counters.dropped.Add(1)
+		return len(b), nil
+	}
+	q.items = append(q.items, queuedSend{b: utils.CopyBuffer(b), send: send})
+	q.counters.queued.Add(1)
+	if !q.sending {
+		q.sending = true
+		go q.run()
+	}
+	q.lock.Unlock()
+	return len(b), nil
+}
+
+// run sends the queued datagrams until there are none left.
+func (q *sendQueue) run() {
+	for {
+		q.lock.Lock()
+		if len(q.items) == 0 {
+			q.sending = false
+			q.lock.Unlock()
+			return
+		}
+		s := q.items[0]
+		q.items[0] = queuedSend{}
+		q.items = q.items[1:]
+		close(q.room)
+		q.room = make(chan struct{})
+		q.lock.Unlock()
+		q.counters.queued.Add(-1)
+		if _, err := s.send(s.b); err != nil {
+			q.counters.failed.Add(1)
+		} else {
+			q.counters.sent.Add(1)
+		}
+		utils.PutBuf(s.b)
+	}
+}
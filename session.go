@@ -0,0 +1,151 @@
+package rawcon
+
+import (
+	"encoding/json"
+	"errors"
+	"net"
+)
+
+// sessionVersion changes whenever sessionState does.
+const sessionVersion = 2
+
+// sessionState is what ExportSession keeps of a dialed connection.
+type sessionState struct {
+	Version int
+	Local   string
+	Remote  string
+	Seq     uint32
+	Ack     uint32
+	HSeq    uint32
+	HLen    uint32 `json:",omitempty"`
+	HPast   bool   `json:",omitempty"`
+	MSS     int
+	Padding int              `json:",omitempty"`
+	SID     []byte           `json:",omitempty"`
+	Udp2raw *udp2rawSnapshot `json:",omitempty"`
+}
+
+// udp2rawSnapshot is the part of udp2rawState a session keeps.
+type udp2rawSnapshot struct {
+	MyID     uint32
+	OppID    uint32
+	ConstID  uint32
+	OppConst uint32
+	Roller   uint8
+	Conv     uint32
+	Seq      uint64
+	MaxSeen  uint64
+}
+
+var (
+	errNotDialed  = errors.New("only dialed connections have a session to export")
+	errBadSession = errors.New("unknown session state")
+)
+
+// ExportSession returns the state of conn, from which ResumeRAW reopens it
+// without a handshake the peer could notice, e.g. in the next process
+// after an upgrade. Stop reading and writing first: conn is detached from
+// the peer and closing it no longer sends a FIN.
+func (conn *RAWConn) ExportSession() ([]byte, error) {
+	if conn.udp == nil {
+		return nil, errNotDialed
+	}
+	conn.detach()
+	conn.lockLayer()
+	seq, ack := conn.seqAck()
+	s := &sessionState{
+		Version: sessionVersion,
+		Local:   conn.LocalAddr().String(),
+		Remote:  conn.RemoteAddr().String(),
+		Seq:     seq,
+		Ack:     ack,
+		HSeq:    conn.hs.seq,
+		HLen:    conn.hs.n,
+		HPast:   conn.hs.past,
+		MSS:     conn.mss,
+		Padding: conn.pad,
+		SID:     conn.sid,
+		Udp2raw: conn.u2r.snapshot(),
+	}
+	conn.unlockLayer()
+	return json.Marshal(s)
+}
+
+// ResumeRAW reopens the connection whose state ExportSession returned. r
+// must be set up like the Raw that dialed it, and the local address of the
+// connection must be free again.
+func (r *Raw) ResumeRAW(session []byte) (conn *RAWConn, err error) {
+	var s sessionState
+	if err = json.Unmarshal(session, &s); err != nil {
+		return
+	}
+	if s.Version != sessionVersion {
+		return nil, errBadSession
+	}
+	conn, err = r.dial(s.Remote, s.SID, &s)
+	if err == nil {
+		conn.start()
+	}
+	return
+}
+
+// localAddr is the address to dial from, nil for a new connection.
+func (s *sessionState) localAddr() *net.UDPAddr {
+	if s == nil {
+		return nil
+	}
+	addr, _ := net.ResolveUDPAddr("udp4", s.Local)
+	return addr
+}
+
+// restore puts the state of s into conn, a connection dialed without a
+// handshake.
+func (s *sessionState) restore(conn *RAWConn) {
+	conn.setSeqAck(s.Seq, s.Ack)
+	conn.hs = hsRange{seq: s.HSeq, n: max(s.HLen, 1), past: s.HPast}
+	// a state saved before the handshake ended has none
+	conn.mss, _ = conn.r.peerMSS(s.MSS, conn.mtu)
+	conn.pad = s.Padding
+	if s.Udp2raw != nil {
+		conn.u2r = s.Udp2raw.state()
+		go conn.udp2rawKeepalive()
+	}
+}
+
+func (s *udp2rawState) snapshot() *udp2rawSnapshot {
+	if s == nil {
+		return nil
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return &udp2rawSnapshot{
+		MyID:     s.myID,
+		OppID:    s.oppID,
+		ConstID:  s.constID,
+		OppConst: s.oppConst,
+		Roller:   s.myRoller,
+		Conv:     s.conv,
+		Seq:      s.seq,
+		MaxSeen:  s.replay.max,
+	}
+}
+
+// state rebuilds the udp2raw state, taking every sequence number up to the
+// last one seen as already seen.
+func (u *udp2rawSnapshot) state() *udp2rawState {
+	s := &udp2rawState{
+		myID:     u.MyID,
+		oppID:    u.OppID,
+		constID:  u.ConstID,
+		oppConst: u.OppConst,
+		myRoller: u.Roller,
+		conv:     u.Conv,
+		seq:      u.Seq,
+		ready:    true,
+	}
+	s.replay.max = u.MaxSeen
+	for i := range s.replay.window {
+		s.replay.window[i] = true
+	}
+	return s
+}
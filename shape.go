@@ -0,0 +1,295 @@
+package rawcon
+
+import (
+	"encoding/binary"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/biotooff/rawcon/utils"
+)
+
+// With Raw.Shape set the sizes and the timing of the segments follow a
+// TrafficModel instead of the datagrams written. A segment is a series of
+// chunks, each one with a 4 byte header: the length of its data as a 16 bit
+// big endian integer, the ID of its datagram, and the index of the chunk in
+// the datagram with the top bit set if more chunks follow. Datagrams larger
+// than a segment thus span several, smaller ones share one, and a chunk of
+// length zero pads the segment out to its end.
+
+const (
+	shapeHeaderLen = 4
+	// shapeMinSegment keeps the chunk headers from taking up most of a
+	// segment
+	shapeMinSegment = 64
+	shapeQueueLen   = 1024
+	shapeMore       = 0x80
+)
+
+// TrafficModel picks the size and the timing of the segments of a shaped
+// connection, see Raw.Shape. A model serves a single connection, or a
+// single peer of a listener.
+type TrafficModel interface {
+	// Next returns the payload size of the next segment, zero for a full
+	// one, and how long to wait before sending it.
+	Next() (size int, gap time.Duration)
+}
+
+// seededModel is a built-in TrafficModel, which draws from Raw.Rand.
+type seededModel interface {
+	seed(rand utils.Random)
+}
+
+// trafficModel returns a new model of Raw.Shape.
+func (r *Raw) trafficModel() TrafficModel {
+	m := r.Shape()
+	if s, ok := m.(seededModel); ok {
+		s.seed(r.random())
+	}
+	return m
+}
+
+type browsingTraffic struct {
+	left int
+	rand utils.Random
+}
+
+// BrowsingTraffic returns a model of page loads: bursts of full segments
+// closely spaced, each one opened by a short segment after a pause of tens
+// to hundreds of milliseconds.
+func BrowsingTraffic() TrafficModel {
+	return &browsingTraffic{}
+}
+
+func (m *browsingTraffic) seed(rand utils.Random) {
+	m.rand = rand
+}
+
+func (m *browsingTraffic) Next() (int, time.Duration) {
+	if m.left == 0 {
+		m.left = 2 + m.rand.Intn(30)
+		return 200 + m.rand.Intn(1000), time.Duration(20+m.rand.Intn(180)) * time.Millisecond
+	}
+	m.left--
+	return 0, time.Duration(m.rand.Intn(2000)) * time.Microsecond
+}
+
+type streamingTraffic struct {
+	left int
+	rand utils.Random
+}
+
+// StreamingTraffic returns a model of adaptive video streaming: chunks of a
+// few hundred full segments sent back to back, every few hundred
+// milliseconds.
+func StreamingTraffic() TrafficModel {
+	return &streamingTraffic{}
+}
+
+func (m *streamingTraffic) seed(rand utils.Random) {
+	m.rand = rand
+}
+
+func (m *streamingTraffic) Next() (int, time.Duration) {
+	if m.left == 0 {
+		m.left = 100 + m.rand.Intn(300)
+		return 0, time.Duration(100+m.rand.Intn(300)) * time.Millisecond
+	}
+	m.left--
+	return 0, time.Duration(m.rand.Intn(200)) * time.Microsecond
+}
+
+// shaper queues the datagrams of a connection and sends them as the model
+// says. Its goroutine runs while there is something queued.
+type shaper struct {
+	lock    sync.Mutex
+	model   TrafficModel
+	limit   func() int
+	send    func(b []byte) error
+	queue   [][]byte
+	id      byte
+	index   byte
+	off     int
+	running bool
+}
+
+func newShaper(model TrafficModel, limit func() int, send func(b []byte) error) *shaper {
+	return &shaper{model: model, limit: limit, send: send}
+}
+
+// write queues a copy of b, dropping it if the queue is full. An empty
+// datagram cannot be told from padding and is dropped too.
+func (s *shaper) write(b []byte) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if len(b) == 0 || len(s.queue) >= shapeQueueLen {
+		return nil
+	}
+	s.queue = append(s.queue, utils.CopyBuffer(b))
+	if !s.running {
+		s.running = true
+		go s.run()
+	}
+	return nil
+}
+
+func (s *shaper) run() {
+	for {
+		size, gap := s.model.Next()
+		time.Sleep(gap)
+		s.lock.Lock()
+		seg := s.segmentLocked(size)
+		s.lock.Unlock()
+		err := s.send(seg)
+		utils.PutBuf(seg)
+		s.lock.Lock()
+		if err != nil {
+			s.dropLocked()
+		}
+		if len(s.queue) == 0 {
+			s.running = false
+			s.lock.Unlock()
+			return
+		}
+		s.lock.Unlock()
+	}
+}
+
+func (s *shaper) dropLocked() {
+	for _, b := range s.queue {
+		utils.PutBuf(b)
+	}
+	s.queue = nil
+	s.off, s.index = 0, 0
+}
+
+// segmentLocked fills a segment of size bytes, padding what the queued
+// datagrams leave empty.
+func (s *shaper) segmentLocked(size int) []byte {
+	limit := s.limit()
+	if size <= 0 || size > limit {
+		size = limit
+	}
+	if size < shapeMinSegment {
+		size = shapeMinSegment
+	}
+	seg := utils.GetBuf(size)
+	n := 0
+	for len(s.queue) > 0 && size-n > shapeHeaderLen {
+		d := s.queue[0]
+		l := len(d) - s.off
+		if l > size-n-shapeHeaderLen {
+			l = size - n - shapeHeaderLen
+		}
+		binary.BigEndian.PutUint16(seg[n:], uint16(l))
+		seg[n+2] = s.id
+		seg[n+3] = s.index
+		n += shapeHeaderLen
+		n += copy(seg[n:], d[s.off:s.off+l])
+		s.off += l
+		if s.off < len(d) {
+			seg[n-l-1] |= shapeMore
+			s.index = nextChunk(s.index)
+			continue
+		}
+		utils.PutBuf(d)
+		s.queue[0] = nil
+		s.queue = s.queue[1:]
+		s.id++
+		s.off, s.index = 0, 0
+	}
+	if n < size {
+		clear(seg[n:size])
+	}
+	return seg[:size]
+}
+
+func (conn *RAWConn) startShaping() {
+	conn.shaper = newShaper(conn.r.trafficModel(), func() int {
+		return payloadLimit(conn.mss, recordLen(conn.r.TLS, conn.r.profile()), conn.u2r, conn.pad)
+	}, func(b []byte) error {
+		_, err := conn.writeSegment(b, 0, time.Time{})
+		return err
+	})
+}
+
+func (listener *RAWListener) peerShaper(info *connInfo) *shaper {
+	if listener.r.Shape == nil {
+		return nil
+	}
+	return newShaper(listener.r.trafficModel(), func() int {
+		return info.payloadLimit()
+	}, func(b []byte) error {
+		_, err := listener.writeSegment(b, info, 0, time.Time{})
+		return err
+	})
+}
+
+// nextChunk returns the index of the chunk after index. Past the largest
+// index the count starts over at one, zero marks the first chunk.
+func nextChunk(index byte) byte {
+	return index%(shapeMore-1) + 1
+}
+
+// partialDatagram is a datagram whose first chunks have been read.
+type partialDatagram struct {
+	id    byte
+	index byte
+	data  []byte
+}
+
+// unshape copies the first datagram completed by the chunks of seg into b
+// and queues the others, it fails if seg completes none. The chunks of a
+// datagram whose previous ones were lost are dropped.
+func (q *datagramQueue) unshape(b []byte, addr net.Addr, seg []byte, max int) (n int, ok bool) {
+	key := addr.String()
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	p := q.partial[key]
+	for len(seg) >= shapeHeaderLen {
+		l := int(binary.BigEndian.Uint16(seg))
+		id, index := seg[2], seg[3]
+		seg = seg[shapeHeaderLen:]
+		if l == 0 || l > len(seg) {
+			break
+		}
+		chunk := seg[:l]
+		seg = seg[l:]
+		if index&^shapeMore == 0 {
+			p = &partialDatagram{id: id}
+		} else if p == nil || p.id != id || p.index != index&^shapeMore {
+			p = nil
+			continue
+		}
+		p.data = append(p.data, chunk...)
+		p.index = nextChunk(p.index)
+		if index&shapeMore != 0 {
+			continue
+		}
+		switch {
+		case !ok:
+			n, ok = copy(b, p.data), true
+		case max > 0 && len(q.items) >= max:
+			q.dropped.Add(1)
+		default:
+			q.items = append(q.items, datagram{addr: addr, data: utils.CopyBuffer(p.data)})
+		}
+		p = nil
+	}
+	if p != nil {
+		if q.partial == nil {
+			q.partial = make(map[string]*partialDatagram)
+		}
+		q.partial[key] = p
+	} else {
+		delete(q.partial, key)
+	}
+	return
+}
+
+// forget drops the datagram being put together for addr.
+func (q *datagramQueue) forget(addr net.Addr) {
+	q.lock.Lock()
+	delete(q.partial, addr.String())
+	q.lock.Unlock()
+}
@@ -0,0 +1,43 @@
+package rawcon
+
+import (
+	"encoding/binary"
+	"errors"
+	"net"
+	"strconv"
+)
+
+var errBadShard = errors.New("Raw.Shard must be below Raw.Shards")
+
+func (r *Raw) checkShard() error {
+	if r.Shards > 1 && (r.Shard < 0 || r.Shard >= r.Shards) {
+		return errBadShard
+	}
+	return nil
+}
+
+// shardOf returns which of n shards serves the peer at ip and port. It must
+// match the expression of shardFilter.
+func shardOf(ip net.IP, port, n int) int {
+	ip4 := ip.To4()
+	if ip4 == nil {
+		return 0
+	}
+	return int((binary.BigEndian.Uint32(ip4) ^ uint32(port)) % uint32(n))
+}
+
+// ownsPeer tells whether the peer at ip and port belongs to the shard of
+// the listener.
+func (listener *RAWListener) ownsPeer(ip net.IP, port int) bool {
+	r := listener.r
+	return r.Shards <= 1 || shardOf(ip, port, r.Shards) == r.Shard
+}
+
+// shardFilter returns the capture filter clause keeping the peers of the
+// shard, empty without sharding.
+func (r *Raw) shardFilter() string {
+	if r.Shards <= 1 {
+		return ""
+	}
+	return " and ((ip[12:4] ^ tcp[0:2]) % " + strconv.Itoa(r.Shards) + " = " + strconv.Itoa(r.Shard) + ")"
+}
@@ -0,0 +1,54 @@
+package rawcon
+
+import (
+	"context"
+	"time"
+)
+
+const drainPoll = 100 * time.Millisecond
+
+// Shutdown closes the listener gracefully: it ignores new SYNs at once but
+// keeps serving ReadFrom and WriteTo for its peers until they have all
+// left or ctx is done. It then sends a FIN to the peers still there and
+// closes. It returns the error of ctx if that cut the drain short.
+func (listener *RAWListener) Shutdown(ctx context.Context) error {
+	listener.draining.Store(true)
+	ticker := time.NewTicker(drainPoll)
+	defer ticker.Stop()
+	for {
+		if b := listener.Backlog(); b.HalfOpen+b.Established == 0 {
+			return listener.Close()
+		}
+		select {
+		case <-ctx.Done():
+			listener.finAll()
+			listener.Close()
+			return ctx.Err()
+		case <-listener.die:
+			return nil
+		case <-ticker.C:
+		}
+	}
+}
+
+// finAll forgets every peer and sends it a FIN.
+func (listener *RAWListener) finAll() {
+	var peers []*connInfo
+	listener.mutex.run(func() {
+		for k, info := range listener.newcons {
+			peers = append(peers, info)
+			delete(listener.newcons, k)
+		}
+		for k, info := range listener.conns {
+			listener.forgetConn(info)
+			peers = append(peers, info)
+			delete(listener.conns, k)
+		}
+		listener.updateFilter()
+	})
+	for _, info := range peers {
+		info.lock.Lock()
+		listener.sendFinWithLayer(info.layer)
+		info.lock.Unlock()
+	}
+}
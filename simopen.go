@@ -0,0 +1,121 @@
+package rawcon
+
+import (
+	"net"
+	"time"
+
+	"github.com/biotooff/rawcon/utils"
+)
+
+// When two dialers reach each other at the same time their SYNs cross and
+// both answer with a SYN-ACK, as on a simultaneous open of TCP. The
+// handshake that follows needs a side to send the request and one to reply,
+// so the end whose SYN carried the greater sequence number plays the
+// listener. Both see the same two numbers, where their addresses may differ
+// behind NATs. Udp2raw has no such roles, its ends cannot cross.
+
+// crossingTimeout bounds the wait of the replying end for the request.
+const crossingTimeout = 8 * time.Second
+
+// crossingQuiet is how long the request has to stay away once replied to for
+// the peer to be taken to have the reply. The peer sends it again well
+// before, every 200 to 300ms.
+const crossingQuiet = time.Second
+
+// answersCrossing tells whether the end whose SYN carried isn replies to
+// the handshake after crossing the SYN of the peer, which carried peer.
+func answersCrossing(isn, peer uint32) bool {
+	return isn > peer
+}
+
+// answerRequest returns the reply of r to the handshake request req of the
+// dialer at addr, and the padding agreed on. rep is nil if req is not a
+// request.
+func (r *Raw) answerRequest(req []byte, addr *net.UDPAddr) (rep []byte, pad int) {
+	if p := r.profile(); p != profileNone {
+		rep, _, _ = p.answer(r.random(), req)
+		return
+	}
+	if r.TLS {
+		ok, _, msg := utils.ParseTLSClientHelloMsg(req)
+		if !ok {
+			return nil, 0
+		}
+		pad = r.agreePadding(parsePadOffer(msg.SessionTicket))
+		return r.tlsReply(msg.SessionId, pad, addr), pad
+	}
+	if !isHTTPMessage(req, "POST") {
+		return nil, 0
+	}
+	pad = r.agreePadding(parsePadHeader(req))
+	return []byte(r.httpResponse(padHeader(pad) + r.addrHeader(addr))), pad
+}
+
+// tlsReply returns the reply to the ClientHello of the dialer at addr with
+// sessionID, answering pad.
+func (r *Raw) tlsReply(sessionID []byte, pad int, addr *net.UDPAddr) []byte {
+	rep := make([]byte, 2048)
+	l := r.reflectLen(padAnswerLen(r.random().Intn(128), pad))
+	h := r.random().GenTLSServerHello(rep, l, sessionID)
+	if pad > 0 {
+		putPadOffer(r.random(), rep[h:], pad)
+	}
+	r.putReflectedAddr(rep[h:], addr)
+	return rep[:l+h]
+}
+
+// answerCrossing has a connection whose SYN crossed the one of the peer
+// reply to the handshake request of the peer, see answersCrossing.
+func (conn *RAWConn) answerCrossing() (err error) {
+	layer := conn.layer
+	start := time.Now()
+	var rep []byte
+	var reqseq uint32
+	for {
+		wait := crossingTimeout - time.Since(start)
+		if rep != nil {
+			wait = crossingQuiet
+		}
+		if err = conn.SetReadDeadline(time.Now().Add(wait)); err != nil {
+			return
+		}
+		var seg segment
+		if seg, err = conn.readSegment(); err != nil {
+			e, ok := err.(net.Error)
+			if !ok || !e.Timeout() {
+				return
+			}
+			if rep == nil {
+				return &HandshakeError{Stage: "request", Elapsed: time.Since(start), Last: err}
+			}
+			break
+		}
+		if seg.syn && seg.ack {
+			if err = conn.sendAck(); err != nil {
+				return
+			}
+			continue
+		}
+		if !seg.psh || !seg.ack || seg.n == 0 {
+			continue
+		}
+		if rep != nil && seg.seq != reqseq {
+			// data, the peer has the reply
+			break
+		}
+		if rep == nil {
+			if rep, conn.pad = conn.r.answerRequest(seg.payload, seg.src); rep == nil {
+				continue
+			}
+			reqseq = seg.seq
+			layer.setAck(seg.seq + uint32(seg.n))
+			conn.hs.set(seg.seq, seg.n)
+		}
+		if _, err = conn.write(rep); err != nil {
+			return
+		}
+	}
+	layer.setSeq(layer.seq() + uint32(len(rep)))
+	conn.noteRequests(1, start)
+	return nil
+}
@@ -0,0 +1,149 @@
+package rawcon
+
+import (
+	"bytes"
+	"encoding/binary"
+
+	"github.com/biotooff/rawcon/utils"
+)
+
+// With Raw.SSH the connection poses as an SSH session. The handshake is the
+// swap of version banners, each followed by a key exchange init packet, the
+// one of the dialer with the session token, if any, at the start of its
+// padding. Then every segment of data is a binary packet as it looks once
+// encrypted with AES-GCM: the length in clear, the padding length, the
+// data, 4 to 19 random bytes of padding and a random tag in place of the
+// real one.
+
+const (
+	sshMsgKexInit = 20
+	sshCookieLen  = 16
+	sshMACLen     = 16
+	sshBlock      = 16
+	// sshRecordLen is the most a segment of data spends on the framing
+	sshRecordLen = 4 + 1 + 4 + sshBlock - 1 + sshMACLen
+)
+
+var sshBanners = []string{
+	"SSH-2.0-OpenSSH_9.6p1 Ubuntu-3ubuntu13.5\r\n",
+	"SSH-2.0-OpenSSH_9.2p1 Debian-2+deb12u3\r\n",
+	"SSH-2.0-OpenSSH_8.9p1 Ubuntu-3ubuntu0.10\r\n",
+	"SSH-2.0-OpenSSH_9.8\r\n",
+}
+
+var sshBannerPrefix = []byte("SSH-2.0-")
+
+// the name-lists of the key exchange init packets of OpenSSH 9.6, client
+// and server, from the algorithms to the languages
+var (
+	sshClientAlgorithms = []string{
+		"sntrup761x25519-sha512@openssh.com,curve25519-sha256,curve25519-sha256@libssh.org,ecdh-sha2-nistp256,ecdh-sha2-nistp384,ecdh-sha2-nistp521,diffie-hellman-group-exchange-sha256,diffie-hellman-group16-sha512,diffie-hellman-group18-sha512,diffie-hellman-group14-sha256,ext-info-c,kex-strict-c-v00@openssh.com",
+		"ssh-ed25519-cert-v01@openssh.com,ecdsa-sha2-nistp256-cert-v01@openssh.com,rsa-sha2-512-cert-v01@openssh.com,rsa-sha2-256-cert-v01@openssh.com,ssh-ed25519,ecdsa-sha2-nistp256,rsa-sha2-512,rsa-sha2-256",
+	}
+	sshServerAlgorithms = []string{
+		"sntrup761x25519-sha512@openssh.com,curve25519-sha256,curve25519-sha256@libssh.org,ecdh-sha2-nistp256,ecdh-sha2-nistp384,ecdh-sha2-nistp521,diffie-hellman-group-exchange-sha256,diffie-hellman-group16-sha512,diffie-hellman-group18-sha512,diffie-hellman-group14-sha256,ext-info-s,kex-strict-s-v00@openssh.com",
+		"rsa-sha2-512,rsa-sha2-256,ecdsa-sha2-nistp256,ssh-ed25519",
+	}
+	sshCiphers     = "chacha20-poly1305@openssh.com,aes128-ctr,aes192-ctr,aes256-ctr,aes128-gcm@openssh.com,aes256-gcm@openssh.com"
+	sshMACs        = "umac-64-etm@openssh.com,umac-128-etm@openssh.com,hmac-sha2-256-etm@openssh.com,hmac-sha2-512-etm@openssh.com,hmac-sha1-etm@openssh.com,umac-64@openssh.com,umac-128@openssh.com,hmac-sha2-256,hmac-sha2-512,hmac-sha1"
+	sshCompression = "none,zlib@openssh.com"
+)
+
+// sshPadding returns the padding of a packet of n bytes, at least min, that
+// makes it a multiple of block.
+func sshPadding(n, block, min int) int {
+	return min + (block-(n+min)%block)%block
+}
+
+// sshHello returns a version banner followed by a key exchange init packet
+// with algorithms, the first name-lists, and token at the start of the
+// padding.
+func sshHello(rnd utils.Random, algorithms []string, token []byte) []byte {
+	b := []byte(sshBanners[rnd.Intn(len(sshBanners))])
+	start := len(b)
+	b = append(b, 0, 0, 0, 0, 0, sshMsgKexInit)
+	cookie := make([]byte, sshCookieLen)
+	rnd.Read(cookie)
+	b = append(b, cookie...)
+	lists := append(append([]string{}, algorithms...), sshCiphers, sshCiphers, sshMACs, sshMACs, sshCompression, sshCompression, "", "")
+	for _, l := range lists {
+		b = binary.BigEndian.AppendUint32(b, uint32(len(l)))
+		b = append(b, l...)
+	}
+	// first_kex_packet_follows and the reserved field
+	b = append(b, 0, 0, 0, 0, 0)
+	// unencrypted packets are a multiple of 8 bytes with their length
+	p := sshPadding(len(b)-start, 8, 4+len(token))
+	b = append(b, token...)
+	pad := make([]byte, p-len(token))
+	rnd.Read(pad)
+	b = append(b, pad...)
+	binary.BigEndian.PutUint32(b[start:], uint32(len(b)-start-4))
+	b[start+4] = byte(p)
+	return b
+}
+
+// sshRequest returns the handshake of a dialer carrying the session token
+// of sid.
+func (r *Raw) sshRequest(sid []byte) []byte {
+	return sshHello(r.random(), sshClientAlgorithms, r.sessionToken(sid))
+}
+
+// parseSSHHello returns the padding of the key exchange init packet that
+// follows the banner in b.
+func parseSSHHello(b []byte) (padding []byte, ok bool) {
+	if !bytes.HasPrefix(b, sshBannerPrefix) {
+		return nil, false
+	}
+	i := bytes.Index(b, []byte("\r\n"))
+	if i < 0 || i > 253 {
+		return nil, false
+	}
+	pkt := b[i+2:]
+	if len(pkt) < 6 || int(binary.BigEndian.Uint32(pkt)) != len(pkt)-4 || pkt[5] != sshMsgKexInit {
+		return nil, false
+	}
+	p := int(pkt[4])
+	if p < 4 || 1+p > len(pkt)-4 {
+		return nil, false
+	}
+	return pkt[len(pkt)-p:], true
+}
+
+// sshAnswer returns the reply of the listener to the handshake b and the
+// session token it carries, nil if there is none.
+func sshAnswer(rnd utils.Random, b []byte) (rep, token []byte, ok bool) {
+	padding, ok := parseSSHHello(b)
+	if !ok {
+		return nil, nil, false
+	}
+	if len(padding) >= sessionTokenLen+4 {
+		token = padding[:sessionTokenLen]
+	}
+	return sshHello(rnd, sshServerAlgorithms, nil), token, true
+}
+
+// sealSSH returns b in a binary packet of its own, in a buffer of
+// utils.GetBuf.
+func sealSSH(rnd utils.Random, b []byte) []byte {
+	p := sshPadding(1+len(b), sshBlock, 4)
+	buf := utils.GetBuf(4 + 1 + len(b) + p + sshMACLen)
+	binary.BigEndian.PutUint32(buf, uint32(1+len(b)+p))
+	buf[4] = byte(p)
+	copy(buf[5:], b)
+	rnd.Read(buf[5+len(b):])
+	return buf
+}
+
+// openSSH returns the data of a packet of sealSSH.
+func openSSH(b []byte) ([]byte, bool) {
+	if len(b) < 4+1+sshMACLen {
+		return nil, false
+	}
+	l := int(binary.BigEndian.Uint32(b))
+	p := int(b[4])
+	if l != len(b)-4-sshMACLen || p < 4 || 1+p > l {
+		return nil, false
+	}
+	return b[5 : 4+l-p], true
+}
@@ -0,0 +1,125 @@
+package rawcon
+
+import (
+	"errors"
+	"net"
+	"os/exec"
+	"regexp"
+	"strconv"
+
+	"golang.org/x/net/bpf"
+)
+
+// skfAdQueue is SKF_AD_OFF + SKF_AD_QUEUE, where a socket filter loads the
+// queue_mapping of a packet from: the receive queue plus one, zero if the
+// driver did not record it.
+const skfAdQueue = 0xfffff000 + uint32(bpf.ExtQueue)
+
+var ethtoolRuleID = regexp.MustCompile(`Added rule with ID (\d+)`)
+
+// maxSteerRules bounds the rules of a listener, one for each of its ports.
+const maxSteerRules = 16
+
+// steerRule is an ntuple rule added with ethtool.
+type steerRule struct {
+	dev string
+	id  string
+}
+
+// ethtool returns the command running ethtool with args, tests replace it.
+var ethtool = func(args ...string) *exec.Cmd {
+	return exec.Command("ethtool", args...)
+}
+
+func (rule steerRule) delete() {
+	ethtool("-N", rule.dev, "delete", rule.id).Run()
+}
+
+// addSteerRule has the NIC dev deliver the TCP segments to ip, any address
+// if nil, and port on queue.
+func addSteerRule(dev string, ip net.IP, port, queue int) (steerRule, error) {
+	args := []string{"-N", dev, "flow-type", "tcp4"}
+	if ip != nil {
+		args = append(args, "dst-ip", ip.String())
+	}
+	args = append(args, "dst-port", strconv.Itoa(port), "action", strconv.Itoa(queue))
+	out, err := ethtool(args...).CombinedOutput()
+	if err != nil {
+		return steerRule{}, errors.New("ethtool: " + string(out))
+	}
+	m := ethtoolRuleID.FindSubmatch(out)
+	if m == nil {
+		return steerRule{}, errors.New("ethtool did not report the rule: " + string(out))
+	}
+	return steerRule{dev: dev, id: string(m[1])}, nil
+}
+
+// steerFlows adds the rules of Raw.FlowSteering for the listener, on the
+// interface of its address or on every interface up if it listens on all
+// of them. It adds all the rules or none, a packet that arrives on a queue
+// without one would be dropped by steerFilter. undo deletes them.
+func (listener *RAWListener) steerFlows() (undo func(), err error) {
+	r, laddr := listener.r, listener.laddr
+	var ifaces []net.Interface
+	ip := laddr.IP.To4()
+	if ip.Equal(ipv4AddrAny) {
+		ip = nil
+		all, err := net.Interfaces()
+		if err != nil {
+			return nil, err
+		}
+		for _, iface := range all {
+			if iface.Flags&net.FlagUp != 0 {
+				ifaces = append(ifaces, iface)
+			}
+		}
+	} else if iface := interfaceOf(ip); iface != nil {
+		ifaces = append(ifaces, *iface)
+	}
+	var rules []steerRule
+	undo = func() {
+		for _, rule := range rules {
+			rule.delete()
+		}
+	}
+	var ports []int
+	for _, p := range listener.lports {
+		for port := p.lo; port <= p.hi && len(ports) <= maxSteerRules; port++ {
+			ports = append(ports, port)
+		}
+	}
+	if len(ports) > maxSteerRules {
+		return nil, errors.New("too many ports to steer the flows of")
+	}
+	for _, iface := range ifaces {
+		if iface.Flags&net.FlagLoopback != 0 {
+			// lo has a single queue and no ntuple rules
+			undo()
+			return nil, errors.New("cannot steer the flows of " + iface.Name)
+		}
+		for _, port := range ports {
+			rule, err := addSteerRule(iface.Name, ip, port, r.SteerQueue)
+			if err != nil {
+				undo()
+				return nil, err
+			}
+			rules = append(rules, rule)
+		}
+	}
+	if len(rules) == 0 {
+		return nil, errors.New("no interface to steer the flows of " + laddr.String())
+	}
+	return undo, nil
+}
+
+// steerFilter puts a check in front of filter that drops the packets the
+// NIC delivered on another queue than queue. Those the driver did not
+// record the queue of go on to filter.
+func steerFilter(queue int, filter []bpf.RawInstruction) []bpf.RawInstruction {
+	return append([]bpf.RawInstruction{
+		{0x20, 0, 0, skfAdQueue},
+		{0x15, 2, 0, 0},
+		{0x15, 1, 0, uint32(queue) + 1},
+		{0x6, 0, 0, 0},
+	}, filter...)
+}
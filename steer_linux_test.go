@@ -0,0 +1,84 @@
+package rawcon
+
+import (
+	"net"
+	"os/exec"
+	"reflect"
+	"strings"
+	"testing"
+
+	"golang.org/x/net/bpf"
+)
+
+func TestSteerFilter(t *testing.T) {
+	filter, err := bpf.Assemble([]bpf.Instruction{bpf.RetConstant{Val: 0xffff}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	insts, ok := bpf.Disassemble(steerFilter(3, filter))
+	if !ok {
+		t.Fatalf("cannot disassemble %v", insts)
+	}
+	// the packets of queue 3, and those of no queue, jump to the filter
+	want := []bpf.Instruction{
+		bpf.LoadExtension{Num: bpf.ExtQueue},
+		bpf.JumpIf{Cond: bpf.JumpEqual, Val: 0, SkipTrue: 2},
+		bpf.JumpIf{Cond: bpf.JumpEqual, Val: 4, SkipTrue: 1},
+		bpf.RetConstant{Val: 0},
+		bpf.RetConstant{Val: 0xffff},
+	}
+	if !reflect.DeepEqual(insts, want) {
+		t.Fatalf("got %v, want %v", insts, want)
+	}
+}
+
+// stubEthtool has ethtool print out instead of running, and fail if fail
+// is set. It returns the arguments of each call.
+func stubEthtool(t *testing.T, out string, fail bool) *[][]string {
+	var calls [][]string
+	saved := ethtool
+	t.Cleanup(func() { ethtool = saved })
+	ethtool = func(args ...string) *exec.Cmd {
+		calls = append(calls, args)
+		script := "printf '%s\\n' \"$0\""
+		if fail {
+			script += "; exit 1"
+		}
+		return exec.Command("sh", "-c", script, out)
+	}
+	return &calls
+}
+
+func TestAddSteerRule(t *testing.T) {
+	calls := stubEthtool(t, "Added rule with ID 1021", false)
+	rule, err := addSteerRule("eth0", net.IPv4(192, 0, 2, 1), 6000, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rule != (steerRule{dev: "eth0", id: "1021"}) {
+		t.Fatalf("unexpected rule %+v", rule)
+	}
+	if _, err = addSteerRule("eth1", nil, 6001, 0); err != nil {
+		t.Fatal(err)
+	}
+	rule.delete()
+	want := [][]string{
+		{"-N", "eth0", "flow-type", "tcp4", "dst-ip", "192.0.2.1", "dst-port", "6000", "action", "3"},
+		{"-N", "eth1", "flow-type", "tcp4", "dst-port", "6001", "action", "0"},
+		{"-N", "eth0", "delete", "1021"},
+	}
+	if !reflect.DeepEqual(*calls, want) {
+		t.Fatalf("ran ethtool with %q, want %q", *calls, want)
+	}
+}
+
+func TestAddSteerRuleErrors(t *testing.T) {
+	stubEthtool(t, "rxclass: Cannot insert RX class rule: Operation not supported", true)
+	if _, err := addSteerRule("eth0", nil, 6000, 1); err == nil || !strings.Contains(err.Error(), "not supported") {
+		t.Fatalf("failed ethtool returned %v", err)
+	}
+	stubEthtool(t, "done", false)
+	if _, err := addSteerRule("eth0", nil, 6000, 1); err == nil {
+		t.Fatal("took a rule ethtool did not report")
+	}
+}
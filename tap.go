@@ -0,0 +1,133 @@
+package rawcon
+
+import (
+	"encoding/binary"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// TapPacket is a copy of a packet a connection or a listener sent or
+// received, see RAWConn.Tap.
+type TapPacket struct {
+	Time time.Time
+	// Out tells that the packet was sent rather than received.
+	Out      bool
+	Src, Dst *net.UDPAddr
+	TTL      int
+	// Flags is the flags byte of the TCP header, FIN being 0x01.
+	Flags   uint8
+	Seq     uint32
+	Ack     uint32
+	Window  uint16
+	Options []byte
+	Payload []byte
+}
+
+// packetTap hands the packets of a connection over to the channel of Tap.
+type packetTap struct {
+	lock    sync.Mutex
+	c       chan TapPacket
+	done    chan struct{} // closed with c, ending the watch of the owner
+	closed  bool
+	dropped atomic.Uint64
+}
+
+func (t *packetTap) close() {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if !t.closed {
+		t.closed = true
+		close(t.c)
+		close(t.done)
+	}
+}
+
+// segment passes on the TCP segment seg from src to dst, dropping it if
+// the channel is full.
+func (t *packetTap) segment(out bool, src, dst net.IP, ttl uint8, seg []byte) {
+	if len(seg) < 20 {
+		return
+	}
+	hl := int(seg[12]>>4) * 4
+	if hl < 20 || hl > len(seg) {
+		return
+	}
+	b := append([]byte(nil), seg...)
+	p := TapPacket{
+		Time:    time.Now(),
+		Out:     out,
+		Src:     &net.UDPAddr{IP: append(net.IP(nil), src...), Port: int(binary.BigEndian.Uint16(b))},
+		Dst:     &net.UDPAddr{IP: append(net.IP(nil), dst...), Port: int(binary.BigEndian.Uint16(b[2:]))},
+		TTL:     int(ttl),
+		Flags:   b[13],
+		Seq:     binary.BigEndian.Uint32(b[4:]),
+		Ack:     binary.BigEndian.Uint32(b[8:]),
+		Window:  binary.BigEndian.Uint16(b[14:]),
+		Options: b[20:hl:hl],
+		Payload: b[hl:],
+	}
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if t.closed {
+		return
+	}
+	select {
+	case t.c <- p:
+	default:
+		t.dropped.Add(1)
+	}
+}
+
+// ip passes on the IPv4 packet made of hdr and payload.
+func (t *packetTap) ip(out bool, hdr, payload []byte) {
+	if len(hdr) < 20 {
+		return
+	}
+	t.segment(out, net.IP(hdr[12:16]), net.IP(hdr[16:20]), hdr[8], payload)
+}
+
+// frame passes on the IPv4 packet in a frame sent, after a link header of
+// linklen bytes.
+func (t *packetTap) frame(frame []byte, linklen int) {
+	if seg, src, dst, ok := parseIPv4(frame[min(linklen, len(frame)):]); ok {
+		t.segment(true, src, dst, frame[linklen+8], seg)
+	}
+}
+
+// Tap returns a channel of copies of the packets the connection, or the
+// listener, sends and receives from now on, decoded down to TCP. It holds
+// up to n packets, those arriving while it is full are dropped, so that a
+// slow reader never holds the connection up; TapDropped counts them.
+// Another call replaces the channel, closing the previous one, and the
+// channel is closed with the connection. Tap(0) stops tapping.
+func (conn *RAWConn) Tap(n int) <-chan TapPacket {
+	var t *packetTap
+	if n > 0 {
+		t = &packetTap{c: make(chan TapPacket, n), done: make(chan struct{})}
+	}
+	if old := conn.tap.Swap(t); old != nil {
+		old.close()
+	}
+	if t == nil {
+		return nil
+	}
+	go func() {
+		select {
+		case <-conn.die:
+			t.close()
+		case <-t.done:
+		}
+	}()
+	return t.c
+}
+
+// TapDropped returns the number of packets the current tap dropped because
+// its channel was full.
+func (conn *RAWConn) TapDropped() uint64 {
+	if t := conn.tap.Load(); t != nil {
+		return t.dropped.Load()
+	}
+	return 0
+}
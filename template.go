@@ -0,0 +1,246 @@
+// +build !linux
+
+package rawcon
+
+import (
+	"encoding/binary"
+	"errors"
+
+	"github.com/biotooff/rawcon/utils"
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+// Most of the headers of the segments of a connection are the same from one
+// segment to the next. The first segment is serialized with gopacket and
+// its headers kept as a template; while the constant fields stay the same,
+// the following segments copy the template, patch the sequence numbers, the
+// IP ID and the lengths, and update the checksums incrementally.
+
+var errBadTemplate = errors.New("cannot parse the serialized headers")
+
+type templateKey struct {
+	link         [16]byte
+	linklen      int
+	src, dst     [4]byte
+	sport, dport layers.TCPPort
+	flags        uint16
+	window       uint16
+	urgent       uint16
+	tos, ttl     uint8
+	ipflags      layers.IPv4Flag
+}
+
+type headerTemplate struct {
+	key  templateKey
+	opts []layers.TCPOption
+	hdr  []byte
+	// ipoff and tcpoff are where the IPv4 and TCP headers start in hdr
+	ipoff  int
+	tcpoff int
+	// minlen is the shortest frame of the link, shorter ones are padded
+	minlen int
+}
+
+func tcpFlags(tcp *layers.TCP) (f uint16) {
+	for i, b := range []bool{tcp.FIN, tcp.SYN, tcp.RST, tcp.PSH, tcp.ACK, tcp.URG, tcp.ECE, tcp.CWR, tcp.NS} {
+		if b {
+			f |= 1 << uint(i)
+		}
+	}
+	return
+}
+
+// keyOf returns the constant fields of a segment, or false if the segment
+// cannot use a template.
+func keyOf(link gopacket.SerializableLayer, ip4 *layers.IPv4, tcp *layers.TCP) (k templateKey, ok bool) {
+	src, dst := ip4.SrcIP.To4(), ip4.DstIP.To4()
+	if src == nil || dst == nil || len(ip4.Options) != 0 || ip4.FragOffset != 0 {
+		return
+	}
+	switch l := link.(type) {
+	case *layers.Ethernet:
+		if len(l.SrcMAC) != 6 || len(l.DstMAC) != 6 {
+			return
+		}
+		k.linklen = copy(k.link[:], l.DstMAC)
+		k.linklen += copy(k.link[k.linklen:], l.SrcMAC)
+		binary.BigEndian.PutUint16(k.link[k.linklen:], uint16(l.EthernetType))
+		k.linklen += 2
+	case *layers.Loopback:
+		binary.BigEndian.PutUint32(k.link[:], uint32(l.Family))
+		k.linklen = 4
+	case gopacket.Payload:
+		if len(l) > len(k.link) {
+			return
+		}
+		k.linklen = copy(k.link[:], l)
+	default:
+		return
+	}
+	// gopacket keeps the padding of earlier options when the options no
+	// longer need any, and sends it as payload
+	n := 0
+	for _, o := range tcp.Options {
+		if o.OptionType <= 1 {
+			n++
+		} else {
+			n += 2 + len(o.OptionData)
+		}
+	}
+	if n%4 == 0 && len(tcp.Padding) != 0 {
+		return
+	}
+	copy(k.src[:], src)
+	copy(k.dst[:], dst)
+	k.sport, k.dport = tcp.SrcPort, tcp.DstPort
+	k.flags = tcpFlags(tcp)
+	k.window, k.urgent = tcp.Window, tcp.Urgent
+	k.tos, k.ttl = ip4.TOS, ip4.TTL
+	k.ipflags = ip4.Flags
+	return k, true
+}
+
+func sameOptions(a, b []layers.TCPOption) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i].OptionType != b[i].OptionType || a[i].OptionLength != b[i].OptionLength ||
+			string(a[i].OptionData) != string(b[i].OptionData) {
+			return false
+		}
+	}
+	return true
+}
+
+func copyOptions(opts []layers.TCPOption) []layers.TCPOption {
+	out := make([]layers.TCPOption, len(opts))
+	for i, o := range opts {
+		out[i] = o
+		out[i].OptionData = append([]byte(nil), o.OptionData...)
+	}
+	return out
+}
+
+// newTemplate serializes the headers of a segment with no payload.
+func newTemplate(k templateKey, opts gopacket.SerializeOptions, link gopacket.SerializableLayer, ip4 *layers.IPv4, tcp *layers.TCP) (*headerTemplate, error) {
+	buffer := gopacket.NewSerializeBuffer()
+	if err := gopacket.SerializeLayers(buffer, opts, link, ip4, tcp, gopacket.Payload(nil)); err != nil {
+		return nil, err
+	}
+	hdr := buffer.Bytes()
+	ipoff := k.linklen
+	if ipoff+20 > len(hdr) {
+		return nil, errBadTemplate
+	}
+	tcpoff := ipoff + int(hdr[ipoff]&0xf)*4
+	if tcpoff+20 > len(hdr) {
+		return nil, errBadTemplate
+	}
+	// the headers end before the padding of a short Ethernet frame
+	end := tcpoff + int(hdr[tcpoff+12]>>4)*4
+	if end > len(hdr) || int(binary.BigEndian.Uint16(hdr[ipoff+2:])) != end-ipoff {
+		return nil, errBadTemplate
+	}
+	t := &headerTemplate{
+		key:    k,
+		opts:   copyOptions(tcp.Options),
+		hdr:    append([]byte(nil), hdr[:end]...),
+		ipoff:  ipoff,
+		tcpoff: tcpoff,
+	}
+	if _, ok := link.(*layers.Ethernet); ok {
+		t.minlen = 60
+	}
+	return t, nil
+}
+
+// validChecksums tells whether the checksums of the decoded ip4 and tcp are
+// right, partial taking a TCP checksum left to the NIC.
+func validChecksums(ip4 *layers.IPv4, tcp *layers.TCP, partial bool) bool {
+	return ipv4HeaderValid(ip4.Contents) && tcpChecksumValid(ip4.SrcIP, ip4.DstIP, partial, tcp.Contents, tcp.Payload)
+}
+
+// partialUDPChecksum tells whether the captured UDP packet carries the sum
+// of its pseudo-header only, which the system leaves for the NIC to finish.
+func partialUDPChecksum(packet gopacket.Packet) bool {
+	ip4, ok := packet.Layer(layers.LayerTypeIPv4).(*layers.IPv4)
+	if !ok {
+		return false
+	}
+	udp, ok := packet.Layer(layers.LayerTypeUDP).(*layers.UDP)
+	if !ok {
+		return false
+	}
+	n := len(udp.Contents) + len(udp.Payload)
+	return udp.Checksum == csumFold(pseudoSum(17, ip4.SrcIP, ip4.DstIP, n))
+}
+
+// putFrameChecksum leaves the TCP checksum of frame to the NIC. The IPv4
+// packet follows a link header of linklen bytes.
+func putFrameChecksum(frame []byte, linklen int) {
+	if len(frame) > linklen {
+		putPartialChecksum(frame[linklen:])
+	}
+}
+
+// frame returns the segment of ip4 and tcp carrying payload, built from the
+// template. The caller gives the frame back with utils.PutBuf.
+func (t *headerTemplate) frame(ip4 *layers.IPv4, tcp *layers.TCP, payload []byte) []byte {
+	n := len(t.hdr) + len(payload)
+	b := utils.GetBuf(n)
+	copy(b, t.hdr)
+	copy(b[len(t.hdr):], payload)
+	if n < t.minlen {
+		b = append(b, make([]byte, t.minlen-n)...)
+	}
+
+	ip := b[t.ipoff:t.tcpoff]
+	iplen := uint16(n - t.ipoff)
+	s := uint32(^binary.BigEndian.Uint16(ip[10:]))
+	s = csumReplace(s, binary.BigEndian.Uint16(ip[2:]), iplen)
+	s = csumReplace(s, binary.BigEndian.Uint16(ip[4:]), ip4.Id)
+	binary.BigEndian.PutUint16(ip[2:], iplen)
+	binary.BigEndian.PutUint16(ip[4:], ip4.Id)
+	binary.BigEndian.PutUint16(ip[10:], ^csumFold(s))
+
+	seg := b[t.tcpoff:n]
+	hdrlen := uint16(len(t.hdr) - t.tcpoff)
+	s = uint32(^binary.BigEndian.Uint16(seg[16:]))
+	// the TCP length of the pseudo header
+	s = csumReplace(s, hdrlen, hdrlen+uint16(len(payload)))
+	var words [8]byte
+	copy(words[:], seg[4:12])
+	binary.BigEndian.PutUint32(seg[4:], tcp.Seq)
+	binary.BigEndian.PutUint32(seg[8:], tcp.Ack)
+	for i := 0; i < 8; i += 2 {
+		s = csumReplace(s, binary.BigEndian.Uint16(words[i:]), binary.BigEndian.Uint16(seg[4+i:]))
+	}
+	s = csumAdd(s, payload)
+	binary.BigEndian.PutUint16(seg[16:], ^csumFold(s))
+	return b
+}
+
+// templateFrame returns the segment built from the template in *tp,
+// replacing it first when a constant field changed, or nil if the segment
+// has to be serialized in full.
+func templateFrame(tp **headerTemplate, opts gopacket.SerializeOptions, link gopacket.SerializableLayer, ip4 *layers.IPv4, tcp *layers.TCP, payload []byte) []byte {
+	if !opts.FixLengths || !opts.ComputeChecksums || len(payload) > 65535-60-20 {
+		return nil
+	}
+	k, ok := keyOf(link, ip4, tcp)
+	if !ok {
+		return nil
+	}
+	t := *tp
+	if t == nil || t.key != k || !sameOptions(t.opts, tcp.Options) {
+		var err error
+		if t, err = newTemplate(k, opts, link, ip4, tcp); err != nil {
+			*tp = nil
+			return nil
+		}
+		*tp = t
+	}
+	return t.frame(ip4, tcp, payload)
+}
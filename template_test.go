@@ -0,0 +1,58 @@
+// +build !linux
+
+package rawcon
+
+import (
+	"bytes"
+	"net"
+	"testing"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+func TestHeaderTemplate(t *testing.T) {
+	opts := gopacket.SerializeOptions{FixLengths: true, ComputeChecksums: true}
+	eth := &layers.Ethernet{
+		SrcMAC:       net.HardwareAddr{2, 0, 0, 0, 0, 1},
+		DstMAC:       net.HardwareAddr{2, 0, 0, 0, 0, 2},
+		EthernetType: layers.EthernetTypeIPv4,
+	}
+	ip4 := &layers.IPv4{
+		Version:  4,
+		TTL:      64,
+		Protocol: layers.IPProtocolTCP,
+		SrcIP:    net.IPv4(10, 0, 0, 1),
+		DstIP:    net.IPv4(10, 0, 0, 2),
+	}
+	tcp := &layers.TCP{SrcPort: 4000, DstPort: 443, Window: 65535, ACK: true, PSH: true}
+	links := []gopacket.SerializableLayer{eth, &layers.Loopback{Family: layers.ProtocolFamilyIPv4}, gopacket.Payload{2, 0, 0, 0}}
+	var tmpl *headerTemplate
+	for i := 0; i < 200; i++ {
+		link := links[i%len(links)]
+		ip4.Id = uint16(i * 7919)
+		tcp.Seq = uint32(i) * 2654435761
+		tcp.Ack = ^tcp.Seq
+		tcp.Options, tcp.Padding = nil, nil
+		if i%5 == 0 {
+			tcp.Options = []layers.TCPOption{{OptionType: layers.TCPOptionKindNop, OptionLength: 1}, {OptionType: layers.TCPOptionKindTimestamps, OptionLength: 10, OptionData: make([]byte, 8)}}
+			tcp.Options[1].OptionData[3] = byte(i)
+		}
+		payload := make([]byte, i*7)
+		for j := range payload {
+			payload[j] = byte(j * i)
+		}
+		tcp.SetNetworkLayerForChecksum(ip4)
+		buffer := gopacket.NewSerializeBuffer()
+		if err := gopacket.SerializeLayers(buffer, opts, link, ip4, tcp, gopacket.Payload(payload)); err != nil {
+			t.Fatal(err)
+		}
+		frame := templateFrame(&tmpl, opts, link, ip4, tcp, payload)
+		if frame == nil {
+			t.Fatal("no template for segment", i)
+		}
+		if !bytes.Equal(frame, buffer.Bytes()) {
+			t.Fatalf("segment %d:\n%x\nwant\n%x", i, frame, buffer.Bytes())
+		}
+	}
+}
@@ -0,0 +1,261 @@
+package transcript
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/biotooff/rawcon"
+	"github.com/google/gopacket/layers"
+)
+
+// Replay replays transcripts through one side of a connection. The side
+// under test gets the packets of the other side of the transcript, and
+// every packet of its own side must be matched by one it sends: same
+// flags, data if and only if the recorded one has some, and the recorded
+// sequence and acknowledgement numbers. Its sequence numbers are taken
+// relative to its initial one, and to the length of the data it sent, as
+// handshakes are random. Packets that match none, like retransmissions,
+// are passed over.
+type Replay struct {
+	// Raw is the configuration of the side under test. Its PacketIO is
+	// replaced by a pipe to the replay.
+	Raw rawcon.Raw
+	// Datagrams are what a dialer writes, the next one whenever the
+	// transcript waits for data from it once it is connected.
+	Datagrams [][]byte
+	// Timeout bounds the wait for each packet the side under test must
+	// send, a second if zero.
+	Timeout time.Duration
+}
+
+// A MismatchError reports a packet of a transcript that the side under
+// test did not send.
+type MismatchError struct {
+	Index int      // of the packet in the transcript
+	Want  string   // the packet
+	Got   []string // the packets sent instead
+}
+
+func (e *MismatchError) Error() string {
+	return fmt.Sprintf("transcript: packet %d: want %s, got [%s]", e.Index, e.Want, strings.Join(e.Got, ", "))
+}
+
+var errNoSYN = errors.New("transcript: does not start with a SYN")
+
+// Listener replays t through a listener on the address the first SYN of t
+// goes to. The listener echoes every datagram it reads, and they are
+// returned.
+func (rp *Replay) Listener(t Transcript) ([][]byte, error) {
+	return rp.run(t, false)
+}
+
+// Dialer replays t through a dialer of the address the first SYN of t goes
+// to, and returns the datagrams it read.
+func (rp *Replay) Dialer(t Transcript) ([][]byte, error) {
+	return rp.run(t, true)
+}
+
+type dialResult struct {
+	conn *rawcon.RAWConn
+	err  error
+}
+
+func sameAddr(a, b *net.TCPAddr) bool {
+	return a.Port == b.Port && a.IP.Equal(b.IP)
+}
+
+// match tells whether o, sent by the side under test, is s once its
+// sequence numbers are moved by delta.
+func match(o, s *segment, delta uint32) bool {
+	return o.flags() == s.flags() &&
+		(len(o.tcp.Payload) > 0) == (len(s.tcp.Payload) > 0) &&
+		o.tcp.Seq == s.tcp.Seq+delta &&
+		(!s.tcp.ACK || o.tcp.Ack == s.tcp.Ack)
+}
+
+func (rp *Replay) run(t Transcript, dial bool) (read [][]byte, err error) {
+	segs := make([]*segment, len(t))
+	for i, b := range t {
+		if segs[i], err = decode(b); err != nil {
+			return nil, err
+		}
+	}
+	if len(segs) == 0 || !segs[0].tcp.SYN || segs[0].tcp.ACK {
+		return nil, errNoSYN
+	}
+	server := segs[0].dst()
+	side := server
+	if dial {
+		side = segs[0].src()
+	}
+	timeout := rp.Timeout
+	if timeout == 0 {
+		timeout = time.Second
+	}
+
+	ours, theirs := rawcon.NewPacketPipe()
+	defer ours.Close()
+	r := rp.Raw
+	r.PacketIO = theirs
+
+	var lock sync.Mutex
+	kept := make(chan int, 1)
+	keep := func(b []byte) {
+		lock.Lock()
+		read = append(read, append([]byte(nil), b...))
+		n := len(read)
+		lock.Unlock()
+		select {
+		case <-kept:
+		default:
+		}
+		kept <- n
+	}
+	defer func() {
+		lock.Lock()
+		read = append([][]byte(nil), read...)
+		lock.Unlock()
+	}()
+
+	var conn *rawcon.RAWConn
+	var dialed chan dialResult
+	if dial {
+		dialed = make(chan dialResult, 1)
+		go func() {
+			c, err := r.DialRAW(server.String())
+			dialed <- dialResult{c, err}
+		}()
+		defer func() {
+			if conn != nil {
+				conn.Close()
+			}
+		}()
+	} else {
+		l, err := r.ListenRAW(server.String())
+		if err != nil {
+			return nil, err
+		}
+		defer l.Close()
+		go func() {
+			buf := make([]byte, 65536)
+			for {
+				n, addr, err := l.ReadFrom(buf)
+				if err != nil {
+					return
+				}
+				keep(buf[:n])
+				l.WriteTo(buf[:n], addr)
+			}
+		}()
+	}
+
+	out := make(chan []byte, 64)
+	go func() {
+		for {
+			b, err := ours.ReadPacketData()
+			if err != nil {
+				return
+			}
+			out <- append([]byte(nil), b...)
+		}
+	}()
+
+	// delta is what the side under test adds to the recorded sequence
+	// numbers, addr its address when it dials. A dialer writes the next
+	// datagram once it read the sent ones, as when it was recorded.
+	var delta uint32
+	var learned bool
+	var addr *net.TCPAddr
+	var next, sent, nread int
+	for i, s := range segs {
+		if !sameAddr(s.src(), side) {
+			if s.tcp.ACK {
+				s.tcp.Ack += delta
+			}
+			if addr != nil {
+				s.ip.DstIP, s.tcp.DstPort = addr.IP, layers.TCPPort(addr.Port)
+			}
+			b, err := s.encode()
+			if err != nil {
+				return nil, err
+			}
+			if err = ours.WritePacketData(b); err != nil {
+				return nil, err
+			}
+			if conn != nil && len(s.tcp.Payload) > 0 {
+				sent++
+			}
+			continue
+		}
+		var got []string
+		wrote := false
+		timer := time.NewTimer(timeout)
+	wait:
+		for {
+			if conn != nil && !wrote && len(s.tcp.Payload) > 0 && next < len(rp.Datagrams) && nread >= sent {
+				if _, err = conn.Write(rp.Datagrams[next]); err != nil {
+					timer.Stop()
+					return
+				}
+				next++
+				wrote = true
+			}
+			select {
+			case d := <-dialed:
+				if d.err != nil {
+					timer.Stop()
+					return nil, d.err
+				}
+				conn, dialed = d.conn, nil
+				go func() {
+					buf := make([]byte, 65536)
+					for {
+						n, err := conn.Read(buf)
+						if err != nil {
+							return
+						}
+						keep(buf[:n])
+					}
+				}()
+			case nread = <-kept:
+			case b := <-out:
+				o, err := decode(b)
+				if err != nil {
+					got = append(got, err.Error())
+					continue
+				}
+				if !learned {
+					delta = o.tcp.Seq - s.tcp.Seq
+				}
+				if !match(o, s, delta) {
+					got = append(got, o.String())
+					continue
+				}
+				learned = true
+				if dial && addr == nil {
+					addr = o.src()
+				}
+				delta = o.tcp.Seq + uint32(len(o.tcp.Payload)) - s.tcp.Seq - uint32(len(s.tcp.Payload))
+				break wait
+			case <-timer.C:
+				return nil, &MismatchError{Index: i, Want: s.String(), Got: got}
+			}
+		}
+		timer.Stop()
+	}
+	// the last data sent is read before the dialer closes
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	for nread < sent {
+		select {
+		case nread = <-kept:
+		case <-timer.C:
+			return
+		}
+	}
+	return
+}
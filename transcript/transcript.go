@@ -0,0 +1,173 @@
+// Package transcript replays canned packet captures of fake TCP connections
+// through a rawcon listener or dialer over Raw.PacketIO, and checks that it
+// answers every packet the way the capture says: the handshake, the data
+// and the close go through the same states as when it was recorded.
+//
+// Captures are pcap files of one connection, as written by WriteFile or by
+// tcpdump. Record makes them from a live connection.
+package transcript
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/biotooff/rawcon"
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/pcapgo"
+)
+
+// A Transcript is the IPv4 packets of one connection in the order they were
+// seen, from both sides.
+type Transcript [][]byte
+
+var errEmpty = errors.New("transcript: no TCP packet")
+
+// ReadFile reads the TCP packets over IPv4 of the pcap file at path.
+func ReadFile(path string) (Transcript, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	r, err := pcapgo.NewReader(f)
+	if err != nil {
+		return nil, err
+	}
+	var t Transcript
+	for {
+		data, _, err := r.ReadPacketData()
+		if err != nil {
+			break
+		}
+		p := gopacket.NewPacket(data, r.LinkType(), gopacket.Default)
+		ip, _ := p.Layer(layers.LayerTypeIPv4).(*layers.IPv4)
+		if ip == nil || p.Layer(layers.LayerTypeTCP) == nil {
+			continue
+		}
+		t = append(t, append(ip.Contents, ip.Payload...))
+	}
+	if len(t) == 0 {
+		return nil, errEmpty
+	}
+	return t, nil
+}
+
+// WriteFile writes t to a pcap file at path.
+func (t Transcript) WriteFile(path string) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	w := pcapgo.NewWriter(f)
+	if err = w.WriteFileHeader(65535, layers.LinkTypeRaw); err != nil {
+		f.Close()
+		return err
+	}
+	ts := time.Unix(0, 0)
+	for _, b := range t {
+		ci := gopacket.CaptureInfo{Timestamp: ts, CaptureLength: len(b), Length: len(b)}
+		if err = w.WritePacket(ci, b); err != nil {
+			f.Close()
+			return err
+		}
+		ts = ts.Add(time.Millisecond)
+	}
+	return f.Close()
+}
+
+// A Recorder is a PacketIO that keeps a copy of every packet going through
+// it, both ways.
+type Recorder struct {
+	rawcon.PacketIO
+	lock sync.Mutex
+	t    Transcript
+}
+
+// Record returns a Recorder of the packets of pio.
+func Record(pio rawcon.PacketIO) *Recorder {
+	return &Recorder{PacketIO: pio}
+}
+
+func (rec *Recorder) add(b []byte) {
+	rec.lock.Lock()
+	rec.t = append(rec.t, append([]byte(nil), b...))
+	rec.lock.Unlock()
+}
+
+func (rec *Recorder) ReadPacketData() ([]byte, error) {
+	b, err := rec.PacketIO.ReadPacketData()
+	if err == nil {
+		rec.add(b)
+	}
+	return b, err
+}
+
+func (rec *Recorder) WritePacketData(b []byte) error {
+	rec.add(b)
+	return rec.PacketIO.WritePacketData(b)
+}
+
+// Transcript returns the packets recorded so far.
+func (rec *Recorder) Transcript() Transcript {
+	rec.lock.Lock()
+	defer rec.lock.Unlock()
+	return append(Transcript(nil), rec.t...)
+}
+
+// segment is a decoded packet of a transcript.
+type segment struct {
+	ip  layers.IPv4
+	tcp layers.TCP
+}
+
+func decode(b []byte) (*segment, error) {
+	p := gopacket.NewPacket(b, layers.LayerTypeIPv4, gopacket.Default)
+	ip, _ := p.Layer(layers.LayerTypeIPv4).(*layers.IPv4)
+	tcp, _ := p.Layer(layers.LayerTypeTCP).(*layers.TCP)
+	if ip == nil || tcp == nil {
+		return nil, fmt.Errorf("transcript: not a TCP packet over IPv4: %x", b)
+	}
+	return &segment{ip: *ip, tcp: *tcp}, nil
+}
+
+func (s *segment) encode() ([]byte, error) {
+	buf := gopacket.NewSerializeBuffer()
+	opts := gopacket.SerializeOptions{FixLengths: true, ComputeChecksums: true}
+	s.tcp.SetNetworkLayerForChecksum(&s.ip)
+	err := gopacket.SerializeLayers(buf, opts, &s.ip, &s.tcp, gopacket.Payload(s.tcp.Payload))
+	return buf.Bytes(), err
+}
+
+func (s *segment) src() *net.TCPAddr {
+	return &net.TCPAddr{IP: s.ip.SrcIP, Port: int(s.tcp.SrcPort)}
+}
+
+func (s *segment) dst() *net.TCPAddr {
+	return &net.TCPAddr{IP: s.ip.DstIP, Port: int(s.tcp.DstPort)}
+}
+
+func (s *segment) flags() string {
+	var f []string
+	for _, v := range []struct {
+		set  bool
+		name string
+	}{
+		{s.tcp.SYN, "SYN"}, {s.tcp.FIN, "FIN"}, {s.tcp.RST, "RST"},
+		{s.tcp.PSH, "PSH"}, {s.tcp.ACK, "ACK"}, {s.tcp.URG, "URG"},
+	} {
+		if v.set {
+			f = append(f, v.name)
+		}
+	}
+	return strings.Join(f, "|")
+}
+
+func (s *segment) String() string {
+	return fmt.Sprintf("%s seq=%d ack=%d len=%d", s.flags(), s.tcp.Seq, s.tcp.Ack, len(s.tcp.Payload))
+}
@@ -0,0 +1,127 @@
+package transcript
+
+import (
+	"bytes"
+	"errors"
+	"flag"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/biotooff/rawcon"
+)
+
+var update = flag.Bool("update", false, "record the transcripts of testdata again")
+
+var cases = []struct {
+	name    string
+	raw     rawcon.Raw
+	address string
+}{
+	{"nohttp", rawcon.Raw{NoHTTP: true}, "127.0.0.1:6790"},
+	{"http", rawcon.Raw{Hosts: []string{"www.example.com"}}, "127.0.0.1:6791"},
+	{"tls", rawcon.Raw{TLS: true}, "127.0.0.1:6792"},
+}
+
+func datagrams() [][]byte {
+	var d [][]byte
+	for i := 0; i < 3; i++ {
+		d = append(d, bytes.Repeat([]byte{byte(i)}, 100+i))
+	}
+	return d
+}
+
+// record has a dialer of r send datagrams to an echoing listener over a
+// pipe, and returns the packets they exchanged.
+func record(t *testing.T, r rawcon.Raw, address string) Transcript {
+	client, server := rawcon.NewPacketPipe()
+	lr, dr := r, r
+	rec := Record(client)
+	lr.PacketIO, dr.PacketIO = server, rec
+	listener, err := lr.ListenRAW(address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	go func() {
+		buf := make([]byte, 2048)
+		for {
+			n, addr, err := listener.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			listener.WriteTo(buf[:n], addr)
+		}
+	}()
+	conn, err := dr.DialRAW(address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	buf := make([]byte, 2048)
+	for _, d := range datagrams() {
+		if _, err = conn.Write(d); err != nil {
+			t.Fatal(err)
+		}
+		if _, err = conn.Read(buf); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return rec.Transcript()
+}
+
+func checkRead(t *testing.T, read [][]byte) {
+	want := datagrams()
+	if len(read) != len(want) {
+		t.Fatalf("read %d datagrams, want %d", len(read), len(want))
+	}
+	for i := range want {
+		if !bytes.Equal(read[i], want[i]) {
+			t.Fatalf("datagram %d is %x", i, read[i])
+		}
+	}
+}
+
+func TestReplay(t *testing.T) {
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			path := filepath.Join("testdata", c.name+".pcap")
+			if *update {
+				if err := record(t, c.raw, c.address).WriteFile(path); err != nil {
+					t.Fatal(err)
+				}
+			}
+			tr, err := ReadFile(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			rp := &Replay{Raw: c.raw}
+			read, err := rp.Listener(tr)
+			if err != nil {
+				t.Fatal("listener:", err)
+			}
+			checkRead(t, read)
+			rp.Datagrams = datagrams()
+			read, err = rp.Dialer(tr)
+			if err != nil {
+				t.Fatal("dialer:", err)
+			}
+			checkRead(t, read)
+		})
+	}
+}
+
+func TestReplayMismatch(t *testing.T) {
+	tr, err := ReadFile(filepath.Join("testdata", "tls.pcap"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// a listener of plain HTTP does not answer a ClientHello
+	rp := &Replay{Raw: rawcon.Raw{}, Timeout: 300 * time.Millisecond}
+	_, err = rp.Listener(tr)
+	var e *MismatchError
+	if !errors.As(err, &e) {
+		t.Fatalf("replayed a TLS transcript through an HTTP listener: %v", err)
+	}
+}
@@ -0,0 +1,28 @@
+package rawcon
+
+// With Raw.DecoyTTL set a dialer sends a decoy right before its HTTP or TLS
+// request: random bytes at the same sequence number, with a TTL too low for
+// them to reach the peer. A middlebox closer than that takes the decoy for
+// the request and the request for a retransmission of it.
+
+const defaultTTL = 64
+
+// ttl returns the TTL of the packets r sends.
+func (r *Raw) ttl() int {
+	if r.TTL > 0 {
+		return r.TTL
+	}
+	return defaultTTL
+}
+
+// writeRequest sends the handshake request req, after its decoy.
+func (conn *RAWConn) writeRequest(req []byte) (n int, err error) {
+	if conn.r.DecoyTTL > 0 {
+		decoy := make([]byte, len(req))
+		conn.r.random().Read(decoy)
+		if err = conn.sendDecoy(decoy); err != nil {
+			return
+		}
+	}
+	return conn.write(req)
+}
@@ -0,0 +1,486 @@
+package rawcon
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/biotooff/rawcon/utils"
+	"golang.org/x/net/ipv4"
+)
+
+// The fake UDP mode sends plain UDP datagrams, but builds the IP and UDP
+// headers itself on a raw socket so that TTL, TOS and IP id are under our
+// control, or hands the packets to Raw.PacketIO. A regular UDP socket stays
+// bound to the local port only to keep the kernel from answering with port
+// unreachable messages, what reaches it is read and dropped.
+//
+// Every datagram starts with an 8 byte random nonce, the rest is encrypted
+// with AES-CTR keyed by Raw.Key. This hides the payload from simple pattern
+// matching but does not authenticate it.
+
+const (
+	udpHeaderLen       = 8
+	fakeUDPNonceLen    = 8
+	fakeUDPMaxDatagram = 1500 - 20 - udpHeaderLen
+
+	// fakeUDPMaxPeers is how many local addresses of peers, and routes, a
+	// listener on the wildcard address keeps, unless Raw.MaxConns says
+	// otherwise
+	fakeUDPMaxPeers = 4096
+)
+
+type fakeUDPObfs struct {
+	block cipher.Block
+	rnd   utils.Random
+}
+
+func newFakeUDPObfs(key string, rnd utils.Random) *fakeUDPObfs {
+	sum := sha256.Sum256([]byte(key))
+	block, _ := aes.NewCipher(sum[:16])
+	return &fakeUDPObfs{block: block, rnd: rnd}
+}
+
+func (o *fakeUDPObfs) stream(nonce []byte) cipher.Stream {
+	var iv [aes.BlockSize]byte
+	copy(iv[:], nonce)
+	return cipher.NewCTR(o.block, iv[:])
+}
+
+func (o *fakeUDPObfs) seal(dst, b []byte) []byte {
+	dst = dst[:fakeUDPNonceLen+len(b)]
+	o.rnd.Read(dst[:fakeUDPNonceLen])
+	o.stream(dst[:fakeUDPNonceLen]).XORKeyStream(dst[fakeUDPNonceLen:], b)
+	return dst
+}
+
+func (o *fakeUDPObfs) open(b []byte) ([]byte, bool) {
+	if len(b) < fakeUDPNonceLen {
+		return nil, false
+	}
+	data := b[fakeUDPNonceLen:]
+	o.stream(b[:fakeUDPNonceLen]).XORKeyStream(data, data)
+	return data, true
+}
+
+func udpChecksum(b []byte, srcip, dstip net.IP) uint16 {
+	srcip = srcip.To4()
+	dstip = dstip.To4()
+	var sum uint32
+	add := func(b []byte) {
+		for i := 0; i+1 < len(b); i += 2 {
+			sum += uint32(binary.BigEndian.Uint16(b[i:]))
+		}
+		if len(b)%2 != 0 {
+			sum += uint32(b[len(b)-1]) << 8
+		}
+	}
+	add(srcip)
+	add(dstip)
+	sum += 17 + uint32(len(b))
+	add(b)
+	for sum>>16 != 0 {
+		sum = (sum & 0xffff) + (sum >> 16)
+	}
+	csum := uint16(^sum)
+	if csum == 0 {
+		csum = 0xffff
+	}
+	return csum
+}
+
+type fakeUDPSocket struct {
+	raw  *ipv4.RawConn
+	pio  PacketIO // in place of raw
+	udp  net.Conn // the placeholder of the local port
+	r    *Raw
+	obfs *fakeUDPObfs
+	id   uint32
+	rbuf []byte
+	lock sync.Mutex
+	wbuf []byte
+	once sync.Once
+}
+
+// newFakeUDPSocket opens the raw socket of the fake UDP mode on ip, or
+// takes Raw.PacketIO. udp is the placeholder, which it drains and closes
+// along.
+func newFakeUDPSocket(r *Raw, ip net.IP, udp net.Conn) (s *fakeUDPSocket, err error) {
+	s = &fakeUDPSocket{
+		pio:  r.PacketIO,
+		udp:  udp,
+		r:    r,
+		obfs: newFakeUDPObfs(r.Key, r.random()),
+		id:   uint32(r.random().Intn(65536)),
+		rbuf: make([]byte, 65536),
+		wbuf: make([]byte, 65536),
+	}
+	if s.pio == nil {
+		var conn *net.IPConn
+		if conn, err = net.ListenIP("ip4:udp", &net.IPAddr{IP: ip}); err != nil {
+			return nil, err
+		}
+		if s.raw, err = ipv4.NewRawConn(conn); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	go drainUDP(udp)
+	return
+}
+
+// drainUDP reads and drops what reaches the placeholder socket udp until
+// it is closed, so that its buffer does not fill up.
+func drainUDP(udp net.Conn) {
+	buf := make([]byte, 2048)
+	for {
+		if _, err := udp.Read(buf); err != nil {
+			return
+		}
+	}
+}
+
+func (s *fakeUDPSocket) writeTo(b []byte, src, dst *net.UDPAddr) (n int, err error) {
+	if len(b)+fakeUDPNonceLen > fakeUDPMaxDatagram {
+		return 0, errors.New("fake udp payload too large")
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	data := s.wbuf[:udpHeaderLen+fakeUDPNonceLen+len(b)]
+	s.obfs.seal(data[udpHeaderLen:], b)
+	binary.BigEndian.PutUint16(data[0:], uint16(src.Port))
+	binary.BigEndian.PutUint16(data[2:], uint16(dst.Port))
+	binary.BigEndian.PutUint16(data[4:], uint16(len(data)))
+	binary.BigEndian.PutUint16(data[6:], 0)
+	binary.BigEndian.PutUint16(data[6:], udpChecksum(data, src.IP, dst.IP))
+	header := &ipv4.Header{
+		Version:  4,
+		Len:      ipv4.HeaderLen,
+		TOS:      s.r.tos(),
+		TotalLen: ipv4.HeaderLen + len(data),
+		ID:       int(uint16(atomic.AddUint32(&s.id, 1))),
+		Flags:    ipv4.DontFragment,
+		TTL:      s.r.ttl(),
+		Protocol: 17,
+		Src:      src.IP,
+		Dst:      dst.IP,
+	}
+	if s.pio != nil {
+		pkt := ipv4PacketOf(17, header.Src, header.Dst, header.ID, header.TOS, header.TTL, data)
+		err = s.pio.WritePacketData(pkt)
+		utils.PutBuf(pkt)
+	} else {
+		err = s.raw.WriteTo(header, data, nil)
+	}
+	if err != nil {
+		return
+	}
+	return len(b), nil
+}
+
+// read returns the next UDP datagram to the local address and its source
+// and destination addresses.
+func (s *fakeUDPSocket) read() (data []byte, src, dst net.IP, err error) {
+	if s.pio == nil {
+		var header *ipv4.Header
+		if header, data, _, err = s.raw.ReadFrom(s.rbuf); err != nil {
+			return
+		}
+		return data, header.Src, header.Dst, nil
+	}
+	for {
+		var pkt []byte
+		if pkt, err = s.pio.ReadPacketData(); err != nil {
+			return
+		}
+		b := s.rbuf[:copy(s.rbuf, pkt)]
+		releasePacket(s.pio, pkt)
+		if len(b) < ipv4.HeaderLen || b[0]>>4 != 4 || b[9] != 17 {
+			continue
+		}
+		hl := int(b[0]&0x0f) * 4
+		tl := int(binary.BigEndian.Uint16(b[2:]))
+		if hl < ipv4.HeaderLen || tl < hl || tl > len(b) {
+			continue
+		}
+		return b[hl:tl], net.IP(b[12:16]), net.IP(b[16:20]), nil
+	}
+}
+
+func (s *fakeUDPSocket) setReadDeadline(t time.Time) error {
+	if s.pio != nil {
+		return s.pio.SetReadDeadline(t)
+	}
+	return s.raw.SetReadDeadline(t)
+}
+
+func (s *fakeUDPSocket) setWriteDeadline(t time.Time) error {
+	if s.pio != nil {
+		return nil
+	}
+	return s.raw.SetWriteDeadline(t)
+}
+
+func (s *fakeUDPSocket) setDeadline(t time.Time) error {
+	if s.pio != nil {
+		return s.pio.SetReadDeadline(t)
+	}
+	return s.raw.SetDeadline(t)
+}
+
+// readFrom returns the next datagram sent to local and the address it was
+// sent to, the source address is checked against remote unless it is nil.
+func (s *fakeUDPSocket) readFrom(b []byte, local, remote *net.UDPAddr) (n int, addr *net.UDPAddr, dst net.IP, err error) {
+	for {
+		var data []byte
+		var src net.IP
+		if data, src, dst, err = s.read(); err != nil {
+			return
+		}
+		if len(data) < udpHeaderLen {
+			continue
+		}
+		if int(binary.BigEndian.Uint16(data[2:])) != local.Port {
+			continue
+		}
+		addr = &net.UDPAddr{IP: src, Port: int(binary.BigEndian.Uint16(data[0:]))}
+		if remote != nil && (addr.Port != remote.Port || !addr.IP.Equal(remote.IP)) {
+			continue
+		}
+		if ulen := int(binary.BigEndian.Uint16(data[4:])); ulen >= udpHeaderLen && ulen < len(data) {
+			data = data[:ulen]
+		}
+		payload, ok := s.obfs.open(data[udpHeaderLen:])
+		if !ok {
+			continue
+		}
+		return copy(b, payload), addr, dst, nil
+	}
+}
+
+// Close closes the sockets, or the PacketIO, once. Closing again does
+// nothing.
+func (s *fakeUDPSocket) Close() (err error) {
+	s.once.Do(func() {
+		if s.pio != nil {
+			err = s.pio.Close()
+		} else {
+			err = s.raw.Close()
+		}
+		s.udp.Close()
+	})
+	return
+}
+
+// FakeUDPConn is the dialer side of the fake UDP mode.
+type FakeUDPConn struct {
+	*fakeUDPSocket
+	laddr *net.UDPAddr
+	raddr *net.UDPAddr
+}
+
+// DialFakeUDP opens a fake UDP connection to address.
+func (r *Raw) DialFakeUDP(address string) (conn *FakeUDPConn, err error) {
+	udp, err := net.Dial("udp4", address)
+	if err != nil {
+		return
+	}
+	laddr := udp.LocalAddr().(*net.UDPAddr)
+	s, err := newFakeUDPSocket(r, laddr.IP, udp)
+	if err != nil {
+		udp.Close()
+		return
+	}
+	conn = &FakeUDPConn{
+		fakeUDPSocket: s,
+		laddr:         laddr,
+		raddr:         udp.RemoteAddr().(*net.UDPAddr),
+	}
+	return
+}
+
+func (conn *FakeUDPConn) ReadFrom(b []byte) (n int, addr net.Addr, err error) {
+	n, _, _, err = conn.readFrom(b, conn.laddr, conn.raddr)
+	if err != nil {
+		return
+	}
+	return n, conn.raddr, nil
+}
+
+func (conn *FakeUDPConn) Read(b []byte) (n int, err error) {
+	n, _, _, err = conn.readFrom(b, conn.laddr, conn.raddr)
+	return
+}
+
+func (conn *FakeUDPConn) WriteTo(b []byte, addr net.Addr) (n int, err error) {
+	return conn.Write(b)
+}
+
+func (conn *FakeUDPConn) Write(b []byte) (n int, err error) {
+	return conn.writeTo(b, conn.laddr, conn.raddr)
+}
+
+func (conn *FakeUDPConn) LocalAddr() net.Addr {
+	return conn.laddr
+}
+
+func (conn *FakeUDPConn) RemoteAddr() net.Addr {
+	return conn.raddr
+}
+
+func (conn *FakeUDPConn) SetDeadline(t time.Time) error {
+	return conn.setDeadline(t)
+}
+
+func (conn *FakeUDPConn) SetReadDeadline(t time.Time) error {
+	return conn.setReadDeadline(t)
+}
+
+func (conn *FakeUDPConn) SetWriteDeadline(t time.Time) error {
+	return conn.setWriteDeadline(t)
+}
+
+func (conn *FakeUDPConn) GetMSS() int {
+	return fakeUDPMaxDatagram - fakeUDPNonceLen
+}
+
+// FakeUDPListener is the server side of the fake UDP mode. On the wildcard
+// address it answers a peer from the address the peer last sent to.
+type FakeUDPListener struct {
+	*fakeUDPSocket
+	laddr *net.UDPAddr
+	mutex myMutex
+	// locals holds the address each peer sent to, routes the source
+	// address of the route to a host for the peers not in locals
+	locals map[string]net.IP
+	routes map[string]net.IP
+	max    int
+}
+
+// ListenFakeUDP accepts fake UDP datagrams sent to address.
+func (r *Raw) ListenFakeUDP(address string) (listener *FakeUDPListener, err error) {
+	udpaddr, err := net.ResolveUDPAddr("udp4", address)
+	if err != nil {
+		return
+	}
+	if udpaddr.IP == nil {
+		udpaddr.IP = ipv4AddrAny
+	}
+	udp, err := net.ListenUDP("udp4", udpaddr)
+	if err != nil {
+		return
+	}
+	s, err := newFakeUDPSocket(r, udpaddr.IP, udp)
+	if err != nil {
+		udp.Close()
+		return
+	}
+	listener = &FakeUDPListener{
+		fakeUDPSocket: s,
+		laddr:         udpaddr,
+		locals:        make(map[string]net.IP),
+		routes:        make(map[string]net.IP),
+		max:           r.MaxConns,
+	}
+	if listener.max <= 0 {
+		listener.max = fakeUDPMaxPeers
+	}
+	return
+}
+
+func (listener *FakeUDPListener) ReadFrom(b []byte) (n int, addr net.Addr, err error) {
+	n, uaddr, dst, err := listener.readFrom(b, listener.laddr, nil)
+	if err != nil {
+		return
+	}
+	if listener.laddr.IP.Equal(ipv4AddrAny) {
+		// the write lock only for a peer new or sending to another address
+		key := uaddr.String()
+		var known bool
+		listener.mutex.read(func() {
+			known = listener.locals[key].Equal(dst)
+		})
+		if !known {
+			ip := append(net.IP(nil), dst.To4()...)
+			listener.mutex.run(func() {
+				remember(listener.locals, key, ip, listener.max)
+			})
+		}
+	}
+	return n, uaddr, nil
+}
+
+// remember puts ip in m at key, forgetting some other key if m holds max
+// of them.
+func remember(m map[string]net.IP, key string, ip net.IP, max int) {
+	if _, ok := m[key]; !ok && len(m) >= max {
+		for k := range m {
+			delete(m, k)
+			break
+		}
+	}
+	m[key] = ip
+}
+
+// srcIP returns the address to answer the peer at addr from, that the peer
+// last sent to or else the source address of the route to it.
+func (listener *FakeUDPListener) srcIP(addr *net.UDPAddr) (ip net.IP, err error) {
+	host := addr.IP.String()
+	listener.mutex.read(func() {
+		if ip = listener.locals[addr.String()]; ip == nil {
+			ip = listener.routes[host]
+		}
+	})
+	if ip != nil {
+		return
+	}
+	if ip, err = getSrcIPForDstIP(addr.IP); err != nil {
+		return
+	}
+	listener.mutex.run(func() {
+		remember(listener.routes, host, ip, listener.max)
+	})
+	return
+}
+
+func (listener *FakeUDPListener) WriteTo(b []byte, addr net.Addr) (n int, err error) {
+	uaddr, ok := addr.(*net.UDPAddr)
+	if !ok {
+		return 0, errors.New("cannot write to " + addr.String())
+	}
+	src := listener.laddr
+	if src.IP.Equal(ipv4AddrAny) {
+		ip, err := listener.srcIP(uaddr)
+		if err != nil {
+			return 0, err
+		}
+		src = &net.UDPAddr{IP: ip, Port: src.Port}
+	}
+	return listener.writeTo(b, src, uaddr)
+}
+
+func (listener *FakeUDPListener) LocalAddr() net.Addr {
+	return listener.laddr
+}
+
+func (listener *FakeUDPListener) SetDeadline(t time.Time) error {
+	return listener.setDeadline(t)
+}
+
+func (listener *FakeUDPListener) SetReadDeadline(t time.Time) error {
+	return listener.setReadDeadline(t)
+}
+
+func (listener *FakeUDPListener) SetWriteDeadline(t time.Time) error {
+	return listener.setWriteDeadline(t)
+}
+
+func (listener *FakeUDPListener) GetMSSByAddr(addr net.Addr) int {
+	return fakeUDPMaxDatagram - fakeUDPNonceLen
+}
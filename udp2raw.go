@@ -0,0 +1,291 @@
+package rawcon
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/biotooff/rawcon/utils"
+)
+
+// udp2raw-tunnel compatible framing, used when Raw.Udp2raw is set.
+//
+// The layout follows udp2raw's faketcp mode: a bare packet is
+// iv(8) padding(8) 'b' data and is only used for the id exchange, while a
+// safer packet is my_id(4) oppsite_id(4) seq(8) type(1) roller(1) data and
+// carries heartbeats ('h') and data ('d', prefixed with a 4 byte conv id).
+// Only "--cipher-mode none --auth-mode none" is wire compatible, the key
+// schedule of the encrypted modes is not implemented, and neither are the
+// icmp and udp raw modes.
+
+const (
+	udp2rawBare      = 'b'
+	udp2rawData      = 'd'
+	udp2rawHeartbeat = 'h'
+
+	udp2rawBareHeaderLen  = 8 + 8 + 1
+	udp2rawSaferHeaderLen = 4 + 4 + 8 + 1 + 1
+	udp2rawConvLen        = 4
+
+	udp2rawReplayWindow      = 4000
+	udp2rawHeartbeatInterval = time.Millisecond * 600
+	udp2rawHandshakeRetry    = 25
+)
+
+type udp2rawReplay struct {
+	max    uint64
+	window [udp2rawReplayWindow]bool
+}
+
+// check reports whether seq has not been seen before and marks it as seen.
+func (r *udp2rawReplay) check(seq uint64) bool {
+	if seq > r.max {
+		if seq-r.max >= udp2rawReplayWindow {
+			r.window = [udp2rawReplayWindow]bool{}
+		} else {
+			for i := r.max + 1; i < seq; i++ {
+				r.window[i%udp2rawReplayWindow] = false
+			}
+		}
+		r.max = seq
+		r.window[seq%udp2rawReplayWindow] = true
+		return true
+	}
+	if r.max-seq >= udp2rawReplayWindow {
+		return false
+	}
+	if r.window[seq%udp2rawReplayWindow] {
+		return false
+	}
+	r.window[seq%udp2rawReplayWindow] = true
+	return true
+}
+
+type udp2rawState struct {
+	lock     sync.Mutex
+	myID     uint32
+	oppID    uint32
+	constID  uint32
+	oppConst uint32
+	myRoller uint8
+	conv     uint32
+	seq      uint64
+	replay   udp2rawReplay
+	ready    bool
+	lastRecv time.Time
+	rnd      utils.Random
+}
+
+func newUdp2rawState(rnd utils.Random) *udp2rawState {
+	s := &udp2rawState{rnd: rnd}
+	for s.myID == 0 {
+		s.myID = rnd.Uint32()
+	}
+	s.constID = rnd.Uint32()
+	s.conv = rnd.Uint32()
+	s.seq = uint64(rnd.Uint32())
+	return s
+}
+
+func putUdp2rawBare(rnd utils.Random, b []byte, data []byte) int {
+	rnd.Read(b[:16])
+	b[16] = udp2rawBare
+	return udp2rawBareHeaderLen + copy(b[udp2rawBareHeaderLen:], data)
+}
+
+func parseUdp2rawBare(b []byte) (data []byte, ok bool) {
+	if len(b) < udp2rawBareHeaderLen || b[16] != udp2rawBare {
+		return
+	}
+	return b[udp2rawBareHeaderLen:], true
+}
+
+// handshakePacket builds the bare packet carrying the three ids exchanged
+// during the udp2raw handshake.
+func (s *udp2rawState) handshakePacket() []byte {
+	var ids [12]byte
+	binary.BigEndian.PutUint32(ids[0:], s.myID)
+	binary.BigEndian.PutUint32(ids[4:], s.oppID)
+	binary.BigEndian.PutUint32(ids[8:], s.constID)
+	b := make([]byte, udp2rawBareHeaderLen+len(ids))
+	return b[:putUdp2rawBare(s.rnd, b, ids[:])]
+}
+
+func parseUdp2rawHandshake(b []byte) (id1, id2, id3 uint32, ok bool) {
+	data, ok := parseUdp2rawBare(b)
+	if !ok || len(data) < 12 {
+		return 0, 0, 0, false
+	}
+	id1 = binary.BigEndian.Uint32(data[0:])
+	id2 = binary.BigEndian.Uint32(data[4:])
+	id3 = binary.BigEndian.Uint32(data[8:])
+	return
+}
+
+// clientHandshake processes a handshake packet received by the dialer, it
+// returns the packet to send back and whether the id exchange is done.
+func (s *udp2rawState) clientHandshake(b []byte) (rep []byte, done bool) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	oppID, myID, oppConst, ok := parseUdp2rawHandshake(b)
+	if !ok || myID != s.myID || oppID == 0 {
+		return
+	}
+	s.oppID = oppID
+	s.oppConst = oppConst
+	return s.handshakePacket(), true
+}
+
+// serverHandshake processes a handshake packet received by the listener, it
+// returns the packet to send back, if any.
+func (s *udp2rawState) serverHandshake(b []byte) (rep []byte) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	oppID, myID, oppConst, ok := parseUdp2rawHandshake(b)
+	if !ok || oppID == 0 {
+		return
+	}
+	if myID == 0 {
+		if s.ready && oppID == s.oppID {
+			return
+		}
+		s.oppID = oppID
+		s.oppConst = oppConst
+		s.ready = false
+		s.replay = udp2rawReplay{}
+		return s.handshakePacket()
+	}
+	if myID != s.myID || oppID != s.oppID {
+		return
+	}
+	s.ready = true
+	s.lastRecv = time.Now()
+	return s.seal(udp2rawHeartbeat, nil)
+}
+
+// seal wraps data into a safer packet of the given type, in a buffer of
+// utils.GetBuf.
+func (s *udp2rawState) seal(typ byte, data []byte) []byte {
+	n := udp2rawSaferHeaderLen + len(data)
+	if typ == udp2rawData {
+		n += udp2rawConvLen
+	}
+	b := utils.GetBuf(n)
+	binary.BigEndian.PutUint32(b[0:], s.myID)
+	binary.BigEndian.PutUint32(b[4:], s.oppID)
+	s.seq++
+	binary.BigEndian.PutUint64(b[8:], s.seq)
+	b[16] = typ
+	b[17] = s.myRoller
+	off := udp2rawSaferHeaderLen
+	if typ == udp2rawData {
+		binary.BigEndian.PutUint32(b[off:], s.conv)
+		off += udp2rawConvLen
+	}
+	copy(b[off:], data)
+	return b
+}
+
+func (s *udp2rawState) sealLocked(typ byte, data []byte) []byte {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.seal(typ, data)
+}
+
+// open unwraps a safer packet, data is nil for anything but a valid data
+// packet.
+func (s *udp2rawState) open(b []byte) (typ byte, data []byte, ok bool) {
+	if len(b) < udp2rawSaferHeaderLen {
+		return
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if binary.BigEndian.Uint32(b[0:]) != s.oppID || binary.BigEndian.Uint32(b[4:]) != s.myID {
+		return
+	}
+	if !s.replay.check(binary.BigEndian.Uint64(b[8:])) {
+		return
+	}
+	typ = b[16]
+	switch typ {
+	case udp2rawHeartbeat:
+	case udp2rawData:
+		if len(b) < udp2rawSaferHeaderLen+udp2rawConvLen {
+			return
+		}
+		s.conv = binary.BigEndian.Uint32(b[udp2rawSaferHeaderLen:])
+		data = b[udp2rawSaferHeaderLen+udp2rawConvLen:]
+	default:
+		return
+	}
+	s.ready = true
+	s.lastRecv = time.Now()
+	ok = true
+	return
+}
+
+// udp2rawHandshake exchanges the ids with a udp2raw server once the SYNs
+// of a dial are through, until its first heartbeat.
+func (conn *RAWConn) udp2rawHandshake() (err error) {
+	u2r := newUdp2rawState(conn.r.random())
+	req := u2r.handshakePacket()
+	layer := conn.layer
+	idsent := false
+	for retry := 0; ; retry++ {
+		if retry > udp2rawHandshakeRetry {
+			return fmt.Errorf("udp2raw: %w", ErrHandshakeTimeout)
+		}
+		if _, err = conn.write(req); err != nil {
+			return
+		}
+		layer.setSeq(layer.seq() + uint32(len(req)))
+		err = conn.SetReadDeadline(time.Now().Add(time.Millisecond * time.Duration(200+int(conn.r.random().Int63()%100))))
+		if err != nil {
+			return
+		}
+		var seg segment
+		if seg, err = conn.readSegment(); err != nil {
+			e, ok := err.(net.Error)
+			if !ok || !e.Temporary() {
+				return
+			}
+			continue
+		}
+		if !seg.ack || seg.n == 0 {
+			continue
+		}
+		layer.setAck(seg.seq + uint32(seg.n))
+		if !idsent {
+			if rep, ok := u2r.clientHandshake(seg.payload); ok {
+				req = rep
+				idsent = true
+			}
+			continue
+		}
+		if typ, _, ok := u2r.open(seg.payload); ok && typ == udp2rawHeartbeat {
+			break
+		}
+	}
+	conn.u2r = u2r
+	go conn.udp2rawKeepalive()
+	return
+}
+
+// udp2rawKeepalive sends the heartbeats udp2raw servers expect from their
+// clients until the connection is closed.
+func (conn *RAWConn) udp2rawKeepalive() {
+	ticker := time.NewTicker(udp2rawHeartbeatInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-conn.die:
+			return
+		case <-ticker.C:
+			if _, err := conn.writeUdp2raw(udp2rawHeartbeat, nil); err != nil {
+				return
+			}
+		}
+	}
+}
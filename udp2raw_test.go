@@ -0,0 +1,55 @@
+package rawcon
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/biotooff/rawcon/utils"
+)
+
+func TestUdp2rawHandshake(t *testing.T) {
+	client := newUdp2rawState(utils.Random{})
+	server := newUdp2rawState(utils.Random{})
+
+	rep := server.serverHandshake(client.handshakePacket())
+	if rep == nil {
+		t.Fatal("server ignored handshake1")
+	}
+	rep, done := client.clientHandshake(rep)
+	if !done {
+		t.Fatal("client rejected server ids")
+	}
+	rep = server.serverHandshake(rep)
+	if typ, _, ok := client.open(rep); !ok || typ != udp2rawHeartbeat {
+		t.Fatal("client did not receive the ready heartbeat")
+	}
+
+	pkt := client.sealLocked(udp2rawData, []byte("hello"))
+	typ, data, ok := server.open(pkt)
+	if !ok || typ != udp2rawData || !bytes.Equal(data, []byte("hello")) {
+		t.Fatalf("unexpected data packet %v %q %v", typ, data, ok)
+	}
+	if _, _, ok := server.open(pkt); ok {
+		t.Fatal("replayed packet accepted")
+	}
+	if server.conv != client.conv {
+		t.Fatal("conv id not learned by server")
+	}
+}
+
+func TestUdp2rawReplayWindow(t *testing.T) {
+	var r udp2rawReplay
+	for _, seq := range []uint64{10, 12, 11, 5000} {
+		if !r.check(seq) {
+			t.Fatalf("seq %d rejected", seq)
+		}
+	}
+	for _, seq := range []uint64{11, 12, 5000, 10} {
+		if r.check(seq) {
+			t.Fatalf("seq %d accepted twice or out of window", seq)
+		}
+	}
+	if !r.check(4999) {
+		t.Fatal("seq inside window rejected")
+	}
+}
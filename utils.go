@@ -4,9 +4,14 @@ import (
 	"bytes"
 	"fmt"
 	"log"
-	"math/rand"
 	"net"
+	"runtime"
+	"strings"
 	"sync"
+	"time"
+	"weak"
+
+	"github.com/biotooff/rawcon/utils"
 )
 
 type Raw struct {
@@ -18,12 +23,566 @@ type Raw struct {
 	IgnRST bool
 	Hosts  []string
 	Dummy  bool
+	// Udp2raw makes the connection speak udp2raw-tunnel's faketcp protocol
+	// instead of the HTTP/TLS camouflage. Only its faketcp raw mode is
+	// spoken, with --cipher-mode none and --auth-mode none: ICMP and
+	// FakeUDP do not frame their packets the way its icmp and udp modes do.
+	Udp2raw bool
+	// ICMP carries the payload in ICMP echo messages instead of fake TCP,
+	// see DialPacket and ListenPacket.
+	ICMP bool
+	// FakeUDP sends UDP datagrams with self-built headers and an obfuscation
+	// header instead of fake TCP, see DialPacket and ListenPacket.
+	FakeUDP bool
+	// Key is the pre-shared key of the modes that need one. With the HTTP or
+	// TLS handshake it also lets connections migrate, see RAWConn.Migrate.
+	Key string
+	// TTL of the packets sent, 64 if zero.
+	TTL int
+	// DecoyTTL, if set, has a dialer send a decoy that dies after that
+	// many hops before its HTTP or TLS request, to mislead the middleboxes
+	// on the way. It must be lower than the hop count to the peer.
+	DecoyTTL int
+	// IPID is how the IP IDs of fake TCP packets are chosen.
+	IPID IPIDMode
+	// ISN is how the initial sequence numbers are chosen.
+	ISN ISNMode
+	// ECN is the codepoint the packets sent carry, ECT0 or ECT1 to tell
+	// the routers on the way they may mark them CE instead of dropping
+	// them. The marks received count in RAWConn.CEMarks either way.
+	ECN ECN
+	// Rate and PacketRate limit the payload bytes and the packets per second
+	// a fake TCP connection sends, a listener applies them to each peer.
+	// Zero means no limit.
+	Rate       int
+	PacketRate int
+	// ListenerRate and ListenerPacketRate limit what a listener sends to all
+	// of its peers together.
+	ListenerRate       int
+	ListenerPacketRate int
+	// Pacing spaces the packets out evenly at the configured rates instead
+	// of sending them in bursts.
+	Pacing bool
+	// BestEffortWrite has Write and WriteTo hand the datagram over and
+	// return at once, and drop it while the previous one is still waiting
+	// for the rate limits or being sent, as a full socket buffer would.
+	// The errors of the sends are lost.
+	BestEffortWrite bool
+	// SendQueue, in place of BestEffortWrite, has Write and WriteTo queue
+	// up to that many datagrams for a goroutine to send, a queue for each
+	// peer of a listener, so that they do not wait for the rate limits or
+	// for a slow send. SendOverflow decides what a full queue does, see
+	// RAWConn.SendStats.
+	SendQueue    int
+	SendOverflow OverflowPolicy
+	// Coalesce packs small datagrams into shared segments, sent after
+	// CoalesceDelay (1ms if zero) or on Flush. Both sides must set it.
+	Coalesce      bool
+	CoalesceDelay time.Duration
+	// Shape, if set, gives each connection, and each peer of a listener, a
+	// model that the sizes and the timing of its segments follow instead of
+	// the datagrams written: these are split, packed together and padded as
+	// needed. It replaces Coalesce. Both sides must set it, see
+	// BrowsingTraffic and StreamingTraffic.
+	Shape func() TrafficModel
+	// Padding is the most random bytes added to each segment of data, up
+	// to 255, so that the segments do not give the sizes of the datagrams
+	// away. The amount is agreed on in the HTTP or TLS handshake, the
+	// smaller of the two sides wins, so both must set it. ZeroRTT turns it
+	// off.
+	Padding int
+	// ReflectAddr has a listener tell each dialer the address and port it
+	// sees it at, in its reply to the HTTP or TLS handshake, so a dialer
+	// behind a NAT learns its mapping without a STUN server. See
+	// RAWConn.PublicAddr.
+	ReflectAddr bool
+	// CaptureBuffer is the size in bytes of the buffer received packets wait
+	// in until they are read: the pcap ring buffer, the BPF buffer on BSD or
+	// the socket receive buffer on Linux. Zero keeps the system default.
+	CaptureBuffer int
+	// DropWatch is how often a connection or a listener looks at its
+	// CaptureStats for packets the capture buffer dropped, to report them
+	// in an EventCaptureDrop. Zero does not look.
+	DropWatch time.Duration
+	// MaxCaptureBuffer, if set, has DropWatch also double the capture
+	// buffer on every drop, from CaptureBuffer or 2MB, up to that many
+	// bytes. Linux resizes the socket, pcap reopens the handle of a dialed
+	// connection or of a listener on a single interface. A listener on
+	// several interfaces and BSD keep their buffer.
+	MaxCaptureBuffer int
+	// QueueLen bounds the packets waiting between the capture and the
+	// reader where there is a queue: datagrams unpacked from coalesced
+	// segments, and the packets of a BSD listener on several interfaces.
+	// What does not fit is dropped, see CaptureStats. Zero keeps them
+	// unbounded, the capture then waits for the reader.
+	QueueLen int
+	// SnapLen, Promisc, Immediate and InboundOnly set up the packet capture
+	// where the system uses one. SnapLen is the number of bytes kept from
+	// each packet, if zero 100 more than the MTU of the interface, which
+	// may be that of jumbo frames. Immediate delivers every packet as soon
+	// as it arrives instead of once the buffer fills, BSD always does. pcap
+	// skips the packets the host sends where the system lets it, with
+	// InboundOnly opening the capture fails where it does not. SnapLen and
+	// InboundOnly only apply to pcap.
+	SnapLen     int
+	Promisc     bool
+	Immediate   bool
+	InboundOnly bool
+	// Filter is a pcap filter expression the capture filter is and-ed with,
+	// e.g. "not src net 192.0.2.0/24". It needs the pcap backend, dialing
+	// and listening fail with the others.
+	Filter string
+	// TightFilter has the pcap capture of a listener only let SYNs and the
+	// packets of known peers through, as long as there are at most 64
+	// peers. The other packets are then no longer answered with a FIN.
+	TightFilter bool
+	// Interface is the name of the network interface to use, as listed by
+	// net.Interfaces. By default it is the one holding the local address.
+	// Dialed connections then get their local address from it.
+	Interface string
+	// LocalPort is the local port of dialed connections instead of one
+	// the system picks: a port, or a list or range of them as ListenRAW
+	// takes, e.g. "40000-40999,50000". A port is drawn at random from a
+	// list at every attempt of DialRAW, failovers and reconnects included,
+	// so that a connection does not reuse the tuple of one the path reset.
+	LocalPort string
+	// PacketIO, if set, carries the packets of the next connection dialed
+	// or listener opened instead of the sockets of the system, so that no
+	// root and no iptables rule is needed. See NewPacketPipe.
+	PacketIO PacketIO
+	// OnEvent, if set, is called with the events of the connections and
+	// listeners, such as a peer resetting its connection. It must not
+	// block.
+	OnEvent func(Event)
+	// ZeroRTT has a dialer with the HTTP or TLS handshake return as soon as
+	// the request is sent instead of waiting for the reply, so the first
+	// datagram goes out one round trip earlier. Only the dialer sets it.
+	ZeroRTT bool
+	// RTTInterval is how often a dialed connection probes the round trip
+	// time, see RAWConn.RTT. Zero disables the probes. Listeners always
+	// answer them.
+	RTTInterval time.Duration
+	// WindowUpdate is how often connections, and listeners to each of
+	// their peers, send a pure ACK announcing their window, as
+	// middleboxes tracking the window may wait for. A peer that advertised
+	// a zero window then gets zero window probes at that interval instead,
+	// and the datagrams written to it are dropped until it opens. Zero
+	// disables both. Probes of the window are always answered.
+	WindowUpdate time.Duration
+	// Window is the receive window connections and listeners announce, in
+	// bytes, scaled as the window scale of their SYN says once the peer
+	// announced one too. Zero keeps the window of the backend, 12580 bytes
+	// for dialers. Up to 65535 bytes go in the SYN.
+	Window int
+	// Chatter is about how often a dialed connection in the HTTP mode
+	// sends a small made up HTTP request, which the listener answers with
+	// a made up response. Both are dropped on arrival, they keep a quiet
+	// tunnel looking like a browsing session. Zero disables it. Listeners
+	// always answer.
+	Chatter time.Duration
+	// FailoverTimeout is how long a connection dialed with several
+	// addresses goes without receiving anything before it moves to the
+	// next address, 5s if zero.
+	FailoverTimeout time.Duration
+	// SegmentID has a connection that can migrate carry its session id,
+	// with a MAC under Key, in every segment, so the listener follows it
+	// to the address of its next new data when a NAT changes its address
+	// mid-flow. Both sides must set it. It does not work with
+	// TightFilter.
+	SegmentID bool
+	// HopInterval has a connection that can migrate move to a new source
+	// port about that often, to keep flows short. Zero disables hopping.
+	HopInterval time.Duration
+	// HopPorts has the hops of HopInterval also move to a port of the
+	// peer, drawn from a list or range of them as ListenRAW takes, e.g.
+	// "4000-4010". The listener must take them all. Empty keeps the port
+	// dialed.
+	HopPorts string
+	// WatchNetwork has a dialed connection follow changes of the local
+	// address and interfaces, such as a new DHCP lease or an interface
+	// going down and up, by dialing the peer again. Listeners do not.
+	WatchNetwork bool
+	// ICMPErrors has connections and listeners read the ICMP errors about
+	// their flows: fragmentation needed lowers the MSS, the others are
+	// reported as an EventPathError and fail the next read or write of a
+	// dialed connection. It needs an ICMP socket, and no PacketIO.
+	ICMPErrors bool
+	// FallbackMSS is the MSS taken for a peer that announces none, or one
+	// too small to be real, 1460 if zero. It is bounded by the MTU of the
+	// interface like an announced one. RFC 9293 has 536 for a peer that may
+	// be far. See HandshakeInfo.MSSAssumed.
+	FallbackMSS int
+	// AdvertisedMSS is the MSS the SYN and the SYN-ACK announce, in place
+	// of the one the MTU of the interface takes: a listener takes that of
+	// the interface each SYN came in on. Set it on links whose path MTU is
+	// smaller than the MTU of the interface.
+	AdvertisedMSS int
+	// VerifyChecksums has connections and listeners drop the packets whose
+	// IPv4 or TCP checksum is wrong instead of taking corrupted data for
+	// datagrams, see CaptureStats. Packets over loopback, and those of
+	// hosts that leave checksums to the NIC, may not carry valid ones.
+	VerifyChecksums bool
+	// Checksums is how the TCP checksums of the packets sent are filled in,
+	// ChecksumFull by default. Some drivers with TX checksum offload want
+	// them left to the NIC rather than computed.
+	Checksums ChecksumMode
+	// Retry is how a dialer retries its SYN, nil for 6 tries waiting
+	// 500ms to 1s each.
+	Retry *RetryPolicy
+	// Reconnect is when a ReconnectingRAWConn takes its connection for
+	// dead and how it waits between dials, nil for the defaults.
+	Reconnect *ReconnectPolicy
+	// OnReconnect, if set, is called with the addresses of the new
+	// connection every time a ReconnectingRAWConn dialed again.
+	OnReconnect func(local, remote net.Addr)
+	// ParallelDial is how many handshakes DialRAW runs at once with the
+	// servers it is given, host names counting for all their IPv4
+	// addresses. The first to complete is kept and the others closed.
+	// Zero tries the servers one after the other. It is ignored with
+	// PacketIO.
+	ParallelDial int
+	// DialUDP, if set, replaces net.Dial for the UDP socket a dialer opens
+	// to learn its local address and port, and for the one sent to find
+	// the gateway. local is the address to bind to, nil for any. The
+	// addresses of the returned conn must be *net.UDPAddr.
+	DialUDP func(address string, local *net.UDPAddr) (net.Conn, error)
+	// MaxHalfOpen caps the peers a listener holds in the handshake, and
+	// MaxConns all its peers, half-open ones included. The SYNs of new
+	// peers beyond them are refused. Zero means no limit.
+	MaxHalfOpen int
+	MaxConns    int
+	// RefuseWithRST answers the SYNs refused by MaxHalfOpen and MaxConns
+	// with a RST instead of ignoring them.
+	RefuseWithRST bool
+	// AcceptSYN, if set, is asked what a listener does with the SYN of
+	// each new peer before it holds anything for the peer or counts it in
+	// MaxHalfOpen and MaxConns: go on, ignore it or answer it with a RST.
+	// It runs on the goroutine reading the packets and must be quick.
+	AcceptSYN func(SYNInfo) SYNVerdict
+	// EvictLRU has a listener at MaxHalfOpen or MaxConns drop its least
+	// recently active peer to make room for a new one instead of refusing
+	// it.
+	EvictLRU bool
+	// IdleTimeout has a listener drop the peers it heard nothing from for
+	// that long, and ConnTTL those older than it, however busy. Zero
+	// disables them.
+	IdleTimeout time.Duration
+	ConnTTL     time.Duration
+	// EvictFunc, if set, is asked every second whether a listener drops
+	// the peer at addr, given the time since its SYN and since its last
+	// segment.
+	EvictFunc func(addr net.Addr, age, idle time.Duration) bool
+	// OnEvict, if set, is called with every peer a listener drops and
+	// why. The peer is sent a FIN.
+	OnEvict func(addr net.Addr, reason EvictReason)
+	// Shards splits the peers of a listened address between that many
+	// listeners, in one process or several, by a hash of the peer address.
+	// Each is opened with its own Shard, from 0 to Shards-1, and only
+	// reads the packets of its peers. Zero or one does not shard. Peers
+	// moving with SegmentID or Migrate may land on another shard. On the
+	// BSDs other than macOS shard 0 must be open for the others to work.
+	Shards int
+	Shard  int
+	// Workers has a listener handle the handshakes and segments of its
+	// peers on that many goroutines while one more captures the packets,
+	// so that a busy listener can use several cores. The packets of a
+	// peer are still handled in order. Zero or one keeps a single reader.
+	Workers int
+	// BusyPoll has a read on Linux keep polling the socket for that long
+	// before it sleeps until a packet comes, burning a core to cut the
+	// wake-up latency of a lone packet. With pcap it turns Immediate on,
+	// the reads there cannot spin. Zero always sleeps.
+	BusyPoll time.Duration
+	// Queues has a dialed connection on Linux capture with up to that many
+	// AF_PACKET sockets, one for each receive queue of its interface,
+	// which a PACKET_FANOUT group of the FANOUT_QM kind hands the packets
+	// of their own queue. Each is read on a goroutine of its own, and the
+	// connection sends with as many raw sockets, segment after segment,
+	// so that a fast flow is not held up by a single socket. Packets of
+	// different queues may be read out of order. Without AF_PACKET, or
+	// for a PacketIO, the connection reads from its raw socket as usual.
+	// pcap captures with a single handle, and the BSDs with a single
+	// BPF device, and ignore it.
+	Queues int
+	// FlowSteering has a listener on Linux add ethtool ntuple rules that
+	// deliver its segments on the receive queue SteerQueue of the NIC,
+	// and its socket filter drop what arrives on the other queues before
+	// looking at the headers. A NIC without ntuple support, or lo, leaves
+	// the filter to do it alone. The rules are deleted on Close: those of
+	// a process that dies without closing the listener stay on the NIC
+	// until `ethtool -N <dev> delete <id>` removes them.
+	FlowSteering bool
+	SteerQueue   int
+	// XDP has a listener on Linux attach an XDP program to the interface
+	// of its address, which hands the TCP segments to its ports over to
+	// AF_XDP sockets, one per receive queue, before the stack sees them.
+	// The rest of the traffic goes on as before, and the listener still
+	// sends with its raw socket. It takes CAP_NET_ADMIN and CAP_BPF and a
+	// kernel of 5.3 or later, and a listener on a given address. Without
+	// them, or if the interface has an XDP program already, the listener
+	// reads from the raw socket. Elsewhere it is ignored.
+	XDP bool
+	// PacketOut and PacketIn, if set, see every packet sent and received
+	// and return the bytes that go on, or nil to drop the packet. On Linux
+	// they get the TCP segment, the IPv4 header being the kernel's or that
+	// of PacketIO, elsewhere the whole link-layer frame. Checksums are not
+	// fixed after PacketOut. The bytes are only valid during the call, and
+	// PacketIn runs before a packet is checked to belong to the connection.
+	PacketOut func(b []byte) []byte
+	PacketIn  func(b []byte) []byte
+	// HostWeights weighs the names of Hosts, or of HostSource, when a
+	// dialer draws the one for its HTTP Host header or its TLS SNI. It is
+	// ignored unless it has a weight for each name.
+	HostWeights []int
+	// HostInterval keeps the name drawn for that long, every connection
+	// dialed in the meantime uses it, instead of drawing one per
+	// connection.
+	HostInterval time.Duration
+	// HostSource, if set, is called for the names to draw from whenever a
+	// dialer needs one, so they can change at runtime. Hosts and Host are
+	// used when it returns none.
+	HostSource func() []string
+	// Fingerprint, if set, has a TLS dialer send the ClientHello of a
+	// browser, such as utils.Chrome120, instead of the one of simple-obfs.
+	// A hello without a session ticket extension, like that of Safari,
+	// cannot offer Padding.
+	Fingerprint *utils.ClientHelloSpec
+	// Response, if set, is the website a listener in the HTTP mode poses
+	// as: its handshake replies carry the status line and headers, and
+	// the HTTP requests that are not handshakes, as from a prober, are
+	// answered with the whole response. Mixed listeners take those for
+	// data and do not answer them.
+	Response *HTTPResponse
+	// Passthrough is the address of a real web server, such as
+	// "127.0.0.1:8080", that a listener hands the peers over to whose
+	// first request is not a tunnel handshake, or with Key set is one
+	// without a valid session token: the server then answers them for as
+	// long as they stay connected. It takes precedence over Response.
+	// Mixed listeners ignore it, and dialers with Key must not be Dummy.
+	Passthrough string
+	// DNS has the connection pose as DNS over TCP instead of HTTP or TLS:
+	// the handshake is a query and its answer, and every segment of data
+	// a message of its own. Both sides must set it and leave NoHTTP and
+	// TLS unset, the listener is best put on port 53. It has no Padding.
+	DNS bool
+	// SSH has the connection pose as an SSH session, as DNS does as DNS:
+	// the handshake is a swap of version banners, and every segment of
+	// data a binary packet of its own. Both sides must set it and leave
+	// NoHTTP, TLS and DNS unset, the listener is best put on port 22.
+	SSH bool
+	// Rand is where connections draw their random numbers from instead of
+	// the system: initial sequence numbers, IP IDs, the contents of the
+	// handshakes, padding and the jitter of timers. A *rand.Rand of
+	// math/rand with a fixed seed makes tests and simulations replay the
+	// same ones, the built-in traffic models and the host names of
+	// HostInterval included. Leave it nil in production, where they come
+	// from crypto/rand and must not be predictable.
+	Rand utils.Rand
+}
+
+// DialRAW opens a fake TCP connection to address. address may be a comma
+// separated list of servers to fail over between, the connection goes to
+// the first one that answers.
+func (r *Raw) DialRAW(address string) (conn *RAWConn, err error) {
+	if _, err = r.hopPorts(); err != nil {
+		return
+	}
+	addrs := strings.Split(address, ",")
+	sid := r.newSessionID()
+	var i int
+	if r.ParallelDial > 0 && r.PacketIO == nil {
+		addrs = resolveAll(addrs)
+		conn, i, err = dialParallel(addrs, r.ParallelDial, func(addr string) (*RAWConn, error) {
+			return r.dial(addr, sid, nil)
+		})
+	} else {
+		for i = range addrs {
+			if conn, err = r.dial(addrs[i], sid, nil); err == nil {
+				break
+			}
+		}
+	}
+	if err != nil {
+		return
+	}
+	conn.start()
+	if len(addrs) > 1 {
+		go conn.failover(addrs, i)
+	}
+	return
+}
+
+// clientHello writes the TLS record of the ClientHello of a dialer into b
+// and returns its length.
+func (r *Raw) clientHello(b []byte, host string, sessionID, ticket []byte) int {
+	if r.Fingerprint != nil {
+		return r.random().GenClientHello(b, r.Fingerprint, host, sessionID, ticket)
+	}
+	return r.random().GenTLSClientHello(b, host, sessionID, ticket)
+}
+
+// random returns where r draws its random numbers from.
+func (r *Raw) random() utils.Random {
+	return utils.Random{Src: r.Rand}
+}
+
+// hostDraw is the number a Raw drew for interval, the HostInterval it
+// picks the same host name in.
+type hostDraw struct {
+	interval int64
+	draw     int64
+}
+
+var (
+	hostDrawsLock sync.Mutex
+	hostDraws     = map[weak.Pointer[Raw]]hostDraw{}
+)
+
+// intervalDraw returns the number r draws its host names with during the
+// current HostInterval, taken from r.Rand on the first call in it.
+func (r *Raw) intervalDraw() int64 {
+	n := time.Now().UnixNano() / int64(r.HostInterval)
+	key := weak.Make(r)
+	hostDrawsLock.Lock()
+	defer hostDrawsLock.Unlock()
+	d, ok := hostDraws[key]
+	if !ok {
+		runtime.AddCleanup(r, func(key weak.Pointer[Raw]) {
+			hostDrawsLock.Lock()
+			delete(hostDraws, key)
+			hostDrawsLock.Unlock()
+		}, key)
+	}
+	if !ok || d.interval != n {
+		d = hostDraw{interval: n, draw: r.random().Int63()}
+		hostDraws[key] = d
+	}
+	return d.draw
+}
+
+// pickHost returns the host name a dialer puts in its request, drawn from
+// HostSource, Hosts or else from the comma separated list in Host.
+func (r *Raw) pickHost() string {
+	var hosts []string
+	if r.HostSource != nil {
+		hosts = r.HostSource()
+	}
+	if len(hosts) == 0 {
+		hosts = r.Hosts
+	}
+	if len(hosts) == 0 && len(r.Host) != 0 {
+		hosts = strings.Split(r.Host, ",")
+	}
+	if len(hosts) == 0 {
+		return ""
+	}
+	draw := r.random().Int63
+	if r.HostInterval > 0 {
+		// the same draw for the whole interval
+		n := r.intervalDraw()
+		draw = func() int64 { return n }
+	}
+	if len(r.HostWeights) != len(hosts) {
+		return hosts[draw()%int64(len(hosts))]
+	}
+	var total int64
+	for _, w := range r.HostWeights {
+		total += int64(max(w, 0))
+	}
+	if total == 0 {
+		return hosts[draw()%int64(len(hosts))]
+	}
+	x := draw() % total
+	for i, w := range r.HostWeights {
+		if x -= int64(max(w, 0)); x < 0 {
+			return hosts[i]
+		}
+	}
+	return hosts[len(hosts)-1]
+}
+
+// start runs what a dialed connection needs once its handshake is done.
+func (conn *RAWConn) start() {
+	if conn.r.Shape != nil {
+		conn.startShaping()
+	} else if conn.r.Coalesce {
+		conn.startCoalescing()
+	}
+	if conn.r.RTTInterval > 0 {
+		go conn.probeRTT(conn.r.RTTInterval)
+	}
+	if conn.r.WindowUpdate > 0 {
+		go conn.updateWindow(conn.r.WindowUpdate)
+	}
+	if conn.r.Chatter > 0 && !conn.r.NoHTTP && !conn.r.TLS && conn.r.profile() == profileNone && !conn.r.Udp2raw {
+		go conn.chatter(conn.r.Chatter)
+	}
+	if conn.r.HopInterval > 0 && conn.sid != nil {
+		go conn.hop()
+	}
+	if conn.r.WatchNetwork {
+		go conn.watchNetwork()
+	}
+	conn.watchICMP()
+	conn.r.startDropWatch(conn.die, conn.RemoteAddr(), conn)
+}
+
+// DialPacket dials address using the transport selected by r.
+func (r *Raw) DialPacket(address string) (net.PacketConn, error) {
+	if r.ICMP {
+		conn, err := r.DialICMP(address)
+		if err != nil {
+			return nil, err
+		}
+		return conn, nil
+	}
+	if r.FakeUDP {
+		conn, err := r.DialFakeUDP(address)
+		if err != nil {
+			return nil, err
+		}
+		return conn, nil
+	}
+	conn, err := r.DialRAW(address)
+	if err != nil {
+		return nil, err
+	}
+	return conn, nil
+}
+
+// ListenPacket listens on address using the transport selected by r.
+func (r *Raw) ListenPacket(address string) (net.PacketConn, error) {
+	if r.ICMP {
+		listener, err := r.ListenICMP(address)
+		if err != nil {
+			return nil, err
+		}
+		return listener, nil
+	}
+	if r.FakeUDP {
+		listener, err := r.ListenFakeUDP(address)
+		if err != nil {
+			return nil, err
+		}
+		return listener, nil
+	}
+	listener, err := r.ListenRAW(address)
+	if err != nil {
+		return nil, err
+	}
+	return listener, nil
 }
 
 type callback func()
 
+// myMutex guards the maps of a listener. The lookups of the peers take the
+// read lock and run side by side, what changes a map takes the write lock.
+// A peer of a listener still sends under a lock of its own, so writers to
+// the same peer take turns while those to different peers do not. The data
+// segments of a dialed connection on Linux go out without lock, see
+// publishLayer.
 type myMutex struct {
-	sync.Mutex
+	sync.RWMutex
 }
 
 func (m *myMutex) run(f callback) {
@@ -32,6 +591,14 @@ func (m *myMutex) run(f callback) {
 	f()
 }
 
+// read runs f with the read lock, for the lookups that leave the maps as
+// they are, so that they do not wait for one another.
+func (m *myMutex) read(f callback) {
+	m.RLock()
+	defer m.RUnlock()
+	f()
+}
+
 // copy from stackoverflow
 
 const letterBytes = "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ"
@@ -42,12 +609,12 @@ const (
 	letterIdxMax  = 63 / letterIdxBits   // # of letter indices fitting in 63 bits
 )
 
-func randStringBytesMaskImprSrc(n int) string {
+func randStringBytesMaskImprSrc(rnd utils.Random, n int) string {
 	b := make([]byte, n)
 	// A src.Int63() generates 63 random bits, enough for letterIdxMax characters!
-	for i, cache, remain := n-1, rand.Int63(), letterIdxMax; i >= 0; {
+	for i, cache, remain := n-1, rnd.Int63(), letterIdxMax; i >= 0; {
 		if remain == 0 {
-			cache, remain = rand.Int63(), letterIdxMax
+			cache, remain = rnd.Int63(), letterIdxMax
 		}
 		if idx := int(cache & letterIdxMask); idx < len(letterBytes) {
 			b[i] = letterBytes[idx]
@@ -95,16 +662,23 @@ func init() {
 	responseFromat = responseBuffer.String()
 }
 
-func buildHTTPRequest(headers string) string {
-	return fmt.Sprintf(requestFormat, randStringBytesMaskImprSrc(10), headers, (rand.Int63()%65536 + 10485760))
+func buildHTTPRequest(rnd utils.Random, headers string) string {
+	return fmt.Sprintf(requestFormat, randStringBytesMaskImprSrc(rnd, 10), headers, (rnd.Int63()%65536 + 10485760))
 	// return fmt.Sprintf(requestFormat, randStringBytesMaskImprSrc(10), headers, 0)
 }
 
-func buildHTTPResponse(headers string) string {
-	return fmt.Sprintf(responseFromat, headers, (rand.Int63()%65536 + 104857600))
+func buildHTTPResponse(rnd utils.Random, headers string) string {
+	return fmt.Sprintf(responseFromat, headers, (rnd.Int63()%65536 + 104857600))
 	// return fmt.Sprintf(responseFromat, headers, 0)
 }
 
+// isHTTPMessage tells whether b is a whole HTTP message head starting with
+// start, such as "POST" for the request of a dialer or "HTTP" for the
+// response of a listener.
+func isHTTPMessage(b []byte, start string) bool {
+	return len(b) >= len(start)+4 && bytes.HasPrefix(b, []byte(start)) && bytes.HasSuffix(b, []byte("\r\n\r\n"))
+}
+
 func fatalErr(err error) {
 	if err != nil {
 		log.Fatal(err)
@@ -127,6 +701,49 @@ func (t *timeoutErr) Timeout() bool {
 	return true
 }
 
+// MessageTooLongError is returned by writes whose payload does not fit in a
+// single segment to the peer.
+type MessageTooLongError struct {
+	Size  int
+	Limit int
+}
+
+func (e *MessageTooLongError) Error() string {
+	return fmt.Sprintf("message too long: %d bytes, the limit is %d", e.Size, e.Limit)
+}
+
+// the MSS of defaultMTU, also taken for the peers announcing none without
+// Raw.FallbackMSS
+const defaultMSS = 1460
+
+// payloadLimit returns the largest payload a segment to a peer announcing
+// mss can carry next to the given framing overhead, record being that of
+// recordLen. Padding takes what room is left, only its count is always
+// there.
+func payloadLimit(mss int, record int, u2r *udp2rawState, pad int) int {
+	if mss <= 0 {
+		mss = defaultMSS
+	}
+	mss = min(mss, linkMSS(maxMTU))
+	mss -= record
+	if u2r != nil {
+		mss -= udp2rawSaferHeaderLen + udp2rawConvLen
+	}
+	if pad > 0 {
+		mss--
+	}
+	return mss
+}
+
+// recordLen returns the most bytes each segment of data spends on the
+// records of the TLS camouflage or of profile p.
+func recordLen(tls bool, p profile) int {
+	if tls {
+		return 5
+	}
+	return p.recordLen()
+}
+
 const (
 	synreceived = 0
 	waithttpreq = 1
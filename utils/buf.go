@@ -39,6 +39,9 @@ func getIndex(n int) int {
 	return ret
 }
 
+// GetBuf returns a buffer of n bytes, with whatever they held before, from
+// the pools. Whoever gets it owns it: it either gives it back with PutBuf
+// once nothing refers to it any more or leaves it to the garbage collector.
 func GetBuf(n int) []byte {
 	if n > 0 && n <= 65536 {
 		return bufPools[getIndex(n)].Get().([]byte)[:n]
@@ -46,6 +49,7 @@ func GetBuf(n int) []byte {
 	return make([]byte, n)
 }
 
+// PutBuf gives back a buffer of GetBuf, b must not be used afterwards.
 func PutBuf(b []byte) {
 	if len(b) > 65536 || len(b) == 0 {
 		return
@@ -54,6 +58,7 @@ func PutBuf(b []byte) {
 	bufPools[index].Put(b[:(1 << uint(index+6))])
 }
 
+// CopyBuffer returns a copy of b in a buffer of GetBuf.
 func CopyBuffer(b []byte) []byte {
 	b2 := GetBuf(len(b))
 	copy(b2, b)
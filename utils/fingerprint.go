@@ -0,0 +1,286 @@
+package utils
+
+import "encoding/binary"
+
+// ClientHelloSpec describes the ClientHello of a browser as far as the
+// fingerprints of TLS clients, such as JA3 and JA4, see it. GREASE in a list
+// stands for a random GREASE value (RFC 8701), each GREASE of a hello
+// getting its own.
+type ClientHelloSpec struct {
+	CipherSuites []uint16
+	// Extensions are the extension types in the order they are sent
+	Extensions          []uint16
+	SupportedGroups     []uint16
+	PointFormats        []uint8
+	SignatureAlgorithms []uint16
+	// DelegatedCredentials are the signature algorithms of the
+	// delegated_credentials extension
+	DelegatedCredentials []uint16
+	SupportedVersions    []uint16
+	ALPN                 []string
+	// KeyShares are the groups a key share is sent for
+	KeyShares       []uint16
+	CertCompression []uint16
+	// ShuffleExtensions shuffles the extensions between the first and the
+	// last GREASE, like Chrome does since version 110
+	ShuffleExtensions bool
+}
+
+// GREASE is the placeholder of a random GREASE value in a ClientHelloSpec.
+const GREASE uint16 = 0x0a0a
+
+// extension types ClientHelloMsg has no use for
+const (
+	extensionPadding              uint16 = 21
+	extensionCompressCertificate  uint16 = 27
+	extensionRecordSizeLimit      uint16 = 28
+	extensionDelegatedCredentials uint16 = 34
+	extensionSupportedVersions    uint16 = 43
+	extensionPSKKeyExchangeModes  uint16 = 45
+	extensionKeyShare             uint16 = 51
+	extensionApplicationSettings  uint16 = 17513
+	extensionEncryptedClientHello uint16 = 0xfe0d
+)
+
+// Chrome120 is the ClientHello of Chrome 120.
+var Chrome120 = &ClientHelloSpec{
+	CipherSuites: []uint16{GREASE, 0x1301, 0x1302, 0x1303, 0xc02b, 0xc02f, 0xc02c, 0xc030,
+		0xcca9, 0xcca8, 0xc013, 0xc014, 0x009c, 0x009d, 0x002f, 0x0035},
+	Extensions: []uint16{GREASE, 0, 23, 0xff01, 10, 11, 35, 16, 5, 13, 18, 51, 45, 43, 27,
+		17513, 0xfe0d, GREASE, 21},
+	SupportedGroups:     []uint16{GREASE, 29, 23, 24},
+	PointFormats:        []uint8{0},
+	SignatureAlgorithms: []uint16{0x0403, 0x0804, 0x0401, 0x0503, 0x0805, 0x0501, 0x0806, 0x0601},
+	SupportedVersions:   []uint16{GREASE, 0x0304, 0x0303},
+	ALPN:                []string{"h2", "http/1.1"},
+	KeyShares:           []uint16{GREASE, 29},
+	CertCompression:     []uint16{2},
+	ShuffleExtensions:   true,
+}
+
+// Firefox121 is the ClientHello of Firefox 121.
+var Firefox121 = &ClientHelloSpec{
+	CipherSuites: []uint16{0x1301, 0x1303, 0x1302, 0xc02b, 0xc02f, 0xcca9, 0xcca8, 0xc02c,
+		0xc030, 0xc00a, 0xc009, 0xc013, 0xc014, 0x009c, 0x009d, 0x002f, 0x0035},
+	Extensions:           []uint16{0, 23, 0xff01, 10, 11, 35, 16, 5, 34, 51, 43, 13, 45, 28, 0xfe0d, 21},
+	SupportedGroups:      []uint16{29, 23, 24, 25, 256, 257},
+	PointFormats:         []uint8{0},
+	SignatureAlgorithms:  []uint16{0x0403, 0x0503, 0x0603, 0x0804, 0x0805, 0x0806, 0x0401, 0x0501, 0x0601, 0x0203, 0x0201},
+	DelegatedCredentials: []uint16{0x0403, 0x0503, 0x0603, 0x0203},
+	SupportedVersions:    []uint16{0x0304, 0x0303},
+	ALPN:                 []string{"h2", "http/1.1"},
+	KeyShares:            []uint16{29, 23},
+}
+
+// Safari17 is the ClientHello of Safari 17. Like Safari it sends no session
+// ticket extension.
+var Safari17 = &ClientHelloSpec{
+	CipherSuites: []uint16{GREASE, 0x1301, 0x1302, 0x1303, 0xc02c, 0xc02b, 0xcca9, 0xc030,
+		0xc02f, 0xcca8, 0xc00a, 0xc009, 0xc014, 0xc013, 0x009d, 0x009c, 0x0035, 0x002f,
+		0xc008, 0xc012, 0x000a},
+	Extensions:      []uint16{GREASE, 0, 23, 0xff01, 10, 11, 16, 5, 13, 18, 51, 45, 43, 27, GREASE, 21},
+	SupportedGroups: []uint16{GREASE, 29, 23, 24, 25},
+	PointFormats:    []uint8{0},
+	// Safari does list rsa_pss_rsae_sha384 twice
+	SignatureAlgorithms: []uint16{0x0403, 0x0804, 0x0401, 0x0503, 0x0203, 0x0805, 0x0805, 0x0501, 0x0806, 0x0601, 0x0201},
+	SupportedVersions:   []uint16{GREASE, 0x0304, 0x0303, 0x0302, 0x0301},
+	ALPN:                []string{"h2", "http/1.1"},
+	KeyShares:           []uint16{GREASE, 29},
+	CertCompression:     []uint16{1},
+}
+
+// greaser hands out the GREASE values of a hello, a different one each
+// time as far as there are.
+type greaser struct {
+	used uint16
+	rnd  Random
+}
+
+func (g *greaser) next() uint16 {
+	for {
+		i := uint16(g.rnd.Intn(16))
+		if g.used == 0xffff || g.used&(1<<i) == 0 {
+			g.used |= 1 << i
+			return i<<12 | 0x0a00 | i<<4 | 0x0a
+		}
+	}
+}
+
+func putUint16s(b []byte, vs []uint16, g *greaser) []byte {
+	for _, v := range vs {
+		if v == GREASE {
+			v = g.next()
+		}
+		b = binary.BigEndian.AppendUint16(b, v)
+	}
+	return b
+}
+
+// appendLen16 appends the data f appends, after its length in 16 bits.
+func appendLen16(b []byte, f func(b []byte) []byte) []byte {
+	i := len(b)
+	b = f(append(b, 0, 0))
+	binary.BigEndian.PutUint16(b[i:], uint16(len(b)-i-2))
+	return b
+}
+
+func appendLen8(b []byte, f func(b []byte) []byte) []byte {
+	i := len(b)
+	b = f(append(b, 0))
+	b[i] = byte(len(b) - i - 1)
+	return b
+}
+
+func (g *greaser) randomBytes(b []byte, n int) []byte {
+	i := len(b)
+	b = append(b, make([]byte, n)...)
+	g.rnd.Read(b[i:])
+	return b
+}
+
+// extension appends the data of the extension typ of spec.
+func (spec *ClientHelloSpec) extension(b []byte, typ uint16, last bool, serverName string, ticket []byte, g *greaser) []byte {
+	switch typ {
+	case extensionServerName:
+		return appendLen16(b, func(b []byte) []byte {
+			b = append(b, 0)
+			return appendLen16(b, func(b []byte) []byte { return append(b, serverName...) })
+		})
+	case extensionSupportedCurves:
+		return appendLen16(b, func(b []byte) []byte { return putUint16s(b, spec.SupportedGroups, g) })
+	case extensionSupportedPoints:
+		return appendLen8(b, func(b []byte) []byte { return append(b, spec.PointFormats...) })
+	case extensionSessionTicket:
+		return append(b, ticket...)
+	case extensionALPN:
+		return appendLen16(b, func(b []byte) []byte {
+			for _, p := range spec.ALPN {
+				b = appendLen8(b, func(b []byte) []byte { return append(b, p...) })
+			}
+			return b
+		})
+	case extensionStatusRequest:
+		return append(b, 1, 0, 0, 0, 0)
+	case extensionSignatureAlgorithms:
+		return appendLen16(b, func(b []byte) []byte { return putUint16s(b, spec.SignatureAlgorithms, g) })
+	case extensionDelegatedCredentials:
+		return appendLen16(b, func(b []byte) []byte { return putUint16s(b, spec.DelegatedCredentials, g) })
+	case extensionKeyShare:
+		return appendLen16(b, func(b []byte) []byte {
+			for _, group := range spec.KeyShares {
+				switch {
+				case group == GREASE:
+					b = binary.BigEndian.AppendUint16(b, g.next())
+					b = append(b, 0, 1, 0)
+				case group == uint16(X25519):
+					b = binary.BigEndian.AppendUint16(b, group)
+					b = append(b, 0, 32)
+					b = g.randomBytes(b, 32)
+				default:
+					// an uncompressed point of P-256
+					b = binary.BigEndian.AppendUint16(b, group)
+					b = append(b, 0, 65, 4)
+					b = g.randomBytes(b, 64)
+				}
+			}
+			return b
+		})
+	case extensionPSKKeyExchangeModes:
+		return append(b, 1, 1)
+	case extensionSupportedVersions:
+		return appendLen8(b, func(b []byte) []byte { return putUint16s(b, spec.SupportedVersions, g) })
+	case extensionCompressCertificate:
+		return appendLen8(b, func(b []byte) []byte { return putUint16s(b, spec.CertCompression, g) })
+	case extensionRecordSizeLimit:
+		return append(b, 0x40, 0x01)
+	case extensionApplicationSettings:
+		return appendLen16(b, func(b []byte) []byte {
+			return appendLen8(b, func(b []byte) []byte { return append(b, "h2"...) })
+		})
+	case extensionEncryptedClientHello:
+		// a GREASE ECH: outer hello, HKDF-SHA256, AES-128-GCM, a random
+		// config id, an X25519 key and a payload of a random length
+		b = append(b, 0, 0, 1, 0, 1, byte(g.rnd.Intn(256)), 0, 32)
+		b = g.randomBytes(b, 32)
+		return appendLen16(b, func(b []byte) []byte { return g.randomBytes(b, 144+32*g.rnd.Intn(4)) })
+	case extensionRenegotiationInfo:
+		return append(b, 0)
+	case GREASE:
+		if last {
+			return append(b, 0)
+		}
+		return b
+	}
+	return b
+}
+
+// GenClientHello writes a TLS record with the ClientHello of spec into b
+// and returns its length. b must hold 2048 bytes.
+func GenClientHello(b []byte, spec *ClientHelloSpec, serverName string, sessionID []byte, sessionTicket []byte) int {
+	return Random{}.GenClientHello(b, spec, serverName, sessionID, sessionTicket)
+}
+
+// GenClientHello is GenClientHello drawing from rnd.
+func (rnd Random) GenClientHello(b []byte, spec *ClientHelloSpec, serverName string, sessionID []byte, sessionTicket []byte) int {
+	g := greaser{rnd: rnd}
+	exts := append([]uint16(nil), spec.Extensions...)
+	if spec.ShuffleExtensions {
+		i, j := 0, len(exts)
+		for i < j && exts[i] == GREASE {
+			i++
+		}
+		for j > i && (exts[j-1] == GREASE || exts[j-1] == extensionPadding) {
+			j--
+		}
+		rnd.Shuffle(j-i, func(x, y int) { exts[i+x], exts[i+y] = exts[i+y], exts[i+x] })
+	}
+
+	hello := make([]byte, 0, 2048)
+	hello = append(hello, typeClientHello, 0, 0, 0)
+	hello = append(hello, 3, 3)
+	hello = g.randomBytes(hello, 32)
+	hello = appendLen8(hello, func(b []byte) []byte { return append(b, sessionID...) })
+	hello = appendLen16(hello, func(b []byte) []byte { return putUint16s(b, spec.CipherSuites, &g) })
+	hello = append(hello, 1, 0)
+	padding := false
+	hello = appendLen16(hello, func(b []byte) []byte {
+		for i, typ := range exts {
+			if typ == extensionPadding {
+				padding = true
+				continue
+			}
+			if typ == extensionServerName && serverName == "" {
+				continue
+			}
+			t := typ
+			if typ == GREASE {
+				t = g.next()
+			}
+			b = binary.BigEndian.AppendUint16(b, t)
+			b = appendLen16(b, func(b []byte) []byte {
+				return spec.extension(b, typ, i == len(exts)-1, serverName, sessionTicket, &g)
+			})
+		}
+		// BoringSSL pads hellos of 256 to 511 bytes, which some
+		// middleboxes choke on, up to 512
+		if l := len(b); padding && l > 0xff && l < 0x200 {
+			n := 0x200 - l
+			if n >= 5 {
+				n -= 4
+			} else {
+				n = 1
+			}
+			b = binary.BigEndian.AppendUint16(b, extensionPadding)
+			b = binary.BigEndian.AppendUint16(b, uint16(n))
+			b = append(b, make([]byte, n)...)
+		}
+		return b
+	})
+	l := len(hello) - 4
+	hello[1], hello[2], hello[3] = byte(l>>16), byte(l>>8), byte(l)
+
+	b[0] = 0x16
+	binary.BigEndian.PutUint16(b[1:], VersionTLS10)
+	binary.BigEndian.PutUint16(b[3:], uint16(len(hello)))
+	return 5 + copy(b[5:], hello)
+}
@@ -0,0 +1,88 @@
+package utils
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"sync"
+)
+
+// Rand is a source of random numbers, such as a *rand.Rand of math/rand
+// with a fixed seed.
+type Rand interface {
+	Int63() int64
+	Read(b []byte) (n int, err error)
+}
+
+// srcLock guards every Src, as those of math/rand are not safe for
+// concurrent use.
+var srcLock sync.Mutex
+
+// Random draws random numbers from Src, or from crypto/rand if it is nil,
+// so that nothing an observer sees, like sequence numbers or IDs, can be
+// predicted without one.
+type Random struct {
+	Src Rand
+}
+
+func (rnd Random) Int63() int64 {
+	if rnd.Src == nil {
+		var b [8]byte
+		rand.Read(b[:])
+		return int64(binary.BigEndian.Uint64(b[:]) &^ (1 << 63))
+	}
+	srcLock.Lock()
+	defer srcLock.Unlock()
+	return rnd.Src.Int63()
+}
+
+// Int63n returns a number in [0, n), n must be positive.
+func (rnd Random) Int63n(n int64) int64 {
+	if rnd.Src == nil {
+		// the numbers past the last multiple of n would favor the small
+		// ones
+		limit := int64(1<<63 - 1 - (1<<63)%uint64(n))
+		v := rnd.Int63()
+		for v > limit {
+			v = rnd.Int63()
+		}
+		return v % n
+	}
+	return rnd.Int63() % n
+}
+
+// Intn returns a number in [0, n), n must be positive.
+func (rnd Random) Intn(n int) int {
+	return int(rnd.Int63n(int64(n)))
+}
+
+func (rnd Random) Uint32() uint32 {
+	return uint32(rnd.Int63() >> 31)
+}
+
+// Read fills b with random bytes.
+func (rnd Random) Read(b []byte) {
+	if rnd.Src == nil {
+		rand.Read(b)
+		return
+	}
+	srcLock.Lock()
+	defer srcLock.Unlock()
+	rnd.Src.Read(b)
+}
+
+// Bytes returns n random bytes.
+func (rnd Random) Bytes(n int) []byte {
+	if n <= 0 {
+		return nil
+	}
+	b := make([]byte, n)
+	rnd.Read(b)
+	return b
+}
+
+// Shuffle shuffles n elements with swap, like rand.Shuffle.
+func (rnd Random) Shuffle(n int, swap func(i, j int)) {
+	for i := n - 1; i > 0; i-- {
+		swap(i, rnd.Intn(i+1))
+	}
+}
@@ -986,6 +986,11 @@ func ParseTLSServerHelloMsg(b []byte) (ok bool, n int, msg *ServerHelloMsg) {
 // GenTLSServerHello generate tls server hello for simple-obfs
 // note: the function don't check the length of buffer
 func GenTLSServerHello(b []byte, l int, sessionID []byte) int {
+	return Random{}.GenTLSServerHello(b, l, sessionID)
+}
+
+// GenTLSServerHello is GenTLSServerHello drawing from rnd.
+func (rnd Random) GenTLSServerHello(b []byte, l int, sessionID []byte) int {
 	n := 0
 	msg := new(ServerHelloMsg)
 	msg.CipherSuite = tls.TLS_ECDHE_RSA_WITH_CHACHA20_POLY1305
@@ -998,9 +1003,9 @@ func GenTLSServerHello(b []byte, l int, sessionID []byte) int {
 	if len(sessionID) != 0 {
 		msg.SessionId = sessionID
 	} else {
-		msg.SessionId = GetRandomBytes(32)
+		msg.SessionId = rnd.Bytes(32)
 	}
-	msg.Random = GetRandomBytes(32)
+	msg.Random = rnd.Bytes(32)
 	binary.BigEndian.PutUint32(msg.Random, uint32(time.Now().Unix()))
 
 	b[0] = 0x16
@@ -1026,6 +1031,11 @@ func GenTLSServerHello(b []byte, l int, sessionID []byte) int {
 }
 
 func GenTLSClientHello(b []byte, serverName string, sessionID []byte, sessionTicket []byte) int {
+	return Random{}.GenTLSClientHello(b, serverName, sessionID, sessionTicket)
+}
+
+// GenTLSClientHello is GenTLSClientHello drawing from rnd.
+func (rnd Random) GenTLSClientHello(b []byte, serverName string, sessionID []byte, sessionTicket []byte) int {
 	n := 0
 	msg := new(ClientHelloMsg)
 	msg.Vers = tls.VersionTLS12
@@ -1081,7 +1091,7 @@ func GenTLSClientHello(b []byte, serverName string, sessionID []byte, sessionTic
 		{hashSHA1, signatureRSA},
 		{hashSHA1, signatureECDSA},
 	}
-	msg.Random = GetRandomBytes(32)
+	msg.Random = rnd.Bytes(32)
 	binary.BigEndian.PutUint32(msg.Random, uint32(time.Now().Unix()))
 	b[0] = 0x16
 	binary.BigEndian.PutUint16(b[1:], VersionTLS10)
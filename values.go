@@ -0,0 +1,119 @@
+package rawcon
+
+import (
+	"context"
+	"net"
+	"sync"
+)
+
+// A server attaches its own state to the peers of a listener, such as what
+// they authenticated as, with SetPeerValue, and finds it again by the
+// address ReadFrom returned. The state goes with the peer when it moves,
+// see Raw.SegmentID and RAWConn.Migrate, and is dropped with it.
+
+// peerValues are the values attached to a peer and its context.
+type peerValues struct {
+	lock   sync.Mutex
+	values map[any]any
+	ctx    context.Context
+	cancel context.CancelFunc
+	ended  bool
+}
+
+// end cancels the context of a peer the listener forgot and drops its
+// values.
+func (v *peerValues) end() {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+	v.ended = true
+	v.values = nil
+	if v.cancel != nil {
+		v.cancel()
+	}
+}
+
+// listenerContext is the parent of the contexts of the peers, canceled
+// once the listener is closed.
+type listenerContext struct {
+	once sync.Once
+	ctx  context.Context
+}
+
+func (listener *RAWListener) context() context.Context {
+	listener.ctx.once.Do(func() {
+		ctx, cancel := context.WithCancel(context.Background())
+		listener.ctx.ctx = ctx
+		go func() {
+			<-listener.die
+			cancel()
+		}()
+	})
+	return listener.ctx.ctx
+}
+
+// peerValues returns the values of the established peer at addr, nil if
+// there is none.
+func (listener *RAWListener) peerValues(addr net.Addr) *peerValues {
+	listener.mutex.RLock()
+	defer listener.mutex.RUnlock()
+	if info, ok := listener.connByAddr(addr.String()); ok {
+		return &info.values
+	}
+	return nil
+}
+
+// SetPeerValue attaches value under key to the established peer at addr,
+// in place of the one key had, and tells whether there is such a peer.
+// A nil value removes the key.
+func (listener *RAWListener) SetPeerValue(addr net.Addr, key, value any) bool {
+	v := listener.peerValues(addr)
+	if v == nil {
+		return false
+	}
+	v.lock.Lock()
+	defer v.lock.Unlock()
+	if v.ended {
+		return false
+	}
+	if value == nil {
+		delete(v.values, key)
+		return true
+	}
+	if v.values == nil {
+		v.values = make(map[any]any)
+	}
+	v.values[key] = value
+	return true
+}
+
+// PeerValue returns the value attached under key to the peer at addr, nil
+// if there is none.
+func (listener *RAWListener) PeerValue(addr net.Addr, key any) any {
+	v := listener.peerValues(addr)
+	if v == nil {
+		return nil
+	}
+	v.lock.Lock()
+	defer v.lock.Unlock()
+	return v.values[key]
+}
+
+// PeerContext returns a context of the established peer at addr, which is
+// canceled once the listener forgets the peer, as when it closes or resets
+// the connection or is evicted, or once the listener is closed. It returns
+// nil for an unknown peer.
+func (listener *RAWListener) PeerContext(addr net.Addr) context.Context {
+	v := listener.peerValues(addr)
+	if v == nil {
+		return nil
+	}
+	v.lock.Lock()
+	defer v.lock.Unlock()
+	if v.ctx == nil {
+		v.ctx, v.cancel = context.WithCancel(listener.context())
+		if v.ended {
+			v.cancel()
+		}
+	}
+	return v.ctx
+}
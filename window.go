@@ -0,0 +1,118 @@
+package rawcon
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// Middleboxes that track the state of TCP flows may probe the window of an
+// end, and drop the flow if nothing answers: they send a segment starting
+// one byte before what the end acknowledged, carrying that byte or
+// nothing, as keepalives and zero window probes do. Dialers and listeners
+// answer it with a pure ACK announcing their window, which is fixed. With
+// Raw.WindowUpdate they also announce it at that interval unasked, and
+// hold back the data to a peer that advertised a zero window, probing it
+// instead until it opens.
+
+// isWindowProbe tells whether a segment at seq carrying n bytes probes the
+// window of an end that expects ack next.
+func isWindowProbe(seq, ack uint32, n int) bool {
+	return n <= 1 && seq == ack-1
+}
+
+// windowShut tells whether the data to a peer whose zero window is
+// recorded in zero is held back.
+func (r *Raw) windowShut(zero *atomic.Bool) bool {
+	return r.WindowUpdate > 0 && zero.Load()
+}
+
+// sendWindowWithLayer sends a pure ACK announcing the window, or with probe
+// a zero window probe, which starts one byte before the next segment.
+func (conn *RAWConn) sendWindowWithLayer(layer *pktLayers, probe bool) error {
+	if probe {
+		seq := layer.seq()
+		layer.setSeq(seq - 1)
+		defer layer.setSeq(seq)
+	}
+	return conn.sendAckWithLayer(layer)
+}
+
+// windowProbe records the window a segment from the peer advertises and
+// answers the segment if it probes the window, telling whether it did.
+// plain is whether the segment has ACK alone of SYN, FIN, RST and ACK.
+func (conn *RAWConn) windowProbe(plain bool, seq uint32, n int, window uint16) (bool, error) {
+	conn.zerownd.Store(window == 0)
+	if !plain {
+		return false, nil
+	}
+	conn.lockLayer()
+	defer conn.unlockLayer()
+	if !isWindowProbe(seq, conn.layer.ack(), n) {
+		return false, nil
+	}
+	return true, conn.sendAckWithLayer(conn.layer)
+}
+
+// peerWindowProbe is windowProbe for the peer of info.
+func (listener *RAWListener) peerWindowProbe(info *connInfo, plain bool, seq uint32, n int, window uint16) (bool, error) {
+	info.zerownd.Store(window == 0)
+	if !plain {
+		return false, nil
+	}
+	info.lock.Lock()
+	defer info.lock.Unlock()
+	if !isWindowProbe(seq, info.layer.ack(), n) {
+		return false, nil
+	}
+	return true, listener.sendAckWithLayer(info.layer)
+}
+
+// updateWindow announces the window of a dialed connection every interval.
+func (conn *RAWConn) updateWindow(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-conn.die:
+			return
+		case <-ticker.C:
+		}
+		conn.lockLayer()
+		err := conn.sendWindowWithLayer(conn.layer, conn.zerownd.Load())
+		conn.unlockLayer()
+		if err != nil {
+			return
+		}
+	}
+}
+
+// startWindowUpdates has the listener announce its window to its
+// established peers every Raw.WindowUpdate.
+func (listener *RAWListener) startWindowUpdates() {
+	interval := listener.r.WindowUpdate
+	if interval <= 0 {
+		return
+	}
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-listener.die:
+				return
+			case <-ticker.C:
+			}
+			var peers []*connInfo
+			listener.mutex.read(func() {
+				for _, info := range listener.conns {
+					peers = append(peers, info)
+				}
+			})
+			for _, info := range peers {
+				info.lock.Lock()
+				listener.sendWindowWithLayer(info.layer, info.zerownd.Load())
+				info.lock.Unlock()
+			}
+		}
+	}()
+}
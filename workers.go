@@ -0,0 +1,195 @@
+package rawcon
+
+import (
+	"net"
+	"sync"
+	"time"
+
+	"github.com/biotooff/rawcon/utils"
+)
+
+// With Raw.Workers a listener splits its reads into stages: one goroutine
+// captures and decodes the packets and hands each to the worker of its
+// peer, picked by the same hash as Shards, and the workers run the state
+// machine and queue the datagrams for ReadFrom. The packets of a peer thus
+// keep their order.
+
+const workQueueLen = 256
+
+type workResult struct {
+	// data is from utils.GetBuf, ReadFrom gives it back
+	data []byte
+	addr net.Addr
+	err  error
+}
+
+type listenWork struct {
+	in  []chan listenPacket
+	out chan workResult
+
+	lock     sync.Mutex
+	deadline time.Time
+	// changed is closed when the deadline moves
+	changed chan struct{}
+}
+
+// startWorkers starts the stages of the listener if Raw.Workers asks for
+// more than one worker.
+func (listener *RAWListener) startWorkers() {
+	n := listener.r.Workers
+	if n <= 1 {
+		return
+	}
+	w := &listenWork{
+		in:      make([]chan listenPacket, n),
+		out:     make(chan workResult, workQueueLen),
+		changed: make(chan struct{}),
+	}
+	for i := range w.in {
+		w.in[i] = make(chan listenPacket, workQueueLen)
+		go listener.runWorker(w.in[i], w.out)
+	}
+	listener.work = w
+	go listener.capture(w)
+}
+
+// capture reads the packets of the listener and dispatches them to the
+// workers.
+func (listener *RAWListener) capture(w *listenWork) {
+	for {
+		p := listener.readPacket()
+		if ip, _ := p.peer(); ip == nil {
+			if p.err == nil {
+				continue
+			}
+			// an error of no peer goes straight to ReadFrom
+			select {
+			case w.out <- workResult{err: p.err}:
+			case <-listener.die:
+				return
+			}
+			continue
+		}
+		p.detach()
+		ip, port := p.peer()
+		select {
+		case w.in[shardOf(ip, port, len(w.in))] <- p:
+		case <-listener.die:
+			return
+		}
+	}
+}
+
+func (listener *RAWListener) runWorker(in chan listenPacket, out chan workResult) {
+	buf := make([]byte, 65536)
+	next := func() listenPacket {
+		select {
+		case p := <-in:
+			return p
+		case <-listener.die:
+			return listenPacket{err: net.ErrClosed}
+		}
+	}
+	for {
+		n, addr, err := listener.doRead(buf, next)
+		res := workResult{err: err}
+		if err == nil {
+			res.data = utils.CopyBuffer(buf[:n])
+			res.addr = addr
+		}
+		select {
+		case out <- res:
+		case <-listener.die:
+			utils.PutBuf(res.data)
+			return
+		}
+	}
+}
+
+// readWork is ReadFrom with workers.
+func (listener *RAWListener) readWork(b []byte) (n int, addr net.Addr, err error) {
+	w := listener.work
+	for {
+		w.lock.Lock()
+		deadline, changed := w.deadline, w.changed
+		w.lock.Unlock()
+		var timer *time.Timer
+		var timeout <-chan time.Time
+		if !deadline.IsZero() {
+			d := time.Until(deadline)
+			if d <= 0 {
+				return 0, nil, &timeoutErr{op: "read from " + listener.LocalAddr().String()}
+			}
+			timer = time.NewTimer(d)
+			timeout = timer.C
+		}
+		var res workResult
+		var got bool
+		select {
+		case res = <-w.out:
+			got = true
+		case <-listener.die:
+			err = net.ErrClosed
+		case <-timeout:
+		case <-changed:
+		}
+		if timer != nil {
+			timer.Stop()
+		}
+		if err != nil {
+			return
+		}
+		if got {
+			if res.err != nil {
+				return 0, nil, res.err
+			}
+			n = copy(b, res.data)
+			utils.PutBuf(res.data)
+			return n, res.addr, nil
+		}
+		if n, addr, ok := listener.rqueue.pop(b); ok {
+			return n, addr, nil
+		}
+	}
+}
+
+// readNoWait takes a datagram the workers already queued, or fails with
+// errWouldBlock.
+func (w *listenWork) readNoWait(b []byte) (n int, addr net.Addr, err error) {
+	select {
+	case res := <-w.out:
+		if res.err != nil {
+			return 0, nil, res.err
+		}
+		n = copy(b, res.data)
+		utils.PutBuf(res.data)
+		return n, res.addr, nil
+	default:
+		return 0, nil, errWouldBlock
+	}
+}
+
+func (w *listenWork) setDeadline(t time.Time) {
+	w.lock.Lock()
+	w.deadline = t
+	close(w.changed)
+	w.changed = make(chan struct{})
+	w.lock.Unlock()
+}
+
+// SetReadDeadline sets the deadline of ReadFrom.
+func (listener *RAWListener) SetReadDeadline(t time.Time) error {
+	if w := listener.work; w != nil {
+		w.setDeadline(t)
+		return nil
+	}
+	return listener.RAWConn.SetReadDeadline(t)
+}
+
+// SetDeadline sets the read and write deadlines.
+func (listener *RAWListener) SetDeadline(t time.Time) error {
+	if err := listener.SetReadDeadline(t); err != nil {
+		return err
+	}
+	return listener.RAWConn.SetWriteDeadline(t)
+}
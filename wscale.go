@@ -0,0 +1,75 @@
+package rawcon
+
+// Dialers and listeners announce a window scale in their SYN and SYN-ACK,
+// windowScale. Once both ends announced one, RFC 7323 has
+// the window field of the later segments count units of 1<<scale bytes,
+// and middleboxes that follow the flow read it that way: those segments
+// then carry the window shifted right by the scale, while the SYN and the
+// SYN-ACK, which are never scaled, carry it as it is, up to 65535 bytes.
+// An end that announced no scale gets the window unscaled throughout.
+
+// windowScale is the window scale of the SYNs, dialWindow and listenWindow
+// the windows announced without Raw.Window. They are the same on every
+// backend, the SYNs of a build being told apart from those of another
+// otherwise.
+const (
+	windowScale  = 5
+	dialWindow   = 12580
+	listenWindow = 12580
+)
+
+// maxWindow is the largest window a scale of 14 announces.
+const maxWindow = 65535 << 14
+
+// window returns the receive window announced, in bytes, def without
+// Raw.Window.
+func (r *Raw) window(def int) int {
+	if r.Window <= 0 {
+		return def
+	}
+	return min(r.Window, maxWindow)
+}
+
+// synWindow returns the window field of a SYN or SYN-ACK announcing w bytes.
+func synWindow(w int) uint16 {
+	return uint16(min(w, 65535))
+}
+
+// scaledWindow returns the window field of the segments after the SYNs
+// announcing w bytes with a window scale of shift, or unscaled if shift is
+// negative. It rounds up, a window never drops to zero by scaling.
+func scaledWindow(w, shift int) uint16 {
+	if shift < 0 {
+		return synWindow(w)
+	}
+	return uint16(min((w+1<<shift-1)>>shift, 65535))
+}
+
+// windowShift returns the window scale of the segments after the SYNs of
+// an end whose peer announced wscale, -1 if it announced none.
+func windowShift(wscale int) int {
+	if wscale < 0 {
+		return -1
+	}
+	return windowScale
+}
+
+// scaleWindow has the segments of a dialed connection announce its window
+// scaled once the SYNs are through.
+func (conn *RAWConn) scaleWindow() {
+	shift := windowShift(conn.peer.wscale)
+	conn.layer.setWindow(scaledWindow(conn.r.window(dialWindow), shift))
+}
+
+// scalePeerWindow is scaleWindow for the peer of info, which completed the
+// handshake.
+func (listener *RAWListener) scalePeerWindow(info *connInfo) {
+	shift := windowShift(info.peer.wscale)
+	info.layer.setWindow(scaledWindow(listener.r.window(listenWindow), shift))
+}
+
+// inWindow tells whether seq falls in the receive window of wnd bytes that
+// opens at ack, modulo 2^32.
+func inWindow(seq, ack uint32, wnd int) bool {
+	return seq-ack < uint32(max(wnd, 1))
+}
@@ -0,0 +1,492 @@
+package rawcon
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// With Raw.XDP a listener takes its segments off the NIC before the stack
+// sees them: an XDP program on the interface redirects the TCP segments to
+// the address and ports of the listener into AF_XDP sockets, one for every
+// receive queue, and passes everything else on. The sockets hand the
+// frames over in a shared memory area, the UMEM, the listener giving every
+// frame back once it copied the packet out. Sending stays with the raw
+// socket.
+
+const (
+	xdpFrameSize = 2048
+	xdpFrames    = 4096 // of the UMEM of a socket, all of them on the fill ring
+	xdpRxRing    = 2048
+	xdpPoll      = 100 // milliseconds a pump waits for packets at most
+)
+
+// bpf(2) commands, map and program types, and helpers.
+const (
+	bpfMapCreate     = 0
+	bpfMapUpdateElem = 2
+	bpfProgLoad      = 5
+
+	bpfMapTypeArray  = 2
+	bpfMapTypeXSKMap = 17
+	bpfProgTypeXDP   = 6
+
+	bpfFuncMapLookupElem = 1
+	bpfFuncRedirectMap   = 51
+
+	bpfPseudoMapFD = 1
+	xdpPass        = 2
+)
+
+// netlink attributes of IFLA_XDP.
+const (
+	iflaXDPFD    = 1
+	iflaXDPFlags = 3
+	nlaFNested   = 0x8000
+)
+
+// ebpfInsn is an eBPF instruction, regs holding dst in its low nibble and
+// src in its high one.
+type ebpfInsn struct {
+	op   uint8
+	regs uint8
+	off  int16
+	imm  int32
+}
+
+func ebpfRegs(dst, src uint8) uint8 {
+	return dst | src<<4
+}
+
+// xdpProgram returns the program redirecting the TCP segments to ip and
+// the ports set in the map ports into the socket of their receive queue in
+// xsks. Fragments and IPv4 headers with options go on to the kernel.
+func xdpProgram(ip net.IP, ports, xsks int) []ebpfInsn {
+	const pass = -1 // jumps to the end, patched below
+	prog := []ebpfInsn{
+		{op: 0xbf, regs: ebpfRegs(6, 1)},                   // r6 = ctx
+		{op: 0x61, regs: ebpfRegs(2, 6), off: 0},           // r2 = data
+		{op: 0x61, regs: ebpfRegs(3, 6), off: 4},           // r3 = data_end
+		{op: 0xbf, regs: ebpfRegs(4, 2)},                   // r4 = data
+		{op: 0x07, regs: ebpfRegs(4, 0), imm: 14 + 20 + 4}, // up to the ports
+		{op: 0x2d, regs: ebpfRegs(4, 3), off: pass},        // too short
+		{op: 0x69, regs: ebpfRegs(4, 2), off: 12},          // ethertype
+		{op: 0xdc, regs: ebpfRegs(4, 0), imm: 16},          // to host order
+		{op: 0x55, regs: ebpfRegs(4, 0), off: pass, imm: 0x0800},
+		{op: 0x71, regs: ebpfRegs(4, 2), off: 14}, // version and IHL
+		{op: 0x55, regs: ebpfRegs(4, 0), off: pass, imm: 0x45},
+		{op: 0x71, regs: ebpfRegs(4, 2), off: 23}, // protocol
+		{op: 0x55, regs: ebpfRegs(4, 0), off: pass, imm: 6},
+		{op: 0x69, regs: ebpfRegs(4, 2), off: 20}, // flags and offset
+		{op: 0xdc, regs: ebpfRegs(4, 0), imm: 16},
+		{op: 0x45, regs: ebpfRegs(4, 0), off: pass, imm: 0x3fff}, // a fragment
+		{op: 0x61, regs: ebpfRegs(4, 2), off: 30},                // destination
+		{op: 0xdc, regs: ebpfRegs(4, 0), imm: 32},
+		{op: 0xb4, regs: ebpfRegs(5, 0), imm: int32(binary.BigEndian.Uint32(ip.To4()))},
+		{op: 0x5d, regs: ebpfRegs(4, 5), off: pass},
+		{op: 0x69, regs: ebpfRegs(4, 2), off: 36}, // destination port
+		{op: 0xdc, regs: ebpfRegs(4, 0), imm: 16},
+		{op: 0x63, regs: ebpfRegs(10, 4), off: -4}, // the key on the stack
+		{op: 0x18, regs: ebpfRegs(1, bpfPseudoMapFD), imm: int32(ports)},
+		{},
+		{op: 0xbf, regs: ebpfRegs(2, 10)},
+		{op: 0x07, regs: ebpfRegs(2, 0), imm: -4},
+		{op: 0x85, imm: bpfFuncMapLookupElem},
+		{op: 0x15, regs: ebpfRegs(0, 0), off: pass, imm: 0},
+		{op: 0x61, regs: ebpfRegs(1, 0), off: 0},
+		{op: 0x15, regs: ebpfRegs(1, 0), off: pass, imm: 0}, // not a port of ours
+		{op: 0x61, regs: ebpfRegs(2, 6), off: 16},           // rx_queue_index
+		{op: 0x18, regs: ebpfRegs(1, bpfPseudoMapFD), imm: int32(xsks)},
+		{},
+		{op: 0xb7, regs: ebpfRegs(3, 0), imm: xdpPass}, // without a socket
+		{op: 0x85, imm: bpfFuncRedirectMap},
+		{op: 0x95},
+		{op: 0xb7, regs: ebpfRegs(0, 0), imm: xdpPass},
+		{op: 0x95},
+	}
+	end := len(prog) - 2
+	for i := range prog {
+		if prog[i].off == pass && prog[i].op&0x07 == 0x05 {
+			prog[i].off = int16(end - i - 1)
+		}
+	}
+	return prog
+}
+
+func bpfCall(cmd int, attr unsafe.Pointer, size uintptr) (int, error) {
+	fd, _, errno := unix.Syscall(unix.SYS_BPF, uintptr(cmd), uintptr(attr), size)
+	if errno != 0 {
+		return -1, os.NewSyscallError("bpf", errno)
+	}
+	return int(fd), nil
+}
+
+func bpfMap(typ, key, value, entries uint32) (int, error) {
+	attr := struct {
+		typ, key, value, entries, flags uint32
+	}{typ, key, value, entries, 0}
+	return bpfCall(bpfMapCreate, unsafe.Pointer(&attr), unsafe.Sizeof(attr))
+}
+
+func bpfMapPut(fd int, key, value uint32) error {
+	attr := struct {
+		fd, _      uint32
+		key, value uint64
+		flags      uint64
+	}{fd: uint32(fd), key: uint64(uintptr(unsafe.Pointer(&key))), value: uint64(uintptr(unsafe.Pointer(&value)))}
+	_, err := bpfCall(bpfMapUpdateElem, unsafe.Pointer(&attr), unsafe.Sizeof(attr))
+	return err
+}
+
+func bpfLoadXDP(prog []ebpfInsn) (int, error) {
+	license := []byte("GPL\x00")
+	log := make([]byte, 4096)
+	attr := struct {
+		typ, count     uint32
+		insns, license uint64
+		level, logSize uint32
+		logBuf         uint64
+		kernel, flags  uint32
+	}{
+		typ:     bpfProgTypeXDP,
+		count:   uint32(len(prog)),
+		insns:   uint64(uintptr(unsafe.Pointer(&prog[0]))),
+		license: uint64(uintptr(unsafe.Pointer(&license[0]))),
+		level:   1,
+		logSize: uint32(len(log)),
+		logBuf:  uint64(uintptr(unsafe.Pointer(&log[0]))),
+	}
+	fd, err := bpfCall(bpfProgLoad, unsafe.Pointer(&attr), unsafe.Sizeof(attr))
+	if err != nil {
+		if n := bytes.IndexByte(log, 0); n > 0 {
+			return -1, errors.New(err.Error() + ": " + string(log[:n]))
+		}
+	}
+	return fd, err
+}
+
+// setLinkXDP attaches the program prog to the interface ifindex with flags,
+// or detaches the one there with prog -1.
+func setLinkXDP(ifindex, prog int, flags uint32) error {
+	s, err := unix.Socket(unix.AF_NETLINK, unix.SOCK_RAW|unix.SOCK_CLOEXEC, unix.NETLINK_ROUTE)
+	if err != nil {
+		return os.NewSyscallError("socket", err)
+	}
+	defer unix.Close(s)
+	if err = unix.Bind(s, &unix.SockaddrNetlink{Family: unix.AF_NETLINK}); err != nil {
+		return os.NewSyscallError("bind", err)
+	}
+	attrs := make([]byte, 4+8+8)
+	binary.LittleEndian.PutUint16(attrs, uint16(len(attrs)))
+	binary.LittleEndian.PutUint16(attrs[2:], unix.IFLA_XDP|nlaFNested)
+	binary.LittleEndian.PutUint16(attrs[4:], 8)
+	binary.LittleEndian.PutUint16(attrs[6:], iflaXDPFD)
+	binary.LittleEndian.PutUint32(attrs[8:], uint32(prog))
+	binary.LittleEndian.PutUint16(attrs[12:], 8)
+	binary.LittleEndian.PutUint16(attrs[14:], iflaXDPFlags)
+	binary.LittleEndian.PutUint32(attrs[16:], flags)
+	msg := make([]byte, unix.SizeofNlMsghdr+unix.SizeofIfInfomsg, unix.SizeofNlMsghdr+unix.SizeofIfInfomsg+len(attrs))
+	msg = append(msg, attrs...)
+	hdr := (*unix.NlMsghdr)(unsafe.Pointer(&msg[0]))
+	hdr.Len = uint32(len(msg))
+	hdr.Type = unix.RTM_SETLINK
+	hdr.Flags = unix.NLM_F_REQUEST | unix.NLM_F_ACK
+	hdr.Seq = 1
+	info := (*unix.IfInfomsg)(unsafe.Pointer(&msg[unix.SizeofNlMsghdr]))
+	info.Family = unix.AF_UNSPEC
+	info.Index = int32(ifindex)
+	if err = unix.Sendto(s, msg, 0, &unix.SockaddrNetlink{Family: unix.AF_NETLINK}); err != nil {
+		return os.NewSyscallError("sendto", err)
+	}
+	buf := make([]byte, 4096)
+	n, _, err := unix.Recvfrom(s, buf, 0)
+	if err != nil {
+		return os.NewSyscallError("recvfrom", err)
+	}
+	if n < unix.SizeofNlMsghdr+4 {
+		return errors.New("netlink: short reply")
+	}
+	reply := (*unix.NlMsghdr)(unsafe.Pointer(&buf[0]))
+	if reply.Type == unix.NLMSG_ERROR {
+		if errno := int32(binary.LittleEndian.Uint32(buf[unix.SizeofNlMsghdr:])); errno != 0 {
+			return os.NewSyscallError("netlink", unix.Errno(-errno))
+		}
+	}
+	return nil
+}
+
+// xdpRing is a ring shared with the kernel.
+type xdpRing struct {
+	mem      []byte
+	producer *uint32
+	consumer *uint32
+	desc     unsafe.Pointer
+	mask     uint32
+}
+
+func mapXDPRing(fd int, pgoff int64, off unix.XDPRingOffset, size, entry uint32) (xdpRing, error) {
+	mem, err := unix.Mmap(fd, pgoff, int(off.Desc)+int(size*entry), unix.PROT_READ|unix.PROT_WRITE, unix.MAP_SHARED|unix.MAP_POPULATE)
+	if err != nil {
+		return xdpRing{}, os.NewSyscallError("mmap", err)
+	}
+	return xdpRing{
+		mem:      mem,
+		producer: (*uint32)(unsafe.Pointer(&mem[off.Producer])),
+		consumer: (*uint32)(unsafe.Pointer(&mem[off.Consumer])),
+		desc:     unsafe.Pointer(&mem[off.Desc]),
+		mask:     size - 1,
+	}, nil
+}
+
+// xdpSocket is the AF_XDP socket of a receive queue and its UMEM.
+type xdpSocket struct {
+	fd   int
+	umem []byte
+	fill xdpRing
+	rx   xdpRing
+}
+
+func setsockoptXDP(fd, opt int, val unsafe.Pointer, size uintptr) error {
+	_, _, errno := unix.Syscall6(unix.SYS_SETSOCKOPT, uintptr(fd), unix.SOL_XDP, uintptr(opt), uintptr(val), size, 0)
+	if errno != 0 {
+		return os.NewSyscallError("setsockopt", errno)
+	}
+	return nil
+}
+
+// openXDPSocket opens the socket of queue on the interface ifindex, its
+// fill ring full.
+func openXDPSocket(ifindex, queue int) (s *xdpSocket, err error) {
+	fd, err := unix.Socket(unix.AF_XDP, unix.SOCK_RAW|unix.SOCK_CLOEXEC, 0)
+	if err != nil {
+		return nil, os.NewSyscallError("socket", err)
+	}
+	s = &xdpSocket{fd: fd}
+	defer func() {
+		if err != nil {
+			s.close()
+			s = nil
+		}
+	}()
+	if s.umem, err = unix.Mmap(-1, 0, xdpFrames*xdpFrameSize, unix.PROT_READ|unix.PROT_WRITE, unix.MAP_PRIVATE|unix.MAP_ANONYMOUS|unix.MAP_POPULATE); err != nil {
+		return s, os.NewSyscallError("mmap", err)
+	}
+	reg := unix.XDPUmemReg{
+		Addr: uint64(uintptr(unsafe.Pointer(&s.umem[0]))),
+		Len:  uint64(len(s.umem)),
+		Size: xdpFrameSize,
+	}
+	if err = setsockoptXDP(fd, unix.XDP_UMEM_REG, unsafe.Pointer(&reg), unsafe.Sizeof(reg)); err != nil {
+		return
+	}
+	for _, ring := range []struct{ opt, size int }{
+		{unix.XDP_UMEM_FILL_RING, xdpFrames},
+		{unix.XDP_UMEM_COMPLETION_RING, xdpRxRing},
+		{unix.XDP_RX_RING, xdpRxRing},
+	} {
+		size := uint32(ring.size)
+		if err = setsockoptXDP(fd, ring.opt, unsafe.Pointer(&size), 4); err != nil {
+			return
+		}
+	}
+	var off unix.XDPMmapOffsets
+	size := uint32(unsafe.Sizeof(off))
+	if _, _, errno := unix.Syscall6(unix.SYS_GETSOCKOPT, uintptr(fd), unix.SOL_XDP, unix.XDP_MMAP_OFFSETS, uintptr(unsafe.Pointer(&off)), uintptr(unsafe.Pointer(&size)), 0); errno != 0 {
+		return s, os.NewSyscallError("getsockopt", errno)
+	}
+	if s.fill, err = mapXDPRing(fd, unix.XDP_UMEM_PGOFF_FILL_RING, off.Fr, xdpFrames, 8); err != nil {
+		return
+	}
+	if s.rx, err = mapXDPRing(fd, unix.XDP_PGOFF_RX_RING, off.Rx, xdpRxRing, uint32(unsafe.Sizeof(unix.XDPDesc{}))); err != nil {
+		return
+	}
+	for i := uint32(0); i < xdpFrames; i++ {
+		*(*uint64)(unsafe.Add(s.fill.desc, i*8)) = uint64(i) * xdpFrameSize
+	}
+	atomic.StoreUint32(s.fill.producer, xdpFrames)
+	if err = unix.Bind(fd, &unix.SockaddrXDP{Ifindex: uint32(ifindex), QueueID: uint32(queue)}); err != nil {
+		return s, os.NewSyscallError("bind", err)
+	}
+	return
+}
+
+// receive passes the frames received to out and gives their memory back
+// to the kernel, it reports whether there were any.
+func (s *xdpSocket) receive(out func(frame []byte)) bool {
+	prod := atomic.LoadUint32(s.rx.producer)
+	cons := *s.rx.consumer
+	if cons == prod {
+		return false
+	}
+	fill := *s.fill.producer
+	for ; cons != prod; cons++ {
+		d := (*unix.XDPDesc)(unsafe.Add(s.rx.desc, uintptr(cons&s.rx.mask)*unsafe.Sizeof(unix.XDPDesc{})))
+		if d.Addr+uint64(d.Len) <= uint64(len(s.umem)) {
+			out(s.umem[d.Addr : d.Addr+uint64(d.Len)])
+		}
+		*(*uint64)(unsafe.Add(s.fill.desc, (fill&s.fill.mask)*8)) = d.Addr &^ (xdpFrameSize - 1)
+		fill++
+	}
+	atomic.StoreUint32(s.fill.producer, fill)
+	atomic.StoreUint32(s.rx.consumer, cons)
+	return true
+}
+
+func (s *xdpSocket) close() {
+	unix.Close(s.fd)
+	for _, mem := range [][]byte{s.rx.mem, s.fill.mem, s.umem} {
+		if mem != nil {
+			unix.Munmap(mem)
+		}
+	}
+}
+
+// xdpSource is what a listener reads with Raw.XDP: the packets of its
+// sockets go through a packet pipe, which gives the reads their deadlines.
+type xdpSource struct {
+	PacketIO
+	in      PacketIO
+	ifindex int
+	flags   uint32
+	fds     []int // of the program and its maps
+	socks   []*xdpSocket
+	die     chan struct{}
+	wg      sync.WaitGroup
+	once    sync.Once
+}
+
+// rxQueues returns the number of receive queues of the interface name.
+func rxQueues(name string) int {
+	m, _ := filepath.Glob("/sys/class/net/" + name + "/queues/rx-*")
+	return max(len(m), 1)
+}
+
+// openXDP sets Raw.XDP up for the listener, which must be bound to the
+// address of an interface.
+func (listener *RAWListener) openXDP() (x *xdpSource, err error) {
+	ip := listener.laddr.IP.To4()
+	if ip == nil || ip.Equal(ipv4AddrAny) {
+		return nil, errors.New("XDP needs a listener on the address of an interface")
+	}
+	iface := interfaceOf(ip)
+	if iface == nil {
+		return nil, errors.New("no interface has " + ip.String())
+	}
+	out, in := NewPacketPipe()
+	x = &xdpSource{PacketIO: out, in: in, ifindex: iface.Index, die: make(chan struct{})}
+	defer func() {
+		if err != nil {
+			x.Close()
+			x = nil
+		}
+	}()
+	queues := rxQueues(iface.Name)
+	ports, err := bpfMap(bpfMapTypeArray, 4, 4, 65536)
+	if err != nil {
+		return
+	}
+	x.fds = append(x.fds, ports)
+	for _, p := range listener.lports {
+		for port := p.lo; port <= p.hi; port++ {
+			if err = bpfMapPut(ports, uint32(port), 1); err != nil {
+				return
+			}
+		}
+	}
+	xsks, err := bpfMap(bpfMapTypeXSKMap, 4, 4, uint32(queues))
+	if err != nil {
+		return
+	}
+	x.fds = append(x.fds, xsks)
+	prog, err := bpfLoadXDP(xdpProgram(ip, ports, xsks))
+	if err != nil {
+		return
+	}
+	x.fds = append(x.fds, prog)
+	for q := 0; q < queues; q++ {
+		var s *xdpSocket
+		if s, err = openXDPSocket(iface.Index, q); err != nil {
+			return
+		}
+		x.socks = append(x.socks, s)
+		if err = bpfMapPut(xsks, uint32(q), uint32(s.fd)); err != nil {
+			return
+		}
+	}
+	// the driver's own mode if it has one, the generic one of the stack
+	// otherwise
+	for _, mode := range []uint32{unix.XDP_FLAGS_DRV_MODE, unix.XDP_FLAGS_SKB_MODE} {
+		flags := mode | unix.XDP_FLAGS_UPDATE_IF_NOEXIST
+		if err = setLinkXDP(iface.Index, prog, flags); err == nil {
+			x.flags = flags
+			break
+		}
+	}
+	if err != nil {
+		return
+	}
+	for _, s := range x.socks {
+		x.wg.Add(1)
+		go x.pump(s)
+	}
+	return
+}
+
+// pump passes the IPv4 packets of s on to the pipe.
+func (x *xdpSource) pump(s *xdpSocket) {
+	defer x.wg.Done()
+	fds := []unix.PollFd{{Fd: int32(s.fd), Events: unix.POLLIN}}
+	for {
+		select {
+		case <-x.die:
+			return
+		default:
+		}
+		if s.receive(func(frame []byte) {
+			if len(frame) > 14 {
+				x.in.WritePacketData(frame[14:])
+			}
+		}) {
+			continue
+		}
+		unix.Poll(fds, xdpPoll)
+	}
+}
+
+// pending tells whether a packet the sockets received waits to be read.
+func (x *xdpSource) pending() bool {
+	return packetsPending(x.PacketIO)
+}
+
+// release hands a packet the sockets received back to the pipe.
+func (x *xdpSource) release(b []byte) {
+	releasePacket(x.PacketIO, b)
+}
+
+// Close detaches the program and closes the sockets.
+func (x *xdpSource) Close() error {
+	x.once.Do(func() {
+		if x.flags != 0 {
+			setLinkXDP(x.ifindex, -1, x.flags&^unix.XDP_FLAGS_UPDATE_IF_NOEXIST)
+		}
+		close(x.die)
+		x.wg.Wait()
+		for _, s := range x.socks {
+			s.close()
+		}
+		for _, fd := range x.fds {
+			unix.Close(fd)
+		}
+		x.PacketIO.Close()
+		x.in.Close()
+	})
+	return nil
+}
@@ -0,0 +1,153 @@
+package rawcon
+
+import (
+	"encoding/binary"
+	"errors"
+	"net"
+	"os/exec"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// TestXDPProgram has the kernel verify the program of Raw.XDP.
+func TestXDPProgram(t *testing.T) {
+	ports, err := bpfMap(bpfMapTypeArray, 4, 4, 65536)
+	if errors.Is(err, unix.EPERM) {
+		t.Skip("bpf:", err)
+	} else if err != nil {
+		t.Fatal(err)
+	}
+	defer unix.Close(ports)
+	if err = bpfMapPut(ports, 6000, 1); err != nil {
+		t.Fatal(err)
+	}
+	xsks, err := bpfMap(bpfMapTypeXSKMap, 4, 4, 4)
+	if err != nil {
+		t.Skip("no XSKMAP:", err)
+	}
+	defer unix.Close(xsks)
+	prog, err := bpfLoadXDP(xdpProgram(net.IPv4(192, 0, 2, 1), ports, xsks))
+	if err != nil {
+		t.Fatal(err)
+	}
+	unix.Close(prog)
+}
+
+// xdpVeth makes a veth pair, puts local on rcx0, or on a macvlan of it
+// without a driver mode of XDP if generic, and returns a function sending
+// IPv4 packets to that interface from rcx1.
+func xdpVeth(t *testing.T, local net.IP, generic bool) func(pkt []byte) {
+	if out, err := exec.Command("ip", "link", "add", "rcx0", "type", "veth", "peer", "name", "rcx1").CombinedOutput(); err != nil {
+		t.Skipf("no veth: %v %s", err, out)
+	}
+	t.Cleanup(func() { exec.Command("ip", "link", "del", "rcx0").Run() })
+	name := "rcx0"
+	cmds := [][]string{{"link", "set", "rcx0", "up"}, {"link", "set", "rcx1", "up"}}
+	if generic {
+		name = "rcxm"
+		cmds = append(cmds, []string{"link", "add", "rcxm", "link", "rcx0", "type", "macvlan", "mode", "bridge"}, []string{"link", "set", "rcxm", "up"})
+	}
+	cmds = append(cmds, []string{"addr", "add", local.String() + "/24", "dev", name})
+	for _, args := range cmds {
+		if out, err := exec.Command("ip", args...).CombinedOutput(); err != nil {
+			t.Skipf("ip %v: %v %s", args, err, out)
+		}
+	}
+	dst, err := net.InterfaceByName(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	src, err := net.InterfaceByName("rcx1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	fd, err := unix.Socket(unix.AF_PACKET, unix.SOCK_RAW|unix.SOCK_CLOEXEC, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { unix.Close(fd) })
+	to := &unix.SockaddrLinklayer{Ifindex: src.Index, Halen: 6}
+	copy(to.Addr[:], dst.HardwareAddr)
+	return func(pkt []byte) {
+		frame := make([]byte, 14, 14+len(pkt))
+		copy(frame, dst.HardwareAddr)
+		copy(frame[6:], src.HardwareAddr)
+		binary.BigEndian.PutUint16(frame[12:], unix.ETH_P_IP)
+		if err := unix.Sendto(fd, append(frame, pkt...), 0, to); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// TestXDPReceive sends segments into a veth and reads them back through
+// the AF_XDP sockets of a listener, more of them than its UMEM has frames
+// so that they must go back on the fill ring. On a macvlan, whose driver
+// has no mode of its own, the program falls back on the generic one.
+func TestXDPReceive(t *testing.T) {
+	for _, c := range []struct {
+		name    string
+		generic bool
+		mode    uint32
+	}{
+		{"drv", false, unix.XDP_FLAGS_DRV_MODE},
+		{"skb", true, unix.XDP_FLAGS_SKB_MODE},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			local := &net.UDPAddr{IP: net.IPv4(10, 78, 0, 1).To4(), Port: 6887}
+			remote := &net.UDPAddr{IP: net.IPv4(10, 78, 0, 2).To4(), Port: 6888}
+			send := xdpVeth(t, local.IP, c.generic)
+			ports, _ := parsePorts(strconv.Itoa(local.Port))
+			// the listener leaves out the other ports itself, those the
+			// program redirects show up here first
+			var stray atomic.Int32
+			r := &Raw{XDP: true, PacketIn: func(b []byte) []byte {
+				if int(binary.BigEndian.Uint16(b[2:])) != local.Port {
+					stray.Add(1)
+				}
+				return b
+			}}
+			listener := &RAWListener{RAWConn: RAWConn{r: r, mtu: 1500, lports: ports}, laddr: local}
+			listener.buf = make([]byte, recvBufLen(listener.mtu))
+			x, err := listener.openXDP()
+			if errors.Is(err, unix.EPERM) {
+				t.Skip("xdp:", err)
+			} else if err != nil {
+				t.Fatal(err)
+			}
+			defer x.Close()
+			listener.xdp = x
+			if x.flags&(unix.XDP_FLAGS_DRV_MODE|unix.XDP_FLAGS_SKB_MODE) != c.mode {
+				t.Fatalf("attached with flags %#x, want mode %#x", x.flags, c.mode)
+			}
+			segment := func(port int, seq uint32) []byte {
+				tcp := &tcpLayer{srcPort: remote.Port, dstPort: port, seqn: seq, flags: PSH | ACK, payload: []byte("xdp")}
+				return ipv4Packet(remote.IP, local.IP, 1, 0, 64, tcp.marshal(remote.IP, local.IP))
+			}
+			const batch = 64
+			for seq := uint32(0); seq < 2*xdpFrames; seq += batch {
+				// the stack gets those of other ports
+				send(segment(local.Port+100, seq))
+				for i := uint32(0); i < batch; i++ {
+					send(segment(local.Port, seq+i))
+				}
+				listener.SetReadDeadline(time.Now().Add(time.Second))
+				for i := uint32(0); i < batch; i++ {
+					tcp, addr, err := listener.ReadTCPLayer()
+					if err != nil {
+						t.Fatalf("segment %d: %v", seq+i, err)
+					}
+					if tcp.dstPort != local.Port || tcp.seqn != seq+i || string(tcp.payload) != "xdp" || !addr.IP.Equal(remote.IP) {
+						t.Fatalf("read %+v from %v, want segment %d", tcp, addr, seq+i)
+					}
+				}
+			}
+			if n := stray.Load(); n != 0 {
+				t.Fatalf("%d segments to another port redirected", n)
+			}
+		})
+	}
+}
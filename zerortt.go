@@ -0,0 +1,98 @@
+package rawcon
+
+import (
+	"sync"
+	"time"
+
+	"github.com/biotooff/rawcon/utils"
+)
+
+// With Raw.ZeroRTT a dialed connection does not wait for the HTTP response
+// or the TLS ServerHello: the dial returns as soon as the request is sent,
+// so the first datagram follows it instead of waiting a round trip. The
+// request is sent again, at its own sequence number, until the reply shows
+// up among the segments read.
+
+const (
+	zeroRTTInterval = 250 * time.Millisecond
+	zeroRTTRetries  = 25
+)
+
+type zeroRTT struct {
+	lock   sync.Mutex
+	r      *Raw
+	done   bool
+	tries  int
+	start  time.Time
+	timer  *time.Timer
+	resend func() error
+}
+
+func newZeroRTT(r *Raw, resend func() error) *zeroRTT {
+	z := &zeroRTT{r: r, resend: resend, start: time.Now()}
+	z.lock.Lock()
+	z.timer = time.AfterFunc(zeroRTTInterval, z.retry)
+	z.lock.Unlock()
+	return z
+}
+
+func (z *zeroRTT) retry() {
+	z.lock.Lock()
+	defer z.lock.Unlock()
+	if z.done || z.tries >= zeroRTTRetries {
+		return
+	}
+	z.tries++
+	z.resend()
+	z.timer.Reset(zeroRTTInterval)
+}
+
+// reply tells whether payload is the reply to the request, which then is
+// no longer sent again. Only the first reply counts.
+func (z *zeroRTT) reply(payload []byte) bool {
+	if z == nil || !z.r.isHandshakeReply(payload) {
+		return false
+	}
+	z.lock.Lock()
+	defer z.lock.Unlock()
+	if z.done {
+		return false
+	}
+	z.done = true
+	z.timer.Stop()
+	return true
+}
+
+// sent returns the number of times the request was sent and when first.
+func (z *zeroRTT) sent() (int, time.Time) {
+	z.lock.Lock()
+	defer z.lock.Unlock()
+	return z.tries + 1, z.start
+}
+
+func (z *zeroRTT) stop() {
+	if z == nil {
+		return
+	}
+	z.lock.Lock()
+	z.done = true
+	z.timer.Stop()
+	z.lock.Unlock()
+}
+
+// isHandshakeReply tells whether payload is the HTTP response, the TLS
+// ServerHello or the DNS answer that ends the handshake of a dialer of r.
+func (r *Raw) isHandshakeReply(payload []byte) bool {
+	n := len(payload)
+	if n < 20 {
+		return false
+	}
+	if p := r.profile(); p != profileNone {
+		return p.isReply(payload)
+	}
+	if r.TLS {
+		ok, _, _ := utils.ParseTLSServerHelloMsg(payload)
+		return ok
+	}
+	return string(payload[:4]) == "HTTP" && string(payload[n-4:]) == "\r\n\r\n"
+}